@@ -0,0 +1,144 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+const (
+	// InvalidDecryptionSecretReason represents the fact that the
+	// decryption Secret contains invalid data.
+	InvalidDecryptionSecretReason string = "InvalidDecryptionSecret"
+
+	// DecryptionAccessDeniedReason represents the fact that the
+	// decryption failed because the key management service denied
+	// access to the key.
+	DecryptionAccessDeniedReason string = "DecryptionAccessDenied"
+
+	// DecryptionThrottledReason represents the fact that the
+	// decryption failed because the key management service kept
+	// throttling the requests.
+	DecryptionThrottledReason string = "DecryptionThrottled"
+
+	// DecryptionConnectionFailedReason represents the fact that the
+	// decryption failed because the key management service could
+	// not be reached.
+	DecryptionConnectionFailedReason string = "DecryptionConnectionFailed"
+
+	// DecryptionPolicyViolationReason represents the fact that the
+	// decryption was rejected because the SOPS metadata refers to a
+	// key management service which is not allowed by the controller.
+	DecryptionPolicyViolationReason string = "DecryptionPolicyViolation"
+
+	// DecryptionKeysMissingReason represents the fact that the
+	// decryption keys of one or more SOPS encrypted files are not
+	// available to the controller.
+	DecryptionKeysMissingReason string = "DecryptionKeysMissing"
+
+	// SOPSMACMismatchReason represents the fact that the decryption
+	// failed because the SOPS data integrity check of an encrypted file
+	// failed, which means the file has been tampered with.
+	SOPSMACMismatchReason string = "SOPSMACMismatch"
+
+	// DecryptionKeyServiceUnavailableReason represents the fact that the
+	// decryption failed while a remote SOPS key service could not be
+	// reached.
+	DecryptionKeyServiceUnavailableReason string = "DecryptionKeyServiceUnavailable"
+
+	// DependencyOutputsFailedReason represents the fact that the
+	// outputs of one or more dependencies could not be read.
+	DependencyOutputsFailedReason string = "DependencyOutputsFailed"
+
+	// CircularDependencyReason represents the fact that the
+	// Kustomization depends, directly or through its dependencies,
+	// on itself.
+	CircularDependencyReason string = "CircularDependency"
+
+	// BuildTimeoutReason represents the fact that the build of the
+	// manifests exceeded the build timeout.
+	BuildTimeoutReason string = "BuildTimeout"
+
+	// ApplyTimeoutReason represents the fact that the apply of the
+	// manifests exceeded the apply timeout.
+	ApplyTimeoutReason string = "ApplyTimeout"
+
+	// HealthCheckTimeoutReason represents the fact that the health checks
+	// exceeded the health check timeout.
+	HealthCheckTimeoutReason string = "HealthCheckTimeout"
+
+	// DryRunSucceededReason represents the fact that the dry-run
+	// reconciliation of the Kustomization succeeded, without applying
+	// the changes.
+	DryRunSucceededReason string = "DryRunSucceeded"
+
+	// PinnedRevisionAvailableReason represents the fact that the artifact
+	// of the revision pinned with the revision-pin annotation is available
+	// for the reconciliation.
+	PinnedRevisionAvailableReason string = "PinnedRevisionAvailable"
+
+	// PinnedRevisionUnavailableReason represents the fact that the artifact
+	// of the revision pinned with the revision-pin annotation is neither
+	// advertised by the Source, nor the last applied one.
+	PinnedRevisionUnavailableReason string = "PinnedRevisionUnavailable"
+
+	// RollbackSucceededReason represents the fact that the last applied
+	// revision was re-applied after the health checks of a new revision
+	// failed.
+	RollbackSucceededReason string = "RollbackSucceeded"
+
+	// RollbackFailedReason represents the fact that the re-apply of the
+	// last applied revision failed after the health checks of a new
+	// revision failed.
+	RollbackFailedReason string = "RollbackFailed"
+
+	// StageFailedReason represents the fact that the apply or the health
+	// checks of a stage of the apply failed, which stopped the rollout of
+	// the next stages.
+	StageFailedReason string = "StageFailed"
+
+	// ArtifactIntegrityErrorReason represents the fact that the digest of
+	// the downloaded artifact doesn't match the one advertised by the
+	// Source, e.g. because the tarball has been truncated.
+	ArtifactIntegrityErrorReason string = "ArtifactIntegrityError"
+
+	// PeriodicReconciliationDisabledReason represents the fact that the
+	// Kustomization has an interval of zero, and is only reconciled on
+	// events.
+	PeriodicReconciliationDisabledReason string = "PeriodicReconciliationDisabled"
+
+	// ResumedReason represents the fact that the reconciliation of a
+	// suspended Kustomization has been resumed.
+	ResumedReason string = "Resumed"
+)
+
+const (
+	// RevisionPinnedCondition indicates that the reconciliation of the
+	// Kustomization is pinned to a revision of its Source with the
+	// revision-pin annotation.
+	RevisionPinnedCondition string = "RevisionPinned"
+
+	// RolledBackCondition indicates that a revision of the Source was
+	// rolled back to the last applied revision after its health checks
+	// failed.
+	RolledBackCondition string = "RolledBack"
+
+	// EventDrivenCondition indicates that the periodic reconciliation of
+	// the Kustomization is disabled, and that drift is not corrected until
+	// the next event.
+	EventDrivenCondition string = "EventDriven"
+
+	// SuspendedCondition indicates that the reconciliation of the
+	// Kustomization is suspended, with the suspend reason in its message.
+	SuspendedCondition string = "Suspended"
+)
@@ -34,13 +34,31 @@ const (
 	IfNotPresentValue         = "IfNotPresent"
 	IgnoreValue               = "Ignore"
 
-	DeletionPolicyMirrorPrune = "MirrorPrune"
-	DeletionPolicyDelete      = "Delete"
-	DeletionPolicyOrphan      = "Orphan"
+	DeletionPolicyMirrorPrune        = "MirrorPrune"
+	DeletionPolicyDelete             = "Delete"
+	DeletionPolicyWaitForTermination = "WaitForTermination"
+	DeletionPolicyOrphan             = "Orphan"
+
+	FixedBackoff       = "Fixed"
+	ExponentialBackoff = "Exponential"
+
+	LoadRestrictionsRootOnly = "RootOnly"
+	LoadRestrictionsNone     = "None"
+
+	// DefaultMaxRetryInterval is the cap of the exponential backoff of the
+	// retries when the retry strategy doesn't set one.
+	DefaultMaxRetryInterval = time.Hour
 )
 
+// RevisionPinAnnotation is the annotation used to pin the reconciliation of
+// a Kustomization to a revision of its source, e.g. 'sha1:<commit>' or
+// 'main@sha1:<commit>'. The controller keeps applying the artifact of the
+// pinned revision until the annotation is removed.
+const RevisionPinAnnotation = "kustomize.toolkit.fluxcd.io/revision-pin"
+
 // KustomizationSpec defines the configuration to calculate the desired state
 // from a Source using Kustomize.
+// +kubebuilder:validation:XValidation:rule="!has(self.path) || !has(self.paths)",message="path and paths are mutually exclusive"
 type KustomizationSpec struct {
 	// CommonMetadata specifies the common labels and annotations that are
 	// applied to all resources. Any existing label or annotation will be
@@ -48,11 +66,11 @@ type KustomizationSpec struct {
 	// +optional
 	CommonMetadata *CommonMetadata `json:"commonMetadata,omitempty"`
 
-	// DependsOn may contain a meta.NamespacedObjectReference slice
+	// DependsOn may contain a DependencyReference slice
 	// with references to Kustomization resources that must be ready before this
 	// Kustomization can be reconciled.
 	// +optional
-	DependsOn []meta.NamespacedObjectReference `json:"dependsOn,omitempty"`
+	DependsOn []DependencyReference `json:"dependsOn,omitempty"`
 
 	// Decrypt Kubernetes secrets before applying them on the cluster.
 	// +optional
@@ -60,12 +78,25 @@ type KustomizationSpec struct {
 
 	// The interval at which to reconcile the Kustomization.
 	// This interval is approximate and may be subject to jitter to ensure
-	// efficient use of resources.
+	// efficient use of resources. An interval of '0s' disables the periodic
+	// reconciliation, the Kustomization is then only reconciled on changes
+	// to its spec, on new revisions of its sources and on reconcile requests.
 	// +kubebuilder:validation:Type=string
 	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
 	// +required
 	Interval metav1.Duration `json:"interval"`
 
+	// DriftInterval is the interval at which to correct the drift of the
+	// applied resources, when shorter than the Interval. Between the
+	// reconciliations at the Interval, the controller re-applies the
+	// resources it built for the last applied revision without fetching and
+	// building the source again, as long as the revision and the spec are
+	// unchanged.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
+	// +optional
+	DriftInterval *metav1.Duration `json:"driftInterval,omitempty"`
+
 	// The interval at which to retry a previously failed reconciliation.
 	// When not specified, the controller uses the KustomizationSpec.Interval
 	// value to retry failures.
@@ -74,6 +105,20 @@ type KustomizationSpec struct {
 	// +optional
 	RetryInterval *metav1.Duration `json:"retryInterval,omitempty"`
 
+	// RetryStrategy configures how the retry interval of successive failed
+	// reconciliations evolves. Defaults to retrying at the fixed RetryInterval.
+	// +optional
+	RetryStrategy *RetryStrategy `json:"retryStrategy,omitempty"`
+
+	// ProgressDeadline is the duration after which a Kustomization of which
+	// the reconciliations keep failing with the same reason, for the same
+	// source revision and generation, is marked as stalled. The failure
+	// events are not emitted again while it is stalled.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
+	// +optional
+	ProgressDeadline *metav1.Duration `json:"progressDeadline,omitempty"`
+
 	// The KubeConfig for reconciling the Kustomization on a remote cluster.
 	// When used in combination with KustomizationSpec.ServiceAccountName,
 	// forces the controller to act on behalf of that Service Account at the
@@ -82,14 +127,24 @@ type KustomizationSpec struct {
 	// a controller level fallback for when KustomizationSpec.ServiceAccountName
 	// is empty.
 	// +optional
-	KubeConfig *meta.KubeConfigReference `json:"kubeConfig,omitempty"`
+	KubeConfig *KubeConfigReference `json:"kubeConfig,omitempty"`
 
 	// Path to the directory containing the kustomization.yaml file, or the
 	// set of plain YAMLs a kustomization.yaml should be generated for.
 	// Defaults to 'None', which translates to the root path of the SourceRef.
+	// The variables of the post build substitutions are substituted in the
+	// path, which must not point outside of the source artifact.
 	// +optional
 	Path string `json:"path,omitempty"`
 
+	// Paths to the directories to build in order instead of Path, of which
+	// the resources are applied, pruned and health checked as a single unit.
+	// An object must not be built from more than one path. Mutually exclusive
+	// with Path.
+	// +kubebuilder:validation:MinItems=1
+	// +optional
+	Paths []string `json:"paths,omitempty"`
+
 	// PostBuild describes which actions to perform on the YAML manifest
 	// generated by building the kustomize overlay.
 	// +optional
@@ -99,17 +154,32 @@ type KustomizationSpec struct {
 	// +required
 	Prune bool `json:"prune"`
 
+	// PruneOptions configures the garbage collection, with a disableSelector
+	// to protect some objects from pruning, a deletionPropagation policy, and
+	// wait to block until the deleted objects are gone.
+	// +optional
+	PruneOptions *PruneOptions `json:"pruneOptions,omitempty"`
+
 	// DeletionPolicy can be used to control garbage collection when this
 	// Kustomization is deleted. Valid values are ('MirrorPrune', 'Delete',
-	// 'Orphan'). 'MirrorPrune' mirrors the Prune field (orphan if false,
-	// delete if true). Defaults to 'MirrorPrune'.
-	// +kubebuilder:validation:Enum=MirrorPrune;Delete;Orphan
+	// 'WaitForTermination', 'Orphan'). 'MirrorPrune' mirrors the Prune field
+	// (orphan if false, delete if true). 'WaitForTermination' deletes the
+	// resources and waits for their termination until the Timeout expires.
+	// Defaults to 'MirrorPrune'.
+	// +kubebuilder:validation:Enum=MirrorPrune;Delete;WaitForTermination;Orphan
 	// +optional
 	DeletionPolicy string `json:"deletionPolicy,omitempty"`
 
 	// A list of resources to be included in the health assessment.
+	// The variables of the post build substitutions are substituted in the
+	// namespaces of the resources.
 	// +optional
-	HealthChecks []meta.NamespacedObjectKindReference `json:"healthChecks,omitempty"`
+	HealthChecks []HealthCheck `json:"healthChecks,omitempty"`
+
+	// A list of label selectors of the applied resources to be included in
+	// the health assessment, in addition to the HealthChecks.
+	// +optional
+	HealthCheckSelectors []HealthCheckSelector `json:"healthCheckSelectors,omitempty"`
 
 	// NamePrefix will prefix the names of all managed resources.
 	// +kubebuilder:validation:MinLength=1
@@ -133,6 +203,10 @@ type KustomizationSpec struct {
 	// Images is a list of (image name, new name, new tag or digest)
 	// for changing image names, tags or digests. This can also be achieved with a
 	// patch, but this operator is simpler to specify.
+	// The images take precedence over the images of the same name specified
+	// in the kustomization.yaml file, and must not set both a new tag and a
+	// digest.
+	// +kubebuilder:validation:XValidation:rule="self.all(i, !has(i.newTag) || !has(i.digest))",message="images must not specify both newTag and digest"
 	// +optional
 	Images []kustomize.Image `json:"images,omitempty"`
 
@@ -145,11 +219,33 @@ type KustomizationSpec struct {
 	// +required
 	SourceRef CrossNamespaceSourceReference `json:"sourceRef"`
 
+	// AdditionalSources is a list of sources of which the artifacts are
+	// extracted into the build workspace at their mount paths, next to the
+	// artifact of the SourceRef, e.g. to build overlays with the shared
+	// bases of another repository.
+	// +kubebuilder:validation:MaxItems=10
+	// +optional
+	AdditionalSources []AdditionalSource `json:"additionalSources,omitempty"`
+
 	// This flag tells the controller to suspend subsequent kustomize executions,
 	// it does not apply to already started executions. Defaults to false.
 	// +optional
 	Suspend bool `json:"suspend,omitempty"`
 
+	// SuspendReason records why the Kustomization is suspended. It is
+	// reported in the message of the Suspended condition and in the events
+	// of the suspension.
+	// +optional
+	SuspendReason string `json:"suspendReason,omitempty"`
+
+	// DryRun instructs the controller to build the manifests and to perform
+	// a server-side dry-run apply of the resources, reporting the changes in
+	// the status without applying them. The inventory is not updated, and
+	// the garbage collection and the health checks are skipped.
+	// Defaults to false.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
 	// TargetNamespace sets or overrides the namespace in the
 	// kustomization.yaml file.
 	// +kubebuilder:validation:MinLength=1
@@ -158,6 +254,13 @@ type KustomizationSpec struct {
 	// +optional
 	TargetNamespace string `json:"targetNamespace,omitempty"`
 
+	// TargetNamespaceMetadata specifies the labels and annotations that are
+	// applied to the target namespace, when the Namespace is defined by the
+	// manifests of the Kustomization. They override the common metadata, and
+	// are not applied to namespaces which are not managed by the Kustomization.
+	// +optional
+	TargetNamespaceMetadata *CommonMetadata `json:"targetNamespaceMetadata,omitempty"`
+
 	// Timeout for validation, apply and health checking operations.
 	// Defaults to 'Interval' duration.
 	// +kubebuilder:validation:Type=string
@@ -165,28 +268,109 @@ type KustomizationSpec struct {
 	// +optional
 	Timeout *metav1.Duration `json:"timeout,omitempty"`
 
+	// Timeouts overrides the Timeout for the build, apply and health check
+	// phases of the reconciliation. A phase which exceeds its timeout fails
+	// the reconciliation with a phase-specific reason.
+	// +optional
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+
 	// Force instructs the controller to recreate resources
 	// when patching fails due to an immutable field change.
 	// +kubebuilder:default:=false
 	// +optional
 	Force bool `json:"force,omitempty"`
 
+	// ForceKinds restricts the recreation of the resources with immutable
+	// field changes to the given kinds, when Force is enabled. The resources
+	// of the other kinds fail to apply on immutable field changes, unless
+	// they are annotated with 'kustomize.toolkit.fluxcd.io/force: enabled'.
+	// +optional
+	ForceKinds []ForceKind `json:"forceKinds,omitempty"`
+
+	// ApplyOrder customises the order in which the resources are applied,
+	// and reversely garbage collected, by kind.
+	// +optional
+	ApplyOrder *ApplyOrder `json:"applyOrder,omitempty"`
+
+	// Stages splits the apply of the resources in ordered stages. The
+	// resources matching the selector of a stage are applied and health
+	// checked before the ones of the next stages, and the resources matching
+	// no stage are applied last. A stage failure stops the rollout.
+	// +kubebuilder:validation:MaxItems=10
+	// +optional
+	Stages []ApplyStage `json:"stages,omitempty"`
+
 	// Wait instructs the controller to check the health of all the reconciled
-	// resources. When enabled, the HealthChecks are ignored. Defaults to false.
+	// resources. When enabled, the HealthChecks and HealthCheckSelectors are
+	// ignored. Defaults to false.
 	// +optional
 	Wait bool `json:"wait,omitempty"`
 
+	// WaitIgnore excludes the matching resources from the health assessment
+	// when Wait is enabled, e.g. custom resources which never report a
+	// status the controller can assess.
+	// +optional
+	WaitIgnore []WaitIgnoreSelector `json:"waitIgnore,omitempty"`
+
+	// Rollback configures the automatic rollback to the last applied
+	// revision when the health checks of a new revision fail.
+	// +optional
+	Rollback *Rollback `json:"rollback,omitempty"`
+
 	// Components specifies relative paths to specifications of other Components.
 	// +optional
 	Components []string `json:"components,omitempty"`
 
+	// BuildOptions configures the kustomize build of the Kustomization.
+	// +optional
+	BuildOptions *BuildOptions `json:"buildOptions,omitempty"`
+
 	// HealthCheckExprs is a list of healthcheck expressions for evaluating the
 	// health of custom resources using Common Expression Language (CEL).
-	// The expressions are evaluated only when Wait or HealthChecks are specified.
+	// The expressions are evaluated only when Wait, HealthChecks or
+	// HealthCheckSelectors are specified.
 	// +optional
 	HealthCheckExprs []kustomize.CustomHealthCheck `json:"healthCheckExprs,omitempty"`
 }
 
+// HealthCheck is a reference to a resource included in the health
+// assessment.
+type HealthCheck struct {
+	meta.NamespacedObjectKindReference `json:",inline"`
+
+	// Timeout for the health check of the resource, overriding the health
+	// check timeout of the Kustomization for this resource only.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// HealthCheckSelector selects the applied resources of a kind to be included
+// in the health assessment by their labels.
+type HealthCheckSelector struct {
+	// API version of the resources, only the group is matched.
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// Kind of the resources.
+	// +required
+	Kind string `json:"kind"`
+
+	// Namespace of the resources, defaults to all namespaces.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// LabelSelector to match the labels of the resources.
+	// +required
+	LabelSelector metav1.LabelSelector `json:"labelSelector"`
+
+	// AllowEmpty passes the health assessment when the selector matches
+	// no resources. Defaults to false, failing the health assessment.
+	// +optional
+	AllowEmpty bool `json:"allowEmpty,omitempty"`
+}
+
 // CommonMetadata defines the common labels and annotations.
 type CommonMetadata struct {
 	// Annotations to be added to the object's metadata.
@@ -198,6 +382,171 @@ type CommonMetadata struct {
 	Labels map[string]string `json:"labels,omitempty"`
 }
 
+// Timeouts defines the timeouts of the reconciliation phases.
+type Timeouts struct {
+	// Build is the timeout for building the manifests, including their
+	// decryption and the post build substitutions. When exceeded, the
+	// reconciliation fails with the BuildTimeout reason. When not set, the
+	// build has no deadline.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
+	// +optional
+	Build *metav1.Duration `json:"build,omitempty"`
+
+	// Apply is the timeout for applying the manifests, including the drift
+	// detection and the wait for the CRDs and Namespaces to register. When
+	// exceeded, the reconciliation fails with the ApplyTimeout reason. When
+	// not set, the apply has no deadline, and the wait for the CRDs and
+	// Namespaces is bounded by the Timeout.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
+	// +optional
+	Apply *metav1.Duration `json:"apply,omitempty"`
+
+	// HealthCheck is the timeout for the health checks. When exceeded, the
+	// reconciliation fails with the HealthCheckTimeout reason. Defaults to
+	// the Timeout.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
+	// +optional
+	HealthCheck *metav1.Duration `json:"healthCheck,omitempty"`
+}
+
+// ForceKind selects a kind of the resources which are recreated when
+// patching fails due to an immutable field change.
+type ForceKind struct {
+	// Group is the API group of the kind, empty for the core API group.
+	// +optional
+	Group string `json:"group,omitempty"`
+
+	// Kind of the resources.
+	// +required
+	Kind string `json:"kind"`
+}
+
+// ApplyOrder defines the kinds of the resources which are applied before and
+// after the others. The CRDs, Namespaces and Class kinds are always applied
+// first, and the kinds which are not listed are sorted by the default order.
+// +kubebuilder:validation:XValidation:rule="!has(self.first) || !has(self.last) || !self.first.exists(k, k in self.last)",message="a kind can't be listed in both first and last"
+type ApplyOrder struct {
+	// First is the list of kinds applied before the others, in their order.
+	// +kubebuilder:validation:MaxItems=100
+	// +kubebuilder:validation:items:Pattern="^[A-Z][a-zA-Z0-9]*$"
+	// +kubebuilder:validation:items:MaxLength=63
+	// +optional
+	First []string `json:"first,omitempty"`
+
+	// Last is the list of kinds applied after the others, in their order.
+	// +kubebuilder:validation:MaxItems=100
+	// +kubebuilder:validation:items:Pattern="^[A-Z][a-zA-Z0-9]*$"
+	// +kubebuilder:validation:items:MaxLength=63
+	// +optional
+	Last []string `json:"last,omitempty"`
+}
+
+// AdditionalSource is a source of which the artifact is extracted into the
+// build workspace of a Kustomization.
+type AdditionalSource struct {
+	// Reference of the source.
+	// +required
+	SourceRef CrossNamespaceSourceReference `json:"sourceRef"`
+
+	// MountPath is the path relative to the root of the workspace, where
+	// the artifact of the source is extracted. It must not be the root
+	// of the workspace, nor point outside of it.
+	// +kubebuilder:validation:MinLength=1
+	// +required
+	MountPath string `json:"mountPath"`
+}
+
+// ApplyStage selects the resources which are applied and health checked
+// in a stage of the apply.
+type ApplyStage struct {
+	// Name of the stage, reported when the stage fails.
+	// +kubebuilder:validation:Pattern="^[a-z0-9]([a-z0-9-]*[a-z0-9])?$"
+	// +kubebuilder:validation:MaxLength=63
+	// +required
+	Name string `json:"name"`
+
+	// Selector selects the resources of the stage by their labels. The
+	// resources matching the selectors of several stages belong to the
+	// first of them.
+	// +required
+	Selector metav1.LabelSelector `json:"selector"`
+
+	// Timeout for the health checks of the resources of the stage.
+	// Defaults to the health check timeout.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// Rollback defines the rollback of a Kustomization to its last applied
+// revision.
+type Rollback struct {
+	// Enable re-applies the last successfully applied revision when the
+	// health checks of a new revision fail, and stops retrying the failed
+	// revision until the Source advertises another one, or the Kustomization
+	// spec changes. Defaults to false.
+	// +optional
+	Enable bool `json:"enable,omitempty"`
+}
+
+// RetryStrategy defines the backoff of the retries of failed
+// reconciliations.
+type RetryStrategy struct {
+	// Backoff is the backoff of the retries, 'Fixed' to retry at the
+	// RetryInterval, or 'Exponential' to double the interval for every
+	// successive failure, starting from the RetryInterval up to the
+	// MaxRetryInterval. The backoff resets on a successful reconciliation,
+	// a new source revision or a change to the spec. Defaults to 'Fixed'.
+	// +kubebuilder:validation:Enum=Fixed;Exponential
+	// +kubebuilder:default:=Fixed
+	// +optional
+	Backoff string `json:"backoff,omitempty"`
+
+	// MaxRetryInterval is the cap of the exponential backoff.
+	// Defaults to '1h'.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
+	// +optional
+	MaxRetryInterval *metav1.Duration `json:"maxRetryInterval,omitempty"`
+}
+
+// BuildOptions configures the kustomize build of a Kustomization.
+type BuildOptions struct {
+	// LoadRestrictions restricts the files a kustomization can load, 'RootOnly'
+	// to the files in the directory of the kustomization.yaml and its
+	// subdirectories, or 'None' to the files anywhere in the source artifact.
+	// 'None' is only allowed when the controller runs with the
+	// --allow-load-restrictions-none flag. Defaults to 'RootOnly'.
+	// +kubebuilder:validation:Enum=RootOnly;None
+	// +kubebuilder:default:=RootOnly
+	// +optional
+	LoadRestrictions string `json:"loadRestrictions,omitempty"`
+}
+
+// WaitIgnoreSelector selects the reconciled resources which are excluded
+// from the health assessment when Wait is enabled.
+type WaitIgnoreSelector struct {
+	// Group is the API group of the resources, empty for the core API group.
+	// +optional
+	Group string `json:"group,omitempty"`
+
+	// Kind of the resources.
+	// +required
+	Kind string `json:"kind"`
+
+	// Name of the resources, defaults to all names.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Namespace of the resources, defaults to all namespaces.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
 // Decryption defines how decryption is handled for Kubernetes manifests.
 type Decryption struct {
 	// Provider is the name of the decryption engine.
@@ -206,8 +555,18 @@ type Decryption struct {
 	Provider string `json:"provider"`
 
 	// The secret name containing the private OpenPGP keys used for decryption.
+	// A Secret in another namespace can only be referenced when the controller
+	// allows cross-namespace decryption Secret references.
+	// +optional
+	SecretRef *meta.NamespacedObjectReference `json:"secretRef,omitempty"`
+
+	// Paths is a list of glob patterns relative to the path of the
+	// Kustomization, e.g. 'secrets/**/*.enc.yaml', which restricts the
+	// decryption of the files referenced by kustomize generators and patches
+	// to the matching files. When not specified, all referenced files are
+	// decrypted.
 	// +optional
-	SecretRef *meta.LocalObjectReference `json:"secretRef,omitempty"`
+	Paths []string `json:"paths,omitempty"`
 }
 
 // PostBuild describes which actions to perform on the YAML manifest
@@ -239,12 +598,20 @@ type SubstituteReference struct {
 	Kind string `json:"kind"`
 
 	// Name of the values referent. Should reside in the same namespace as the
-	// referring resource.
+	// referring resource, unless Namespace is set.
 	// +kubebuilder:validation:MinLength=1
 	// +kubebuilder:validation:MaxLength=253
 	// +required
 	Name string `json:"name"`
 
+	// Namespace of the values referent, defaults to the namespace of the
+	// Kustomization. Another namespace must be allowed by the controller
+	// with the --allowed-substitution-namespaces flag.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=63
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
 	// Optional indicates whether the referenced resource must exist, or whether to
 	// tolerate its absence. If true and the referenced resource is absent, proceed
 	// as if the resource was present but empty, without any variables defined.
@@ -253,6 +620,39 @@ type SubstituteReference struct {
 	Optional bool `json:"optional,omitempty"`
 }
 
+// PruneOptions configures the garbage collection and the deletion of the
+// objects on the finalization of the Kustomization.
+type PruneOptions struct {
+	// DisableSelector selects the objects which are not garbage collected,
+	// neither when removed from the source nor when the Kustomization is
+	// deleted, in addition to the ones with pruning disabled by annotation.
+	// +optional
+	DisableSelector *metav1.LabelSelector `json:"disableSelector,omitempty"`
+
+	// DeletionPropagation is the propagation policy of the delete calls
+	// issued by the garbage collection and the finalization, one of
+	// 'Background', 'Foreground' or 'Orphan'. With 'Foreground', the
+	// controller waits for the deleted objects to be gone, up to the
+	// WaitTimeout. Defaults to 'Background'.
+	// +kubebuilder:validation:Enum=Background;Foreground;Orphan
+	// +optional
+	DeletionPropagation metav1.DeletionPropagation `json:"deletionPropagation,omitempty"`
+
+	// Wait makes the garbage collection and the finalization wait for the
+	// deleted objects to be gone, up to the WaitTimeout, and fail with the
+	// objects stuck terminating and their finalizers at the timeout.
+	// Defaults to false.
+	// +optional
+	Wait bool `json:"wait,omitempty"`
+
+	// WaitTimeout is the timeout of the wait for the deleted objects,
+	// defaults to the timeout of the Kustomization.
+	// +kubebuilder:validation:Type=string
+	// +kubebuilder:validation:Pattern="^([0-9]+(\\.[0-9]+)?(ms|s|m|h))+$"
+	// +optional
+	WaitTimeout *metav1.Duration `json:"waitTimeout,omitempty"`
+}
+
 // KustomizationStatus defines the observed state of a kustomization.
 type KustomizationStatus struct {
 	meta.ReconcileRequestStatus `json:",inline"`
@@ -281,10 +681,121 @@ type KustomizationStatus struct {
 	// +optional
 	LastAttemptedRevision string `json:"lastAttemptedRevision,omitempty"`
 
+	// LastAppliedArtifact references the last successfully applied Artifact
+	// from the referenced Source. It is used to keep applying the revision
+	// pinned with the revision-pin annotation after the Source has advanced.
+	// +optional
+	LastAppliedArtifact *AppliedArtifact `json:"lastAppliedArtifact,omitempty"`
+
+	// RolledBackRevision is the revision of which the health checks failed,
+	// and which was rolled back to the last applied revision.
+	// +optional
+	RolledBackRevision string `json:"rolledBackRevision,omitempty"`
+
 	// Inventory contains the list of Kubernetes resource object references that
 	// have been successfully applied.
 	// +optional
 	Inventory *ResourceInventory `json:"inventory,omitempty"`
+
+	// DryRun contains the changes reported by the last dry-run
+	// reconciliation, if DryRun is enabled.
+	// +optional
+	DryRun *DryRunStatus `json:"dryRun,omitempty"`
+
+	// RetryBackoff is the exponential backoff of the retries of the
+	// successive failed reconciliations, if the retry strategy is
+	// exponential and the last reconciliation failed.
+	// +optional
+	RetryBackoff *RetryBackoff `json:"retryBackoff,omitempty"`
+
+	// Failure tracks the continuous failures of the reconciliations with
+	// the same reason, if a progress deadline is set and the last
+	// reconciliation failed.
+	// +optional
+	Failure *FailureStatus `json:"failure,omitempty"`
+}
+
+// FailureStatus reports the continuous failures of the reconciliations of a
+// Kustomization.
+type FailureStatus struct {
+	// Since is the time of the first failure.
+	// +required
+	Since metav1.Time `json:"since"`
+
+	// Reason is the reason of the Ready condition of the failures.
+	// +required
+	Reason string `json:"reason"`
+
+	// Revision is the source revision of the failed reconciliations.
+	// +optional
+	Revision string `json:"revision,omitempty"`
+
+	// ObservedGeneration is the generation of the failed reconciliations.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+// RetryBackoff reports the exponential backoff of the retries of a
+// Kustomization.
+type RetryBackoff struct {
+	// Failures is the number of successive failed reconciliations.
+	// +required
+	Failures int `json:"failures"`
+
+	// RetryInterval is the interval after which the last failed
+	// reconciliation is retried.
+	// +required
+	RetryInterval metav1.Duration `json:"retryInterval"`
+
+	// Revision is the source revision of the failed reconciliations.
+	// +optional
+	Revision string `json:"revision,omitempty"`
+
+	// ObservedGeneration is the generation of the failed reconciliations.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+// AppliedArtifact references an Artifact applied by the Kustomization.
+type AppliedArtifact struct {
+	// Revision is the revision of the Artifact.
+	// +required
+	Revision string `json:"revision"`
+
+	// URL is the HTTP address of the Artifact as exposed by the controller
+	// managing the Source.
+	// +required
+	URL string `json:"url"`
+
+	// Digest is the digest of the Artifact in the form of
+	// '<algorithm>:<checksum>'.
+	// +optional
+	Digest string `json:"digest,omitempty"`
+}
+
+// DryRunStatus summarises the changes of a dry-run reconciliation.
+type DryRunStatus struct {
+	// Revision is the revision of the source of the dry-run.
+	// +required
+	Revision string `json:"revision"`
+
+	// Created is the number of resources which would be created.
+	// +required
+	Created int `json:"created"`
+
+	// Configured is the number of resources which would be configured.
+	// +required
+	Configured int `json:"configured"`
+
+	// Pruned is the number of resources which would be garbage collected.
+	// +required
+	Pruned int `json:"pruned"`
+
+	// Changes lists the resources which would be created, configured and
+	// pruned, in the format 'Kind/namespace/name action', truncated to
+	// the first 100 entries.
+	// +optional
+	Changes []string `json:"changes,omitempty"`
 }
 
 // GetTimeout returns the timeout with default.
@@ -299,6 +810,67 @@ func (in Kustomization) GetTimeout() time.Duration {
 	return duration
 }
 
+// GetBuildTimeout returns the timeout for building the manifests,
+// defaulting to the timeout of the Kustomization.
+func (in Kustomization) GetBuildTimeout() time.Duration {
+	if in.Spec.Timeouts != nil && in.Spec.Timeouts.Build != nil {
+		return in.Spec.Timeouts.Build.Duration
+	}
+	return in.GetTimeout()
+}
+
+// GetApplyTimeout returns the timeout for applying the manifests,
+// defaulting to the timeout of the Kustomization.
+func (in Kustomization) GetApplyTimeout() time.Duration {
+	if in.Spec.Timeouts != nil && in.Spec.Timeouts.Apply != nil {
+		return in.Spec.Timeouts.Apply.Duration
+	}
+	return in.GetTimeout()
+}
+
+// GetHealthCheckTimeout returns the timeout for the health checks,
+// defaulting to the timeout of the Kustomization.
+func (in Kustomization) GetHealthCheckTimeout() time.Duration {
+	if in.Spec.Timeouts != nil && in.Spec.Timeouts.HealthCheck != nil {
+		return in.Spec.Timeouts.HealthCheck.Duration
+	}
+	return in.GetTimeout()
+}
+
+// GetPruneDisableSelector returns the selector of the objects protected from
+// the garbage collection, if any.
+func (in Kustomization) GetPruneDisableSelector() *metav1.LabelSelector {
+	if in.Spec.PruneOptions == nil {
+		return nil
+	}
+	return in.Spec.PruneOptions.DisableSelector
+}
+
+// GetPruneDeletionPropagation returns the deletion propagation policy of the
+// garbage collection, defaulting to background propagation.
+func (in Kustomization) GetPruneDeletionPropagation() metav1.DeletionPropagation {
+	if in.Spec.PruneOptions == nil || in.Spec.PruneOptions.DeletionPropagation == "" {
+		return metav1.DeletePropagationBackground
+	}
+	return in.Spec.PruneOptions.DeletionPropagation
+}
+
+// GetPruneWait returns if the garbage collection waits for the deleted
+// objects to be gone.
+func (in Kustomization) GetPruneWait() bool {
+	return in.Spec.PruneOptions != nil && in.Spec.PruneOptions.Wait
+}
+
+// GetPruneWaitTimeout returns the timeout of the wait for the objects
+// deleted by the garbage collection, defaulting to the timeout of the
+// Kustomization.
+func (in Kustomization) GetPruneWaitTimeout() time.Duration {
+	if in.Spec.PruneOptions != nil && in.Spec.PruneOptions.WaitTimeout != nil {
+		return in.Spec.PruneOptions.WaitTimeout.Duration
+	}
+	return in.GetTimeout()
+}
+
 // GetRetryInterval returns the retry interval
 func (in Kustomization) GetRetryInterval() time.Duration {
 	if in.Spec.RetryInterval != nil {
@@ -307,12 +879,51 @@ func (in Kustomization) GetRetryInterval() time.Duration {
 	return in.GetRequeueAfter()
 }
 
+// IsExponentialBackoff returns if the retry interval of successive failed
+// reconciliations grows exponentially.
+func (in Kustomization) IsExponentialBackoff() bool {
+	return in.Spec.RetryStrategy != nil && in.Spec.RetryStrategy.Backoff == ExponentialBackoff
+}
+
+// GetMaxRetryInterval returns the cap of the exponential backoff of the
+// retries, with default.
+func (in Kustomization) GetMaxRetryInterval() time.Duration {
+	if in.Spec.RetryStrategy != nil && in.Spec.RetryStrategy.MaxRetryInterval != nil {
+		return in.Spec.RetryStrategy.MaxRetryInterval.Duration
+	}
+	return DefaultMaxRetryInterval
+}
+
+// GetLoadRestrictions returns the load restrictions of the kustomize build,
+// with default.
+func (in Kustomization) GetLoadRestrictions() string {
+	if in.Spec.BuildOptions != nil && in.Spec.BuildOptions.LoadRestrictions != "" {
+		return in.Spec.BuildOptions.LoadRestrictions
+	}
+	return LoadRestrictionsRootOnly
+}
+
 // GetRequeueAfter returns the duration after which the Kustomization must be
 // reconciled again.
 func (in Kustomization) GetRequeueAfter() time.Duration {
 	return in.Spec.Interval.Duration
 }
 
+// GetDriftInterval returns the interval at which to correct the drift of the
+// applied resources, or zero if it is not set.
+func (in Kustomization) GetDriftInterval() time.Duration {
+	if in.Spec.DriftInterval != nil {
+		return in.Spec.DriftInterval.Duration
+	}
+	return 0
+}
+
+// IsEventDriven returns if the periodic reconciliation of the Kustomization
+// is disabled with an interval of zero.
+func (in Kustomization) IsEventDriven() bool {
+	return in.Spec.Interval.Duration == 0
+}
+
 // GetDeletionPolicy returns the deletion policy and default value if not specified.
 func (in Kustomization) GetDeletionPolicy() string {
 	if in.Spec.DeletionPolicy == "" {
@@ -323,7 +934,14 @@ func (in Kustomization) GetDeletionPolicy() string {
 
 // GetDependsOn returns the list of dependencies across-namespaces.
 func (in Kustomization) GetDependsOn() []meta.NamespacedObjectReference {
-	return in.Spec.DependsOn
+	deps := make([]meta.NamespacedObjectReference, len(in.Spec.DependsOn))
+	for i := range in.Spec.DependsOn {
+		deps[i] = meta.NamespacedObjectReference{
+			Name:      in.Spec.DependsOn[i].Name,
+			Namespace: in.Spec.DependsOn[i].Namespace,
+		}
+	}
+	return deps
 }
 
 // GetConditions returns the status conditions of the object.
@@ -344,6 +962,8 @@ func (in *Kustomization) SetConditions(conditions []metav1.Condition) {
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description=""
 // +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description=""
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].message",description=""
+// +kubebuilder:printcolumn:name="Suspended",type="boolean",JSONPath=".spec.suspend",description=""
+// +kubebuilder:printcolumn:name="Suspend Reason",type="string",JSONPath=".spec.suspendReason",priority=1,description=""
 
 // Kustomization is the Schema for the kustomizations API.
 type Kustomization struct {
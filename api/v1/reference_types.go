@@ -16,7 +16,12 @@ limitations under the License.
 
 package v1
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
 
 // CrossNamespaceSourceReference contains enough information to let you locate the
 // typed Kubernetes resource object at cluster level.
@@ -40,6 +45,92 @@ type CrossNamespaceSourceReference struct {
 	Namespace string `json:"namespace,omitempty"`
 }
 
+// DependencyReference defines a dependency of a Kustomization on another
+// Kustomization resource.
+type DependencyReference struct {
+	// Name of the referent.
+	// +required
+	Name string `json:"name"`
+
+	// Namespace of the referent, defaults to the namespace of the Kustomization
+	// resource object that contains the reference.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// ReadyExpr is a CEL expression which assesses the readiness of the
+	// dependency, replacing the check of its Ready condition and of its
+	// last applied revision. The expression is evaluated with the variables
+	// 'dep' for the dependency, 'self' for the dependent Kustomization and
+	// 'source' for the source of the dependent Kustomization.
+	// +optional
+	ReadyExpr string `json:"readyExpr,omitempty"`
+
+	// OutputsFrom selects the ConfigMaps and Secrets in the inventory of the
+	// dependency, of which the data keys are exposed as variables to the
+	// post build substitutions of the dependent Kustomization.
+	// +optional
+	OutputsFrom *DependencyOutputs `json:"outputsFrom,omitempty"`
+}
+
+// DependencyOutputs selects the outputs of a dependency.
+type DependencyOutputs struct {
+	// LabelSelector to match the labels of the ConfigMaps and Secrets in the
+	// inventory of the dependency. At least one must match.
+	// +required
+	LabelSelector metav1.LabelSelector `json:"labelSelector"`
+}
+
+// KubeConfigReference contains enough information to build a client for a
+// remote cluster, either from a kubeconfig Secret, or from the address of
+// the cluster, its CA certificate and a Secret with a token.
+// +kubebuilder:validation:XValidation:rule="!has(self.caData) || !has(self.configMapRef)",message="caData and configMapRef are mutually exclusive"
+// +kubebuilder:validation:XValidation:rule="has(self.address) || (!has(self.caData) && !has(self.configMapRef))",message="caData and configMapRef can only be set with address"
+type KubeConfigReference struct {
+	// SecretRef holds the name of a secret that contains a key with
+	// the kubeconfig file as the value. If no key is set, the key will default
+	// to 'value'. When the Address is set, the key holds a bearer token for
+	// the cluster instead, and defaults to 'token'.
+	// It is recommended that the kubeconfig is self-contained, and the secret
+	// is regularly updated if credentials such as a cloud-access-token expire.
+	// Cloud specific `cmd-path` auth helpers will not function without adding
+	// binaries and credentials to the Pod that is responsible for reconciling
+	// Kubernetes resources.
+	// +required
+	SecretRef meta.SecretKeyReference `json:"secretRef"`
+
+	// Address of the API server of the remote cluster, e.g.
+	// 'https://cluster.example.com:6443'. When set, the client is built from
+	// the address, the CA certificate and the token of the SecretRef, instead
+	// of a kubeconfig.
+	// +kubebuilder:validation:Pattern="^https://"
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// CAData is the PEM encoded CA certificate of the API server of the
+	// remote cluster. Defaults to the system certificate pool.
+	// +optional
+	CAData string `json:"caData,omitempty"`
+
+	// ConfigMapRef holds the name of a ConfigMap that contains a key with
+	// the PEM encoded CA certificate of the API server of the remote cluster.
+	// If no key is set, the key will default to 'ca.crt'.
+	// +optional
+	ConfigMapRef *ConfigMapKeyReference `json:"configMapRef,omitempty"`
+}
+
+// ConfigMapKeyReference contains enough information to locate the referenced
+// key of a ConfigMap in the same namespace.
+type ConfigMapKeyReference struct {
+	// Name of the ConfigMap.
+	// +required
+	Name string `json:"name"`
+
+	// Key in the ConfigMap, when not specified an implementation-specific
+	// default key is used.
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
 func (s *CrossNamespaceSourceReference) String() string {
 	if s.Namespace != "" {
 		return fmt.Sprintf("%s/%s/%s", s.Kind, s.Namespace, s.Name)
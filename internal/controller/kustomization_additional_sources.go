@@ -0,0 +1,164 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/fluxcd/pkg/runtime/acl"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// errAdditionalArtifactNotFound is returned when an additional source has
+// no artifact.
+var errAdditionalArtifactNotFound = errors.New("source artifact not found")
+
+// mountedArtifact is the artifact of an additional source, with the path
+// where it's extracted in the build workspace.
+type mountedArtifact struct {
+	mountPath string
+	artifact  *sourcev1.Artifact
+}
+
+// combinedSource is a Source of which the artifact revision combines the
+// revisions of the additional sources of the Kustomization.
+type combinedSource struct {
+	sourcev1.Source
+	artifact *sourcev1.Artifact
+	mounted  []mountedArtifact
+}
+
+// GetArtifact returns the artifact of the Source with the combined revision.
+func (s *combinedSource) GetArtifact() *sourcev1.Artifact {
+	return s.artifact
+}
+
+// combineSources returns the Source with the artifacts of the additional
+// sources of the Kustomization, or the Source as is if it has none. It
+// returns an error if an additional source can't be accessed, or has no
+// artifact.
+func (r *KustomizationReconciler) combineSources(ctx context.Context,
+	obj *kustomizev1.Kustomization,
+	src sourcev1.Source) (sourcev1.Source, error) {
+	if len(obj.Spec.AdditionalSources) == 0 {
+		return src, nil
+	}
+
+	mounted := make([]mountedArtifact, len(obj.Spec.AdditionalSources))
+	for i, as := range obj.Spec.AdditionalSources {
+		additional, err := r.getSourceRef(ctx, obj, as.SourceRef)
+		if acl.IsAccessDenied(err) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("additional source '%s': %w", as.SourceRef.String(), err)
+		}
+		if additional.GetArtifact() == nil {
+			return nil, fmt.Errorf("additional source '%s': %w", as.SourceRef.String(), errAdditionalArtifactNotFound)
+		}
+		mounted[i] = mountedArtifact{mountPath: as.MountPath, artifact: additional.GetArtifact()}
+	}
+
+	artifact := src.GetArtifact().DeepCopy()
+	artifact.Revision = combineRevisions(artifact.Revision, mounted)
+	return &combinedSource{Source: src, artifact: artifact, mounted: mounted}, nil
+}
+
+// fetchAdditionalSources extracts the artifacts of the additional sources of
+// a combined Source at their mount paths in the build workspace.
+func (r *KustomizationReconciler) fetchAdditionalSources(ctx context.Context, src sourcev1.Source, workDir string) error {
+	combined, ok := src.(*combinedSource)
+	if !ok {
+		return nil
+	}
+	for _, m := range combined.mounted {
+		dir, err := mountDir(workDir, m.mountPath)
+		if err != nil {
+			return err
+		}
+		if err := r.fetchArtifact(ctx, m.artifact, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountDir returns the directory of the mount path in the build workspace.
+// It returns an error if the mount path is the root of the workspace, or
+// points outside of it.
+func mountDir(workDir, mountPath string) (string, error) {
+	if escapesRoot(mountPath) {
+		return "", fmt.Errorf("mount path '%s' must not point outside of the workspace", mountPath)
+	}
+	dir, err := securejoin.SecureJoin(workDir, mountPath)
+	if err != nil {
+		return "", err
+	}
+	if filepath.Clean(dir) == filepath.Clean(workDir) {
+		return "", fmt.Errorf("mount path '%s' must not be the root of the workspace", mountPath)
+	}
+	return dir, nil
+}
+
+// sourceArtifact returns the artifact of the SourceRef, without the
+// revisions of the additional sources.
+func sourceArtifact(src sourcev1.Source) *sourcev1.Artifact {
+	if combined, ok := src.(*combinedSource); ok {
+		return combined.Source.GetArtifact()
+	}
+	return src.GetArtifact()
+}
+
+// combineRevisions returns the revision of the SourceRef followed by the
+// revisions of the additional sources prefixed by their mount paths, e.g.
+// 'main@sha1:<commit>, bases=main@sha1:<commit>'.
+func combineRevisions(revision string, mounted []mountedArtifact) string {
+	revisions := make([]string, 0, len(mounted)+1)
+	revisions = append(revisions, revision)
+	for _, m := range mounted {
+		revisions = append(revisions, fmt.Sprintf("%s=%s", m.mountPath, m.artifact.Revision))
+	}
+	return strings.Join(revisions, ", ")
+}
+
+// hasSourceRevision returns if the artifact has the revision, or one of the
+// revisions it combines.
+func hasSourceRevision(artifact *sourcev1.Artifact, revision string) bool {
+	if artifact.HasRevision(revision) {
+		return true
+	}
+	revisions := strings.Split(revision, ", ")
+	if len(revisions) < 2 {
+		return false
+	}
+	if artifact.HasRevision(revisions[0]) {
+		return true
+	}
+	for _, r := range revisions[1:] {
+		if _, rev, ok := strings.Cut(r, "="); ok && artifact.HasRevision(rev) {
+			return true
+		}
+	}
+	return false
+}
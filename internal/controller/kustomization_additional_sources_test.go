@@ -0,0 +1,235 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_AdditionalSources(t *testing.T) {
+	g := NewWithT(t)
+	id := "as-" + randStringRunes(5)
+	overlaysRevision := "main@sha1:" + randStringRunes(40)
+	basesRevision := "main@sha1:" + randStringRunes(40)
+	resultK := &kustomizev1.Kustomization{}
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	basesFiles := func(data string) []testserver.File {
+		return []testserver.File{
+			{
+				Name: "app/kustomization.yaml",
+				Body: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- configmap.yaml
+`,
+			},
+			{
+				Name: "app/configmap.yaml",
+				Body: fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  key: %s
+`, data),
+			},
+		}
+	}
+
+	overlaysArtifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "prod/kustomization.yaml",
+			Body: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+namePrefix: prod-
+resources:
+- ../bases/app
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	basesArtifact, err := testServer.ArtifactFromFiles(basesFiles("v1"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	overlaysName := types.NamespacedName{
+		Name:      fmt.Sprintf("overlays-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+	basesName := types.NamespacedName{
+		Name:      fmt.Sprintf("bases-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(overlaysName, overlaysArtifact, overlaysRevision)
+	g.Expect(err).NotTo(HaveOccurred())
+	err = applyGitRepository(basesName, basesArtifact, basesRevision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("as-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./prod",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      overlaysName.Name,
+				Namespace: overlaysName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			AdditionalSources: []kustomizev1.AdditionalSource{
+				{
+					SourceRef: kustomizev1.CrossNamespaceSourceReference{
+						Name: basesName.Name,
+						Kind: sourcev1.GitRepositoryKind,
+					},
+					MountPath: "bases",
+				},
+			},
+			TargetNamespace: id,
+			Prune:           true,
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultCM := &corev1.ConfigMap{}
+	cmKey := types.NamespacedName{Name: "prod-app", Namespace: id}
+
+	t.Run("builds the overlay with the additional source", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal(
+			fmt.Sprintf("%s, bases=%s", overlaysRevision, basesRevision)))
+		g.Expect(resultK.Status.LastAppliedArtifact.Revision).To(Equal(overlaysRevision))
+
+		g.Expect(k8sClient.Get(context.Background(), cmKey, resultCM)).To(Succeed())
+		g.Expect(resultCM.Data).To(HaveKeyWithValue("key", "v1"))
+	})
+
+	t.Run("reconciles a new revision of the additional source", func(t *testing.T) {
+		g := NewWithT(t)
+		basesArtifact, err := testServer.ArtifactFromFiles(basesFiles("v2"))
+		g.Expect(err).NotTo(HaveOccurred())
+		basesRevision = "main@sha1:" + randStringRunes(40)
+		err = applyGitRepository(basesName, basesArtifact, basesRevision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAppliedRevision == fmt.Sprintf("%s, bases=%s", overlaysRevision, basesRevision)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(k8sClient.Get(context.Background(), cmKey, resultCM)).To(Succeed())
+		g.Expect(resultCM.Data).To(HaveKeyWithValue("key", "v2"))
+	})
+
+	t.Run("fails when an additional source is not found", func(t *testing.T) {
+		g := NewWithT(t)
+		resultK.Spec.AdditionalSources[0].SourceRef.Name = "not-found"
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsFalse(resultK, meta.ReadyCondition) &&
+				conditions.GetReason(resultK, meta.ReadyCondition) == meta.ArtifactFailedReason
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring(
+			fmt.Sprintf("additional source 'GitRepository/%s/not-found'", id)))
+	})
+}
+
+func Test_combineRevisions(t *testing.T) {
+	g := NewWithT(t)
+
+	mounted := []mountedArtifact{
+		{mountPath: "bases", artifact: &sourcev1.Artifact{Revision: "main@sha1:b"}},
+		{mountPath: "charts", artifact: &sourcev1.Artifact{Revision: "latest@sha256:c"}},
+	}
+	revision := combineRevisions("main@sha1:a", mounted)
+	g.Expect(revision).To(Equal("main@sha1:a, bases=main@sha1:b, charts=latest@sha256:c"))
+
+	g.Expect(hasSourceRevision(&sourcev1.Artifact{Revision: "main@sha1:a"}, revision)).To(BeTrue())
+	g.Expect(hasSourceRevision(&sourcev1.Artifact{Revision: "main@sha1:b"}, revision)).To(BeTrue())
+	g.Expect(hasSourceRevision(&sourcev1.Artifact{Revision: "latest@sha256:c"}, revision)).To(BeTrue())
+	g.Expect(hasSourceRevision(&sourcev1.Artifact{Revision: "main@sha1:d"}, revision)).To(BeFalse())
+	g.Expect(hasSourceRevision(&sourcev1.Artifact{Revision: "main@sha1:a"}, "main@sha1:a")).To(BeTrue())
+	g.Expect(hasSourceRevision(&sourcev1.Artifact{Revision: "main@sha1:a"}, "main@sha1:b")).To(BeFalse())
+}
+
+func Test_mountDir(t *testing.T) {
+	workDir := "/tmp/kustomization-123"
+	tests := []struct {
+		mountPath string
+		want      string
+		wantErr   string
+	}{
+		{mountPath: "bases", want: filepath.Join(workDir, "bases")},
+		{mountPath: "./shared/bases/", want: filepath.Join(workDir, "shared/bases")},
+		{mountPath: ".", wantErr: "must not be the root of the workspace"},
+		{mountPath: "bases/..", wantErr: "must not be the root of the workspace"},
+		{mountPath: "../bases", wantErr: "must not point outside of the workspace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mountPath, func(t *testing.T) {
+			g := NewWithT(t)
+			dir, err := mountDir(workDir, tt.mountPath)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(dir).To(Equal(tt.want))
+		})
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+
+	"github.com/fluxcd/cli-utils/pkg/object"
+	"github.com/fluxcd/pkg/ssa"
+	ssautil "github.com/fluxcd/pkg/ssa/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// applyOrderStages splits the objects in the stages of the apply order: a
+// stage for each of the kinds listed first, in their order, a stage for the
+// objects of the other kinds, and a stage for each of the kinds listed last.
+// The empty stages are left out.
+func applyOrderStages(order *kustomizev1.ApplyOrder,
+	objects []*unstructured.Unstructured) [][]*unstructured.Unstructured {
+	if order == nil || (len(order.First) == 0 && len(order.Last) == 0) {
+		if len(objects) == 0 {
+			return nil
+		}
+		return [][]*unstructured.Unstructured{objects}
+	}
+
+	others := len(order.First)
+	stageOf := make(map[string]int, len(order.First)+len(order.Last))
+	for i, kind := range order.First {
+		if _, ok := stageOf[kind]; !ok {
+			stageOf[kind] = i
+		}
+	}
+	for i, kind := range order.Last {
+		if _, ok := stageOf[kind]; !ok {
+			stageOf[kind] = others + 1 + i
+		}
+	}
+
+	stages := make([][]*unstructured.Unstructured, others+1+len(order.Last))
+	for _, u := range objects {
+		i, ok := stageOf[u.GetKind()]
+		if !ok {
+			i = others
+		}
+		stages[i] = append(stages[i], u)
+	}
+	return slices.DeleteFunc(stages, func(stage []*unstructured.Unstructured) bool {
+		return len(stage) == 0
+	})
+}
+
+// deleteAll deletes the objects with the resource manager in the stages of
+// pruneStages. The objects in the Namespaces deleted by the same operation are
+// left to the deletion of their Namespace, and reported as deleted with it.
+// If a Namespace is not deleted, e.g. because it is not owned by the
+// Kustomization, the objects it contains are deleted individually at the end.
+// The deletion of all the stages is attempted, even if some fail.
+func deleteAll(ctx context.Context,
+	manager *ssa.ResourceManager,
+	objects []*unstructured.Unstructured,
+	opts ssa.DeleteOptions,
+	order *kustomizev1.ApplyOrder) (*ssa.ChangeSet, error) {
+	stages, contained := pruneStages(objects, order)
+
+	resultSet := ssa.NewChangeSet()
+	var errs []error
+	for _, stage := range stages {
+		changeSet, err := manager.DeleteAll(ctx, stage, opts)
+		if changeSet != nil {
+			resultSet.Append(changeSet.Entries)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(contained) > 0 {
+		deletedNamespaces := make(map[string]bool)
+		for _, entry := range resultSet.Entries {
+			if entry.ObjMetadata.GroupKind.Kind == "Namespace" && entry.Action == ssa.DeletedAction {
+				deletedNamespaces[entry.ObjMetadata.Name] = true
+			}
+		}
+		var remaining []*unstructured.Unstructured
+		for _, u := range contained {
+			if !deletedNamespaces[u.GetNamespace()] {
+				remaining = append(remaining, u)
+				continue
+			}
+			resultSet.Add(ssa.ChangeSetEntry{
+				ObjMetadata:  object.UnstructuredToObjMetadata(u),
+				GroupVersion: u.GroupVersionKind().Version,
+				Subject:      ssautil.FmtUnstructured(u),
+				Action:       ssa.DeletedAction,
+			})
+		}
+		if len(remaining) > 0 {
+			changeSet, err := manager.DeleteAll(ctx, remaining, opts)
+			if changeSet != nil {
+				resultSet.Append(changeSet.Entries)
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return resultSet, errors.Join(errs...)
+}
+
+// pruneStages splits the objects to delete in stages: the namespaced objects,
+// then the cluster-scoped objects, each in the reverse of the apply order,
+// and the Namespaces and CRDs last. The objects of each stage are sorted in
+// the order of their deletion. The namespaced objects in the Namespaces to
+// delete are returned apart, as they are deleted with their Namespace.
+func pruneStages(objects []*unstructured.Unstructured,
+	order *kustomizev1.ApplyOrder) (stages [][]*unstructured.Unstructured, contained []*unstructured.Unstructured) {
+	namespaces := make(map[string]bool)
+	for _, u := range objects {
+		if ssautil.IsNamespace(u) {
+			namespaces[u.GetName()] = true
+		}
+	}
+
+	var namespaced, clusterScoped, definitions []*unstructured.Unstructured
+	for _, u := range objects {
+		switch {
+		case ssautil.IsClusterDefinition(u):
+			definitions = append(definitions, u)
+		case u.GetNamespace() == "":
+			clusterScoped = append(clusterScoped, u)
+		case namespaces[u.GetNamespace()]:
+			contained = append(contained, u)
+		default:
+			namespaced = append(namespaced, u)
+		}
+	}
+
+	for _, group := range [][]*unstructured.Unstructured{namespaced, clusterScoped} {
+		groupStages := applyOrderStages(order, group)
+		slices.Reverse(groupStages)
+		stages = append(stages, groupStages...)
+	}
+	if len(definitions) > 0 {
+		stages = append(stages, definitions)
+	}
+	for _, stage := range stages {
+		sort.Sort(sort.Reverse(ssa.SortableUnstructureds(stage)))
+	}
+	return stages, contained
+}
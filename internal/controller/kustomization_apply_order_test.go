@@ -0,0 +1,248 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_ApplyOrder(t *testing.T) {
+	g := NewWithT(t)
+	id := "order-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "resources.yaml",
+			Body: `---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: app
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("order-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("order-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Prune:           true,
+			ApplyOrder: &kustomizev1.ApplyOrder{
+				First: []string{"Secret"},
+				Last:  []string{"ServiceAccount"},
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	t.Run("applies in the custom order", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		// The default order would apply the ServiceAccount first.
+		events := getEvents(resultK.GetName(), map[string]string{"kustomize.toolkit.fluxcd.io/revision": revision})
+		g.Expect(events).To(ContainElement(HaveField("Message", Equal(strings.Join([]string{
+			fmt.Sprintf("Secret/%s/app created", id),
+			fmt.Sprintf("ConfigMap/%s/app created", id),
+			fmt.Sprintf("ServiceAccount/%s/app created", id),
+		}, "\n")))))
+	})
+
+	t.Run("prunes in the reverse custom order", func(t *testing.T) {
+		g := NewWithT(t)
+		revision = "v2.0.0"
+		artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+			{
+				Name: "resources.yaml",
+				Body: `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+`,
+			},
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		events := getEvents(resultK.GetName(), map[string]string{"kustomize.toolkit.fluxcd.io/revision": revision})
+		g.Expect(events).To(ContainElement(HaveField("Message", Equal(strings.Join([]string{
+			fmt.Sprintf("ServiceAccount/%s/app deleted", id),
+			fmt.Sprintf("ConfigMap/%s/app deleted", id),
+			fmt.Sprintf("Secret/%s/app deleted", id),
+		}, "\n")))))
+	})
+
+	t.Run("rejects invalid kinds", func(t *testing.T) {
+		g := NewWithT(t)
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+
+		invalid := resultK.DeepCopy()
+		invalid.Spec.ApplyOrder = &kustomizev1.ApplyOrder{First: []string{"cluster-secret-store"}}
+		err := k8sClient.Update(context.Background(), invalid)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("spec.applyOrder.first[0]"))
+
+		invalid = resultK.DeepCopy()
+		invalid.Spec.ApplyOrder = &kustomizev1.ApplyOrder{First: []string{"Secret"}, Last: []string{"Secret"}}
+		err = k8sClient.Update(context.Background(), invalid)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("a kind can't be listed in both first and last"))
+	})
+}
+
+func Test_applyOrderStages(t *testing.T) {
+	newObject := func(kind, name string) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("v1")
+		u.SetKind(kind)
+		u.SetName(name)
+		return u
+	}
+	objects := []*unstructured.Unstructured{
+		newObject("ExternalSecret", "db"),
+		newObject("ValidatingWebhookConfiguration", "policy"),
+		newObject("ConfigMap", "app"),
+		newObject("ClusterSecretStore", "vault"),
+		newObject("ExternalSecret", "api"),
+		newObject("Deployment", "app"),
+	}
+
+	tests := []struct {
+		name  string
+		order *kustomizev1.ApplyOrder
+		want  [][]string
+	}{
+		{
+			name: "single stage without order",
+			want: [][]string{
+				{"ExternalSecret/db", "ValidatingWebhookConfiguration/policy", "ConfigMap/app",
+					"ClusterSecretStore/vault", "ExternalSecret/api", "Deployment/app"},
+			},
+		},
+		{
+			name: "stages first and last kinds in their order",
+			order: &kustomizev1.ApplyOrder{
+				First: []string{"ClusterSecretStore", "ExternalSecret"},
+				Last:  []string{"ValidatingWebhookConfiguration"},
+			},
+			want: [][]string{
+				{"ClusterSecretStore/vault"},
+				{"ExternalSecret/db", "ExternalSecret/api"},
+				{"ConfigMap/app", "Deployment/app"},
+				{"ValidatingWebhookConfiguration/policy"},
+			},
+		},
+		{
+			name: "leaves out empty stages",
+			order: &kustomizev1.ApplyOrder{
+				First: []string{"Job", "ClusterSecretStore"},
+				Last:  []string{"MutatingWebhookConfiguration"},
+			},
+			want: [][]string{
+				{"ClusterSecretStore/vault"},
+				{"ExternalSecret/db", "ValidatingWebhookConfiguration/policy", "ConfigMap/app",
+					"ExternalSecret/api", "Deployment/app"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var got [][]string
+			for _, stage := range applyOrderStages(tt.order, objects) {
+				var names []string
+				for _, u := range stage {
+					names = append(names, u.GetKind()+"/"+u.GetName())
+				}
+				got = append(got, names)
+			}
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+
+	g := NewWithT(t)
+	g.Expect(applyOrderStages(nil, nil)).To(BeEmpty())
+}
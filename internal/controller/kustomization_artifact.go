@@ -0,0 +1,96 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/http/fetch"
+	"github.com/fluxcd/pkg/tar"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// artifactIntegrityError is returned when the digest of a downloaded
+// artifact doesn't match the one advertised by its Source.
+type artifactIntegrityError struct {
+	URL    string
+	Digest string
+	Err    error
+}
+
+// Error implements the error interface.
+func (e *artifactIntegrityError) Error() string {
+	return fmt.Sprintf("integrity check of artifact '%s' with digest '%s' failed: %s", e.URL, e.Digest, e.Err)
+}
+
+// Unwrap returns the error of the verification.
+func (e *artifactIntegrityError) Unwrap() error {
+	return e.Err
+}
+
+// fetchArtifact downloads the artifact, verifies its digest and extracts
+// its files to the dir. The files are only extracted once the downloaded
+// bytes match the digest, and the download is retried once on a mismatch,
+// e.g. when a proxy truncated the tarball or when source-controller rotated
+// the artifact during the download.
+func (r *KustomizationReconciler) fetchArtifact(ctx context.Context, artifact *sourcev1.Artifact, dir string) error {
+	fetcher := fetch.NewArchiveFetcherWithLogger(
+		r.artifactFetchRetries,
+		tar.UnlimitedUntarSize,
+		tar.UnlimitedUntarSize,
+		os.Getenv("SOURCE_CONTROLLER_LOCALHOST"),
+		ctrl.LoggerFrom(ctx),
+	)
+
+	err := fetcher.Fetch(artifact.URL, artifact.Digest, dir)
+	if !isDigestMismatch(err) {
+		return err
+	}
+	ctrl.LoggerFrom(ctx).Info("Artifact digest mismatch, retrying the download",
+		"url", artifact.URL, "digest", artifact.Digest, "error", err.Error())
+
+	err = fetcher.Fetch(artifact.URL, artifact.Digest, dir)
+	if isDigestMismatch(err) {
+		return &artifactIntegrityError{URL: artifact.URL, Digest: artifact.Digest, Err: err}
+	}
+	return err
+}
+
+// isDigestMismatch returns if the fetch failed to verify the digest of the
+// downloaded artifact. The fetcher doesn't return a typed error for it, the
+// message of its verification error is matched instead.
+func isDigestMismatch(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "failed to verify archive")
+}
+
+// artifactFailedReason returns the Ready condition reason of a failure to
+// fetch an artifact.
+func artifactFailedReason(err error) string {
+	var integrityErr *artifactIntegrityError
+	if errors.As(err, &integrityErr) {
+		return kustomizev1.ArtifactIntegrityErrorReason
+	}
+	return meta.ArtifactFailedReason
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_fetchArtifact(t *testing.T) {
+	tarball := tarGzFiles(t, map[string]string{"configmap.yaml": "kind: ConfigMap\n"})
+	tampered := tarGzFiles(t, map[string]string{"configmap.yaml": "kind: Secret\n"})
+
+	tests := []struct {
+		name         string
+		responses    [][]byte
+		wantErr      bool
+		wantReason   string
+		wantRequests int32
+	}{
+		{
+			name:         "extracts a verified artifact",
+			responses:    [][]byte{tarball},
+			wantRequests: 1,
+		},
+		{
+			name:         "retries the download of a truncated artifact",
+			responses:    [][]byte{tarball[:len(tarball)/2], tarball},
+			wantRequests: 2,
+		},
+		{
+			name:         "fails on a tampered artifact",
+			responses:    [][]byte{tampered, tampered},
+			wantErr:      true,
+			wantReason:   kustomizev1.ArtifactIntegrityErrorReason,
+			wantRequests: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				n := int(requests.Add(1)) - 1
+				_, _ = w.Write(tt.responses[min(n, len(tt.responses)-1)])
+			}))
+			defer server.Close()
+
+			artifact := &sourcev1.Artifact{
+				URL:    server.URL + "/artifact.tar.gz",
+				Digest: digest.SHA256.FromBytes(tarball).String(),
+			}
+			dir := t.TempDir()
+
+			r := &KustomizationReconciler{}
+			err := r.fetchArtifact(context.Background(), artifact, dir)
+			g.Expect(requests.Load()).To(Equal(tt.wantRequests))
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(artifactFailedReason(err)).To(Equal(tt.wantReason))
+				g.Expect(filepath.Join(dir, "configmap.yaml")).NotTo(BeAnExistingFile())
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			b, err := os.ReadFile(filepath.Join(dir, "configmap.yaml"))
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(string(b)).To(Equal("kind: ConfigMap\n"))
+		})
+	}
+}
+
+func Test_artifactFailedReason(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(artifactFailedReason(os.ErrNotExist)).To(Equal(meta.ArtifactFailedReason))
+	g.Expect(artifactFailedReason(&artifactIntegrityError{Err: os.ErrInvalid})).To(
+		Equal(kustomizev1.ArtifactIntegrityErrorReason))
+}
+
+// tarGzFiles returns a gzipped tarball of the files.
+func tarGzFiles(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0o600,
+			Size:     int64(len(body)),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+
+	securefs "github.com/fluxcd/pkg/kustomize/filesys"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/resmap"
+	kustypes "sigs.k8s.io/kustomize/api/types"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// kustomizeBuildMutex protects against the kustomize concurrent map
+// read/write panic, see https://github.com/kubernetes-sigs/kustomize/issues/3659.
+var kustomizeBuildMutex sync.Mutex
+
+// loadRestrictions returns the kustomize load restrictions of the
+// Kustomization, or an error if they are 'None' and the controller doesn't
+// allow it.
+func loadRestrictions(obj *kustomizev1.Kustomization, allowNone bool) (kustypes.LoadRestrictions, error) {
+	switch obj.GetLoadRestrictions() {
+	case kustomizev1.LoadRestrictionsNone:
+		if !allowNone {
+			return kustypes.LoadRestrictionsUnknown,
+				fmt.Errorf("load restrictions '%s' are not allowed, the controller must run with --allow-load-restrictions-none",
+					kustomizev1.LoadRestrictionsNone)
+		}
+		return kustypes.LoadRestrictionsNone, nil
+	default:
+		return kustypes.LoadRestrictionsRootOnly, nil
+	}
+}
+
+// secureBuild runs the kustomize build of dirPath on a file system which
+// denies the operations outside of root, with the builtin plugins only and
+// the given load restrictions. Regardless of the load restrictions, the
+// files outside of root, e.g. absolute paths or relative paths escaping it,
+// can't be loaded.
+func secureBuild(root, dirPath string, allowRemoteBases bool,
+	restrictions kustypes.LoadRestrictions) (res resmap.ResMap, err error) {
+	makeFs := securefs.MakeFsOnDiskSecure
+	if allowRemoteBases {
+		makeFs = securefs.MakeFsOnDiskSecureBuild
+	}
+	fs, err := makeFs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	kustomizeBuildMutex.Lock()
+	defer kustomizeBuildMutex.Unlock()
+
+	// Recover from the kustomize panics on invalid object data to keep
+	// reconciling the other Kustomizations.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered from kustomize build panic: %v", r)
+		}
+	}()
+
+	k := krusty.MakeKustomizer(&krusty.Options{
+		LoadRestrictions: restrictions,
+		PluginConfig:     kustypes.DisabledPluginConfig(),
+	})
+	return k.Run(fs, dirPath)
+}
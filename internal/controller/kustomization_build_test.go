@@ -0,0 +1,136 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	kustypes "sigs.k8s.io/kustomize/api/types"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func Test_loadRestrictions(t *testing.T) {
+	tests := []struct {
+		name         string
+		restrictions string
+		allowNone    bool
+		want         kustypes.LoadRestrictions
+		wantErr      string
+	}{
+		{name: "default", want: kustypes.LoadRestrictionsRootOnly},
+		{name: "root only", restrictions: kustomizev1.LoadRestrictionsRootOnly, want: kustypes.LoadRestrictionsRootOnly},
+		{name: "none allowed", restrictions: kustomizev1.LoadRestrictionsNone, allowNone: true, want: kustypes.LoadRestrictionsNone},
+		{name: "none not allowed", restrictions: kustomizev1.LoadRestrictionsNone,
+			wantErr: "load restrictions 'None' are not allowed, the controller must run with --allow-load-restrictions-none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			obj := &kustomizev1.Kustomization{}
+			if tt.restrictions != "" {
+				obj.Spec.BuildOptions = &kustomizev1.BuildOptions{LoadRestrictions: tt.restrictions}
+			}
+			got, err := loadRestrictions(obj, tt.allowNone)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(tt.wantErr))
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func Test_secureBuild(t *testing.T) {
+	configMap := func(name string) string {
+		return fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+`, name)
+	}
+
+	tests := []struct {
+		name         string
+		resources    []string
+		restrictions kustypes.LoadRestrictions
+		wantErr      string
+	}{
+		{
+			name:         "sibling file with root only",
+			resources:    []string{"../common/configmap.yaml"},
+			restrictions: kustypes.LoadRestrictionsRootOnly,
+			wantErr:      "security; file",
+		},
+		{
+			name:         "sibling file with none",
+			resources:    []string{"../common/configmap.yaml"},
+			restrictions: kustypes.LoadRestrictionsNone,
+		},
+		{
+			name:         "relative path escaping the root with none",
+			resources:    []string{"../../outside/outside.yaml"},
+			restrictions: kustypes.LoadRestrictionsNone,
+			wantErr:      "is not in or below",
+		},
+		{
+			name:         "absolute path with none",
+			resources:    []string{"{outside}/outside.yaml"},
+			restrictions: kustypes.LoadRestrictionsNone,
+			wantErr:      "is not in or below",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			tmpDir := t.TempDir()
+			root := filepath.Join(tmpDir, "root")
+			outside := filepath.Join(tmpDir, "outside")
+			g.Expect(os.MkdirAll(filepath.Join(root, "apps"), 0o755)).To(Succeed())
+			g.Expect(os.MkdirAll(filepath.Join(root, "common"), 0o755)).To(Succeed())
+			g.Expect(os.MkdirAll(outside, 0o755)).To(Succeed())
+			g.Expect(os.WriteFile(filepath.Join(root, "common", "configmap.yaml"),
+				[]byte(configMap("common")), 0o644)).To(Succeed())
+			g.Expect(os.WriteFile(filepath.Join(outside, "outside.yaml"),
+				[]byte(configMap("outside")), 0o644)).To(Succeed())
+
+			kustomization := "apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\nresources:\n"
+			for _, r := range tt.resources {
+				kustomization += fmt.Sprintf("- %s\n", strings.ReplaceAll(r, "{outside}", outside))
+			}
+			dirPath := filepath.Join(root, "apps")
+			g.Expect(os.WriteFile(filepath.Join(dirPath, "kustomization.yaml"),
+				[]byte(kustomization), 0o644)).To(Succeed())
+
+			m, err := secureBuild(root, dirPath, false, tt.restrictions)
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(m.Resources()).To(HaveLen(1))
+			g.Expect(m.Resources()[0].GetName()).To(Equal("common"))
+		})
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_Components(t *testing.T) {
+	g := NewWithT(t)
+	id := "comp-" + randStringRunes(5)
+	revision := "v1.0.0"
+	resultK := &kustomizev1.Kustomization{}
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	// The app has no kustomization.yaml, which is generated by the
+	// controller, and the component adds a sidecar to its Deployment.
+	manifests := func(name string) []testserver.File {
+		return []testserver.File{
+			{
+				Name: "app/deployment.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: %[1]s
+spec:
+  selector:
+    matchLabels:
+      app: %[1]s
+  template:
+    metadata:
+      labels:
+        app: %[1]s
+    spec:
+      containers:
+      - name: app
+        image: ghcr.io/stefanprodan/podinfo:6.7.0
+`, name),
+			},
+			{
+				Name: "components/sidecar/kustomization.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: kustomize.config.k8s.io/v1alpha1
+kind: Component
+patches:
+- patch: |
+    apiVersion: apps/v1
+    kind: Deployment
+    metadata:
+      name: %[1]s
+    spec:
+      template:
+        spec:
+          containers:
+          - name: sidecar
+            image: ghcr.io/stefanprodan/podinfo:6.7.0
+`, name),
+			},
+		}
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests(id))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("comp-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomizationKey := types.NamespacedName{
+		Name:      fmt.Sprintf("comp-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      kustomizationKey.Name,
+			Namespace: kustomizationKey.Namespace,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./app",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Components:      []string{"../components/sidecar"},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	t.Run("adds the sidecar of the component", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+		kstatusCheck.CheckErr(ctx, resultK)
+
+		var deployment appsv1.Deployment
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: id, Namespace: id}, &deployment)).To(Succeed())
+		var names []string
+		for _, c := range deployment.Spec.Template.Spec.Containers {
+			names = append(names, c.Name)
+		}
+		g.Expect(names).To(ConsistOf("app", "sidecar"))
+	})
+
+	t.Run("rejects a component outside of the artifact", func(t *testing.T) {
+		g := NewWithT(t)
+		resultK.Spec.Components = []string{"../../sidecar"}
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.ObservedGeneration == resultK.GetGeneration() &&
+				conditions.IsFalse(resultK, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(meta.BuildFailedReason))
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(
+			ContainSubstring("component path '../../sidecar' must not point outside of the artifact"))
+	})
+}
+
+func Test_checkComponentPaths(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		components []string
+		wantErr    string
+	}{
+		{name: "component in path", path: "app", components: []string{"./sidecar", "sidecar/"}},
+		{name: "component in artifact", path: "clusters/prod", components: []string{"../../components/sidecar"}},
+		{name: "artifact root", path: "app", components: []string{".."}},
+		{name: "outside of artifact", path: "app", components: []string{"../../sidecar"},
+			wantErr: "component path '../../sidecar' must not point outside of the artifact"},
+		{name: "sibling of artifact", path: ".", components: []string{"../tmp-sidecar"},
+			wantErr: "component path '../tmp-sidecar' must not point outside of the artifact"},
+		{name: "absolute path", path: "app", components: []string{"/components/sidecar"},
+			wantErr: "component path '/components/sidecar' must be local and relative"},
+		{name: "remote", path: "app", components: []string{"https://github.com/fluxcd/components"},
+			wantErr: "must be local and relative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			root := "/tmp/artifact"
+			err := checkComponentPaths(root, root+"/"+tt.path, tt.components)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+		})
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -29,6 +30,7 @@ import (
 	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/fluxcd/pkg/ssa/normalize"
 	ssautil "github.com/fluxcd/pkg/ssa/utils"
+	"github.com/getsops/sops/v3/keyservice"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
@@ -61,16 +63,20 @@ import (
 	"github.com/fluxcd/pkg/runtime/conditions"
 	runtimeCtrl "github.com/fluxcd/pkg/runtime/controller"
 	"github.com/fluxcd/pkg/runtime/jitter"
+	"github.com/fluxcd/pkg/runtime/logger"
 	"github.com/fluxcd/pkg/runtime/patch"
 	"github.com/fluxcd/pkg/runtime/predicates"
 	"github.com/fluxcd/pkg/ssa"
-	"github.com/fluxcd/pkg/tar"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1"
 	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
 
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
 	"github.com/fluxcd/kustomize-controller/internal/decryptor"
 	"github.com/fluxcd/kustomize-controller/internal/inventory"
+	intage "github.com/fluxcd/kustomize-controller/internal/sops/age"
+	intazkv "github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+	inthcvault "github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
+	intpgp "github.com/fluxcd/kustomize-controller/internal/sops/pgp"
 )
 
 // +kubebuilder:rbac:groups=kustomize.toolkit.fluxcd.io,resources=kustomizations,verbs=get;list;watch;create;update;patch;delete
@@ -79,6 +85,7 @@ import (
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=buckets;ocirepositories;gitrepositories,verbs=get;list;watch
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=buckets/status;ocirepositories/status;gitrepositories/status,verbs=get
 // +kubebuilder:rbac:groups="",resources=configmaps;secrets;serviceaccounts,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=serviceaccounts/token,verbs=create
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // KustomizationReconciler reconciles a Kustomization object
@@ -98,13 +105,38 @@ type KustomizationReconciler struct {
 	statusManager           string
 	NoCrossNamespaceRefs    bool
 	NoRemoteBases           bool
+	AllowUnrestrictedLoad   bool
+	NoDecryptionPreflight   bool
+	CrossNSDecryptionSecret bool
+	SubstitutionNamespaces  []string
+	DefaultDecryptionSecret *meta.NamespacedObjectReference
+	AgeKeyFiles             []*intage.IdentityFile
+	RemoteKeyServices       []keyservice.KeyServiceClient
+	SOPSMaxFileSize         int64
 	FailFast                bool
 	DefaultServiceAccount   string
 	KubeConfigOpts          runtimeClient.KubeConfigOptions
 	ConcurrentSSA           int
+	EventDiffMaxBytes       int
+	EventDiffSecrets        bool
 	DisallowedFieldManagers []string
 	StrictSubstitutions     bool
 	GroupChangeLog          bool
+	AzureCredentialCache    *intazkv.CredentialCache
+	AzureVaultDNSSuffixes   []string
+	AzureTokenMetrics       *intazkv.TokenMetrics
+	AWSKMSEndpoint          string
+	AWSSTSEndpoint          string
+	GCPKMSEndpoint          string
+	VaultLoginCache         *inthcvault.LoginCache
+	VaultAddressAllowlist   []string
+	PGPKeyringCache         *intpgp.KeyringCache
+	GnuPGHomeDir            string
+	DecryptionMetrics       *decryptor.Metrics
+	DecryptionLimiter       *decryptor.Limiter
+
+	healthCheckExprs *healthCheckExprsCache
+	driftCache       *driftCache
 }
 
 // KustomizationReconcilerOptions contains options for the KustomizationReconciler.
@@ -142,10 +174,12 @@ func (r *KustomizationReconciler) SetupWithManager(ctx context.Context, mgr ctrl
 	r.requeueDependency = opts.DependencyRequeueInterval
 	r.statusManager = fmt.Sprintf("gotk-%s", r.ControllerName)
 	r.artifactFetchRetries = opts.HTTPRetry
+	r.healthCheckExprs = newHealthCheckExprsCache()
+	r.driftCache = newDriftCache()
 
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&kustomizev1.Kustomization{}, builder.WithPredicates(
-			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}),
+			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}, RevisionPinChangePredicate{}),
 		)).
 		Watches(
 			&sourcev1b2.OCIRepository{},
@@ -174,9 +208,15 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 
 	obj := &kustomizev1.Kustomization{}
 	if err := r.Get(ctx, req.NamespacedName, obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.driftCache.delete(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// Record if the object was stalled to deduplicate the failure events.
+	prevStalledReason := stalledReason(obj)
+
 	// Initialize the runtime patcher with the current version of the object.
 	patcher := patch.NewSerialPatcher(obj, r.Client)
 
@@ -189,12 +229,13 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 
 		// Record Prometheus metrics.
 		r.Metrics.RecordDuration(ctx, obj, reconcileStart)
+		r.Metrics.RecordSuspend(ctx, obj, obj.Spec.Suspend)
 
 		// Log and emit success event.
 		if conditions.IsReady(obj) {
-			msg := fmt.Sprintf("Reconciliation finished in %s, next run in %s",
+			msg := fmt.Sprintf("Reconciliation finished in %s, next run %s",
 				time.Since(reconcileStart).String(),
-				obj.Spec.Interval.Duration.String())
+				nextRun(reconcileInterval(obj)))
 			log.Info(msg, "revision", obj.Status.LastAttemptedRevision)
 			r.event(obj, obj.Status.LastAppliedRevision, obj.Status.LastAppliedOriginRevision, eventv1.EventSeverityInfo, msg,
 				map[string]string{
@@ -217,14 +258,25 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return ctrl.Result{Requeue: true}, nil
 	}
 
+	// Record the suspension and the transitions from and to it.
+	r.recordSuspension(obj)
+
 	// Skip reconciliation if the object is suspended.
 	if obj.Spec.Suspend {
 		log.Info("Reconciliation is suspended for this object")
+		r.driftCache.delete(client.ObjectKeyFromObject(obj))
 		return ctrl.Result{}, nil
 	}
 
-	// Configure custom health checks.
+	// Record if the periodic reconciliation is disabled.
+	markEventDriven(obj)
+
+	// Configure custom health checks and parse the dependency ready expressions.
 	statusPoller, pollingOpts, err := r.getPollerAndOptions(ctx, obj)
+	var readyExprs []*cel.Expression
+	if err == nil {
+		readyExprs, err = parseReadyExprs(obj.Spec.DependsOn)
+	}
 	if err != nil {
 		const msg = "Reconciliation failed terminally due to configuration error"
 		errMsg := fmt.Sprintf("%s: %v", msg, err)
@@ -244,14 +296,14 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		if apierrors.IsNotFound(err) {
 			msg := fmt.Sprintf("Source '%s' not found", obj.Spec.SourceRef.String())
 			log.Info(msg)
-			return ctrl.Result{RequeueAfter: obj.GetRetryInterval()}, nil
+			return ctrl.Result{RequeueAfter: retryInterval(obj, r.requeueDependency)}, nil
 		}
 
 		if acl.IsAccessDenied(err) {
 			conditions.MarkFalse(obj, meta.ReadyCondition, apiacl.AccessDeniedReason, "%s", err)
 			log.Error(err, "Access denied to cross-namespace source")
 			r.event(obj, "", "", eventv1.EventSeverityError, err.Error(), nil)
-			return ctrl.Result{RequeueAfter: obj.GetRetryInterval()}, nil
+			return ctrl.Result{RequeueAfter: retryInterval(obj, r.requeueDependency)}, nil
 		}
 
 		// Retry with backoff on transient errors.
@@ -265,12 +317,65 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		log.Info(msg)
 		return ctrl.Result{RequeueAfter: r.requeueDependency}, nil
 	}
-	revision := artifactSource.GetArtifact().Revision
-	originRevision := getOriginRevision(artifactSource)
+
+	// Resolve the artifact of the revision pinned with the revision-pin
+	// annotation, and requeue the reconciliation if it's unavailable.
+	src, err := pinSource(obj, artifactSource)
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.PinnedRevisionUnavailableReason, "%s", err)
+		log.Error(err, "Pinned revision unavailable")
+		r.event(obj, artifactSource.GetArtifact().Revision, getOriginRevision(artifactSource),
+			eventv1.EventSeverityError, err.Error(), nil)
+		return ctrl.Result{RequeueAfter: retryInterval(obj, r.requeueDependency)}, nil
+	}
+	_, pinned := src.(*appliedSource)
+
+	// Resolve the additional sources, and requeue the reconciliation if any
+	// of them is not found or has no artifact.
+	src, err = r.combineSources(ctx, obj, src)
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, meta.ArtifactFailedReason, "%s", err)
+
+		if acl.IsAccessDenied(err) {
+			conditions.MarkFalse(obj, meta.ReadyCondition, apiacl.AccessDeniedReason, "%s", err)
+			log.Error(err, "Access denied to cross-namespace source")
+			r.event(obj, "", "", eventv1.EventSeverityError, err.Error(), nil)
+			return ctrl.Result{RequeueAfter: retryInterval(obj, r.requeueDependency)}, nil
+		}
+
+		if apierrors.IsNotFound(err) || errors.Is(err, errAdditionalArtifactNotFound) {
+			msg := fmt.Sprintf("%s, retrying in %s", err, r.requeueDependency.String())
+			conditions.MarkFalse(obj, meta.ReadyCondition, meta.ArtifactFailedReason, "%s", msg)
+			log.Info(msg)
+			return ctrl.Result{RequeueAfter: r.requeueDependency}, nil
+		}
+
+		// Retry with backoff on transient errors.
+		return ctrl.Result{}, err
+	}
+	revision := src.GetArtifact().Revision
+	originRevision := getOriginRevision(src)
+
+	// Deny the reconciliation if the substitutions reference a namespace
+	// which is not allowed.
+	if err := r.checkSubstitutionNamespaces(obj); err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, apiacl.AccessDeniedReason, "%s", err)
+		log.Error(err, "Access denied to cross-namespace substitution")
+		r.event(obj, revision, originRevision, eventv1.EventSeverityError, err.Error(), nil)
+		return ctrl.Result{RequeueAfter: retryInterval(obj, r.requeueDependency)}, nil
+	}
 
 	// Check dependencies and requeue the reconciliation if the check fails.
+	var outputs map[string]string
 	if len(obj.Spec.DependsOn) > 0 {
-		if err := r.checkDependencies(ctx, obj, artifactSource); err != nil {
+		if err := r.checkDependencies(ctx, obj, artifactSource, readyExprs); err != nil {
+			// Dependencies in a cycle are never ready, report the cycle instead.
+			if cycleErr := r.findDependencyCycle(ctx, obj); cycleErr != nil {
+				conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.CircularDependencyReason, "%s", cycleErr)
+				log.Error(cycleErr, "Dependencies can't meet ready condition")
+				r.event(obj, revision, originRevision, eventv1.EventSeverityError, cycleErr.Error(), nil)
+				return ctrl.Result{RequeueAfter: r.requeueDependency}, nil
+			}
 			conditions.MarkFalse(obj, meta.ReadyCondition, meta.DependencyNotReadyReason, "%s", err)
 			msg := fmt.Sprintf("Dependencies do not meet ready condition, retrying in %s", r.requeueDependency.String())
 			log.Info(msg)
@@ -278,10 +383,40 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 			return ctrl.Result{RequeueAfter: r.requeueDependency}, nil
 		}
 		log.Info("All dependencies are ready, proceeding with reconciliation")
+
+		// Read the outputs of the dependencies for the post build substitutions.
+		outputs, err = r.dependencyOutputs(ctx, obj)
+		if err != nil {
+			conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.DependencyOutputsFailedReason, "%s", err)
+			msg := fmt.Sprintf("Dependency outputs can't be read, retrying in %s", r.requeueDependency.String())
+			log.Error(err, msg)
+			r.event(obj, revision, originRevision, eventv1.EventSeverityError, err.Error(), nil)
+			return ctrl.Result{RequeueAfter: r.requeueDependency}, nil
+		}
 	}
 
-	// Reconcile the latest revision.
-	reconcileErr := r.reconcile(ctx, obj, artifactSource, patcher, statusPoller, pollingOpts)
+	// Correct the drift of the resources of the last applied revision if it
+	// has been built within the interval, or reconcile the latest revision,
+	// or roll back to the last applied one.
+	var reconcileErr error
+	if objects := r.driftCache.get(obj, revision, time.Now()); objects != nil && canCorrectDrift(obj, revision) {
+		reconcileErr = r.correctDrift(ctx, obj, src, objects, patcher, statusPoller, pollingOpts)
+	} else {
+		reconcileErr = r.reconcileWithRollback(ctx, obj, src, outputs, patcher, statusPoller, pollingOpts)
+	}
+
+	// Requeue at the specified retry interval if the artifact tarball of the
+	// pinned revision has been garbage collected from the Source storage.
+	if pinned && errors.Is(reconcileErr, fetch.ErrFileNotFound) {
+		retryAfter := retryInterval(obj, r.requeueDependency)
+		msg := fmt.Sprintf("Pinned revision %s is no longer available in the Source storage, retrying %s",
+			revision, nextRun(retryAfter))
+		conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.PinnedRevisionUnavailableReason, "%s", msg)
+		conditions.MarkFalse(obj, kustomizev1.RevisionPinnedCondition, kustomizev1.PinnedRevisionUnavailableReason, "%s", msg)
+		log.Info(msg)
+		r.event(obj, revision, originRevision, eventv1.EventSeverityError, msg, nil)
+		return ctrl.Result{RequeueAfter: retryAfter}, nil
+	}
 
 	// Requeue at the specified retry interval if the artifact tarball is not found.
 	if errors.Is(reconcileErr, fetch.ErrFileNotFound) {
@@ -293,24 +428,72 @@ func (r *KustomizationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 
 	// Broadcast the reconciliation failure and requeue at the specified retry interval.
 	if reconcileErr != nil {
-		log.Error(reconcileErr, fmt.Sprintf("Reconciliation failed after %s, next try in %s",
+		retryAfter := retryInterval(obj, r.requeueDependency)
+		stalled := markProgressDeadline(obj, time.Now())
+		log.Error(reconcileErr, fmt.Sprintf("Reconciliation failed after %s, next try %s",
 			time.Since(reconcileStart).String(),
-			obj.GetRetryInterval().String()),
+			nextRun(retryAfter)),
 			"revision",
 			revision)
-		r.event(obj, revision, originRevision, eventv1.EventSeverityError,
-			reconcileErr.Error(), nil)
-		return ctrl.Result{RequeueAfter: obj.GetRetryInterval()}, nil
+
+		// Skip the event if the object was already stalled by the same failure.
+		if !stalled || prevStalledReason != stalledReason(obj) {
+			r.event(obj, revision, originRevision, eventv1.EventSeverityError,
+				reconcileErr.Error(), nil)
+		}
+		return ctrl.Result{RequeueAfter: retryAfter}, nil
 	}
 
-	// Requeue the reconciliation at the specified interval.
-	return ctrl.Result{RequeueAfter: jitter.JitteredIntervalDuration(obj.GetRequeueAfter())}, nil
+	// Reset the retry backoff and the failure status, and requeue the
+	// reconciliation at the specified interval.
+	obj.Status.RetryBackoff = nil
+	obj.Status.Failure = nil
+	return ctrl.Result{RequeueAfter: requeueInterval(obj, jitter.JitteredIntervalDuration)}, nil
+}
+
+// requeueInterval returns the interval after which a successfully reconciled
+// Kustomization is requeued, with the given interval jitter. The retries of
+// failed reconciliations are requeued at the retry interval as is. It returns
+// zero for an event-driven Kustomization without a drift interval, which is
+// not requeued.
+func requeueInterval(obj *kustomizev1.Kustomization, jitterFn jitter.Duration) time.Duration {
+	interval := reconcileInterval(obj)
+	if interval == 0 {
+		return 0
+	}
+	return jitterFn(interval)
+}
+
+// markEventDriven sets the EventDriven condition of a Kustomization with an
+// interval of zero, and removes it otherwise.
+func markEventDriven(obj *kustomizev1.Kustomization) {
+	if !obj.IsEventDriven() {
+		conditions.Delete(obj, kustomizev1.EventDrivenCondition)
+		return
+	}
+	if drift := obj.GetDriftInterval(); drift > 0 {
+		conditions.MarkTrue(obj, kustomizev1.EventDrivenCondition, kustomizev1.PeriodicReconciliationDisabledReason,
+			"Periodic reconciliation is disabled, drift is corrected every %s", drift)
+		return
+	}
+	conditions.MarkTrue(obj, kustomizev1.EventDrivenCondition, kustomizev1.PeriodicReconciliationDisabledReason,
+		"Periodic reconciliation is disabled, drift is corrected on the next source revision or reconcile request")
+}
+
+// nextRun describes when the next reconciliation runs after the interval,
+// where an interval of zero means there is no periodic reconciliation.
+func nextRun(interval time.Duration) string {
+	if interval == 0 {
+		return "on the next event"
+	}
+	return "in " + interval.String()
 }
 
 func (r *KustomizationReconciler) reconcile(
 	ctx context.Context,
 	obj *kustomizev1.Kustomization,
 	src sourcev1.Source,
+	outputs map[string]string,
 	patcher *patch.SerialPatcher,
 	statusPoller *polling.StatusPoller,
 	pollingOpts polling.Options) error {
@@ -346,82 +529,123 @@ func (r *KustomizationReconciler) reconcile(
 		}
 	}(tmpDir)
 
-	// Download artifact and extract files to the tmp dir.
-	if err = fetch.NewArchiveFetcherWithLogger(
-		r.artifactFetchRetries,
-		tar.UnlimitedUntarSize,
-		tar.UnlimitedUntarSize,
-		os.Getenv("SOURCE_CONTROLLER_LOCALHOST"),
-		ctrl.LoggerFrom(ctx),
-	).Fetch(src.GetArtifact().URL, src.GetArtifact().Digest, tmpDir); err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, meta.ArtifactFailedReason, "%s", err)
+	// Download artifact, verify its digest and extract files to the tmp dir.
+	if err = r.fetchArtifact(ctx, src.GetArtifact(), tmpDir); err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, artifactFailedReason(err), "%s", err)
 		return err
 	}
 
-	// check build path exists
-	dirPath, err := securejoin.SecureJoin(tmpDir, obj.Spec.Path)
-	if err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, meta.ArtifactFailedReason, "%s", err)
+	// Extract the artifacts of the additional sources at their mount paths.
+	if err = r.fetchAdditionalSources(ctx, src, tmpDir); err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, artifactFailedReason(err), "%s", err)
 		return err
 	}
 
-	if _, err := os.Stat(dirPath); err != nil {
-		err = fmt.Errorf("kustomization path not found: %w", err)
-		conditions.MarkFalse(obj, meta.ReadyCondition, meta.ArtifactFailedReason, "%s", err)
+	// Substitute the variables in the build paths and the health checks.
+	specVars := r.newSpecVariables(ctx, obj, outputs)
+	specPaths, err := specVars.paths()
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, meta.BuildFailedReason, "%s", err)
 		return err
 	}
+	healthChecks, err := specVars.healthChecks()
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, meta.BuildFailedReason, "%s", err)
+		return err
+	}
+
+	// check build paths exist
+	dirPaths := make([]string, len(specPaths))
+	for i, specPath := range specPaths {
+		dirPath, err := securejoin.SecureJoin(tmpDir, specPath)
+		if err != nil {
+			conditions.MarkFalse(obj, meta.ReadyCondition, meta.ArtifactFailedReason, "%s", err)
+			return err
+		}
+
+		if _, err := os.Stat(dirPath); err != nil {
+			err = fmt.Errorf("kustomization path not found: %w", err)
+			conditions.MarkFalse(obj, meta.ReadyCondition, meta.ArtifactFailedReason, "%s", err)
+			return err
+		}
+		dirPaths[i] = dirPath
+	}
 
 	// Report progress and set last attempted revision in status.
 	obj.Status.LastAttemptedRevision = revision
-	progressingMsg = fmt.Sprintf("Building manifests for revision %s with a timeout of %s", revision, obj.GetTimeout().String())
+	progressingMsg = fmt.Sprintf("Building manifests for revision %s with a timeout of %s", revision, obj.GetBuildTimeout().String())
 	conditions.MarkReconciling(obj, meta.ProgressingReason, "%s", progressingMsg)
 	if err := r.patch(ctx, obj, patcher); err != nil {
 		return fmt.Errorf("failed to update status: %w", err)
 	}
 
 	// Configure the Kubernetes client for impersonation.
-	impersonation := runtimeClient.NewImpersonator(
-		r.Client,
-		statusPoller,
-		pollingOpts,
-		obj.Spec.KubeConfig,
-		r.KubeConfigOpts,
-		r.DefaultServiceAccount,
-		obj.Spec.ServiceAccountName,
-		obj.GetNamespace(),
-	)
+	impersonation := r.newImpersonator(obj, statusPoller, pollingOpts)
 
 	// Create the Kubernetes client that runs under impersonation.
-	kubeClient, statusPoller, err := impersonation.GetClient(ctx)
+	kubeClient, statusPoller, err := r.getKubeClient(ctx, obj, impersonation, pollingOpts)
 	if err != nil {
 		conditions.MarkFalse(obj, meta.ReadyCondition, meta.ReconciliationFailedReason, "%s", err)
 		return fmt.Errorf("failed to build kube client: %w", err)
 	}
 
-	// Generate kustomization.yaml if needed.
 	k, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
 	if err != nil {
 		conditions.MarkFalse(obj, meta.ReadyCondition, meta.BuildFailedReason, "%s", err)
 		return err
 	}
-	err = r.generate(unstructured.Unstructured{Object: k}, tmpDir, dirPath)
-	if err != nil {
+	if err := setOutputVariables(k, outputs); err != nil {
 		conditions.MarkFalse(obj, meta.ReadyCondition, meta.BuildFailedReason, "%s", err)
 		return err
 	}
-
-	// Build the Kustomize overlay and decrypt secrets if needed.
-	resources, err := r.build(ctx, obj, unstructured.Unstructured{Object: k}, tmpDir, dirPath)
-	if err != nil {
+	if err := r.inlineSubstituteFrom(ctx, obj, k); err != nil {
 		conditions.MarkFalse(obj, meta.ReadyCondition, meta.BuildFailedReason, "%s", err)
 		return err
 	}
 
-	// Convert the build result into Kubernetes unstructured objects.
-	objects, err := ssautil.ReadObjects(bytes.NewReader(resources))
-	if err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, meta.BuildFailedReason, "%s", err)
-		return err
+	var timeouts kustomizev1.Timeouts
+	if obj.Spec.Timeouts != nil {
+		timeouts = *obj.Spec.Timeouts
+	}
+
+	// Generate kustomization.yaml if needed, build the Kustomize overlay
+	// and decrypt secrets if needed, for each of the paths in order.
+	buildCtx, cancelBuild := withPhaseTimeout(ctx, timeouts.Build)
+	defer cancelBuild()
+	var objects []*unstructured.Unstructured
+	builtFrom := make(map[object.ObjMetadata]string)
+	for i, dirPath := range dirPaths {
+		resources, err := r.build(buildCtx, obj, unstructured.Unstructured{Object: k}, tmpDir, dirPath)
+		err = checkPhaseTimeout(buildCtx, "build", timeouts.Build, kustomizev1.BuildTimeoutReason, err)
+		if err != nil {
+			reason := meta.BuildFailedReason
+			var decErr *decryptor.DecryptionError
+			var timeoutErr *phaseTimeoutError
+			switch {
+			case errors.As(err, &timeoutErr):
+				reason = timeoutErr.Reason
+			case errors.As(err, &decErr):
+				reason = decErr.Reason
+			}
+			if len(obj.Spec.Paths) > 0 {
+				err = fmt.Errorf("failed to build path '%s': %w", specPaths[i], err)
+			}
+			conditions.MarkFalse(obj, meta.ReadyCondition, reason, "%s", err)
+			return err
+		}
+
+		// Convert the build result into Kubernetes unstructured objects.
+		pathObjects, err := ssautil.ReadObjects(bytes.NewReader(resources))
+		if err != nil {
+			conditions.MarkFalse(obj, meta.ReadyCondition, meta.BuildFailedReason, "%s", err)
+			return err
+		}
+
+		objects, err = appendBuiltObjects(objects, builtFrom, specPaths[i], pathObjects)
+		if err != nil {
+			conditions.MarkFalse(obj, meta.ReadyCondition, meta.BuildFailedReason, "%s", err)
+			return err
+		}
 	}
 
 	// Create the server-side apply manager.
@@ -433,16 +657,50 @@ func (r *KustomizationReconciler) reconcile(
 	resourceManager.SetConcurrency(r.ConcurrentSSA)
 
 	// Update status with the reconciliation progress.
-	progressingMsg = fmt.Sprintf("Detecting drift for revision %s with a timeout of %s", revision, obj.GetTimeout().String())
+	progressingMsg = fmt.Sprintf("Detecting drift for revision %s with a timeout of %s", revision, obj.GetApplyTimeout().String())
 	conditions.MarkReconciling(obj, meta.ProgressingReason, "%s", progressingMsg)
 	if err := r.patch(ctx, obj, patcher); err != nil {
 		return fmt.Errorf("failed to update status: %w", err)
 	}
 
+	applyCtx, cancelApply := withPhaseTimeout(ctx, timeouts.Apply)
+	defer cancelApply()
+
+	// Report the changes without applying them in dry-run mode.
+	if obj.Spec.DryRun {
+		err := r.dryRun(applyCtx, resourceManager, obj, revision, originRevision, objects, oldInventory)
+		err = checkPhaseTimeout(applyCtx, "apply", timeouts.Apply, kustomizev1.ApplyTimeoutReason, err)
+		if err != nil {
+			reason := meta.ReconciliationFailedReason
+			var timeoutErr *phaseTimeoutError
+			if errors.As(err, &timeoutErr) {
+				reason = timeoutErr.Reason
+			}
+			conditions.MarkFalse(obj, meta.ReadyCondition, reason, "%s", err)
+			return err
+		}
+		return nil
+	}
+
 	// Validate and apply resources in stages.
-	drifted, changeSet, err := r.apply(ctx, resourceManager, obj, revision, originRevision, objects)
+	drifted, changeSet, err := r.apply(applyCtx, resourceManager, obj, revision, originRevision, objects, "")
+	err = checkPhaseTimeout(applyCtx, "apply", timeouts.Apply, kustomizev1.ApplyTimeoutReason, err)
 	if err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, meta.ReconciliationFailedReason, "%s", err)
+		reason := meta.ReconciliationFailedReason
+		var timeoutErr *phaseTimeoutError
+		var stageErr *stageError
+		switch {
+		case errors.As(err, &timeoutErr):
+			reason = timeoutErr.Reason
+		case errors.As(err, &stageErr):
+			reason = kustomizev1.StageFailedReason
+		}
+		// Keep track of the objects applied by the stages before the failure
+		// for their garbage collection.
+		if changeSet != nil {
+			obj.Status.Inventory = addToInventory(oldInventory, changeSet)
+		}
+		conditions.MarkFalse(obj, meta.ReadyCondition, reason, "%s", err)
 		return err
 	}
 
@@ -480,14 +738,32 @@ func (r *KustomizationReconciler) reconcile(
 		originRevision,
 		isNewRevision,
 		drifted,
+		healthChecks,
+		objects,
 		changeSet.ToObjMetadataSet()); err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, meta.HealthCheckFailedReason, "%s", err)
+		reason := meta.HealthCheckFailedReason
+		var timeoutErr *phaseTimeoutError
+		if errors.As(err, &timeoutErr) {
+			reason = timeoutErr.Reason
+		}
+		conditions.MarkFalse(obj, meta.ReadyCondition, reason, "%s", err)
 		return err
 	}
 
-	// Set last applied revisions.
+	// Set last applied revisions and clear the result of a former dry-run.
 	obj.Status.LastAppliedRevision = revision
 	obj.Status.LastAppliedOriginRevision = originRevision
+	artifact := sourceArtifact(src)
+	obj.Status.LastAppliedArtifact = &kustomizev1.AppliedArtifact{
+		Revision: artifact.Revision,
+		URL:      artifact.URL,
+		Digest:   artifact.Digest,
+	}
+	obj.Status.DryRun = nil
+
+	// Cache the objects to correct their drift until the next reconciliation
+	// of the revision.
+	r.driftCache.set(obj, revision, objects, time.Now())
 
 	// Mark the object as ready.
 	conditions.MarkTrue(obj,
@@ -500,8 +776,9 @@ func (r *KustomizationReconciler) reconcile(
 
 func (r *KustomizationReconciler) checkDependencies(ctx context.Context,
 	obj *kustomizev1.Kustomization,
-	source sourcev1.Source) error {
-	for _, d := range obj.Spec.DependsOn {
+	source sourcev1.Source,
+	readyExprs []*cel.Expression) error {
+	for i, d := range obj.Spec.DependsOn {
 		if d.Namespace == "" {
 			d.Namespace = obj.GetNamespace()
 		}
@@ -515,6 +792,14 @@ func (r *KustomizationReconciler) checkDependencies(ctx context.Context,
 			return fmt.Errorf("dependency '%s' not found: %w", dName, err)
 		}
 
+		// The ready expression replaces the built-in readiness checks.
+		if readyExprs[i] != nil {
+			if err := evalReadyExpr(ctx, readyExprs[i], &k, obj, source); err != nil {
+				return fmt.Errorf("dependency '%s' is not ready: %w", dName, err)
+			}
+			continue
+		}
+
 		if len(k.Status.Conditions) == 0 || k.Generation != k.Status.ObservedGeneration {
 			return fmt.Errorf("dependency '%s' is not ready", dName)
 		}
@@ -535,7 +820,7 @@ func (r *KustomizationReconciler) checkDependencies(ctx context.Context,
 		if k.Spec.SourceRef.Name == obj.Spec.SourceRef.Name &&
 			srcNamespace == dSrcNamespace &&
 			k.Spec.SourceRef.Kind == obj.Spec.SourceRef.Kind &&
-			!source.GetArtifact().HasRevision(k.Status.LastAppliedRevision) {
+			!hasSourceRevision(source.GetArtifact(), k.Status.LastAppliedRevision) {
 			return fmt.Errorf("dependency '%s' revision is not up to date", dName)
 		}
 	}
@@ -545,23 +830,29 @@ func (r *KustomizationReconciler) checkDependencies(ctx context.Context,
 
 func (r *KustomizationReconciler) getSource(ctx context.Context,
 	obj *kustomizev1.Kustomization) (sourcev1.Source, error) {
+	return r.getSourceRef(ctx, obj, obj.Spec.SourceRef)
+}
+
+func (r *KustomizationReconciler) getSourceRef(ctx context.Context,
+	obj *kustomizev1.Kustomization,
+	ref kustomizev1.CrossNamespaceSourceReference) (sourcev1.Source, error) {
 	var src sourcev1.Source
 	sourceNamespace := obj.GetNamespace()
-	if obj.Spec.SourceRef.Namespace != "" {
-		sourceNamespace = obj.Spec.SourceRef.Namespace
+	if ref.Namespace != "" {
+		sourceNamespace = ref.Namespace
 	}
 	namespacedName := types.NamespacedName{
 		Namespace: sourceNamespace,
-		Name:      obj.Spec.SourceRef.Name,
+		Name:      ref.Name,
 	}
 
 	if r.NoCrossNamespaceRefs && sourceNamespace != obj.GetNamespace() {
 		return src, acl.AccessDeniedError(
 			fmt.Sprintf("can't access '%s/%s', cross-namespace references have been blocked",
-				obj.Spec.SourceRef.Kind, namespacedName))
+				ref.Kind, namespacedName))
 	}
 
-	switch obj.Spec.SourceRef.Kind {
+	switch ref.Kind {
 	case sourcev1b2.OCIRepositoryKind:
 		var repository sourcev1b2.OCIRepository
 		err := r.Client.Get(ctx, namespacedName, &repository)
@@ -594,7 +885,7 @@ func (r *KustomizationReconciler) getSource(ctx context.Context,
 		src = &bucket
 	default:
 		return src, fmt.Errorf("source `%s` kind '%s' not supported",
-			obj.Spec.SourceRef.Name, obj.Spec.SourceRef.Kind)
+			ref.Name, ref.Kind)
 	}
 	return src, nil
 }
@@ -608,23 +899,74 @@ func (r *KustomizationReconciler) generate(obj unstructured.Unstructured,
 func (r *KustomizationReconciler) build(ctx context.Context,
 	obj *kustomizev1.Kustomization, u unstructured.Unstructured,
 	workDir, dirPath string) ([]byte, error) {
-	dec, cleanup, err := decryptor.NewTempDecryptor(workDir, r.Client, obj)
+	dec, cleanup, err := decryptor.NewTempDecryptor(workDir, r.Client, obj,
+		decryptor.WithDefaultServiceAccount(r.DefaultServiceAccount),
+		decryptor.WithCrossNamespaceSecret(r.CrossNSDecryptionSecret),
+		decryptor.WithDefaultSecret(r.DefaultDecryptionSecret),
+		decryptor.WithAgeKeyFiles(r.AgeKeyFiles),
+		decryptor.WithRemoteKeyServices(r.RemoteKeyServices),
+		decryptor.WithMaxFileSize(r.SOPSMaxFileSize),
+		decryptor.WithAzureCredentialCache(r.AzureCredentialCache),
+		decryptor.WithAzureVaultDNSSuffixes(r.AzureVaultDNSSuffixes),
+		decryptor.WithAzureTokenMetrics(r.AzureTokenMetrics),
+		decryptor.WithAWSEndpoints(r.AWSKMSEndpoint, r.AWSSTSEndpoint),
+		decryptor.WithGCPEndpoint(r.GCPKMSEndpoint),
+		decryptor.WithVaultLoginCache(r.VaultLoginCache),
+		decryptor.WithVaultAddressAllowlist(r.VaultAddressAllowlist),
+		decryptor.WithPGPKeyringCache(r.PGPKeyringCache),
+		decryptor.WithGnuPGHomeDir(r.GnuPGHomeDir),
+		decryptor.WithMetrics(r.DecryptionMetrics),
+		decryptor.WithLimiter(r.DecryptionLimiter),
+		decryptor.WithEventFunc(func(msg string) {
+			r.event(obj, "", "", eventv1.EventSeverityInfo, msg, nil)
+		}),
+		decryptor.WithWarningEventFunc(func(msg string) {
+			r.event(obj, "", "", eventv1.EventSeverityError, msg, nil)
+		}))
 	if err != nil {
 		return nil, err
 	}
 	defer cleanup()
 
-	// Import decryption keys
-	if err := dec.ImportKeys(ctx); err != nil {
+	// Import decryption keys, waiting up to the build timeout for a slot of
+	// the decryption limiter
+	importCtx, cancelImport := context.WithTimeout(ctx, obj.GetBuildTimeout())
+	defer cancelImport()
+	if err := dec.ImportKeys(importCtx); err != nil {
+		return nil, err
+	}
+
+	// Decrypt Kustomization files before they are read by the generator
+	if err := dec.DecryptKustomizationFiles(dirPath); err != nil {
+		return nil, fmt.Errorf("error decrypting kustomization files: %w", err)
+	}
+
+	// Generate kustomization.yaml if needed, after checking that the
+	// components it references are within the artifact
+	if err := checkComponentPaths(workDir, dirPath, obj.Spec.Components); err != nil {
+		return nil, err
+	}
+	if err := r.generate(u, workDir, dirPath); err != nil {
 		return nil, err
 	}
 
+	// Verify the decryption keys of the SOPS encrypted files are available before decrypting any of them
+	if !r.NoDecryptionPreflight {
+		if err := dec.PreflightCheck(dirPath); err != nil {
+			return nil, err
+		}
+	}
+
 	// Decrypt Kustomize EnvSources files before build
 	if err = dec.DecryptSources(dirPath); err != nil {
 		return nil, fmt.Errorf("error decrypting sources: %w", err)
 	}
 
-	m, err := generator.SecureBuild(workDir, dirPath, !r.NoRemoteBases)
+	restrictions, err := loadRestrictions(obj, r.AllowUnrestrictedLoad)
+	if err != nil {
+		return nil, err
+	}
+	m, err := secureBuild(workDir, dirPath, !r.NoRemoteBases, restrictions)
 	if err != nil {
 		return nil, fmt.Errorf("kustomize build failed: %w", err)
 	}
@@ -650,8 +992,25 @@ func (r *KustomizationReconciler) build(ctx context.Context,
 			}
 		}
 
+		// set the common metadata before the variable substitutions, so that
+		// its values are substituted as well
+		if cmeta := obj.Spec.CommonMetadata; cmeta != nil {
+			if err := setCommonMetadata(res, cmeta); err != nil {
+				return nil, fmt.Errorf("failed to set common metadata of '%s': %w", res.GetName(), err)
+			}
+		}
+
+		// set the target namespace metadata on the Namespace managed by the
+		// Kustomization, the namespaces which are not part of the manifests
+		// are never mutated
+		if tnmeta := obj.Spec.TargetNamespaceMetadata; tnmeta != nil && isTargetNamespace(res, obj.Spec.TargetNamespace) {
+			if err := setCommonMetadata(res, tnmeta); err != nil {
+				return nil, fmt.Errorf("failed to set target namespace metadata of '%s': %w", res.GetName(), err)
+			}
+		}
+
 		// run variable substitutions
-		if obj.Spec.PostBuild != nil {
+		if _, ok, _ := unstructured.NestedFieldNoCopy(u.Object, "spec", "postBuild"); ok {
 			outRes, err := generator.SubstituteVariables(ctx, r.Client, u, res,
 				generator.SubstituteWithStrict(r.StrictSubstitutions))
 			if err != nil {
@@ -680,17 +1039,14 @@ func (r *KustomizationReconciler) apply(ctx context.Context,
 	obj *kustomizev1.Kustomization,
 	revision string,
 	originRevision string,
-	objects []*unstructured.Unstructured) (bool, *ssa.ChangeSet, error) {
+	objects []*unstructured.Unstructured,
+	eventPrefix string) (bool, *ssa.ChangeSet, error) {
 	log := ctrl.LoggerFrom(ctx)
 
 	if err := normalize.UnstructuredList(objects); err != nil {
 		return false, nil, err
 	}
 
-	if cmeta := obj.Spec.CommonMetadata; cmeta != nil {
-		ssautil.SetCommonMetadata(objects, cmeta.Labels, cmeta.Annotations)
-	}
-
 	applyOpts := ssa.DefaultApplyOptions()
 	applyOpts.Force = obj.Spec.Force
 	applyOpts.ExclusionSelector = map[string]string{
@@ -790,9 +1146,13 @@ func (r *KustomizationReconciler) apply(ctx context.Context,
 
 	var changeSetLog strings.Builder
 
+	// contains the diff of the changed objects if enabled
+	var diffLog strings.Builder
+
 	// validate, apply and wait for CRDs and Namespaces to register
 	if len(defStage) > 0 {
-		changeSet, err := manager.ApplyAll(ctx, defStage, applyOpts)
+		diffs := r.diffObjects(ctx, manager, obj, defStage)
+		changeSet, err := applyAll(ctx, manager, defStage, applyOpts, obj.Spec.ForceKinds)
 		if err != nil {
 			return false, nil, err
 		}
@@ -808,12 +1168,13 @@ func (r *KustomizationReconciler) apply(ctx context.Context,
 			for _, change := range changeSet.Entries {
 				if HasChanged(change.Action) {
 					changeSetLog.WriteString(change.String() + "\n")
+					diffLog.WriteString(diffs[change.Subject])
 				}
 			}
 
 			if err := manager.WaitForSet(changeSet.ToObjMetadataSet(), ssa.WaitOptions{
 				Interval: 2 * time.Second,
-				Timeout:  obj.GetTimeout(),
+				Timeout:  obj.GetApplyTimeout(),
 			}); err != nil {
 				return false, nil, err
 			}
@@ -822,7 +1183,8 @@ func (r *KustomizationReconciler) apply(ctx context.Context,
 
 	// validate, apply and wait for Class type objects to register
 	if len(classStage) > 0 {
-		changeSet, err := manager.ApplyAll(ctx, classStage, applyOpts)
+		diffs := r.diffObjects(ctx, manager, obj, classStage)
+		changeSet, err := applyAll(ctx, manager, classStage, applyOpts, obj.Spec.ForceKinds)
 		if err != nil {
 			return false, nil, err
 		}
@@ -831,55 +1193,106 @@ func (r *KustomizationReconciler) apply(ctx context.Context,
 			resultSet.Append(changeSet.Entries)
 
 			if r.GroupChangeLog {
-				log.Info("server-side apply for cluster definitions completed", "output", changeSet.ToGroupedMap())
+				log.Info("server-side apply for cluster class types completed", "output", changeSet.ToGroupedMap())
 			} else {
 				log.Info("server-side apply for cluster class types completed", "output", changeSet.ToMap())
 			}
 			for _, change := range changeSet.Entries {
 				if HasChanged(change.Action) {
 					changeSetLog.WriteString(change.String() + "\n")
+					diffLog.WriteString(diffs[change.Subject])
 				}
 			}
 
 			if err := manager.WaitForSet(changeSet.ToObjMetadataSet(), ssa.WaitOptions{
 				Interval: 2 * time.Second,
-				Timeout:  obj.GetTimeout(),
+				Timeout:  obj.GetApplyTimeout(),
 			}); err != nil {
 				return false, nil, err
 			}
 		}
 	}
 
-	// sort by kind, validate and apply all the others objects
-	sort.Sort(ssa.SortableUnstructureds(resStage))
-	if len(resStage) > 0 {
-		changeSet, err := manager.ApplyAll(ctx, resStage, applyOpts)
-		if err != nil {
-			return false, nil, fmt.Errorf("%w\n%s", err, changeSetLog.String())
+	// split the others objects in the stages of the spec if any
+	stages, err := applyStages(obj.Spec.Stages, obj.GetHealthCheckTimeout(), resStage)
+	if err != nil {
+		return false, nil, err
+	}
+
+	// emit event only if the server-side apply resulted in changes, with
+	// the diff truncated to the byte budget in the event metadata
+	emitChanges := func() string {
+		applyLog := strings.TrimSuffix(changeSetLog.String(), "\n")
+		if applyLog != "" {
+			var metadata map[string]string
+			if diffLog.Len() > 0 {
+				diff := truncateDiff(strings.TrimSuffix(diffLog.String(), "\n"), r.EventDiffMaxBytes)
+				log.V(logger.DebugLevel).Info("server-side apply diff", "diff", diff, "revision", revision)
+				metadata = map[string]string{kustomizev1.GroupVersion.Group + "/" + diffMetaKey: diff}
+			}
+			r.event(obj, revision, originRevision, eventv1.EventSeverityInfo, eventPrefix+applyLog, metadata)
 		}
+		return applyLog
+	}
 
-		if changeSet != nil && len(changeSet.Entries) > 0 {
-			resultSet.Append(changeSet.Entries)
+	// stageFailed reports the changes of the stages applied so far, and
+	// returns their objects to be tracked in the inventory
+	stageFailed := func(stage applyStage, err error) (bool, *ssa.ChangeSet, error) {
+		emitChanges()
+		if stage.gated() {
+			err = &stageError{Name: stage.name, Index: stage.index, Total: len(obj.Spec.Stages), Err: err}
+		}
+		return false, resultSet, err
+	}
 
-			if r.GroupChangeLog {
-				log.Info("server-side apply for cluster definitions completed", "output", changeSet.ToGroupedMap())
-			} else {
-				log.Info("server-side apply completed", "output", changeSet.ToMap(), "revision", revision)
+	for _, stage := range stages {
+		// sort by kind, validate and apply the objects of the stage, in the
+		// stages of the custom apply order if any
+		for _, orderStage := range applyOrderStages(obj.Spec.ApplyOrder, stage.objects) {
+			sort.Sort(ssa.SortableUnstructureds(orderStage))
+			diffs := r.diffObjects(ctx, manager, obj, orderStage)
+			changeSet, err := applyAll(ctx, manager, orderStage, applyOpts, obj.Spec.ForceKinds)
+			if err != nil {
+				err = fmt.Errorf("%w\n%s", err, changeSetLog.String())
+				if len(obj.Spec.Stages) > 0 {
+					return stageFailed(stage, err)
+				}
+				return false, nil, err
 			}
-			for _, change := range changeSet.Entries {
-				if HasChanged(change.Action) {
-					changeSetLog.WriteString(change.String() + "\n")
+
+			if changeSet != nil && len(changeSet.Entries) > 0 {
+				resultSet.Append(changeSet.Entries)
+
+				if r.GroupChangeLog {
+					log.Info("server-side apply completed", "output", changeSet.ToGroupedMap(), "revision", revision)
+				} else {
+					log.Info("server-side apply completed", "output", changeSet.ToMap(), "revision", revision)
+				}
+				for _, change := range changeSet.Entries {
+					if HasChanged(change.Action) {
+						changeSetLog.WriteString(change.String() + "\n")
+						diffLog.WriteString(diffs[change.Subject])
+					}
 				}
 			}
 		}
-	}
 
-	// emit event only if the server-side apply resulted in changes
-	applyLog := strings.TrimSuffix(changeSetLog.String(), "\n")
-	if applyLog != "" {
-		r.event(obj, revision, originRevision, eventv1.EventSeverityInfo, applyLog, nil)
+		// wait for the objects of the stage to become ready before applying
+		// the next stages
+		if stage.gated() {
+			toCheck, _ := ignoreWaitObjects(obj.Spec.WaitIgnore, object.UnstructuredSetToObjMetadataSet(stage.objects))
+			if err := manager.WaitForSet(toCheck, ssa.WaitOptions{
+				Interval: 2 * time.Second,
+				Timeout:  stage.timeout,
+				FailFast: r.FailFast,
+			}); err != nil {
+				return stageFailed(stage, fmt.Errorf("health check failed after %s: %w", stage.timeout.String(), err))
+			}
+			log.Info(fmt.Sprintf("stage '%s' applied and healthy", stage.name), "revision", revision)
+		}
 	}
 
+	applyLog := emitChanges()
 	return applyLog != "", resultSet, nil
 }
 
@@ -891,19 +1304,32 @@ func (r *KustomizationReconciler) checkHealth(ctx context.Context,
 	originRevision string,
 	isNewRevision bool,
 	drifted bool,
+	healthChecks []kustomizev1.HealthCheck,
+	applied []*unstructured.Unstructured,
 	objects object.ObjMetadataSet) error {
-	if len(obj.Spec.HealthChecks) == 0 && !obj.Spec.Wait {
+	if len(healthChecks) == 0 && len(obj.Spec.HealthCheckSelectors) == 0 && !obj.Spec.Wait {
 		conditions.Delete(obj, meta.HealthyCondition)
 		return nil
 	}
 
 	checkStart := time.Now()
 	var err error
-	if !obj.Spec.Wait {
-		objects, err = inventory.ReferenceToObjMetadataSet(obj.Spec.HealthChecks)
+	var ignored object.ObjMetadataSet
+	var timeouts map[object.ObjMetadata]time.Duration
+	if obj.Spec.Wait {
+		objects, ignored = ignoreWaitObjects(obj.Spec.WaitIgnore, objects)
+	} else {
+		objects, timeouts, err = healthCheckObjects(healthChecks)
 		if err != nil {
 			return err
 		}
+
+		selected, err := selectHealthChecks(obj.Spec.HealthCheckSelectors, applied)
+		if err != nil {
+			conditions.MarkFalse(obj, meta.HealthyCondition, meta.HealthCheckFailedReason, "%s", err)
+			return err
+		}
+		objects = objects.Union(selected)
 	}
 
 	if len(objects) == 0 {
@@ -926,7 +1352,8 @@ func (r *KustomizationReconciler) checkHealth(ctx context.Context,
 	wasHealthy := apimeta.IsStatusConditionTrue(obj.Status.Conditions, meta.HealthyCondition)
 
 	// Update status with the reconciliation progress.
-	message := fmt.Sprintf("Running health checks for revision %s with a timeout of %s", revision, obj.GetTimeout().String())
+	groups := groupHealthChecks(toCheck, timeouts, obj.GetHealthCheckTimeout())
+	message := fmt.Sprintf("Running health checks for revision %s with a timeout of %s", revision, maxHealthCheckTimeout(groups).String())
 	conditions.MarkReconciling(obj, meta.ProgressingReason, "%s", message)
 	conditions.MarkUnknown(obj, meta.HealthyCondition, meta.ProgressingReason, "%s", message)
 	if err := r.patch(ctx, obj, patcher); err != nil {
@@ -934,18 +1361,43 @@ func (r *KustomizationReconciler) checkHealth(ctx context.Context,
 	}
 
 	// Check the health with a default timeout of 30sec shorter than the reconciliation interval.
-	if err := manager.WaitForSet(toCheck, ssa.WaitOptions{
-		Interval: 5 * time.Second,
-		Timeout:  obj.GetTimeout(),
-		FailFast: r.FailFast,
-	}); err != nil {
-		conditions.MarkFalse(obj, meta.ReadyCondition, meta.HealthCheckFailedReason, "%s", err)
-		conditions.MarkFalse(obj, meta.HealthyCondition, meta.HealthCheckFailedReason, "%s", err)
-		return fmt.Errorf("health check failed after %s: %w", time.Since(checkStart).String(), err)
+	// The wait has its own deadline, the health context only tells if it has been reached.
+	var healthCheckTimeout *metav1.Duration
+	if obj.Spec.Timeouts != nil {
+		healthCheckTimeout = obj.Spec.Timeouts.HealthCheck
+	}
+	// The groups of objects with overridden timeouts are waited for in turn,
+	// each until its own deadline counted from the start of the checks.
+	healthCtx, cancelHealth := context.WithTimeout(ctx, obj.GetHealthCheckTimeout())
+	defer cancelHealth()
+	for _, group := range groups {
+		interval := 5 * time.Second
+		if err := manager.WaitForSet(group.objects, ssa.WaitOptions{
+			Interval: interval,
+			Timeout:  max(group.timeout-time.Since(checkStart), interval),
+			FailFast: r.FailFast,
+		}); err != nil {
+			if group.overridden {
+				err = healthCheckTimeoutError(group, err)
+			} else {
+				err = checkPhaseTimeout(healthCtx, "health check", healthCheckTimeout, kustomizev1.HealthCheckTimeoutReason, err)
+			}
+			reason := meta.HealthCheckFailedReason
+			var timeoutErr *phaseTimeoutError
+			if errors.As(err, &timeoutErr) {
+				reason = timeoutErr.Reason
+			}
+			conditions.MarkFalse(obj, meta.ReadyCondition, reason, "%s", err)
+			conditions.MarkFalse(obj, meta.HealthyCondition, reason, "%s", err)
+			return fmt.Errorf("health check failed after %s: %w", time.Since(checkStart).String(), err)
+		}
 	}
 
 	// Emit recovery event if the previous health check failed.
 	msg := fmt.Sprintf("Health check passed in %s", time.Since(checkStart).String())
+	if len(ignored) > 0 {
+		msg = fmt.Sprintf("%s, excluded by waitIgnore: %s", msg, formatObjMetadataSet(ignored))
+	}
 	if !wasHealthy || (isNewRevision && drifted) {
 		r.event(obj, revision, originRevision, eventv1.EventSeverityInfo, msg, nil)
 	}
@@ -970,58 +1422,92 @@ func (r *KustomizationReconciler) prune(ctx context.Context,
 
 	log := ctrl.LoggerFrom(ctx)
 
-	opts := ssa.DeleteOptions{
-		PropagationPolicy: metav1.DeletePropagationBackground,
-		Inclusions:        manager.GetOwnerLabels(obj.Name, obj.Namespace),
-		Exclusions: map[string]string{
-			fmt.Sprintf("%s/prune", kustomizev1.GroupVersion.Group):     kustomizev1.DisabledValue,
-			fmt.Sprintf("%s/reconcile", kustomizev1.GroupVersion.Group): kustomizev1.DisabledValue,
-		},
+	opts, err := pruneDeleteOptions(manager, obj)
+	if err != nil {
+		return false, err
 	}
 
-	changeSet, err := manager.DeleteAll(ctx, objects, opts)
+	objects, err = r.skipPruneProtected(ctx, manager.Client(), obj, revision, originRevision, objects)
+	if err != nil {
+		return false, err
+	}
+
+	changeSet, err := deleteAll(ctx, manager, objects, opts, obj.Spec.ApplyOrder)
 	if err != nil {
 		return false, err
 	}
 
 	// emit event only if the prune operation resulted in changes
-	if changeSet != nil && len(changeSet.Entries) > 0 {
+	changed := changeSet != nil && len(changeSet.Entries) > 0
+	if changed {
 		log.Info(fmt.Sprintf("garbage collection completed: %s", changeSet.String()))
 		r.event(obj, revision, originRevision, eventv1.EventSeverityInfo, changeSet.String(), nil)
-		return true, nil
 	}
 
-	return false, nil
+	// Wait for the deleted objects to be gone, and keep the ones still
+	// terminating at the timeout in the inventory to retry.
+	if obj.GetPruneWait() || opts.PropagationPolicy == metav1.DeletePropagationForeground {
+		if deleted := deletedObjects(objects, changeSet); len(deleted) > 0 {
+			if err := waitForTermination(ctx, manager, deleted, obj.GetPruneWaitTimeout()); err != nil {
+				var timeoutErr *terminationTimeoutError
+				if errors.As(err, &timeoutErr) {
+					obj.Status.Inventory = addToInventory(obj.Status.Inventory,
+						terminatingChangeSet(changeSet, timeoutErr.Objects))
+				}
+				return changed, err
+			}
+		}
+	}
+
+	return changed, nil
 }
 
 func finalizerShouldDeleteResources(obj *kustomizev1.Kustomization) bool {
-	if obj.GetDeletionPolicy() == kustomizev1.DeletionPolicyMirrorPrune {
+	switch obj.GetDeletionPolicy() {
+	case kustomizev1.DeletionPolicyMirrorPrune:
 		return obj.Spec.Prune
+	case kustomizev1.DeletionPolicyDelete, kustomizev1.DeletionPolicyWaitForTermination:
+		return true
+	default:
+		return false
 	}
-	return obj.Spec.DeletionPolicy == kustomizev1.DeletionPolicyDelete
+}
+
+// deletedObjects returns the objects which have been deleted according to
+// the given change set.
+func deletedObjects(objects []*unstructured.Unstructured, changeSet *ssa.ChangeSet) []*unstructured.Unstructured {
+	if changeSet == nil {
+		return nil
+	}
+	deleted := make(map[object.ObjMetadata]bool, len(changeSet.Entries))
+	for _, entry := range changeSet.Entries {
+		if entry.Action == ssa.DeletedAction {
+			deleted[entry.ObjMetadata] = true
+		}
+	}
+	var result []*unstructured.Unstructured
+	for _, u := range objects {
+		if deleted[object.UnstructuredToObjMetadata(u)] {
+			result = append(result, u)
+		}
+	}
+	return result
 }
 
 func (r *KustomizationReconciler) finalize(ctx context.Context,
 	obj *kustomizev1.Kustomization) (ctrl.Result, error) {
 	log := ctrl.LoggerFrom(ctx)
+	r.driftCache.delete(client.ObjectKeyFromObject(obj))
+
 	if finalizerShouldDeleteResources(obj) &&
 		!obj.Spec.Suspend &&
 		obj.Status.Inventory != nil &&
 		obj.Status.Inventory.Entries != nil {
 		objects, _ := inventory.List(obj.Status.Inventory)
 
-		impersonation := runtimeClient.NewImpersonator(
-			r.Client,
-			r.StatusPoller,
-			r.PollingOpts,
-			obj.Spec.KubeConfig,
-			r.KubeConfigOpts,
-			r.DefaultServiceAccount,
-			obj.Spec.ServiceAccountName,
-			obj.GetNamespace(),
-		)
+		impersonation := r.newImpersonator(obj, r.StatusPoller, r.PollingOpts)
 		if impersonation.CanImpersonate(ctx) {
-			kubeClient, _, err := impersonation.GetClient(ctx)
+			kubeClient, _, err := r.getKubeClient(ctx, obj, impersonation, r.PollingOpts)
 			if err != nil {
 				return ctrl.Result{}, err
 			}
@@ -1031,16 +1517,20 @@ func (r *KustomizationReconciler) finalize(ctx context.Context,
 				Group: kustomizev1.GroupVersion.Group,
 			})
 
-			opts := ssa.DeleteOptions{
-				PropagationPolicy: metav1.DeletePropagationBackground,
-				Inclusions:        resourceManager.GetOwnerLabels(obj.Name, obj.Namespace),
-				Exclusions: map[string]string{
-					fmt.Sprintf("%s/prune", kustomizev1.GroupVersion.Group):     kustomizev1.DisabledValue,
-					fmt.Sprintf("%s/reconcile", kustomizev1.GroupVersion.Group): kustomizev1.DisabledValue,
-				},
+			opts, err := pruneDeleteOptions(resourceManager, obj)
+			if err != nil {
+				r.event(obj, obj.Status.LastAppliedRevision, obj.Status.LastAppliedOriginRevision, eventv1.EventSeverityError, err.Error(), nil)
+				return ctrl.Result{}, err
+			}
+
+			objects, err = r.skipPruneProtected(ctx, kubeClient, obj,
+				obj.Status.LastAppliedRevision, obj.Status.LastAppliedOriginRevision, objects)
+			if err != nil {
+				r.event(obj, obj.Status.LastAppliedRevision, obj.Status.LastAppliedOriginRevision, eventv1.EventSeverityError, "pruning for deleted resource failed", nil)
+				return ctrl.Result{}, err
 			}
 
-			changeSet, err := resourceManager.DeleteAll(ctx, objects, opts)
+			changeSet, err := deleteAll(ctx, resourceManager, objects, opts, obj.Spec.ApplyOrder)
 			if err != nil {
 				r.event(obj, obj.Status.LastAppliedRevision, obj.Status.LastAppliedOriginRevision, eventv1.EventSeverityError, "pruning for deleted resource failed", nil)
 				// Return the error so we retry the failed garbage collection
@@ -1050,6 +1540,26 @@ func (r *KustomizationReconciler) finalize(ctx context.Context,
 			if changeSet != nil && len(changeSet.Entries) > 0 {
 				r.event(obj, obj.Status.LastAppliedRevision, obj.Status.LastAppliedOriginRevision, eventv1.EventSeverityInfo, changeSet.String(), nil)
 			}
+
+			// Wait for the deleted objects to be gone. With the prune wait,
+			// the finalizer is kept at the timeout to retry the finalization,
+			// otherwise the wait gives up to not block the deletion of the
+			// Kustomization forever.
+			if obj.GetDeletionPolicy() == kustomizev1.DeletionPolicyWaitForTermination ||
+				obj.GetPruneWait() ||
+				opts.PropagationPolicy == metav1.DeletePropagationForeground {
+				if deleted := deletedObjects(objects, changeSet); len(deleted) > 0 {
+					if err := waitForTermination(ctx, resourceManager, deleted, obj.GetPruneWaitTimeout()); err != nil {
+						msg := fmt.Sprintf("waiting for the termination of the deleted resources failed: %s", err.Error())
+						log.Error(err, "waiting for termination failed")
+						r.event(obj, obj.Status.LastAppliedRevision, obj.Status.LastAppliedOriginRevision, eventv1.EventSeverityError, msg, nil)
+						if obj.GetPruneWait() {
+							conditions.MarkFalse(obj, meta.ReadyCondition, meta.PruneFailedReason, "%s", msg)
+							return ctrl.Result{}, err
+						}
+					}
+				}
+			}
 		} else {
 			// when the account to impersonate is gone, log the stale objects and continue with the finalization
 			msg := fmt.Sprintf("unable to prune objects: \n%s", ssautil.FmtUnstructuredList(objects))
@@ -1058,6 +1568,8 @@ func (r *KustomizationReconciler) finalize(ctx context.Context,
 		}
 	}
 
+	r.healthCheckExprs.delete(client.ObjectKeyFromObject(obj))
+
 	// Remove our finalizer from the list and update it
 	controllerutil.RemoveFinalizer(obj, kustomizev1.KustomizationFinalizer)
 	// Stop reconciliation as the object is being deleted
@@ -1129,6 +1641,10 @@ func (r *KustomizationReconciler) patch(ctx context.Context,
 		meta.ReadyCondition,
 		meta.ReconcilingCondition,
 		meta.StalledCondition,
+		kustomizev1.RevisionPinnedCondition,
+		kustomizev1.RolledBackCondition,
+		kustomizev1.SuspendedCondition,
+		kustomizev1.EventDrivenCondition,
 	}
 	patchOpts = append(patchOpts,
 		patch.WithOwnedConditions{Conditions: ownedConditions},
@@ -1163,7 +1679,8 @@ func getOriginRevision(src sourcev1.Source) string {
 
 // getPollerAndOptions returns the status poller and polling options
 // based on the healthcheck expressions defined in the Kustomization
-// object spec.
+// object spec. The expressions are compiled on the first reconciliation
+// and again only when they change.
 func (r *KustomizationReconciler) getPollerAndOptions(ctx context.Context,
 	obj *kustomizev1.Kustomization) (*polling.StatusPoller, polling.Options, error) {
 
@@ -1171,12 +1688,17 @@ func (r *KustomizationReconciler) getPollerAndOptions(ctx context.Context,
 	opts := r.PollingOpts
 
 	if hc := obj.Spec.HealthCheckExprs; len(hc) > 0 {
-		var err error
-		opts, err = cel.PollerWithCustomHealthChecks(ctx, opts, hc, r.Mapper)
+		evaluators, err := r.healthCheckExprs.get(client.ObjectKeyFromObject(obj), hc)
 		if err != nil {
 			return nil, polling.Options{}, err
 		}
 
+		readers := slices.Clone(opts.CustomStatusReaders)
+		for _, e := range evaluators {
+			readers = append(readers, newHealthCheckStatusReader(ctx, r.Mapper, e))
+		}
+		opts.CustomStatusReaders = readers
+
 		poller = polling.NewStatusPoller(r.Client, r.Mapper, opts)
 	}
 
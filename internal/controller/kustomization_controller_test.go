@@ -19,10 +19,12 @@ package controller
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
 	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/jitter"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
@@ -75,7 +77,7 @@ func TestKustomizationReconciler_StagedApply(t *testing.T) {
 			Namespace: repositoryName.Namespace,
 			Kind:      sourcev1.GitRepositoryKind,
 		},
-		KubeConfig: &meta.KubeConfigReference{
+		KubeConfig: &kustomizev1.KubeConfigReference{
 			SecretRef: meta.SecretKeyReference{
 				Name: "kubeconfig",
 			},
@@ -136,3 +138,48 @@ func TestKustomizationReconciler_deleteBeforeFinalizer(t *testing.T) {
 	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(kustomization)})
 	g.Expect(err).NotTo(HaveOccurred())
 }
+
+func Test_requeueInterval(t *testing.T) {
+	g := NewWithT(t)
+
+	// The jitter is passed in rather than set globally, which could be done
+	// only once and would apply to the other tests of the package as well.
+	jitterFn := jitter.Percent(0.1, rand.New(rand.NewSource(1)))
+
+	obj := &kustomizev1.Kustomization{
+		Spec: kustomizev1.KustomizationSpec{
+			Interval:      metav1.Duration{Duration: 10 * time.Minute},
+			RetryInterval: &metav1.Duration{Duration: time.Minute},
+		},
+	}
+
+	intervals := make(map[time.Duration]struct{})
+	for i := 0; i < 100; i++ {
+		d := requeueInterval(obj, jitterFn)
+		g.Expect(d).To(BeNumerically(">=", 9*time.Minute))
+		g.Expect(d).To(BeNumerically("<=", 11*time.Minute))
+		intervals[d] = struct{}{}
+	}
+	g.Expect(len(intervals)).To(BeNumerically(">", 1), "the requeue intervals should be spread")
+
+	// The retry interval is not jittered.
+	g.Expect(obj.GetRetryInterval()).To(Equal(time.Minute))
+
+	// An event-driven Kustomization is not requeued.
+	obj.Spec.Interval = metav1.Duration{}
+	g.Expect(requeueInterval(obj, jitterFn)).To(BeZero())
+	g.Expect(obj.GetRetryInterval()).To(Equal(time.Minute))
+
+	// An event-driven Kustomization with a drift interval is requeued at
+	// the drift interval.
+	obj.Spec.DriftInterval = &metav1.Duration{Duration: 2 * time.Minute}
+	d := requeueInterval(obj, jitterFn)
+	g.Expect(d).To(BeNumerically(">=", 108*time.Second))
+	g.Expect(d).To(BeNumerically("<=", 132*time.Second))
+
+	// The drift interval applies only when it is shorter than the interval.
+	obj.Spec.Interval = metav1.Duration{Duration: time.Minute}
+	g.Expect(reconcileInterval(obj)).To(Equal(time.Minute))
+	obj.Spec.Interval = metav1.Duration{Duration: 10 * time.Minute}
+	g.Expect(reconcileInterval(obj)).To(Equal(2 * time.Minute))
+}
@@ -19,21 +19,32 @@ package controller
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	apiacl "github.com/fluxcd/pkg/apis/acl"
 	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/testserver"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	"github.com/getsops/sops/v3/keyservice"
 	"github.com/hashicorp/vault/api"
 	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	intage "github.com/fluxcd/kustomize-controller/internal/sops/age"
+	intkeyservice "github.com/fluxcd/kustomize-controller/internal/sops/keyservice"
 )
 
 func TestKustomizationReconciler_Decryptor(t *testing.T) {
@@ -113,7 +124,7 @@ func TestKustomizationReconciler_Decryptor(t *testing.T) {
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: 2 * time.Minute},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -125,7 +136,7 @@ func TestKustomizationReconciler_Decryptor(t *testing.T) {
 			},
 			Decryption: &kustomizev1.Decryption{
 				Provider: "sops",
-				SecretRef: &meta.LocalObjectReference{
+				SecretRef: &meta.NamespacedObjectReference{
 					Name: sopsSecretKey.Name,
 				},
 			},
@@ -176,6 +187,15 @@ func TestKustomizationReconciler_Decryptor(t *testing.T) {
 		g.Expect(string(patchedSecret.Data["merge2"])).To(Equal("merge2"))
 	})
 
+	t.Run("removes the imported keys after reconciliation", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// Other reconciliations may briefly create GnuPG home directories.
+		g.Eventually(func() ([]os.DirEntry, error) {
+			return os.ReadDir(reconciler.GnuPGHomeDir)
+		}, timeout, time.Second).Should(BeEmpty())
+	})
+
 	t.Run("does not emit change events for identical secrets", func(t *testing.T) {
 		g := NewWithT(t)
 
@@ -195,3 +215,666 @@ func TestKustomizationReconciler_Decryptor(t *testing.T) {
 		g.Expect(events[0].Message).ShouldNot(ContainSubstring("configured"))
 	})
 }
+
+func TestKustomizationReconciler_CrossNamespaceDecryptionSecret(t *testing.T) {
+	g := NewWithT(t)
+
+	id := "sops-xns-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	secretData, err := os.ReadFile("testdata/sops/algorithms/age.yaml")
+	g.Expect(err).ToNot(HaveOccurred())
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{Name: "secret.yaml", Body: string(secretData)},
+	})
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      randStringRunes(5),
+		Namespace: id,
+	}
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// The age key is held in a namespace other than the one of the
+	// Kustomization.
+	keysNamespace := fmt.Sprintf("keys-%s", id)
+	err = createNamespace(keysNamespace)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create keys namespace")
+
+	ageKey, err := os.ReadFile("testdata/sops/keys/age.txt")
+	g.Expect(err).ToNot(HaveOccurred())
+	sopsSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sops-age",
+			Namespace: keysNamespace,
+		},
+		StringData: map[string]string{
+			"age.agekey": string(ageKey),
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), sopsSecret)).To(Succeed())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("sops-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Decryption: &kustomizev1.Decryption{
+				Provider: "sops",
+				SecretRef: &meta.NamespacedObjectReference{
+					Name:      sopsSecret.Name,
+					Namespace: sopsSecret.Namespace,
+				},
+			},
+			TargetNamespace: id,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	t.Run("fails to reconcile with cross-namespace decryption Secret", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var readyCondition *metav1.Condition
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			readyCondition = apimeta.FindStatusCondition(resultK.Status.Conditions, meta.ReadyCondition)
+			return apimeta.IsStatusConditionFalse(resultK.Status.Conditions, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(readyCondition.Reason).To(Equal(apiacl.AccessDeniedReason))
+		g.Expect(readyCondition.Message).To(ContainSubstring("--allow-cross-namespace-decryption-secret=false"))
+	})
+
+	t.Run("reconciles with allowed cross-namespace decryption Secret", func(t *testing.T) {
+		g := NewWithT(t)
+
+		reconciler.CrossNSDecryptionSecret = true
+		defer func() {
+			reconciler.CrossNSDecryptionSecret = false
+		}()
+
+		revision = "v2.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		var secret corev1.Secret
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "age", Namespace: id}, &secret)).To(Succeed())
+		g.Expect(string(secret.Data["key"])).To(Equal("value"))
+	})
+}
+
+func TestKustomizationReconciler_DefaultDecryptionSecret(t *testing.T) {
+	g := NewWithT(t)
+
+	id := "sops-default-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	secretData, err := os.ReadFile("testdata/sops/algorithms/age.yaml")
+	g.Expect(err).ToNot(HaveOccurred())
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{Name: "secret.yaml", Body: string(secretData)},
+	})
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      randStringRunes(5),
+		Namespace: id,
+	}
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// The default decryption Secret is held in a namespace other than the
+	// one of the Kustomization, while cross-namespace decryption Secret
+	// references remain blocked.
+	keysNamespace := fmt.Sprintf("keys-%s", id)
+	err = createNamespace(keysNamespace)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create keys namespace")
+
+	ageKey, err := os.ReadFile("testdata/sops/keys/age.txt")
+	g.Expect(err).ToNot(HaveOccurred())
+	defaultSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sops-age",
+			Namespace: keysNamespace,
+		},
+		StringData: map[string]string{
+			"age.agekey": string(ageKey),
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), defaultSecret)).To(Succeed())
+	emptySecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sops-empty",
+			Namespace: keysNamespace,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), emptySecret)).To(Succeed())
+	overrideSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sops-age",
+			Namespace: id,
+		},
+		StringData: map[string]string{
+			"age.agekey": string(ageKey),
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), overrideSecret)).To(Succeed())
+
+	reconciler.DefaultDecryptionSecret = &meta.NamespacedObjectReference{
+		Name:      defaultSecret.Name,
+		Namespace: defaultSecret.Namespace,
+	}
+	defer func() {
+		reconciler.DefaultDecryptionSecret = nil
+	}()
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("sops-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Decryption: &kustomizev1.Decryption{
+				Provider: "sops",
+			},
+			TargetNamespace: id,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	t.Run("reconciles with default decryption Secret", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		var secret corev1.Secret
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "age", Namespace: id}, &secret)).To(Succeed())
+		g.Expect(string(secret.Data["key"])).To(Equal("value"))
+	})
+
+	t.Run("reconciles with secretRef overriding default decryption Secret", func(t *testing.T) {
+		g := NewWithT(t)
+
+		reconciler.DefaultDecryptionSecret = &meta.NamespacedObjectReference{
+			Name:      emptySecret.Name,
+			Namespace: emptySecret.Namespace,
+		}
+
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)).To(Succeed())
+		patch := client.MergeFrom(resultK.DeepCopy())
+		resultK.Spec.Decryption.SecretRef = &meta.NamespacedObjectReference{Name: overrideSecret.Name}
+		g.Expect(k8sClient.Patch(context.Background(), resultK, patch)).To(Succeed())
+
+		revision = "v2.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+	})
+
+	t.Run("fails to reconcile with missing default decryption Secret", func(t *testing.T) {
+		g := NewWithT(t)
+
+		reconciler.DefaultDecryptionSecret = &meta.NamespacedObjectReference{
+			Name:      "missing",
+			Namespace: keysNamespace,
+		}
+
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)).To(Succeed())
+		patch := client.MergeFrom(resultK.DeepCopy())
+		resultK.Spec.Decryption.SecretRef = nil
+		g.Expect(k8sClient.Patch(context.Background(), resultK, patch)).To(Succeed())
+
+		revision = "v3.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		var readyCondition *metav1.Condition
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			readyCondition = apimeta.FindStatusCondition(resultK.Status.Conditions, meta.ReadyCondition)
+			return apimeta.IsStatusConditionFalse(resultK.Status.Conditions, meta.ReadyCondition) &&
+				resultK.Status.LastAttemptedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(readyCondition.Reason).To(Equal(kustomizev1.DecryptionKeysMissingReason))
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal("v2.0.0"))
+	})
+}
+
+func TestKustomizationReconciler_AgeKeyFile(t *testing.T) {
+	g := NewWithT(t)
+
+	id := "sops-keyfile-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	secretData, err := os.ReadFile("testdata/sops/algorithms/age.yaml")
+	g.Expect(err).ToNot(HaveOccurred())
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{Name: "secret.yaml", Body: string(secretData)},
+	})
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      randStringRunes(5),
+		Namespace: id,
+	}
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// The age key is mounted into the controller instead of being held in
+	// a decryption Secret.
+	ageKey, err := os.ReadFile("testdata/sops/keys/age.txt")
+	g.Expect(err).ToNot(HaveOccurred())
+	keyFile := filepath.Join(t.TempDir(), "keys.txt")
+	g.Expect(os.WriteFile(keyFile, ageKey, 0o600)).To(Succeed())
+
+	reconciler.AgeKeyFiles = []*intage.IdentityFile{intage.NewIdentityFile(keyFile)}
+	defer func() {
+		reconciler.AgeKeyFiles = nil
+	}()
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("sops-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Decryption: &kustomizev1.Decryption{
+				Provider: "sops",
+			},
+			TargetNamespace: id,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	var secret corev1.Secret
+	g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "age", Namespace: id}, &secret)).To(Succeed())
+	g.Expect(string(secret.Data["key"])).To(Equal("value"))
+}
+
+func TestKustomizationReconciler_RemoteKeyService(t *testing.T) {
+	g := NewWithT(t)
+
+	id := "sops-ks-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	secretData, err := os.ReadFile("testdata/sops/algorithms/age.yaml")
+	g.Expect(err).ToNot(HaveOccurred())
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{Name: "secret.yaml", Body: string(secretData)},
+	})
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      randStringRunes(5),
+		Namespace: id,
+	}
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// The age key is only available to a stub key service, which is served
+	// on a Unix socket.
+	ageKey, err := os.ReadFile("testdata/sops/keys/age.txt")
+	g.Expect(err).ToNot(HaveOccurred())
+	identities, err := intage.ParseIdentities(ageKey, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	dir, err := os.MkdirTemp("", "ks")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+	lis, err := net.Listen("unix", filepath.Join(dir, "ks.sock"))
+	g.Expect(err).ToNot(HaveOccurred())
+	server := grpc.NewServer()
+	keyservice.RegisterKeyServiceServer(server, intkeyservice.NewServer(intkeyservice.WithAgeIdentities(identities)))
+	go func() { _ = server.Serve(lis) }()
+	defer server.Stop()
+
+	remote, err := intkeyservice.NewRemoteClient("unix://" + lis.Addr().String())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer remote.Close()
+
+	reconciler.RemoteKeyServices = []keyservice.KeyServiceClient{remote}
+	defer func() {
+		reconciler.RemoteKeyServices = nil
+	}()
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("sops-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Decryption: &kustomizev1.Decryption{
+				Provider: "sops",
+			},
+			TargetNamespace: id,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	t.Run("reconciles with data key decrypted by remote key service", func(t *testing.T) {
+		g := NewWithT(t)
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		var secret corev1.Secret
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "age", Namespace: id}, &secret)).To(Succeed())
+		g.Expect(string(secret.Data["key"])).To(Equal("value"))
+	})
+
+	t.Run("fails to reconcile with unavailable remote key service", func(t *testing.T) {
+		g := NewWithT(t)
+
+		server.Stop()
+
+		revision = "v2.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		var readyCondition *metav1.Condition
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			readyCondition = apimeta.FindStatusCondition(resultK.Status.Conditions, meta.ReadyCondition)
+			return apimeta.IsStatusConditionFalse(resultK.Status.Conditions, meta.ReadyCondition) &&
+				resultK.Status.LastAttemptedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(readyCondition.Reason).To(Equal(kustomizev1.DecryptionKeyServiceUnavailableReason))
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal("v1.0.0"))
+	})
+}
+
+func TestKustomizationReconciler_DecryptedKustomizationFile(t *testing.T) {
+	g := NewWithT(t)
+
+	id := "sops-kfile-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	// The kustomization.yaml files of the overlay and its base are encrypted
+	// with the age key.
+	artifactName := "sops-kfile-" + randStringRunes(5)
+	artifactChecksum, err := testServer.ArtifactFromDir("testdata/sops-kustomization", artifactName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      randStringRunes(5),
+		Namespace: id,
+	}
+	revision := "main/" + artifactChecksum
+	err = applyGitRepository(repositoryName, artifactName, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ageKey, err := os.ReadFile("testdata/sops/keys/age.txt")
+	g.Expect(err).ToNot(HaveOccurred())
+	sopsSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sops-" + randStringRunes(5),
+			Namespace: id,
+		},
+		StringData: map[string]string{
+			"age.agekey": string(ageKey),
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), sopsSecret)).To(Succeed())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("sops-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Decryption: &kustomizev1.Decryption{
+				Provider: "sops",
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: sopsSecret.Name,
+				},
+			},
+			TargetNamespace: id,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	var configMap corev1.ConfigMap
+	g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "literals", Namespace: id}, &configMap)).To(Succeed())
+	g.Expect(configMap.Data["token"]).To(Equal("secret"))
+
+	var secret corev1.Secret
+	g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "nested", Namespace: id}, &secret)).To(Succeed())
+	g.Expect(string(secret.Data["key"])).To(Equal("value"))
+}
+
+func TestKustomizationReconciler_DecryptorMACMismatch(t *testing.T) {
+	g := NewWithT(t)
+
+	id := "sops-mac-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	// Corrupt one byte of the ciphertext of the encrypted value.
+	envData, err := os.ReadFile("testdata/sops/envs/env.env")
+	g.Expect(err).ToNot(HaveOccurred())
+	corrupted := strings.Replace(string(envData), "data:3PTvx6o=", "data:3QTvx6o=", 1)
+	g.Expect(corrupted).ToNot(Equal(string(envData)))
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "kustomization.yaml",
+			Body: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+generatorOptions:
+  disableNameSuffixHash: true
+secretGenerator:
+- name: tampered
+  envs:
+  - secrets/env.env
+`,
+		},
+		{Name: "secrets/env.env", Body: corrupted},
+	})
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      randStringRunes(5),
+		Namespace: id,
+	}
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ageKey, err := os.ReadFile("testdata/sops/keys/age.txt")
+	g.Expect(err).ToNot(HaveOccurred())
+	sopsSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sops-age",
+			Namespace: id,
+		},
+		StringData: map[string]string{
+			"age.agekey": string(ageKey),
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), sopsSecret)).To(Succeed())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("sops-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Decryption: &kustomizev1.Decryption{
+				Provider: "sops",
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: sopsSecret.Name,
+				},
+			},
+			TargetNamespace: id,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	var readyCondition *metav1.Condition
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		readyCondition = apimeta.FindStatusCondition(resultK.Status.Conditions, meta.ReadyCondition)
+		return apimeta.IsStatusConditionFalse(resultK.Status.Conditions, meta.ReadyCondition)
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(readyCondition.Reason).To(Equal(kustomizev1.SOPSMACMismatchReason))
+	g.Expect(readyCondition.Message).To(ContainSubstring("'secrets/env.env'"))
+	g.Expect(resultK.Status.LastAppliedRevision).To(BeEmpty())
+
+	g.Eventually(func() bool {
+		for _, event := range getEvents(resultK.GetName(), nil) {
+			if event.Type == corev1.EventTypeWarning && event.Reason == kustomizev1.SOPSMACMismatchReason &&
+				strings.Contains(event.Message, "'secrets/env.env'") {
+				return true
+			}
+		}
+		return false
+	}, timeout, time.Second).Should(BeTrue())
+
+	// Nothing is applied when the integrity check fails.
+	var secret corev1.Secret
+	err = k8sClient.Get(context.Background(), types.NamespacedName{Name: "tampered", Namespace: id}, &secret)
+	g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+}
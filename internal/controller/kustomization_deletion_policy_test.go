@@ -54,6 +54,12 @@ func TestKustomizationReconciler_DeletionPolicyDelete(t *testing.T) {
 			deletionPolicy: kustomizev1.DeletionPolicyMirrorPrune,
 			wantDelete:     true,
 		},
+		{
+			name:           "should delete when deletionPolicy waits for termination and pruning disabled",
+			prune:          false,
+			deletionPolicy: kustomizev1.DeletionPolicyWaitForTermination,
+			wantDelete:     true,
+		},
 		{
 			name:           "should orphan when deletionPolicy overrides pruning enabled",
 			prune:          true,
@@ -118,7 +124,7 @@ data:
 				Spec: kustomizev1.KustomizationSpec{
 					Interval: metav1.Duration{Duration: reconciliationInterval},
 					Path:     "./",
-					KubeConfig: &meta.KubeConfigReference{
+					KubeConfig: &kustomizev1.KubeConfigReference{
 						SecretRef: meta.SecretKeyReference{
 							Name: "kubeconfig",
 						},
@@ -162,3 +168,160 @@ data:
 		})
 	}
 }
+
+func TestKustomizationReconciler_DeletionPolicyWaitForTermination(t *testing.T) {
+	g := NewWithT(t)
+	id := "gc-wait-" + randStringRunes(5)
+	revision := "v1.0.0"
+	blockingFinalizer := "test.fluxcd.io/block"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	// The finalizer of the ConfigMap keeps it terminating until removed.
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "config.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: blocked
+  finalizers:
+  - %[1]s
+data:
+  key: value
+`, blockingFinalizer),
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("gc-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	newKustomization := func(timeout time.Duration) *kustomizev1.Kustomization {
+		return &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("gc-%s", randStringRunes(5)),
+				Namespace: id,
+			},
+			Spec: kustomizev1.KustomizationSpec{
+				Interval: metav1.Duration{Duration: reconciliationInterval},
+				Timeout:  &metav1.Duration{Duration: timeout},
+				Path:     "./",
+				KubeConfig: &kustomizev1.KubeConfigReference{
+					SecretRef: meta.SecretKeyReference{
+						Name: "kubeconfig",
+					},
+				},
+				SourceRef: kustomizev1.CrossNamespaceSourceReference{
+					Name:      repositoryName.Name,
+					Namespace: repositoryName.Namespace,
+					Kind:      sourcev1.GitRepositoryKind,
+				},
+				TargetNamespace: id,
+				DeletionPolicy:  kustomizev1.DeletionPolicyWaitForTermination,
+			},
+		}
+	}
+
+	configKey := types.NamespacedName{Name: "blocked", Namespace: id}
+	applyAndDelete := func(g *WithT, kustomization *kustomizev1.Kustomization) {
+		g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+		resultK := &kustomizev1.Kustomization{}
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+		g.Expect(k8sClient.Get(context.Background(), configKey, &corev1.ConfigMap{})).To(Succeed())
+
+		g.Expect(k8sClient.Delete(context.Background(), kustomization)).To(Succeed())
+		g.Eventually(func() bool {
+			var cm corev1.ConfigMap
+			_ = k8sClient.Get(context.Background(), configKey, &cm)
+			return !cm.GetDeletionTimestamp().IsZero()
+		}, timeout, time.Second).Should(BeTrue())
+	}
+
+	removeBlockingFinalizer := func(g *WithT) {
+		var cm corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), configKey, &cm)).To(Succeed())
+		cm.SetFinalizers(nil)
+		g.Expect(k8sClient.Update(context.Background(), &cm)).To(Succeed())
+		g.Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), configKey, &corev1.ConfigMap{})
+			return apierrors.IsNotFound(err)
+		}, timeout, time.Second).Should(BeTrue())
+	}
+
+	t.Run("waits for the termination of the resources", func(t *testing.T) {
+		g := NewWithT(t)
+		kustomization := newKustomization(time.Minute)
+		applyAndDelete(g, kustomization)
+
+		g.Consistently(func() error {
+			return k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), &kustomizev1.Kustomization{})
+		}, 5*time.Second, time.Second).Should(Succeed())
+
+		removeBlockingFinalizer(g)
+		g.Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), &kustomizev1.Kustomization{})
+			return apierrors.IsNotFound(err)
+		}, timeout, time.Second).Should(BeTrue())
+	})
+
+	t.Run("stops waiting at the timeout", func(t *testing.T) {
+		g := NewWithT(t)
+		kustomization := newKustomization(5 * time.Second)
+		applyAndDelete(g, kustomization)
+
+		g.Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), &kustomizev1.Kustomization{})
+			return apierrors.IsNotFound(err)
+		}, timeout, time.Second).Should(BeTrue())
+
+		// The resource is left terminating.
+		var cm corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), configKey, &cm)).To(Succeed())
+		g.Expect(cm.GetDeletionTimestamp().IsZero()).To(BeFalse())
+
+		removeBlockingFinalizer(g)
+	})
+}
+
+func Test_finalizerShouldDeleteResources(t *testing.T) {
+	tests := []struct {
+		prune          bool
+		deletionPolicy string
+		want           bool
+	}{
+		{prune: true, deletionPolicy: "", want: true},
+		{prune: false, deletionPolicy: "", want: false},
+		{prune: true, deletionPolicy: kustomizev1.DeletionPolicyMirrorPrune, want: true},
+		{prune: false, deletionPolicy: kustomizev1.DeletionPolicyMirrorPrune, want: false},
+		{prune: false, deletionPolicy: kustomizev1.DeletionPolicyDelete, want: true},
+		{prune: false, deletionPolicy: kustomizev1.DeletionPolicyWaitForTermination, want: true},
+		{prune: true, deletionPolicy: kustomizev1.DeletionPolicyOrphan, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s prune=%t", tt.deletionPolicy, tt.prune), func(t *testing.T) {
+			g := NewWithT(t)
+			obj := &kustomizev1.Kustomization{
+				Spec: kustomizev1.KustomizationSpec{
+					Prune:          tt.prune,
+					DeletionPolicy: tt.deletionPolicy,
+				},
+			}
+			g.Expect(finalizerShouldDeleteResources(obj)).To(Equal(tt.want))
+		})
+	}
+}
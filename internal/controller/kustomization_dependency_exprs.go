@@ -0,0 +1,75 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fluxcd/pkg/runtime/cel"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	celgo "github.com/google/cel-go/cel"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// parseReadyExprs returns the parsed ready expressions of the dependencies,
+// indexed as the dependencies, with nil for the dependencies without one.
+func parseReadyExprs(deps []kustomizev1.DependencyReference) ([]*cel.Expression, error) {
+	exprs := make([]*cel.Expression, len(deps))
+	for i, d := range deps {
+		if d.ReadyExpr == "" {
+			continue
+		}
+		expr, err := cel.NewExpression(d.ReadyExpr,
+			cel.WithCompile(),
+			cel.WithOutputType(celgo.BoolType),
+			cel.WithStructVariables("dep", "self", "source"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the readyExpr of dependsOn[%d]: %w", i, err)
+		}
+		exprs[i] = expr
+	}
+	return exprs, nil
+}
+
+// evalReadyExpr returns an error if the ready expression fails to evaluate,
+// or evaluates to false, for the given dependency.
+func evalReadyExpr(ctx context.Context,
+	expr *cel.Expression,
+	dep *kustomizev1.Kustomization,
+	self *kustomizev1.Kustomization,
+	source sourcev1.Source) error {
+	vars := make(map[string]any, 3)
+	for name, obj := range map[string]any{"dep": dep, "self": self, "source": source} {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return fmt.Errorf("failed to convert '%s' for the readyExpr: %w", name, err)
+		}
+		vars[name] = u
+	}
+
+	ready, err := expr.EvaluateBoolean(ctx, vars)
+	if err != nil {
+		return err
+	}
+	if !ready {
+		return fmt.Errorf("readyExpr evaluated to false")
+	}
+	return nil
+}
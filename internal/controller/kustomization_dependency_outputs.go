@@ -0,0 +1,189 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+
+	ssautil "github.com/fluxcd/pkg/ssa/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/inventory"
+)
+
+// dependencyOutputs returns the variables exposed by the dependencies of the
+// Kustomization, read from the data of the ConfigMaps and Secrets in their
+// inventories which match their outputsFrom selectors. It returns an error
+// if a selector matches no outputs, or if a variable is exposed by more
+// than one output.
+func (r *KustomizationReconciler) dependencyOutputs(ctx context.Context,
+	obj *kustomizev1.Kustomization) (map[string]string, error) {
+	var vars map[string]string
+	exposedBy := make(map[string]string)
+	for _, d := range obj.Spec.DependsOn {
+		if d.OutputsFrom == nil {
+			continue
+		}
+		if d.Namespace == "" {
+			d.Namespace = obj.GetNamespace()
+		}
+		dName := types.NamespacedName{Namespace: d.Namespace, Name: d.Name}
+
+		selector, err := metav1.LabelSelectorAsSelector(&d.OutputsFrom.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid outputsFrom label selector of dependency '%s': %w", dName, err)
+		}
+
+		var dep kustomizev1.Kustomization
+		if err := r.APIReader.Get(ctx, dName, &dep); err != nil {
+			return nil, fmt.Errorf("dependency '%s' not found: %w", dName, err)
+		}
+		if dep.Status.Inventory == nil {
+			return nil, fmt.Errorf("dependency '%s' has no inventory to read the outputs from", dName)
+		}
+		objects, err := inventory.List(dep.Status.Inventory)
+		if err != nil {
+			return nil, err
+		}
+
+		matched := 0
+		for _, u := range objects {
+			gvk := u.GroupVersionKind()
+			if gvk.Group != "" || (gvk.Kind != "ConfigMap" && gvk.Kind != "Secret") {
+				continue
+			}
+			output := ssautil.FmtUnstructured(u)
+			if r.NoCrossNamespaceRefs && u.GetNamespace() != obj.GetNamespace() {
+				return nil, fmt.Errorf("output '%s' of dependency '%s' can't be read across namespaces", output, dName)
+			}
+
+			data, outputLabels, err := r.readOutput(ctx, gvk.Kind, client.ObjectKeyFromObject(u))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read output '%s' of dependency '%s': %w", output, dName, err)
+			}
+			if !selector.Matches(labels.Set(outputLabels)) {
+				continue
+			}
+			matched++
+
+			if vars == nil {
+				vars = make(map[string]string)
+			}
+			for k, v := range data {
+				if other, ok := exposedBy[k]; ok {
+					return nil, fmt.Errorf("variable '%s' is exposed by both output '%s' and output '%s'", k, other, output)
+				}
+				exposedBy[k] = output
+				vars[k] = strings.ReplaceAll(v, "\n", "")
+			}
+		}
+
+		if matched == 0 {
+			return nil, fmt.Errorf("dependency '%s' has no outputs matching '%s'",
+				dName, metav1.FormatLabelSelector(&d.OutputsFrom.LabelSelector))
+		}
+	}
+	return vars, nil
+}
+
+// setOutputVariables sets the outputs of the dependencies as in-line variables
+// of the post build substitutions of the unstructured Kustomization. The
+// outputs override the variables of the ConfigMaps and Secrets referenced by
+// the Kustomization, and are overridden by its own in-line variables.
+func setOutputVariables(kustomization map[string]any, outputs map[string]string) error {
+	if len(outputs) == 0 {
+		return nil
+	}
+	substitute, _, err := unstructured.NestedStringMap(kustomization, "spec", "postBuild", "substitute")
+	if err != nil {
+		return err
+	}
+	vars := maps.Clone(outputs)
+	maps.Copy(vars, substitute)
+	return unstructured.SetNestedStringMap(kustomization, vars, "spec", "postBuild", "substitute")
+}
+
+// readOutput returns the data and the labels of the ConfigMap or Secret.
+func (r *KustomizationReconciler) readOutput(ctx context.Context,
+	kind string, key client.ObjectKey) (map[string]string, map[string]string, error) {
+	if kind == "ConfigMap" {
+		var cm corev1.ConfigMap
+		if err := r.Client.Get(ctx, key, &cm); err != nil {
+			return nil, nil, err
+		}
+		return cm.Data, cm.GetLabels(), nil
+	}
+
+	var secret corev1.Secret
+	if err := r.Client.Get(ctx, key, &secret); err != nil {
+		return nil, nil, err
+	}
+	data := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		data[k] = string(v)
+	}
+	return data, secret.GetLabels(), nil
+}
+
+// findDependencyCycle returns an error describing the first cycle found in
+// the dependencies of the Kustomization which leads back to itself. The
+// dependencies which can't be read are not followed.
+func (r *KustomizationReconciler) findDependencyCycle(ctx context.Context,
+	obj *kustomizev1.Kustomization) error {
+	self := client.ObjectKeyFromObject(obj)
+	visited := make(map[types.NamespacedName]bool)
+
+	var walk func(k *kustomizev1.Kustomization, path []string) []string
+	walk = func(k *kustomizev1.Kustomization, path []string) []string {
+		for _, d := range k.Spec.DependsOn {
+			dName := types.NamespacedName{Namespace: d.Namespace, Name: d.Name}
+			if dName.Namespace == "" {
+				dName.Namespace = k.GetNamespace()
+			}
+			if dName == self {
+				return append(path, dName.String())
+			}
+			if visited[dName] {
+				continue
+			}
+			visited[dName] = true
+
+			var dep kustomizev1.Kustomization
+			if err := r.APIReader.Get(ctx, dName, &dep); err != nil {
+				continue
+			}
+			if cycle := walk(&dep, append(path, dName.String())); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+
+	if cycle := walk(obj, []string{self.String()}); cycle != nil {
+		return fmt.Errorf("circular dependency: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_DependencyOutputs(t *testing.T) {
+	g := NewWithT(t)
+	id := "outputs-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	// The database exposes its endpoint and credentials in labeled ConfigMaps
+	// and Secrets, which the app consumes as substitution variables.
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "database/outputs.yaml",
+			Body: `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: endpoint
+  labels:
+    example.com/output: "true"
+data:
+  db_host: db.example.com
+  db_port: "5432"
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: credentials
+  labels:
+    example.com/output: "true"
+data:
+  db_password: czNjcjN0
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: internal
+data:
+  db_host: 10.0.0.1
+`,
+		},
+		{
+			Name: "app/config.yaml",
+			Body: `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  url: "postgres://${db_host}:${db_port}/${db_name}"
+  password: "${db_password}"
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("outputs-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	newKustomization := func(name string) *kustomizev1.Kustomization {
+		return &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: id,
+			},
+			Spec: kustomizev1.KustomizationSpec{
+				Interval: metav1.Duration{Duration: reconciliationInterval},
+				Path:     "./" + name,
+				KubeConfig: &kustomizev1.KubeConfigReference{
+					SecretRef: meta.SecretKeyReference{
+						Name: "kubeconfig",
+					},
+				},
+				SourceRef: kustomizev1.CrossNamespaceSourceReference{
+					Name:      repositoryName.Name,
+					Namespace: repositoryName.Namespace,
+					Kind:      sourcev1.GitRepositoryKind,
+				},
+				TargetNamespace: id,
+				Prune:           true,
+			},
+		}
+	}
+
+	database := newKustomization("database")
+	g.Expect(k8sClient.Create(context.Background(), database)).To(Succeed())
+
+	app := newKustomization("app")
+	app.Spec.DependsOn = []kustomizev1.DependencyReference{
+		{
+			Name: database.Name,
+			OutputsFrom: &kustomizev1.DependencyOutputs{
+				LabelSelector: metav1.LabelSelector{
+					MatchLabels: map[string]string{"example.com/output": "true"},
+				},
+			},
+		},
+	}
+	app.Spec.PostBuild = &kustomizev1.PostBuild{
+		Substitute: map[string]string{"db_name": "app"},
+	}
+	g.Expect(k8sClient.Create(context.Background(), app)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	t.Run("substitutes the outputs of the dependency", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(app), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+
+		var cm corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: "app", Namespace: id}, &cm)).To(Succeed())
+		g.Expect(cm.Data).To(HaveKeyWithValue("url", "postgres://db.example.com:5432/app"))
+		g.Expect(cm.Data).To(HaveKeyWithValue("password", "s3cr3t"))
+	})
+
+	t.Run("fails when the dependency has no matching outputs", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(app), resultK)
+			resultK.Spec.DependsOn[0].OutputsFrom.LabelSelector.MatchLabels = map[string]string{"example.com/output": "false"}
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(app), resultK)
+			return conditions.GetReason(resultK, meta.ReadyCondition) == kustomizev1.DependencyOutputsFailedReason
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(Equal(
+			fmt.Sprintf("dependency '%s/database' has no outputs matching 'example.com/output=false'", id)))
+	})
+
+	t.Run("fails on circular dependencies", func(t *testing.T) {
+		g := NewWithT(t)
+		resultDB := &kustomizev1.Kustomization{}
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(database), resultDB)
+			resultDB.Spec.DependsOn = []kustomizev1.DependencyReference{{Name: app.Name}}
+			return k8sClient.Update(context.Background(), resultDB)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(database), resultDB)
+			return conditions.GetReason(resultDB, meta.ReadyCondition) == kustomizev1.CircularDependencyReason
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultDB)
+
+		g.Expect(conditions.GetMessage(resultDB, meta.ReadyCondition)).To(Equal(
+			fmt.Sprintf("circular dependency: %[1]s/database -> %[1]s/app -> %[1]s/database", id)))
+	})
+}
+
+func Test_setOutputVariables(t *testing.T) {
+	g := NewWithT(t)
+
+	kustomization := map[string]any{
+		"spec": map[string]any{
+			"postBuild": map[string]any{
+				"substitute": map[string]any{"region": "eu-west-1"},
+			},
+		},
+	}
+	g.Expect(setOutputVariables(kustomization, map[string]string{
+		"region":  "us-east-1",
+		"db_host": "db.example.com",
+	})).To(Succeed())
+
+	// The in-line variables override the outputs.
+	g.Expect(kustomization).To(HaveKeyWithValue("spec", HaveKeyWithValue("postBuild",
+		HaveKeyWithValue("substitute", Equal(map[string]any{
+			"region":  "eu-west-1",
+			"db_host": "db.example.com",
+		})))))
+
+	// The post build substitutions are enabled by the outputs.
+	kustomization = map[string]any{"spec": map[string]any{}}
+	g.Expect(setOutputVariables(kustomization, map[string]string{"db_host": "db.example.com"})).To(Succeed())
+	g.Expect(kustomization).To(HaveKeyWithValue("spec", HaveKeyWithValue("postBuild",
+		HaveKeyWithValue("substitute", Equal(map[string]any{"db_host": "db.example.com"})))))
+
+	kustomization = map[string]any{"spec": map[string]any{}}
+	g.Expect(setOutputVariables(kustomization, nil)).To(Succeed())
+	g.Expect(kustomization).To(Equal(map[string]any{"spec": map[string]any{}}))
+}
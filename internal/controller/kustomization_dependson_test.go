@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
 	"github.com/fluxcd/pkg/testserver"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1"
 	. "github.com/onsi/gomega"
@@ -119,7 +120,7 @@ spec:
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: reconciliationInterval},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -168,7 +169,7 @@ spec:
 		g := NewWithT(t)
 		g.Eventually(func() error {
 			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
-			resultK.Spec.DependsOn = []meta.NamespacedObjectReference{
+			resultK.Spec.DependsOn = []kustomizev1.DependencyReference{
 				{
 					Namespace: id,
 					Name:      "root",
@@ -184,3 +185,143 @@ spec:
 		}, timeout, time.Second).Should(BeTrue())
 	})
 }
+
+func TestKustomizationReconciler_DependsOnReadyExpr(t *testing.T) {
+	g := NewWithT(t)
+	id := "dep-expr-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	configMap := func(name string) testserver.File {
+		return testserver.File{
+			Name: name + "/config.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+`, name),
+		}
+	}
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		configMap("upstream"),
+		configMap("downstream"),
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// The Kustomizations are reconciled from different sources, which are
+	// released with the same revisions in a coordinated rollout.
+	upstreamRepo := types.NamespacedName{Name: "upstream", Namespace: id}
+	downstreamRepo := types.NamespacedName{Name: "downstream", Namespace: id}
+	g.Expect(applyGitRepository(upstreamRepo, artifact, "v1.0.0")).To(Succeed())
+	g.Expect(applyGitRepository(downstreamRepo, artifact, "v2.0.0")).To(Succeed())
+
+	newKustomization := func(name string, repo types.NamespacedName) *kustomizev1.Kustomization {
+		return &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: id,
+			},
+			Spec: kustomizev1.KustomizationSpec{
+				Interval: metav1.Duration{Duration: reconciliationInterval},
+				Path:     "./" + name,
+				KubeConfig: &kustomizev1.KubeConfigReference{
+					SecretRef: meta.SecretKeyReference{
+						Name: "kubeconfig",
+					},
+				},
+				SourceRef: kustomizev1.CrossNamespaceSourceReference{
+					Name:      repo.Name,
+					Namespace: repo.Namespace,
+					Kind:      sourcev1.GitRepositoryKind,
+				},
+				TargetNamespace: id,
+				Prune:           true,
+			},
+		}
+	}
+
+	upstream := newKustomization("upstream", upstreamRepo)
+	g.Expect(k8sClient.Create(context.Background(), upstream)).To(Succeed())
+	g.Eventually(func() bool {
+		resultK := &kustomizev1.Kustomization{}
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(upstream), resultK)
+		return isReconcileSuccess(resultK)
+	}, timeout, time.Second).Should(BeTrue())
+
+	downstream := newKustomization("downstream", downstreamRepo)
+	downstream.Spec.DependsOn = []kustomizev1.DependencyReference{
+		{
+			Name:      upstream.Name,
+			ReadyExpr: "dep.status.lastAppliedRevision == source.status.artifact.revision",
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), downstream)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	updateReadyExpr := func(g *WithT, expr string) {
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(downstream), resultK)
+			resultK.Spec.DependsOn[0].ReadyExpr = expr
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+	}
+
+	t.Run("waits for the dependency to apply the same revision", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(downstream), resultK)
+			return conditions.GetReason(resultK, meta.ReadyCondition) == meta.DependencyNotReadyReason
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(Equal(
+			fmt.Sprintf("dependency '%s/upstream' is not ready: readyExpr evaluated to false", id)))
+	})
+
+	t.Run("reconciles when the dependency revision matches", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Expect(applyGitRepository(downstreamRepo, artifact, "v1.0.0")).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(downstream), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == "v1.0.0"
+		}, timeout, time.Second).Should(BeTrue())
+	})
+
+	t.Run("fails on evaluation errors", func(t *testing.T) {
+		g := NewWithT(t)
+		updateReadyExpr(g, "dep.status.lastAppliedRevisions == 'v1.0.0'")
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(downstream), resultK)
+			return conditions.GetReason(resultK, meta.ReadyCondition) == meta.DependencyNotReadyReason
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(meta.DependencyNotReadyReason))
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring(
+			"failed to evaluate the CEL expression 'dep.status.lastAppliedRevisions == 'v1.0.0'': no such key: lastAppliedRevisions"))
+	})
+
+	t.Run("fails terminally on malformed expressions", func(t *testing.T) {
+		g := NewWithT(t)
+		updateReadyExpr(g, "dep.status.")
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(downstream), resultK)
+			return conditions.IsTrue(resultK, meta.StalledCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(resultK.Status.ObservedGeneration).To(Equal(resultK.GetGeneration()))
+		for _, cond := range []string{meta.ReadyCondition, meta.StalledCondition} {
+			g.Expect(conditions.GetReason(resultK, cond)).To(Equal(meta.InvalidCELExpressionReason))
+			g.Expect(conditions.GetMessage(resultK, cond)).To(ContainSubstring(
+				"failed to parse the readyExpr of dependsOn[0]: failed to parse the CEL expression 'dep.status.'"))
+		}
+	})
+}
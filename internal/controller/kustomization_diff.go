@@ -0,0 +1,238 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fluxcd/pkg/runtime/logger"
+	"github.com/fluxcd/pkg/ssa"
+	ssautil "github.com/fluxcd/pkg/ssa/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+const (
+	// diffMetaKey is the event metadata key of the diff of the changed
+	// objects.
+	diffMetaKey = "diff"
+
+	// secretDataMask replaces the values of the Secret data in the diff.
+	secretDataMask = "***"
+
+	// diffTruncatedSuffix ends a diff truncated to the byte budget.
+	diffTruncatedSuffix = "... (truncated)"
+)
+
+// diffObjects returns the diff of the objects the server-side apply changes,
+// keyed by their change subject, by comparing the live objects with the
+// result of a server-side apply dry-run. It returns nil when the diff of the
+// apply events is disabled. The objects whose dry-run fails, e.g. the custom
+// resources of CRDs which are not applied yet, are left out.
+func (r *KustomizationReconciler) diffObjects(ctx context.Context,
+	manager *ssa.ResourceManager,
+	obj *kustomizev1.Kustomization,
+	objects []*unstructured.Unstructured) map[string]string {
+	if r.EventDiffMaxBytes <= 0 {
+		return nil
+	}
+	log := ctrl.LoggerFrom(ctx)
+
+	opts := ssa.DiffOptions{
+		Exclusions: map[string]string{
+			fmt.Sprintf("%s/reconcile", kustomizev1.GroupVersion.Group): kustomizev1.DisabledValue,
+			fmt.Sprintf("%s/ssa", kustomizev1.GroupVersion.Group):       kustomizev1.IgnoreValue,
+		},
+		IfNotPresentSelector: map[string]string{
+			fmt.Sprintf("%s/ssa", kustomizev1.GroupVersion.Group): kustomizev1.IfNotPresentValue,
+		},
+	}
+
+	diffs := make(map[string]string)
+	for _, u := range objects {
+		entry, existing, dryRun, err := manager.Diff(ctx, u, opts)
+		if err != nil {
+			log.V(logger.DebugLevel).Info("server-side apply diff skipped", "object", ssautil.FmtUnstructured(u), "error", err.Error())
+			continue
+		}
+		if entry.Action != ssa.ConfiguredAction || existing == nil || dryRun == nil {
+			continue
+		}
+		diffs[entry.Subject] = renderDiff(entry.Subject, existing, dryRun, r.EventDiffSecrets)
+	}
+	return diffs
+}
+
+// renderDiff renders the changes of the labels, annotations and fields of the
+// live object made by the dry-run, one per line, under the subject of the
+// change. The values of the Secret data are masked, and the changes of a
+// Secret are omitted unless diffSecrets is set.
+func renderDiff(subject string, existing, dryRun *unstructured.Unstructured, diffSecrets bool) string {
+	var sb strings.Builder
+	sb.WriteString(subject + "\n")
+	if ssautil.IsSecret(dryRun) && !diffSecrets {
+		sb.WriteString("  (diff of Secret omitted)\n")
+		return sb.String()
+	}
+
+	before, after := diffableContent(existing), diffableContent(dryRun)
+	if ssautil.IsSecret(dryRun) {
+		maskSecretData(before, after)
+	}
+
+	var changes []string
+	diffValues("", before, after, &changes)
+	for _, change := range changes {
+		sb.WriteString("  " + change + "\n")
+	}
+	return sb.String()
+}
+
+// diffableContent returns a copy of the object without the metadata fields
+// managed by the API server and without the status.
+func diffableContent(u *unstructured.Unstructured) map[string]any {
+	content := u.DeepCopy().UnstructuredContent()
+	delete(content, "status")
+	metadata := map[string]any{}
+	if labels := u.GetLabels(); len(labels) > 0 {
+		metadata["labels"] = content["metadata"].(map[string]any)["labels"]
+	}
+	if annotations := u.GetAnnotations(); len(annotations) > 0 {
+		metadata["annotations"] = content["metadata"].(map[string]any)["annotations"]
+	}
+	delete(content, "metadata")
+	if len(metadata) > 0 {
+		content["metadata"] = metadata
+	}
+	return content
+}
+
+// maskSecretData replaces the values of the data and stringData of the
+// Secret contents before and after the change, so that only the keys which
+// changed are reported.
+func maskSecretData(before, after map[string]any) {
+	for _, field := range []string{"data", "stringData"} {
+		beforeData, _ := before[field].(map[string]any)
+		afterData, _ := after[field].(map[string]any)
+		for k, bv := range beforeData {
+			av, ok := afterData[k]
+			switch {
+			case !ok:
+				beforeData[k] = secretDataMask
+			case jsonValue(av) != jsonValue(bv):
+				beforeData[k] = secretDataMask + " (before)"
+				afterData[k] = secretDataMask + " (after)"
+			default:
+				beforeData[k] = secretDataMask
+				afterData[k] = secretDataMask
+			}
+		}
+		for k := range afterData {
+			if _, ok := beforeData[k]; !ok {
+				afterData[k] = secretDataMask
+			}
+		}
+	}
+}
+
+// diffValues appends the changes between the values at the JSON pointer path
+// to the changes, descending into the maps and the lists of the same length.
+func diffValues(path string, before, after any, changes *[]string) {
+	switch b := before.(type) {
+	case map[string]any:
+		if a, ok := after.(map[string]any); ok {
+			keys := make(map[string]struct{}, len(b)+len(a))
+			for k := range b {
+				keys[k] = struct{}{}
+			}
+			for k := range a {
+				keys[k] = struct{}{}
+			}
+			sorted := make([]string, 0, len(keys))
+			for k := range keys {
+				sorted = append(sorted, k)
+			}
+			sort.Strings(sorted)
+			for _, k := range sorted {
+				bv, inBefore := b[k]
+				av, inAfter := a[k]
+				p := path + "/" + escapePointer(k)
+				switch {
+				case !inBefore:
+					*changes = append(*changes, fmt.Sprintf("+ %s: %s", p, jsonValue(av)))
+				case !inAfter:
+					*changes = append(*changes, fmt.Sprintf("- %s: %s", p, jsonValue(bv)))
+				default:
+					diffValues(p, bv, av, changes)
+				}
+			}
+			return
+		}
+	case []any:
+		if a, ok := after.([]any); ok && len(a) == len(b) {
+			for i := range b {
+				diffValues(fmt.Sprintf("%s/%d", path, i), b[i], a[i], changes)
+			}
+			return
+		}
+	}
+
+	if bv, av := jsonValue(before), jsonValue(after); bv != av {
+		*changes = append(*changes, fmt.Sprintf("~ %s: %s -> %s", path, bv, av))
+	}
+}
+
+// escapePointer escapes a key as a JSON pointer reference token.
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+func jsonValue(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// truncateDiff truncates the diff to the byte budget at a line boundary, and
+// marks it as truncated. A first line longer than the budget is cut at a
+// UTF-8 character boundary.
+func truncateDiff(diff string, maxBytes int) string {
+	if len(diff) <= maxBytes {
+		return diff
+	}
+	budget := maxBytes - len(diffTruncatedSuffix)
+	if budget <= 0 {
+		return diffTruncatedSuffix
+	}
+	cut := strings.LastIndex(diff[:budget], "\n") + 1
+	if cut == 0 {
+		cut = budget
+		for cut > 0 && !utf8.RuneStart(diff[cut]) {
+			cut--
+		}
+	}
+	return diff[:cut] + diffTruncatedSuffix
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func Test_renderDiff(t *testing.T) {
+	deployment := func(replicas int64, labels map[string]any) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata": map[string]any{
+				"name":            "app",
+				"namespace":       "default",
+				"resourceVersion": "1",
+				"labels":          labels,
+			},
+			"spec": map[string]any{
+				"replicas": replicas,
+				"template": map[string]any{
+					"spec": map[string]any{
+						"containers": []any{
+							map[string]any{"name": "app", "image": "ghcr.io/example/app:v1"},
+						},
+					},
+				},
+			},
+			"status": map[string]any{"replicas": replicas},
+		}}
+		return u
+	}
+
+	g := NewWithT(t)
+	existing := deployment(5, map[string]any{"app": "app", "kustomize.toolkit.fluxcd.io/name": "app"})
+	dryRun := deployment(2, map[string]any{"app": "app", "env": "prod"})
+	dryRun.SetResourceVersion("2")
+	containers, _, _ := unstructured.NestedSlice(dryRun.Object, "spec", "template", "spec", "containers")
+	containers[0].(map[string]any)["image"] = "ghcr.io/example/app:v2"
+	g.Expect(unstructured.SetNestedSlice(dryRun.Object, containers, "spec", "template", "spec", "containers")).To(Succeed())
+
+	g.Expect(renderDiff("Deployment/default/app", existing, dryRun, false)).To(Equal(`Deployment/default/app
+  + /metadata/labels/env: "prod"
+  - /metadata/labels/kustomize.toolkit.fluxcd.io~1name: "app"
+  ~ /spec/replicas: 5 -> 2
+  ~ /spec/template/spec/containers/0/image: "ghcr.io/example/app:v1" -> "ghcr.io/example/app:v2"
+`))
+}
+
+func Test_renderDiff_secrets(t *testing.T) {
+	secret := func(data map[string]any) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]any{
+				"name":      "creds",
+				"namespace": "default",
+			},
+			"type": "Opaque",
+			"data": data,
+		}}
+	}
+	existing := secret(map[string]any{
+		"password": "b2xkLXNlY3JldA==",
+		"removed":  "cmVtb3ZlZC1zZWNyZXQ=",
+		"same":     "c2FtZS1zZWNyZXQ=",
+	})
+	dryRun := secret(map[string]any{
+		"password": "bmV3LXNlY3JldA==",
+		"added":    "YWRkZWQtc2VjcmV0",
+		"same":     "c2FtZS1zZWNyZXQ=",
+	})
+
+	t.Run("omits the diff by default", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Expect(renderDiff("Secret/default/creds", existing, dryRun, false)).To(Equal(
+			"Secret/default/creds\n  (diff of Secret omitted)\n"))
+	})
+
+	t.Run("masks the data values", func(t *testing.T) {
+		g := NewWithT(t)
+		diff := renderDiff("Secret/default/creds", existing, dryRun, true)
+		g.Expect(diff).To(Equal(`Secret/default/creds
+  + /data/added: "***"
+  ~ /data/password: "*** (before)" -> "*** (after)"
+  - /data/removed: "***"
+`))
+		for _, value := range []string{"b2xkLXNlY3JldA==", "bmV3LXNlY3JldA==", "cmVtb3ZlZC1zZWNyZXQ=", "YWRkZWQtc2VjcmV0"} {
+			g.Expect(diff).NotTo(ContainSubstring(value))
+		}
+
+		// The objects of the dry-run are not modified.
+		g.Expect(dryRun.Object["data"].(map[string]any)["password"]).To(Equal("bmV3LXNlY3JldA=="))
+	})
+
+	t.Run("masks the data of a created field", func(t *testing.T) {
+		g := NewWithT(t)
+		diff := renderDiff("Secret/default/creds", secret(nil), dryRun, true)
+		g.Expect(diff).To(ContainSubstring(`"***"`))
+		g.Expect(diff).NotTo(ContainSubstring("bmV3LXNlY3JldA=="))
+		g.Expect(diff).NotTo(ContainSubstring("c2FtZS1zZWNyZXQ="))
+	})
+}
+
+func Test_truncateDiff(t *testing.T) {
+	diff := "Deployment/default/app\n  ~ /spec/replicas: 5 -> 2\n  ~ /spec/paused: true -> false"
+
+	tests := []struct {
+		name     string
+		maxBytes int
+		want     string
+	}{
+		{
+			name:     "within the budget",
+			maxBytes: len(diff),
+			want:     diff,
+		},
+		{
+			name:     "at a line boundary",
+			maxBytes: 65,
+			want:     "Deployment/default/app\n  ~ /spec/replicas: 5 -> 2\n" + diffTruncatedSuffix,
+		},
+		{
+			name:     "within the first line",
+			maxBytes: 25,
+			want:     "Deployment" + diffTruncatedSuffix,
+		},
+		{
+			name:     "budget smaller than the suffix",
+			maxBytes: 4,
+			want:     diffTruncatedSuffix,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			got := truncateDiff(diff, tt.maxBytes)
+			g.Expect(got).To(Equal(tt.want))
+			if tt.maxBytes >= len(diffTruncatedSuffix) {
+				g.Expect(len(got)).To(BeNumerically("<=", tt.maxBytes))
+			}
+		})
+	}
+
+	t.Run("at a character boundary", func(t *testing.T) {
+		g := NewWithT(t)
+		got := truncateDiff(strings.Repeat("é", 20), len(diffTruncatedSuffix)+3)
+		g.Expect(got).To(Equal("é" + diffTruncatedSuffix))
+	})
+}
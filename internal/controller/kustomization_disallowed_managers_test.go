@@ -85,7 +85,7 @@ data:
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: reconciliationInterval},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -95,12 +95,14 @@ data:
 				Namespace: repositoryName.Namespace,
 				Kind:      sourcev1.GitRepositoryKind,
 			},
-			HealthChecks: []meta.NamespacedObjectKindReference{
+			HealthChecks: []kustomizev1.HealthCheck{
 				{
-					APIVersion: "v1",
-					Kind:       "ConfigMap",
-					Name:       id,
-					Namespace:  id,
+					NamespacedObjectKindReference: meta.NamespacedObjectKindReference{
+						APIVersion: "v1",
+						Kind:       "ConfigMap",
+						Name:       id,
+						Namespace:  id,
+					},
 				},
 			},
 			TargetNamespace: id,
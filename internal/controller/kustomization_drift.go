@@ -0,0 +1,233 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fluxcd/cli-utils/pkg/kstatus/polling"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/runtime/patch"
+	"github.com/fluxcd/pkg/ssa"
+	ssautil "github.com/fluxcd/pkg/ssa/utils"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// driftCache holds the objects built for the last applied revision of the
+// Kustomizations with a drift interval, so that their drift is corrected
+// without fetching and building their sources again. The Secrets are not
+// cached, so that their decrypted data does not stay in memory between the
+// reconciliations. It is safe for concurrent use.
+type driftCache struct {
+	mu      sync.Mutex
+	entries map[types.NamespacedName]driftCacheEntry
+}
+
+type driftCacheEntry struct {
+	revision    string
+	generation  int64
+	requestedAt string
+	builtAt     time.Time
+	objects     []*unstructured.Unstructured
+}
+
+func newDriftCache() *driftCache {
+	return &driftCache{
+		entries: make(map[types.NamespacedName]driftCacheEntry),
+	}
+}
+
+// set caches the objects built for the revision of the Kustomization, except
+// for the Secrets, or removes them if the Kustomization has no drift
+// interval.
+func (c *driftCache) set(obj *kustomizev1.Kustomization, revision string,
+	objects []*unstructured.Unstructured, now time.Time) {
+	if c == nil {
+		return
+	}
+	if obj.GetDriftInterval() == 0 || obj.Spec.DryRun {
+		c.delete(client.ObjectKeyFromObject(obj))
+		return
+	}
+	requestedAt, _ := meta.ReconcileAnnotationValue(obj.GetAnnotations())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[client.ObjectKeyFromObject(obj)] = driftCacheEntry{
+		revision:    revision,
+		generation:  obj.GetGeneration(),
+		requestedAt: requestedAt,
+		builtAt:     now,
+		objects:     copyObjects(withoutSecrets(objects)),
+	}
+}
+
+// get returns a copy of the objects cached for the revision of the
+// Kustomization, or nil if the revision, the generation or the reconcile
+// request of the Kustomization changed since they were built, or if they
+// were built longer than the interval ago.
+func (c *driftCache) get(obj *kustomizev1.Kustomization, revision string, now time.Time) []*unstructured.Unstructured {
+	if c == nil {
+		return nil
+	}
+	requestedAt, _ := meta.ReconcileAnnotationValue(obj.GetAnnotations())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[client.ObjectKeyFromObject(obj)]
+	if !ok ||
+		entry.revision != revision ||
+		entry.generation != obj.GetGeneration() ||
+		entry.requestedAt != requestedAt {
+		return nil
+	}
+	if !obj.IsEventDriven() && now.Sub(entry.builtAt) >= obj.GetRequeueAfter() {
+		return nil
+	}
+	return copyObjects(entry.objects)
+}
+
+// delete removes the objects cached for the Kustomization.
+func (c *driftCache) delete(key types.NamespacedName) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func withoutSecrets(objects []*unstructured.Unstructured) []*unstructured.Unstructured {
+	result := make([]*unstructured.Unstructured, 0, len(objects))
+	for _, u := range objects {
+		if !ssautil.IsSecret(u) {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+func copyObjects(objects []*unstructured.Unstructured) []*unstructured.Unstructured {
+	result := make([]*unstructured.Unstructured, len(objects))
+	for i, u := range objects {
+		result[i] = u.DeepCopy()
+	}
+	return result
+}
+
+// canCorrectDrift returns if the last reconciliation of the Kustomization
+// applied the revision successfully, with its current spec, so that only its
+// drift needs to be corrected.
+func canCorrectDrift(obj *kustomizev1.Kustomization, revision string) bool {
+	return obj.GetDriftInterval() > 0 &&
+		!obj.Spec.DryRun &&
+		conditions.IsReady(obj) &&
+		obj.Status.LastAppliedRevision == revision &&
+		obj.Status.ObservedGeneration == obj.GetGeneration()
+}
+
+// reconcileInterval returns the interval at which the Kustomization is
+// reconciled, which is the drift interval when it is shorter than the
+// interval.
+func reconcileInterval(obj *kustomizev1.Kustomization) time.Duration {
+	interval := obj.GetRequeueAfter()
+	if drift := obj.GetDriftInterval(); drift > 0 && (interval == 0 || drift < interval) {
+		return drift
+	}
+	return interval
+}
+
+// correctDrift re-applies the objects built for the last applied revision to
+// revert the changes made to them on the cluster, without fetching and
+// building the source, pruning or running the health checks. The drift of
+// the Secrets, which are not cached, is corrected by the full
+// reconciliations.
+func (r *KustomizationReconciler) correctDrift(
+	ctx context.Context,
+	obj *kustomizev1.Kustomization,
+	src sourcev1.Source,
+	objects []*unstructured.Unstructured,
+	patcher *patch.SerialPatcher,
+	statusPoller *polling.StatusPoller,
+	pollingOpts polling.Options) error {
+	log := ctrl.LoggerFrom(ctx)
+	revision := src.GetArtifact().Revision
+	originRevision := getOriginRevision(src)
+
+	// Update status with the reconciliation progress.
+	progressingMsg := fmt.Sprintf("Correcting drift for revision %s with a timeout of %s", revision, obj.GetApplyTimeout().String())
+	conditions.MarkReconciling(obj, meta.ProgressingReason, "%s", progressingMsg)
+	if err := r.patch(ctx, obj, patcher); err != nil {
+		return fmt.Errorf("failed to update status: %w", err)
+	}
+
+	// Create the Kubernetes client that runs under impersonation.
+	impersonation := r.newImpersonator(obj, statusPoller, pollingOpts)
+	kubeClient, statusPoller, err := r.getKubeClient(ctx, obj, impersonation, pollingOpts)
+	if err != nil {
+		conditions.MarkFalse(obj, meta.ReadyCondition, meta.ReconciliationFailedReason, "%s", err)
+		return fmt.Errorf("failed to build kube client: %w", err)
+	}
+
+	resourceManager := ssa.NewResourceManager(kubeClient, statusPoller, ssa.Owner{
+		Field: r.ControllerName,
+		Group: kustomizev1.GroupVersion.Group,
+	})
+	resourceManager.SetConcurrency(r.ConcurrentSSA)
+
+	var timeouts kustomizev1.Timeouts
+	if obj.Spec.Timeouts != nil {
+		timeouts = *obj.Spec.Timeouts
+	}
+	applyCtx, cancelApply := withPhaseTimeout(ctx, timeouts.Apply)
+	defer cancelApply()
+
+	eventPrefix := fmt.Sprintf("Drift corrected for revision %s, reverted:\n", revision)
+	drifted, _, err := r.apply(applyCtx, resourceManager, obj, revision, originRevision, objects, eventPrefix)
+	err = checkPhaseTimeout(applyCtx, "apply", timeouts.Apply, kustomizev1.ApplyTimeoutReason, err)
+	if err != nil {
+		reason := meta.ReconciliationFailedReason
+		var timeoutErr *phaseTimeoutError
+		var stageErr *stageError
+		switch {
+		case errors.As(err, &timeoutErr):
+			reason = timeoutErr.Reason
+		case errors.As(err, &stageErr):
+			reason = kustomizev1.StageFailedReason
+		}
+		conditions.MarkFalse(obj, meta.ReadyCondition, reason, "%s", err)
+		return err
+	}
+	if drifted {
+		log.Info("Drift corrected", "revision", revision)
+	}
+
+	conditions.MarkTrue(obj,
+		meta.ReadyCondition,
+		meta.ReconciliationSucceededReason,
+		"Applied revision: %s", revision)
+	return nil
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_DriftInterval(t *testing.T) {
+	g := NewWithT(t)
+	id := "drift-" + randStringRunes(5)
+	revision := "v1.0.0"
+	resultK := &kustomizev1.Kustomization{}
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "app.yaml",
+			Body: `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: app
+  template:
+    metadata:
+      labels:
+        app: app
+    spec:
+      containers:
+      - name: app
+        image: ghcr.io/example/app:v1
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("drift-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// The interval is longer than the test timeout, so that only the drift
+	// interval can revert the changes made to the Deployment.
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("drift-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval:      metav1.Duration{Duration: time.Hour},
+			DriftInterval: &metav1.Duration{Duration: 2 * time.Second},
+			Path:          "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	appKey := types.NamespacedName{Name: "app", Namespace: id}
+
+	t.Run("reverts a scale of the deployment", func(t *testing.T) {
+		g := NewWithT(t)
+		deployment := &appsv1.Deployment{}
+		g.Expect(k8sClient.Get(context.Background(), appKey, deployment)).To(Succeed())
+		g.Expect(deployment.Spec.Replicas).To(Equal(ptr.To[int32](2)))
+
+		// Scale the deployment as 'kubectl scale' does.
+		scale := &autoscalingv1.Scale{Spec: autoscalingv1.ScaleSpec{Replicas: 5}}
+		g.Expect(k8sClient.SubResource("scale").Update(context.Background(), deployment,
+			client.WithSubResourceBody(scale), client.FieldOwner("kubectl"))).To(Succeed())
+		g.Expect(k8sClient.Get(context.Background(), appKey, deployment)).To(Succeed())
+		g.Expect(deployment.Spec.Replicas).To(Equal(ptr.To[int32](5)))
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), appKey, deployment)
+			return *deployment.Spec.Replicas == 2
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)).To(Succeed())
+		logStatus(t, resultK)
+		g.Expect(isReconcileSuccess(resultK)).To(BeTrue())
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal(revision))
+	})
+}
+
+func Test_driftCache(t *testing.T) {
+	g := NewWithT(t)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	revision := "main@sha1:1111111111111111111111111111111111111111"
+
+	obj := &kustomizev1.Kustomization{}
+	obj.Name = "app"
+	obj.Namespace = "default"
+	obj.Generation = 1
+	obj.Spec.Interval = metav1.Duration{Duration: 10 * time.Minute}
+	obj.Spec.DriftInterval = &metav1.Duration{Duration: time.Minute}
+
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("v1")
+	u.SetKind("ConfigMap")
+	u.SetName("config")
+
+	c := newDriftCache()
+	c.set(obj, revision, []*unstructured.Unstructured{u}, now)
+
+	// The cached objects are copies.
+	u.SetName("changed")
+	objects := c.get(obj, revision, now.Add(time.Minute))
+	g.Expect(objects).To(HaveLen(1))
+	g.Expect(objects[0].GetName()).To(Equal("config"))
+	objects[0].SetName("changed")
+	g.Expect(c.get(obj, revision, now)[0].GetName()).To(Equal("config"))
+
+	// The cache is invalidated by a new revision, an interval elapsed since
+	// the build, a new generation or a reconcile request.
+	g.Expect(c.get(obj, "main@sha1:2222222222222222222222222222222222222222", now)).To(BeNil())
+	g.Expect(c.get(obj, revision, now.Add(10*time.Minute))).To(BeNil())
+
+	obj.Generation = 2
+	g.Expect(c.get(obj, revision, now)).To(BeNil())
+	obj.Generation = 1
+
+	obj.Annotations = map[string]string{meta.ReconcileRequestAnnotation: "now"}
+	g.Expect(c.get(obj, revision, now)).To(BeNil())
+	obj.Annotations = nil
+
+	// The cache of an event-driven Kustomization doesn't expire.
+	obj.Spec.Interval = metav1.Duration{}
+	g.Expect(c.get(obj, revision, now.Add(24*time.Hour))).To(HaveLen(1))
+
+	// The Secrets are not cached.
+	secret := &unstructured.Unstructured{}
+	secret.SetAPIVersion("v1")
+	secret.SetKind("Secret")
+	secret.SetName("creds")
+	g.Expect(unstructured.SetNestedStringMap(secret.Object, map[string]string{"password": "cGFzc3dvcmQ="}, "data")).To(Succeed())
+	c.set(obj, revision, []*unstructured.Unstructured{u, secret}, now)
+	objects = c.get(obj, revision, now)
+	g.Expect(objects).To(HaveLen(1))
+	g.Expect(objects[0].GetKind()).To(Equal("ConfigMap"))
+
+	// Removing the drift interval removes the cached objects.
+	obj.Spec.DriftInterval = nil
+	c.set(obj, revision, []*unstructured.Unstructured{u}, now)
+	g.Expect(c.get(obj, revision, now)).To(BeNil())
+
+	// The cache methods are nil-safe.
+	var nilCache *driftCache
+	nilCache.set(obj, revision, nil, now)
+	g.Expect(nilCache.get(obj, revision, now)).To(BeNil())
+	nilCache.delete(client.ObjectKeyFromObject(obj))
+}
+
+func Test_canCorrectDrift(t *testing.T) {
+	revision := "main@sha1:1111111111111111111111111111111111111111"
+	newObj := func() *kustomizev1.Kustomization {
+		obj := &kustomizev1.Kustomization{}
+		obj.Generation = 1
+		obj.Spec.DriftInterval = &metav1.Duration{Duration: time.Minute}
+		obj.Status.ObservedGeneration = 1
+		obj.Status.LastAppliedRevision = revision
+		obj.Status.Conditions = []metav1.Condition{
+			{Type: meta.ReadyCondition, Status: metav1.ConditionTrue, Reason: meta.ReconciliationSucceededReason},
+		}
+		return obj
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(obj *kustomizev1.Kustomization)
+		want   bool
+	}{
+		{name: "ready with the revision applied", mutate: func(*kustomizev1.Kustomization) {}, want: true},
+		{name: "no drift interval", mutate: func(obj *kustomizev1.Kustomization) { obj.Spec.DriftInterval = nil }},
+		{name: "dry-run", mutate: func(obj *kustomizev1.Kustomization) { obj.Spec.DryRun = true }},
+		{name: "new generation", mutate: func(obj *kustomizev1.Kustomization) { obj.Generation = 2 }},
+		{name: "new revision", mutate: func(obj *kustomizev1.Kustomization) { obj.Status.LastAppliedRevision = "v0" }},
+		{name: "not ready", mutate: func(obj *kustomizev1.Kustomization) {
+			obj.Status.Conditions[0].Status = metav1.ConditionFalse
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			obj := newObj()
+			tt.mutate(obj)
+			g.Expect(canCorrectDrift(obj, revision)).To(Equal(tt.want))
+		})
+	}
+}
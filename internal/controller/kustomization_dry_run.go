@@ -0,0 +1,164 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fluxcd/cli-utils/pkg/object"
+	eventv1 "github.com/fluxcd/pkg/apis/event/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/ssa"
+	"github.com/fluxcd/pkg/ssa/normalize"
+	ssautil "github.com/fluxcd/pkg/ssa/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
+	"github.com/fluxcd/kustomize-controller/internal/inventory"
+)
+
+// maxDryRunChanges is the maximum number of changes listed in the status
+// and in the event of a dry-run reconciliation.
+const maxDryRunChanges = 100
+
+// dryRun performs a server-side dry-run apply of the objects, and reports
+// the resources which would be created, configured and pruned in the status
+// and in an event. Nothing is applied or deleted, and the inventory is left
+// as is.
+func (r *KustomizationReconciler) dryRun(ctx context.Context,
+	manager *ssa.ResourceManager,
+	obj *kustomizev1.Kustomization,
+	revision string,
+	originRevision string,
+	objects []*unstructured.Unstructured,
+	oldInventory *kustomizev1.ResourceInventory) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	if err := normalize.UnstructuredList(objects); err != nil {
+		return err
+	}
+
+	opts := ssa.DiffOptions{
+		Exclusions: map[string]string{
+			fmt.Sprintf("%s/reconcile", kustomizev1.GroupVersion.Group): kustomizev1.DisabledValue,
+			fmt.Sprintf("%s/ssa", kustomizev1.GroupVersion.Group):       kustomizev1.IgnoreValue,
+		},
+		IfNotPresentSelector: map[string]string{
+			fmt.Sprintf("%s/ssa", kustomizev1.GroupVersion.Group): kustomizev1.IfNotPresentValue,
+		},
+	}
+
+	// The CRDs and Namespaces are sorted first, so that the resources of the
+	// kinds and in the namespaces they would create are reported as created,
+	// as their dry-run would be rejected by the API server.
+	sort.Sort(ssa.SortableUnstructureds(objects))
+	createdKinds := make(map[schema.GroupKind]bool)
+	createdNamespaces := make(map[string]bool)
+	changeSet := ssa.NewChangeSet()
+	for _, u := range objects {
+		if decryptor.IsEncryptedSecret(u) {
+			return fmt.Errorf("%s is SOPS encrypted, configuring decryption is required for this secret to be reconciled",
+				ssautil.FmtUnstructured(u))
+		}
+
+		var entry *ssa.ChangeSetEntry
+		if createdKinds[u.GroupVersionKind().GroupKind()] || createdNamespaces[u.GetNamespace()] {
+			entry = &ssa.ChangeSetEntry{
+				ObjMetadata:  object.UnstructuredToObjMetadata(u),
+				GroupVersion: u.GroupVersionKind().Version,
+				Subject:      ssautil.FmtUnstructured(u),
+				Action:       ssa.CreatedAction,
+			}
+		} else {
+			var err error
+			entry, _, _, err = manager.Diff(ctx, u, opts)
+			if err != nil {
+				return err
+			}
+		}
+
+		if entry.Action == ssa.CreatedAction {
+			switch {
+			case ssautil.IsNamespace(u):
+				createdNamespaces[u.GetName()] = true
+			case ssautil.IsCRD(u):
+				group, _, _ := unstructured.NestedString(u.Object, "spec", "group")
+				kind, _, _ := unstructured.NestedString(u.Object, "spec", "names", "kind")
+				createdKinds[schema.GroupKind{Group: group, Kind: kind}] = true
+			}
+		}
+		changeSet.Add(*entry)
+	}
+
+	// Detect the stale resources which would be garbage collected.
+	var staleObjects []*unstructured.Unstructured
+	if obj.Spec.Prune {
+		newInventory := inventory.New()
+		if err := inventory.AddChangeSet(newInventory, changeSet); err != nil {
+			return err
+		}
+		var err error
+		staleObjects, err = inventory.Diff(oldInventory, newInventory)
+		if err != nil {
+			return err
+		}
+	}
+
+	result := &kustomizev1.DryRunStatus{
+		Revision: revision,
+		Pruned:   len(staleObjects),
+	}
+	var changes []string
+	for _, entry := range changeSet.Entries {
+		switch entry.Action {
+		case ssa.CreatedAction:
+			result.Created++
+		case ssa.ConfiguredAction:
+			result.Configured++
+		default:
+			continue
+		}
+		changes = append(changes, entry.String())
+	}
+	for _, u := range staleObjects {
+		changes = append(changes, fmt.Sprintf("%s %s", ssautil.FmtUnstructured(u), ssa.DeletedAction))
+	}
+	if len(changes) > maxDryRunChanges {
+		changes = changes[:maxDryRunChanges]
+	}
+	result.Changes = changes
+	obj.Status.DryRun = result
+
+	msg := fmt.Sprintf("Dry-run of revision %s: %d created, %d configured, %d pruned",
+		revision, result.Created, result.Configured, result.Pruned)
+	log.Info(msg, "changes", changes)
+	if len(changes) > 0 {
+		r.event(obj, revision, originRevision, eventv1.EventSeverityInfo,
+			fmt.Sprintf("%s\n%s", msg, strings.Join(changes, "\n")), nil)
+	}
+
+	conditions.Delete(obj, meta.HealthyCondition)
+	conditions.MarkTrue(obj, meta.ReadyCondition, kustomizev1.DryRunSucceededReason, "%s", msg)
+	return nil
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_DryRun(t *testing.T) {
+	g := NewWithT(t)
+	id := "dry-run-" + randStringRunes(5)
+	appsNamespace := id + "-apps"
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	existing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "existing",
+			Namespace: id,
+		},
+		Data: map[string]string{"key": "old"},
+	}
+	g.Expect(k8sClient.Create(context.Background(), existing)).To(Succeed())
+
+	manifests := func(withApp bool) []testserver.File {
+		files := []testserver.File{
+			{
+				Name: "existing.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: existing
+  namespace: %s
+data:
+  key: new
+`, id),
+			},
+		}
+		if withApp {
+			files = append(files, testserver.File{
+				Name: "app.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: %[1]s
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  namespace: %[1]s
+data:
+  key: app
+`, appsNamespace),
+			})
+		}
+		return files
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests(true))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("dry-run-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("dry-run-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Prune:  true,
+			Wait:   true,
+			DryRun: true,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	// isDryRun returns if the dry-run of the revision has been reported.
+	isDryRun := func(revision string) bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return conditions.GetReason(resultK, meta.ReadyCondition) == kustomizev1.DryRunSucceededReason &&
+			conditions.GetObservedGeneration(resultK, meta.ReadyCondition) == resultK.Generation &&
+			resultK.Status.DryRun != nil && resultK.Status.DryRun.Revision == revision
+	}
+
+	t.Run("reports changes without applying", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			return isDryRun(revision)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.IsTrue(resultK, meta.ReadyCondition)).To(BeTrue())
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(
+			Equal("Dry-run of revision v1.0.0: 2 created, 1 configured, 0 pruned"))
+		g.Expect(conditions.Has(resultK, meta.HealthyCondition)).To(BeFalse())
+		g.Expect(resultK.Status.DryRun.Created).To(Equal(2))
+		g.Expect(resultK.Status.DryRun.Configured).To(Equal(1))
+		g.Expect(resultK.Status.DryRun.Pruned).To(BeZero())
+		g.Expect(resultK.Status.DryRun.Changes).To(ConsistOf(
+			fmt.Sprintf("Namespace/%s created", appsNamespace),
+			fmt.Sprintf("ConfigMap/%s/app created", appsNamespace),
+			fmt.Sprintf("ConfigMap/%s/existing configured", id),
+		))
+		g.Expect(resultK.Status.Inventory).To(BeNil())
+		g.Expect(resultK.Status.LastAppliedRevision).To(BeEmpty())
+
+		err := k8sClient.Get(context.Background(), types.NamespacedName{Name: appsNamespace}, &corev1.Namespace{})
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		cm := &corev1.ConfigMap{}
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(existing), cm)).To(Succeed())
+		g.Expect(cm.Data["key"]).To(Equal("old"))
+
+		events := getEvents(resultK.GetName(), map[string]string{"kustomize.toolkit.fluxcd.io/revision": revision})
+		g.Expect(events).To(ContainElement(HaveField("Message",
+			HavePrefix("Dry-run of revision v1.0.0: 2 created, 1 configured, 0 pruned\n"))))
+	})
+
+	t.Run("applies and clears the dry-run when disabled", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			resultK.Spec.DryRun = false
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(resultK.Status.DryRun).To(BeNil())
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "app", Namespace: appsNamespace}, &corev1.ConfigMap{})).To(Succeed())
+	})
+
+	t.Run("reports pruning without deleting", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			resultK.Spec.DryRun = true
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		revision = "v2.0.0"
+		artifact, err := testServer.ArtifactFromFiles(manifests(false))
+		g.Expect(err).NotTo(HaveOccurred())
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			return isDryRun(revision)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(resultK.Status.DryRun.Created).To(BeZero())
+		g.Expect(resultK.Status.DryRun.Configured).To(BeZero())
+		g.Expect(resultK.Status.DryRun.Pruned).To(Equal(2))
+		g.Expect(resultK.Status.DryRun.Changes).To(ConsistOf(
+			fmt.Sprintf("Namespace/%s deleted", appsNamespace),
+			fmt.Sprintf("ConfigMap/%s/app deleted", appsNamespace),
+		))
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal("v1.0.0"))
+		g.Expect(resultK.Status.Inventory.Entries).To(HaveLen(3))
+
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "app", Namespace: appsNamespace}, &corev1.ConfigMap{})).To(Succeed())
+	})
+}
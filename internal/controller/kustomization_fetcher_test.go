@@ -85,7 +85,7 @@ stringData:
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: reconciliationInterval},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -95,12 +95,14 @@ stringData:
 				Namespace: repositoryName.Namespace,
 				Kind:      sourcev1.GitRepositoryKind,
 			},
-			HealthChecks: []meta.NamespacedObjectKindReference{
+			HealthChecks: []kustomizev1.HealthCheck{
 				{
-					APIVersion: "v1",
-					Kind:       "Secret",
-					Name:       id,
-					Namespace:  id,
+					NamespacedObjectKindReference: meta.NamespacedObjectKindReference{
+						APIVersion: "v1",
+						Kind:       "Secret",
+						Name:       id,
+						Namespace:  id,
+					},
 				},
 			},
 			TargetNamespace: id,
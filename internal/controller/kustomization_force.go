@@ -0,0 +1,79 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	"github.com/fluxcd/pkg/ssa"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// applyAll applies the objects with the resource manager. When force is
+// enabled with a list of kinds, only the objects of those kinds are recreated
+// on immutable field changes. They are applied after the other objects, for
+// which force is disabled, while the force selector applies to both.
+func applyAll(ctx context.Context,
+	manager *ssa.ResourceManager,
+	objects []*unstructured.Unstructured,
+	opts ssa.ApplyOptions,
+	forceKinds []kustomizev1.ForceKind) (*ssa.ChangeSet, error) {
+	if !opts.Force || len(forceKinds) == 0 {
+		return manager.ApplyAll(ctx, objects, opts)
+	}
+
+	var forced, others []*unstructured.Unstructured
+	for _, u := range objects {
+		if isForceKind(u, forceKinds) {
+			forced = append(forced, u)
+		} else {
+			others = append(others, u)
+		}
+	}
+
+	resultSet := ssa.NewChangeSet()
+	if len(others) > 0 {
+		othersOpts := opts
+		othersOpts.Force = false
+		changeSet, err := manager.ApplyAll(ctx, others, othersOpts)
+		if err != nil {
+			return nil, err
+		}
+		resultSet.Append(changeSet.Entries)
+	}
+	if len(forced) > 0 {
+		changeSet, err := manager.ApplyAll(ctx, forced, opts)
+		if err != nil {
+			return nil, err
+		}
+		resultSet.Append(changeSet.Entries)
+	}
+	return resultSet, nil
+}
+
+// isForceKind returns if the object is of one of the given kinds.
+func isForceKind(u *unstructured.Unstructured, forceKinds []kustomizev1.ForceKind) bool {
+	gvk := u.GroupVersionKind()
+	for _, fk := range forceKinds {
+		if fk.Group == gvk.Group && fk.Kind == gvk.Kind {
+			return true
+		}
+	}
+	return false
+}
@@ -23,9 +23,11 @@ import (
 	"time"
 
 	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
 	"github.com/fluxcd/pkg/testserver"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1"
 	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -86,7 +88,7 @@ stringData:
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: reconciliationInterval},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -96,12 +98,14 @@ stringData:
 				Namespace: repositoryName.Namespace,
 				Kind:      sourcev1.GitRepositoryKind,
 			},
-			HealthChecks: []meta.NamespacedObjectKindReference{
+			HealthChecks: []kustomizev1.HealthCheck{
 				{
-					APIVersion: "v1",
-					Kind:       "Secret",
-					Name:       id,
-					Namespace:  id,
+					NamespacedObjectKindReference: meta.NamespacedObjectKindReference{
+						APIVersion: "v1",
+						Kind:       "Secret",
+						Name:       id,
+						Namespace:  id,
+					},
 				},
 			},
 			TargetNamespace: id,
@@ -172,3 +176,167 @@ stringData:
 		g.Expect(apimeta.IsStatusConditionTrue(resultK.Status.Conditions, meta.HealthyCondition)).To(BeTrue())
 	})
 }
+
+func TestKustomizationReconciler_ForceKinds(t *testing.T) {
+	g := NewWithT(t)
+	id := "force-kinds-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	manifests := func(tag, accessMode, data string) []testserver.File {
+		return []testserver.File{
+			{
+				Name: "job.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+spec:
+  template:
+    spec:
+      restartPolicy: Never
+      containers:
+      - name: migrate
+        image: "ghcr.io/example/migrate:%[1]s"
+`, tag),
+			},
+			{
+				Name: "pvc.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: data
+spec:
+  accessModes:
+  - %[1]s
+  resources:
+    requests:
+      storage: 1Gi
+`, accessMode),
+			},
+			{
+				Name: "secret.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: token
+  annotations:
+    kustomize.toolkit.fluxcd.io/force: enabled
+immutable: true
+stringData:
+  key: "%[1]s"
+`, data),
+			},
+		}
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests("v1", "ReadWriteOnce", "v1"))
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create artifact from files")
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("force-kinds-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("force-kinds-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Force:           true,
+			ForceKinds: []kustomizev1.ForceKind{
+				{Group: "batch", Kind: "Job"},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	resultJob := &batchv1.Job{}
+	resultPVC := &corev1.PersistentVolumeClaim{}
+	resultSecret := &corev1.Secret{}
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "migrate", Namespace: id}, resultJob)).Should(Succeed())
+	jobUID := resultJob.GetUID()
+	g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "data", Namespace: id}, resultPVC)).Should(Succeed())
+	pvcUID := resultPVC.GetUID()
+	g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "token", Namespace: id}, resultSecret)).Should(Succeed())
+	secretUID := resultSecret.GetUID()
+
+	t.Run("recreates the job of a force kind", func(t *testing.T) {
+		g := NewWithT(t)
+		artifact, err := testServer.ArtifactFromFiles(manifests("v2", "ReadWriteOnce", "v2"))
+		g.Expect(err).NotTo(HaveOccurred())
+		revision = "v2.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "migrate", Namespace: id}, resultJob)).Should(Succeed())
+		g.Expect(resultJob.GetUID()).ToNot(Equal(jobUID))
+		g.Expect(resultJob.Spec.Template.Spec.Containers[0].Image).To(Equal("ghcr.io/example/migrate:v2"))
+
+		// The force annotation overrides the force kinds.
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "token", Namespace: id}, resultSecret)).Should(Succeed())
+		g.Expect(resultSecret.GetUID()).ToNot(Equal(secretUID))
+	})
+
+	t.Run("refuses to recreate the pvc of another kind", func(t *testing.T) {
+		g := NewWithT(t)
+		artifact, err := testServer.ArtifactFromFiles(manifests("v2", "ReadWriteMany", "v2"))
+		g.Expect(err).NotTo(HaveOccurred())
+		revision = "v3.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileFailure(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(
+			ContainSubstring(fmt.Sprintf("PersistentVolumeClaim/%s/data dry-run failed", id)))
+		g.Expect(resultK.Status.LastAppliedRevision).ToNot(Equal(revision))
+
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "data", Namespace: id}, resultPVC)).Should(Succeed())
+		g.Expect(resultPVC.GetUID()).To(Equal(pvcUID))
+		g.Expect(resultPVC.Spec.AccessModes).To(ConsistOf(corev1.ReadWriteOnce))
+	})
+}
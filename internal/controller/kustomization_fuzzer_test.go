@@ -231,7 +231,7 @@ func Fuzz_Controllers(f *testing.F) {
 				},
 				Spec: kustomizev1.KustomizationSpec{
 					Path: "./",
-					KubeConfig: &meta.KubeConfigReference{
+					KubeConfig: &kustomizev1.KubeConfigReference{
 						SecretRef: meta.SecretKeyReference{
 							Name: "kubeconfig",
 						},
@@ -243,7 +243,7 @@ func Fuzz_Controllers(f *testing.F) {
 					},
 					Decryption: &kustomizev1.Decryption{
 						Provider: "sops",
-						SecretRef: &meta.LocalObjectReference{
+						SecretRef: &meta.NamespacedObjectReference{
 							Name: sopsSecretKey.Name,
 						},
 					},
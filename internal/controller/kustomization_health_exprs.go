@@ -0,0 +1,131 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/fluxcd/cli-utils/pkg/kstatus/polling/engine"
+	kstatusreaders "github.com/fluxcd/cli-utils/pkg/kstatus/polling/statusreaders"
+	"github.com/fluxcd/cli-utils/pkg/kstatus/status"
+	"github.com/fluxcd/pkg/apis/kustomize"
+	"github.com/fluxcd/pkg/runtime/cel"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// healthCheckExprsCache holds the compiled health check expressions of the
+// Kustomizations, so that the expressions are compiled again only when
+// they change. It is safe for concurrent use.
+type healthCheckExprsCache struct {
+	mu      sync.Mutex
+	entries map[types.NamespacedName]healthCheckExprsEntry
+}
+
+type healthCheckExprsEntry struct {
+	exprs      []kustomize.CustomHealthCheck
+	evaluators []healthCheckEvaluator
+}
+
+// healthCheckEvaluator is the compiled health check expressions of a kind.
+type healthCheckEvaluator struct {
+	gk        schema.GroupKind
+	evaluator *cel.StatusEvaluator
+}
+
+func newHealthCheckExprsCache() *healthCheckExprsCache {
+	return &healthCheckExprsCache{
+		entries: make(map[types.NamespacedName]healthCheckExprsEntry),
+	}
+}
+
+// get returns the compiled health check expressions of the Kustomization,
+// compiling them if they are not cached or differ from the cached ones.
+// Only the first entry of a kind is used, and a nil cache compiles the
+// expressions on every call.
+func (c *healthCheckExprsCache) get(key types.NamespacedName,
+	exprs []kustomize.CustomHealthCheck) ([]healthCheckEvaluator, error) {
+	if c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if entry, ok := c.entries[key]; ok && slices.Equal(entry.exprs, exprs) {
+			return entry.evaluators, nil
+		}
+	}
+
+	evaluators := make([]healthCheckEvaluator, 0, len(exprs))
+	seen := make(map[schema.GroupKind]struct{}, len(exprs))
+	for i, hc := range exprs {
+		gk := schema.FromAPIVersionAndKind(hc.APIVersion, hc.Kind).GroupKind()
+		if _, ok := seen[gk]; ok {
+			continue
+		}
+		evaluator, err := cel.NewStatusEvaluator(&hc.HealthCheckExpressions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create custom status reader for healthchecks[%d]: %w", i, err)
+		}
+		evaluators = append(evaluators, healthCheckEvaluator{gk: gk, evaluator: evaluator})
+		seen[gk] = struct{}{}
+	}
+
+	if c != nil {
+		c.entries[key] = healthCheckExprsEntry{
+			exprs:      slices.Clone(exprs),
+			evaluators: evaluators,
+		}
+	}
+	return evaluators, nil
+}
+
+// delete removes the compiled health check expressions of the Kustomization.
+func (c *healthCheckExprsCache) delete(key types.NamespacedName) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// healthCheckStatusReader is a status reader of the kind of the compiled
+// health check expressions. The expressions are evaluated with the context
+// of the reconciliation the reader is created for.
+type healthCheckStatusReader struct {
+	engine.StatusReader
+	gk schema.GroupKind
+}
+
+func newHealthCheckStatusReader(ctx context.Context, mapper apimeta.RESTMapper,
+	e healthCheckEvaluator) *healthCheckStatusReader {
+	statusFunc := func(u *unstructured.Unstructured) (*status.Result, error) {
+		return e.evaluator.Evaluate(ctx, u)
+	}
+	return &healthCheckStatusReader{
+		StatusReader: kstatusreaders.NewGenericStatusReader(mapper, statusFunc),
+		gk:           e.gk,
+	}
+}
+
+// Supports returns true for the kind of the health check expressions.
+func (r *healthCheckStatusReader) Supports(gk schema.GroupKind) bool {
+	return gk == r.gk
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/apis/kustomize"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_HealthCheckExprsOutcomes(t *testing.T) {
+	g := NewWithT(t)
+	id := "hce-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	// The Order kind has no status subresource, which allows the manifests
+	// to set the state of the custom resources. kstatus considers them
+	// Current as soon as they exist, as they have no Ready condition.
+	order := func(state string) testserver.File {
+		return testserver.File{
+			Name: state + "/order.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: acme.example.com/v1
+kind: Order
+metadata:
+  name: %[1]s
+spec:
+  domain: example.com
+status:
+  state: %[2]s
+`, "order-"+state, state),
+		}
+	}
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "crds/order.yaml",
+			Body: `---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: orders.acme.example.com
+spec:
+  group: acme.example.com
+  names:
+    kind: Order
+    listKind: OrderList
+    plural: orders
+    singular: order
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        x-kubernetes-preserve-unknown-fields: true
+`,
+		},
+		order("Issued"),
+		order("Errored"),
+		order("Pending"),
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("hce-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	newKustomization := func(path string) *kustomizev1.Kustomization {
+		return &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("hce-%s", randStringRunes(5)),
+				Namespace: id,
+			},
+			Spec: kustomizev1.KustomizationSpec{
+				Interval: metav1.Duration{Duration: 2 * time.Minute},
+				Path:     path,
+				SourceRef: kustomizev1.CrossNamespaceSourceReference{
+					Name:      repositoryName.Name,
+					Namespace: repositoryName.Namespace,
+					Kind:      sourcev1.GitRepositoryKind,
+				},
+				Timeout: &metav1.Duration{Duration: 5 * time.Second},
+			},
+		}
+	}
+
+	crds := newKustomization("./crds")
+	g.Expect(k8sClient.Create(context.Background(), crds)).To(Succeed())
+	g.Eventually(func() bool {
+		resultK := &kustomizev1.Kustomization{}
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(crds), resultK)
+		return isReconcileSuccess(resultK)
+	}, timeout, time.Second).Should(BeTrue())
+
+	tests := []struct {
+		state       string
+		wantHealthy bool
+		wantMessage string
+	}{
+		{
+			state:       "Issued",
+			wantHealthy: true,
+		},
+		{
+			state:       "Errored",
+			wantMessage: fmt.Sprintf("Order/%s/order-Errored status: 'Failed'", id),
+		},
+		{
+			state:       "Pending",
+			wantMessage: fmt.Sprintf("timeout waiting for: [Order/%s/order-Pending status: 'InProgress'", id),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			g := NewWithT(t)
+			kustomization := newKustomization("./" + tt.state)
+			kustomization.Spec.TargetNamespace = id
+			kustomization.Spec.Wait = true
+			kustomization.Spec.HealthCheckExprs = []kustomize.CustomHealthCheck{{
+				APIVersion: "acme.example.com/v1",
+				Kind:       "Order",
+				HealthCheckExpressions: kustomize.HealthCheckExpressions{
+					InProgress: "status.state == 'Pending'",
+					Failed:     "status.state == 'Errored'",
+					Current:    "status.state == 'Issued'",
+				},
+			}}
+			g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+			resultK := &kustomizev1.Kustomization{}
+			g.Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+				return conditions.Has(resultK, meta.HealthyCondition) &&
+					!conditions.IsUnknown(resultK, meta.HealthyCondition)
+			}, timeout, time.Second).Should(BeTrue())
+			logStatus(t, resultK)
+
+			if tt.wantHealthy {
+				g.Expect(conditions.IsTrue(resultK, meta.HealthyCondition)).To(BeTrue())
+				g.Expect(isReconcileSuccess(resultK)).To(BeTrue())
+				return
+			}
+			g.Expect(conditions.IsFalse(resultK, meta.HealthyCondition)).To(BeTrue())
+			g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(meta.HealthCheckFailedReason))
+			g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring(tt.wantMessage))
+		})
+	}
+}
+
+func Test_healthCheckExprsCache(t *testing.T) {
+	g := NewWithT(t)
+
+	key := types.NamespacedName{Name: "app", Namespace: "apps"}
+	exprs := []kustomize.CustomHealthCheck{
+		{
+			APIVersion: "acme.example.com/v1",
+			Kind:       "Order",
+			HealthCheckExpressions: kustomize.HealthCheckExpressions{
+				Current: "status.state == 'Issued'",
+			},
+		},
+		{
+			// The expressions of a kind are defined by its first entry.
+			APIVersion: "acme.example.com/v2",
+			Kind:       "Order",
+			HealthCheckExpressions: kustomize.HealthCheckExpressions{
+				Current: "status.phase == 'Issued'",
+			},
+		},
+	}
+
+	cache := newHealthCheckExprsCache()
+	evaluators, err := cache.get(key, exprs)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(evaluators).To(HaveLen(1))
+	g.Expect(evaluators[0].gk.String()).To(Equal("Order.acme.example.com"))
+
+	// The compiled expressions are reused until the expressions change.
+	cached, err := cache.get(key, []kustomize.CustomHealthCheck{exprs[0], exprs[1]})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(cached[0].evaluator).To(BeIdenticalTo(evaluators[0].evaluator))
+
+	exprs[0].Current = "status.state == 'Valid'"
+	changed, err := cache.get(key, exprs)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(changed[0].evaluator).ToNot(BeIdenticalTo(evaluators[0].evaluator))
+
+	// Compile errors are not cached.
+	invalid := []kustomize.CustomHealthCheck{{
+		APIVersion: "acme.example.com/v1",
+		Kind:       "Order",
+		HealthCheckExpressions: kustomize.HealthCheckExpressions{
+			Current: "status.",
+		},
+	}}
+	_, err = cache.get(key, invalid)
+	g.Expect(err).To(MatchError(ContainSubstring("failed to create custom status reader for healthchecks[0]")))
+	cached, err = cache.get(key, exprs)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(cached[0].evaluator).To(BeIdenticalTo(changed[0].evaluator))
+
+	cache.delete(key)
+	g.Expect(cache.entries).To(BeEmpty())
+
+	// A nil cache compiles the expressions on every call.
+	var nilCache *healthCheckExprsCache
+	evaluators, err = nilCache.get(key, exprs)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(evaluators).To(HaveLen(1))
+	nilCache.delete(key)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fluxcd/cli-utils/pkg/object"
+	ssautil "github.com/fluxcd/pkg/ssa/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// selectHealthChecks returns the objects matching the given health check
+// selectors. The selectors are expanded against the applied objects rather
+// than the cluster, so that only the resources managed by the Kustomization
+// are assessed. It returns an error if a selector is invalid, or if it
+// matches no objects and does not allow it.
+func selectHealthChecks(selectors []kustomizev1.HealthCheckSelector,
+	objects []*unstructured.Unstructured) (object.ObjMetadataSet, error) {
+	var result object.ObjMetadataSet
+	for i, hcs := range selectors {
+		selector, err := metav1.LabelSelectorAsSelector(&hcs.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label selector in .spec.healthCheckSelectors[%d]: %w", i, err)
+		}
+
+		var group *string
+		if hcs.APIVersion != "" {
+			gv, err := schema.ParseGroupVersion(hcs.APIVersion)
+			if err != nil {
+				return nil, fmt.Errorf("invalid API version in .spec.healthCheckSelectors[%d]: %w", i, err)
+			}
+			group = &gv.Group
+		}
+
+		var matched object.ObjMetadataSet
+		for _, u := range objects {
+			gvk := u.GroupVersionKind()
+			if gvk.Kind != hcs.Kind ||
+				(group != nil && gvk.Group != *group) ||
+				(hcs.Namespace != "" && u.GetNamespace() != hcs.Namespace) ||
+				!selector.Matches(labels.Set(u.GetLabels())) {
+				continue
+			}
+			matched = append(matched, object.UnstructuredToObjMetadata(u))
+		}
+
+		if len(matched) == 0 && !hcs.AllowEmpty {
+			return nil, fmt.Errorf("no applied %s matches the health check selector '%s'",
+				formatHealthCheckSelector(hcs), metav1.FormatLabelSelector(&hcs.LabelSelector))
+		}
+		result = result.Union(matched)
+	}
+	return result, nil
+}
+
+// formatHealthCheckSelector returns the kind and namespace of the selector.
+func formatHealthCheckSelector(hcs kustomizev1.HealthCheckSelector) string {
+	if hcs.Namespace != "" {
+		return fmt.Sprintf("%s in namespace '%s'", hcs.Kind, hcs.Namespace)
+	}
+	return hcs.Kind
+}
+
+// ignoreWaitObjects returns the objects to be assessed when waiting for all
+// the reconciled resources, and the ones excluded by the waitIgnore selectors.
+func ignoreWaitObjects(selectors []kustomizev1.WaitIgnoreSelector,
+	objects object.ObjMetadataSet) (object.ObjMetadataSet, object.ObjMetadataSet) {
+	if len(selectors) == 0 {
+		return objects, nil
+	}
+	var assessed, ignored object.ObjMetadataSet
+	for _, o := range objects {
+		if slices.ContainsFunc(selectors, func(wis kustomizev1.WaitIgnoreSelector) bool {
+			return wis.Group == o.GroupKind.Group &&
+				wis.Kind == o.GroupKind.Kind &&
+				(wis.Name == "" || wis.Name == o.Name) &&
+				(wis.Namespace == "" || wis.Namespace == o.Namespace)
+		}) {
+			ignored = append(ignored, o)
+			continue
+		}
+		assessed = append(assessed, o)
+	}
+	return assessed, ignored
+}
+
+// formatObjMetadataSet returns the comma-separated list of the objects.
+func formatObjMetadataSet(objects object.ObjMetadataSet) string {
+	names := make([]string, len(objects))
+	for i, o := range objects {
+		names[i] = ssautil.FmtObjMetadata(o)
+	}
+	return strings.Join(names, ", ")
+}
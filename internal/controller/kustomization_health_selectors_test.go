@@ -0,0 +1,349 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/cli-utils/pkg/object"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_HealthCheckSelectors(t *testing.T) {
+	g := NewWithT(t)
+	id := "hcs-" + randStringRunes(5)
+	revision := "v1.0.0"
+	resultK := &kustomizev1.Kustomization{}
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	// The names of the resources are prefixed by the Kustomization, and
+	// can't be listed in the health checks ahead of the build.
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "configs.yaml",
+			Body: `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: frontend
+  labels:
+    app.kubernetes.io/part-of: podinfo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: backend
+  labels:
+    app.kubernetes.io/part-of: podinfo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("hcs-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	podinfoSelector := metav1.LabelSelector{
+		MatchLabels: map[string]string{"app.kubernetes.io/part-of": "podinfo"},
+	}
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("hcs-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Timeout:  &metav1.Duration{Duration: 30 * time.Second},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			NamePrefix:      "prod-",
+			HealthCheckSelectors: []kustomizev1.HealthCheckSelector{
+				{
+					APIVersion:    "v1",
+					Kind:          "ConfigMap",
+					Namespace:     id,
+					LabelSelector: podinfoSelector,
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	t.Run("passes the health checks of the selected resources", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+		kstatusCheck.CheckErr(ctx, resultK)
+
+		g.Expect(conditions.IsTrue(resultK, meta.HealthyCondition)).To(BeTrue())
+	})
+
+	t.Run("fails when a selector matches no resources", func(t *testing.T) {
+		g := NewWithT(t)
+		resultK.Spec.HealthCheckSelectors[0].LabelSelector = metav1.LabelSelector{
+			MatchLabels: map[string]string{"app.kubernetes.io/part-of": "podinf"},
+		}
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.ObservedGeneration == resultK.GetGeneration() &&
+				conditions.IsFalse(resultK, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(meta.HealthCheckFailedReason))
+		g.Expect(conditions.IsFalse(resultK, meta.HealthyCondition)).To(BeTrue())
+		g.Expect(conditions.GetMessage(resultK, meta.HealthyCondition)).To(ContainSubstring(
+			fmt.Sprintf("no applied ConfigMap in namespace '%s' matches the health check selector 'app.kubernetes.io/part-of=podinf'", id)))
+	})
+
+	t.Run("passes when an empty match is allowed", func(t *testing.T) {
+		g := NewWithT(t)
+		resultK.Spec.HealthCheckSelectors[0].AllowEmpty = true
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.ObservedGeneration == resultK.GetGeneration() && isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+	})
+
+	t.Run("ignores the selectors when waiting for all resources", func(t *testing.T) {
+		g := NewWithT(t)
+		resultK.Spec.HealthCheckSelectors[0].AllowEmpty = false
+		resultK.Spec.Wait = true
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.ObservedGeneration == resultK.GetGeneration() && isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.IsTrue(resultK, meta.HealthyCondition)).To(BeTrue())
+	})
+}
+
+func Test_selectHealthChecks(t *testing.T) {
+	newObject := func(apiVersion, kind, namespace, name string, labels map[string]string) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion(apiVersion)
+		u.SetKind(kind)
+		u.SetNamespace(namespace)
+		u.SetName(name)
+		u.SetLabels(labels)
+		return u
+	}
+	podinfo := map[string]string{"app": "podinfo"}
+	objects := []*unstructured.Unstructured{
+		newObject("apps/v1", "Deployment", "apps", "prod-frontend-5f7d9", podinfo),
+		newObject("apps/v1", "Deployment", "staging", "staging-frontend-8c1a2", podinfo),
+		newObject("apps/v1", "Deployment", "apps", "prod-redis", map[string]string{"app": "redis"}),
+		newObject("v1", "Service", "apps", "prod-frontend", podinfo),
+		newObject("example.com/v1", "Deployment", "apps", "prod-frontend", podinfo),
+	}
+
+	tests := []struct {
+		name      string
+		selectors []kustomizev1.HealthCheckSelector
+		want      []string
+		wantErr   string
+	}{
+		{
+			name: "matches kind and labels in all namespaces",
+			selectors: []kustomizev1.HealthCheckSelector{
+				{APIVersion: "apps/v1", Kind: "Deployment", LabelSelector: metav1.LabelSelector{MatchLabels: podinfo}},
+			},
+			want: []string{"apps_prod-frontend-5f7d9_apps_Deployment", "staging_staging-frontend-8c1a2_apps_Deployment"},
+		},
+		{
+			name: "matches namespace",
+			selectors: []kustomizev1.HealthCheckSelector{
+				{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "apps", LabelSelector: metav1.LabelSelector{MatchLabels: podinfo}},
+			},
+			want: []string{"apps_prod-frontend-5f7d9_apps_Deployment"},
+		},
+		{
+			name: "matches any group without API version",
+			selectors: []kustomizev1.HealthCheckSelector{
+				{Kind: "Deployment", Namespace: "apps", LabelSelector: metav1.LabelSelector{MatchLabels: podinfo}},
+			},
+			want: []string{"apps_prod-frontend-5f7d9_apps_Deployment", "apps_prod-frontend_example.com_Deployment"},
+		},
+		{
+			name: "matches expressions and merges selectors",
+			selectors: []kustomizev1.HealthCheckSelector{
+				{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "apps", LabelSelector: metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"podinfo", "redis"}},
+					},
+				}},
+				{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "apps", LabelSelector: metav1.LabelSelector{MatchLabels: podinfo}},
+			},
+			want: []string{"apps_prod-frontend-5f7d9_apps_Deployment", "apps_prod-redis_apps_Deployment"},
+		},
+		{
+			name: "fails on empty match",
+			selectors: []kustomizev1.HealthCheckSelector{
+				{APIVersion: "apps/v1", Kind: "StatefulSet", Namespace: "apps", LabelSelector: metav1.LabelSelector{MatchLabels: podinfo}},
+			},
+			wantErr: "no applied StatefulSet in namespace 'apps' matches the health check selector 'app=podinfo'",
+		},
+		{
+			name: "allows empty match",
+			selectors: []kustomizev1.HealthCheckSelector{
+				{APIVersion: "apps/v1", Kind: "StatefulSet", LabelSelector: metav1.LabelSelector{MatchLabels: podinfo}, AllowEmpty: true},
+			},
+			want: nil,
+		},
+		{
+			name: "fails on invalid selector",
+			selectors: []kustomizev1.HealthCheckSelector{
+				{Kind: "Deployment", LabelSelector: metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "app", Operator: metav1.LabelSelectorOpIn},
+					},
+				}},
+			},
+			wantErr: "invalid label selector in .spec.healthCheckSelectors[0]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			selected, err := selectHealthChecks(tt.selectors, objects)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+
+			var ids []string
+			for _, o := range selected {
+				ids = append(ids, o.String())
+			}
+			g.Expect(ids).To(ConsistOf(tt.want))
+		})
+	}
+}
+
+func Test_ignoreWaitObjects(t *testing.T) {
+	newObject := func(group, kind, namespace, name string) object.ObjMetadata {
+		return object.ObjMetadata{
+			GroupKind: schema.GroupKind{Group: group, Kind: kind},
+			Namespace: namespace,
+			Name:      name,
+		}
+	}
+	objects := object.ObjMetadataSet{
+		newObject("apps", "Deployment", "apps", "frontend"),
+		newObject("example.com", "Widget", "apps", "frontend"),
+		newObject("example.com", "Widget", "staging", "frontend"),
+		newObject("example.com", "Widget", "apps", "backend"),
+		newObject("", "ConfigMap", "apps", "frontend"),
+	}
+
+	tests := []struct {
+		name        string
+		selectors   []kustomizev1.WaitIgnoreSelector
+		wantIgnored []string
+	}{
+		{
+			name:        "ignores nothing without selectors",
+			wantIgnored: nil,
+		},
+		{
+			name: "ignores kind in all namespaces",
+			selectors: []kustomizev1.WaitIgnoreSelector{
+				{Group: "example.com", Kind: "Widget"},
+			},
+			wantIgnored: []string{"apps_frontend_example.com_Widget", "staging_frontend_example.com_Widget", "apps_backend_example.com_Widget"},
+		},
+		{
+			name: "ignores by name and namespace",
+			selectors: []kustomizev1.WaitIgnoreSelector{
+				{Group: "example.com", Kind: "Widget", Name: "frontend", Namespace: "staging"},
+			},
+			wantIgnored: []string{"staging_frontend_example.com_Widget"},
+		},
+		{
+			name: "matches the core group",
+			selectors: []kustomizev1.WaitIgnoreSelector{
+				{Kind: "ConfigMap"},
+				{Kind: "Widget"},
+			},
+			wantIgnored: []string{"apps_frontend__ConfigMap"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			assessed, ignored := ignoreWaitObjects(tt.selectors, objects)
+			g.Expect(assessed).To(HaveLen(len(objects) - len(tt.wantIgnored)))
+
+			var ids []string
+			for _, o := range ignored {
+				ids = append(ids, o.String())
+			}
+			g.Expect(ids).To(ConsistOf(tt.wantIgnored))
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fluxcd/cli-utils/pkg/object"
+	"github.com/fluxcd/pkg/apis/meta"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/inventory"
+)
+
+// healthCheckGroup holds the objects of which the health is checked
+// together, with the same timeout.
+type healthCheckGroup struct {
+	// timeout is the time allowed for the objects to become healthy,
+	// measured from the start of the health checks.
+	timeout time.Duration
+	// overridden is true for the group of a single object of which the
+	// health check sets its own timeout.
+	overridden bool
+	objects    []object.ObjMetadata
+}
+
+// healthCheckObjects returns the objects of the health checks, and the
+// timeouts of the health checks which override the default one.
+func healthCheckObjects(healthChecks []kustomizev1.HealthCheck) (object.ObjMetadataSet, map[object.ObjMetadata]time.Duration, error) {
+	refs := make([]meta.NamespacedObjectKindReference, len(healthChecks))
+	for i, hc := range healthChecks {
+		refs[i] = hc.NamespacedObjectKindReference
+	}
+	objects, err := inventory.ReferenceToObjMetadataSet(refs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timeouts := make(map[object.ObjMetadata]time.Duration)
+	for i, hc := range healthChecks {
+		if hc.Timeout != nil {
+			timeouts[objects[i]] = hc.Timeout.Duration
+		}
+	}
+	return objects, timeouts, nil
+}
+
+// groupHealthChecks splits the objects in a group with the default timeout,
+// and a group for each object with an overridden timeout. The groups are
+// sorted by timeout, so that waiting for them in turn fails as soon as the
+// first deadline is exceeded, and lasts at most as long as the longest
+// timeout.
+func groupHealthChecks(objects []object.ObjMetadata, timeouts map[object.ObjMetadata]time.Duration,
+	defaultTimeout time.Duration) []healthCheckGroup {
+	var groups []healthCheckGroup
+	defaultGroup := healthCheckGroup{timeout: defaultTimeout}
+	for _, o := range objects {
+		if timeout, ok := timeouts[o]; ok {
+			groups = append(groups, healthCheckGroup{
+				timeout:    timeout,
+				overridden: true,
+				objects:    []object.ObjMetadata{o},
+			})
+			continue
+		}
+		defaultGroup.objects = append(defaultGroup.objects, o)
+	}
+	if len(defaultGroup.objects) > 0 {
+		groups = append(groups, defaultGroup)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].timeout < groups[j].timeout
+	})
+	return groups
+}
+
+// maxHealthCheckTimeout returns the longest timeout of the groups.
+func maxHealthCheckTimeout(groups []healthCheckGroup) time.Duration {
+	var result time.Duration
+	for _, group := range groups {
+		result = max(result, group.timeout)
+	}
+	return result
+}
+
+// healthCheckTimeoutError is returned when the health check of an object
+// with an overridden timeout fails.
+func healthCheckTimeoutError(group healthCheckGroup, err error) error {
+	return fmt.Errorf("health check of %s with a timeout of %s failed: %w",
+		formatObjMetadataSet(group.objects), group.timeout.String(), err)
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/cli-utils/pkg/object"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_HealthCheckTimeouts(t *testing.T) {
+	g := NewWithT(t)
+	id := "hct-" + randStringRunes(5)
+	revision := "v1.0.0"
+	resultK := &kustomizev1.Kustomization{}
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "configs.yaml",
+			Body: `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: fast
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: slow
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("hct-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	healthCheck := func(name string, timeout time.Duration) kustomizev1.HealthCheck {
+		hc := kustomizev1.HealthCheck{
+			NamespacedObjectKindReference: meta.NamespacedObjectKindReference{
+				APIVersion: "v1",
+				Kind:       "ConfigMap",
+				Name:       name,
+				Namespace:  id,
+			},
+		}
+		if timeout > 0 {
+			hc.Timeout = &metav1.Duration{Duration: timeout}
+		}
+		return hc
+	}
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("hct-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Timeout:  &metav1.Duration{Duration: 30 * time.Second},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			HealthChecks: []kustomizev1.HealthCheck{
+				healthCheck("fast", 5*time.Second),
+				healthCheck("slow", 0),
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	t.Run("passes the health checks with mixed timeouts", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+		kstatusCheck.CheckErr(ctx, resultK)
+
+		g.Expect(conditions.IsTrue(resultK, meta.HealthyCondition)).To(BeTrue())
+	})
+
+	t.Run("fails on the overridden timeout of a missing resource", func(t *testing.T) {
+		g := NewWithT(t)
+		resultK.Spec.HealthChecks = append(resultK.Spec.HealthChecks, healthCheck("missing", 2*time.Second))
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.ObservedGeneration == resultK.GetGeneration() &&
+				conditions.IsFalse(resultK, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(meta.HealthCheckFailedReason))
+		g.Expect(conditions.IsFalse(resultK, meta.HealthyCondition)).To(BeTrue())
+		g.Expect(conditions.GetMessage(resultK, meta.HealthyCondition)).To(ContainSubstring(
+			fmt.Sprintf("health check of ConfigMap/%s/missing with a timeout of 2s failed", id)))
+	})
+}
+
+func Test_groupHealthChecks(t *testing.T) {
+	configMap := func(name string) object.ObjMetadata {
+		return object.ObjMetadata{
+			Namespace: "default",
+			Name:      name,
+			GroupKind: schema.GroupKind{Kind: "ConfigMap"},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		objects  []object.ObjMetadata
+		timeouts map[object.ObjMetadata]time.Duration
+		want     []healthCheckGroup
+	}{
+		{
+			name:    "uses the default timeout",
+			objects: []object.ObjMetadata{configMap("a"), configMap("b")},
+			want: []healthCheckGroup{
+				{timeout: time.Minute, objects: []object.ObjMetadata{configMap("a"), configMap("b")}},
+			},
+		},
+		{
+			name:    "sorts the overridden timeouts",
+			objects: []object.ObjMetadata{configMap("a"), configMap("b"), configMap("c")},
+			timeouts: map[object.ObjMetadata]time.Duration{
+				configMap("a"): 10 * time.Minute,
+				configMap("c"): 10 * time.Second,
+			},
+			want: []healthCheckGroup{
+				{timeout: 10 * time.Second, overridden: true, objects: []object.ObjMetadata{configMap("c")}},
+				{timeout: time.Minute, objects: []object.ObjMetadata{configMap("b")}},
+				{timeout: 10 * time.Minute, overridden: true, objects: []object.ObjMetadata{configMap("a")}},
+			},
+		},
+		{
+			name:    "omits the empty default group",
+			objects: []object.ObjMetadata{configMap("a")},
+			timeouts: map[object.ObjMetadata]time.Duration{
+				configMap("a"): time.Second,
+			},
+			want: []healthCheckGroup{
+				{timeout: time.Second, overridden: true, objects: []object.ObjMetadata{configMap("a")}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			groups := groupHealthChecks(tt.objects, tt.timeouts, time.Minute)
+			g.Expect(groups).To(Equal(tt.want))
+			g.Expect(maxHealthCheckTimeout(groups)).To(Equal(tt.want[len(tt.want)-1].timeout))
+		})
+	}
+}
+
+func Test_healthCheckObjects(t *testing.T) {
+	g := NewWithT(t)
+
+	objects, timeouts, err := healthCheckObjects([]kustomizev1.HealthCheck{
+		{
+			NamespacedObjectKindReference: meta.NamespacedObjectKindReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       "backend",
+				Namespace:  "default",
+			},
+			Timeout: &metav1.Duration{Duration: 5 * time.Minute},
+		},
+		{
+			NamespacedObjectKindReference: meta.NamespacedObjectKindReference{
+				APIVersion: "v1",
+				Kind:       "ConfigMap",
+				Name:       "frontend",
+				Namespace:  "default",
+			},
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	backend := object.ObjMetadata{
+		Namespace: "default",
+		Name:      "backend",
+		GroupKind: schema.GroupKind{Group: "apps", Kind: "Deployment"},
+	}
+	g.Expect(objects).To(HaveLen(2))
+	g.Expect(objects[0]).To(Equal(backend))
+	g.Expect(timeouts).To(Equal(map[object.ObjMetadata]time.Duration{backend: 5 * time.Minute}))
+}
@@ -19,6 +19,7 @@ package controller
 import (
 	"context"
 	"fmt"
+	"slices"
 
 	"github.com/fluxcd/pkg/runtime/conditions"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -59,7 +60,7 @@ func (r *KustomizationReconciler) requestsForRevisionChangeOf(indexKey string) h
 		for i, d := range list.Items {
 			// If the Kustomization is ready and the revision of the artifact equals
 			// to the last attempted revision, we should not make a request for this Kustomization
-			if conditions.IsReady(&list.Items[i]) && repo.GetArtifact().HasRevision(d.Status.LastAttemptedRevision) {
+			if conditions.IsReady(&list.Items[i]) && hasSourceRevision(repo.GetArtifact(), d.Status.LastAttemptedRevision) {
 				continue
 			}
 			dd = append(dd, d.DeepCopy())
@@ -85,14 +86,27 @@ func (r *KustomizationReconciler) indexBy(kind string) func(o client.Object) []s
 			panic(fmt.Sprintf("Expected a Kustomization, got %T", o))
 		}
 
-		if k.Spec.SourceRef.Kind == kind {
+		// The Kustomization is reconciled when its source or any of its
+		// additional sources advertises a new revision.
+		var keys []string
+		refs := []kustomizev1.CrossNamespaceSourceReference{k.Spec.SourceRef}
+		for _, as := range k.Spec.AdditionalSources {
+			refs = append(refs, as.SourceRef)
+		}
+		for _, ref := range refs {
+			if ref.Kind != kind {
+				continue
+			}
 			namespace := k.GetNamespace()
-			if k.Spec.SourceRef.Namespace != "" {
-				namespace = k.Spec.SourceRef.Namespace
+			if ref.Namespace != "" {
+				namespace = ref.Namespace
+			}
+			key := fmt.Sprintf("%s/%s", namespace, ref.Name)
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
 			}
-			return []string{fmt.Sprintf("%s/%s", namespace, k.Spec.SourceRef.Name)}
 		}
 
-		return nil
+		return keys
 	}
 }
@@ -0,0 +1,151 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fluxcd/cli-utils/pkg/kstatus/polling"
+	"github.com/fluxcd/pkg/apis/meta"
+	runtimeClient "github.com/fluxcd/pkg/runtime/client"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+const (
+	// defaultTokenKey is the key of the token in the Secret of a KubeConfig
+	// reference with an address.
+	defaultTokenKey = "token"
+
+	// defaultCAKey is the key of the CA certificate in the ConfigMap of a
+	// KubeConfig reference with an address.
+	defaultCAKey = "ca.crt"
+)
+
+// newImpersonator returns the Impersonator of the Kustomization, with the
+// kubeconfig Secret of the KubeConfig reference if it has no address.
+func (r *KustomizationReconciler) newImpersonator(obj *kustomizev1.Kustomization,
+	statusPoller *polling.StatusPoller,
+	pollingOpts polling.Options) *runtimeClient.Impersonator {
+	var kubeConfigRef *meta.KubeConfigReference
+	if ref := obj.Spec.KubeConfig; ref != nil && ref.Address == "" {
+		kubeConfigRef = &meta.KubeConfigReference{SecretRef: ref.SecretRef}
+	}
+	return runtimeClient.NewImpersonator(
+		r.Client,
+		statusPoller,
+		pollingOpts,
+		kubeConfigRef,
+		r.KubeConfigOpts,
+		r.DefaultServiceAccount,
+		obj.Spec.ServiceAccountName,
+		obj.GetNamespace(),
+	)
+}
+
+// getKubeClient returns the client and status poller that apply the
+// resources of the Kustomization. When the KubeConfig reference has an
+// address, the client is built from the address, the CA certificate and the
+// token of the reference. The token is read on every call, so a rotation of
+// the Secret takes effect on the next reconciliation.
+func (r *KustomizationReconciler) getKubeClient(ctx context.Context,
+	obj *kustomizev1.Kustomization,
+	impersonation *runtimeClient.Impersonator,
+	pollingOpts polling.Options) (client.Client, *polling.StatusPoller, error) {
+	ref := obj.Spec.KubeConfig
+	if ref == nil || ref.Address == "" {
+		return impersonation.GetClient(ctx)
+	}
+
+	restConfig, err := r.kubeConfigFromAddress(ctx, obj.GetNamespace(), ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	restConfig = runtimeClient.KubeConfig(restConfig, r.KubeConfigOpts)
+
+	name := r.DefaultServiceAccount
+	if sa := obj.Spec.ServiceAccountName; sa != "" {
+		name = sa
+	}
+	if name != "" {
+		restConfig.Impersonate = rest.ImpersonationConfig{
+			UserName: fmt.Sprintf("system:serviceaccount:%s:%s", obj.GetNamespace(), name),
+		}
+	}
+
+	restMapper, err := runtimeClient.NewDynamicRESTMapper(restConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	kubeClient, err := client.New(restConfig, client.Options{
+		Scheme: r.Client.Scheme(),
+		Mapper: restMapper,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return kubeClient, polling.NewStatusPoller(kubeClient, restMapper, pollingOpts), nil
+}
+
+// kubeConfigFromAddress returns the REST config of the KubeConfig reference
+// with an address, with the token of its Secret and its CA certificate.
+func (r *KustomizationReconciler) kubeConfigFromAddress(ctx context.Context,
+	namespace string,
+	ref *kustomizev1.KubeConfigReference) (*rest.Config, error) {
+	secretName := types.NamespacedName{Namespace: namespace, Name: ref.SecretRef.Name}
+	var secret corev1.Secret
+	if err := r.Get(ctx, secretName, &secret); err != nil {
+		return nil, fmt.Errorf("unable to read KubeConfig secret '%s' error: %w", secretName, err)
+	}
+	tokenKey := defaultTokenKey
+	if ref.SecretRef.Key != "" {
+		tokenKey = ref.SecretRef.Key
+	}
+	token, ok := secret.Data[tokenKey]
+	if !ok || len(token) == 0 {
+		return nil, fmt.Errorf("KubeConfig secret '%s' does not contain a '%s' key with a token", secretName, tokenKey)
+	}
+
+	caData := []byte(ref.CAData)
+	if ref.ConfigMapRef != nil {
+		cmName := types.NamespacedName{Namespace: namespace, Name: ref.ConfigMapRef.Name}
+		var cm corev1.ConfigMap
+		if err := r.Get(ctx, cmName, &cm); err != nil {
+			return nil, fmt.Errorf("unable to read KubeConfig config map '%s' error: %w", cmName, err)
+		}
+		caKey := defaultCAKey
+		if ref.ConfigMapRef.Key != "" {
+			caKey = ref.ConfigMapRef.Key
+		}
+		ca, ok := cm.Data[caKey]
+		if !ok || ca == "" {
+			return nil, fmt.Errorf("KubeConfig config map '%s' does not contain a '%s' key with a CA certificate", cmName, caKey)
+		}
+		caData = []byte(ca)
+	}
+
+	return &rest.Config{
+		Host:            ref.Address,
+		BearerToken:     string(token),
+		TLSClientConfig: rest.TLSClientConfig{CAData: caData},
+	}, nil
+}
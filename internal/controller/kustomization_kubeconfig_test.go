@@ -0,0 +1,224 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_KubeConfigAddress(t *testing.T) {
+	g := NewWithT(t)
+	id := "kca-" + randStringRunes(5)
+	revision := "v1.0.0"
+	resultK := &kustomizev1.Kustomization{}
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "remote",
+			Namespace: id,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), sa)).To(Succeed())
+
+	crb := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: id,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      "ServiceAccount",
+				Name:      sa.Name,
+				Namespace: id,
+			},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "ClusterRole",
+			Name:     "cluster-admin",
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), crb)).To(Succeed())
+
+	tokenRequest := &authenticationv1.TokenRequest{}
+	err = k8sClient.SubResource("token").Create(context.Background(), sa, tokenRequest)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to request a service account token")
+	token := tokenRequest.Status.Token
+	g.Expect(token).NotTo(BeEmpty())
+
+	tokenSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "remote-token",
+			Namespace: id,
+		},
+		StringData: map[string]string{
+			"token": token,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), tokenSecret)).To(Succeed())
+
+	caConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "remote-ca",
+			Namespace: id,
+		},
+		Data: map[string]string{
+			"ca.crt": string(testEnv.Config.CAData),
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), caConfigMap)).To(Succeed())
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "configmap.yaml",
+			Body: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: remote
+data:
+  key: value
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("kca-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("kca-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				Address: testEnv.Config.Host,
+				ConfigMapRef: &kustomizev1.ConfigMapKeyReference{
+					Name: caConfigMap.Name,
+				},
+				SecretRef: meta.SecretKeyReference{
+					Name: tokenSecret.Name,
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Prune:           true,
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	t.Run("applies with the token of the secret", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		resultCM := &corev1.ConfigMap{}
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "remote", Namespace: id}, resultCM)).To(Succeed())
+	})
+
+	t.Run("fails after the token is rotated to an invalid one", func(t *testing.T) {
+		g := NewWithT(t)
+		tokenSecret.StringData = map[string]string{"token": "invalid"}
+		g.Expect(k8sClient.Update(context.Background(), tokenSecret)).To(Succeed())
+
+		revision = "v2.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAttemptedRevision == revision &&
+				conditions.IsFalse(resultK, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(resultK.Status.LastAppliedRevision).NotTo(Equal(revision))
+	})
+
+	t.Run("recovers after the token is rotated to a valid one", func(t *testing.T) {
+		g := NewWithT(t)
+		tokenSecret.StringData = map[string]string{"token": token}
+		g.Expect(k8sClient.Update(context.Background(), tokenSecret)).To(Succeed())
+
+		revision = "v3.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+	})
+
+	t.Run("rejects the CA without an address", func(t *testing.T) {
+		g := NewWithT(t)
+		invalid := &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("kca-%s", randStringRunes(5)),
+				Namespace: id,
+			},
+			Spec: kustomizev1.KustomizationSpec{
+				Interval: metav1.Duration{Duration: 2 * time.Minute},
+				Path:     "./",
+				KubeConfig: &kustomizev1.KubeConfigReference{
+					CAData: string(testEnv.Config.CAData),
+					SecretRef: meta.SecretKeyReference{
+						Name: tokenSecret.Name,
+					},
+				},
+				SourceRef: kustomization.Spec.SourceRef,
+			},
+		}
+		err := k8sClient.Create(context.Background(), invalid)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("caData and configMapRef can only be set with address"))
+	})
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/cli-utils/pkg/object"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_Paths(t *testing.T) {
+	g := NewWithT(t)
+	id := "paths-" + randStringRunes(5)
+	revision := "v1.0.0"
+	resultK := &kustomizev1.Kustomization{}
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	configMap := func(path, name string) testserver.File {
+		return testserver.File{
+			Name: path + "/" + name + ".yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+data:
+  path: %[2]s
+`, name, path),
+		}
+	}
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		configMap("operators", "operator"),
+		configMap("apps", "app"),
+		configMap("duplicates", "app"),
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("paths-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("paths-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Paths:    []string{"./operators", "./apps"},
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Prune:           true,
+		},
+	}
+
+	t.Run("rejects both path and paths", func(t *testing.T) {
+		g := NewWithT(t)
+		invalid := kustomization.DeepCopy()
+		invalid.Spec.Path = "./apps"
+		err := k8sClient.Create(context.Background(), invalid)
+		g.Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		g.Expect(err.Error()).To(ContainSubstring("path and paths are mutually exclusive"))
+	})
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	t.Run("applies the resources of all paths as a unit", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+		kstatusCheck.CheckErr(ctx, resultK)
+
+		for _, name := range []string{"operator", "app"} {
+			var cm corev1.ConfigMap
+			g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: name, Namespace: id}, &cm)).To(Succeed())
+		}
+
+		var entries []string
+		for _, entry := range resultK.Status.Inventory.Entries {
+			entries = append(entries, entry.ID)
+		}
+		g.Expect(entries).To(ConsistOf(
+			fmt.Sprintf("%s_operator__ConfigMap", id),
+			fmt.Sprintf("%s_app__ConfigMap", id),
+		))
+	})
+
+	t.Run("fails on objects built from more than one path", func(t *testing.T) {
+		g := NewWithT(t)
+		resultK.Spec.Paths = []string{"./operators", "./apps", "./duplicates"}
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.ObservedGeneration == resultK.GetGeneration() &&
+				conditions.IsFalse(resultK, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(meta.BuildFailedReason))
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring(
+			fmt.Sprintf("ConfigMap/%s/app is built from both path './apps' and path './duplicates'", id)))
+
+		// The resources of the last successful reconciliation are kept.
+		var cm corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: "app", Namespace: id}, &cm)).To(Succeed())
+		g.Expect(cm.Data).To(HaveKeyWithValue("path", "apps"))
+	})
+
+	t.Run("prunes the resources of a removed path", func(t *testing.T) {
+		g := NewWithT(t)
+		resultK.Spec.Paths = []string{"./apps"}
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.ObservedGeneration == resultK.GetGeneration() && isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), client.ObjectKey{Name: "operator", Namespace: id}, &corev1.ConfigMap{})
+			return apierrors.IsNotFound(err)
+		}, timeout, time.Second).Should(BeTrue())
+	})
+}
+
+func Test_appendBuiltObjects(t *testing.T) {
+	g := NewWithT(t)
+
+	newObject := func(kind, name string) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("v1")
+		u.SetKind(kind)
+		u.SetName(name)
+		u.SetNamespace("apps")
+		return u
+	}
+
+	builtFrom := make(map[object.ObjMetadata]string)
+	objects, err := appendBuiltObjects(nil, builtFrom, "./crds",
+		[]*unstructured.Unstructured{newObject("ConfigMap", "b"), newObject("ConfigMap", "a")})
+	g.Expect(err).ToNot(HaveOccurred())
+	objects, err = appendBuiltObjects(objects, builtFrom, "./apps",
+		[]*unstructured.Unstructured{newObject("Secret", "a"), newObject("ConfigMap", "c")})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// The objects are kept in the order of the paths, and of their builds.
+	var names []string
+	for _, u := range objects {
+		names = append(names, u.GetKind()+"/"+u.GetName())
+	}
+	g.Expect(names).To(Equal([]string{"ConfigMap/b", "ConfigMap/a", "Secret/a", "ConfigMap/c"}))
+
+	_, err = appendBuiltObjects(objects, builtFrom, "./other",
+		[]*unstructured.Unstructured{newObject("ConfigMap", "d"), newObject("ConfigMap", "a")})
+	g.Expect(err).To(MatchError("ConfigMap/apps/a is built from both path './crds' and path './other'"))
+}
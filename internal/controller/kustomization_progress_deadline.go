@@ -0,0 +1,73 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// stalledReason returns the reason of the Stalled condition of the
+// Kustomization, or an empty string if it is not stalled.
+func stalledReason(obj *kustomizev1.Kustomization) string {
+	if !conditions.IsTrue(obj, meta.StalledCondition) {
+		return ""
+	}
+	return conditions.GetReason(obj, meta.StalledCondition)
+}
+
+// markProgressDeadline records the failed reconciliation in the failure
+// status of the Kustomization, and marks it as stalled if the reconciliations
+// have been failing with the same reason for longer than the progress
+// deadline. The failure status starts over when the reason, the last
+// attempted revision or the generation changes. It returns true if the
+// Kustomization is stalled.
+func markProgressDeadline(obj *kustomizev1.Kustomization, now time.Time) bool {
+	deadline := obj.Spec.ProgressDeadline
+	if deadline == nil {
+		obj.Status.Failure = nil
+		return false
+	}
+
+	reason := conditions.GetReason(obj, meta.ReadyCondition)
+	failure := obj.Status.Failure
+	if failure == nil ||
+		failure.Reason != reason ||
+		failure.Revision != obj.Status.LastAttemptedRevision ||
+		failure.ObservedGeneration != obj.GetGeneration() {
+		failure = &kustomizev1.FailureStatus{
+			Since:              metav1.NewTime(now),
+			Reason:             reason,
+			Revision:           obj.Status.LastAttemptedRevision,
+			ObservedGeneration: obj.GetGeneration(),
+		}
+		obj.Status.Failure = failure
+	}
+
+	if now.Sub(failure.Since.Time) < deadline.Duration {
+		return false
+	}
+	conditions.MarkStalled(obj, reason,
+		"Reconciliation failing with %s since %s, exceeding the progress deadline of %s",
+		reason, failure.Since.UTC().Format(time.RFC3339), deadline.Duration.String())
+	return true
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_ProgressDeadline(t *testing.T) {
+	g := NewWithT(t)
+	id := "pd-" + randStringRunes(5)
+	revision := "v1.0.0"
+	resultK := &kustomizev1.Kustomization{}
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "kustomization.yaml",
+			Body: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- missing.yaml
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("pd-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("pd-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval:         metav1.Duration{Duration: reconciliationInterval},
+			RetryInterval:    &metav1.Duration{Duration: time.Second},
+			ProgressDeadline: &metav1.Duration{Duration: 3 * time.Second},
+			Path:             "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	var since metav1.Time
+	var stalledAt metav1.Time
+
+	t.Run("stalls after the progress deadline", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsTrue(resultK, meta.StalledCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.IsFalse(resultK, meta.ReadyCondition)).To(BeTrue())
+		g.Expect(conditions.GetReason(resultK, meta.StalledCondition)).To(Equal(meta.BuildFailedReason))
+		g.Expect(resultK.Status.Failure).NotTo(BeNil())
+		g.Expect(resultK.Status.Failure.Reason).To(Equal(meta.BuildFailedReason))
+		g.Expect(resultK.Status.Failure.Revision).To(Equal(revision))
+		g.Expect(conditions.GetMessage(resultK, meta.StalledCondition)).To(
+			ContainSubstring(resultK.Status.Failure.Since.UTC().Format(time.RFC3339)))
+
+		since = resultK.Status.Failure.Since
+		stalledAt = conditions.Get(resultK, meta.StalledCondition).LastTransitionTime
+	})
+
+	t.Run("stays stalled with the first failure time on retries", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			c := conditions.Get(resultK, meta.StalledCondition)
+			return c != nil && c.Status == metav1.ConditionTrue && c.LastTransitionTime.After(stalledAt.Time)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.GetReason(resultK, meta.StalledCondition)).To(Equal(meta.BuildFailedReason))
+		g.Expect(resultK.Status.Failure.Since.Equal(&since)).To(BeTrue())
+	})
+
+	t.Run("recovers on a new revision", func(t *testing.T) {
+		g := NewWithT(t)
+		artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+			{
+				Name: "configmap.yaml",
+				Body: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: fixed
+`,
+			},
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		revision = "v2.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.Has(resultK, meta.StalledCondition)).To(BeFalse())
+		g.Expect(resultK.Status.Failure).To(BeNil())
+	})
+}
+
+func Test_markProgressDeadline(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	newObj := func(deadline *metav1.Duration) *kustomizev1.Kustomization {
+		obj := &kustomizev1.Kustomization{
+			Spec: kustomizev1.KustomizationSpec{
+				ProgressDeadline: deadline,
+			},
+		}
+		obj.Generation = 1
+		obj.Status.LastAttemptedRevision = "main@sha1:a"
+		conditions.MarkFalse(obj, meta.ReadyCondition, meta.BuildFailedReason, "build failed")
+		return obj
+	}
+
+	t.Run("does not track the failures without a deadline", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(nil)
+		obj.Status.Failure = &kustomizev1.FailureStatus{Reason: meta.BuildFailedReason}
+		g.Expect(markProgressDeadline(obj, now)).To(BeFalse())
+		g.Expect(obj.Status.Failure).To(BeNil())
+		g.Expect(conditions.Has(obj, meta.StalledCondition)).To(BeFalse())
+	})
+
+	t.Run("stalls after the deadline and holds the first failure", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(&metav1.Duration{Duration: 10 * time.Minute})
+
+		g.Expect(markProgressDeadline(obj, now)).To(BeFalse())
+		g.Expect(markProgressDeadline(obj, now.Add(5*time.Minute))).To(BeFalse())
+		g.Expect(stalledReason(obj)).To(BeEmpty())
+
+		g.Expect(markProgressDeadline(obj, now.Add(10*time.Minute))).To(BeTrue())
+		g.Expect(stalledReason(obj)).To(Equal(meta.BuildFailedReason))
+		g.Expect(conditions.GetMessage(obj, meta.StalledCondition)).To(Equal(
+			"Reconciliation failing with BuildFailed since 2024-01-01T12:00:00Z, exceeding the progress deadline of 10m0s"))
+
+		g.Expect(markProgressDeadline(obj, now.Add(20*time.Minute))).To(BeTrue())
+		g.Expect(stalledReason(obj)).To(Equal(meta.BuildFailedReason))
+		g.Expect(obj.Status.Failure).To(Equal(&kustomizev1.FailureStatus{
+			Since:              metav1.NewTime(now),
+			Reason:             meta.BuildFailedReason,
+			Revision:           "main@sha1:a",
+			ObservedGeneration: 1,
+		}))
+	})
+
+	t.Run("starts over on a new revision", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(&metav1.Duration{Duration: 10 * time.Minute})
+		markProgressDeadline(obj, now)
+
+		obj.Status.LastAttemptedRevision = "main@sha1:b"
+		g.Expect(markProgressDeadline(obj, now.Add(15*time.Minute))).To(BeFalse())
+		g.Expect(obj.Status.Failure.Since.Time).To(Equal(now.Add(15 * time.Minute)))
+		g.Expect(obj.Status.Failure.Revision).To(Equal("main@sha1:b"))
+	})
+
+	t.Run("starts over on a new generation", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(&metav1.Duration{Duration: 10 * time.Minute})
+		markProgressDeadline(obj, now)
+
+		obj.Generation = 2
+		g.Expect(markProgressDeadline(obj, now.Add(15*time.Minute))).To(BeFalse())
+		g.Expect(obj.Status.Failure.ObservedGeneration).To(Equal(int64(2)))
+	})
+
+	t.Run("starts over on a different reason", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(&metav1.Duration{Duration: 10 * time.Minute})
+		markProgressDeadline(obj, now)
+
+		conditions.MarkFalse(obj, meta.ReadyCondition, meta.HealthCheckFailedReason, "health check failed")
+		g.Expect(markProgressDeadline(obj, now.Add(15*time.Minute))).To(BeFalse())
+		g.Expect(obj.Status.Failure.Reason).To(Equal(meta.HealthCheckFailedReason))
+	})
+}
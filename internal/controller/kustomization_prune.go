@@ -0,0 +1,175 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fluxcd/cli-utils/pkg/object"
+	eventv1 "github.com/fluxcd/pkg/apis/event/v1beta1"
+	"github.com/fluxcd/pkg/ssa"
+	ssautil "github.com/fluxcd/pkg/ssa/utils"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// skipPruneProtected returns the objects which may be garbage collected,
+// leaving out the ones of which the in-cluster labels match the prune
+// disableSelector of the Kustomization. The skipped objects are reported
+// with an event.
+func (r *KustomizationReconciler) skipPruneProtected(ctx context.Context,
+	kubeClient client.Client,
+	obj *kustomizev1.Kustomization,
+	revision string,
+	originRevision string,
+	objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	disableSelector := obj.GetPruneDisableSelector()
+	if disableSelector == nil || len(objects) == 0 {
+		return objects, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(disableSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pruneOptions disableSelector: %w", err)
+	}
+
+	var deletable, protected []*unstructured.Unstructured
+	for _, u := range objects {
+		existing := &unstructured.Unstructured{}
+		existing.SetGroupVersionKind(u.GroupVersionKind())
+		err := kubeClient.Get(ctx, client.ObjectKeyFromObject(u), existing)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%s query failed: %w", ssautil.FmtUnstructured(u), err)
+		}
+		if err == nil && selector.Matches(labels.Set(existing.GetLabels())) {
+			protected = append(protected, u)
+			continue
+		}
+		deletable = append(deletable, u)
+	}
+
+	if len(protected) > 0 {
+		msg := fmt.Sprintf("garbage collection skipped for objects matching the pruneOptions disableSelector:\n%s",
+			ssautil.FmtUnstructuredList(protected))
+		ctrl.LoggerFrom(ctx).Info(msg)
+		r.event(obj, revision, originRevision, eventv1.EventSeverityInfo, msg, nil)
+	}
+
+	return deletable, nil
+}
+
+// pruneDeleteOptions returns the options of the delete calls issued by the
+// garbage collection and the finalization of the Kustomization. It returns
+// an error if the deletion propagation policy is invalid, which the enum of
+// the CRD schema rejects on admission.
+func pruneDeleteOptions(manager *ssa.ResourceManager, obj *kustomizev1.Kustomization) (ssa.DeleteOptions, error) {
+	policy := obj.GetPruneDeletionPropagation()
+	switch policy {
+	case metav1.DeletePropagationBackground, metav1.DeletePropagationForeground, metav1.DeletePropagationOrphan:
+	default:
+		return ssa.DeleteOptions{}, fmt.Errorf("invalid pruneOptions deletionPropagation '%s', must be one of %s, %s or %s",
+			policy, metav1.DeletePropagationBackground, metav1.DeletePropagationForeground, metav1.DeletePropagationOrphan)
+	}
+	return ssa.DeleteOptions{
+		PropagationPolicy: policy,
+		Inclusions:        manager.GetOwnerLabels(obj.Name, obj.Namespace),
+		Exclusions: map[string]string{
+			fmt.Sprintf("%s/prune", kustomizev1.GroupVersion.Group):     kustomizev1.DisabledValue,
+			fmt.Sprintf("%s/reconcile", kustomizev1.GroupVersion.Group): kustomizev1.DisabledValue,
+		},
+	}, nil
+}
+
+// terminationTimeoutError is returned when deleted objects are still
+// terminating at the timeout, e.g. because the foreground deletion of
+// their dependents is blocked by finalizers. The Objects are the in-cluster
+// objects, with their finalizers.
+type terminationTimeoutError struct {
+	Timeout time.Duration
+	Objects []*unstructured.Unstructured
+}
+
+// Error implements the error interface.
+func (e *terminationTimeoutError) Error() string {
+	objects := make([]string, 0, len(e.Objects))
+	for _, u := range e.Objects {
+		entry := ssautil.FmtUnstructured(u)
+		if finalizers := u.GetFinalizers(); len(finalizers) > 0 {
+			entry = fmt.Sprintf("%s (finalizers: %s)", entry, strings.Join(finalizers, ", "))
+		}
+		objects = append(objects, entry)
+	}
+	return fmt.Sprintf("deletion timed out after %s, objects stuck terminating:\n%s",
+		e.Timeout.String(), strings.Join(objects, "\n"))
+}
+
+// waitForTermination waits for the deleted objects to be gone. At the timeout,
+// it returns a terminationTimeoutError with the objects still terminating.
+func waitForTermination(ctx context.Context,
+	manager *ssa.ResourceManager,
+	objects []*unstructured.Unstructured,
+	timeout time.Duration) error {
+	if err := manager.WaitForTermination(objects, ssa.WaitOptions{
+		Interval: 2 * time.Second,
+		Timeout:  timeout,
+	}); err == nil {
+		return nil
+	}
+
+	var terminating []*unstructured.Unstructured
+	for _, u := range objects {
+		existing := &unstructured.Unstructured{}
+		existing.SetGroupVersionKind(u.GroupVersionKind())
+		err := manager.Client().Get(ctx, client.ObjectKeyFromObject(u), existing)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s query failed: %w", ssautil.FmtUnstructured(u), err)
+		}
+		terminating = append(terminating, existing)
+	}
+	if len(terminating) == 0 {
+		return nil
+	}
+	return &terminationTimeoutError{Timeout: timeout, Objects: terminating}
+}
+
+// terminatingChangeSet returns the entries of the change set of the objects
+// which are still terminating.
+func terminatingChangeSet(changeSet *ssa.ChangeSet, terminating []*unstructured.Unstructured) *ssa.ChangeSet {
+	ids := make(map[object.ObjMetadata]bool, len(terminating))
+	for _, u := range terminating {
+		ids[object.UnstructuredToObjMetadata(u)] = true
+	}
+	result := ssa.NewChangeSet()
+	for _, entry := range changeSet.Entries {
+		if ids[entry.ObjMetadata] {
+			result.Add(entry)
+		}
+	}
+	return result
+}
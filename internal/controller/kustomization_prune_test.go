@@ -18,21 +18,31 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/ssa"
+	ssautil "github.com/fluxcd/pkg/ssa/utils"
 	"github.com/fluxcd/pkg/testserver"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/inventory"
 )
 
 func TestKustomizationReconciler_Prune(t *testing.T) {
@@ -98,7 +108,7 @@ data:
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: reconciliationInterval},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -226,7 +236,7 @@ data:
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: reconciliationInterval},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -384,7 +394,7 @@ data:
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: reconciliationInterval},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -441,3 +451,767 @@ data:
 	})
 
 }
+
+func TestKustomizationReconciler_PruneDisableSelector(t *testing.T) {
+	g := NewWithT(t)
+	id := "gc-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	manifests := func(names ...string) []testserver.File {
+		var files []testserver.File
+		for _, name := range names {
+			files = append(files, testserver.File{
+				Name: name + ".yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %[1]s
+data:
+  key: "%[1]s"
+`, name),
+			})
+		}
+		return files
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests("hotfix", "stale"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("gc-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("gc-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Prune:           true,
+			PruneOptions: &kustomizev1.PruneOptions{
+				DisableSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"hotfix": "true"},
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	// protect marks the in-cluster ConfigMap as hand-managed.
+	protect := func(name string) {
+		cm := &corev1.ConfigMap{}
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: name, Namespace: id}, cm)).To(Succeed())
+		patch := client.MergeFrom(cm.DeepCopy())
+		cm.Labels["hotfix"] = "true"
+		g.Expect(k8sClient.Patch(context.Background(), cm, patch)).To(Succeed())
+	}
+
+	t.Run("skips objects matching the selector", func(t *testing.T) {
+		g := NewWithT(t)
+		protect("hotfix")
+
+		revision = "v2.0.0"
+		artifact, err := testServer.ArtifactFromFiles(manifests("final"))
+		g.Expect(err).NotTo(HaveOccurred())
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "hotfix", Namespace: id}, &corev1.ConfigMap{})).To(Succeed())
+		err = k8sClient.Get(context.Background(), types.NamespacedName{Name: "stale", Namespace: id}, &corev1.ConfigMap{})
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		events := getEvents(resultK.GetName(), map[string]string{"kustomize.toolkit.fluxcd.io/revision": revision})
+		g.Expect(events).To(ContainElement(HaveField("Message", Equal(
+			fmt.Sprintf("garbage collection skipped for objects matching the pruneOptions disableSelector:\nConfigMap/%s/hotfix", id)))))
+	})
+
+	t.Run("skips objects matching the selector on deletion", func(t *testing.T) {
+		g := NewWithT(t)
+		protect("final")
+
+		g.Expect(k8sClient.Delete(context.Background(), kustomization)).To(Succeed())
+		g.Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), kustomization)
+			return apierrors.IsNotFound(err)
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "final", Namespace: id}, &corev1.ConfigMap{})).To(Succeed())
+
+		events := getEvents(kustomization.GetName(), nil)
+		g.Expect(events).To(ContainElement(HaveField("Message", Equal(
+			fmt.Sprintf("garbage collection skipped for objects matching the pruneOptions disableSelector:\nConfigMap/%s/final", id)))))
+	})
+}
+
+func TestKustomizationReconciler_PruneSchema(t *testing.T) {
+	g := NewWithT(t)
+	id := "gc-" + randStringRunes(5)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	newKustomization := func(spec map[string]any) *unstructured.Unstructured {
+		spec["interval"] = "5m"
+		spec["sourceRef"] = map[string]any{"kind": sourcev1.GitRepositoryKind, "name": "source"}
+		u := &unstructured.Unstructured{Object: map[string]any{"spec": spec}}
+		u.SetGroupVersionKind(kustomizev1.GroupVersion.WithKind(kustomizev1.KustomizationKind))
+		u.SetName("gc-" + randStringRunes(5))
+		u.SetNamespace(id)
+		return u
+	}
+
+	tests := []struct {
+		name    string
+		spec    map[string]any
+		wantErr string
+	}{
+		{
+			name: "boolean prune with options",
+			spec: map[string]any{
+				"prune": true,
+				"pruneOptions": map[string]any{
+					"disableSelector": map[string]any{"matchLabels": map[string]any{"hotfix": "true"}},
+					"wait":            true,
+					"waitTimeout":     "1m",
+				},
+			},
+		},
+		{
+			name:    "string prune",
+			spec:    map[string]any{"prune": "true"},
+			wantErr: "spec.prune",
+		},
+		{
+			name:    "object prune",
+			spec:    map[string]any{"prune": map[string]any{"enabled": true}},
+			wantErr: "spec.prune",
+		},
+		{
+			name: "string wait",
+			spec: map[string]any{
+				"prune":        true,
+				"pruneOptions": map[string]any{"wait": "yes"},
+			},
+			wantErr: "spec.pruneOptions.wait",
+		},
+		{
+			name: "invalid deletion propagation",
+			spec: map[string]any{
+				"prune":        true,
+				"pruneOptions": map[string]any{"deletionPropagation": "Cascade"},
+			},
+			wantErr: `spec.pruneOptions.deletionPropagation: Unsupported value: "Cascade"`,
+		},
+		{
+			name: "invalid wait timeout",
+			spec: map[string]any{
+				"prune":        true,
+				"pruneOptions": map[string]any{"waitTimeout": "1 minute"},
+			},
+			wantErr: "spec.pruneOptions.waitTimeout",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := k8sClient.Create(context.Background(), newKustomization(tt.spec), client.DryRunAll)
+			if tt.wantErr == "" {
+				g.Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			g.Expect(apierrors.IsInvalid(err)).To(BeTrue(), "unexpected error: %v", err)
+			g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+		})
+	}
+}
+
+func TestKustomizationReconciler_PruneForeground(t *testing.T) {
+	g := NewWithT(t)
+	id := "gc-" + randStringRunes(5)
+	revision := "v1.0.0"
+	const blockFinalizer = "test.kustomize.toolkit.fluxcd.io/block"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	keep := testserver.File{
+		Name: "keep.yaml",
+		Body: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: keep
+`,
+	}
+	stuck := testserver.File{
+		Name: "stuck.yaml",
+		Body: fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: stuck
+  finalizers:
+  - %s
+`, blockFinalizer),
+	}
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{keep, stuck})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("gc-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("gc-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Prune:           true,
+			PruneOptions: &kustomizev1.PruneOptions{
+				DeletionPropagation: metav1.DeletePropagationForeground,
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	stuckKey := types.NamespacedName{Name: "stuck", Namespace: id}
+	stuckID := fmt.Sprintf("%s_stuck__ConfigMap", id)
+
+	t.Run("reports the objects stuck terminating", func(t *testing.T) {
+		g := NewWithT(t)
+		artifact, err := testServer.ArtifactFromFiles([]testserver.File{keep})
+		g.Expect(err).NotTo(HaveOccurred())
+		revision = "v2.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAttemptedRevision == revision &&
+				conditions.GetReason(resultK, meta.ReadyCondition) == meta.PruneFailedReason
+		}, 2*timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring(
+			fmt.Sprintf("objects stuck terminating:\nConfigMap/%s/stuck", id)))
+		g.Expect(resultK.Status.Inventory.Entries).To(ContainElement(HaveField("ID", stuckID)))
+
+		// The API server sets the foreground finalizer according to the
+		// propagation policy of the delete call.
+		cm := &corev1.ConfigMap{}
+		g.Expect(k8sClient.Get(context.Background(), stuckKey, cm)).To(Succeed())
+		g.Expect(cm.GetDeletionTimestamp()).NotTo(BeNil())
+		g.Expect(cm.GetFinalizers()).To(ContainElement(metav1.FinalizerDeleteDependents))
+	})
+
+	t.Run("recovers when the objects are gone", func(t *testing.T) {
+		g := NewWithT(t)
+		cm := &corev1.ConfigMap{}
+		g.Expect(k8sClient.Get(context.Background(), stuckKey, cm)).To(Succeed())
+		cm.SetFinalizers(nil)
+		g.Expect(k8sClient.Update(context.Background(), cm)).To(Succeed())
+
+		revision = "v3.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, 2*timeout, time.Second).Should(BeTrue())
+
+		g.Expect(resultK.Status.Inventory.Entries).NotTo(ContainElement(HaveField("ID", stuckID)))
+		err := k8sClient.Get(context.Background(), stuckKey, &corev1.ConfigMap{})
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+}
+
+func TestKustomizationReconciler_PruneWait(t *testing.T) {
+	g := NewWithT(t)
+	id := "gc-" + randStringRunes(5)
+	revision := "v1.0.0"
+	const blockFinalizer = "test.kustomize.toolkit.fluxcd.io/block"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	keep := testserver.File{
+		Name: "keep.yaml",
+		Body: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: keep
+`,
+	}
+	held := testserver.File{
+		Name: "held.yaml",
+		Body: fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: held
+  finalizers:
+  - %s
+`, blockFinalizer),
+	}
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{keep, held})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("gc-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("gc-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Prune:           true,
+			PruneOptions: &kustomizev1.PruneOptions{
+				Wait: true,
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	heldKey := types.NamespacedName{Name: "held", Namespace: id}
+	heldID := fmt.Sprintf("%s_held__ConfigMap", id)
+
+	isTerminating := func() bool {
+		cm := &corev1.ConfigMap{}
+		err := k8sClient.Get(context.Background(), heldKey, cm)
+		return err == nil && cm.GetDeletionTimestamp() != nil
+	}
+	release := func(g *WithT) {
+		cm := &corev1.ConfigMap{}
+		g.Expect(k8sClient.Get(context.Background(), heldKey, cm)).To(Succeed())
+		cm.SetFinalizers(nil)
+		g.Expect(k8sClient.Update(context.Background(), cm)).To(Succeed())
+	}
+
+	t.Run("waits for the pruned objects to be gone", func(t *testing.T) {
+		g := NewWithT(t)
+		artifact, err := testServer.ArtifactFromFiles([]testserver.File{keep})
+		g.Expect(err).NotTo(HaveOccurred())
+		revision = "v2.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(isTerminating, timeout, time.Second).Should(BeTrue())
+
+		// The revision is not reported as applied while the pruned object
+		// is terminating.
+		g.Consistently(func() string {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAppliedRevision
+		}, 3*time.Second, time.Second).Should(Equal("v1.0.0"))
+
+		release(g)
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(resultK.Status.Inventory.Entries).NotTo(ContainElement(HaveField("ID", heldID)))
+		err = k8sClient.Get(context.Background(), heldKey, &corev1.ConfigMap{})
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	t.Run("reports the finalizers of the objects stuck terminating", func(t *testing.T) {
+		g := NewWithT(t)
+		artifact, err := testServer.ArtifactFromFiles([]testserver.File{keep, held})
+		g.Expect(err).NotTo(HaveOccurred())
+		revision = "v3.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		patch := client.MergeFrom(resultK.DeepCopy())
+		resultK.Spec.PruneOptions.WaitTimeout = &metav1.Duration{Duration: 2 * time.Second}
+		g.Expect(k8sClient.Patch(context.Background(), resultK, patch)).To(Succeed())
+
+		artifact, err = testServer.ArtifactFromFiles([]testserver.File{keep})
+		g.Expect(err).NotTo(HaveOccurred())
+		revision = "v4.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastAttemptedRevision == revision &&
+				conditions.GetReason(resultK, meta.ReadyCondition) == meta.PruneFailedReason
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring(
+			fmt.Sprintf("deletion timed out after 2s, objects stuck terminating:\nConfigMap/%s/held (finalizers: %s)", id, blockFinalizer)))
+		g.Expect(resultK.Status.Inventory.Entries).To(ContainElement(HaveField("ID", heldID)))
+
+		release(g)
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+		g.Expect(resultK.Status.Inventory.Entries).NotTo(ContainElement(HaveField("ID", heldID)))
+	})
+
+	t.Run("retries the finalization until the deleted objects are gone", func(t *testing.T) {
+		g := NewWithT(t)
+		artifact, err := testServer.ArtifactFromFiles([]testserver.File{keep, held})
+		g.Expect(err).NotTo(HaveOccurred())
+		revision = "v5.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(k8sClient.Delete(context.Background(), kustomization)).To(Succeed())
+		g.Eventually(isTerminating, timeout, time.Second).Should(BeTrue())
+
+		// The finalization fails at the wait timeout, and the Kustomization
+		// is kept while the deleted object is terminating.
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.GetReason(resultK, meta.ReadyCondition) == meta.PruneFailedReason
+		}, timeout, time.Second).Should(BeTrue())
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring(
+			fmt.Sprintf("ConfigMap/%s/held (finalizers: %s)", id, blockFinalizer)))
+		g.Consistently(func() error {
+			return k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		}, 5*time.Second, time.Second).Should(Succeed())
+
+		release(g)
+
+		g.Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return apierrors.IsNotFound(err)
+		}, timeout, time.Second).Should(BeTrue())
+		err = k8sClient.Get(context.Background(), heldKey, &corev1.ConfigMap{})
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+}
+
+func Test_pruneDeleteOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy metav1.DeletionPropagation
+		want   metav1.DeletionPropagation
+	}{
+		{name: "defaults to background", want: metav1.DeletePropagationBackground},
+		{name: "foreground", policy: metav1.DeletePropagationForeground, want: metav1.DeletePropagationForeground},
+		{name: "orphan", policy: metav1.DeletePropagationOrphan, want: metav1.DeletePropagationOrphan},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			obj := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Spec: kustomizev1.KustomizationSpec{
+					Prune:        true,
+					PruneOptions: &kustomizev1.PruneOptions{DeletionPropagation: tt.policy},
+				},
+			}
+			manager := ssa.NewResourceManager(nil, nil, ssa.Owner{
+				Field: "kustomize-controller",
+				Group: kustomizev1.GroupVersion.Group,
+			})
+			cm := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "stale",
+					Namespace: "default",
+					Labels:    manager.GetOwnerLabels(obj.Name, obj.Namespace),
+				},
+			}
+
+			var policies []metav1.DeletionPropagation
+			kubeClient := fake.NewClientBuilder().
+				WithScheme(scheme.Scheme).
+				WithObjects(cm).
+				WithInterceptorFuncs(interceptor.Funcs{
+					Delete: func(ctx context.Context, c client.WithWatch, o client.Object, opts ...client.DeleteOption) error {
+						deleteOpts := &client.DeleteOptions{}
+						deleteOpts.ApplyOptions(opts)
+						if deleteOpts.PropagationPolicy != nil {
+							policies = append(policies, *deleteOpts.PropagationPolicy)
+						}
+						return c.Delete(ctx, o, opts...)
+					},
+				}).
+				Build()
+			manager = ssa.NewResourceManager(kubeClient, nil, ssa.Owner{
+				Field: "kustomize-controller",
+				Group: kustomizev1.GroupVersion.Group,
+			})
+
+			r := &KustomizationReconciler{EventRecorder: record.NewFakeRecorder(32)}
+			u := &unstructured.Unstructured{}
+			u.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ConfigMap"))
+			u.SetName(cm.Name)
+			u.SetNamespace(cm.Namespace)
+
+			changed, err := r.prune(context.Background(), manager, obj, "", "", []*unstructured.Unstructured{u})
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(changed).To(BeTrue())
+			g.Expect(policies).To(Equal([]metav1.DeletionPropagation{tt.want}))
+		})
+	}
+
+	t.Run("rejects an invalid policy", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := &kustomizev1.Kustomization{
+			Spec: kustomizev1.KustomizationSpec{
+				Prune:        true,
+				PruneOptions: &kustomizev1.PruneOptions{DeletionPropagation: "Cascade"},
+			},
+		}
+		_, err := pruneDeleteOptions(ssa.NewResourceManager(nil, nil, ssa.Owner{}), obj)
+		g.Expect(err).To(MatchError(ContainSubstring("invalid pruneOptions deletionPropagation 'Cascade'")))
+	})
+}
+
+func Test_waitForTermination(t *testing.T) {
+	g := NewWithT(t)
+
+	now := metav1.Now()
+	terminating := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "terminating",
+			Namespace:         "default",
+			Finalizers:        []string{metav1.FinalizerDeleteDependents},
+			DeletionTimestamp: &now,
+		},
+	}
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(terminating).Build()
+	manager := ssa.NewResourceManager(kubeClient, nil, ssa.Owner{})
+
+	configMap := func(name string) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ConfigMap"))
+		u.SetName(name)
+		u.SetNamespace("default")
+		return u
+	}
+
+	g.Expect(waitForTermination(context.Background(), manager,
+		[]*unstructured.Unstructured{configMap("gone")}, time.Second)).To(Succeed())
+
+	err := waitForTermination(context.Background(), manager,
+		[]*unstructured.Unstructured{configMap("gone"), configMap("terminating")}, time.Second)
+	var timeoutErr *terminationTimeoutError
+	g.Expect(errors.As(err, &timeoutErr)).To(BeTrue())
+	g.Expect(timeoutErr.Objects).To(HaveLen(1))
+	g.Expect(err.Error()).To(Equal("deletion timed out after 1s, objects stuck terminating:\n" +
+		"ConfigMap/default/terminating (finalizers: foregroundDeletion)"))
+}
+
+func Test_deleteAll_order(t *testing.T) {
+	owner := ssa.Owner{Field: "kustomize-controller", Group: kustomizev1.GroupVersion.Group}
+	ownerLabels := ssa.NewResourceManager(nil, nil, owner).GetOwnerLabels("app", "default")
+
+	// The inventory holds a Namespace with its contents, a CRD with a
+	// custom resource, and objects in a Namespace which is not pruned.
+	stale := &kustomizev1.ResourceInventory{Entries: []kustomizev1.ResourceRef{
+		{ID: "_apps__Namespace", Version: "v1"},
+		{ID: "apps_app_apps_Deployment", Version: "v1"},
+		{ID: "apps_app__Service", Version: "v1"},
+		{ID: "_widgets.example.com_apiextensions.k8s.io_CustomResourceDefinition", Version: "v1"},
+		{ID: "default_widget_example.com_Widget", Version: "v1"},
+		{ID: "default_app__ConfigMap", Version: "v1"},
+		{ID: "default_app__ServiceAccount", Version: "v1"},
+		{ID: "default_app_rbac.authorization.k8s.io_Role", Version: "v1"},
+		{ID: "_app_rbac.authorization.k8s.io_ClusterRole", Version: "v1"},
+	}}
+
+	tests := []struct {
+		name      string
+		order     *kustomizev1.ApplyOrder
+		notOwned  string
+		wantOrder []string
+		wantSet   []string
+	}{
+		{
+			name: "namespaced, cluster-scoped, then Namespaces and CRDs",
+			wantOrder: []string{
+				"Widget/default/widget",
+				"ConfigMap/default/app",
+				"Role/default/app",
+				"ServiceAccount/default/app",
+				"ClusterRole/app",
+				"Namespace/apps",
+				"CustomResourceDefinition/widgets.example.com",
+			},
+		},
+		{
+			name:  "namespaced in the reverse custom order",
+			order: &kustomizev1.ApplyOrder{First: []string{"Role"}},
+			wantOrder: []string{
+				"Widget/default/widget",
+				"ConfigMap/default/app",
+				"ServiceAccount/default/app",
+				"Role/default/app",
+				"ClusterRole/app",
+				"Namespace/apps",
+				"CustomResourceDefinition/widgets.example.com",
+			},
+		},
+		{
+			name:     "contents of a Namespace which is not deleted",
+			notOwned: "Namespace/apps",
+			wantOrder: []string{
+				"Widget/default/widget",
+				"ConfigMap/default/app",
+				"Role/default/app",
+				"ServiceAccount/default/app",
+				"ClusterRole/app",
+				"CustomResourceDefinition/widgets.example.com",
+				"Deployment/apps/app",
+				"Service/apps/app",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var deleted []string
+			kubeClient := fake.NewClientBuilder().
+				WithScheme(scheme.Scheme).
+				WithInterceptorFuncs(interceptor.Funcs{
+					Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, o client.Object, opts ...client.GetOption) error {
+						u := o.(*unstructured.Unstructured)
+						u.SetName(key.Name)
+						u.SetNamespace(key.Namespace)
+						if ssautil.FmtUnstructured(u) != tt.notOwned {
+							u.SetLabels(ownerLabels)
+						}
+						return nil
+					},
+					Delete: func(ctx context.Context, c client.WithWatch, o client.Object, opts ...client.DeleteOption) error {
+						deleted = append(deleted, ssautil.FmtUnstructured(o.(*unstructured.Unstructured)))
+						return nil
+					},
+				}).Build()
+			manager := ssa.NewResourceManager(kubeClient, nil, owner)
+
+			objects, err := inventory.List(stale)
+			g.Expect(err).NotTo(HaveOccurred())
+			changeSet, err := deleteAll(context.Background(), manager, objects,
+				ssa.DeleteOptions{PropagationPolicy: metav1.DeletePropagationBackground, Inclusions: ownerLabels},
+				tt.order)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(deleted).To(Equal(tt.wantOrder))
+
+			// The contents of a deleted Namespace are reported as deleted.
+			for _, entry := range changeSet.Entries {
+				wantAction := ssa.DeletedAction
+				if entry.Subject == tt.notOwned {
+					wantAction = ssa.SkippedAction
+				}
+				g.Expect(entry.Action).To(Equal(wantAction), entry.Subject)
+			}
+			g.Expect(changeSet.Entries).To(HaveLen(len(stale.Entries)))
+		})
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// retryInterval returns the interval after which a failed reconciliation of
+// the Kustomization is retried. The fallback interval is used when the retry
+// interval is zero, i.e. for event-driven Kustomizations without a retry
+// interval, so that their failures are still retried. With the exponential
+// retry strategy, it records the failure in the retry backoff of the status,
+// which starts over when the last attempted revision or the generation
+// changes.
+func retryInterval(obj *kustomizev1.Kustomization, fallback time.Duration) time.Duration {
+	base := obj.GetRetryInterval()
+	if base == 0 {
+		base = fallback
+	}
+	if !obj.IsExponentialBackoff() {
+		obj.Status.RetryBackoff = nil
+		return base
+	}
+
+	backoff := obj.Status.RetryBackoff
+	if backoff == nil ||
+		backoff.Revision != obj.Status.LastAttemptedRevision ||
+		backoff.ObservedGeneration != obj.GetGeneration() {
+		backoff = &kustomizev1.RetryBackoff{
+			Revision:           obj.Status.LastAttemptedRevision,
+			ObservedGeneration: obj.GetGeneration(),
+		}
+	}
+	backoff.Failures++
+	backoff.RetryInterval = metav1.Duration{
+		Duration: backoffInterval(base, obj.GetMaxRetryInterval(), backoff.Failures),
+	}
+	obj.Status.RetryBackoff = backoff
+	return backoff.RetryInterval.Duration
+}
+
+// backoffInterval returns the retry interval after the given number of
+// successive failures, doubling the base interval for every failure after
+// the first one, up to the max interval.
+func backoffInterval(base, maxInterval time.Duration, failures int) time.Duration {
+	interval := base
+	for i := 1; i < failures && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	return min(interval, maxInterval)
+}
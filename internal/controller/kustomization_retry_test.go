@@ -0,0 +1,257 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_RetryBackoff(t *testing.T) {
+	g := NewWithT(t)
+	id := "rb-" + randStringRunes(5)
+	revision := "v1.0.0"
+	resultK := &kustomizev1.Kustomization{}
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "kustomization.yaml",
+			Body: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- missing.yaml
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("rb-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("rb-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval:      metav1.Duration{Duration: reconciliationInterval},
+			RetryInterval: &metav1.Duration{Duration: time.Second},
+			RetryStrategy: &kustomizev1.RetryStrategy{
+				Backoff:          kustomizev1.ExponentialBackoff,
+				MaxRetryInterval: &metav1.Duration{Duration: 4 * time.Second},
+			},
+			Path: "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	t.Run("backs off the retries up to the max retry interval", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.RetryBackoff != nil && resultK.Status.RetryBackoff.Failures >= 4
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(meta.BuildFailedReason))
+		g.Expect(resultK.Status.RetryBackoff.Revision).To(Equal(revision))
+		g.Expect(resultK.Status.RetryBackoff.RetryInterval.Duration).To(Equal(4 * time.Second))
+	})
+
+	t.Run("resets the backoff on a successful reconciliation", func(t *testing.T) {
+		g := NewWithT(t)
+		artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+			{
+				Name: "configmap.yaml",
+				Body: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: fixed
+`,
+			},
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		revision = "v2.0.0"
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(resultK.Status.RetryBackoff).To(BeNil())
+	})
+}
+
+func Test_backoffInterval(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: 30 * time.Second},
+		{failures: 2, want: time.Minute},
+		{failures: 3, want: 2 * time.Minute},
+		{failures: 4, want: 4 * time.Minute},
+		{failures: 5, want: 5 * time.Minute},
+		{failures: 100, want: 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d failures", tt.failures), func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(backoffInterval(30*time.Second, 5*time.Minute, tt.failures)).To(Equal(tt.want))
+		})
+	}
+}
+
+func Test_retryInterval(t *testing.T) {
+	newObj := func(strategy *kustomizev1.RetryStrategy) *kustomizev1.Kustomization {
+		obj := &kustomizev1.Kustomization{
+			Spec: kustomizev1.KustomizationSpec{
+				Interval:      metav1.Duration{Duration: 10 * time.Minute},
+				RetryInterval: &metav1.Duration{Duration: time.Minute},
+				RetryStrategy: strategy,
+			},
+		}
+		obj.Generation = 1
+		obj.Status.LastAttemptedRevision = "main@sha1:a"
+		return obj
+	}
+
+	t.Run("retries at the fixed retry interval by default", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(nil)
+		for i := 0; i < 3; i++ {
+			g.Expect(retryInterval(obj, 30*time.Second)).To(Equal(time.Minute))
+		}
+		g.Expect(obj.Status.RetryBackoff).To(BeNil())
+	})
+
+	t.Run("doubles the retry interval up to the max", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(&kustomizev1.RetryStrategy{
+			Backoff:          kustomizev1.ExponentialBackoff,
+			MaxRetryInterval: &metav1.Duration{Duration: 5 * time.Minute},
+		})
+		var intervals []time.Duration
+		for i := 0; i < 5; i++ {
+			intervals = append(intervals, retryInterval(obj, 30*time.Second))
+		}
+		g.Expect(intervals).To(Equal([]time.Duration{
+			time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute,
+		}))
+		g.Expect(obj.Status.RetryBackoff).To(Equal(&kustomizev1.RetryBackoff{
+			Failures:           5,
+			RetryInterval:      metav1.Duration{Duration: 5 * time.Minute},
+			Revision:           "main@sha1:a",
+			ObservedGeneration: 1,
+		}))
+	})
+
+	t.Run("defaults the max retry interval", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(&kustomizev1.RetryStrategy{Backoff: kustomizev1.ExponentialBackoff})
+		for i := 0; i < 10; i++ {
+			retryInterval(obj, 30*time.Second)
+		}
+		g.Expect(obj.Status.RetryBackoff.RetryInterval.Duration).To(Equal(kustomizev1.DefaultMaxRetryInterval))
+	})
+
+	t.Run("resets on a new source revision", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(&kustomizev1.RetryStrategy{Backoff: kustomizev1.ExponentialBackoff})
+		retryInterval(obj, 30*time.Second)
+		retryInterval(obj, 30*time.Second)
+		g.Expect(obj.Status.RetryBackoff.Failures).To(Equal(2))
+
+		obj.Status.LastAttemptedRevision = "main@sha1:b"
+		g.Expect(retryInterval(obj, 30*time.Second)).To(Equal(time.Minute))
+		g.Expect(obj.Status.RetryBackoff.Failures).To(Equal(1))
+		g.Expect(obj.Status.RetryBackoff.Revision).To(Equal("main@sha1:b"))
+	})
+
+	t.Run("resets on a spec change", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(&kustomizev1.RetryStrategy{Backoff: kustomizev1.ExponentialBackoff})
+		retryInterval(obj, 30*time.Second)
+		retryInterval(obj, 30*time.Second)
+
+		obj.Generation = 2
+		g.Expect(retryInterval(obj, 30*time.Second)).To(Equal(time.Minute))
+		g.Expect(obj.Status.RetryBackoff.Failures).To(Equal(1))
+	})
+
+	t.Run("clears the backoff when the strategy is fixed", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(&kustomizev1.RetryStrategy{Backoff: kustomizev1.ExponentialBackoff})
+		retryInterval(obj, 30*time.Second)
+		retryInterval(obj, 30*time.Second)
+
+		obj.Spec.RetryStrategy.Backoff = kustomizev1.FixedBackoff
+		g.Expect(retryInterval(obj, 30*time.Second)).To(Equal(time.Minute))
+		g.Expect(obj.Status.RetryBackoff).To(BeNil())
+	})
+
+	t.Run("falls back for event-driven objects", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := newObj(nil)
+		obj.Spec.Interval = metav1.Duration{}
+		obj.Spec.RetryInterval = nil
+		g.Expect(retryInterval(obj, 30*time.Second)).To(Equal(30 * time.Second))
+
+		obj.Spec.RetryStrategy = &kustomizev1.RetryStrategy{Backoff: kustomizev1.ExponentialBackoff}
+		retryInterval(obj, 30*time.Second)
+		g.Expect(retryInterval(obj, 30*time.Second)).To(Equal(time.Minute))
+		g.Expect(obj.Status.RetryBackoff.RetryInterval.Duration).To(Equal(time.Minute))
+	})
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fluxcd/pkg/runtime/conditions"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// appliedSource is a Source of which the artifact is replaced by the last
+// one applied by the Kustomization.
+type appliedSource struct {
+	sourcev1.Source
+	artifact *sourcev1.Artifact
+}
+
+// newAppliedSource returns the Source with the last applied artifact of
+// the Kustomization, which must be recorded in its status.
+func newAppliedSource(obj *kustomizev1.Kustomization, src sourcev1.Source) *appliedSource {
+	last := obj.Status.LastAppliedArtifact
+	artifact := &sourcev1.Artifact{
+		Revision: last.Revision,
+		URL:      last.URL,
+		Digest:   last.Digest,
+	}
+	if obj.Status.LastAppliedOriginRevision != "" {
+		artifact.Metadata = map[string]string{
+			OCIArtifactOriginRevisionAnnotation: obj.Status.LastAppliedOriginRevision,
+		}
+	}
+	return &appliedSource{Source: src, artifact: artifact}
+}
+
+// GetArtifact returns the last applied artifact.
+func (s *appliedSource) GetArtifact() *sourcev1.Artifact {
+	return s.artifact
+}
+
+// pinSource returns the Source to reconcile, according to the revision-pin
+// annotation of the Kustomization. Without the annotation, the Source is
+// returned as is and the RevisionPinned condition is removed. Otherwise,
+// the artifact advertised by the Source is used if it has the pinned
+// revision, else the last applied one if it has. An error is returned if
+// neither has the pinned revision.
+func pinSource(obj *kustomizev1.Kustomization, src sourcev1.Source) (sourcev1.Source, error) {
+	pin := obj.GetAnnotations()[kustomizev1.RevisionPinAnnotation]
+	if pin == "" {
+		conditions.Delete(obj, kustomizev1.RevisionPinnedCondition)
+		return src, nil
+	}
+
+	if artifact := src.GetArtifact(); hasPinnedRevision(artifact.Revision, pin) {
+		conditions.MarkTrue(obj, kustomizev1.RevisionPinnedCondition, kustomizev1.PinnedRevisionAvailableReason,
+			"Reconciliation pinned to revision %s", artifact.Revision)
+		return src, nil
+	}
+
+	if last := obj.Status.LastAppliedArtifact; last != nil && hasPinnedRevision(last.Revision, pin) {
+		conditions.MarkTrue(obj, kustomizev1.RevisionPinnedCondition, kustomizev1.PinnedRevisionAvailableReason,
+			"Reconciliation pinned to revision %s, the Source advertises %s", last.Revision, src.GetArtifact().Revision)
+		return newAppliedSource(obj, src), nil
+	}
+
+	err := fmt.Errorf("pinned revision '%s' is unavailable, the Source advertises '%s' and the last applied revision is '%s'",
+		pin, src.GetArtifact().Revision, obj.Status.LastAppliedRevision)
+	conditions.MarkFalse(obj, kustomizev1.RevisionPinnedCondition, kustomizev1.PinnedRevisionUnavailableReason, "%s", err)
+	return nil, err
+}
+
+// hasPinnedRevision returns if the revision matches the pin, which is either
+// the revision itself, or its digest part, e.g. 'sha1:<commit>' for the
+// revision 'main@sha1:<commit>'.
+func hasPinnedRevision(revision, pin string) bool {
+	if revision == pin {
+		return true
+	}
+	if i := strings.LastIndex(revision, "@"); i >= 0 {
+		return revision[i+1:] == pin
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_RevisionPin(t *testing.T) {
+	g := NewWithT(t)
+	id := "pin-" + randStringRunes(5)
+	revision1 := "main@sha1:1111111111111111111111111111111111111111"
+	revision2 := "main@sha1:2222222222222222222222222222222222222222"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	manifests := func(value string) []testserver.File {
+		return []testserver.File{
+			{
+				Name: "config.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: %s
+data:
+  key: %s
+`, id, value),
+			},
+		}
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests("v1"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("pin-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision1)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("pin-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			Prune: true,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	configKey := types.NamespacedName{Name: "config", Namespace: id}
+
+	// setPin sets the revision-pin annotation, or removes it if empty.
+	setPin := func(g *WithT, pin string) {
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			annotations := resultK.GetAnnotations()
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			if pin == "" {
+				delete(annotations, kustomizev1.RevisionPinAnnotation)
+			} else {
+				annotations[kustomizev1.RevisionPinAnnotation] = pin
+			}
+			resultK.SetAnnotations(annotations)
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+	}
+
+	// configValue returns the value of the applied ConfigMap.
+	configValue := func() string {
+		cm := &corev1.ConfigMap{}
+		_ = k8sClient.Get(context.Background(), configKey, cm)
+		return cm.Data["key"]
+	}
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision1
+	}, timeout, time.Second).Should(BeTrue())
+	g.Expect(resultK.Status.LastAppliedArtifact).ToNot(BeNil())
+	g.Expect(resultK.Status.LastAppliedArtifact.Revision).To(Equal(revision1))
+
+	t.Run("keeps applying the pinned revision", func(t *testing.T) {
+		g := NewWithT(t)
+		setPin(g, "sha1:1111111111111111111111111111111111111111")
+
+		artifact, err := testServer.ArtifactFromFiles(manifests("v2"))
+		g.Expect(err).NotTo(HaveOccurred())
+		err = applyGitRepository(repositoryName, artifact, revision2)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) &&
+				conditions.IsTrue(resultK, kustomizev1.RevisionPinnedCondition) &&
+				conditions.GetMessage(resultK, kustomizev1.RevisionPinnedCondition) ==
+					fmt.Sprintf("Reconciliation pinned to revision %s, the Source advertises %s", revision1, revision2)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal(revision1))
+		g.Expect(resultK.Status.LastAttemptedRevision).To(Equal(revision1))
+		g.Expect(configValue()).To(Equal("v1"))
+	})
+
+	t.Run("fails if the pinned revision is unavailable", func(t *testing.T) {
+		g := NewWithT(t)
+		setPin(g, "sha1:3333333333333333333333333333333333333333")
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.GetReason(resultK, meta.ReadyCondition) == kustomizev1.PinnedRevisionUnavailableReason
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.IsFalse(resultK, meta.ReadyCondition)).To(BeTrue())
+		g.Expect(conditions.IsFalse(resultK, kustomizev1.RevisionPinnedCondition)).To(BeTrue())
+		g.Expect(conditions.GetReason(resultK, kustomizev1.RevisionPinnedCondition)).To(
+			Equal(kustomizev1.PinnedRevisionUnavailableReason))
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal(revision1))
+		g.Expect(configValue()).To(Equal("v1"))
+
+		events := getEvents(resultK.GetName(), map[string]string{"kustomize.toolkit.fluxcd.io/revision": revision2})
+		g.Expect(events).To(ContainElement(HaveField("Message",
+			ContainSubstring("pinned revision 'sha1:3333333333333333333333333333333333333333' is unavailable"))))
+	})
+
+	t.Run("resumes tracking the source when unpinned", func(t *testing.T) {
+		g := NewWithT(t)
+		setPin(g, "")
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision2
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.Has(resultK, kustomizev1.RevisionPinnedCondition)).To(BeFalse())
+		g.Expect(resultK.Status.LastAppliedArtifact.Revision).To(Equal(revision2))
+		g.Expect(configValue()).To(Equal("v2"))
+	})
+}
+
+func Test_hasPinnedRevision(t *testing.T) {
+	tests := []struct {
+		revision string
+		pin      string
+		want     bool
+	}{
+		{revision: "main@sha1:abcd", pin: "main@sha1:abcd", want: true},
+		{revision: "main@sha1:abcd", pin: "sha1:abcd", want: true},
+		{revision: "v1.0.0@sha256:abcd", pin: "sha256:abcd", want: true},
+		{revision: "sha256:abcd", pin: "sha256:abcd", want: true},
+		{revision: "main@sha1:abcd", pin: "sha1:ab", want: false},
+		{revision: "main@sha1:abcd", pin: "main", want: false},
+		{revision: "sha256:abcd", pin: "sha256:dcba", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.revision+"/"+tt.pin, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(hasPinnedRevision(tt.revision, tt.pin)).To(Equal(tt.want))
+		})
+	}
+}
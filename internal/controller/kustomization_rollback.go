@@ -0,0 +1,137 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fluxcd/cli-utils/pkg/kstatus/polling"
+	eventv1 "github.com/fluxcd/pkg/apis/event/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/runtime/patch"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// reconcileWithRollback reconciles the revision of the Source and, if the
+// rollback is enabled and the health checks of the revision fail, re-applies
+// the last applied revision. While the Source advertises the rolled back
+// revision and the spec is unchanged, the last applied revision is
+// reconciled instead.
+func (r *KustomizationReconciler) reconcileWithRollback(
+	ctx context.Context,
+	obj *kustomizev1.Kustomization,
+	src sourcev1.Source,
+	outputs map[string]string,
+	patcher *patch.SerialPatcher,
+	statusPoller *polling.StatusPoller,
+	pollingOpts polling.Options) error {
+	if obj.Spec.Rollback == nil || !obj.Spec.Rollback.Enable {
+		clearRollback(obj)
+		return r.reconcile(ctx, obj, src, outputs, patcher, statusPoller, pollingOpts)
+	}
+
+	if isRolledBack(obj, src) {
+		if err := r.reconcile(ctx, obj, newAppliedSource(obj, src), outputs, patcher, statusPoller, pollingOpts); err != nil {
+			return err
+		}
+		markRolledBack(obj)
+		return nil
+	}
+
+	clearRollback(obj)
+	err := r.reconcile(ctx, obj, src, outputs, patcher, statusPoller, pollingOpts)
+	if err == nil || !needsRollback(obj, src) {
+		return err
+	}
+
+	log := ctrl.LoggerFrom(ctx)
+	revision := src.GetArtifact().Revision
+	lastSrc := newAppliedSource(obj, src)
+	lastRevision := lastSrc.GetArtifact().Revision
+
+	msg := fmt.Sprintf("Health checks of revision %s failed, rolling back to revision %s: %s",
+		revision, lastRevision, err)
+	log.Info(msg)
+	r.event(obj, revision, getOriginRevision(src), eventv1.EventSeverityError, msg, nil)
+
+	if err := r.reconcile(ctx, obj, lastSrc, outputs, patcher, statusPoller, pollingOpts); err != nil {
+		conditions.MarkFalse(obj, kustomizev1.RolledBackCondition, kustomizev1.RollbackFailedReason,
+			"Rollback of revision %s to %s failed: %s", revision, lastRevision, err)
+		return fmt.Errorf("rollback to revision %s failed: %w", lastRevision, err)
+	}
+
+	obj.Status.RolledBackRevision = revision
+	markRolledBack(obj)
+	r.event(obj, lastRevision, getOriginRevision(lastSrc), eventv1.EventSeverityInfo,
+		conditions.GetMessage(obj, kustomizev1.RolledBackCondition), nil)
+	return nil
+}
+
+// isRolledBack returns if the Source advertises the revision which has
+// been rolled back, and the Kustomization spec has not changed since.
+func isRolledBack(obj *kustomizev1.Kustomization, src sourcev1.Source) bool {
+	return obj.Status.LastAppliedArtifact != nil &&
+		obj.Status.RolledBackRevision != "" &&
+		src.GetArtifact().HasRevision(obj.Status.RolledBackRevision) &&
+		conditions.IsTrue(obj, kustomizev1.RolledBackCondition) &&
+		conditions.GetObservedGeneration(obj, kustomizev1.RolledBackCondition) == obj.Generation
+}
+
+// needsRollback returns if the reconciliation of the revision of the Source
+// failed due to its health checks, and there is a last applied revision to
+// roll back to. Pinned revisions are never rolled back, nor the ones built
+// with additional sources, of which the artifacts are not recorded.
+func needsRollback(obj *kustomizev1.Kustomization, src sourcev1.Source) bool {
+	if _, ok := src.(*appliedSource); ok || obj.GetAnnotations()[kustomizev1.RevisionPinAnnotation] != "" {
+		return false
+	}
+	if _, ok := src.(*combinedSource); ok {
+		return false
+	}
+	if last := obj.Status.LastAppliedArtifact; last == nil || src.GetArtifact().HasRevision(last.Revision) {
+		return false
+	}
+	switch conditions.GetReason(obj, meta.ReadyCondition) {
+	case meta.HealthCheckFailedReason, kustomizev1.HealthCheckTimeoutReason:
+		return true
+	default:
+		return false
+	}
+}
+
+// markRolledBack marks the Kustomization as rolled back to its last applied
+// revision. The Ready condition is set to false, as the revision advertised
+// by the Source is not applied, but the reconciliation is not retried.
+func markRolledBack(obj *kustomizev1.Kustomization) {
+	msg := fmt.Sprintf("Revision %s rolled back to %s after its health checks failed",
+		obj.Status.RolledBackRevision, obj.Status.LastAppliedRevision)
+	conditions.MarkTrue(obj, kustomizev1.RolledBackCondition, kustomizev1.RollbackSucceededReason, "%s", msg)
+	conditions.MarkFalse(obj, meta.ReadyCondition, kustomizev1.RollbackSucceededReason, "%s", msg)
+	conditions.Delete(obj, meta.ReconcilingCondition)
+}
+
+// clearRollback removes the rolled back revision and the RolledBack
+// condition of the Kustomization.
+func clearRollback(obj *kustomizev1.Kustomization) {
+	obj.Status.RolledBackRevision = ""
+	conditions.Delete(obj, kustomizev1.RolledBackCondition)
+}
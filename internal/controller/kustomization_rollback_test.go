@@ -0,0 +1,217 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_Rollback(t *testing.T) {
+	g := NewWithT(t)
+	id := "rollback-" + randStringRunes(5)
+	revision1 := "main@sha1:1111111111111111111111111111111111111111"
+	revision2 := "main@sha1:2222222222222222222222222222222222222222"
+	revision3 := "main@sha1:3333333333333333333333333333333333333333"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	config := func(value string) testserver.File {
+		return testserver.File{
+			Name: "config.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  key: %s
+`, value),
+		}
+	}
+
+	// The Deployment never becomes ready, as there are no controllers
+	// running in the test environment.
+	app := testserver.File{
+		Name: "app.yaml",
+		Body: `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  selector:
+    matchLabels:
+      app: app
+  template:
+    metadata:
+      labels:
+        app: app
+    spec:
+      containers:
+      - name: app
+        image: ghcr.io/example/app:v1
+`,
+	}
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{config("v1")})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("rollback-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision1)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("rollback-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Prune:           true,
+			Timeout:         &metav1.Duration{Duration: time.Second},
+			Wait:            true,
+			Rollback:        &kustomizev1.Rollback{Enable: true},
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+	configKey := types.NamespacedName{Name: "config", Namespace: id}
+	appKey := types.NamespacedName{Name: "app", Namespace: id}
+
+	// configValue returns the value of the applied ConfigMap.
+	configValue := func() string {
+		cm := &corev1.ConfigMap{}
+		_ = k8sClient.Get(context.Background(), configKey, cm)
+		return cm.Data["key"]
+	}
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision1
+	}, timeout, time.Second).Should(BeTrue())
+
+	t.Run("rolls back the failed revision", func(t *testing.T) {
+		g := NewWithT(t)
+		artifact, err := testServer.ArtifactFromFiles([]testserver.File{config("v2"), app})
+		g.Expect(err).NotTo(HaveOccurred())
+		err = applyGitRepository(repositoryName, artifact, revision2)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsTrue(resultK, kustomizev1.RolledBackCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		expectedMessage := fmt.Sprintf("Revision %s rolled back to %s after its health checks failed", revision2, revision1)
+		g.Expect(conditions.GetMessage(resultK, kustomizev1.RolledBackCondition)).To(Equal(expectedMessage))
+		g.Expect(conditions.IsFalse(resultK, meta.ReadyCondition)).To(BeTrue())
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.RollbackSucceededReason))
+		g.Expect(conditions.Has(resultK, meta.ReconcilingCondition)).To(BeFalse())
+		g.Expect(resultK.Status.RolledBackRevision).To(Equal(revision2))
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal(revision1))
+		g.Expect(resultK.Status.Inventory.Entries).To(HaveLen(1))
+
+		// The objects of the failed revision are reverted, and the ones only
+		// present in the failed revision are garbage collected.
+		g.Expect(configValue()).To(Equal("v1"))
+		err = k8sClient.Get(context.Background(), appKey, &appsv1.Deployment{})
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		events := getEvents(resultK.GetName(), map[string]string{"kustomize.toolkit.fluxcd.io/revision": revision2})
+		g.Expect(events).To(ContainElement(HaveField("Message",
+			HavePrefix(fmt.Sprintf("Health checks of revision %s failed, rolling back to revision %s", revision2, revision1)))))
+	})
+
+	t.Run("does not retry the failed revision", func(t *testing.T) {
+		g := NewWithT(t)
+		reconcileRequestAt := metav1.Now().String()
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			resultK.SetAnnotations(map[string]string{
+				meta.ReconcileRequestAnnotation: reconcileRequestAt,
+			})
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.LastHandledReconcileAt == reconcileRequestAt
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.IsTrue(resultK, kustomizev1.RolledBackCondition)).To(BeTrue())
+		g.Expect(conditions.GetReason(resultK, meta.ReadyCondition)).To(Equal(kustomizev1.RollbackSucceededReason))
+		g.Expect(resultK.Status.LastAttemptedRevision).To(Equal(revision1))
+		err = k8sClient.Get(context.Background(), appKey, &appsv1.Deployment{})
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	t.Run("reconciles the next revision", func(t *testing.T) {
+		g := NewWithT(t)
+		artifact, err := testServer.ArtifactFromFiles([]testserver.File{config("v3")})
+		g.Expect(err).NotTo(HaveOccurred())
+		err = applyGitRepository(repositoryName, artifact, revision3)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision3
+		}, timeout, time.Second).Should(BeTrue())
+
+		g.Expect(conditions.Has(resultK, kustomizev1.RolledBackCondition)).To(BeFalse())
+		g.Expect(resultK.Status.RolledBackRevision).To(BeEmpty())
+		g.Expect(configValue()).To(Equal("v3"))
+	})
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/fluxcd/pkg/ssa"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// applyStage holds the objects of a stage of the apply.
+type applyStage struct {
+	// name is the name of the stage in the spec, empty for the final stage
+	// of the objects matching no stage.
+	name string
+	// index is the position of the stage in the spec.
+	index int
+	// timeout is the timeout of the health checks of the stage.
+	timeout time.Duration
+	objects []*unstructured.Unstructured
+}
+
+// gated returns if the health of the objects of the stage is checked before
+// the next stages are applied, which is the case for all the stages of the
+// spec.
+func (s applyStage) gated() bool {
+	return s.name != ""
+}
+
+// applyStages splits the objects in the stages of the spec, in their order,
+// followed by a final stage with the objects matching no stage. An object
+// matching several stages belongs to the first of them. The empty stages
+// are left out.
+func applyStages(stages []kustomizev1.ApplyStage, healthCheckTimeout time.Duration,
+	objects []*unstructured.Unstructured) ([]applyStage, error) {
+	result := make([]applyStage, len(stages)+1)
+	selectors := make([]labels.Selector, len(stages))
+	for i, stage := range stages {
+		selector, err := metav1.LabelSelectorAsSelector(&stage.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector of stage '%s': %w", stage.Name, err)
+		}
+		selectors[i] = selector
+		result[i] = applyStage{name: stage.Name, index: i, timeout: healthCheckTimeout}
+		if stage.Timeout != nil {
+			result[i].timeout = stage.Timeout.Duration
+		}
+	}
+	result[len(stages)].index = len(stages)
+
+	for _, u := range objects {
+		i := len(stages)
+		for j, selector := range selectors {
+			if selector.Matches(labels.Set(u.GetLabels())) {
+				i = j
+				break
+			}
+		}
+		result[i].objects = append(result[i].objects, u)
+	}
+
+	return slices.DeleteFunc(result, func(stage applyStage) bool {
+		return len(stage.objects) == 0
+	}), nil
+}
+
+// stageError is returned when the apply or the health checks of a stage of
+// the spec fail, which stops the rollout of the next stages.
+type stageError struct {
+	Name  string
+	Index int
+	Total int
+	Err   error
+}
+
+// Error implements the error interface.
+func (e *stageError) Error() string {
+	return fmt.Sprintf("stage '%s' (%d/%d) failed: %s", e.Name, e.Index+1, e.Total, e.Err)
+}
+
+// Unwrap returns the error of the stage.
+func (e *stageError) Unwrap() error {
+	return e.Err
+}
+
+// addToInventory returns a copy of the inventory with the entries of the
+// change set which are not part of it. It's used to keep track of the
+// objects applied by the stages before a failed one, for their garbage
+// collection.
+func addToInventory(inv *kustomizev1.ResourceInventory, set *ssa.ChangeSet) *kustomizev1.ResourceInventory {
+	result := inv.DeepCopy()
+	if set == nil {
+		return result
+	}
+	ids := make(map[string]bool, len(result.Entries))
+	for _, entry := range result.Entries {
+		ids[entry.ID] = true
+	}
+	for _, entry := range set.Entries {
+		id := entry.ObjMetadata.String()
+		if ids[id] {
+			continue
+		}
+		ids[id] = true
+		result.Entries = append(result.Entries, kustomizev1.ResourceRef{
+			ID:      id,
+			Version: entry.GroupVersion,
+		})
+	}
+	return result
+}
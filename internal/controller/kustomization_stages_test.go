@@ -0,0 +1,318 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_Stages(t *testing.T) {
+	g := NewWithT(t)
+	id := "stages-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	configMaps := func(value string) testserver.File {
+		return testserver.File{
+			Name: "configmaps.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: canary
+  labels:
+    tier: canary
+data:
+  key: %[1]s
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: main
+  labels:
+    tier: main
+data:
+  key: %[1]s
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+data:
+  key: %[1]s
+`, value),
+		}
+	}
+
+	// The Deployment never becomes ready, as there are no controllers
+	// running in the test environment.
+	app := testserver.File{
+		Name: "app.yaml",
+		Body: `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    tier: canary
+spec:
+  selector:
+    matchLabels:
+      app: app
+  template:
+    metadata:
+      labels:
+        app: app
+    spec:
+      containers:
+      - name: app
+        image: ghcr.io/example/app:v1
+`,
+	}
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{configMaps("v1")})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("stages-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("stages-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Prune:           true,
+			Stages: []kustomizev1.ApplyStage{
+				{
+					Name: "canary",
+					Selector: metav1.LabelSelector{
+						MatchLabels: map[string]string{"tier": "canary"},
+					},
+					Timeout: &metav1.Duration{Duration: time.Second},
+				},
+				{
+					Name: "main",
+					Selector: metav1.LabelSelector{
+						MatchLabels: map[string]string{"tier": "main"},
+					},
+				},
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	// configValue returns the value of the given applied ConfigMap.
+	configValue := func(name string) string {
+		cm := &corev1.ConfigMap{}
+		_ = k8sClient.Get(context.Background(), types.NamespacedName{Name: name, Namespace: id}, cm)
+		return cm.Data["key"]
+	}
+
+	t.Run("applies all the stages", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+		}, timeout, time.Second).Should(BeTrue())
+
+		for _, name := range []string{"canary", "main", "other"} {
+			g.Expect(configValue(name)).To(Equal("v1"))
+		}
+		g.Expect(resultK.Status.Inventory.Entries).To(HaveLen(3))
+	})
+
+	t.Run("stops the rollout when the first stage fails", func(t *testing.T) {
+		g := NewWithT(t)
+		revision = "v2.0.0"
+		artifact, err := testServer.ArtifactFromFiles([]testserver.File{configMaps("v2"), app})
+		g.Expect(err).NotTo(HaveOccurred())
+		err = applyGitRepository(repositoryName, artifact, revision)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.GetReason(resultK, meta.ReadyCondition) == kustomizev1.StageFailedReason
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.IsFalse(resultK, meta.ReadyCondition)).To(BeTrue())
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(
+			HavePrefix("stage 'canary' (1/2) failed: health check failed after 1s"))
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal("v1.0.0"))
+
+		// The first stage is applied, the next ones are not.
+		g.Expect(configValue("canary")).To(Equal("v2"))
+		g.Expect(configValue("main")).To(Equal("v1"))
+		g.Expect(configValue("other")).To(Equal("v1"))
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "app", Namespace: id}, &appsv1.Deployment{})).To(Succeed())
+
+		// The objects created by the first stage are tracked for their
+		// garbage collection.
+		g.Expect(resultK.Status.Inventory.Entries).To(ContainElement(HaveField("ID", fmt.Sprintf("%s_app_apps_Deployment", id))))
+		g.Expect(resultK.Status.Inventory.Entries).To(HaveLen(4))
+	})
+}
+
+func Test_applyStages(t *testing.T) {
+	objectWithLabels := func(name string, labels map[string]string) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("v1")
+		u.SetKind("ConfigMap")
+		u.SetName(name)
+		u.SetLabels(labels)
+		return u
+	}
+	objects := []*unstructured.Unstructured{
+		objectWithLabels("a", map[string]string{"tier": "canary"}),
+		objectWithLabels("b", map[string]string{"tier": "main"}),
+		objectWithLabels("c", nil),
+		objectWithLabels("d", map[string]string{"tier": "canary", "app": "d"}),
+	}
+	canary := kustomizev1.ApplyStage{
+		Name: "canary",
+		Selector: metav1.LabelSelector{
+			MatchLabels: map[string]string{"tier": "canary"},
+		},
+		Timeout: &metav1.Duration{Duration: time.Minute},
+	}
+	main := kustomizev1.ApplyStage{
+		Name: "main",
+		Selector: metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "tier", Operator: metav1.LabelSelectorOpExists},
+			},
+		},
+	}
+
+	// names returns the names of the objects of the stages.
+	names := func(stages []applyStage) [][]string {
+		var result [][]string
+		for _, stage := range stages {
+			var stageNames []string
+			for _, u := range stage.objects {
+				stageNames = append(stageNames, u.GetName())
+			}
+			result = append(result, stageNames)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name     string
+		stages   []kustomizev1.ApplyStage
+		want     [][]string
+		wantErr  string
+		wantName []string
+	}{
+		{
+			name:     "no stages",
+			want:     [][]string{{"a", "b", "c", "d"}},
+			wantName: []string{""},
+		},
+		{
+			name:     "objects belong to the first matching stage",
+			stages:   []kustomizev1.ApplyStage{canary, main},
+			want:     [][]string{{"a", "d"}, {"b"}, {"c"}},
+			wantName: []string{"canary", "main", ""},
+		},
+		{
+			name:     "empty stages are left out",
+			stages:   []kustomizev1.ApplyStage{main, canary},
+			want:     [][]string{{"a", "b", "d"}, {"c"}},
+			wantName: []string{"main", ""},
+		},
+		{
+			name: "invalid selector",
+			stages: []kustomizev1.ApplyStage{{
+				Name: "invalid",
+				Selector: metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "tier", Operator: "Unknown"},
+					},
+				},
+			}},
+			wantErr: "invalid selector of stage 'invalid'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			stages, err := applyStages(tt.stages, 5*time.Minute, objects)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(names(stages)).To(Equal(tt.want))
+			for i, stage := range stages {
+				g.Expect(stage.name).To(Equal(tt.wantName[i]))
+				g.Expect(stage.gated()).To(Equal(tt.wantName[i] != ""))
+			}
+		})
+	}
+
+	t.Run("stage timeout", func(t *testing.T) {
+		g := NewWithT(t)
+		stages, err := applyStages([]kustomizev1.ApplyStage{canary, main}, 5*time.Minute, objects)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(stages[0].timeout).To(Equal(time.Minute))
+		g.Expect(stages[1].timeout).To(Equal(5 * time.Minute))
+	})
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/fluxcd/pkg/runtime/acl"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// checkSubstitutionNamespaces returns an access denied error if the post
+// build substitutions of the Kustomization reference a ConfigMap or Secret
+// in a namespace which is not allowed by the controller.
+func (r *KustomizationReconciler) checkSubstitutionNamespaces(obj *kustomizev1.Kustomization) error {
+	if obj.Spec.PostBuild == nil {
+		return nil
+	}
+	for _, ref := range obj.Spec.PostBuild.SubstituteFrom {
+		if ref.Namespace == "" || ref.Namespace == obj.GetNamespace() {
+			continue
+		}
+		if !slices.Contains(r.SubstitutionNamespaces, ref.Namespace) {
+			return acl.AccessDeniedError(
+				fmt.Sprintf("can't substitute from '%s/%s/%s', the namespace '%s' is not allowed by --allowed-substitution-namespaces",
+					ref.Kind, ref.Namespace, ref.Name, ref.Namespace))
+		}
+	}
+	return nil
+}
+
+// inlineSubstituteFrom loads the variables of the substituteFrom references
+// of the Kustomization in their order, and merges them under the in-line
+// variables of the given unstructured Kustomization, from which it removes
+// the references. This is only done if any reference is cross-namespace, the
+// kustomize generator reading the others from the Kustomization namespace.
+func (r *KustomizationReconciler) inlineSubstituteFrom(ctx context.Context,
+	obj *kustomizev1.Kustomization, kustomization map[string]any) error {
+	if obj.Spec.PostBuild == nil || !slices.ContainsFunc(obj.Spec.PostBuild.SubstituteFrom,
+		func(ref kustomizev1.SubstituteReference) bool { return ref.Namespace != "" }) {
+		return nil
+	}
+
+	vars := make(map[string]string)
+	for _, ref := range obj.Spec.PostBuild.SubstituteFrom {
+		key := client.ObjectKey{Namespace: obj.GetNamespace(), Name: ref.Name}
+		if ref.Namespace != "" {
+			key.Namespace = ref.Namespace
+		}
+		data, _, err := r.readOutput(ctx, ref.Kind, key)
+		if err != nil {
+			if ref.Optional && apierrors.IsNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("substitute from '%s/%s' error: %w", ref.Kind, key, err)
+		}
+		for k, v := range data {
+			vars[k] = strings.ReplaceAll(v, "\n", "")
+		}
+	}
+
+	substitute, _, err := unstructured.NestedStringMap(kustomization, "spec", "postBuild", "substitute")
+	if err != nil {
+		return err
+	}
+	maps.Copy(vars, substitute)
+	unstructured.RemoveNestedField(kustomization, "spec", "postBuild", "substituteFrom")
+	return unstructured.SetNestedStringMap(kustomization, vars, "spec", "postBuild", "substitute")
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// suspendReasonMetaKey is the event metadata key of the suspend reason.
+const suspendReasonMetaKey = "suspendReason"
+
+// recordSuspension sets the Suspended condition of a suspended Kustomization,
+// and removes it from a resumed one. It emits an event on the transitions
+// from and to the suspension.
+func (r *KustomizationReconciler) recordSuspension(obj *kustomizev1.Kustomization) {
+	wasSuspended := conditions.IsTrue(obj, kustomizev1.SuspendedCondition)
+
+	if obj.Spec.Suspend {
+		msg := suspensionMessage("Reconciliation suspended", obj)
+		if obj.Spec.SuspendReason != "" {
+			msg = fmt.Sprintf("%s: %s", msg, obj.Spec.SuspendReason)
+		}
+		conditions.MarkTrue(obj, kustomizev1.SuspendedCondition, meta.SuspendedReason, "%s", msg)
+		if !wasSuspended {
+			r.suspensionEvent(obj, meta.SuspendedReason, msg)
+		}
+		return
+	}
+
+	if conditions.Has(obj, kustomizev1.SuspendedCondition) {
+		conditions.Delete(obj, kustomizev1.SuspendedCondition)
+		if wasSuspended {
+			r.suspensionEvent(obj, kustomizev1.ResumedReason, suspensionMessage("Reconciliation resumed", obj))
+		}
+	}
+}
+
+// suspensionEvent emits a Normal event for a transition from or to the
+// suspension, with the suspend reason in its metadata.
+func (r *KustomizationReconciler) suspensionEvent(obj *kustomizev1.Kustomization, reason, msg string) {
+	metadata := map[string]string{}
+	if obj.Spec.SuspendReason != "" {
+		metadata[kustomizev1.GroupVersion.Group+"/"+suspendReasonMetaKey] = obj.Spec.SuspendReason
+	}
+	r.EventRecorder.AnnotatedEventf(obj, metadata, corev1.EventTypeNormal, reason, "%s", msg)
+}
+
+// suspensionMessage appends the field manager and the time of the last
+// update of the suspension to the message, if they are available.
+func suspensionMessage(msg string, obj *kustomizev1.Kustomization) string {
+	manager, at := lastSuspendUpdate(obj)
+	if manager != "" {
+		msg = fmt.Sprintf("%s by %s", msg, manager)
+	}
+	if at != nil {
+		msg = fmt.Sprintf("%s at %s", msg, at.UTC().Format(time.RFC3339))
+	}
+	return msg
+}
+
+// lastSuspendUpdate returns the field manager and the time of the last
+// update of .spec.suspend from the managed fields of the object. As a false
+// value is omitted from the object, it falls back to the last update of the
+// spec when no manager owns the field.
+func lastSuspendUpdate(obj *kustomizev1.Kustomization) (string, *metav1.Time) {
+	var manager, specManager string
+	var at, specAt *metav1.Time
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Subresource != "" || entry.FieldsV1 == nil {
+			continue
+		}
+		var fields map[string]any
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		spec, ok := fields["f:spec"].(map[string]any)
+		if !ok {
+			continue
+		}
+		if isLaterEntry(entry, specManager, specAt) {
+			specManager, specAt = entry.Manager, entry.Time
+		}
+		if _, ok := spec["f:suspend"]; ok && isLaterEntry(entry, manager, at) {
+			manager, at = entry.Manager, entry.Time
+		}
+	}
+	if manager == "" {
+		return specManager, specAt
+	}
+	return manager, at
+}
+
+// isLaterEntry returns if the managed fields entry is the first one found,
+// or is more recent than the one found at the given time.
+func isLaterEntry(entry metav1.ManagedFieldsEntry, manager string, at *metav1.Time) bool {
+	if manager == "" {
+		return true
+	}
+	return entry.Time != nil && (at == nil || entry.Time.After(at.Time))
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_SuspendReason(t *testing.T) {
+	g := NewWithT(t)
+	id := "sr-" + randStringRunes(5)
+	revision := "v1.0.0"
+	resultK := &kustomizev1.Kustomization{}
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "configmap.yaml",
+			Body: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: suspended
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("sr-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("sr-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+	g.Eventually(func() bool {
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+		return isReconcileSuccess(resultK) && resultK.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	t.Run("reports the suspend reason", func(t *testing.T) {
+		g := NewWithT(t)
+		patch := client.MergeFrom(resultK.DeepCopy())
+		resultK.Spec.Suspend = true
+		resultK.Spec.SuspendReason = "maintenance window"
+		g.Expect(k8sClient.Patch(context.Background(), resultK, patch, client.FieldOwner("ops"))).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsTrue(resultK, kustomizev1.SuspendedCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetReason(resultK, kustomizev1.SuspendedCondition)).To(Equal(meta.SuspendedReason))
+		msg := conditions.GetMessage(resultK, kustomizev1.SuspendedCondition)
+		g.Expect(msg).To(HavePrefix("Reconciliation suspended by ops at "))
+		g.Expect(msg).To(HaveSuffix(": maintenance window"))
+	})
+
+	t.Run("removes the condition on resume", func(t *testing.T) {
+		g := NewWithT(t)
+		patch := client.MergeFrom(resultK.DeepCopy())
+		resultK.Spec.Suspend = false
+		resultK.Spec.SuspendReason = ""
+		g.Expect(k8sClient.Patch(context.Background(), resultK, patch, client.FieldOwner("ops"))).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return !conditions.Has(resultK, kustomizev1.SuspendedCondition)
+		}, timeout, time.Second).Should(BeTrue())
+	})
+}
+
+func TestKustomizationReconciler_recordSuspension(t *testing.T) {
+	suspendedAt := metav1.NewTime(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	resumedAt := metav1.NewTime(time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC))
+
+	g := NewWithT(t)
+	recorder := record.NewFakeRecorder(32)
+	r := &KustomizationReconciler{EventRecorder: recorder}
+
+	obj := &kustomizev1.Kustomization{}
+	obj.Spec.Suspend = true
+	obj.Spec.SuspendReason = "maintenance window"
+	obj.ManagedFields = []metav1.ManagedFieldsEntry{
+		{
+			Manager:    "flux",
+			Operation:  metav1.ManagedFieldsOperationUpdate,
+			Time:       &suspendedAt,
+			FieldsType: "FieldsV1",
+			FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:suspend":{},"f:suspendReason":{}}}`)},
+		},
+	}
+
+	// Entering the suspension emits an event.
+	r.recordSuspension(obj)
+	msg := "Reconciliation suspended by flux at 2024-01-01T12:00:00Z: maintenance window"
+	g.Expect(conditions.IsTrue(obj, kustomizev1.SuspendedCondition)).To(BeTrue())
+	g.Expect(conditions.GetMessage(obj, kustomizev1.SuspendedCondition)).To(Equal(msg))
+	g.Expect(recorder.Events).To(Receive(And(
+		HavePrefix("Normal Suspended "+msg),
+		ContainSubstring("kustomize.toolkit.fluxcd.io/suspendReason:maintenance window"),
+	)))
+
+	// Holding the suspension doesn't emit an event.
+	r.recordSuspension(obj)
+	g.Expect(conditions.IsTrue(obj, kustomizev1.SuspendedCondition)).To(BeTrue())
+	g.Expect(recorder.Events).NotTo(Receive())
+
+	// Resuming removes the condition and emits an event.
+	obj.Spec.Suspend = false
+	obj.Spec.SuspendReason = ""
+	obj.ManagedFields = append(obj.ManagedFields, metav1.ManagedFieldsEntry{
+		Manager:    "kubectl-patch",
+		Operation:  metav1.ManagedFieldsOperationUpdate,
+		Time:       &resumedAt,
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:path":{}}}`)},
+	})
+	obj.ManagedFields[0].FieldsV1 = &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:interval":{}}}`)}
+	r.recordSuspension(obj)
+	g.Expect(conditions.Has(obj, kustomizev1.SuspendedCondition)).To(BeFalse())
+	g.Expect(recorder.Events).To(Receive(HavePrefix(
+		"Normal Resumed Reconciliation resumed by kubectl-patch at 2024-01-02T12:00:00Z")))
+
+	// Reconciling a resumed object doesn't emit an event.
+	r.recordSuspension(obj)
+	g.Expect(recorder.Events).NotTo(Receive())
+}
+
+func Test_lastSuspendUpdate(t *testing.T) {
+	older := metav1.NewTime(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	newer := metav1.NewTime(time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC))
+	entry := func(manager string, at *metav1.Time, subresource, fields string) metav1.ManagedFieldsEntry {
+		return metav1.ManagedFieldsEntry{
+			Manager:     manager,
+			Time:        at,
+			Subresource: subresource,
+			FieldsType:  "FieldsV1",
+			FieldsV1:    &metav1.FieldsV1{Raw: []byte(fields)},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		entries     []metav1.ManagedFieldsEntry
+		wantManager string
+		wantAt      *metav1.Time
+	}{
+		{
+			name: "no managed fields",
+		},
+		{
+			name: "owner of the suspend field",
+			entries: []metav1.ManagedFieldsEntry{
+				entry("flux", &older, "", `{"f:spec":{"f:suspend":{}}}`),
+				entry("kubectl", &newer, "", `{"f:spec":{"f:path":{}}}`),
+			},
+			wantManager: "flux",
+			wantAt:      &older,
+		},
+		{
+			name: "latest owner of the suspend field",
+			entries: []metav1.ManagedFieldsEntry{
+				entry("flux", &older, "", `{"f:spec":{"f:suspend":{}}}`),
+				entry("kubectl", &newer, "", `{"f:spec":{"f:suspend":{}}}`),
+			},
+			wantManager: "kubectl",
+			wantAt:      &newer,
+		},
+		{
+			name: "latest update of the spec without owner",
+			entries: []metav1.ManagedFieldsEntry{
+				entry("kubectl", &newer, "", `{"f:spec":{"f:path":{}}}`),
+				entry("flux", &older, "", `{"f:spec":{"f:interval":{}}}`),
+			},
+			wantManager: "kubectl",
+			wantAt:      &newer,
+		},
+		{
+			name: "ignores the status",
+			entries: []metav1.ManagedFieldsEntry{
+				entry("kustomize-controller", &newer, "status", `{"f:status":{}}`),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			obj := &kustomizev1.Kustomization{}
+			obj.ManagedFields = tt.entries
+			manager, at := lastSuspendUpdate(obj)
+			g.Expect(manager).To(Equal(tt.wantManager))
+			g.Expect(at).To(Equal(tt.wantAt))
+		})
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// phaseTimeoutError is returned when a phase of the reconciliation exceeds
+// the timeout set for it in .spec.timeouts.
+type phaseTimeoutError struct {
+	// Reason is the condition reason of the phase timeout, e.g.
+	// kustomizev1.BuildTimeoutReason.
+	Reason string
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns the message of the underlying error.
+func (e *phaseTimeoutError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *phaseTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// withPhaseTimeout returns a context which expires after the given phase
+// timeout, or when the parent context expires if the timeout is not set.
+func withPhaseTimeout(ctx context.Context, timeout *metav1.Duration) (context.Context, context.CancelFunc) {
+	if timeout == nil {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout.Duration)
+}
+
+// checkPhaseTimeout returns a phaseTimeoutError wrapping the error of the
+// phase, if any, when the phase timeout is set and the context of the phase
+// has expired. Otherwise, it returns the error of the phase as is. A phase
+// which completes after its timeout fails as well, for its steps which do
+// not honour the context, e.g. the kustomize build.
+func checkPhaseTimeout(ctx context.Context, phase string, timeout *metav1.Duration, reason string, err error) error {
+	if timeout == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	timeoutErr := fmt.Errorf("%s timeout of %s exceeded", phase, timeout.Duration.String())
+	if err != nil {
+		timeoutErr = fmt.Errorf("%w: %w", timeoutErr, err)
+	}
+	return &phaseTimeoutError{Reason: reason, Err: timeoutErr}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
+	"github.com/fluxcd/pkg/testserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+func TestKustomizationReconciler_Timeouts(t *testing.T) {
+	g := NewWithT(t)
+	id := "timeouts-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	// The Deployment never becomes ready, as there is no controller
+	// creating its pods in the test environment.
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "deployment.yaml",
+			Body: `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  selector:
+    matchLabels:
+      app: app
+  template:
+    metadata:
+      labels:
+        app: app
+    spec:
+      containers:
+      - name: app
+        image: ghcr.io/example/app:v1
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("timeouts-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	tests := []struct {
+		name           string
+		timeouts       kustomizev1.Timeouts
+		wantReason     string
+		wantMessage    string
+		wantDeployment bool
+	}{
+		{
+			name:        "build",
+			timeouts:    kustomizev1.Timeouts{Build: &metav1.Duration{Duration: time.Millisecond}},
+			wantReason:  kustomizev1.BuildTimeoutReason,
+			wantMessage: "build timeout of 1ms exceeded",
+		},
+		{
+			name:        "apply",
+			timeouts:    kustomizev1.Timeouts{Apply: &metav1.Duration{Duration: time.Millisecond}},
+			wantReason:  kustomizev1.ApplyTimeoutReason,
+			wantMessage: "apply timeout of 1ms exceeded",
+		},
+		{
+			name:           "health check",
+			timeouts:       kustomizev1.Timeouts{HealthCheck: &metav1.Duration{Duration: 2 * time.Second}},
+			wantReason:     kustomizev1.HealthCheckTimeoutReason,
+			wantMessage:    "health check timeout of 2s exceeded: timeout waiting for",
+			wantDeployment: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			kustomization := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      fmt.Sprintf("timeouts-%s", randStringRunes(5)),
+					Namespace: id,
+				},
+				Spec: kustomizev1.KustomizationSpec{
+					Interval: metav1.Duration{Duration: reconciliationInterval},
+					Path:     "./",
+					KubeConfig: &kustomizev1.KubeConfigReference{
+						SecretRef: meta.SecretKeyReference{
+							Name: "kubeconfig",
+						},
+					},
+					SourceRef: kustomizev1.CrossNamespaceSourceReference{
+						Name:      repositoryName.Name,
+						Namespace: repositoryName.Namespace,
+						Kind:      sourcev1.GitRepositoryKind,
+					},
+					// Each case applies its own Deployment.
+					NamePrefix:      randStringRunes(5) + "-",
+					TargetNamespace: id,
+					Wait:            true,
+					Timeouts:        &tt.timeouts,
+				},
+			}
+			g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+			resultK := &kustomizev1.Kustomization{}
+			g.Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+				return conditions.GetReason(resultK, meta.ReadyCondition) == tt.wantReason
+			}, timeout, time.Second).Should(BeTrue())
+			logStatus(t, resultK)
+
+			g.Expect(conditions.IsFalse(resultK, meta.ReadyCondition)).To(BeTrue())
+			g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(ContainSubstring(tt.wantMessage))
+
+			var deployment appsv1.Deployment
+			err := k8sClient.Get(context.Background(), client.ObjectKey{
+				Name:      kustomization.Spec.NamePrefix + "app",
+				Namespace: id,
+			}, &deployment)
+			if tt.wantDeployment {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(conditions.GetReason(resultK, meta.HealthyCondition)).To(Equal(tt.wantReason))
+			} else {
+				g.Expect(client.IgnoreNotFound(err)).ToNot(HaveOccurred())
+			}
+		})
+	}
+}
+
+func Test_checkPhaseTimeout(t *testing.T) {
+	g := NewWithT(t)
+
+	timeout := &metav1.Duration{Duration: time.Millisecond}
+	phaseErr := errors.New("context deadline exceeded")
+
+	// A phase without timeout returns its error as is.
+	ctx, cancel := withPhaseTimeout(context.Background(), nil)
+	cancel()
+	g.Expect(checkPhaseTimeout(ctx, "build", nil, kustomizev1.BuildTimeoutReason, phaseErr)).To(BeIdenticalTo(phaseErr))
+	g.Expect(checkPhaseTimeout(ctx, "build", nil, kustomizev1.BuildTimeoutReason, nil)).To(Succeed())
+
+	// A phase within its timeout returns its error as is.
+	ctx, cancel = withPhaseTimeout(context.Background(), &metav1.Duration{Duration: time.Minute})
+	defer cancel()
+	g.Expect(checkPhaseTimeout(ctx, "build", timeout, kustomizev1.BuildTimeoutReason, phaseErr)).To(BeIdenticalTo(phaseErr))
+	g.Expect(checkPhaseTimeout(ctx, "build", timeout, kustomizev1.BuildTimeoutReason, nil)).To(Succeed())
+
+	// A phase which exceeds its timeout fails with the reason of the phase,
+	// even if it completes.
+	ctx, cancel = withPhaseTimeout(context.Background(), timeout)
+	defer cancel()
+	<-ctx.Done()
+
+	err := checkPhaseTimeout(ctx, "apply", timeout, kustomizev1.ApplyTimeoutReason, phaseErr)
+	var timeoutErr *phaseTimeoutError
+	g.Expect(errors.As(err, &timeoutErr)).To(BeTrue())
+	g.Expect(timeoutErr.Reason).To(Equal(kustomizev1.ApplyTimeoutReason))
+	g.Expect(err).To(MatchError("apply timeout of 1ms exceeded: context deadline exceeded"))
+	g.Expect(errors.Is(err, phaseErr)).To(BeTrue())
+
+	err = checkPhaseTimeout(ctx, "apply", timeout, kustomizev1.ApplyTimeoutReason, nil)
+	g.Expect(errors.As(err, &timeoutErr)).To(BeTrue())
+	g.Expect(err).To(MatchError("apply timeout of 1ms exceeded"))
+}
@@ -30,6 +30,7 @@ import (
 	. "github.com/onsi/gomega"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -62,6 +63,27 @@ metadata:
     tenant: test
 data:
   key: val
+`, name),
+			},
+			{
+				Name: "deployment.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: %[1]s
+spec:
+  selector:
+    matchLabels:
+      app: %[1]s
+  template:
+    metadata:
+      labels:
+        app: %[1]s
+    spec:
+      containers:
+      - name: app
+        image: ghcr.io/stefanprodan/podinfo:6.7.0
 `, name),
 			},
 		}
@@ -90,7 +112,7 @@ data:
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: 2 * time.Minute},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -106,6 +128,12 @@ data:
 				},
 				Labels: map[string]string{
 					"tenant": id,
+					"team":   "${team}",
+				},
+			},
+			PostBuild: &kustomizev1.PostBuild{
+				Substitute: map[string]string{
+					"team": "platform",
 				},
 			},
 			TargetNamespace: id,
@@ -128,6 +156,38 @@ data:
 		g.Expect(cm.GetAnnotations()).To(HaveKeyWithValue("tenant", id))
 	})
 
+	t.Run("substitutes variables in labels", func(t *testing.T) {
+		g := NewWithT(t)
+		var cm corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: id, Namespace: id}, &cm)).To(Succeed())
+		g.Expect(cm.GetLabels()).To(HaveKeyWithValue("team", "platform"))
+	})
+
+	t.Run("does not set labels on selectors and templates", func(t *testing.T) {
+		g := NewWithT(t)
+		var deployment appsv1.Deployment
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: id, Namespace: id}, &deployment)).To(Succeed())
+		g.Expect(deployment.GetLabels()).To(HaveKeyWithValue("tenant", id))
+		g.Expect(deployment.Spec.Selector.MatchLabels).To(Equal(map[string]string{"app": id}))
+		g.Expect(deployment.Spec.Template.GetLabels()).To(Equal(map[string]string{"app": id}))
+	})
+
+	t.Run("updates labels", func(t *testing.T) {
+		g := NewWithT(t)
+		resultK.Spec.PostBuild.Substitute["team"] = "apps"
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.ObservedGeneration == resultK.GetGeneration() && isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+
+		var deployment appsv1.Deployment
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: id, Namespace: id}, &deployment)).To(Succeed())
+		g.Expect(deployment.GetLabels()).To(HaveKeyWithValue("team", "apps"))
+		g.Expect(deployment.Spec.Selector.MatchLabels).To(Equal(map[string]string{"app": id}))
+	})
+
 	t.Run("removes labels and annotations", func(t *testing.T) {
 		g := NewWithT(t)
 		resultK.Spec.CommonMetadata = nil
@@ -146,6 +206,156 @@ data:
 	})
 }
 
+func TestKustomizationReconciler_TargetNamespaceMetadata(t *testing.T) {
+	g := NewWithT(t)
+	id := "tnm-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	owned := "tnm-owned-" + randStringRunes(5)
+	notOwned := "tnm-not-owned-" + randStringRunes(5)
+	err = createNamespace(notOwned)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create not owned namespace")
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "owned/namespace.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: %[1]s
+  labels:
+    team: apps
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  key: val
+`, owned),
+		},
+		{
+			Name: "not-owned/config.yaml",
+			Body: `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  key: val
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("tnm-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	newKustomization := func(path, targetNamespace string) *kustomizev1.Kustomization {
+		return &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("tnm-%s", randStringRunes(5)),
+				Namespace: id,
+			},
+			Spec: kustomizev1.KustomizationSpec{
+				Interval: metav1.Duration{Duration: reconciliationInterval},
+				Path:     path,
+				KubeConfig: &kustomizev1.KubeConfigReference{
+					SecretRef: meta.SecretKeyReference{
+						Name: "kubeconfig",
+					},
+				},
+				SourceRef: kustomizev1.CrossNamespaceSourceReference{
+					Name:      repositoryName.Name,
+					Namespace: repositoryName.Namespace,
+					Kind:      sourcev1.GitRepositoryKind,
+				},
+				Prune:           true,
+				TargetNamespace: targetNamespace,
+				TargetNamespaceMetadata: &kustomizev1.CommonMetadata{
+					Annotations: map[string]string{
+						"quota.example.com/tier": "small",
+					},
+					Labels: map[string]string{
+						"pod-security.kubernetes.io/enforce": "restricted",
+					},
+				},
+			},
+		}
+	}
+
+	t.Run("sets the metadata of the created namespace", func(t *testing.T) {
+		g := NewWithT(t)
+		kustomization := newKustomization("./owned", owned)
+		g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+		resultK := &kustomizev1.Kustomization{}
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+
+		var ns corev1.Namespace
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: owned}, &ns)).To(Succeed())
+		g.Expect(ns.GetLabels()).To(HaveKeyWithValue("pod-security.kubernetes.io/enforce", "restricted"))
+		g.Expect(ns.GetLabels()).To(HaveKeyWithValue("team", "apps"))
+		g.Expect(ns.GetAnnotations()).To(HaveKeyWithValue("quota.example.com/tier", "small"))
+
+		// The metadata is set on the target namespace only.
+		var cm corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: "config", Namespace: owned}, &cm)).To(Succeed())
+		g.Expect(cm.GetLabels()).ToNot(HaveKey("pod-security.kubernetes.io/enforce"))
+		g.Expect(cm.GetAnnotations()).ToNot(HaveKey("quota.example.com/tier"))
+	})
+
+	t.Run("corrects the drift of the namespace labels", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() error {
+			var ns corev1.Namespace
+			if err := k8sClient.Get(context.Background(), client.ObjectKey{Name: owned}, &ns); err != nil {
+				return err
+			}
+			ns.Labels["pod-security.kubernetes.io/enforce"] = "privileged"
+			return k8sClient.Update(context.Background(), &ns)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() string {
+			var ns corev1.Namespace
+			_ = k8sClient.Get(context.Background(), client.ObjectKey{Name: owned}, &ns)
+			return ns.GetLabels()["pod-security.kubernetes.io/enforce"]
+		}, timeout, time.Second).Should(Equal("restricted"))
+	})
+
+	t.Run("does not mutate a namespace not owned", func(t *testing.T) {
+		g := NewWithT(t)
+		kustomization := newKustomization("./not-owned", notOwned)
+		g.Expect(k8sClient.Create(context.Background(), kustomization)).To(Succeed())
+
+		resultK := &kustomizev1.Kustomization{}
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+
+		var ns corev1.Namespace
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: notOwned}, &ns)).To(Succeed())
+		g.Expect(ns.GetLabels()).ToNot(HaveKey("pod-security.kubernetes.io/enforce"))
+		g.Expect(ns.GetAnnotations()).ToNot(HaveKey("quota.example.com/tier"))
+	})
+}
+
 func TestKustomizationReconciler_NamePrefixSuffix(t *testing.T) {
 	g := NewWithT(t)
 	id := "np-" + randStringRunes(5)
@@ -171,6 +381,30 @@ metadata:
     tenant: test
 data:
   key: val
+`, name),
+			},
+			{
+				Name: "deployment.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: %[1]s
+spec:
+  selector:
+    matchLabels:
+      app: %[1]s
+  template:
+    metadata:
+      labels:
+        app: %[1]s
+    spec:
+      containers:
+      - name: app
+        image: ghcr.io/stefanprodan/podinfo:6.7.0
+        envFrom:
+        - configMapRef:
+            name: %[1]s
 `, name),
 			},
 		}
@@ -199,7 +433,7 @@ data:
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: 2 * time.Minute},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -212,6 +446,7 @@ data:
 			NamePrefix:      "prefix-",
 			NameSuffix:      "-suffix",
 			TargetNamespace: id,
+			Prune:           true,
 		},
 	}
 
@@ -225,9 +460,45 @@ data:
 		}, timeout, time.Second).Should(BeTrue())
 		kstatusCheck.CheckErr(ctx, resultK)
 
+		// The target namespace is not renamed.
 		name := fmt.Sprintf("prefix-%s-suffix", id)
 		var cm corev1.ConfigMap
 		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: name, Namespace: id}, &cm)).To(Succeed())
+
+		// The references to the renamed resources are renamed too.
+		var deployment appsv1.Deployment
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: name, Namespace: id}, &deployment)).To(Succeed())
+		g.Expect(deployment.Spec.Template.Spec.Containers[0].EnvFrom[0].ConfigMapRef.Name).To(Equal(name))
+	})
+
+	t.Run("prunes the resources of the previous prefix", func(t *testing.T) {
+		g := NewWithT(t)
+		resultK.Spec.NamePrefix = "blue-"
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return resultK.Status.ObservedGeneration == resultK.GetGeneration() && isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+
+		name := fmt.Sprintf("blue-%s-suffix", id)
+		var cm corev1.ConfigMap
+		g.Expect(k8sClient.Get(context.Background(), client.ObjectKey{Name: name, Namespace: id}, &cm)).To(Succeed())
+
+		oldName := fmt.Sprintf("prefix-%s-suffix", id)
+		g.Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), client.ObjectKey{Name: oldName, Namespace: id}, &corev1.ConfigMap{})
+			return apierrors.IsNotFound(err)
+		}, timeout, time.Second).Should(BeTrue())
+
+		var entries []string
+		for _, entry := range resultK.Status.Inventory.Entries {
+			entries = append(entries, entry.ID)
+		}
+		g.Expect(entries).To(ConsistOf(
+			fmt.Sprintf("%s_%s__ConfigMap", id, name),
+			fmt.Sprintf("%s_%s_apps_Deployment", id, name),
+		))
 	})
 }
 
@@ -269,7 +540,7 @@ func TestKustomizationReconciler_KustomizeTransformer(t *testing.T) {
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: reconciliationInterval},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -392,7 +663,7 @@ func TestKustomizationReconciler_KustomizeTransformerFiles(t *testing.T) {
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: reconciliationInterval},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -511,7 +782,7 @@ func TestKustomizationReconciler_FluxTransformers(t *testing.T) {
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: reconciliationInterval},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -577,6 +848,143 @@ metadata:
 	})
 }
 
+func TestKustomizationReconciler_ImagesPrecedence(t *testing.T) {
+	g := NewWithT(t)
+	id := "images-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	manifests := func(name string) []testserver.File {
+		return []testserver.File{
+			{
+				Name: "kustomization.yaml",
+				Body: `---
+apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- deployment.yaml
+images:
+- name: podinfo
+  newName: ghcr.io/stefanprodan/podinfo
+  newTag: 6.0.0
+- name: flagger
+  newName: ghcr.io/fluxcd/flagger
+  newTag: 1.0.0
+`,
+			},
+			{
+				Name: "deployment.yaml",
+				Body: fmt.Sprintf(`---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: %[1]s
+spec:
+  selector:
+    matchLabels:
+      app: %[1]s
+  template:
+    metadata:
+      labels:
+        app: %[1]s
+    spec:
+      containers:
+      - name: podinfo
+        image: podinfo
+      - name: flagger
+        image: flagger
+`, name),
+			},
+		}
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests(id))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("images-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("images-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Images: []kustomize.Image{
+				{
+					Name:   "podinfo",
+					NewTag: "6.7.0",
+				},
+			},
+		},
+	}
+
+	g.Expect(k8sClient.Create(context.TODO(), kustomization)).To(Succeed())
+
+	g.Eventually(func() bool {
+		var obj kustomizev1.Kustomization
+		_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), &obj)
+		return obj.Status.LastAppliedRevision == revision
+	}, timeout, time.Second).Should(BeTrue())
+
+	var deployment appsv1.Deployment
+	g.Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: id, Namespace: id}, &deployment)).To(Succeed())
+
+	t.Run("overrides the committed image of the same name", func(t *testing.T) {
+		g := NewWithT(t)
+		// The entry of the Kustomization replaces the committed entry as a
+		// whole, including its newName.
+		g.Expect(deployment.Spec.Template.Spec.Containers[0].Image).To(Equal("podinfo:6.7.0"))
+	})
+
+	t.Run("keeps the other committed images", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Expect(deployment.Spec.Template.Spec.Containers[1].Image).To(Equal("ghcr.io/fluxcd/flagger:1.0.0"))
+	})
+
+	t.Run("rejects an image with both newTag and digest", func(t *testing.T) {
+		g := NewWithT(t)
+		invalid := kustomization.DeepCopy()
+		invalid.ObjectMeta = metav1.ObjectMeta{
+			Name:      fmt.Sprintf("images-%s", randStringRunes(5)),
+			Namespace: id,
+		}
+		invalid.Spec.Images = []kustomize.Image{
+			{
+				Name:   "podinfo",
+				NewTag: "6.7.0",
+				Digest: "sha256:2832f53c577d44753e97b0ed5f00e7e3a06979c9fab77d0e78bdac4b612b14fb",
+			},
+		}
+		err := k8sClient.Create(context.TODO(), invalid)
+		g.Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		g.Expect(err.Error()).To(ContainSubstring("images must not specify both newTag and digest"))
+	})
+}
+
 func checkConfigMap(list *corev1.ConfigMapList, name string) bool {
 	if list == nil {
 		return false
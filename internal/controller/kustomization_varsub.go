@@ -0,0 +1,164 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/fluxcd/pkg/envsubst"
+	generator "github.com/fluxcd/pkg/kustomize"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// specVariables substitutes the variables of the post build substitutions
+// of a Kustomization in the fields of its spec which are used before the
+// build. The variables are loaded once, on the first field referencing any.
+type specVariables struct {
+	obj     *kustomizev1.Kustomization
+	outputs map[string]string
+	loader  func() (map[string]string, error)
+
+	vars map[string]string
+}
+
+// newSpecVariables returns a specVariables for the given Kustomization, of
+// which the variables are read with the client of the reconciler, and
+// merged with the outputs of its dependencies.
+func (r *KustomizationReconciler) newSpecVariables(ctx context.Context,
+	obj *kustomizev1.Kustomization, outputs map[string]string) *specVariables {
+	return &specVariables{
+		obj:     obj,
+		outputs: outputs,
+		loader: func() (map[string]string, error) {
+			u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+			if err != nil {
+				return nil, err
+			}
+			// The cross-namespace references are inlined in the substitute
+			// map, the generator loading the others only.
+			if err := r.inlineSubstituteFrom(ctx, obj, u); err != nil {
+				return nil, err
+			}
+			vars, err := generator.LoadVariables(ctx, r.Client, unstructured.Unstructured{Object: u})
+			if err != nil {
+				return nil, err
+			}
+			inlined, _, err := unstructured.NestedStringMap(u, "spec", "postBuild", "substitute")
+			if err != nil {
+				return nil, err
+			}
+			maps.Copy(vars, inlined)
+			// The outputs of the dependencies and the in-line variables
+			// override the ones of the ConfigMaps and Secrets, as in the
+			// post build substitutions.
+			maps.Copy(vars, outputs)
+			if obj.Spec.PostBuild != nil {
+				for k, v := range obj.Spec.PostBuild.Substitute {
+					vars[k] = strings.ReplaceAll(v, "\n", "")
+				}
+			}
+			return vars, nil
+		},
+	}
+}
+
+// substitute returns the given value of the field with its variables
+// substituted. Values without a '$' are returned as is, and undefined
+// variables result in an error, regardless of the strict substitution
+// option of the controller, as an empty value would silently point the
+// field at another path or namespace.
+func (s *specVariables) substitute(field, value string) (string, error) {
+	if !strings.Contains(value, "$") {
+		return value, nil
+	}
+	if s.vars == nil {
+		if s.obj.Spec.PostBuild == nil && len(s.outputs) == 0 {
+			return "", fmt.Errorf("failed to substitute variables in %s '%s': no post build substitutions are specified", field, value)
+		}
+		vars, err := s.loader()
+		if err != nil {
+			return "", fmt.Errorf("failed to substitute variables in %s '%s': %w", field, value, err)
+		}
+		s.vars = vars
+	}
+	out, err := envsubst.Eval(value, func(name string) (string, bool) {
+		v, ok := s.vars[name]
+		return v, ok
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to substitute variables in %s '%s': %w", field, value, err)
+	}
+	return out, nil
+}
+
+// paths returns the .spec.paths of the Kustomization, or its .spec.path if
+// not set, with their variables substituted. It returns an error if any of
+// the substituted paths points outside of the artifact.
+func (s *specVariables) paths() ([]string, error) {
+	if len(s.obj.Spec.Paths) == 0 {
+		path, err := s.path(".spec.path", s.obj.Spec.Path)
+		if err != nil {
+			return nil, err
+		}
+		return []string{path}, nil
+	}
+	paths := make([]string, len(s.obj.Spec.Paths))
+	for i, p := range s.obj.Spec.Paths {
+		path, err := s.path(fmt.Sprintf(".spec.paths[%d]", i), p)
+		if err != nil {
+			return nil, err
+		}
+		paths[i] = path
+	}
+	return paths, nil
+}
+
+// path returns the given path of the field with its variables substituted.
+func (s *specVariables) path(field, value string) (string, error) {
+	path, err := s.substitute(field, value)
+	if err != nil {
+		return "", err
+	}
+	if path != value && escapesRoot(path) {
+		return "", fmt.Errorf("path '%s' substituted from '%s' must not point outside of the artifact", path, value)
+	}
+	return path, nil
+}
+
+// healthChecks returns the .spec.healthChecks of the Kustomization with the
+// variables of their namespaces substituted.
+func (s *specVariables) healthChecks() ([]kustomizev1.HealthCheck, error) {
+	if len(s.obj.Spec.HealthChecks) == 0 {
+		return nil, nil
+	}
+	healthChecks := make([]kustomizev1.HealthCheck, len(s.obj.Spec.HealthChecks))
+	for i, hc := range s.obj.Spec.HealthChecks {
+		ns, err := s.substitute(fmt.Sprintf(".spec.healthChecks[%d].namespace", i), hc.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		hc.Namespace = ns
+		healthChecks[i] = hc
+	}
+	return healthChecks, nil
+}
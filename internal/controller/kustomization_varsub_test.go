@@ -20,12 +20,16 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
+	apiacl "github.com/fluxcd/pkg/apis/acl"
 	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/conditions"
 	"github.com/fluxcd/pkg/testserver"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -119,7 +123,7 @@ stringData:
 			Namespace: id,
 		},
 		Spec: kustomizev1.KustomizationSpec{
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -144,12 +148,14 @@ stringData:
 					},
 				},
 			},
-			HealthChecks: []meta.NamespacedObjectKindReference{
+			HealthChecks: []kustomizev1.HealthCheck{
 				{
-					APIVersion: "v1",
-					Kind:       "ServiceAccount",
-					Name:       id,
-					Namespace:  id,
+					NamespacedObjectKindReference: meta.NamespacedObjectKindReference{
+						APIVersion: "v1",
+						Kind:       "ServiceAccount",
+						Name:       id,
+						Namespace:  id,
+					},
 				},
 			},
 		},
@@ -268,7 +274,7 @@ metadata:
 			Namespace: id,
 		},
 		Spec: kustomizev1.KustomizationSpec{
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -295,12 +301,14 @@ metadata:
 					},
 				},
 			},
-			HealthChecks: []meta.NamespacedObjectKindReference{
+			HealthChecks: []kustomizev1.HealthCheck{
 				{
-					APIVersion: "v1",
-					Kind:       "ServiceAccount",
-					Name:       id,
-					Namespace:  id,
+					NamespacedObjectKindReference: meta.NamespacedObjectKindReference{
+						APIVersion: "v1",
+						Kind:       "ServiceAccount",
+						Name:       id,
+						Namespace:  id,
+					},
 				},
 			},
 		},
@@ -425,7 +433,7 @@ data:
 			Namespace: id,
 		},
 		Spec: kustomizev1.KustomizationSpec{
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -531,7 +539,7 @@ metadata:
 			Namespace: id,
 		},
 		Spec: kustomizev1.KustomizationSpec{
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -570,3 +578,303 @@ metadata:
 	g.Expect(ready.Message).To(ContainSubstring("variable not set"))
 	g.Expect(k8sClient.Delete(context.Background(), &resultK)).To(Succeed())
 }
+
+func TestKustomizationReconciler_VarsubPath(t *testing.T) {
+	g := NewWithT(t)
+	id := "vars-" + randStringRunes(5)
+	revision := "v1.0.0/" + randStringRunes(7)
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	manifests := func(name string) []testserver.File {
+		return []testserver.File{
+			{
+				Name: "clusters/prod/apps/service-account.yaml",
+				Body: fmt.Sprintf(`
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: %[1]s
+  namespace: %[1]s
+`, name),
+			},
+		}
+	}
+
+	artifact, err := testServer.ArtifactFromFiles(manifests(id))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      randStringRunes(5),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	config := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      randStringRunes(5),
+			Namespace: id,
+		},
+		Data: map[string]string{
+			"CLUSTER_NAME": "prod",
+			"HC_NAMESPACE": id,
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), config)).Should(Succeed())
+
+	inputK := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      id,
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./clusters/${CLUSTER_NAME}/apps",
+			Prune:    true,
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Kind: sourcev1.GitRepositoryKind,
+				Name: repositoryName.Name,
+			},
+			PostBuild: &kustomizev1.PostBuild{
+				Substitute: map[string]string{"environment": "prod"},
+				SubstituteFrom: []kustomizev1.SubstituteReference{
+					{
+						Kind: "ConfigMap",
+						Name: config.Name,
+					},
+				},
+			},
+			HealthChecks: []kustomizev1.HealthCheck{
+				{
+					NamespacedObjectKindReference: meta.NamespacedObjectKindReference{
+						APIVersion: "v1",
+						Kind:       "ServiceAccount",
+						Name:       id,
+						Namespace:  "${HC_NAMESPACE}",
+					},
+				},
+			},
+		},
+	}
+	g.Expect(k8sClient.Create(context.Background(), inputK)).Should(Succeed())
+
+	resultK := &kustomizev1.Kustomization{}
+
+	t.Run("substitutes the path and health checks from a ConfigMap", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(inputK), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, interval).Should(BeTrue())
+
+		g.Expect(resultK.Status.LastAppliedRevision).To(Equal(revision))
+		g.Expect(apimeta.IsStatusConditionTrue(resultK.Status.Conditions, meta.HealthyCondition)).To(BeTrue())
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: id, Namespace: id}, &corev1.ServiceAccount{})).Should(Succeed())
+	})
+
+	t.Run("rejects a substituted path outside of the artifact", func(t *testing.T) {
+		g := NewWithT(t)
+		// The in-line variables override the ones of the ConfigMap.
+		resultK.Spec.PostBuild.Substitute["CLUSTER_NAME"] = "../../.."
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(inputK), resultK)
+			return resultK.Status.ObservedGeneration == resultK.GetGeneration() &&
+				apimeta.IsStatusConditionFalse(resultK.Status.Conditions, meta.ReadyCondition)
+		}, timeout, interval).Should(BeTrue())
+
+		ready := apimeta.FindStatusCondition(resultK.Status.Conditions, meta.ReadyCondition)
+		g.Expect(ready.Reason).To(Equal(meta.BuildFailedReason))
+		g.Expect(ready.Message).To(ContainSubstring(
+			"path './clusters/../../../apps' substituted from './clusters/${CLUSTER_NAME}/apps' must not point outside of the artifact"))
+	})
+
+	t.Run("fails on undefined variables", func(t *testing.T) {
+		g := NewWithT(t)
+		delete(resultK.Spec.PostBuild.Substitute, "CLUSTER_NAME")
+		resultK.Spec.Path = "./clusters/${CLUSTER}/apps"
+		g.Expect(k8sClient.Update(context.Background(), resultK)).To(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(inputK), resultK)
+			return resultK.Status.ObservedGeneration == resultK.GetGeneration() &&
+				apimeta.IsStatusConditionFalse(resultK.Status.Conditions, meta.ReadyCondition)
+		}, timeout, interval).Should(BeTrue())
+
+		ready := apimeta.FindStatusCondition(resultK.Status.Conditions, meta.ReadyCondition)
+		g.Expect(ready.Reason).To(Equal(meta.BuildFailedReason))
+		g.Expect(ready.Message).To(ContainSubstring(
+			"failed to substitute variables in .spec.path './clusters/${CLUSTER}/apps'"))
+		g.Expect(ready.Message).To(ContainSubstring("variable not set"))
+	})
+}
+
+func Test_escapesRoot(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "", want: false},
+		{path: "./", want: false},
+		{path: "/clusters/prod", want: false},
+		{path: "./clusters/../apps", want: false},
+		{path: "..", want: true},
+		{path: "./clusters/../../apps", want: true},
+		{path: "../apps", want: true},
+		{path: "..apps", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(escapesRoot(tt.path)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestKustomizationReconciler_VarsubCrossNamespace(t *testing.T) {
+	g := NewWithT(t)
+	id := "vars-" + randStringRunes(5)
+	platformNamespace := "platform-" + randStringRunes(5)
+	revision := "v1.0.0"
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	err = createNamespace(platformNamespace)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create platform namespace")
+
+	err = createKubeConfigSecret(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create kubeconfig secret")
+
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "service-account.yaml",
+			Body: fmt.Sprintf(`---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: %[1]s
+  namespace: %[1]s
+  labels:
+    cluster: ${cluster}
+    zone: ${zone}
+`, id),
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      randStringRunes(5),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	platformConfig := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cluster-vars",
+			Namespace: platformNamespace,
+		},
+		Data: map[string]string{"cluster": "prod-1", "zone": "az-1a"},
+	}
+	g.Expect(k8sClient.Create(context.Background(), platformConfig)).Should(Succeed())
+
+	// The local ConfigMap comes last and overrides the platform zone.
+	localConfig := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "local-vars",
+			Namespace: id,
+		},
+		Data: map[string]string{"zone": "az-1b"},
+	}
+	g.Expect(k8sClient.Create(context.Background(), localConfig)).Should(Succeed())
+
+	inputK := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      id,
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			KubeConfig: &kustomizev1.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{
+					Name: "kubeconfig",
+				},
+			},
+			Interval: metav1.Duration{Duration: reconciliationInterval},
+			Path:     "./",
+			Prune:    true,
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Kind: sourcev1.GitRepositoryKind,
+				Name: repositoryName.Name,
+			},
+			PostBuild: &kustomizev1.PostBuild{
+				SubstituteFrom: []kustomizev1.SubstituteReference{
+					{
+						Kind:      "ConfigMap",
+						Name:      platformConfig.Name,
+						Namespace: platformNamespace,
+					},
+					{
+						Kind: "ConfigMap",
+						Name: localConfig.Name,
+					},
+				},
+			},
+		},
+	}
+
+	resultK := &kustomizev1.Kustomization{}
+
+	t.Run("denies namespace not in the allowlist", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Expect(k8sClient.Create(context.Background(), inputK)).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(inputK), resultK)
+			return conditions.GetReason(resultK, meta.ReadyCondition) == apiacl.AccessDeniedReason
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.IsFalse(resultK, meta.ReadyCondition)).To(BeTrue())
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).To(Equal(
+			fmt.Sprintf("can't substitute from 'ConfigMap/%[1]s/cluster-vars', the namespace '%[1]s' is not allowed by --allowed-substitution-namespaces",
+				platformNamespace)))
+
+		resultSA := &corev1.ServiceAccount{}
+		err := k8sClient.Get(context.Background(), types.NamespacedName{Name: id, Namespace: id}, resultSA)
+		g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	t.Run("substitutes from allowed namespace", func(t *testing.T) {
+		g := NewWithT(t)
+		reconciler.SubstitutionNamespaces = []string{platformNamespace}
+		defer func() {
+			reconciler.SubstitutionNamespaces = nil
+		}()
+
+		// The denied Kustomization is retried at its interval.
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(inputK), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		resultSA := &corev1.ServiceAccount{}
+		g.Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: id, Namespace: id}, resultSA)).Should(Succeed())
+		g.Expect(resultSA.Labels["cluster"]).To(Equal("prod-1"))
+		g.Expect(resultSA.Labels["zone"]).To(Equal("az-1b"))
+	})
+}
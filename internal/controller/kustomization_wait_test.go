@@ -102,7 +102,7 @@ parameters:
 		Spec: kustomizev1.KustomizationSpec{
 			Interval: metav1.Duration{Duration: 2 * time.Minute},
 			Path:     "./",
-			KubeConfig: &meta.KubeConfigReference{
+			KubeConfig: &kustomizev1.KubeConfigReference{
 				SecretRef: meta.SecretKeyReference{
 					Name: "kubeconfig",
 				},
@@ -143,12 +143,14 @@ parameters:
 				meta.ReconcileRequestAnnotation: reconcileRequestAt,
 			})
 			resultK.Spec.Wait = false
-			resultK.Spec.HealthChecks = []meta.NamespacedObjectKindReference{
+			resultK.Spec.HealthChecks = []kustomizev1.HealthCheck{
 				{
-					APIVersion: "v1",
-					Kind:       "ConfigMap",
-					Name:       "does-not-exists",
-					Namespace:  id,
+					NamespacedObjectKindReference: meta.NamespacedObjectKindReference{
+						APIVersion: "v1",
+						Kind:       "ConfigMap",
+						Name:       "does-not-exists",
+						Namespace:  id,
+					},
 				},
 			}
 			return k8sClient.Update(context.Background(), resultK)
@@ -360,3 +362,116 @@ data: {}
 	g.Expect(msg).
 		To(ContainSubstring("failed to evaluate the CEL expression 'has(data.foo.bar)': no such attribute(s): data.foo.bar"))
 }
+
+func TestKustomizationReconciler_WaitIgnore(t *testing.T) {
+	g := NewWithT(t)
+	id := "wait-" + randStringRunes(5)
+	revision := "v1.0.0"
+	resultK := &kustomizev1.Kustomization{}
+	timeout := 60 * time.Second
+
+	err := createNamespace(id)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+	// The GitRepository never reports an artifact, as there is no source
+	// controller in the test environment.
+	artifact, err := testServer.ArtifactFromFiles([]testserver.File{
+		{
+			Name: "config.yaml",
+			Body: `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data: {}
+`,
+		},
+		{
+			Name: "repository.yaml",
+			Body: `---
+apiVersion: source.toolkit.fluxcd.io/v1
+kind: GitRepository
+metadata:
+  name: third-party
+spec:
+  interval: 1h
+  url: https://example.com/repository
+`,
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repositoryName := types.NamespacedName{
+		Name:      fmt.Sprintf("wait-%s", randStringRunes(5)),
+		Namespace: id,
+	}
+
+	err = applyGitRepository(repositoryName, artifact, revision)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("wait-%s", randStringRunes(5)),
+			Namespace: id,
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./",
+			SourceRef: kustomizev1.CrossNamespaceSourceReference{
+				Name:      repositoryName.Name,
+				Namespace: repositoryName.Namespace,
+				Kind:      sourcev1.GitRepositoryKind,
+			},
+			TargetNamespace: id,
+			Prune:           true,
+			Timeout:         &metav1.Duration{Duration: time.Second},
+			Wait:            true,
+			HealthCheckExprs: []kustomize.CustomHealthCheck{{
+				APIVersion: sourcev1.GroupVersion.String(),
+				Kind:       sourcev1.GitRepositoryKind,
+				HealthCheckExpressions: kustomize.HealthCheckExpressions{
+					Current: "has(status.artifact)",
+				},
+			}},
+		},
+	}
+
+	err = k8sClient.Create(context.Background(), kustomization)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	t.Run("blocks readiness on the custom resource", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return conditions.IsFalse(resultK, meta.ReadyCondition)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		g.Expect(conditions.GetMessage(resultK, meta.ReadyCondition)).
+			To(ContainSubstring(fmt.Sprintf("timeout waiting for: [GitRepository/%s/third-party", id)))
+	})
+
+	t.Run("excludes the custom resource from the health assessment", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Eventually(func() error {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			resultK.Spec.WaitIgnore = []kustomizev1.WaitIgnoreSelector{
+				{Group: sourcev1.GroupVersion.Group, Kind: sourcev1.GitRepositoryKind, Name: "third-party"},
+			}
+			return k8sClient.Update(context.Background(), resultK)
+		}, timeout, time.Second).Should(Succeed())
+
+		g.Eventually(func() bool {
+			_ = k8sClient.Get(context.Background(), client.ObjectKeyFromObject(kustomization), resultK)
+			return isReconcileSuccess(resultK)
+		}, timeout, time.Second).Should(BeTrue())
+		logStatus(t, resultK)
+
+		wantMsg := fmt.Sprintf("excluded by waitIgnore: GitRepository/%s/third-party", id)
+		g.Expect(conditions.IsTrue(resultK, meta.HealthyCondition)).To(BeTrue())
+		g.Expect(conditions.GetMessage(resultK, meta.HealthyCondition)).To(ContainSubstring(wantMsg))
+
+		events := getEvents(resultK.GetName(), map[string]string{"kustomize.toolkit.fluxcd.io/revision": revision})
+		g.Expect(events).To(ContainElement(HaveField("Message", ContainSubstring(wantMsg))))
+	})
+}
@@ -50,6 +50,7 @@ import (
 	sourcev1b2 "github.com/fluxcd/source-controller/api/v1beta2"
 
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
 )
 
 const (
@@ -173,6 +174,10 @@ func TestMain(m *testing.M) {
 		// for inspection.
 		kstatusInProgressCheck = kcheck.NewInProgressChecker(testEnv.Client)
 		kstatusInProgressCheck.DisableFetch = true
+		gnuPGHomeDir, err := os.MkdirTemp("", "gnupg")
+		if err != nil {
+			panic(fmt.Sprintf("Failed to create GnuPG home directory: %v", err))
+		}
 		reconciler = &KustomizationReconciler{
 			ControllerName:          controllerName,
 			Client:                  testEnv,
@@ -182,6 +187,8 @@ func TestMain(m *testing.M) {
 			Metrics:                 testMetricsH,
 			ConcurrentSSA:           4,
 			DisallowedFieldManagers: []string{overrideManagerName},
+			GnuPGHomeDir:            gnuPGHomeDir,
+			SOPSMaxFileSize:         decryptor.DefaultMaxEncryptedFileSize,
 		}
 		if err := (reconciler).SetupWithManager(ctx, testEnv, KustomizationReconcilerOptions{
 			DependencyRequeueInterval: 2 * time.Second,
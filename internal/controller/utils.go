@@ -20,8 +20,16 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/fluxcd/cli-utils/pkg/object"
+	generator "github.com/fluxcd/pkg/kustomize"
 	"github.com/fluxcd/pkg/ssa"
+	ssautil "github.com/fluxcd/pkg/ssa/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/resource"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
 )
 
 // MkdirTempAbs creates a tmp dir and returns the absolute path to the dir.
@@ -51,3 +59,80 @@ func HasChanged(action ssa.Action) bool {
 		return true
 	}
 }
+
+// checkComponentPaths returns an error if any of the given component paths,
+// relative to dirPath, is not local, or resolves to a path outside of root.
+// Symlinks are resolved when building the kustomization, which is confined to
+// root as well.
+func checkComponentPaths(root, dirPath string, components []string) error {
+	for _, component := range components {
+		if !generator.IsLocalRelativePath(component) {
+			return fmt.Errorf("component path '%s' must be local and relative", component)
+		}
+		rel, err := filepath.Rel(root, filepath.Join(dirPath, component))
+		if err != nil || escapesRoot(rel) {
+			return fmt.Errorf("component path '%s' must not point outside of the artifact", component)
+		}
+	}
+	return nil
+}
+
+// setCommonMetadata sets the labels and annotations of the given common
+// metadata on the resource, overriding the ones with the same keys. Unlike
+// the Kustomize commonLabels, the labels are set on the metadata of the
+// resource only, and not on its selectors or templates.
+func setCommonMetadata(res *resource.Resource, cmeta *kustomizev1.CommonMetadata) error {
+	if len(cmeta.Labels) > 0 {
+		labels := res.GetLabels()
+		for k, v := range cmeta.Labels {
+			labels[k] = v
+		}
+		if err := res.SetLabels(labels); err != nil {
+			return err
+		}
+	}
+	if len(cmeta.Annotations) > 0 {
+		annotations := res.GetAnnotations()
+		for k, v := range cmeta.Annotations {
+			annotations[k] = v
+		}
+		if err := res.SetAnnotations(annotations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isTargetNamespace returns if the resource is the Namespace with the given
+// target namespace name.
+func isTargetNamespace(res *resource.Resource, targetNamespace string) bool {
+	return targetNamespace != "" &&
+		res.GetApiVersion() == "v1" &&
+		res.GetKind() == "Namespace" &&
+		res.GetName() == targetNamespace
+}
+
+// escapesRoot returns if the given path, relative to a root directory,
+// points outside of it.
+func escapesRoot(path string) bool {
+	path = filepath.Join(".", path)
+	return path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator))
+}
+
+// appendBuiltObjects appends the objects built from the given path to the
+// objects built from the previous paths of a Kustomization, and records the
+// path of each object in builtFrom. It returns an error if an object has
+// been built from a previous path already, instead of applying either of
+// them.
+func appendBuiltObjects(objects []*unstructured.Unstructured, builtFrom map[object.ObjMetadata]string,
+	path string, built []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	for _, u := range built {
+		id := object.UnstructuredToObjMetadata(u)
+		if from, ok := builtFrom[id]; ok {
+			return nil, fmt.Errorf("%s is built from both path '%s' and path '%s'",
+				ssautil.FmtObjMetadata(id), from, path)
+		}
+		builtFrom[id] = path
+	}
+	return append(objects, built...), nil
+}
@@ -19,35 +19,78 @@ package decryptor
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"math/big"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
 	extage "filippo.io/age"
+	extagearmor "filippo.io/age/armor"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
 	"github.com/getsops/sops/v3"
 	"github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/azkv"
+	"github.com/getsops/sops/v3/cmd/sops/common"
 	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/hcvault"
+	"github.com/getsops/sops/v3/keys"
+	"github.com/getsops/sops/v3/keyservice"
+	awskms "github.com/getsops/sops/v3/kms"
+	"github.com/getsops/sops/v3/pgp"
+	"github.com/getsops/sops/v3/shamir"
 	. "github.com/onsi/gomega"
 	gt "github.com/onsi/gomega/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 	"sigs.k8s.io/kustomize/api/konfig"
 	"sigs.k8s.io/kustomize/api/provider"
 	"sigs.k8s.io/kustomize/api/resource"
 	kustypes "sigs.k8s.io/kustomize/api/types"
 	"sigs.k8s.io/yaml"
 
+	apiacl "github.com/fluxcd/pkg/apis/acl"
 	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/acl"
 
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	intage "github.com/fluxcd/kustomize-controller/internal/sops/age"
+	intawskms "github.com/fluxcd/kustomize-controller/internal/sops/awskms"
+	intazkv "github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+	inthcvault "github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
+	intkeyservice "github.com/fluxcd/kustomize-controller/internal/sops/keyservice"
+	intpgp "github.com/fluxcd/kustomize-controller/internal/sops/pgp"
 )
 
 func TestIsEncryptedSecret(t *testing.T) {
@@ -80,11 +123,14 @@ func TestDecryptor_ImportKeys(t *testing.T) {
 	g.Expect(err).ToNot(HaveOccurred())
 	ageKey, err := os.ReadFile("testdata/age.txt")
 	g.Expect(err).ToNot(HaveOccurred())
+	azureClientCert, err := os.ReadFile("testdata/azure-client-cert.pfx")
+	g.Expect(err).ToNot(HaveOccurred())
 
 	tests := []struct {
 		name        string
 		decryption  *kustomizev1.Decryption
 		secret      *corev1.Secret
+		env         map[string]string
 		wantErr     bool
 		inspectFunc func(g *GomegaWithT, decryptor *Decryptor)
 	}{
@@ -92,7 +138,7 @@ func TestDecryptor_ImportKeys(t *testing.T) {
 			name: "PGP key",
 			decryption: &kustomizev1.Decryption{
 				Provider: provider,
-				SecretRef: &meta.LocalObjectReference{
+				SecretRef: &meta.NamespacedObjectReference{
 					Name: "pgp-secret",
 				},
 			},
@@ -110,7 +156,7 @@ func TestDecryptor_ImportKeys(t *testing.T) {
 			name: "PGP key import error",
 			decryption: &kustomizev1.Decryption{
 				Provider: provider,
-				SecretRef: &meta.LocalObjectReference{
+				SecretRef: &meta.NamespacedObjectReference{
 					Name: "pgp-secret",
 				},
 			},
@@ -129,7 +175,7 @@ func TestDecryptor_ImportKeys(t *testing.T) {
 			name: "age key",
 			decryption: &kustomizev1.Decryption{
 				Provider: provider,
-				SecretRef: &meta.LocalObjectReference{
+				SecretRef: &meta.NamespacedObjectReference{
 					Name: "age-secret",
 				},
 			},
@@ -150,7 +196,7 @@ func TestDecryptor_ImportKeys(t *testing.T) {
 			name: "age key import error",
 			decryption: &kustomizev1.Decryption{
 				Provider: provider,
-				SecretRef: &meta.LocalObjectReference{
+				SecretRef: &meta.NamespacedObjectReference{
 					Name: "age-secret",
 				},
 			},
@@ -172,7 +218,7 @@ func TestDecryptor_ImportKeys(t *testing.T) {
 			name: "HC Vault token",
 			decryption: &kustomizev1.Decryption{
 				Provider: provider,
-				SecretRef: &meta.LocalObjectReference{
+				SecretRef: &meta.NamespacedObjectReference{
 					Name: "hcvault-secret",
 				},
 			},
@@ -193,7 +239,7 @@ func TestDecryptor_ImportKeys(t *testing.T) {
 			name: "AWS KMS credentials",
 			decryption: &kustomizev1.Decryption{
 				Provider: provider,
-				SecretRef: &meta.LocalObjectReference{
+				SecretRef: &meta.NamespacedObjectReference{
 					Name: "awskms-secret",
 				},
 			},
@@ -213,304 +259,3409 @@ aws_session_token: test-token`),
 			},
 		},
 		{
-			name: "GCP Service Account key",
+			name: "AWS KMS web identity role",
 			decryption: &kustomizev1.Decryption{
 				Provider: provider,
-				SecretRef: &meta.LocalObjectReference{
-					Name: "gcpkms-secret",
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "awskms-secret",
 				},
 			},
 			secret: &corev1.Secret{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "gcpkms-secret",
+					Name:      "awskms-secret",
 					Namespace: provider,
 				},
 				Data: map[string][]byte{
-					DecryptionGCPCredsFile: []byte(`{ "client_id": "<client-id>.apps.googleusercontent.com",
-					"client_secret": "<secret>",
-				   "type": "authorized_user"}`),
+					DecryptionAWSKmsFile: []byte(`role_arn: arn:aws:iam::123456789012:role/sops
+web_identity_token_file: /var/run/secrets/eks.amazonaws.com/serviceaccount/token`),
 				},
 			},
 			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
-				g.Expect(decryptor.gcpCredsJSON).ToNot(BeNil())
+				g.Expect(decryptor.awsCredsProvider).ToNot(BeNil())
 			},
 		},
 		{
-			name: "Azure Key Vault token",
+			name: "AWS KMS credentials file with profile",
 			decryption: &kustomizev1.Decryption{
 				Provider: provider,
-				SecretRef: &meta.LocalObjectReference{
-					Name: "azkv-secret",
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "awskms-secret",
 				},
 			},
 			secret: &corev1.Secret{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "azkv-secret",
+					Name:      "awskms-secret",
 					Namespace: provider,
 				},
 				Data: map[string][]byte{
-					DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
-clientId: some-client-id
-clientSecret: some-client-secret`),
+					DecryptionAWSKmsFile: []byte(`profile: production
+credentials: |
+  [default]
+  aws_access_key_id = default-id
+  aws_secret_access_key = default-secret
+
+  [production]
+  aws_access_key_id = production-id
+  aws_secret_access_key = production-secret
+  aws_session_token = production-token`),
 				},
 			},
 			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
-				g.Expect(decryptor.azureToken).ToNot(BeNil())
+				g.Expect(decryptor.awsCredsProvider).ToNot(BeNil())
+				creds, err := decryptor.awsCredsProvider.Retrieve(context.TODO())
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(creds.AccessKeyID).To(Equal("production-id"))
+				g.Expect(creds.SessionToken).To(Equal("production-token"))
 			},
 		},
 		{
-			name: "Azure Key Vault token load config error",
+			name: "AWS KMS credentials file with missing profile",
 			decryption: &kustomizev1.Decryption{
 				Provider: provider,
-				SecretRef: &meta.LocalObjectReference{
-					Name: "azkv-secret",
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "awskms-secret",
 				},
 			},
 			secret: &corev1.Secret{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "azkv-secret",
+					Name:      "awskms-secret",
 					Namespace: provider,
 				},
 				Data: map[string][]byte{
-					DecryptionAzureAuthFile: []byte(`{"malformed\: JSON"}`),
+					DecryptionAWSKmsFile: []byte(`profile: staging
+credentials: |
+  [default]
+  aws_access_key_id = default-id
+  aws_secret_access_key = default-secret`),
 				},
 			},
 			wantErr: true,
 			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
-				g.Expect(decryptor.azureToken).To(BeNil())
+				g.Expect(decryptor.awsCredsProvider).To(BeNil())
 			},
 		},
 		{
-			name: "Azure Key Vault unsupported config",
+			name: "AWS KMS cross-account role",
 			decryption: &kustomizev1.Decryption{
 				Provider: provider,
-				SecretRef: &meta.LocalObjectReference{
-					Name: "azkv-secret",
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "awskms-secret",
 				},
 			},
 			secret: &corev1.Secret{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "azkv-secret",
+					Name:      "awskms-secret",
 					Namespace: provider,
 				},
 				Data: map[string][]byte{
-					DecryptionAzureAuthFile: []byte(`tenantId: incomplete`),
+					DecryptionAWSKmsFile: []byte(`aws_access_key_id: test-id
+aws_secret_access_key: test-secret
+aws_role_arn: arn:aws:iam::123456789012:role/central
+aws_external_id: some-external-id`),
 				},
 			},
-			wantErr: true,
 			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
-				g.Expect(decryptor.azureToken).To(BeNil())
+				g.Expect(decryptor.awsCredsProvider).ToNot(BeNil())
+				g.Expect(decryptor.awsIgnoreKeyRole).To(BeTrue())
 			},
 		},
 		{
-			name: "multiple Secret data entries",
+			name: "AWS KMS endpoints",
 			decryption: &kustomizev1.Decryption{
 				Provider: provider,
-				SecretRef: &meta.LocalObjectReference{
-					Name: "multiple-secret",
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "awskms-secret",
 				},
 			},
 			secret: &corev1.Secret{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "multiple-secret",
+					Name:      "awskms-secret",
 					Namespace: provider,
 				},
 				Data: map[string][]byte{
-					"age" + DecryptionAgeExt:     ageKey,
-					DecryptionVaultTokenFileName: []byte("some-hcvault-token"),
+					DecryptionAWSKmsFile: []byte(`aws_access_key_id: test-id
+aws_secret_access_key: test-secret
+aws_endpoint_kms: https://kms-fips.us-gov-west-1.amazonaws.com
+aws_endpoint_sts: https://sts.us-gov-west-1.amazonaws.com`),
 				},
 			},
 			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
-				g.Expect(decryptor.vaultToken).ToNot(BeEmpty())
-				g.Expect(decryptor.ageIdentities).To(HaveLen(1))
+				g.Expect(decryptor.awsKMSEndpoint).To(Equal("https://kms-fips.us-gov-west-1.amazonaws.com"))
+				g.Expect(decryptor.awsSTSEndpoint).To(Equal("https://sts.us-gov-west-1.amazonaws.com"))
 			},
 		},
 		{
-			name:       "no Decryption spec",
-			decryption: nil,
-			wantErr:    false,
+			name: "AWS KMS region",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "awskms-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "awskms-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAWSKmsFile: []byte(`aws_access_key_id: test-id
+aws_secret_access_key: test-secret
+aws_region: eu-west-1
+aws_replica_regions:
+  - us-west-2
+  - ap-southeast-2`),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.awsRegion).To(Equal("eu-west-1"))
+				g.Expect(decryptor.awsReplicaRegions).To(Equal([]string{"us-west-2", "ap-southeast-2"}))
+			},
 		},
 		{
-			name: "no Decryption Secret",
+			name: "AWS KMS required context",
 			decryption: &kustomizev1.Decryption{
-				Provider: DecryptionProviderSOPS,
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "awskms-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "awskms-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAWSKmsFile: []byte(`aws_access_key_id: test-id
+aws_secret_access_key: test-secret
+aws_required_context:
+  tenant: team-a`),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.awsRequiredContext).To(Equal(map[string]string{"tenant": "team-a"}))
 			},
-			wantErr: false,
 		},
 		{
-			name: "non-existing Decryption Secret",
+			name: "AWS KMS proxy",
 			decryption: &kustomizev1.Decryption{
-				Provider: DecryptionProviderSOPS,
-				SecretRef: &meta.LocalObjectReference{
-					Name: "does-not-exist",
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "awskms-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "awskms-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAWSKmsFile: []byte(`aws_access_key_id: test-id
+aws_secret_access_key: test-secret
+aws_proxy_url: http://proxy.example.com:3128`),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.awsProxyURL).To(Equal("http://proxy.example.com:3128"))
+			},
+		},
+		{
+			name: "AWS KMS invalid proxy",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "awskms-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "awskms-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAWSKmsFile: []byte(`aws_access_key_id: test-id
+aws_secret_access_key: test-secret
+aws_proxy_url: proxy.example.com:3128`),
 				},
 			},
 			wantErr: true,
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.awsProxyURL).To(BeEmpty())
+			},
 		},
 		{
-			name: "unimplemented Decryption Provider",
+			name: "AWS KMS invalid endpoint",
 			decryption: &kustomizev1.Decryption{
-				Provider: "not-supported",
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "awskms-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "awskms-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAWSKmsFile: []byte(`aws_access_key_id: test-id
+aws_secret_access_key: test-secret
+aws_endpoint_kms: kms-fips.us-gov-west-1.amazonaws.com`),
+				},
+			},
+			wantErr: true,
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.awsCredsProvider).To(BeNil())
+				g.Expect(decryptor.awsKMSEndpoint).To(BeEmpty())
 			},
-			wantErr: false,
 		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			g := NewWithT(t)
-
-			cb := fake.NewClientBuilder()
-			if tt.secret != nil {
-				cb.WithObjects(tt.secret)
-			}
-			kustomization := kustomizev1.Kustomization{
+		{
+			name: "AWS KMS web identity role without token file",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "awskms-secret",
+				},
+			},
+			secret: &corev1.Secret{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      provider + "-" + tt.name,
+					Name:      "awskms-secret",
 					Namespace: provider,
 				},
-				Spec: kustomizev1.KustomizationSpec{
-					Interval:   metav1.Duration{Duration: 2 * time.Minute},
-					Path:       "./",
-					Decryption: tt.decryption,
+				Data: map[string][]byte{
+					DecryptionAWSKmsFile: []byte(`role_arn: arn:aws:iam::123456789012:role/sops`),
 				},
-			}
-
-			d, cleanup, err := NewTempDecryptor("", cb.Build(), &kustomization)
-			g.Expect(err).ToNot(HaveOccurred())
-			t.Cleanup(cleanup)
-
-			match := Succeed()
-			if tt.wantErr {
-				match = HaveOccurred()
-			}
-			g.Expect(d.ImportKeys(context.TODO())).To(match)
-
-			if tt.inspectFunc != nil {
-				tt.inspectFunc(g, d)
-			}
-		})
-	}
-}
-
-func TestDecryptor_SopsDecryptWithFormat(t *testing.T) {
-	t.Run("decrypt INI to INI", func(t *testing.T) {
-		g := NewWithT(t)
-
-		ageID, err := extage.GenerateX25519Identity()
-		g.Expect(err).ToNot(HaveOccurred())
-
-		kd := &Decryptor{
-			checkSopsMac:  true,
-			ageIdentities: age.ParsedIdentities{ageID},
-		}
-
-		format := formats.Ini
-		data := []byte("[config]\nkey = value\n")
-		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
-			KeyGroups: []sops.KeyGroup{
-				{&age.MasterKey{Recipient: ageID.Recipient().String()}},
 			},
-		}, data, format, format)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
-		g.Expect(encData).ToNot(Equal(data))
-
-		out, err := kd.SopsDecryptWithFormat(encData, format, format)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(out).To(Equal(data))
-	})
+			env: map[string]string{
+				"AWS_WEB_IDENTITY_TOKEN_FILE": "",
+			},
+			wantErr: true,
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.awsCredsProvider).To(BeNil())
+			},
+		},
+		{
+			name: "GCP Service Account key",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "gcpkms-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "gcpkms-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionGCPCredsFile: []byte(`{ "client_id": "<client-id>.apps.googleusercontent.com",
+					"client_secret": "<secret>",
+				   "type": "authorized_user"}`),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.gcpCredsJSON).ToNot(BeNil())
+			},
+		},
+		{
+			name: "GCP Service Account key base64-encoded",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "gcpkms-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "gcpkms-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionGCPCredsFile: []byte(base64.StdEncoding.EncodeToString([]byte(`{"type": "service_account", "project_id": "test-flux"}`)) + "\n"),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(string(decryptor.gcpCredsJSON)).To(Equal(`{"type": "service_account", "project_id": "test-flux"}`))
+			},
+		},
+		{
+			name: "GCP Service Account key without project ID",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "gcpkms-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "gcpkms-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionGCPCredsFile: []byte(`{"type": "service_account"}`),
+				},
+			},
+			wantErr: true,
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.gcpCredsJSON).To(BeNil())
+			},
+		},
+		{
+			name: "Azure Key Vault token",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "azkv-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azkv-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
+clientId: some-client-id
+clientSecret: some-client-secret`),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.azureToken).ToNot(BeNil())
+			},
+		},
+		{
+			name: "Azure Key Vault token with vault DNS suffix",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "azkv-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azkv-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
+clientId: some-client-id
+clientSecret: some-client-secret
+vaultDnsSuffix: privatelink.vaultcore.azure.net`),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.azureToken).ToNot(BeNil())
+				g.Expect(decryptor.azureVaultDNSSuffixes).To(Equal([]string{"privatelink.vaultcore.azure.net"}))
+			},
+		},
+		{
+			name: "Azure Key Vault token with latest key version fallback",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "azkv-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azkv-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
+clientId: some-client-id
+clientSecret: some-client-secret
+latestKeyVersionFallback: true`),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.azureToken).ToNot(BeNil())
+				g.Expect(decryptor.azureLatestKeyVersionFallback).To(BeTrue())
+			},
+		},
+		{
+			name: "Azure Key Vault Workload Identity token",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "azkv-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azkv-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
+clientId: some-client-id`),
+				},
+			},
+			env: map[string]string{
+				"AZURE_FEDERATED_TOKEN_FILE": "/var/run/secrets/azure/tokens/azure-identity-token",
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.azureToken).ToNot(BeNil())
+			},
+		},
+		{
+			name: "Azure Key Vault token with dedicated client certificate keys",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "azkv-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azkv-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
+clientId: some-client-id`),
+					DecryptionAzureClientCertPFXFile:      azureClientCert,
+					DecryptionAzureClientCertPasswordFile: []byte("password\n"),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.azureToken).To(BeAssignableToTypeOf(&intazkv.TokenCredential{}))
+				token := decryptor.azureToken.(*intazkv.TokenCredential)
+				g.Expect(token.TokenCredential).To(BeAssignableToTypeOf(&azidentity.ClientCertificateCredential{}))
+				g.Expect(token.String()).To(Equal("azure client-certificate credential for tenant some-tenant-id, client some-client-id"))
+			},
+		},
+		{
+			name: "Azure Key Vault token with invalid client certificate password",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "azkv-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azkv-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
+clientId: some-client-id`),
+					DecryptionAzureClientCertPFXFile:      azureClientCert,
+					DecryptionAzureClientCertPasswordFile: []byte("invalid"),
+				},
+			},
+			wantErr: true,
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.azureToken).To(BeNil())
+			},
+		},
+		{
+			name: "Azure Key Vault token with PEM and PFX client certificate keys",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "azkv-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azkv-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
+clientId: some-client-id`),
+					DecryptionAzureClientCertPEMFile: []byte("some-pem"),
+					DecryptionAzureClientCertPFXFile: azureClientCert,
+				},
+			},
+			wantErr: true,
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.azureToken).To(BeNil())
+			},
+		},
+		{
+			name: "Azure Key Vault token load config error",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "azkv-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azkv-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAzureAuthFile: []byte(`{"malformed\: JSON"}`),
+				},
+			},
+			wantErr: true,
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.azureToken).To(BeNil())
+			},
+		},
+		{
+			name: "Azure Key Vault unsupported config",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "azkv-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azkv-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					DecryptionAzureAuthFile: []byte(`tenantId: incomplete`),
+				},
+			},
+			wantErr: true,
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.azureToken).To(BeNil())
+			},
+		},
+		{
+			name: "multiple Secret data entries",
+			decryption: &kustomizev1.Decryption{
+				Provider: provider,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "multiple-secret",
+				},
+			},
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "multiple-secret",
+					Namespace: provider,
+				},
+				Data: map[string][]byte{
+					"age" + DecryptionAgeExt:     ageKey,
+					DecryptionVaultTokenFileName: []byte("some-hcvault-token"),
+				},
+			},
+			inspectFunc: func(g *GomegaWithT, decryptor *Decryptor) {
+				g.Expect(decryptor.vaultToken).ToNot(BeEmpty())
+				g.Expect(decryptor.ageIdentities).To(HaveLen(1))
+			},
+		},
+		{
+			name:       "no Decryption spec",
+			decryption: nil,
+			wantErr:    false,
+		},
+		{
+			name: "no Decryption Secret",
+			decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+			},
+			wantErr: false,
+		},
+		{
+			name: "non-existing Decryption Secret",
+			decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: "does-not-exist",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unimplemented Decryption Provider",
+			decryption: &kustomizev1.Decryption{
+				Provider: "not-supported",
+			},
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			cb := fake.NewClientBuilder()
+			if tt.secret != nil {
+				cb.WithObjects(tt.secret)
+			}
+			kustomization := kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      provider + "-" + tt.name,
+					Namespace: provider,
+				},
+				Spec: kustomizev1.KustomizationSpec{
+					Interval:   metav1.Duration{Duration: 2 * time.Minute},
+					Path:       "./",
+					Decryption: tt.decryption,
+				},
+			}
+
+			d, cleanup, err := NewTempDecryptor("", cb.Build(), &kustomization)
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+
+			match := Succeed()
+			if tt.wantErr {
+				match = HaveOccurred()
+			}
+			g.Expect(d.ImportKeys(context.TODO())).To(match)
+
+			if tt.inspectFunc != nil {
+				tt.inspectFunc(g, d)
+			}
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_InvalidKeyFormat(t *testing.T) {
+	pgpKey, err := os.ReadFile("testdata/pgp.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageKey, err := os.ReadFile("testdata/age.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		ageRecipient = "age1l44xcng8dqj32nlv6d930qvvrny05hglzcv9qpc7kxjc6902ma4qufys29"
+		pgpPublicKey = "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nabc\n-----END PGP PUBLIC KEY BLOCK-----\n"
+	)
+	ageIdentity := strings.TrimSpace(string(ageKey[bytes.Index(ageKey, []byte("AGE-SECRET-KEY-1")):]))
+
+	tests := []struct {
+		name    string
+		key     string
+		value   []byte
+		wantErr string
+	}{
+		{
+			name:    "age recipient",
+			key:     "identity" + DecryptionAgeExt,
+			value:   []byte(ageRecipient + "\n"),
+			wantErr: "key 'identity.agekey' contains an age recipient (public key) on line 1, expected an identity starting with AGE-SECRET-KEY-1",
+		},
+		{
+			name:    "age recipient after identity",
+			key:     "identity" + DecryptionAgeExt,
+			value:   append(append([]byte{}, ageKey...), ageRecipient+"\n"...),
+			wantErr: "key 'identity.agekey' contains an age recipient (public key) on line 4",
+		},
+		{
+			name:    "truncated age identity",
+			key:     "identity" + DecryptionAgeExt,
+			value:   []byte(ageIdentity[:len(ageIdentity)-8]),
+			wantErr: "key 'identity.agekey' contains a truncated or malformed age identity (invalid Bech32 string) on line 1",
+		},
+		{
+			name:    "PGP key as age identity",
+			key:     "identity" + DecryptionAgeExt,
+			value:   pgpKey,
+			wantErr: "key 'identity.agekey' contains an armored PGP key on line 1",
+		},
+		{
+			name:    "SSH public key",
+			key:     "id" + DecryptionAgeSSHExt,
+			value:   []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKH2Q6cjpV4Lo8CcUt9FanZKcYf7U3HEMQO5nI6vL0 flux\n"),
+			wantErr: "key 'id.ssh' contains an SSH public key on line 1",
+		},
+		{
+			name:    "PGP public key",
+			key:     "pgp" + DecryptionPGPExt,
+			value:   []byte(pgpPublicKey),
+			wantErr: "key 'pgp.asc' contains a PGP public key block only, expected an ASCII-armored or binary PGP private key",
+		},
+		{
+			name:    "truncated PGP private key",
+			key:     "pgp" + DecryptionPGPExt,
+			value:   pgpKey[:len(pgpKey)/2],
+			wantErr: "key 'pgp.asc' contains a truncated or malformed PGP private key block",
+		},
+		{
+			name:    "age identity as PGP key",
+			key:     "pgp" + DecryptionPGPExt,
+			value:   ageKey,
+			wantErr: "key 'pgp.asc' contains an age identity, expected an ASCII-armored or binary PGP private key",
+		},
+		{
+			name:    "empty PGP key",
+			key:     "pgp" + DecryptionPGPExt,
+			value:   []byte("\n"),
+			wantErr: "key 'pgp.asc' contains no data",
+		},
+		{
+			name:    "age identity with wrong suffix",
+			key:     "identity.txt",
+			value:   ageKey,
+			wantErr: "key 'identity.txt' contains an age identity, expected the '.agekey' extension",
+		},
+		{
+			name:    "PGP private key with wrong suffix",
+			key:     "private.key",
+			value:   pgpKey,
+			wantErr: "key 'private.key' contains a PGP private key, expected the '.asc' extension",
+		},
+		{
+			name:    "OpenSSH private key without suffix",
+			key:     "id_ed25519",
+			value:   newTestSSHKeyPEM(t, nil),
+			wantErr: "key 'id_ed25519' contains an OpenSSH private key, expected the '.ssh' extension",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "sops-keys", Namespace: "default"},
+				Data:       map[string][]byte{tt.key: bytes.Clone(tt.value)},
+			}
+			kustomization := kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Spec: kustomizev1.KustomizationSpec{
+					Interval: metav1.Duration{Duration: 2 * time.Minute},
+					Path:     "./",
+					Decryption: &kustomizev1.Decryption{
+						Provider:  DecryptionProviderSOPS,
+						SecretRef: &meta.NamespacedObjectReference{Name: secret.Name},
+					},
+				},
+			}
+			d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().WithObjects(secret).Build(), &kustomization)
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+
+			err = d.ImportKeys(context.TODO())
+			g.Expect(err).To(MatchError(ContainSubstring("invalid sops decryption Secret 'default/sops-keys': " + tt.wantErr)))
+			var decErr *DecryptionError
+			g.Expect(errors.As(err, &decErr)).To(BeTrue())
+			g.Expect(decErr.Reason).To(Equal(kustomizev1.InvalidDecryptionSecretReason))
+			// The key material must not be disclosed in the condition message.
+			g.Expect(err.Error()).ToNot(ContainSubstring(ageIdentity[16:]))
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_CrossNamespaceSecret(t *testing.T) {
+	ageKey, err := os.ReadFile("testdata/age.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		allow          bool
+		secretRef      *meta.NamespacedObjectReference
+		wantAccessDeny bool
+		wantIdentities int
+	}{
+		{
+			name:           "Secret in same namespace",
+			secretRef:      &meta.NamespacedObjectReference{Name: "sops-age", Namespace: "tenant"},
+			wantIdentities: 1,
+		},
+		{
+			name:           "Secret in other namespace denied",
+			secretRef:      &meta.NamespacedObjectReference{Name: "sops-age", Namespace: "flux-system"},
+			wantAccessDeny: true,
+		},
+		{
+			name:           "Secret in other namespace allowed",
+			allow:          true,
+			secretRef:      &meta.NamespacedObjectReference{Name: "sops-age", Namespace: "flux-system"},
+			wantIdentities: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var secrets []client.Object
+			for _, ns := range []string{"tenant", "flux-system"} {
+				secrets = append(secrets, &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "sops-age", Namespace: ns},
+					Data:       map[string][]byte{"age" + DecryptionAgeExt: ageKey},
+				})
+			}
+			kustomization := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "tenant"},
+				Spec: kustomizev1.KustomizationSpec{
+					Decryption: &kustomizev1.Decryption{
+						Provider:  DecryptionProviderSOPS,
+						SecretRef: tt.secretRef,
+					},
+				},
+			}
+
+			d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().WithObjects(secrets...).Build(), kustomization,
+				WithCrossNamespaceSecret(tt.allow))
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+
+			err = d.ImportKeys(context.TODO())
+			if tt.wantAccessDeny {
+				var decErr *DecryptionError
+				g.Expect(errors.As(err, &decErr)).To(BeTrue())
+				g.Expect(decErr.Reason).To(Equal(apiacl.AccessDeniedReason))
+				g.Expect(acl.IsAccessDenied(decErr.Err)).To(BeTrue())
+				g.Expect(err.Error()).To(ContainSubstring("'flux-system/sops-age'"))
+				g.Expect(err.Error()).To(ContainSubstring("--allow-cross-namespace-decryption-secret=false"))
+				g.Expect(d.ageIdentities).To(BeEmpty())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(d.ageIdentities).To(HaveLen(tt.wantIdentities))
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_DefaultSecret(t *testing.T) {
+	ageKey, err := os.ReadFile("testdata/age.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		defaultRef     *meta.NamespacedObjectReference
+		secretRef      *meta.NamespacedObjectReference
+		provider       string
+		wantNotFound   bool
+		wantIdentities int
+	}{
+		{
+			name:           "default Secret in controller namespace",
+			defaultRef:     &meta.NamespacedObjectReference{Name: "sops-age", Namespace: "flux-system"},
+			wantIdentities: 1,
+		},
+		{
+			name:           "default Secret in Kustomization namespace",
+			defaultRef:     &meta.NamespacedObjectReference{Name: "sops-age"},
+			wantIdentities: 1,
+		},
+		{
+			name:           "secretRef overrides default Secret",
+			defaultRef:     &meta.NamespacedObjectReference{Name: "missing", Namespace: "flux-system"},
+			secretRef:      &meta.NamespacedObjectReference{Name: "sops-age"},
+			wantIdentities: 1,
+		},
+		{
+			name:         "missing secretRef Secret with default Secret",
+			defaultRef:   &meta.NamespacedObjectReference{Name: "sops-age", Namespace: "flux-system"},
+			secretRef:    &meta.NamespacedObjectReference{Name: "missing"},
+			wantNotFound: true,
+		},
+		{
+			name:       "missing default Secret",
+			defaultRef: &meta.NamespacedObjectReference{Name: "missing", Namespace: "flux-system"},
+		},
+		{
+			name:       "default Secret with other provider",
+			defaultRef: &meta.NamespacedObjectReference{Name: "sops-age", Namespace: "flux-system"},
+			provider:   "other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var secrets []client.Object
+			for _, ns := range []string{"tenant", "flux-system"} {
+				secrets = append(secrets, &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "sops-age", Namespace: ns},
+					Data:       map[string][]byte{"age" + DecryptionAgeExt: ageKey},
+				})
+			}
+			provider := DecryptionProviderSOPS
+			if tt.provider != "" {
+				provider = tt.provider
+			}
+			kustomization := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "tenant"},
+				Spec: kustomizev1.KustomizationSpec{
+					Decryption: &kustomizev1.Decryption{
+						Provider:  provider,
+						SecretRef: tt.secretRef,
+					},
+				},
+			}
+
+			// The default Secret is not subject to the cross-namespace policy.
+			d, cleanup, err := NewTempDecryptor("", fake.NewClientBuilder().WithObjects(secrets...).Build(), kustomization,
+				WithCrossNamespaceSecret(false), WithDefaultSecret(tt.defaultRef))
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+
+			err = d.ImportKeys(context.TODO())
+			if tt.wantNotFound {
+				g.Expect(apierrors.IsNotFound(err)).To(BeTrue())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(d.ageIdentities).To(HaveLen(tt.wantIdentities))
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_AgeKeyFiles(t *testing.T) {
+	g := NewWithT(t)
+
+	ageKey, err := os.ReadFile("testdata/age.txt")
+	g.Expect(err).ToNot(HaveOccurred())
+	secretIDs, err := intage.ParseIdentities(ageKey, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	secretID := secretIDs[0].(*extage.X25519Identity)
+	fileID, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+	rotatedID, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys.txt")
+	g.Expect(os.WriteFile(keyFile, []byte(fileID.String()+"\n"), 0o600)).To(Succeed())
+	files := []*intage.IdentityFile{
+		intage.NewIdentityFile(filepath.Join(dir, "missing.txt")),
+		intage.NewIdentityFile(keyFile),
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sops-age", Namespace: "tenant"},
+		Data:       map[string][]byte{"age" + DecryptionAgeExt: ageKey},
+	}
+	c := fake.NewClientBuilder().WithObjects(secret).Build()
+
+	recipients := func(secretRef *meta.NamespacedObjectReference, provider string) []string {
+		kustomization := &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "tenant"},
+			Spec: kustomizev1.KustomizationSpec{
+				Decryption: &kustomizev1.Decryption{
+					Provider:  provider,
+					SecretRef: secretRef,
+				},
+			},
+		}
+		d, cleanup, err := NewTempDecryptor("", c, kustomization, WithAgeKeyFiles(files))
+		g.Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+		g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+
+		var got []string
+		for _, id := range d.ageIdentities {
+			got = append(got, id.(*extage.X25519Identity).Recipient().String())
+		}
+		return got
+	}
+
+	// The identities of the Secret take precedence over the ones of the files.
+	g.Expect(recipients(&meta.NamespacedObjectReference{Name: "sops-age"}, DecryptionProviderSOPS)).To(Equal([]string{
+		secretID.Recipient().String(),
+		fileID.Recipient().String(),
+	}))
+	g.Expect(recipients(nil, DecryptionProviderSOPS)).To(Equal([]string{fileID.Recipient().String()}))
+	g.Expect(recipients(nil, "other")).To(BeEmpty())
+
+	// The rotated file is read again by the next Decryptor.
+	g.Expect(os.WriteFile(keyFile, []byte("# rotated\n"+rotatedID.String()+"\n"), 0o600)).To(Succeed())
+	g.Expect(recipients(nil, DecryptionProviderSOPS)).To(Equal([]string{rotatedID.Recipient().String()}))
+}
+
+func TestDecryptor_ImportKeys_WipesSecretData(t *testing.T) {
+	g := NewWithT(t)
+
+	ageKey, err := os.ReadFile("testdata/age.txt")
+	g.Expect(err).ToNot(HaveOccurred())
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sops-age", Namespace: "tenant"},
+		Data: map[string][]byte{
+			"age" + DecryptionAgeExt:     ageKey,
+			DecryptionVaultTokenFileName: []byte("hvs.token"),
+		},
+	}
+
+	// Record the copy of the Secret used by the Decryptor.
+	var got *corev1.Secret
+	c := interceptor.NewClient(fake.NewClientBuilder().WithObjects(secret).Build(), interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			err := c.Get(ctx, key, obj, opts...)
+			if s, ok := obj.(*corev1.Secret); ok {
+				got = s
+			}
+			return err
+		},
+	})
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "tenant"},
+		Spec: kustomizev1.KustomizationSpec{
+			Decryption: &kustomizev1.Decryption{
+				Provider:  DecryptionProviderSOPS,
+				SecretRef: &meta.NamespacedObjectReference{Name: "sops-age"},
+			},
+		},
+	}
+	d, cleanup, err := NewTempDecryptor("", c, kustomization)
+	g.Expect(err).ToNot(HaveOccurred())
+	t.Cleanup(cleanup)
+
+	g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+	g.Expect(d.ageIdentities).To(HaveLen(1))
+	g.Expect(d.vaultToken).To(Equal("hvs.token"))
+
+	g.Expect(got).ToNot(BeNil())
+	g.Expect(got.Data).To(HaveLen(2))
+	for name, value := range got.Data {
+		g.Expect(value).To(Equal(make([]byte, len(value))), "data of '%s' is not wiped", name)
+	}
+}
+
+func TestDecryptor_SopsDecryptWithFormat_WipesDataKey(t *testing.T) {
+	g := NewWithT(t)
+
+	svc := &recordingKeyService{}
+	d := &Decryptor{
+		keyServices: []keyservice.KeyServiceClient{svc},
+	}
+	d.localServiceOnce.Do(func() {})
+
+	format := formats.Json
+	encData, err := d.sopsEncryptWithFormat(sops.Metadata{
+		KeyGroups: []sops.KeyGroup{
+			{hcvault.NewMasterKey("https://vault.example.com", "transit", "sops")},
+		},
+	}, []byte(`{"key": "value"}`), format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	// The data key provided to the key service is wiped after encryption.
+	g.Expect(svc.encrypted).To(Equal(make([]byte, len(svc.dataKey))))
+
+	data, err := d.SopsDecryptWithFormat(encData, format, format)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(data).To(MatchJSON(`{"key": "value"}`))
+
+	g.Expect(svc.decrypted).To(HaveLen(1))
+	g.Expect(svc.decrypted[0]).To(Equal(make([]byte, len(svc.dataKey))))
+}
+
+func TestDecryptor_SopsDecryptWithFormat_KeyIdentifiers(t *testing.T) {
+	const arn = "arn:aws:kms:us-west-2:107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48"
+
+	newRecipient := func(g *WithT) string {
+		id, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+		return id.Recipient().String()
+	}
+	encrypt := func(g *WithT, group sops.KeyGroup) []byte {
+		d := &Decryptor{keyServices: []keyservice.KeyServiceClient{&recordingKeyService{}}}
+		d.localServiceOnce.Do(func() {})
+		data, err := d.sopsEncryptWithFormat(sops.Metadata{KeyGroups: []sops.KeyGroup{group}},
+			[]byte(`{"key": "value"}`), formats.Json, formats.Json)
+		g.Expect(err).ToNot(HaveOccurred())
+		return data
+	}
+	decrypt := func(data []byte) error {
+		d := &Decryptor{keyServices: []keyservice.KeyServiceClient{failingKeyService{err: errors.New("no key")}}}
+		d.localServiceOnce.Do(func() {})
+		_, err := d.SopsDecryptWithFormat(data, formats.Json, formats.Json)
+		return err
+	}
+
+	t.Run("lists the keys", func(t *testing.T) {
+		g := NewWithT(t)
+
+		recipient1, recipient2 := newRecipient(g), newRecipient(g)
+		data := encrypt(g, sops.KeyGroup{
+			&age.MasterKey{Recipient: recipient1},
+			&age.MasterKey{Recipient: recipient2},
+			awskms.NewMasterKeyFromArn(arn, nil, ""),
+		})
+
+		err := decrypt(data)
+		g.Expect(err).To(HaveOccurred())
+		// The message is included in the event and condition of the
+		// Kustomization, and should only contain public identifiers. The
+		// keys are listed in the order of the SOPS metadata, which stores
+		// the KMS keys before the age keys.
+		g.Expect(err.Error()).To(HaveSuffix(fmt.Sprintf("; encrypted with keys: kms '%s', age '%s', age '%s'",
+			arn, recipient1, recipient2)))
+		g.Expect(err.Error()).ToNot(ContainSubstring("vault:v1:encrypted"))
+	})
+
+	t.Run("truncates the list of keys", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var group sops.KeyGroup
+		for range 20 {
+			group = append(group, &age.MasterKey{Recipient: newRecipient(g)})
+		}
+
+		err := decrypt(encrypt(g, group))
+		g.Expect(err).To(HaveOccurred())
+		_, ids, ok := strings.Cut(err.Error(), "; encrypted with keys: ")
+		g.Expect(ok).To(BeTrue())
+		g.Expect(len(ids)).To(BeNumerically("<=", maxKeyIdentifiersLength+len(" and 20 more")))
+		g.Expect(ids).To(MatchRegexp(` and \d+ more$`))
+	})
+}
+
+func TestNewTempDecryptor_CleanupShredsDecryptedFiles(t *testing.T) {
+	g := NewWithT(t)
+
+	id, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	root := t.TempDir()
+	kustomization := &kustomizev1.Kustomization{
+		Spec: kustomizev1.KustomizationSpec{
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+			},
+		},
+	}
+	d, cleanup, err := NewTempDecryptor(root, nil, kustomization)
+	g.Expect(err).ToNot(HaveOccurred())
+	d.ageIdentities = append(d.ageIdentities, id)
+
+	encrypted, err := d.sopsEncryptWithFormat(sops.Metadata{
+		KeyGroups: []sops.KeyGroup{
+			{&age.MasterKey{Recipient: id.Recipient().String()}},
+		},
+	}, []byte("key=value\n"), formats.Dotenv, formats.Dotenv)
+	g.Expect(err).ToNot(HaveOccurred())
+	kus := []byte("secretGenerator:\n- name: app\n  envs:\n  - app.env\n")
+	g.Expect(os.WriteFile(filepath.Join(root, "kustomization.yaml"), kus, 0o600)).To(Succeed())
+	g.Expect(os.WriteFile(filepath.Join(root, "app.env"), encrypted, 0o600)).To(Succeed())
+
+	g.Expect(d.DecryptSources(root)).To(Succeed())
+	g.Expect(os.ReadFile(filepath.Join(root, "app.env"))).To(Equal([]byte("key=value\n")))
+
+	cleanup()
+	g.Expect(os.ReadFile(filepath.Join(root, "app.env"))).To(Equal(make([]byte, len("key=value\n"))))
+	g.Expect(os.ReadFile(filepath.Join(root, "kustomization.yaml"))).To(Equal(kus))
+}
+
+func TestParseSecretReference(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    *meta.NamespacedObjectReference
+		wantErr string
+	}{
+		{in: "flux-system/sops-age", want: &meta.NamespacedObjectReference{Name: "sops-age", Namespace: "flux-system"}},
+		{in: "sops-age", want: &meta.NamespacedObjectReference{Name: "sops-age"}},
+		{in: "", wantErr: "invalid name ''"},
+		{in: "flux-system/", wantErr: "invalid name ''"},
+		{in: "/sops-age", wantErr: "invalid namespace ''"},
+		{in: "flux.system/sops-age", wantErr: "invalid namespace 'flux.system'"},
+		{in: "flux-system/sops/age", wantErr: "invalid name 'sops/age'"},
+		{in: "Sops-Age", wantErr: "invalid name 'Sops-Age'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := ParseSecretReference(tt.in)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_AgeIdentities(t *testing.T) {
+	ageKey, err := os.ReadFile("testdata/age.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherAgeID, err := extage.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedAgeKey := newTestEncryptedAgeKey(t, string(ageKey)+"\n"+otherAgeID.String()+"\n", "passphrase")
+	sshKey := newTestSSHKeyPEM(t, nil)
+	encryptedSSHKey := newTestSSHKeyPEM(t, []byte("passphrase"))
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaBlock, err := ssh.MarshalPrivateKey(rsaKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		data           map[string][]byte
+		wantIdentities int
+		wantErr        string
+	}{
+		{
+			name: "SSH key",
+			data: map[string][]byte{
+				"id_ed25519" + DecryptionAgeSSHExt: sshKey,
+			},
+			wantIdentities: 1,
+		},
+		{
+			name: "SSH key in age key file",
+			data: map[string][]byte{
+				"identities" + DecryptionAgeExt: append(append(ageKey, '\n'), sshKey...),
+			},
+			wantIdentities: 2,
+		},
+		{
+			name: "age and SSH keys",
+			data: map[string][]byte{
+				"age" + DecryptionAgeExt:           ageKey,
+				"id_ed25519" + DecryptionAgeSSHExt: sshKey,
+			},
+			wantIdentities: 2,
+		},
+		{
+			name: "age key file with multiple identities and comments",
+			data: map[string][]byte{
+				"identities" + DecryptionAgeExt: []byte("# created: 2023-01-01T00:00:00Z\r\n" + string(bytes.TrimSpace(ageKey)) +
+					"\r\n\r\n# team key\r\n" + otherAgeID.String() + "\r\n"),
+			},
+			wantIdentities: 2,
+		},
+		{
+			name: "age key file without identities",
+			data: map[string][]byte{
+				"identities" + DecryptionAgeExt: []byte("# created: 2023-01-01T00:00:00Z\n"),
+			},
+			wantErr: "failed to import 'identities.agekey' data from sops decryption Secret 'tenant-ns/age-secret': no age identities found",
+		},
+		{
+			name: "passphrase-protected age key file",
+			data: map[string][]byte{
+				"age" + DecryptionAgeExt:    encryptedAgeKey,
+				DecryptionAgePassphraseFile: []byte("passphrase\n"),
+			},
+			wantIdentities: 2,
+		},
+		{
+			name: "passphrase-protected age key file without passphrase",
+			data: map[string][]byte{
+				"age" + DecryptionAgeExt: encryptedAgeKey,
+			},
+			wantErr: "failed to import 'age.agekey' data from sops decryption Secret 'tenant-ns/age-secret': age identity file is encrypted with a passphrase, but no passphrase is provided: configure 'age.passphrase'",
+		},
+		{
+			name: "passphrase-protected age key file with wrong passphrase",
+			data: map[string][]byte{
+				"age" + DecryptionAgeExt:    encryptedAgeKey,
+				DecryptionAgePassphraseFile: []byte("wrong"),
+			},
+			wantErr: "failed to import 'age.agekey' data from sops decryption Secret 'tenant-ns/age-secret': incorrect passphrase for age identity file, or the file is not encrypted with a passphrase: configure 'age.passphrase'",
+		},
+		{
+			name: "encrypted SSH key with passphrase",
+			data: map[string][]byte{
+				"id_ed25519" + DecryptionAgeSSHExt: encryptedSSHKey,
+				DecryptionAgeSSHPassphraseFile:     []byte("passphrase\n"),
+			},
+			wantIdentities: 1,
+		},
+		{
+			name: "encrypted SSH key without passphrase",
+			data: map[string][]byte{
+				"id_ed25519" + DecryptionAgeSSHExt: encryptedSSHKey,
+			},
+			wantErr: "failed to import 'id_ed25519.ssh' data from sops decryption Secret 'tenant-ns/age-secret': SSH private key is encrypted with a passphrase, but no passphrase is provided: configure 'age_ssh_passphrase'",
+		},
+		{
+			name: "SSH RSA key",
+			data: map[string][]byte{
+				"id_rsa" + DecryptionAgeSSHExt: pem.EncodeToMemory(rsaBlock),
+			},
+			wantErr: "failed to import 'id_rsa.ssh' data from sops decryption Secret 'tenant-ns/age-secret': unsupported SSH private key type 'ssh-rsa'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "age-secret",
+					Namespace: "tenant-ns",
+				},
+				Data: tt.data,
+			}
+			kustomization := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "tenant",
+					Namespace: "tenant-ns",
+				},
+				Spec: kustomizev1.KustomizationSpec{
+					Interval: metav1.Duration{Duration: 2 * time.Minute},
+					Path:     "./",
+					Decryption: &kustomizev1.Decryption{
+						Provider: DecryptionProviderSOPS,
+						SecretRef: &meta.NamespacedObjectReference{
+							Name: secret.Name,
+						},
+					},
+				},
+			}
+			c := fake.NewClientBuilder().WithObjects(secret).Build()
+
+			d, cleanup, err := NewTempDecryptor("", c, kustomization)
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+
+			err = d.ImportKeys(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(d.ageIdentities).To(HaveLen(tt.wantIdentities))
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_PGPPassphrase(t *testing.T) {
+	plainKey, plainFingerprint := newTestPGPKey(t, nil)
+	lockedKey, lockedFingerprint := newTestPGPKey(t, []byte("passphrase"))
+
+	tests := []struct {
+		name            string
+		data            map[string][]byte
+		wantFingerprint string
+		wantErr         string
+		wantReason      string
+	}{
+		{
+			name: "unprotected key",
+			data: map[string][]byte{
+				"pgp" + DecryptionPGPExt: plainKey,
+			},
+			wantFingerprint: plainFingerprint,
+		},
+		{
+			name: "protected key with passphrase",
+			data: map[string][]byte{
+				"pgp" + DecryptionPGPExt:                              lockedKey,
+				"pgp" + DecryptionPGPExt + DecryptionPGPPassphraseExt: []byte("passphrase\n"),
+			},
+			wantFingerprint: lockedFingerprint,
+		},
+		{
+			name: "protected key without passphrase",
+			data: map[string][]byte{
+				"pgp" + DecryptionPGPExt: lockedKey,
+			},
+			wantErr: fmt.Sprintf("failed to import 'pgp.asc' data from sops decryption Secret 'tenant-ns/pgp-secret': PGP key '%s': "+
+				"private key is protected with a passphrase, but no passphrase is provided: configure 'pgp.asc.passphrase'", lockedFingerprint),
+			wantReason: kustomizev1.InvalidDecryptionSecretReason,
+		},
+		{
+			name: "protected key with passphrase of other key",
+			data: map[string][]byte{
+				"pgp" + DecryptionPGPExt:                                lockedKey,
+				"other" + DecryptionPGPExt + DecryptionPGPPassphraseExt: []byte("passphrase"),
+			},
+			wantErr:    "configure 'pgp.asc.passphrase'",
+			wantReason: kustomizev1.InvalidDecryptionSecretReason,
+		},
+		{
+			name: "protected key with wrong passphrase",
+			data: map[string][]byte{
+				"pgp" + DecryptionPGPExt:                              lockedKey,
+				"pgp" + DecryptionPGPExt + DecryptionPGPPassphraseExt: []byte("wrong"),
+			},
+			wantErr:    fmt.Sprintf("failed to import 'pgp.asc' data from sops decryption Secret 'tenant-ns/pgp-secret': failed to unlock PGP key '%s': incorrect passphrase", lockedFingerprint),
+			wantReason: kustomizev1.InvalidDecryptionSecretReason,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "pgp-secret",
+					Namespace: "tenant-ns",
+				},
+				Data: tt.data,
+			}
+			kustomization := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "tenant",
+					Namespace: "tenant-ns",
+				},
+				Spec: kustomizev1.KustomizationSpec{
+					Interval: metav1.Duration{Duration: 2 * time.Minute},
+					Path:     "./",
+					Decryption: &kustomizev1.Decryption{
+						Provider: DecryptionProviderSOPS,
+						SecretRef: &meta.NamespacedObjectReference{
+							Name: secret.Name,
+						},
+					},
+				},
+			}
+			c := fake.NewClientBuilder().WithObjects(secret).Build()
+
+			d, cleanup, err := NewTempDecryptor("", c, kustomization)
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+
+			err = d.ImportKeys(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				var decryptionErr *DecryptionError
+				g.Expect(errors.As(err, &decryptionErr)).To(BeTrue())
+				g.Expect(decryptionErr.Reason).To(Equal(tt.wantReason))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+
+			// The imported key must be usable without a passphrase prompt.
+			key := pgp.NewMasterKeyFromFingerprint(tt.wantFingerprint)
+			pgp.DisableOpenPGP{}.ApplyToMasterKey(key)
+			d.gnuPGHome.ApplyToMasterKey(key)
+			g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+			got, err := key.Decrypt()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal([]byte("data-key")))
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_BinaryPGPKeys(t *testing.T) {
+	g := NewWithT(t)
+
+	armoredKey, armoredFingerprint := newTestPGPKey(t, nil)
+	binaryKey, binaryFingerprint := newTestBinaryPGPKey(t, nil)
+	lockedKey, lockedFingerprint := newTestBinaryPGPKey(t, []byte("passphrase"))
+
+	// A Secret with an armored key, and a binary key ring with multiple
+	// keys, of which one is protected with a passphrase.
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pgp-secret",
+			Namespace: "tenant-ns",
+		},
+		Data: map[string][]byte{
+			"pgp" + DecryptionPGPExt:                                        armoredKey,
+			"secring" + DecryptionPGPBinaryExt:                              append(bytes.Clone(binaryKey), lockedKey...),
+			"secring" + DecryptionPGPBinaryExt + DecryptionPGPPassphraseExt: []byte("passphrase"),
+		},
+	}
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "tenant",
+			Namespace: "tenant-ns",
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./",
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: secret.Name,
+				},
+			},
+		},
+	}
+	c := fake.NewClientBuilder().WithObjects(secret).Build()
+
+	d, cleanup, err := NewTempDecryptor("", c, kustomization)
+	g.Expect(err).ToNot(HaveOccurred())
+	t.Cleanup(cleanup)
+	g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+
+	for _, fingerprint := range []string{armoredFingerprint, binaryFingerprint, lockedFingerprint} {
+		g.Expect(d.hasPGPKey(fingerprint)).To(BeTrue())
+
+		key := pgp.NewMasterKeyFromFingerprint(fingerprint)
+		pgp.DisableOpenPGP{}.ApplyToMasterKey(key)
+		d.gnuPGHome.ApplyToMasterKey(key)
+		g.Expect(key.Encrypt([]byte("data-key"))).To(Succeed())
+		got, err := key.Decrypt()
+		g.Expect(err).ToNot(HaveOccurred(), "PGP key '%s'", fingerprint)
+		g.Expect(got).To(Equal([]byte("data-key")))
+	}
+}
+
+func TestNewTempDecryptor_GnuPGHomeDir(t *testing.T) {
+	pgpKey, _ := newTestPGPKey(t, []byte("passphrase"))
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pgp-secret",
+			Namespace: "tenant-ns",
+		},
+		Data: map[string][]byte{
+			"pgp" + DecryptionPGPExt:                              pgpKey,
+			"pgp" + DecryptionPGPExt + DecryptionPGPPassphraseExt: []byte("passphrase"),
+		},
+	}
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "tenant",
+			Namespace: "tenant-ns",
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./",
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: secret.Name,
+				},
+			},
+		},
+	}
+	c := fake.NewClientBuilder().WithObjects(secret).Build()
+
+	t.Run("removes imported keys on cleanup", func(t *testing.T) {
+		g := NewWithT(t)
+
+		dir := newTestGnuPGHomeDir(t)
+		d, cleanup, err := NewTempDecryptor("", c, kustomization, WithGnuPGHomeDir(dir))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(filepath.Dir(d.gnuPGHome.String())).To(Equal(dir))
+
+		g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+		entries, err := os.ReadDir(d.gnuPGHome.String())
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(entries).ToNot(BeEmpty())
+
+		cleanup()
+		g.Expect(os.ReadDir(dir)).To(BeEmpty())
+	})
+
+	t.Run("removes imported keys on panic", func(t *testing.T) {
+		g := NewWithT(t)
+
+		dir := newTestGnuPGHomeDir(t)
+		func() {
+			defer func() {
+				g.Expect(recover()).To(Equal("decryption panicked"))
+			}()
+
+			d, cleanup, err := NewTempDecryptor("", c, kustomization, WithGnuPGHomeDir(dir))
+			g.Expect(err).ToNot(HaveOccurred())
+			defer cleanup()
+
+			g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+			panic("decryption panicked")
+		}()
+		g.Expect(os.ReadDir(dir)).To(BeEmpty())
+	})
+
+	t.Run("invalid directory", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, _, err := NewTempDecryptor("", c, kustomization, WithGnuPGHomeDir(filepath.Join(t.TempDir(), "missing")))
+		g.Expect(err).To(MatchError(ContainSubstring("cannot create decryptor: failed to create GnuPG home directory")))
+	})
+}
+
+func TestDecryptor_ImportKeys_PGPKeyringCache(t *testing.T) {
+	g := NewWithT(t)
+
+	key1, fingerprint1 := newTestPGPKey(t, nil)
+	key2, fingerprint2 := newTestPGPKey(t, []byte("passphrase"))
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pgp-secret",
+			Namespace: "tenant-ns",
+		},
+		Data: map[string][]byte{
+			"pgp" + DecryptionPGPExt: key1,
+		},
+	}
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "tenant",
+			Namespace: "tenant-ns",
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./",
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: secret.Name,
+				},
+			},
+		},
+	}
+	c := fake.NewClientBuilder().WithObjects(secret).Build()
+
+	cache := intpgp.NewKeyringCache(2, "")
+	reg := prometheus.NewRegistry()
+	cache.MustRegister(reg)
+
+	importKeys := func() (*Decryptor, func()) {
+		d, cleanup, err := NewTempDecryptor("", c, kustomization, WithPGPKeyringCache(cache))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+		return d, cleanup
+	}
+	roundTrip := func(d *Decryptor, fingerprint string) error {
+		key := pgp.NewMasterKeyFromFingerprint(fingerprint)
+		pgp.DisableOpenPGP{}.ApplyToMasterKey(key)
+		d.gnuPGHome.ApplyToMasterKey(key)
+		if err := key.Encrypt([]byte("data-key")); err != nil {
+			return err
+		}
+		_, err := key.Decrypt()
+		return err
+	}
+
+	d1, cleanup1 := importKeys()
+	g.Expect(roundTrip(d1, fingerprint1)).To(Succeed())
+	cleanup1()
+
+	// The keyring is reused while the Secret does not change.
+	d2, cleanup2 := importKeys()
+	g.Expect(d2.gnuPGHome).To(Equal(d1.gnuPGHome))
+	g.Expect(roundTrip(d2, fingerprint1)).To(Succeed())
+
+	// Rotating the keys in the Secret invalidates the cached keyring.
+	secret.Data = map[string][]byte{
+		"pgp" + DecryptionPGPExt:                              key2,
+		"pgp" + DecryptionPGPExt + DecryptionPGPPassphraseExt: []byte("passphrase"),
+	}
+	g.Expect(c.Update(context.TODO(), secret)).To(Succeed())
+
+	d3, cleanup3 := importKeys()
+	t.Cleanup(cleanup3)
+	g.Expect(d3.gnuPGHome).ToNot(Equal(d1.gnuPGHome))
+	g.Expect(roundTrip(d3, fingerprint2)).To(Succeed())
+	g.Expect(roundTrip(d3, fingerprint1)).ToNot(Succeed())
+
+	// The replaced keyring is removed once no longer in use.
+	g.Expect(d1.gnuPGHome.String()).To(BeADirectory())
+	cleanup2()
+	g.Expect(d1.gnuPGHome.String()).ToNot(BeAnExistingFile())
+	g.Expect(cache.Len()).To(Equal(1))
+
+	g.Expect(testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP gotk_pgp_keyring_cache_requests_total The number of GnuPG keyring cache requests, partitioned by hit or miss result.
+# TYPE gotk_pgp_keyring_cache_requests_total counter
+gotk_pgp_keyring_cache_requests_total{result="hit"} 1
+gotk_pgp_keyring_cache_requests_total{result="miss"} 2
+`), "gotk_pgp_keyring_cache_requests_total")).To(Succeed())
+}
+
+func TestDecryptor_ImportKeys_ServiceAccountRole(t *testing.T) {
+	roleAnnotations := map[string]string{
+		intawskms.RoleARNAnnotation: "arn:aws:iam::123456789012:role/tenant",
+	}
+	tests := []struct {
+		name                  string
+		serviceAccountName    string
+		defaultServiceAccount string
+		annotations           map[string]string
+		kubeConfig            bool
+		secretData            map[string][]byte
+		getErr                error
+		wantErr               string
+		wantCredsProvider     bool
+		wantGet               bool
+	}{
+		{
+			name:               "annotated ServiceAccount",
+			serviceAccountName: "tenant",
+			annotations:        roleAnnotations,
+			wantCredsProvider:  true,
+			wantGet:            true,
+		},
+		{
+			name:                  "annotated default ServiceAccount",
+			defaultServiceAccount: "tenant",
+			annotations:           roleAnnotations,
+			wantCredsProvider:     true,
+			wantGet:               true,
+		},
+		{
+			name:               "ServiceAccount without annotation",
+			serviceAccountName: "tenant",
+			wantGet:            true,
+		},
+		{
+			name: "no ServiceAccount",
+		},
+		{
+			name:               "ServiceAccount not found",
+			serviceAccountName: "missing",
+			wantGet:            true,
+		},
+		{
+			name:               "ServiceAccount of a remote cluster",
+			serviceAccountName: "tenant",
+			annotations:        roleAnnotations,
+			kubeConfig:         true,
+		},
+		{
+			name:               "AWS credentials in decryption Secret",
+			serviceAccountName: "tenant",
+			annotations:        roleAnnotations,
+			secretData: map[string][]byte{
+				DecryptionAWSKmsFile: []byte(`aws_access_key_id: test-id
+aws_secret_access_key: test-secret`),
+			},
+			wantCredsProvider: true,
+		},
+		{
+			name:               "ServiceAccount get error",
+			serviceAccountName: "tenant",
+			getErr:             errors.New("forbidden"),
+			wantErr:            "cannot get ServiceAccount 'tenant-ns/tenant' for sops decryption: forbidden",
+			wantGet:            true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			sa := &corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "tenant",
+					Namespace:   "tenant-ns",
+					Annotations: tt.annotations,
+				},
+			}
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "sops-keys",
+					Namespace: "tenant-ns",
+				},
+				Data: tt.secretData,
+			}
+			kustomization := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "tenant",
+					Namespace: "tenant-ns",
+				},
+				Spec: kustomizev1.KustomizationSpec{
+					Interval:           metav1.Duration{Duration: 2 * time.Minute},
+					Path:               "./",
+					ServiceAccountName: tt.serviceAccountName,
+					Decryption: &kustomizev1.Decryption{
+						Provider: DecryptionProviderSOPS,
+					},
+				},
+			}
+			if tt.kubeConfig {
+				kustomization.Spec.KubeConfig = &kustomizev1.KubeConfigReference{
+					SecretRef: meta.SecretKeyReference{Name: "remote-kubeconfig"},
+				}
+			}
+			if tt.secretData != nil {
+				kustomization.Spec.Decryption.SecretRef = &meta.NamespacedObjectReference{Name: secret.Name}
+			}
+
+			// Record whether the ServiceAccount is read by the Decryptor.
+			var gotGet bool
+			c := interceptor.NewClient(fake.NewClientBuilder().WithObjects(sa, secret).Build(), interceptor.Funcs{
+				Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+					if _, ok := obj.(*corev1.ServiceAccount); ok {
+						gotGet = true
+						if tt.getErr != nil {
+							return tt.getErr
+						}
+					}
+					return c.Get(ctx, key, obj, opts...)
+				},
+			})
+
+			d, cleanup, err := NewTempDecryptor("", c, kustomization, WithDefaultServiceAccount(tt.defaultServiceAccount))
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+
+			err = d.ImportKeys(context.TODO())
+			g.Expect(gotGet).To(Equal(tt.wantGet))
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			if tt.wantCredsProvider {
+				g.Expect(d.awsCredsProvider).ToNot(BeNil())
+			} else {
+				g.Expect(d.awsCredsProvider).To(BeNil())
+			}
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_AzureCredentialCache(t *testing.T) {
+	g := NewWithT(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "azkv-secret",
+			Namespace: "default",
+		},
+		Data: map[string][]byte{
+			DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
+clientId: some-client-id
+clientSecret: some-client-secret`),
+		},
+	}
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "azkv",
+			Namespace: "default",
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./",
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: secret.Name,
+				},
+			},
+		},
+	}
+	c := fake.NewClientBuilder().WithObjects(secret).Build()
+	cache := intazkv.NewCredentialCache(10, 0)
+
+	for i := 0; i < 2; i++ {
+		d, cleanup, err := NewTempDecryptor("", c, kustomization, WithAzureCredentialCache(cache))
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(cleanup)
+
+		g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+		g.Expect(d.azureToken).ToNot(BeNil())
+		g.Expect(cache.Len()).To(Equal(1))
+	}
+
+	secret.Data[DecryptionAzureAuthFile] = []byte(`tenantId: some-tenant-id
+clientId: some-other-client-id
+clientSecret: some-client-secret`)
+	g.Expect(c.Update(context.TODO(), secret)).To(Succeed())
+
+	d, cleanup, err := NewTempDecryptor("", c, kustomization, WithAzureCredentialCache(cache))
+	g.Expect(err).ToNot(HaveOccurred())
+	t.Cleanup(cleanup)
+
+	g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+	g.Expect(cache.Len()).To(Equal(2))
+}
+
+func TestDecryptor_ImportKeys_AzureTokenMetrics(t *testing.T) {
+	g := NewWithT(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "azkv-secret",
+			Namespace: "default",
+		},
+		Data: map[string][]byte{
+			DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
+clientId: some-client-id
+clientSecret: some-client-secret`),
+		},
+	}
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "azkv",
+			Namespace: "default",
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./",
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: secret.Name,
+				},
+			},
+		},
+	}
+	c := fake.NewClientBuilder().WithObjects(secret).Build()
+
+	d, cleanup, err := NewTempDecryptor("", c, kustomization, WithAzureTokenMetrics(intazkv.NewTokenMetrics()))
+	g.Expect(err).ToNot(HaveOccurred())
+	t.Cleanup(cleanup)
+
+	g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+	token := d.azureToken.(*intazkv.TokenCredential)
+	g.Expect(token.Kind).To(Equal(intazkv.CredentialKindClientSecret))
+	g.Expect(token.TokenCredential).ToNot(BeAssignableToTypeOf(&azidentity.ClientSecretCredential{}))
+}
+
+func TestDecryptor_ImportKeys_InvalidAzureSecret(t *testing.T) {
+	g := NewWithT(t)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "azkv-secret",
+			Namespace: "default",
+		},
+		Data: map[string][]byte{
+			DecryptionAzureAuthFile: []byte(`tenantId: some-tenant-id
+clientSecret: some-client-secret`),
+		},
+	}
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "azkv",
+			Namespace: "default",
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval: metav1.Duration{Duration: 2 * time.Minute},
+			Path:     "./",
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: secret.Name,
+				},
+			},
+		},
+	}
+	c := fake.NewClientBuilder().WithObjects(secret).Build()
+
+	d, cleanup, err := NewTempDecryptor("", c, kustomization)
+	g.Expect(err).ToNot(HaveOccurred())
+	t.Cleanup(cleanup)
+
+	err = d.ImportKeys(context.TODO())
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("invalid 'sops.azure-kv' data in sops decryption Secret 'default/azkv-secret'"))
+	g.Expect(err.Error()).To(ContainSubstring("clientId: Required value"))
+	g.Expect(err.Error()).ToNot(ContainSubstring("some-client-secret"))
+
+	var decErr *DecryptionError
+	g.Expect(errors.As(err, &decErr)).To(BeTrue())
+	g.Expect(decErr.Reason).To(Equal(kustomizev1.InvalidDecryptionSecretReason))
+	g.Expect(d.azureToken).To(BeNil())
+}
+
+func TestDecryptor_ImportKeys_GCPEndpoint(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         map[string][]byte
+		wantEndpoint string
+		wantErr      string
+	}{
+		{
+			name: "default endpoint",
+			data: map[string][]byte{
+				DecryptionGCPCredsFile: []byte(`{"type": "authorized_user"}`),
+			},
+			wantEndpoint: "cloudkms.restricted.googleapis.com:443",
+		},
+		{
+			name: "endpoint from Secret",
+			data: map[string][]byte{
+				DecryptionGCPKMSEndpointFile: []byte("europe-west1-cloudkms.googleapis.com:443\n"),
+			},
+			wantEndpoint: "europe-west1-cloudkms.googleapis.com:443",
+		},
+		{
+			name: "invalid endpoint from Secret",
+			data: map[string][]byte{
+				DecryptionGCPKMSEndpointFile: []byte("https://cloudkms.googleapis.com"),
+			},
+			wantErr: "invalid 'gcp_kms_endpoint' data in sops decryption Secret 'default/gcpkms-secret': invalid endpoint 'https://cloudkms.googleapis.com'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "gcpkms-secret",
+					Namespace: "default",
+				},
+				Data: tt.data,
+			}
+			kustomization := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "gcpkms",
+					Namespace: "default",
+				},
+				Spec: kustomizev1.KustomizationSpec{
+					Interval: metav1.Duration{Duration: 2 * time.Minute},
+					Path:     "./",
+					Decryption: &kustomizev1.Decryption{
+						Provider: DecryptionProviderSOPS,
+						SecretRef: &meta.NamespacedObjectReference{
+							Name: secret.Name,
+						},
+					},
+				},
+			}
+			c := fake.NewClientBuilder().WithObjects(secret).Build()
+
+			d, cleanup, err := NewTempDecryptor("", c, kustomization,
+				WithGCPEndpoint("cloudkms.restricted.googleapis.com:443"))
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+
+			err = d.ImportKeys(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				var decErr *DecryptionError
+				g.Expect(errors.As(err, &decErr)).To(BeTrue())
+				g.Expect(decErr.Reason).To(Equal(kustomizev1.InvalidDecryptionSecretReason))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(d.gcpKMSEndpoint).To(Equal(tt.wantEndpoint))
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_GCPImpersonation(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		wantChain []string
+		wantErr   string
+	}{
+		{
+			name:      "service account",
+			value:     "decrypter@test-flux.iam.gserviceaccount.com\n",
+			wantChain: []string{"decrypter@test-flux.iam.gserviceaccount.com"},
+		},
+		{
+			name:  "service account through delegates",
+			value: "delegate@test-flux.iam.gserviceaccount.com,decrypter@test-flux.iam.gserviceaccount.com",
+			wantChain: []string{
+				"delegate@test-flux.iam.gserviceaccount.com",
+				"decrypter@test-flux.iam.gserviceaccount.com",
+			},
+		},
+		{
+			name:    "invalid service account",
+			value:   "decrypter",
+			wantErr: "invalid 'gcp_impersonate_service_account' data in sops decryption Secret 'default/gcpkms-secret': invalid service account 'decrypter'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "gcpkms-secret",
+					Namespace: "default",
+				},
+				Data: map[string][]byte{
+					DecryptionGCPImpersonateServiceAccountFile: []byte(tt.value),
+				},
+			}
+			kustomization := &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "gcpkms",
+					Namespace: "default",
+				},
+				Spec: kustomizev1.KustomizationSpec{
+					Interval: metav1.Duration{Duration: 2 * time.Minute},
+					Path:     "./",
+					Decryption: &kustomizev1.Decryption{
+						Provider: DecryptionProviderSOPS,
+						SecretRef: &meta.NamespacedObjectReference{
+							Name: secret.Name,
+						},
+					},
+				},
+			}
+			c := fake.NewClientBuilder().WithObjects(secret).Build()
+
+			d, cleanup, err := NewTempDecryptor("", c, kustomization)
+			g.Expect(err).ToNot(HaveOccurred())
+			t.Cleanup(cleanup)
+
+			err = d.ImportKeys(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				var decErr *DecryptionError
+				g.Expect(errors.As(err, &decErr)).To(BeTrue())
+				g.Expect(decErr.Reason).To(Equal(kustomizev1.InvalidDecryptionSecretReason))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(d.gcpImpersonationChain).To(Equal(tt.wantChain))
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_UnknownKeys(t *testing.T) {
+	g := NewWithT(t)
+
+	// The keys which only resemble the names of the provider keys are
+	// ignored.
+	d := importVaultTestKeys(t, "", map[string][]byte{
+		"gcp_kms_endpoint_backup":     []byte("not-an-endpoint"),
+		DecryptionVaultRoleFile + "2": []byte("flux"),
+		"vault_skip_verify.txt":       []byte("not-a-bool"),
+		"README":                      []byte("decryption keys of the tenant"),
+	})
+	g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+	g.Expect(d.gcpKMSEndpoint).To(BeEmpty())
+	g.Expect(d.vaultRole).To(BeEmpty())
+	g.Expect(d.vaultSkipVerify).To(BeFalse())
+	g.Expect(d.vaultLogin).To(BeNil())
+}
+
+func TestDecryptor_ImportKeys_VaultKubernetesAuth(t *testing.T) {
+	tests := []struct {
+		name               string
+		serviceAccountName string
+		data               map[string][]byte
+		wantRole           string
+		wantMount          string
+		wantServiceAccount bool
+		wantErr            string
+	}{
+		{
+			name: "role",
+			data: map[string][]byte{
+				DecryptionVaultRoleFile: []byte("flux\n"),
+			},
+			wantRole: "flux",
+		},
+		{
+			name: "role and auth mount",
+			data: map[string][]byte{
+				DecryptionVaultRoleFile:      []byte("flux"),
+				DecryptionVaultAuthMountFile: []byte("/kubernetes-prod/\n"),
+			},
+			wantRole:  "flux",
+			wantMount: "kubernetes-prod",
+		},
+		{
+			name:               "role with ServiceAccount",
+			serviceAccountName: "tenant",
+			data: map[string][]byte{
+				DecryptionVaultRoleFile: []byte("flux"),
+			},
+			wantRole:           "flux",
+			wantServiceAccount: true,
+		},
+		{
+			name: "auth mount without role",
+			data: map[string][]byte{
+				DecryptionVaultAuthMountFile: []byte("kubernetes-prod"),
+			},
+			wantErr: "invalid Vault authentication data in sops decryption Secret 'tenant-ns/hcvault-secret': 'vault_auth_mount' requires 'vault_role' or 'vault_role_id' to be set",
+		},
+		{
+			name: "role and token",
+			data: map[string][]byte{
+				DecryptionVaultRoleFile:      []byte("flux"),
+				DecryptionVaultTokenFileName: []byte("some-hcvault-token"),
+			},
+			wantErr: "invalid Vault authentication data in sops decryption Secret 'tenant-ns/hcvault-secret': 'sops.vault-token' and 'vault_role' are mutually exclusive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			d := importVaultTestKeys(t, tt.serviceAccountName, tt.data)
+			err := d.ImportKeys(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				var decErr *DecryptionError
+				g.Expect(errors.As(err, &decErr)).To(BeTrue())
+				g.Expect(decErr.Reason).To(Equal(kustomizev1.InvalidDecryptionSecretReason))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(d.vaultRole).To(Equal(tt.wantRole))
+			g.Expect(d.vaultAuthMount).To(Equal(tt.wantMount))
+			g.Expect(d.vaultLogin).ToNot(BeNil())
+			g.Expect(d.serviceAccount != nil).To(Equal(tt.wantServiceAccount))
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_VaultAppRoleAuth(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         map[string][]byte
+		wantRoleID   string
+		wantSecretID string
+		wantMount    string
+		wantErr      string
+	}{
+		{
+			name: "role ID and secret ID",
+			data: map[string][]byte{
+				DecryptionVaultRoleIDFile:   []byte("role-id\n"),
+				DecryptionVaultSecretIDFile: []byte("secret-id\n"),
+			},
+			wantRoleID:   "role-id",
+			wantSecretID: "secret-id",
+		},
+		{
+			name: "role ID, wrapped secret ID and auth mount",
+			data: map[string][]byte{
+				DecryptionVaultRoleIDFile:    []byte("role-id"),
+				DecryptionVaultSecretIDFile:  []byte("hvs.wrapping-token"),
+				DecryptionVaultAuthMountFile: []byte("approle-prod"),
+			},
+			wantRoleID:   "role-id",
+			wantSecretID: "hvs.wrapping-token",
+			wantMount:    "approle-prod",
+		},
+		{
+			name: "role ID without secret ID",
+			data: map[string][]byte{
+				DecryptionVaultRoleIDFile: []byte("role-id"),
+			},
+			wantErr: "invalid Vault authentication data in sops decryption Secret 'tenant-ns/hcvault-secret': 'vault_role_id' and 'vault_secret_id' must be set together",
+		},
+		{
+			name: "role ID and role",
+			data: map[string][]byte{
+				DecryptionVaultRoleIDFile:   []byte("role-id"),
+				DecryptionVaultSecretIDFile: []byte("secret-id"),
+				DecryptionVaultRoleFile:     []byte("flux"),
+			},
+			wantErr: "'vault_role' and 'vault_role_id' are mutually exclusive",
+		},
+		{
+			name: "role ID and token",
+			data: map[string][]byte{
+				DecryptionVaultRoleIDFile:    []byte("role-id"),
+				DecryptionVaultSecretIDFile:  []byte("secret-id"),
+				DecryptionVaultTokenFileName: []byte("some-hcvault-token"),
+			},
+			wantErr: "'sops.vault-token' and 'vault_role_id' are mutually exclusive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			d := importVaultTestKeys(t, "", tt.data)
+			err := d.ImportKeys(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				var decErr *DecryptionError
+				g.Expect(errors.As(err, &decErr)).To(BeTrue())
+				g.Expect(decErr.Reason).To(Equal(kustomizev1.InvalidDecryptionSecretReason))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(d.vaultRoleID).To(Equal(tt.wantRoleID))
+			g.Expect(d.vaultSecretID).To(Equal(tt.wantSecretID))
+			g.Expect(d.vaultAuthMount).To(Equal(tt.wantMount))
+			g.Expect(d.vaultLogin).ToNot(BeNil())
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_VaultCertAuth(t *testing.T) {
+	certPEM, keyPEM := newTestCertificatePEM(t, "flux")
+
+	tests := []struct {
+		name      string
+		data      map[string][]byte
+		wantLogin bool
+		wantErr   string
+	}{
+		{
+			name: "client certificate",
+			data: map[string][]byte{
+				DecryptionVaultAuthMethodFile: []byte("cert\n"),
+				DecryptionVaultClientCertFile: certPEM,
+				DecryptionVaultClientKeyFile:  keyPEM,
+			},
+			wantLogin: true,
+		},
+		{
+			name: "client certificate with role name and auth mount",
+			data: map[string][]byte{
+				DecryptionVaultAuthMethodFile: []byte("Cert"),
+				DecryptionVaultRoleFile:       []byte("sops"),
+				DecryptionVaultAuthMountFile:  []byte("cert-prod"),
+				DecryptionVaultClientCertFile: certPEM,
+				DecryptionVaultClientKeyFile:  keyPEM,
+			},
+			wantLogin: true,
+		},
+		{
+			name: "client certificate without auth method",
+			data: map[string][]byte{
+				DecryptionVaultClientCertFile: certPEM,
+				DecryptionVaultClientKeyFile:  keyPEM,
+			},
+		},
+		{
+			name: "missing client certificate",
+			data: map[string][]byte{
+				DecryptionVaultAuthMethodFile: []byte("cert"),
+			},
+			wantErr: "invalid Vault authentication data in sops decryption Secret 'tenant-ns/hcvault-secret': the cert auth method requires 'vault_client.crt' and 'vault_client.key' to be set",
+		},
+		{
+			name: "role ID",
+			data: map[string][]byte{
+				DecryptionVaultAuthMethodFile: []byte("cert"),
+				DecryptionVaultClientCertFile: certPEM,
+				DecryptionVaultClientKeyFile:  keyPEM,
+				DecryptionVaultRoleIDFile:     []byte("role-id"),
+			},
+			wantErr: "'vault_role_id' and 'vault_secret_id' can not be used with the cert auth method",
+		},
+		{
+			name: "token",
+			data: map[string][]byte{
+				DecryptionVaultAuthMethodFile: []byte("cert"),
+				DecryptionVaultClientCertFile: certPEM,
+				DecryptionVaultClientKeyFile:  keyPEM,
+				DecryptionVaultTokenFileName:  []byte("some-hcvault-token"),
+			},
+			wantErr: "'sops.vault-token' and 'vault_auth_method' are mutually exclusive",
+		},
+		{
+			name: "explicit Kubernetes auth method without role",
+			data: map[string][]byte{
+				DecryptionVaultAuthMethodFile: []byte("kubernetes"),
+			},
+			wantErr: "the kubernetes auth method requires 'vault_role' to be set",
+		},
+		{
+			name: "unsupported auth method",
+			data: map[string][]byte{
+				DecryptionVaultAuthMethodFile: []byte("userpass"),
+			},
+			wantErr: "unsupported 'vault_auth_method' 'userpass', must be one of: approle, cert, kubernetes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			d := importVaultTestKeys(t, "", tt.data)
+			err := d.ImportKeys(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				var decErr *DecryptionError
+				g.Expect(errors.As(err, &decErr)).To(BeTrue())
+				g.Expect(decErr.Reason).To(Equal(kustomizev1.InvalidDecryptionSecretReason))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(d.vaultTLSConfig).ToNot(BeNil())
+			g.Expect(d.vaultTLSConfig.Certificates).To(HaveLen(1))
+			if tt.wantLogin {
+				g.Expect(d.vaultLogin).ToNot(BeNil())
+			} else {
+				g.Expect(d.vaultLogin).To(BeNil())
+			}
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_VaultLoginCache(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := inthcvault.NewLoginCache(10, 0)
+	importLogin := func(serviceAccountName string, data map[string][]byte) *inthcvault.Login {
+		t.Helper()
+		d := importVaultTestKeys(t, serviceAccountName, data, WithVaultLoginCache(cache))
+		g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+		g.Expect(d.vaultLogin).ToNot(BeNil())
+		return d.vaultLogin
+	}
+
+	data := map[string][]byte{
+		DecryptionVaultRoleFile: []byte("flux"),
+	}
+	first := importLogin("", data)
+	g.Expect(importLogin("", data)).To(BeIdenticalTo(first))
+	g.Expect(cache.Len()).To(Equal(1))
+
+	// The Login is cached per ServiceAccount.
+	g.Expect(importLogin("tenant", data)).ToNot(BeIdenticalTo(first))
+	g.Expect(cache.Len()).To(Equal(2))
+
+	// A change of the authentication data replaces the Login.
+	changed := importLogin("", map[string][]byte{
+		DecryptionVaultRoleFile:      []byte("flux"),
+		DecryptionVaultAuthMountFile: []byte("kubernetes-prod"),
+	})
+	g.Expect(changed).ToNot(BeIdenticalTo(first))
+	g.Expect(cache.Len()).To(Equal(2))
+}
+
+func TestDecryptor_ImportKeys_VaultNamespace(t *testing.T) {
+	ptr := func(s string) *string { return &s }
+
+	tests := []struct {
+		name          string
+		data          map[string][]byte
+		wantNamespace *string
+	}{
+		{
+			name: "namespace",
+			data: map[string][]byte{
+				DecryptionVaultNamespaceFile: []byte("/ns1/team-a/\n"),
+			},
+			wantNamespace: ptr("ns1/team-a"),
+		},
+		{
+			name: "empty namespace",
+			data: map[string][]byte{
+				DecryptionVaultNamespaceFile: []byte(""),
+			},
+			wantNamespace: ptr(""),
+		},
+		{
+			name: "no namespace",
+			data: map[string][]byte{
+				DecryptionVaultTokenFileName: []byte("some-hcvault-token"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			d := importVaultTestKeys(t, "", tt.data)
+			g.Expect(d.ImportKeys(context.TODO())).To(Succeed())
+			g.Expect(d.vaultNamespace).To(Equal(tt.wantNamespace))
+		})
+	}
+}
+
+func TestDecryptor_ImportKeys_VaultTLS(t *testing.T) {
+	certPEM, keyPEM := newTestCertificatePEM(t, "flux")
+	_, otherKeyPEM := newTestCertificatePEM(t, "other")
+
+	tests := []struct {
+		name           string
+		data           map[string][]byte
+		wantCACerts    int
+		wantClientCert bool
+		wantSkipVerify bool
+		wantWarning    string
+		wantErr        string
+	}{
+		{
+			name: "CA certificate",
+			data: map[string][]byte{
+				DecryptionVaultCACertFile: certPEM,
+			},
+			wantCACerts: 1,
+		},
+		{
+			name: "CA certificate and client certificate",
+			data: map[string][]byte{
+				DecryptionVaultCACertFile:     certPEM,
+				DecryptionVaultClientCertFile: certPEM,
+				DecryptionVaultClientKeyFile:  keyPEM,
+			},
+			wantCACerts:    1,
+			wantClientCert: true,
+		},
+		{
+			name: "unrelated certificate",
+			data: map[string][]byte{
+				"ingress.crt": []byte("invalid"),
+			},
+		},
+		{
+			name: "skip verify",
+			data: map[string][]byte{
+				DecryptionVaultSkipVerifyFile: []byte("true\n"),
+			},
+			wantSkipVerify: true,
+			wantWarning:    "verification of the TLS certificate of Hashicorp Vault is disabled by 'vault_skip_verify' in sops decryption Secret 'tenant-ns/hcvault-secret'",
+		},
+		{
+			name: "skip verify disabled",
+			data: map[string][]byte{
+				DecryptionVaultSkipVerifyFile: []byte("false"),
+			},
+		},
+		{
+			name: "invalid skip verify",
+			data: map[string][]byte{
+				DecryptionVaultSkipVerifyFile: []byte("yes please"),
+			},
+			wantErr: "invalid 'vault_skip_verify' data in sops decryption Secret 'tenant-ns/hcvault-secret'",
+		},
+		{
+			name: "invalid CA certificate",
+			data: map[string][]byte{
+				DecryptionVaultCACertFile: []byte("invalid"),
+			},
+			wantErr: "invalid 'vault_ca.crt' data in sops decryption Secret 'tenant-ns/hcvault-secret': no PEM encoded certificates found",
+		},
+		{
+			name: "invalid client certificate",
+			data: map[string][]byte{
+				DecryptionVaultClientCertFile: keyPEM,
+				DecryptionVaultClientKeyFile:  keyPEM,
+			},
+			wantErr: "invalid 'vault_client.crt' data in sops decryption Secret 'tenant-ns/hcvault-secret': no PEM encoded certificates found",
+		},
+		{
+			name: "mismatching client key",
+			data: map[string][]byte{
+				DecryptionVaultClientCertFile: certPEM,
+				DecryptionVaultClientKeyFile:  otherKeyPEM,
+			},
+			wantErr: "invalid 'vault_client.key' data in sops decryption Secret 'tenant-ns/hcvault-secret': failed to parse client certificate and key",
+		},
+		{
+			name: "client certificate without key",
+			data: map[string][]byte{
+				DecryptionVaultClientCertFile: certPEM,
+			},
+			wantErr: "'vault_client.crt' in sops decryption Secret 'tenant-ns/hcvault-secret' requires 'vault_client.key' to be set",
+		},
+		{
+			name: "client key without certificate",
+			data: map[string][]byte{
+				DecryptionVaultClientKeyFile: keyPEM,
+			},
+			wantErr: "'vault_client.key' in sops decryption Secret 'tenant-ns/hcvault-secret' requires 'vault_client.crt' to be set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var warnings []string
+			d := importVaultTestKeys(t, "", tt.data, WithWarningEventFunc(func(msg string) {
+				warnings = append(warnings, msg)
+			}))
+			err := d.ImportKeys(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				var decErr *DecryptionError
+				g.Expect(errors.As(err, &decErr)).To(BeTrue())
+				g.Expect(decErr.Reason).To(Equal(kustomizev1.InvalidDecryptionSecretReason))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			if tt.wantCACerts == 0 && !tt.wantClientCert && !tt.wantSkipVerify {
+				g.Expect(d.vaultTLSConfig).To(BeNil())
+				g.Expect(warnings).To(BeEmpty())
+				return
+			}
+			g.Expect(d.vaultTLSConfig).ToNot(BeNil())
+			if tt.wantCACerts > 0 {
+				g.Expect(d.vaultTLSConfig.RootCAs).ToNot(BeNil())
+			}
+			if tt.wantClientCert {
+				g.Expect(d.vaultTLSConfig.Certificates).To(HaveLen(1))
+			} else {
+				g.Expect(d.vaultTLSConfig.Certificates).To(BeEmpty())
+			}
+			g.Expect(d.vaultTLSConfig.InsecureSkipVerify).To(Equal(tt.wantSkipVerify))
+			if tt.wantWarning != "" {
+				g.Expect(warnings).To(ConsistOf(ContainSubstring(tt.wantWarning)))
+			} else {
+				g.Expect(warnings).To(BeEmpty())
+			}
+		})
+	}
+}
+
+// newTestSSHKeyPEM returns a PEM encoded OpenSSH ed25519 private key,
+// encrypted with the passphrase if not nil.
+func newTestSSHKeyPEM(t *testing.T, passphrase []byte) []byte {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block *pem.Block
+	if passphrase != nil {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", passphrase)
+	} else {
+		block, err = ssh.MarshalPrivateKey(priv, "")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(block)
+}
+
+// newTestEncryptedAgeKey returns the given age identity file, encrypted with
+// the passphrase in armored format as done by "age -p -a".
+func newTestEncryptedAgeKey(t *testing.T, identityFile, passphrase string) []byte {
+	t.Helper()
+
+	recipient, err := extage.NewScryptRecipient(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient.SetWorkFactor(10)
+
+	var buf bytes.Buffer
+	aw := extagearmor.NewWriter(&buf)
+	w, err := extage.Encrypt(aw, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte(identityFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestGnuPGHomeDir returns a new directory for GnuPG home directories,
+// which unlike t.TempDir() has a path short enough for the sockets of the
+// gpg-agent.
+func newTestGnuPGHomeDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "gnupg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+// newTestPGPKey returns a new armored PGP private key, protected with the
+// given passphrase if not empty, and its fingerprint.
+func newTestPGPKey(t *testing.T, passphrase []byte) ([]byte, string) {
+	t.Helper()
+
+	e, err := openpgp.NewEntity("Flux", "test", "flux@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passphrase) > 0 {
+		if err := e.EncryptPrivateKeys(passphrase, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SerializePrivateWithoutSigning(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+}
+
+// newTestBinaryPGPKey returns a new binary PGP private key, as exported by
+// "gpg --export-secret-keys" without "--armor", and its fingerprint, see
+// newTestPGPKey.
+func newTestBinaryPGPKey(t *testing.T, passphrase []byte) ([]byte, string) {
+	t.Helper()
+
+	armored, fingerprint := newTestPGPKey(t, passphrase)
+	block, err := armor.Decode(bytes.NewReader(armored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, fingerprint
+}
+
+// newTestCertificatePEM returns a PEM encoded self-signed certificate with
+// the given common name, and its private key.
+func newTestCertificatePEM(t *testing.T, commonName string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// importVaultTestKeys returns a Decryptor for a Kustomization in the
+// "tenant-ns" namespace with the given ServiceAccount name, referring to an
+// "hcvault-secret" Secret with the given data, and the given options. A
+// "tenant" ServiceAccount exists in the namespace.
+func importVaultTestKeys(t *testing.T, serviceAccountName string, data map[string][]byte, opts ...Option) *Decryptor {
+	t.Helper()
+
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "tenant",
+			Namespace: "tenant-ns",
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "hcvault-secret",
+			Namespace: "tenant-ns",
+		},
+		Data: data,
+	}
+	kustomization := &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "tenant",
+			Namespace: "tenant-ns",
+		},
+		Spec: kustomizev1.KustomizationSpec{
+			Interval:           metav1.Duration{Duration: 2 * time.Minute},
+			Path:               "./",
+			ServiceAccountName: serviceAccountName,
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+				SecretRef: &meta.NamespacedObjectReference{
+					Name: secret.Name,
+				},
+			},
+		},
+	}
+	c := fake.NewClientBuilder().WithObjects(sa, secret).Build()
+
+	d, cleanup, err := NewTempDecryptor("", c, kustomization, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	return d
+}
+
+func TestDecryptor_azureLatestKeyVersionEvent(t *testing.T) {
+	g := NewWithT(t)
+
+	var events []string
+	d := &Decryptor{}
+	WithEventFunc(func(msg string) {
+		events = append(events, msg)
+	})(d)
+
+	key := azkv.NewMasterKey("https://myvault.vault.azure.net", "key-name", "key-version")
+	d.azureLatestKeyVersionEvent(key, errors.New("KeyDisabled"))
+	g.Expect(events).To(ConsistOf(
+		"decrypted sops data key with the latest version of Azure Key Vault key 'https://myvault.vault.azure.net/keys/key-name', " +
+			"as version 'key-version' is disabled or not found: re-encrypt the data to stop relying on the fallback",
+	))
+
+	// Without an event function, no event is emitted.
+	(&Decryptor{}).azureLatestKeyVersionEvent(key, errors.New("KeyDisabled"))
+}
+
+func TestDecryptor_awsRegionFailoverEvent(t *testing.T) {
+	g := NewWithT(t)
+
+	var events []string
+	d := &Decryptor{}
+	WithEventFunc(func(msg string) {
+		events = append(events, msg)
+	})(d)
+
+	key := awskms.NewMasterKeyFromArn("arn:aws:kms:us-west-2:107501996527:key/mrk-1234abcd12ab34cd56ef1234567890ab", nil, "")
+	d.awsRegionFailoverEvent(key, "eu-west-1", errors.New("region 'us-west-2': context deadline exceeded"))
+	g.Expect(events).To(ConsistOf(
+		"decrypted sops data key with the replica of AWS KMS key 'arn:aws:kms:us-west-2:107501996527:key/mrk-1234abcd12ab34cd56ef1234567890ab' " +
+			"in region 'eu-west-1', after failing in the preceding regions: region 'us-west-2': context deadline exceeded",
+	))
+
+	// Without an event function, no event is emitted.
+	(&Decryptor{}).awsRegionFailoverEvent(key, "eu-west-1", errors.New("failure"))
+}
+
+func TestDecryptor_SopsDecryptWithFormat(t *testing.T) {
+	t.Run("decrypt INI to INI", func(t *testing.T) {
+		g := NewWithT(t)
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		kd := &Decryptor{
+			checkSopsMac:  true,
+			ageIdentities: age.ParsedIdentities{ageID},
+		}
+
+		format := formats.Ini
+		data := []byte("[config]\nkey = value\n")
+		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&age.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, data, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
+		g.Expect(encData).ToNot(Equal(data))
+
+		out, err := kd.SopsDecryptWithFormat(encData, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(out).To(Equal(data))
+	})
+
+	t.Run("decrypt JSON to YAML", func(t *testing.T) {
+		g := NewWithT(t)
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		kd := &Decryptor{
+			checkSopsMac:  true,
+			ageIdentities: age.ParsedIdentities{ageID},
+		}
+
+		inputFormat, outputFormat := formats.Json, formats.Yaml
+		data := []byte("{\"key\": \"value\"}\n")
+		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&age.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, data, inputFormat, inputFormat)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[inputFormat])).To(BeTrue())
+
+		out, err := kd.SopsDecryptWithFormat(encData, inputFormat, outputFormat)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(out).To(Equal([]byte("key: value\n")))
+	})
+
+	t.Run("invalid JSON data", func(t *testing.T) {
+		g := NewWithT(t)
+
+		format := formats.Json
+		data, err := (&Decryptor{}).SopsDecryptWithFormat([]byte("invalid json"), format, format)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("failed to load encrypted JSON data"))
+		g.Expect(data).To(BeNil())
+	})
+
+	t.Run("no data key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		kd := &Decryptor{}
+
+		format := formats.Binary
+		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&age.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, []byte("foo bar"), format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
+
+		data, err := kd.SopsDecryptWithFormat(encData, format, format)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("cannot get sops data key"))
+		g.Expect(data).To(BeNil())
+	})
+
+	t.Run("with mac check", func(t *testing.T) {
+		g := NewWithT(t)
+
+		ageID, err := extage.GenerateX25519Identity()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		kd := &Decryptor{
+			checkSopsMac:  true,
+			ageIdentities: age.ParsedIdentities{ageID},
+		}
+
+		format := formats.Dotenv
+		data := []byte("key=value\n")
+		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&age.MasterKey{Recipient: ageID.Recipient().String()}},
+			},
+		}, data, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
+
+		out, err := kd.SopsDecryptWithFormat(encData, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(out).To(Equal(data))
+
+		badMAC := regexp.MustCompile("(?m)[\r\n]+^.*sops_mac=.*$")
+		badMACData := badMAC.ReplaceAll(encData, []byte("\nsops_mac=\n"))
+		out, err = kd.SopsDecryptWithFormat(badMACData, format, format)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("failed to verify sops data integrity: expected mac 'no MAC'"))
+		g.Expect(out).To(BeNil())
+	})
+}
+
+func TestDecryptor_SopsDecryptWithFormat_RemoteKeyService(t *testing.T) {
+	g := NewWithT(t)
+
+	localID, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+	remoteID, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// The remote key service holds an identity which is not available
+	// to the controller, and is served on a Unix socket.
+	dir, err := os.MkdirTemp("", "ks")
+	g.Expect(err).ToNot(HaveOccurred())
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	lis, err := net.Listen("unix", filepath.Join(dir, "ks.sock"))
+	g.Expect(err).ToNot(HaveOccurred())
+	server := grpc.NewServer()
+	keyservice.RegisterKeyServiceServer(server, intkeyservice.NewServer(intkeyservice.WithAgeIdentities(age.ParsedIdentities{remoteID})))
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	remote, err := intkeyservice.NewRemoteClient("unix://" + lis.Addr().String())
+	g.Expect(err).ToNot(HaveOccurred())
+	t.Cleanup(func() { _ = remote.Close() })
+
+	encrypt := func(recipients ...string) []byte {
+		var group sops.KeyGroup
+		for _, r := range recipients {
+			group = append(group, &age.MasterKey{Recipient: r})
+		}
+		d := &Decryptor{}
+		encrypted, err := d.sopsEncryptWithFormat(sops.Metadata{KeyGroups: []sops.KeyGroup{group}},
+			[]byte("key: value\n"), formats.Yaml, formats.Yaml)
+		g.Expect(err).ToNot(HaveOccurred())
+		return encrypted
+	}
+	remoteOnly := encrypt(remoteID.Recipient().String())
+	localAndRemote := encrypt(remoteID.Recipient().String(), localID.Recipient().String())
+
+	decrypt := func(data []byte) ([]byte, error) {
+		d := &Decryptor{
+			kustomization: &kustomizev1.Kustomization{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"},
+			},
+			ageIdentities:     age.ParsedIdentities{localID},
+			checkSopsMac:      true,
+			remoteKeyServices: []keyservice.KeyServiceClient{remote},
+		}
+		return d.SopsDecryptWithFormat(data, formats.Yaml, formats.Yaml)
+	}
+
+	// The data key which can't be decrypted locally is forwarded to the
+	// remote key service.
+	decrypted, err := decrypt(remoteOnly)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(decrypted).To(Equal([]byte("key: value\n")))
+
+	// Without the remote key service, the local keys are still used.
+	server.Stop()
+	decrypted, err = decrypt(localAndRemote)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(decrypted).To(Equal([]byte("key: value\n")))
+
+	_, err = decrypt(remoteOnly)
+	var decErr *DecryptionError
+	g.Expect(errors.As(err, &decErr)).To(BeTrue())
+	g.Expect(decErr.Reason).To(Equal(kustomizev1.DecryptionKeyServiceUnavailableReason))
+	g.Expect(err.Error()).To(ContainSubstring("key service '%s'", remote.Address()))
+}
+
+func TestDecryptor_SopsDecryptWithFormat_KeyGroups(t *testing.T) {
+	ids := make([]*extage.X25519Identity, 3)
+	for i := range ids {
+		id, err := extage.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+	groups := func(n int) []sops.KeyGroup {
+		var groups []sops.KeyGroup
+		for _, id := range ids[:n] {
+			groups = append(groups, sops.KeyGroup{&age.MasterKey{Recipient: id.Recipient().String()}})
+		}
+		return groups
+	}
+
+	tests := []struct {
+		name       string
+		groups     int
+		threshold  int
+		identities []int
+		wantErr    string
+	}{
+		{name: "two groups with threshold 2", groups: 2, threshold: 2, identities: []int{0, 1}},
+		{name: "two groups with threshold 2 and missing group", groups: 2, threshold: 2, identities: []int{1},
+			wantErr: "1 of 2 required key groups decrypted: key group 1 [age]: failed"},
+		{name: "two groups with threshold 1", groups: 2, threshold: 1, identities: []int{1}},
+		{name: "two groups with threshold 1 and missing groups", groups: 2, threshold: 1,
+			wantErr: "0 of 1 required key groups decrypted: key group 1 [age]: failed"},
+		{name: "three groups with threshold 2", groups: 3, threshold: 2, identities: []int{0, 2}},
+		{name: "three groups with threshold 2 and missing groups", groups: 3, threshold: 2, identities: []int{2},
+			wantErr: "1 of 2 required key groups decrypted: key group 1 [age]: failed"},
+		{name: "three groups with threshold 1", groups: 3, threshold: 1, identities: []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			format := formats.Yaml
+			data := []byte("key: value\n")
+
+			var encData []byte
+			var err error
+			if tt.threshold > 1 {
+				encData, err = (&Decryptor{}).sopsEncryptWithFormat(sops.Metadata{
+					KeyGroups:       groups(tt.groups),
+					ShamirThreshold: tt.threshold,
+				}, data, format, format)
+				g.Expect(err).ToNot(HaveOccurred())
+			} else {
+				// SOPS can not split the data key with a threshold of 1, which
+				// is instead met by every key group holding the data key.
+				encData, err = (&Decryptor{}).sopsEncryptWithFormat(sops.Metadata{
+					KeyGroups: []sops.KeyGroup{slices.Concat(groups(tt.groups)...)},
+				}, data, format, format)
+				g.Expect(err).ToNot(HaveOccurred())
+
+				store := common.StoreForFormat(format, config.NewStoresConfig())
+				tree, err := store.LoadEncryptedFile(encData)
+				g.Expect(err).ToNot(HaveOccurred())
+				var split []sops.KeyGroup
+				for _, key := range tree.Metadata.KeyGroups[0] {
+					split = append(split, sops.KeyGroup{key})
+				}
+				tree.Metadata.KeyGroups = split
+				tree.Metadata.ShamirThreshold = tt.threshold
+				encData, err = store.EmitEncryptedFile(tree)
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+
+			kd := &Decryptor{checkSopsMac: true}
+			for _, i := range tt.identities {
+				kd.ageIdentities = append(kd.ageIdentities, ids[i])
+			}
+			out, err := kd.SopsDecryptWithFormat(encData, format, format)
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				for _, i := range tt.identities {
+					g.Expect(err.Error()).To(ContainSubstring("key group %d [age]: decrypted", i+1))
+				}
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(out).To(Equal(data))
+		})
+	}
+}
+
+// keyTypeService is a keyservice.KeyServiceClient which "decrypts" the data
+// key of the allowed key types by returning the ciphertext.
+type keyTypeService struct {
+	allowed []string
+}
+
+func (s keyTypeService) Encrypt(context.Context, *keyservice.EncryptRequest, ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s keyTypeService) Decrypt(_ context.Context, req *keyservice.DecryptRequest, _ ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	if !slices.Contains(s.allowed, keyProvider(req.GetKey())) {
+		return nil, errors.New("access denied")
+	}
+	return &keyservice.DecryptResponse{Plaintext: req.Ciphertext}, nil
+}
+
+func Test_sopsDataKey(t *testing.T) {
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	kmsKey := func(share []byte) keys.MasterKey {
+		return &awskms.MasterKey{Arn: "arn:aws:kms:us-west-2:107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48", EncryptedKey: string(share)}
+	}
+	azkvKey := func(share []byte) keys.MasterKey {
+		return &azkv.MasterKey{VaultURL: "https://myvault.vault.azure.net", Name: "key-name", Version: "1", EncryptedKey: string(share)}
+	}
+	ageKey := func(share []byte) keys.MasterKey {
+		return &age.MasterKey{Recipient: "age1l44xcng8dqj32nlv6d930qvvrny05hglzcv9qpc7kxjc6902ma4qufys29", EncryptedKey: string(share)}
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		groups    []func(share []byte) keys.MasterKey
+		allowed   []string
+		wantErr   string
+	}{
+		{
+			name:      "two KMS providers with threshold 2",
+			threshold: 2,
+			groups:    []func([]byte) keys.MasterKey{kmsKey, azkvKey},
+			allowed:   []string{ProviderAWSKMS, ProviderAzureKeyVault},
+		},
+		{
+			name:      "two KMS providers with threshold 2 and one denied",
+			threshold: 2,
+			groups:    []func([]byte) keys.MasterKey{kmsKey, azkvKey},
+			allowed:   []string{ProviderAWSKMS},
+			wantErr: "1 of 2 required key groups decrypted: key group 1 [kms]: decrypted, " +
+				"key group 2 [azure_kv]: failed (azure_kv key 'https://myvault.vault.azure.net/keys/key-name/1': access denied)",
+		},
+		{
+			name:      "two KMS providers with threshold 1 and one denied",
+			threshold: 1,
+			groups:    []func([]byte) keys.MasterKey{kmsKey, azkvKey},
+			allowed:   []string{ProviderAzureKeyVault},
+		},
+		{
+			name:      "three groups with threshold 2 and one denied",
+			threshold: 2,
+			groups:    []func([]byte) keys.MasterKey{kmsKey, azkvKey, ageKey},
+			allowed:   []string{ProviderAWSKMS, ProviderAge},
+		},
+		{
+			name:      "three groups with threshold 2 and two denied",
+			threshold: 2,
+			groups:    []func([]byte) keys.MasterKey{kmsKey, azkvKey, ageKey},
+			allowed:   []string{ProviderAge},
+			wantErr:   "1 of 2 required key groups decrypted: key group 1 [kms]: failed",
+		},
+		{
+			name:      "three groups with threshold 1",
+			threshold: 1,
+			groups:    []func([]byte) keys.MasterKey{kmsKey, azkvKey, ageKey},
+			allowed:   []string{ProviderAge},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			shares := make([][]byte, len(tt.groups))
+			if tt.threshold > 1 {
+				var err error
+				shares, err = shamir.Split(dataKey, len(tt.groups), tt.threshold)
+				g.Expect(err).ToNot(HaveOccurred())
+			} else {
+				for i := range shares {
+					shares[i] = dataKey
+				}
+			}
+			metadata := sops.Metadata{ShamirThreshold: tt.threshold}
+			for i, key := range tt.groups {
+				metadata.KeyGroups = append(metadata.KeyGroups, sops.KeyGroup{key(shares[i])})
+			}
+
+			got, err := sopsDataKey(metadata, []keyservice.KeyServiceClient{keyTypeService{allowed: tt.allowed}})
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				g.Expect(got).To(BeNil())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(dataKey))
+		})
+	}
+}
+
+func TestDecryptor_SopsDecryptWithFormat_DecryptionError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantReason string
+	}{
+		{
+			name:       "access denied",
+			err:        &intazkv.KeyVaultError{Class: intazkv.ErrorClassAccessDenied, Err: errors.New("forbidden")},
+			wantReason: kustomizev1.DecryptionAccessDeniedReason,
+		},
+		{
+			name:       "throttled",
+			err:        &intazkv.KeyVaultError{Class: intazkv.ErrorClassThrottled, Err: errors.New("too many requests")},
+			wantReason: kustomizev1.DecryptionThrottledReason,
+		},
+		{
+			name:       "connection failed",
+			err:        fmt.Errorf("wrapped: %w", &intazkv.KeyVaultError{Class: intazkv.ErrorClassConnectionFailed, Err: errors.New("no such host")}),
+			wantReason: kustomizev1.DecryptionConnectionFailedReason,
+		},
+		{
+			name: "unclassified",
+			err:  errors.New("some error"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
 
-	t.Run("decrypt JSON to YAML", func(t *testing.T) {
-		g := NewWithT(t)
+			ageID, err := extage.GenerateX25519Identity()
+			g.Expect(err).ToNot(HaveOccurred())
 
-		ageID, err := extage.GenerateX25519Identity()
-		g.Expect(err).ToNot(HaveOccurred())
+			format := formats.Json
+			encData, err := (&Decryptor{}).sopsEncryptWithFormat(sops.Metadata{
+				KeyGroups: []sops.KeyGroup{
+					{&age.MasterKey{Recipient: ageID.Recipient().String()}},
+				},
+			}, []byte(`{"key": "value"}`), format, format)
+			g.Expect(err).ToNot(HaveOccurred())
 
-		kd := &Decryptor{
-			checkSopsMac:  true,
-			ageIdentities: age.ParsedIdentities{ageID},
-		}
+			kd := &Decryptor{
+				keyServices: []keyservice.KeyServiceClient{failingKeyService{err: tt.err}},
+			}
+			kd.localServiceOnce.Do(func() {})
 
-		inputFormat, outputFormat := formats.Json, formats.Yaml
-		data := []byte("{\"key\": \"value\"}\n")
-		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
-			KeyGroups: []sops.KeyGroup{
-				{&age.MasterKey{Recipient: ageID.Recipient().String()}},
-			},
-		}, data, inputFormat, inputFormat)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[inputFormat])).To(BeTrue())
+			data, err := kd.SopsDecryptWithFormat(encData, format, format)
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(data).To(BeNil())
+			g.Expect(err.Error()).To(ContainSubstring("cannot get sops data key"))
 
-		out, err := kd.SopsDecryptWithFormat(encData, inputFormat, outputFormat)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(out).To(Equal([]byte("key: value\n")))
-	})
+			var decErr *DecryptionError
+			if tt.wantReason == "" {
+				g.Expect(errors.As(err, &decErr)).To(BeFalse())
+				return
+			}
+			g.Expect(errors.As(err, &decErr)).To(BeTrue())
+			g.Expect(decErr.Reason).To(Equal(tt.wantReason))
+		})
+	}
+}
 
-	t.Run("invalid JSON data", func(t *testing.T) {
-		g := NewWithT(t)
+func TestDecryptor_SopsDecryptWithFormat_VaultAddressAllowlist(t *testing.T) {
+	tests := []struct {
+		name       string
+		address    string
+		allowlist  []string
+		wantErr    string
+		wantReason string
+	}{
+		{
+			name:    "no allowlist",
+			address: "https://attacker.example.com",
+		},
+		{
+			name:      "allowed address",
+			address:   "https://Vault.example.com:8200/",
+			allowlist: []string{"https://vault.example.com:8200"},
+		},
+		{
+			name:       "address not allowed",
+			address:    "https://attacker.example.com",
+			allowlist:  []string{"https://vault.example.com:8200"},
+			wantErr:    "hc_vault key 'sops' refers to Vault address 'https://attacker.example.com' which is not allowed, must be one of: https://vault.example.com:8200",
+			wantReason: kustomizev1.DecryptionPolicyViolationReason,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
 
-		format := formats.Json
-		data, err := (&Decryptor{}).SopsDecryptWithFormat([]byte("invalid json"), format, format)
-		g.Expect(err).To(HaveOccurred())
-		g.Expect(err.Error()).To(ContainSubstring("failed to load encrypted JSON data"))
-		g.Expect(data).To(BeNil())
-	})
+			svc := &dataKeyKeyService{}
+			kd := &Decryptor{
+				keyServices:           []keyservice.KeyServiceClient{svc},
+				vaultAddressAllowlist: tt.allowlist,
+			}
+			kd.localServiceOnce.Do(func() {})
 
-	t.Run("no data key", func(t *testing.T) {
-		g := NewWithT(t)
+			format := formats.Json
+			encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
+				KeyGroups: []sops.KeyGroup{
+					{hcvault.NewMasterKey(tt.address, "team-a/transit", "sops")},
+				},
+			}, []byte(`{"key": "value"}`), format, format)
+			g.Expect(err).ToNot(HaveOccurred())
 
-		ageID, err := extage.GenerateX25519Identity()
-		g.Expect(err).ToNot(HaveOccurred())
+			data, err := kd.SopsDecryptWithFormat(encData, format, format)
+			if tt.wantErr == "" {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(string(data)).To(ContainSubstring(`"key": "value"`))
+				g.Expect(svc.decrypts).To(Equal(1))
+				return
+			}
+			g.Expect(err).To(MatchError(tt.wantErr))
+			var decErr *DecryptionError
+			g.Expect(errors.As(err, &decErr)).To(BeTrue())
+			g.Expect(decErr.Reason).To(Equal(tt.wantReason))
+			g.Expect(svc.decrypts).To(BeZero())
+		})
+	}
+}
 
-		kd := &Decryptor{}
+// dataKeyKeyService is a keyservice.KeyServiceClient "encrypting" the data
+// key by keeping it, and counting the decryption requests.
+type dataKeyKeyService struct {
+	dataKey  []byte
+	decrypts int
+}
 
-		format := formats.Binary
-		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
-			KeyGroups: []sops.KeyGroup{
-				{&age.MasterKey{Recipient: ageID.Recipient().String()}},
-			},
-		}, []byte("foo bar"), format, format)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
+func (f *dataKeyKeyService) Encrypt(_ context.Context, req *keyservice.EncryptRequest, _ ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	// Like a real key service, the data key is not aliased, as the caller
+	// wipes it after use.
+	f.dataKey = bytes.Clone(req.Plaintext)
+	return &keyservice.EncryptResponse{Ciphertext: []byte("vault:v1:encrypted")}, nil
+}
 
-		data, err := kd.SopsDecryptWithFormat(encData, format, format)
-		g.Expect(err).To(HaveOccurred())
-		g.Expect(err.Error()).To(ContainSubstring("cannot get sops data key"))
-		g.Expect(data).To(BeNil())
-	})
+func (f *dataKeyKeyService) Decrypt(_ context.Context, _ *keyservice.DecryptRequest, _ ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	f.decrypts++
+	return &keyservice.DecryptResponse{Plaintext: bytes.Clone(f.dataKey)}, nil
+}
 
-	t.Run("with mac check", func(t *testing.T) {
-		g := NewWithT(t)
+// recordingKeyService is a keyservice.KeyServiceClient which "encrypts" the
+// data key by keeping it, and records the data key it is asked to encrypt
+// and the data keys it returns.
+type recordingKeyService struct {
+	dataKey   []byte
+	encrypted []byte
+	decrypted [][]byte
+}
 
-		ageID, err := extage.GenerateX25519Identity()
-		g.Expect(err).ToNot(HaveOccurred())
+func (f *recordingKeyService) Encrypt(_ context.Context, req *keyservice.EncryptRequest, _ ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	f.dataKey, f.encrypted = bytes.Clone(req.Plaintext), req.Plaintext
+	return &keyservice.EncryptResponse{Ciphertext: []byte("vault:v1:encrypted")}, nil
+}
 
-		kd := &Decryptor{
-			checkSopsMac:  true,
-			ageIdentities: age.ParsedIdentities{ageID},
-		}
+func (f *recordingKeyService) Decrypt(_ context.Context, _ *keyservice.DecryptRequest, _ ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	dataKey := bytes.Clone(f.dataKey)
+	f.decrypted = append(f.decrypted, dataKey)
+	return &keyservice.DecryptResponse{Plaintext: dataKey}, nil
+}
 
-		format := formats.Dotenv
-		data := []byte("key=value\n")
-		encData, err := kd.sopsEncryptWithFormat(sops.Metadata{
-			KeyGroups: []sops.KeyGroup{
-				{&age.MasterKey{Recipient: ageID.Recipient().String()}},
-			},
-		}, data, format, format)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(bytes.Contains(encData, sopsFormatToMarkerBytes[format])).To(BeTrue())
+// failingKeyService is a keyservice.KeyServiceClient failing all requests
+// with err.
+type failingKeyService struct {
+	err error
+}
 
-		out, err := kd.SopsDecryptWithFormat(encData, format, format)
-		g.Expect(err).ToNot(HaveOccurred())
-		g.Expect(out).To(Equal(data))
+func (f failingKeyService) Encrypt(_ context.Context, _ *keyservice.EncryptRequest, _ ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	return nil, f.err
+}
 
-		badMAC := regexp.MustCompile("(?m)[\r\n]+^.*sops_mac=.*$")
-		badMACData := badMAC.ReplaceAll(encData, []byte("\nsops_mac=\n"))
-		out, err = kd.SopsDecryptWithFormat(badMACData, format, format)
-		g.Expect(err).To(HaveOccurred())
-		g.Expect(err.Error()).To(ContainSubstring("failed to verify sops data integrity: expected mac 'no MAC'"))
-		g.Expect(out).To(BeNil())
-	})
+func (f failingKeyService) Decrypt(_ context.Context, _ *keyservice.DecryptRequest, _ ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	return nil, f.err
 }
 
 func TestDecryptor_DecryptResource(t *testing.T) {
@@ -757,15 +3908,109 @@ func TestDecryptor_decryptKustomizationSources(t *testing.T) {
 		expectData     bool
 	}
 	binaryFormat := formats.Binary
+	dotenvFormat := formats.Dotenv
 	tests := []struct {
-		name            string
-		wordirSuffix    string
-		path            string
-		files           []file
-		secretGenerator []kustypes.SecretArgs
-		expectVisited   []string
-		wantErr         error
+		name                  string
+		wordirSuffix          string
+		path                  string
+		files                 []file
+		secretGenerator       []kustypes.SecretArgs
+		configMapGenerator    []kustypes.ConfigMapArgs
+		patches               []kustypes.Patch
+		patchesStrategicMerge []kustypes.PatchStrategicMerge
+		patchesJson6902       []kustypes.Patch
+		expectVisited         []string
+		wantErr               error
 	}{
+		{
+			name: "decrypt patch files",
+			files: []file{
+				{name: "patches/ingress.enc.yaml", data: []byte("metadata:\n    annotations:\n        basic-auth: secret\n"), encrypt: true, expectData: true},
+				{name: "patches/deployment.enc.yaml", data: []byte("spec:\n    replicas: 2\n"), encrypt: true, expectData: true},
+				// JSON 6902 patches are lists, which can only be encrypted as whole-file binary.
+				{name: "patches/service.enc.json", data: []byte(`[{"op": "add", "path": "/metadata/labels/app", "value": "secret"}]`), originalFormat: &binaryFormat, encrypt: true, expectData: true},
+				{name: "patches/plain.yaml", data: []byte("spec:\n  replicas: 3\n"), expectData: true},
+			},
+			patches: []kustypes.Patch{
+				{Path: "patches/ingress.enc.yaml"},
+				{Patch: "- op: add\n  path: /metadata/labels/inline\n  value: value\n"},
+			},
+			patchesStrategicMerge: []kustypes.PatchStrategicMerge{
+				"patches/deployment.enc.yaml",
+				"patches/plain.yaml",
+				"apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\n",
+				`{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "app"}}`,
+			},
+			patchesJson6902: []kustypes.Patch{
+				{Path: "patches/service.enc.json"},
+			},
+			expectVisited: []string{"patches/ingress.enc.yaml", "patches/deployment.enc.yaml", "patches/plain.yaml", "patches/service.enc.json"},
+		},
+		{
+			name:         "error on patch reference outside root",
+			wordirSuffix: "subdir",
+			path:         "./",
+			files: []file{
+				{name: "patch.yaml", data: []byte("spec:\n  replicas: 2\n"), encrypt: true, expectData: false},
+			},
+			patchesStrategicMerge: []kustypes.PatchStrategicMerge{"../patch.yaml"},
+			wantErr:               &fs.PathError{Op: "resolve", Path: "../patch.yaml", Err: errRefOutsideRoot},
+			expectVisited:         []string{},
+		},
+		{
+			name: "decrypt configmap generator sources",
+			files: []file{
+				{name: "app.env", data: []byte("var1=value1\n"), encrypt: true, expectData: true},
+				{name: "config.ini", data: []byte("[server]\nport = 8080\n"), encrypt: true, expectData: true},
+				{name: "legacy.env", data: []byte("var2=value2\n"), encrypt: true, expectData: true},
+			},
+			configMapGenerator: []kustypes.ConfigMapArgs{
+				{
+					GeneratorArgs: kustypes.GeneratorArgs{
+						Name: "envConfigMap",
+						KvPairSources: kustypes.KvPairSources{
+							FileSources: []string{"config.ini"},
+							EnvSources:  []string{"app.env"},
+							EnvSource:   "legacy.env",
+						},
+					},
+				},
+			},
+			expectVisited: []string{"app.env", "config.ini", "legacy.env"},
+		},
+		{
+			name: "decrypt sources encrypted with another input type than their extension",
+			files: []file{
+				// Encrypted with "sops --input-type dotenv".
+				{name: "app.enc", data: []byte("var1=value1\n"), originalFormat: &dotenvFormat, encrypt: true, expectData: true},
+				{name: "file.yaml", data: []byte("var2=value2\n"), originalFormat: &dotenvFormat, encrypt: true, expectData: true},
+				// Encrypted as whole-file binary.
+				{name: "secrets.enc", data: []byte("var3=value3\n"), originalFormat: &binaryFormat, encrypt: true, expectData: true},
+				{name: "cert.enc", data: []byte("-----BEGIN CERTIFICATE-----\n..."), originalFormat: &binaryFormat, encrypt: true, expectData: true},
+			},
+			secretGenerator: []kustypes.SecretArgs{
+				{
+					GeneratorArgs: kustypes.GeneratorArgs{
+						Name: "envSecret",
+						KvPairSources: kustypes.KvPairSources{
+							FileSources: []string{"tls.crt=cert.enc", "file.yaml"},
+							EnvSources:  []string{"secrets.enc"},
+						},
+					},
+				},
+			},
+			configMapGenerator: []kustypes.ConfigMapArgs{
+				{
+					GeneratorArgs: kustypes.GeneratorArgs{
+						Name: "envConfigMap",
+						KvPairSources: kustypes.KvPairSources{
+							EnvSources: []string{"app.enc"},
+						},
+					},
+				},
+			},
+			expectVisited: []string{"app.enc", "cert.enc", "file.yaml", "secrets.enc"},
+		},
 		{
 			name: "decrypt env sources",
 			path: "subdir",
@@ -843,7 +4088,7 @@ func TestDecryptor_decryptKustomizationSources(t *testing.T) {
 					},
 				},
 			},
-			wantErr:       &fs.PathError{Op: "lstat", Path: "otherdir/data.env", Err: fmt.Errorf("")},
+			wantErr:       &fs.PathError{Op: "resolve", Path: "symlink", Err: errSymlinkOutsideRoot},
 			expectVisited: []string{},
 		},
 		{
@@ -863,71 +4108,204 @@ func TestDecryptor_decryptKustomizationSources(t *testing.T) {
 					},
 				},
 			},
-			wantErr:       &fs.PathError{Op: "lstat", Path: "data.env", Err: fmt.Errorf("")},
-			expectVisited: []string{},
+			wantErr:       &fs.PathError{Op: "resolve", Path: "../data.env", Err: errRefOutsideRoot},
+			expectVisited: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			tmpDir := t.TempDir()
+			root := filepath.Join(tmpDir, tt.wordirSuffix)
+
+			id, err := extage.GenerateX25519Identity()
+			g.Expect(err).ToNot(HaveOccurred())
+			ageIdentities := age.ParsedIdentities{id}
+
+			d := &Decryptor{
+				root:          root,
+				ageIdentities: ageIdentities,
+			}
+
+			for _, f := range tt.files {
+				fPath := filepath.Join(tmpDir, f.name)
+				g.Expect(os.MkdirAll(filepath.Dir(fPath), 0o700)).To(Succeed())
+				if f.symlink != "" {
+					g.Expect(os.Symlink(f.symlink, fPath)).To(Succeed())
+					continue
+				}
+				data := f.data
+				if f.encrypt {
+					var format formats.Format
+					if f.originalFormat != nil {
+						format = *f.originalFormat
+					} else {
+						format = formats.FormatForPath(f.name)
+					}
+					data, err = d.sopsEncryptWithFormat(sops.Metadata{
+						KeyGroups: []sops.KeyGroup{
+							{&age.MasterKey{Recipient: id.Recipient().String()}},
+						},
+					}, f.data, format, format)
+					g.Expect(err).ToNot(HaveOccurred())
+					g.Expect(data).ToNot(Equal(f.data))
+				}
+				g.Expect(os.WriteFile(fPath, data, 0o600)).To(Succeed())
+			}
+
+			visited := make(map[string]struct{}, 0)
+			visit := d.decryptKustomizationSources(visited, nil)
+			kus := &kustypes.Kustomization{
+				SecretGenerator:       tt.secretGenerator,
+				ConfigMapGenerator:    tt.configMapGenerator,
+				Patches:               tt.patches,
+				PatchesStrategicMerge: tt.patchesStrategicMerge,
+				PatchesJson6902:       tt.patchesJson6902,
+			}
+
+			err = visit(root, tt.path, kus)
+			if tt.wantErr == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+			} else {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err).To(BeAssignableToTypeOf(tt.wantErr))
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr.Error()))
+			}
+
+			for _, f := range tt.files {
+				if f.symlink != "" {
+					continue
+				}
+
+				b, err := os.ReadFile(filepath.Join(tmpDir, f.name))
+				g.Expect(err).ToNot(HaveOccurred())
+				if f.expectData {
+					g.Expect(b).To(Equal(f.data))
+				} else {
+					g.Expect(b).ToNot(Equal(f.data))
+				}
+			}
+
+			absVisited := make(map[string]struct{}, 0)
+			for _, v := range tt.expectVisited {
+				absVisited[filepath.Join(tmpDir, v)] = struct{}{}
+			}
+			g.Expect(visited).To(Equal(absVisited))
+		})
+	}
+}
+
+func TestDecryptor_DecryptSources(t *testing.T) {
+	type file struct {
+		name       string
+		data       []byte
+		encrypt    bool
+		expectData bool
+	}
+	tests := []struct {
+		name    string
+		path    string
+		paths   []string
+		files   []file
+		wantErr error
+	}{
+		{
+			name: "decrypt files of sibling base outside the kustomization directory",
+			path: "apps/prod",
+			files: []file{
+				{name: "apps/prod/kustomization.yaml", data: []byte("resources:\n- ../base\n")},
+				{name: "apps/base/kustomization.yaml", data: []byte("secretGenerator:\n- name: credentials\n  files:\n  - ../shared/credentials.enc.yaml\n  envs:\n  - ../../shared/app.env\n")},
+				{name: "apps/shared/credentials.enc.yaml", data: []byte("password: secret\n"), encrypt: true, expectData: true},
+				{name: "shared/app.env", data: []byte("key=value\n"), encrypt: true, expectData: true},
+			},
+		},
+		{
+			name: "error on reference outside the root",
+			path: "prod",
+			files: []file{
+				{name: "prod/kustomization.yaml", data: []byte("resources:\n- ../base\n")},
+				{name: "base/kustomization.yaml", data: []byte("secretGenerator:\n- name: passwd\n  files:\n  - ../../etc/passwd\n")},
+				// The reference must not be scoped to this file inside the root.
+				{name: "etc/passwd", data: []byte("root:x:0:0:root:/root:/bin/sh\n"), encrypt: true},
+			},
+			wantErr: &fs.PathError{Op: "resolve", Path: "../etc/passwd", Err: errRefOutsideRoot},
+		},
+		{
+			name:  "decrypt files matching decryption paths",
+			path:  "apps",
+			paths: []string{"secrets/**/*.enc.yaml", "../shared/*.env"},
+			files: []file{
+				{name: "apps/kustomization.yaml", data: []byte("configMapGenerator:\n- name: config\n  files:\n  - config.yaml\n  - secrets/db/password.enc.yaml\n  - secrets/token.enc.yaml\n  - other/token.enc.yaml\n  envs:\n  - ../shared/app.env\n")},
+				// Matches, but is not encrypted.
+				{name: "apps/config.yaml", data: []byte("key: value\n")},
+				{name: "apps/secrets/db/password.enc.yaml", data: []byte("password: secret\n"), encrypt: true, expectData: true},
+				{name: "apps/secrets/token.enc.yaml", data: []byte("token: secret\n"), encrypt: true, expectData: true},
+				{name: "apps/other/token.enc.yaml", data: []byte("token: secret\n"), encrypt: true, expectData: false},
+				{name: "shared/app.env", data: []byte("key=value\n"), encrypt: true, expectData: true},
+			},
+		},
+		{
+			name:  "error on invalid decryption path",
+			path:  "apps",
+			paths: []string{"secrets/[*.yaml"},
+			files: []file{
+				{name: "apps/kustomization.yaml", data: []byte("secretGenerator:\n- name: token\n  files:\n  - secrets/token.yaml\n")},
+				{name: "apps/secrets/token.yaml", data: []byte("token: secret\n"), encrypt: true, expectData: false},
+			},
+			wantErr: fmt.Errorf("invalid decryption path 'secrets/[*.yaml': %w", path.ErrBadPattern),
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			g := NewWithT(t)
 
-			tmpDir := t.TempDir()
-			root := filepath.Join(tmpDir, tt.wordirSuffix)
+			root := t.TempDir()
 
 			id, err := extage.GenerateX25519Identity()
 			g.Expect(err).ToNot(HaveOccurred())
-			ageIdentities := age.ParsedIdentities{id}
 
 			d := &Decryptor{
-				root:          root,
-				ageIdentities: ageIdentities,
+				root: root,
+				kustomization: &kustomizev1.Kustomization{
+					Spec: kustomizev1.KustomizationSpec{
+						Decryption: &kustomizev1.Decryption{
+							Provider: DecryptionProviderSOPS,
+							Paths:    tt.paths,
+						},
+					},
+				},
+				ageIdentities: age.ParsedIdentities{id},
 			}
 
 			for _, f := range tt.files {
-				fPath := filepath.Join(tmpDir, f.name)
+				fPath := filepath.Join(root, f.name)
 				g.Expect(os.MkdirAll(filepath.Dir(fPath), 0o700)).To(Succeed())
-				if f.symlink != "" {
-					g.Expect(os.Symlink(f.symlink, fPath)).To(Succeed())
-					continue
-				}
 				data := f.data
 				if f.encrypt {
-					var format formats.Format
-					if f.originalFormat != nil {
-						format = *f.originalFormat
-					} else {
-						format = formats.FormatForPath(f.name)
-					}
+					format := formats.FormatForPath(f.name)
 					data, err = d.sopsEncryptWithFormat(sops.Metadata{
 						KeyGroups: []sops.KeyGroup{
 							{&age.MasterKey{Recipient: id.Recipient().String()}},
 						},
 					}, f.data, format, format)
 					g.Expect(err).ToNot(HaveOccurred())
-					g.Expect(data).ToNot(Equal(f.data))
 				}
 				g.Expect(os.WriteFile(fPath, data, 0o600)).To(Succeed())
 			}
 
-			visited := make(map[string]struct{}, 0)
-			visit := d.decryptKustomizationSources(visited)
-			kus := &kustypes.Kustomization{SecretGenerator: tt.secretGenerator}
-
-			err = visit(root, tt.path, kus)
+			err = d.DecryptSources(filepath.Join(root, tt.path))
 			if tt.wantErr == nil {
 				g.Expect(err).ToNot(HaveOccurred())
 			} else {
-				g.Expect(err).To(HaveOccurred())
-				g.Expect(err).To(BeAssignableToTypeOf(tt.wantErr))
-				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr.Error()))
+				g.Expect(err).To(MatchError(tt.wantErr.Error()))
 			}
 
 			for _, f := range tt.files {
-				if f.symlink != "" {
+				if !f.encrypt {
 					continue
 				}
-
-				b, err := os.ReadFile(filepath.Join(tmpDir, f.name))
+				b, err := os.ReadFile(filepath.Join(root, f.name))
 				g.Expect(err).ToNot(HaveOccurred())
 				if f.expectData {
 					g.Expect(b).To(Equal(f.data))
@@ -935,16 +4313,311 @@ func TestDecryptor_decryptKustomizationSources(t *testing.T) {
 					g.Expect(b).ToNot(Equal(f.data))
 				}
 			}
+		})
+	}
+}
 
-			absVisited := make(map[string]struct{}, 0)
-			for _, v := range tt.expectVisited {
-				absVisited[filepath.Join(tmpDir, v)] = struct{}{}
+func TestDecryptor_DecryptSources_DetectsEncryptedFiles(t *testing.T) {
+	g := NewWithT(t)
+
+	root := t.TempDir()
+	id, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+	d := &Decryptor{
+		root: root,
+		kustomization: &kustomizev1.Kustomization{
+			Spec: kustomizev1.KustomizationSpec{
+				Decryption: &kustomizev1.Decryption{
+					Provider: DecryptionProviderSOPS,
+				},
+			},
+		},
+		ageIdentities: age.ParsedIdentities{id},
+	}
+	encrypt := func(data []byte, format formats.Format) []byte {
+		encrypted, err := d.sopsEncryptWithFormat(sops.Metadata{
+			KeyGroups: []sops.KeyGroup{
+				{&age.MasterKey{Recipient: id.Recipient().String()}},
+			},
+		}, data, format, format)
+		g.Expect(err).ToNot(HaveOccurred())
+		return encrypted
+	}
+
+	// The SOPS metadata of a large file is beyond the start of the file
+	// which is sniffed.
+	var large bytes.Buffer
+	for i := range 4096 {
+		fmt.Fprintf(&large, "key%d: value%d\n", i, i)
+	}
+	random := make([]byte, 3*sopsSniffSize)
+	_, err = rand.Read(random)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	files := []struct {
+		name      string
+		plain     []byte
+		format    formats.Format
+		encrypted bool
+	}{
+		{name: "token", plain: []byte("secret-token"), format: formats.Binary, encrypted: true},
+		{name: "ca-bundle.pem.enc", plain: []byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"), format: formats.Binary, encrypted: true},
+		{name: "config", plain: []byte("password: secret\n"), format: formats.Yaml, encrypted: true},
+		{name: "large.enc", plain: large.Bytes(), format: formats.Yaml, encrypted: true},
+		{name: "notes", plain: []byte("encrypted with sops\nsops: true\n[sops]\nmac = none\n")},
+		{name: "settings.ini", plain: []byte("[sops]\nversion = 3\n")},
+		{name: "random.bin", plain: random},
+	}
+	kus := "secretGenerator:\n- name: files\n  files:\n"
+	for _, f := range files {
+		data := f.plain
+		if f.encrypted {
+			data = encrypt(f.plain, f.format)
+		}
+		g.Expect(os.WriteFile(filepath.Join(root, f.name), data, 0o600)).To(Succeed())
+		kus += fmt.Sprintf("  - %s\n", f.name)
+	}
+	g.Expect(os.WriteFile(filepath.Join(root, "kustomization.yaml"), []byte(kus), 0o600)).To(Succeed())
+
+	g.Expect(d.DecryptSources(root)).To(Succeed())
+	for _, f := range files {
+		b, err := os.ReadFile(filepath.Join(root, f.name))
+		g.Expect(err).ToNot(HaveOccurred())
+		if f.format == formats.Yaml {
+			g.Expect(b).To(MatchYAML(f.plain), f.name)
+			continue
+		}
+		// Files which are not encrypted are left untouched byte-for-byte.
+		g.Expect(b).To(Equal(f.plain), f.name)
+	}
+}
+
+func TestDecryptor_DecryptSources_MACMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+	}{
+		{
+			name: "corrupted encrypted value",
+			corrupt: func(data []byte) []byte {
+				// Flip a byte of the ciphertext of the first encrypted value.
+				i := bytes.Index(data, []byte("ENC[AES256_GCM,data:")) + len("ENC[AES256_GCM,data:")
+				corrupted := slices.Clone(data)
+				if corrupted[i] == 'A' {
+					corrupted[i] = 'B'
+				} else {
+					corrupted[i] = 'A'
+				}
+				return corrupted
+			},
+		},
+		{
+			name: "corrupted unencrypted value",
+			corrupt: func(data []byte) []byte {
+				return bytes.Replace(data, []byte("user_unencrypted: admin"), []byte("user_unencrypted: admim"), 1)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			root := t.TempDir()
+
+			id, err := extage.GenerateX25519Identity()
+			g.Expect(err).ToNot(HaveOccurred())
+
+			d := &Decryptor{
+				root: root,
+				kustomization: &kustomizev1.Kustomization{
+					Spec: kustomizev1.KustomizationSpec{
+						Decryption: &kustomizev1.Decryption{
+							Provider: DecryptionProviderSOPS,
+						},
+					},
+				},
+				ageIdentities: age.ParsedIdentities{id},
 			}
-			g.Expect(visited).To(Equal(absVisited))
+
+			plain := []byte("password: secret\nuser_unencrypted: admin\n")
+			encrypted, err := d.sopsEncryptWithFormat(sops.Metadata{
+				KeyGroups: []sops.KeyGroup{
+					{&age.MasterKey{Recipient: id.Recipient().String()}},
+				},
+				UnencryptedSuffix: "_unencrypted",
+			}, plain, formats.Yaml, formats.Yaml)
+			g.Expect(err).ToNot(HaveOccurred())
+			corrupted := tt.corrupt(encrypted)
+			g.Expect(corrupted).ToNot(Equal(encrypted))
+
+			g.Expect(os.MkdirAll(filepath.Join(root, "secrets"), 0o700)).To(Succeed())
+			g.Expect(os.WriteFile(filepath.Join(root, "kustomization.yaml"),
+				[]byte("secretGenerator:\n- name: credentials\n  files:\n  - secrets/credentials.yaml\n"), 0o600)).To(Succeed())
+			g.Expect(os.WriteFile(filepath.Join(root, "secrets/credentials.yaml"), corrupted, 0o600)).To(Succeed())
+
+			err = d.DecryptSources(root)
+			g.Expect(err).To(HaveOccurred())
+			var decErr *DecryptionError
+			g.Expect(errors.As(err, &decErr)).To(BeTrue())
+			g.Expect(decErr.Reason).To(Equal(kustomizev1.SOPSMACMismatchReason))
+			g.Expect(err.Error()).To(HavePrefix("'secrets/credentials.yaml': "))
+
+			// The file is left encrypted.
+			b, err := os.ReadFile(filepath.Join(root, "secrets/credentials.yaml"))
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(b).To(Equal(corrupted))
+		})
+	}
+}
+
+func TestDecryptor_DecryptKustomizationFiles(t *testing.T) {
+	for _, kfile := range []string{"kustomization.yaml", "kustomization.yml", "Kustomization"} {
+		t.Run(kfile, func(t *testing.T) {
+			g := NewWithT(t)
+
+			root := t.TempDir()
+
+			id, err := extage.GenerateX25519Identity()
+			g.Expect(err).ToNot(HaveOccurred())
+
+			d := &Decryptor{
+				root: root,
+				kustomization: &kustomizev1.Kustomization{
+					Spec: kustomizev1.KustomizationSpec{
+						Decryption: &kustomizev1.Decryption{
+							Provider: DecryptionProviderSOPS,
+						},
+					},
+				},
+				ageIdentities: age.ParsedIdentities{id},
+			}
+			encrypt := func(data []byte, format formats.Format) []byte {
+				encrypted, err := d.sopsEncryptWithFormat(sops.Metadata{
+					KeyGroups: []sops.KeyGroup{
+						{&age.MasterKey{Recipient: id.Recipient().String()}},
+					},
+				}, data, format, format)
+				g.Expect(err).ToNot(HaveOccurred())
+				return encrypted
+			}
+
+			// The encrypted Kustomization file embeds secret literals, and
+			// refers to a base of which the Kustomization file and the
+			// generator sources are encrypted as well.
+			files := map[string][]byte{
+				kfile: encrypt([]byte(`resources:
+- base
+configMapGenerator:
+- name: app
+  literals:
+  - token=secret
+generatorOptions:
+  disableNameSuffixHash: true
+`), formats.Yaml),
+				"base/kustomization.yaml": encrypt([]byte(`secretGenerator:
+- name: credentials
+  envs:
+  - credentials.env
+`), formats.Yaml),
+				"base/credentials.env": encrypt([]byte("password=secret\n"), formats.Dotenv),
+			}
+			for name, data := range files {
+				g.Expect(os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o700)).To(Succeed())
+				g.Expect(os.WriteFile(filepath.Join(root, name), data, 0o600)).To(Succeed())
+			}
+
+			g.Expect(d.DecryptKustomizationFiles(root)).To(Succeed())
+			for _, name := range []string{kfile, "base/kustomization.yaml"} {
+				kus, err := secureLoadKustomizationFile(root, filepath.Dir(name))
+				g.Expect(err).ToNot(HaveOccurred())
+				if name == kfile {
+					g.Expect(kus.Resources).To(Equal([]string{"base"}))
+					g.Expect(kus.ConfigMapGenerator[0].LiteralSources).To(Equal([]string{"token=secret"}))
+					g.Expect(kus.GeneratorOptions.DisableNameSuffixHash).To(BeTrue())
+				} else {
+					g.Expect(kus.SecretGenerator[0].EnvSources).To(Equal([]string{"credentials.env"}))
+				}
+			}
+
+			// The sources of the decrypted Kustomization files are decrypted
+			// next.
+			g.Expect(d.DecryptSources(root)).To(Succeed())
+			data, err := os.ReadFile(filepath.Join(root, "base/credentials.env"))
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(string(data)).To(Equal("password=secret\n"))
 		})
 	}
 }
 
+func TestDecryptor_DecryptKustomizationFiles_Unencrypted(t *testing.T) {
+	g := NewWithT(t)
+
+	root := t.TempDir()
+	d := &Decryptor{
+		root: root,
+		kustomization: &kustomizev1.Kustomization{
+			Spec: kustomizev1.KustomizationSpec{
+				Decryption: &kustomizev1.Decryption{
+					Provider: DecryptionProviderSOPS,
+				},
+			},
+		},
+	}
+
+	// A missing Kustomization file is left to the generator.
+	g.Expect(d.DecryptKustomizationFiles(root)).To(Succeed())
+
+	kus := []byte("resources:\n- base\n- deployment.yaml\n")
+	g.Expect(os.WriteFile(filepath.Join(root, "kustomization.yaml"), kus, 0o600)).To(Succeed())
+	g.Expect(os.Mkdir(filepath.Join(root, "base"), 0o700)).To(Succeed())
+	g.Expect(os.WriteFile(filepath.Join(root, "base", "kustomization.yaml"), []byte("resources: []\n"), 0o600)).To(Succeed())
+	g.Expect(d.DecryptKustomizationFiles(root)).To(Succeed())
+
+	data, err := os.ReadFile(filepath.Join(root, "kustomization.yaml"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(data).To(Equal(kus))
+}
+
+func TestDecryptor_DecryptKustomizationFiles_MACMismatch(t *testing.T) {
+	g := NewWithT(t)
+
+	root := t.TempDir()
+
+	id, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	d := &Decryptor{
+		root: root,
+		kustomization: &kustomizev1.Kustomization{
+			Spec: kustomizev1.KustomizationSpec{
+				Decryption: &kustomizev1.Decryption{
+					Provider: DecryptionProviderSOPS,
+				},
+			},
+		},
+		ageIdentities: age.ParsedIdentities{id},
+	}
+	encrypted, err := d.sopsEncryptWithFormat(sops.Metadata{
+		KeyGroups: []sops.KeyGroup{
+			{&age.MasterKey{Recipient: id.Recipient().String()}},
+		},
+		UnencryptedSuffix: "_unencrypted",
+	}, []byte("resources:\n- deployment.yaml\nnamespace_unencrypted: apps\n"), formats.Yaml, formats.Yaml)
+	g.Expect(err).ToNot(HaveOccurred())
+	corrupted := bytes.Replace(encrypted, []byte("namespace_unencrypted: apps"), []byte("namespace_unencrypted: appz"), 1)
+	g.Expect(corrupted).ToNot(Equal(encrypted))
+
+	g.Expect(os.Mkdir(filepath.Join(root, "overlay"), 0o700)).To(Succeed())
+	g.Expect(os.WriteFile(filepath.Join(root, "kustomization.yaml"), []byte("resources:\n- overlay\n"), 0o600)).To(Succeed())
+	g.Expect(os.WriteFile(filepath.Join(root, "overlay", "kustomization.yaml"), corrupted, 0o600)).To(Succeed())
+
+	err = d.DecryptKustomizationFiles(root)
+	var decErr *DecryptionError
+	g.Expect(errors.As(err, &decErr)).To(BeTrue())
+	g.Expect(decErr.Reason).To(Equal(kustomizev1.SOPSMACMismatchReason))
+	g.Expect(err.Error()).To(ContainSubstring("'overlay/kustomization.yaml'"))
+}
+
 func TestDecryptor_decryptSopsFile(t *testing.T) {
 	g := NewWithT(t)
 
@@ -999,7 +4672,7 @@ func TestDecryptor_decryptSopsFile(t *testing.T) {
 				{name: "app.env", data: []byte("app=key\n"), encrypt: true, format: formats.Dotenv, expectData: false},
 			},
 			path:    "app.env",
-			wantErr: fmt.Errorf("cannot decrypt file with size (972 bytes) exceeding limit (5)"),
+			wantErr: fmt.Errorf("cannot decrypt file 'app.env' with size (972 bytes) exceeding limit (5 bytes)"),
 		},
 		{
 			name: "wrong file format",
@@ -1025,7 +4698,7 @@ func TestDecryptor_decryptSopsFile(t *testing.T) {
 
 			d := &Decryptor{
 				root:          tmpDir,
-				maxFileSize:   maxEncryptedFileSize,
+				maxFileSize:   DefaultMaxEncryptedFileSize,
 				ageIdentities: ageIdentities,
 			}
 			if tt.maxFileSize != 0 {
@@ -1075,6 +4748,68 @@ func TestDecryptor_decryptSopsFile(t *testing.T) {
 	}
 }
 
+func TestDecryptor_decryptSopsFile_MaxFileSize(t *testing.T) {
+	g := NewWithT(t)
+
+	root := t.TempDir()
+	kus := []byte("secretGenerator:\n- name: large\n  files:\n  - large.bin\n")
+	g.Expect(os.WriteFile(filepath.Join(root, "kustomization.yaml"), kus, 0o600)).To(Succeed())
+
+	// A sparse file, taking up no space on disk.
+	const size int64 = 200 << 20
+	f, err := os.Create(filepath.Join(root, "large.bin"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(f.Truncate(size)).To(Succeed())
+	g.Expect(f.Close()).To(Succeed())
+
+	ks := &kustomizev1.Kustomization{
+		Spec: kustomizev1.KustomizationSpec{
+			Decryption: &kustomizev1.Decryption{
+				Provider: DecryptionProviderSOPS,
+			},
+		},
+	}
+	d, cleanup, err := NewTempDecryptor(root, nil, ks, WithMaxFileSize(1<<20))
+	g.Expect(err).ToNot(HaveOccurred())
+	t.Cleanup(cleanup)
+
+	// A file which is not encrypted is left untouched, without reading it.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	g.Expect(d.DecryptSources(root)).To(Succeed())
+	runtime.ReadMemStats(&after)
+	g.Expect(after.TotalAlloc - before.TotalAlloc).To(BeNumerically("<", 1<<20))
+
+	// An encrypted file is refused before it is read.
+	f, err = os.OpenFile(filepath.Join(root, "large.bin"), os.O_WRONLY, 0)
+	g.Expect(err).ToNot(HaveOccurred())
+	marker := []byte(`"sops": {"mac": "ENC[AES256_GCM,data:abc]"}}`)
+	_, err = f.WriteAt(marker, size-int64(len(marker)))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(f.Close()).To(Succeed())
+
+	runtime.ReadMemStats(&before)
+	err = d.DecryptSources(root)
+	runtime.ReadMemStats(&after)
+	g.Expect(err).To(MatchError("cannot decrypt file 'large.bin' with size (209715200 bytes) exceeding limit (1048576 bytes)"))
+	g.Expect(after.TotalAlloc - before.TotalAlloc).To(BeNumerically("<", 1<<20))
+
+	// The limit is also enforced when the file grows after its size was
+	// checked, by reading no more than the limit.
+	fi, err := os.Lstat(filepath.Join(root, "large.bin"))
+	g.Expect(err).ToNot(HaveOccurred())
+	d.maxFileSize = 1 << 10
+	runtime.ReadMemStats(&before)
+	_, err = d.readFile(filepath.Join(root, "large.bin"), fi)
+	runtime.ReadMemStats(&after)
+	g.Expect(err).To(MatchError(ContainSubstring("cannot decrypt file 'large.bin' with size (1025 bytes)")))
+	g.Expect(after.TotalAlloc - before.TotalAlloc).To(BeNumerically("<", 1<<20))
+
+	// A limit of 0 disables the check.
+	d.maxFileSize = 0
+	g.Expect(d.checkFileSize(filepath.Join(root, "large.bin"), size)).To(Succeed())
+}
+
 func TestDecryptor_secureLoadKustomizationFile(t *testing.T) {
 	kusType := kustypes.TypeMeta{
 		APIVersion: kustypes.KustomizationVersion,
@@ -1598,3 +5333,184 @@ func TestDecryptor_detectFormatFromMarkerBytes(t *testing.T) {
 		})
 	}
 }
+
+func TestDecryptor_detectFileFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		b      []byte
+		format formats.Format
+		want   formats.Format
+	}{
+		{
+			name:   "prefers given format",
+			b:      []byte(`{"key": "ENC[...]", "sops": {"mac": "ENC[...]"}}`),
+			format: formats.Binary,
+			want:   formats.Binary,
+		},
+		{
+			name:   "detects binary envelope of JSON file",
+			b:      []byte(`{"data": "ENC[...]", "sops": {"mac": "ENC[...]"}}`),
+			format: formats.Json,
+			want:   formats.Binary,
+		},
+		{
+			name:   "detects dotenv",
+			b:      []byte("key=ENC[...]\nsops_mac=ENC[...]\n"),
+			format: formats.Yaml,
+			want:   formats.Dotenv,
+		},
+		{
+			name:   "detects INI",
+			b:      []byte("[section]\nkey = ENC[...]\n\n[sops]\nmac = ENC[...]\n"),
+			format: formats.Dotenv,
+			want:   formats.Ini,
+		},
+		{
+			name:   "detects INI with aligned entries",
+			b:      []byte("[section]\nkey = ENC[...]\n\n[sops]\nversion = 3.9.4\nmac     = ENC[...]\n"),
+			format: formats.Binary,
+			want:   formats.Ini,
+		},
+		{
+			name:   "ignores plain INI with sops section",
+			b:      []byte("[sops]\nmac = none\n"),
+			format: formats.Ini,
+			want:   unsupportedFormat,
+		},
+		{
+			name:   "detects binary envelope",
+			b:      []byte(`{"data": "ENC[...]", "sops": {"mac": "ENC[...]"}}`),
+			format: formats.Dotenv,
+			want:   formats.Binary,
+		},
+		{
+			name:   "detects JSON",
+			b:      []byte(`{"key": "ENC[...]", "sops": {"mac": "ENC[...]"}}`),
+			format: formats.Dotenv,
+			want:   formats.Json,
+		},
+		{
+			name:   "returns unsupported format",
+			b:      []byte("key=value\n"),
+			format: formats.Dotenv,
+			want:   unsupportedFormat,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectFileFormat(tt.b, tt.format); got != tt.want {
+				t.Errorf("detectFileFormat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptor_matchPathGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{pattern: "secret.yaml", name: "secret.yaml", want: true},
+		{pattern: "*.enc.yaml", name: "secret.enc.yaml", want: true},
+		{pattern: "*.enc.yaml", name: "secrets/secret.enc.yaml", want: false},
+		{pattern: "secrets/*.enc.yaml", name: "secrets/secret.enc.yaml", want: true},
+		{pattern: "secrets/*.enc.yaml", name: "secrets/db/secret.enc.yaml", want: false},
+		{pattern: "secrets/**/*.enc.yaml", name: "secrets/secret.enc.yaml", want: true},
+		{pattern: "secrets/**/*.enc.yaml", name: "secrets/db/prod/secret.enc.yaml", want: true},
+		{pattern: "secrets/**/*.enc.yaml", name: "other/secret.enc.yaml", want: false},
+		{pattern: "secrets/**", name: "secrets/db/secret.yaml", want: true},
+		{pattern: "**/*.env", name: "app.env", want: true},
+		{pattern: "**/*.env", name: "apps/prod/app.env", want: true},
+		{pattern: "**", name: "apps/prod/app.env", want: true},
+		{pattern: "secrets/?.env", name: "secrets/a.env", want: true},
+		{pattern: "secrets/[ab].env", name: "secrets/c.env", want: false},
+		{pattern: "../shared/*.yaml", name: "../shared/secret.yaml", want: true},
+		{pattern: "*/secret.yaml", name: "../secret.yaml", want: true},
+		{pattern: "secrets", name: "secrets/secret.yaml", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			if got := matchPathGlob(tt.pattern, tt.name); got != tt.want {
+				t.Errorf("matchPathGlob() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptor_validatePathGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr string
+	}{
+		{pattern: "secrets/**/*.enc.yaml"},
+		{pattern: "../shared/[a-z]*.env"},
+		{pattern: "", wantErr: "pattern is empty"},
+		{pattern: "/secrets/*.yaml", wantErr: "pattern must be relative"},
+		{pattern: "secrets/[*.yaml", wantErr: path.ErrBadPattern.Error()},
+		{pattern: "secrets/\\", wantErr: path.ErrBadPattern.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			g := NewWithT(t)
+
+			err := validatePathGlob(tt.pattern)
+			if tt.wantErr == "" {
+				g.Expect(err).ToNot(HaveOccurred())
+				return
+			}
+			g.Expect(err).To(MatchError(tt.wantErr))
+		})
+	}
+}
+
+// BenchmarkDecryptor_DecryptSources compares the overhead of walking the
+// sources of a Kustomization generating a ConfigMap from many plain files,
+// with and without decryption paths excluding them.
+func BenchmarkDecryptor_DecryptSources(b *testing.B) {
+	const files = 1000
+
+	root := b.TempDir()
+	var kus strings.Builder
+	kus.WriteString("configMapGenerator:\n- name: config\n  files:\n")
+	if err := os.MkdirAll(filepath.Join(root, "config"), 0o700); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("config/%d.yaml", i)
+		fmt.Fprintf(&kus, "  - %s\n", name)
+		if err := os.WriteFile(filepath.Join(root, name), []byte(strings.Repeat("key: value\n", 100)), 0o600); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "kustomization.yaml"), []byte(kus.String()), 0o600); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bb := range []struct {
+		name  string
+		paths []string
+	}{
+		{name: "all files"},
+		{name: "decryption paths", paths: []string{"secrets/**/*.enc.yaml"}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			d := &Decryptor{
+				root: root,
+				kustomization: &kustomizev1.Kustomization{
+					Spec: kustomizev1.KustomizationSpec{
+						Decryption: &kustomizev1.Decryption{
+							Provider: DecryptionProviderSOPS,
+							Paths:    bb.paths,
+						},
+					},
+				},
+			}
+			for i := 0; i < b.N; i++ {
+				if err := d.DecryptSources(root); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
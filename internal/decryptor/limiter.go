@@ -0,0 +1,79 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Limiter bounds the number of Decryptors configured with it which decrypt
+// concurrently, regardless of the number of concurrent reconciliations. This
+// bounds the load on the CPU, GnuPG, and the key management services, e.g.
+// to stay within their rate limits.
+//
+// A Decryptor acquires a slot of the Limiter for the duration of its
+// decryption phase, from the import of the keys until its cleanup. A nil
+// *Limiter is valid, and does not limit the concurrency.
+type Limiter struct {
+	slots         chan struct{}
+	inFlightGauge prometheus.Gauge
+}
+
+// NewLimiter returns a new Limiter which allows up to n concurrent
+// decryptions.
+func NewLimiter(n int) *Limiter {
+	return &Limiter{
+		slots: make(chan struct{}, n),
+		inFlightGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "kustomize_decryptions_in_flight",
+			Help: "The number of Kustomizations being decrypted.",
+		}),
+	}
+}
+
+// MustRegister registers the metrics of the Limiter with the given
+// prometheus.Registerer. It panics if any of the metrics can not be
+// registered.
+func (l *Limiter) MustRegister(r prometheus.Registerer) {
+	r.MustRegister(l.inFlightGauge)
+}
+
+// acquire blocks until a slot is available, and returns a function to
+// release it, which may be called more than once. It returns an error if
+// the context is done before a slot is available.
+func (l *Limiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("stopped waiting for one of the %d concurrent decryptions to complete: %w", cap(l.slots), context.Cause(ctx))
+	}
+	l.inFlightGauge.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.inFlightGauge.Dec()
+			<-l.slots
+		})
+	}, nil
+}
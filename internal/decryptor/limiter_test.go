@@ -0,0 +1,245 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	extage "filippo.io/age"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/keyservice"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// slowKeyService is a keyservice.KeyServiceClient which decrypts the data
+// key of a recordingKeyService after a delay, and records the maximum
+// number of concurrent decryption requests.
+type slowKeyService struct {
+	*recordingKeyService
+	delay time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (f *slowKeyService) Decrypt(ctx context.Context, _ *keyservice.DecryptRequest, _ ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	f.mu.Lock()
+	f.inFlight++
+	f.max = max(f.max, f.inFlight)
+	dataKey := append([]byte(nil), f.dataKey...)
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.inFlight--
+		f.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(f.delay):
+		return &keyservice.DecryptResponse{Plaintext: dataKey}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *slowKeyService) maxInFlight() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.max
+}
+
+// newTestLimiterData returns data encrypted for a recipient of which the
+// identity is unavailable, with the data key held by the returned
+// slowKeyService.
+func newTestLimiterData(g *WithT, delay time.Duration) ([]byte, *slowKeyService) {
+	id, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	svc := &slowKeyService{recordingKeyService: &recordingKeyService{}, delay: delay}
+	d := &Decryptor{keyServices: []keyservice.KeyServiceClient{svc.recordingKeyService}}
+	d.localServiceOnce.Do(func() {})
+	data, err := d.sopsEncryptWithFormat(sops.Metadata{
+		KeyGroups: []sops.KeyGroup{{&age.MasterKey{Recipient: id.Recipient().String()}}},
+	}, []byte(`{"key": "value"}`), formats.Json, formats.Json)
+	g.Expect(err).ToNot(HaveOccurred())
+	return data, svc
+}
+
+func newTestLimiterKustomization() *kustomizev1.Kustomization {
+	return &kustomizev1.Kustomization{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"},
+		Spec: kustomizev1.KustomizationSpec{
+			Decryption: &kustomizev1.Decryption{Provider: DecryptionProviderSOPS},
+		},
+	}
+}
+
+func TestLimiter_ConcurrentDecryptions(t *testing.T) {
+	g := NewWithT(t)
+
+	const (
+		limit        = 2
+		reconcilers  = 6
+		decryptDelay = 50 * time.Millisecond
+	)
+
+	data, svc := newTestLimiterData(g, decryptDelay)
+	limiter := NewLimiter(limit)
+	reg := prometheus.NewRegistry()
+	limiter.MustRegister(reg)
+	c := fake.NewClientBuilder().Build()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		peak    float64
+		errs    []error
+		results [][]byte
+	)
+	for range reconcilers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			d, cleanup, err := NewTempDecryptor("", c, newTestLimiterKustomization(),
+				WithLimiter(limiter), WithRemoteKeyServices([]keyservice.KeyServiceClient{svc}))
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			defer cleanup()
+
+			if err = d.ImportKeys(context.TODO()); err == nil {
+				mu.Lock()
+				peak = max(peak, testutil.ToFloat64(limiter.inFlightGauge))
+				mu.Unlock()
+
+				var out []byte
+				out, err = d.SopsDecryptWithFormat(data, formats.Json, formats.Json)
+				mu.Lock()
+				results = append(results, out)
+				mu.Unlock()
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	g.Expect(errs).To(BeEmpty())
+	g.Expect(results).To(HaveLen(reconcilers))
+	g.Expect(svc.maxInFlight()).To(BeNumerically("<=", limit))
+	g.Expect(svc.maxInFlight()).To(BeNumerically(">", 0))
+	g.Expect(peak).To(BeNumerically("<=", limit))
+
+	// All slots are released by the cleanup of the Decryptors.
+	g.Expect(testutil.ToFloat64(limiter.inFlightGauge)).To(BeZero())
+	g.Expect(testutil.GatherAndCount(reg, "kustomize_decryptions_in_flight")).To(Equal(1))
+}
+
+func TestLimiter_ContextDone(t *testing.T) {
+	g := NewWithT(t)
+
+	limiter := NewLimiter(1)
+	c := fake.NewClientBuilder().Build()
+
+	holder, cleanup, err := NewTempDecryptor("", c, newTestLimiterKustomization(), WithLimiter(limiter))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(holder.ImportKeys(context.TODO())).To(Succeed())
+
+	// A Decryptor waiting for the slot of the holder stops waiting at the
+	// deadline of its reconciliation.
+	waiter, waiterCleanup, err := NewTempDecryptor("", c, newTestLimiterKustomization(), WithLimiter(limiter))
+	g.Expect(err).ToNot(HaveOccurred())
+	t.Cleanup(waiterCleanup)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	err = waiter.ImportKeys(ctx)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+	g.Expect(err.Error()).To(ContainSubstring("stopped waiting for one of the 1 concurrent decryptions to complete"))
+	g.Expect(testutil.ToFloat64(limiter.inFlightGauge)).To(Equal(float64(1)))
+
+	// The slot becomes available once the holder is cleaned up, which may
+	// happen more than once.
+	cleanup()
+	cleanup()
+	g.Expect(testutil.ToFloat64(limiter.inFlightGauge)).To(BeZero())
+
+	ctx, cancel = context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	g.Expect(waiter.ImportKeys(ctx)).To(Succeed())
+	g.Expect(testutil.ToFloat64(limiter.inFlightGauge)).To(Equal(float64(1)))
+}
+
+func TestLimiter_Nil(t *testing.T) {
+	g := NewWithT(t)
+
+	data, svc := newTestLimiterData(g, 50*time.Millisecond)
+	c := fake.NewClientBuilder().Build()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			d, cleanup, err := NewTempDecryptor("", c, newTestLimiterKustomization(),
+				WithRemoteKeyServices([]keyservice.KeyServiceClient{svc}))
+			if err == nil {
+				defer cleanup()
+				if err = d.ImportKeys(context.TODO()); err == nil {
+					_, err = d.SopsDecryptWithFormat(data, formats.Json, formats.Json)
+				}
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	g.Expect(errs).To(BeEmpty())
+	g.Expect(svc.maxInFlight()).To(BeNumerically(">", 1))
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+
+	intazkv "github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+)
+
+const (
+	// ProviderAge is the provider label value of age keys.
+	ProviderAge = "age"
+	// ProviderPGP is the provider label value of OpenPGP keys.
+	ProviderPGP = "pgp"
+	// ProviderAzureKeyVault is the provider label value of Azure Key Vault
+	// keys.
+	ProviderAzureKeyVault = "azkv"
+	// ProviderAWSKMS is the provider label value of AWS KMS keys.
+	ProviderAWSKMS = "awskms"
+	// ProviderGCPKMS is the provider label value of GCP KMS keys.
+	ProviderGCPKMS = "gcpkms"
+	// ProviderHashiCorpVault is the provider label value of HashiCorp Vault
+	// Transit keys.
+	ProviderHashiCorpVault = "hcvault"
+)
+
+const (
+	// ErrorReasonAccessDenied is the reason label value of failures caused
+	// by the key management service denying access to the key.
+	ErrorReasonAccessDenied = "AccessDenied"
+	// ErrorReasonThrottled is the reason label value of failures caused by
+	// the key management service throttling requests.
+	ErrorReasonThrottled = "Throttled"
+	// ErrorReasonConnectionFailed is the reason label value of failures
+	// caused by the key management service not being reachable.
+	ErrorReasonConnectionFailed = "ConnectionFailed"
+	// ErrorReasonTimeout is the reason label value of failures caused by
+	// the request exceeding its deadline.
+	ErrorReasonTimeout = "Timeout"
+	// ErrorReasonUnknown is the reason label value of failures which could
+	// not be classified, e.g. because the key is not available.
+	ErrorReasonUnknown = "Unknown"
+)
+
+// Metrics records the latency and failures of the decryption of SOPS data
+// keys by the key services of the Decryptors configured with it, partitioned
+// by key provider and the namespace of the Kustomization.
+//
+// A nil *Metrics is valid, and results in no metrics being recorded.
+type Metrics struct {
+	durationHistogram *prometheus.HistogramVec
+	errorCounter      *prometheus.CounterVec
+
+	// now is used to measure the duration of requests, and can be
+	// overwritten in tests.
+	now func() time.Time
+}
+
+// NewMetrics returns a new Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		durationHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kustomize_decryption_duration_seconds",
+			Help:    "The duration in seconds of SOPS data key decryption requests, partitioned by key provider and namespace.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"provider", "namespace"}),
+		errorCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kustomize_decryption_errors_total",
+			Help: "The number of failed SOPS data key decryption requests, partitioned by key provider, namespace and reason.",
+		}, []string{"provider", "namespace", "reason"}),
+		now: time.Now,
+	}
+}
+
+// MustRegister registers the metrics with the given prometheus.Registerer.
+// It panics if any of the metrics can not be registered.
+func (m *Metrics) MustRegister(r prometheus.Registerer) {
+	r.MustRegister(m.durationHistogram, m.errorCounter)
+}
+
+// instrument wraps the given key service clients to record their decryption
+// requests for the given namespace. It returns the clients as is if m is
+// nil.
+func (m *Metrics) instrument(svcs []keyservice.KeyServiceClient, namespace string) []keyservice.KeyServiceClient {
+	if m == nil {
+		return svcs
+	}
+	instrumented := make([]keyservice.KeyServiceClient, 0, len(svcs))
+	for _, svc := range svcs {
+		instrumented = append(instrumented, instrumentedKeyService{KeyServiceClient: svc, metrics: m, namespace: namespace})
+	}
+	return instrumented
+}
+
+// instrumentedKeyService is a keyservice.KeyServiceClient which records the
+// duration and failures of the decryption requests to the underlying
+// client.
+type instrumentedKeyService struct {
+	keyservice.KeyServiceClient
+	metrics   *Metrics
+	namespace string
+}
+
+// Decrypt forwards the request to the underlying client, and records the
+// duration of the request and its failure, if any.
+func (s instrumentedKeyService) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	provider := keyProvider(req.GetKey())
+	start := s.metrics.now()
+	resp, err := s.KeyServiceClient.Decrypt(ctx, req, opts...)
+	s.metrics.durationHistogram.WithLabelValues(provider, s.namespace).Observe(s.metrics.now().Sub(start).Seconds())
+	if err != nil {
+		s.metrics.errorCounter.WithLabelValues(provider, s.namespace, keyServiceErrorReason(err)).Inc()
+	}
+	return resp, err
+}
+
+// keyProvider returns the provider label value for the given key.
+func keyProvider(key *keyservice.Key) string {
+	switch key.GetKeyType().(type) {
+	case *keyservice.Key_AgeKey:
+		return ProviderAge
+	case *keyservice.Key_PgpKey:
+		return ProviderPGP
+	case *keyservice.Key_AzureKeyvaultKey:
+		return ProviderAzureKeyVault
+	case *keyservice.Key_KmsKey:
+		return ProviderAWSKMS
+	case *keyservice.Key_GcpKmsKey:
+		return ProviderGCPKMS
+	case *keyservice.Key_VaultKey:
+		return ProviderHashiCorpVault
+	default:
+		return "unknown"
+	}
+}
+
+// keyServiceErrorReason returns the reason label value classifying the
+// given key service error.
+func keyServiceErrorReason(err error) string {
+	var kvErr *intazkv.KeyVaultError
+	if errors.As(err, &kvErr) {
+		switch kvErr.Class {
+		case intazkv.ErrorClassAccessDenied:
+			return ErrorReasonAccessDenied
+		case intazkv.ErrorClassThrottled:
+			return ErrorReasonThrottled
+		case intazkv.ErrorClassConnectionFailed:
+			return ErrorReasonConnectionFailed
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorReasonTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrorReasonTimeout
+		}
+		return ErrorReasonConnectionFailed
+	}
+	return ErrorReasonUnknown
+}
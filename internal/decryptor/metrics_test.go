@@ -0,0 +1,214 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	extage "filippo.io/age"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/keyservice"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+	intazkv "github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+)
+
+// stubKeyService is a keyservice.KeyServiceClient returning err for
+// decryption requests, or a static plaintext if nil.
+type stubKeyService struct {
+	err error
+}
+
+func (s stubKeyService) Encrypt(context.Context, *keyservice.EncryptRequest, ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s stubKeyService) Decrypt(context.Context, *keyservice.DecryptRequest, ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &keyservice.DecryptResponse{Plaintext: []byte("data key")}, nil
+}
+
+func TestMetrics_instrument(t *testing.T) {
+	g := NewWithT(t)
+
+	m := NewMetrics()
+	var ticks int
+	m.now = func() time.Time {
+		ticks++
+		return time.Unix(0, 0).Add(time.Duration(ticks) * 250 * time.Millisecond)
+	}
+
+	ageKey := &keyservice.Key{KeyType: &keyservice.Key_AgeKey{AgeKey: &keyservice.AgeKey{}}}
+	azkvKey := &keyservice.Key{KeyType: &keyservice.Key_AzureKeyvaultKey{AzureKeyvaultKey: &keyservice.AzureKeyVaultKey{}}}
+
+	ok := m.instrument([]keyservice.KeyServiceClient{stubKeyService{}}, "apps")[0]
+	resp, err := ok.Decrypt(context.TODO(), &keyservice.DecryptRequest{Key: ageKey})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(resp.Plaintext).To(Equal([]byte("data key")))
+
+	failing := stubKeyService{err: &intazkv.KeyVaultError{Class: intazkv.ErrorClassAccessDenied, Err: errors.New("forbidden")}}
+	failed := m.instrument([]keyservice.KeyServiceClient{failing}, "infra")[0]
+	_, err = failed.Decrypt(context.TODO(), &keyservice.DecryptRequest{Key: azkvKey})
+	g.Expect(err).To(MatchError(failing.err))
+
+	g.Expect(testutil.CollectAndCount(m.durationHistogram)).To(Equal(2))
+	g.Expect(testutil.CollectAndCount(m.errorCounter)).To(Equal(1))
+	g.Expect(testutil.ToFloat64(m.errorCounter.WithLabelValues(ProviderAzureKeyVault, "infra", ErrorReasonAccessDenied))).To(Equal(float64(1)))
+
+	g.Expect(testutil.CollectAndCompare(m.errorCounter, strings.NewReader(`
+# HELP kustomize_decryption_errors_total The number of failed SOPS data key decryption requests, partitioned by key provider, namespace and reason.
+# TYPE kustomize_decryption_errors_total counter
+kustomize_decryption_errors_total{namespace="infra",provider="azkv",reason="AccessDenied"} 1
+`))).To(Succeed())
+}
+
+func TestMetrics_instrument_Nil(t *testing.T) {
+	g := NewWithT(t)
+
+	svcs := []keyservice.KeyServiceClient{stubKeyService{}}
+
+	var m *Metrics
+	g.Expect(m.instrument(svcs, "apps")).To(Equal(svcs))
+}
+
+func TestMetrics_SopsDecryptWithFormat(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := prometheus.NewRegistry()
+	m := NewMetrics()
+	m.MustRegister(reg)
+
+	id, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+	other, err := extage.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	d := &Decryptor{
+		kustomization: &kustomizev1.Kustomization{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"},
+		},
+		ageIdentities: age.ParsedIdentities{id},
+		checkSopsMac:  true,
+		metrics:       m,
+	}
+
+	// The data key is encrypted for a recipient of which the identity is
+	// missing, before the recipient of which the identity is available.
+	encrypted, err := d.sopsEncryptWithFormat(sops.Metadata{
+		KeyGroups: []sops.KeyGroup{
+			{
+				&age.MasterKey{Recipient: other.Recipient().String()},
+				&age.MasterKey{Recipient: id.Recipient().String()},
+			},
+		},
+	}, []byte("key: value\n"), formats.Yaml, formats.Yaml)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	decrypted, err := d.SopsDecryptWithFormat(encrypted, formats.Yaml, formats.Yaml)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(decrypted).To(Equal([]byte("key: value\n")))
+
+	g.Expect(testutil.GatherAndCount(reg, "kustomize_decryption_duration_seconds")).To(Equal(1))
+	g.Expect(testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP kustomize_decryption_errors_total The number of failed SOPS data key decryption requests, partitioned by key provider, namespace and reason.
+# TYPE kustomize_decryption_errors_total counter
+kustomize_decryption_errors_total{namespace="apps",provider="age",reason="Unknown"} 1
+`), "kustomize_decryption_errors_total")).To(Succeed())
+}
+
+func Test_keyProvider(t *testing.T) {
+	tests := []struct {
+		key  *keyservice.Key
+		want string
+	}{
+		{key: &keyservice.Key{KeyType: &keyservice.Key_AgeKey{}}, want: ProviderAge},
+		{key: &keyservice.Key{KeyType: &keyservice.Key_PgpKey{}}, want: ProviderPGP},
+		{key: &keyservice.Key{KeyType: &keyservice.Key_AzureKeyvaultKey{}}, want: ProviderAzureKeyVault},
+		{key: &keyservice.Key{KeyType: &keyservice.Key_KmsKey{}}, want: ProviderAWSKMS},
+		{key: &keyservice.Key{KeyType: &keyservice.Key_GcpKmsKey{}}, want: ProviderGCPKMS},
+		{key: &keyservice.Key{KeyType: &keyservice.Key_VaultKey{}}, want: ProviderHashiCorpVault},
+		{key: nil, want: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := keyProvider(tt.key); got != tt.want {
+				t.Errorf("keyProvider() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_keyServiceErrorReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "Azure Key Vault access denied",
+			err:  fmt.Errorf("failed to decrypt: %w", &intazkv.KeyVaultError{Class: intazkv.ErrorClassAccessDenied, Err: errors.New("forbidden")}),
+			want: ErrorReasonAccessDenied,
+		},
+		{
+			name: "Azure Key Vault throttled",
+			err:  &intazkv.KeyVaultError{Class: intazkv.ErrorClassThrottled, Err: errors.New("too many requests")},
+			want: ErrorReasonThrottled,
+		},
+		{
+			name: "Azure Key Vault connection failed",
+			err:  &intazkv.KeyVaultError{Class: intazkv.ErrorClassConnectionFailed, Err: errors.New("no such host")},
+			want: ErrorReasonConnectionFailed,
+		},
+		{
+			name: "deadline exceeded",
+			err:  fmt.Errorf("failed to decrypt: %w", context.DeadlineExceeded),
+			want: ErrorReasonTimeout,
+		},
+		{
+			name: "network error",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			want: ErrorReasonConnectionFailed,
+		},
+		{
+			name: "other error",
+			err:  errors.New("no identity matched any of the recipients"),
+			want: ErrorReasonUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keyServiceErrorReason(tt.err); got != tt.want {
+				t.Errorf("keyServiceErrorReason() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
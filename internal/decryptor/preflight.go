@@ -0,0 +1,228 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	extage "filippo.io/age"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/pgp"
+	kustypes "sigs.k8s.io/kustomize/api/types"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+// missingFileKeys holds the identifiers of the missing keys of a SOPS
+// encrypted file.
+type missingFileKeys struct {
+	// path is the path of the file relative to the root.
+	path string
+	// keys are the identifiers of the missing keys.
+	keys []string
+}
+
+// PreflightCheck confirms the data keys of all SOPS encrypted files the
+// Kustomization file in the directory at the provided path refers to can
+// be decrypted with the imported decryption keys, before anything is
+// decrypted. It walks over the same files as DecryptSources, and the files
+// listed as resources.
+//
+// It returns a DecryptionError listing every file of which the data key can
+// not be decrypted and the identifiers of its missing keys. Only age and
+// OpenPGP keys are verified, as access to the keys of the other providers
+// can not be confirmed without requesting the decryption of the data key.
+// Any error reading or parsing a file is left to the decryption.
+//
+// The check is skipped when remote key services are configured, as the keys
+// available to them are not known.
+func (d *Decryptor) PreflightCheck(path string) error {
+	if d.kustomization.Spec.Decryption == nil || d.kustomization.Spec.Decryption.Provider != DecryptionProviderSOPS {
+		return nil
+	}
+	if len(d.remoteKeyServices) > 0 {
+		return nil
+	}
+
+	include, err := d.decryptionPathsFilter(path)
+	if err != nil {
+		return err
+	}
+
+	var missing []missingFileKeys
+	checked, visited := make(map[string]struct{}), make(map[string]struct{})
+	visit := func(root, path string, kus *kustypes.Kustomization) error {
+		refs := kustomizationSourceRefs(root, path, kus)
+		sources := len(refs)
+		for _, res := range kus.Resources {
+			refs = append(refs, sourceRef{path: res, format: formatForPath(res)})
+		}
+		for i, ref := range refs {
+			relRef, err := refPath(root, path, ref.path)
+			if err != nil {
+				continue
+			}
+			// The decryption paths only apply to the source files.
+			if i < sources && include != nil && !include(filepath.Join(root, relRef)) {
+				continue
+			}
+			absRef, err := secureRefPath(root, relRef)
+			if err != nil {
+				continue
+			}
+			if _, ok := checked[absRef]; ok {
+				continue
+			}
+			checked[absRef] = struct{}{}
+			if keys := d.missingFileKeys(absRef, ref.format); len(keys) > 0 {
+				missing = append(missing, missingFileKeys{path: relRef, keys: keys})
+			}
+		}
+		return nil
+	}
+	if err := recurseKustomizationFiles(d.root, path, visit, visited); err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	files := make([]string, 0, len(missing))
+	for _, m := range missing {
+		files = append(files, fmt.Sprintf("'%s' (%s)", m.path, strings.Join(m.keys, ", ")))
+	}
+	return &DecryptionError{
+		Reason: kustomizev1.DecryptionKeysMissingReason,
+		Err: fmt.Errorf("decryption keys are missing for %d SOPS encrypted file(s): %s",
+			len(missing), strings.Join(files, ", ")),
+	}
+}
+
+// missingFileKeys returns the identifiers of the missing keys of the SOPS
+// encrypted file at the given absolute path, if its data key can not be
+// decrypted with the imported decryption keys. It returns nil if the file
+// can not be read, or is not encrypted.
+func (d *Decryptor) missingFileKeys(path string, format formats.Format) []string {
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() || (d.maxFileSize > 0 && fi.Size() > d.maxFileSize) {
+		return nil
+	}
+	if sniffed, err := sniffFileFormat(path, fi.Size(), format); err != nil || sniffed == unsupportedFormat {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	if format = detectFileFormat(data, format); format == unsupportedFormat {
+		return nil
+	}
+	tree, err := common.StoreForFormat(format, config.NewStoresConfig()).LoadEncryptedFile(data)
+	if err != nil {
+		return nil
+	}
+	return d.missingDataKeys(tree.Metadata)
+}
+
+// missingDataKeys returns the identifiers of the age and OpenPGP keys of the
+// key groups of the given SOPS metadata which can not be decrypted with the
+// imported decryption keys, if fewer key groups than required by the Shamir
+// threshold can be decrypted. A key group is considered decryptable if any of
+// its keys is imported, or belongs to another provider.
+func (d *Decryptor) missingDataKeys(metadata sops.Metadata) []string {
+	required := metadata.ShamirThreshold
+	if required <= 0 || required > len(metadata.KeyGroups) {
+		required = len(metadata.KeyGroups)
+	}
+
+	var decryptable int
+	var missing []string
+	for _, group := range metadata.KeyGroups {
+		var groupMissing []string
+		ok := false
+		for _, key := range group {
+			switch k := key.(type) {
+			case *age.MasterKey:
+				if d.hasAgeIdentity(k.Recipient) {
+					ok = true
+				} else {
+					groupMissing = append(groupMissing, fmt.Sprintf("age recipient '%s'", k.Recipient))
+				}
+			case *pgp.MasterKey:
+				if d.hasPGPKey(k.Fingerprint) {
+					ok = true
+				} else {
+					groupMissing = append(groupMissing, fmt.Sprintf("PGP key '%s'", k.Fingerprint))
+				}
+			default:
+				ok = true
+			}
+		}
+		if ok {
+			decryptable++
+			continue
+		}
+		missing = append(missing, groupMissing...)
+	}
+	if decryptable >= required {
+		return nil
+	}
+	return missing
+}
+
+// hasAgeIdentity returns if an age identity was imported for the given
+// recipient. As the recipients of SSH and plugin identities can not be
+// derived, any such recipient is considered to be available if an identity
+// other than a native X25519 identity was imported.
+func (d *Decryptor) hasAgeIdentity(recipient string) bool {
+	_, nativeErr := extage.ParseX25519Recipient(recipient)
+	for _, id := range d.ageIdentities {
+		x25519, ok := id.(*extage.X25519Identity)
+		if !ok {
+			if nativeErr != nil {
+				return true
+			}
+			continue
+		}
+		if x25519.Recipient().String() == recipient {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPGPKey returns if a PGP private (sub)key was imported for the given
+// fingerprint, which may be shortened to e.g. the long key ID.
+func (d *Decryptor) hasPGPKey(fingerprint string) bool {
+	fingerprint = strings.ToUpper(strings.ReplaceAll(fingerprint, " ", ""))
+	if fingerprint == "" {
+		return false
+	}
+	for _, fp := range d.pgpFingerprints {
+		if strings.HasSuffix(fp, fingerprint) {
+			return true
+		}
+	}
+	return false
+}
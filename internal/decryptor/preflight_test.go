@@ -0,0 +1,259 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decryptor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	extage "filippo.io/age"
+	"github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/keyservice"
+	. "github.com/onsi/gomega"
+
+	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
+)
+
+const (
+	preflightPGPFingerprint = "B59DAF469E8C948138901A649732075EA221A7EA"
+	preflightKMSARN         = "arn:aws:kms:us-west-2:107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48"
+)
+
+// sopsYAMLWithKeyGroups returns a SOPS encrypted YAML document of which the
+// data key is encrypted for the given key groups, which are written as is
+// into the metadata. The encrypted values are not valid, and the document
+// can therefore only be used to check the keys of the data key.
+func sopsYAMLWithKeyGroups(threshold int, groups ...string) []byte {
+	var b strings.Builder
+	b.WriteString("password: ENC[AES256_GCM,data:Zm9v,iv:Zm9v,tag:Zm9v,type:str]\n")
+	b.WriteString("sops:\n    key_groups:\n")
+	for _, g := range groups {
+		b.WriteString(g)
+	}
+	if threshold > 0 {
+		fmt.Fprintf(&b, "    shamir_threshold: %d\n", threshold)
+	}
+	b.WriteString("    lastmodified: \"2023-01-01T00:00:00Z\"\n")
+	b.WriteString("    mac: ENC[AES256_GCM,data:Zm9v,iv:Zm9v,tag:Zm9v,type:str]\n")
+	b.WriteString("    version: 3.8.1\n")
+	return []byte(b.String())
+}
+
+func ageKeyGroup(recipients ...string) string {
+	var b strings.Builder
+	b.WriteString("        - age:\n")
+	for _, r := range recipients {
+		fmt.Fprintf(&b, "            - recipient: %s\n              enc: encrypted\n", r)
+	}
+	return b.String()
+}
+
+func pgpKeyGroup(fingerprint string) string {
+	return fmt.Sprintf("        - pgp:\n            - fp: %s\n              created_at: \"2023-01-01T00:00:00Z\"\n              enc: encrypted\n", fingerprint)
+}
+
+func mixedKeyGroup(ageRecipient, fingerprint string) string {
+	return fmt.Sprintf("        - kms:\n            - arn: %s\n              created_at: \"2023-01-01T00:00:00Z\"\n              enc: encrypted\n"+
+		"          age:\n            - recipient: %s\n              enc: encrypted\n"+
+		"          pgp:\n            - fp: %s\n              created_at: \"2023-01-01T00:00:00Z\"\n              enc: encrypted\n",
+		preflightKMSARN, ageRecipient, fingerprint)
+}
+
+func TestDecryptor_PreflightCheck(t *testing.T) {
+	id, err := extage.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	missingID, err := extage.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, missingRecipient := id.Recipient().String(), missingID.Recipient().String()
+	const missingFingerprint = "35C1A64CD7FC0AB6EB66756B2445463C3234ECE1"
+
+	type file struct {
+		name string
+		data []byte
+	}
+	tests := []struct {
+		name        string
+		paths       []string
+		files       []file
+		wantMissing map[string][]string
+	}{
+		{
+			name: "all keys available",
+			files: []file{
+				{name: "kustomization.yaml", data: []byte("resources:\n- secret.yaml\nsecretGenerator:\n- name: app\n  files:\n  - age.yaml\n  - pgp.yaml\n")},
+				{name: "secret.yaml", data: sopsYAMLWithKeyGroups(0, ageKeyGroup(missingRecipient, recipient))},
+				{name: "age.yaml", data: sopsYAMLWithKeyGroups(0, ageKeyGroup(recipient))},
+				{name: "pgp.yaml", data: sopsYAMLWithKeyGroups(0, pgpKeyGroup(preflightPGPFingerprint))},
+			},
+		},
+		{
+			name: "key of other provider in key group",
+			files: []file{
+				{name: "kustomization.yaml", data: []byte("resources:\n- secret.yaml\n")},
+				{name: "secret.yaml", data: sopsYAMLWithKeyGroups(0, mixedKeyGroup(missingRecipient, missingFingerprint))},
+			},
+		},
+		{
+			name: "Shamir threshold met with missing key group",
+			files: []file{
+				{name: "kustomization.yaml", data: []byte("resources:\n- secret.yaml\n")},
+				{name: "secret.yaml", data: sopsYAMLWithKeyGroups(1, ageKeyGroup(recipient), pgpKeyGroup(missingFingerprint))},
+			},
+		},
+		{
+			name: "mixed age, PGP and KMS key groups with one missing key",
+			files: []file{
+				{name: "kustomization.yaml", data: []byte("resources:\n- secret.yaml\n- base\n")},
+				{name: "secret.yaml", data: sopsYAMLWithKeyGroups(0, mixedKeyGroup(missingRecipient, missingFingerprint), ageKeyGroup(recipient))},
+				{name: "base/kustomization.yaml", data: []byte("secretGenerator:\n- name: app\n  files:\n  - credentials.yaml\n  envs:\n  - app.env\n")},
+				{name: "base/credentials.yaml", data: sopsYAMLWithKeyGroups(0, ageKeyGroup(recipient), pgpKeyGroup(missingFingerprint))},
+				{name: "base/app.env", data: []byte("key=value\n")},
+			},
+			wantMissing: map[string][]string{
+				"base/credentials.yaml": {fmt.Sprintf("PGP key '%s'", missingFingerprint)},
+			},
+		},
+		{
+			name: "missing keys of multiple files",
+			files: []file{
+				{name: "kustomization.yaml", data: []byte("resources:\n- secret.yaml\npatches:\n- path: patch.yaml\n")},
+				{name: "secret.yaml", data: sopsYAMLWithKeyGroups(0, ageKeyGroup(missingRecipient))},
+				{name: "patch.yaml", data: sopsYAMLWithKeyGroups(2, ageKeyGroup(recipient), ageKeyGroup(missingRecipient), pgpKeyGroup(missingFingerprint))},
+			},
+			wantMissing: map[string][]string{
+				"secret.yaml": {fmt.Sprintf("age recipient '%s'", missingRecipient)},
+				"patch.yaml":  {fmt.Sprintf("age recipient '%s'", missingRecipient), fmt.Sprintf("PGP key '%s'", missingFingerprint)},
+			},
+		},
+		{
+			name:  "source files not matching decryption paths",
+			paths: []string{"secrets/*.yaml"},
+			files: []file{
+				{name: "kustomization.yaml", data: []byte("resources:\n- secret.yaml\nsecretGenerator:\n- name: app\n  files:\n  - credentials.yaml\n")},
+				{name: "secret.yaml", data: sopsYAMLWithKeyGroups(0, ageKeyGroup(missingRecipient))},
+				{name: "credentials.yaml", data: sopsYAMLWithKeyGroups(0, ageKeyGroup(missingRecipient))},
+			},
+			wantMissing: map[string][]string{
+				"secret.yaml": {fmt.Sprintf("age recipient '%s'", missingRecipient)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			root := t.TempDir()
+			for _, f := range tt.files {
+				fPath := filepath.Join(root, f.name)
+				g.Expect(os.MkdirAll(filepath.Dir(fPath), 0o700)).To(Succeed())
+				g.Expect(os.WriteFile(fPath, f.data, 0o600)).To(Succeed())
+			}
+
+			d := &Decryptor{
+				root: root,
+				kustomization: &kustomizev1.Kustomization{
+					Spec: kustomizev1.KustomizationSpec{
+						Decryption: &kustomizev1.Decryption{
+							Provider: DecryptionProviderSOPS,
+							Paths:    tt.paths,
+						},
+					},
+				},
+				ageIdentities:   age.ParsedIdentities{id},
+				pgpFingerprints: []string{"0123456789ABCDEF0123456789ABCDEF01234567", preflightPGPFingerprint},
+			}
+
+			err := d.PreflightCheck(root)
+			if tt.wantMissing == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+				return
+			}
+
+			var decErr *DecryptionError
+			g.Expect(errors.As(err, &decErr)).To(BeTrue())
+			g.Expect(decErr.Reason).To(Equal(kustomizev1.DecryptionKeysMissingReason))
+			g.Expect(err.Error()).To(ContainSubstring("decryption keys are missing for %d SOPS encrypted file(s)", len(tt.wantMissing)))
+			for name, keys := range tt.wantMissing {
+				g.Expect(err.Error()).To(ContainSubstring("'%s' (%s)", name, strings.Join(keys, ", ")))
+			}
+		})
+	}
+}
+
+func TestDecryptor_PreflightCheck_NoDecryption(t *testing.T) {
+	g := NewWithT(t)
+
+	root := t.TempDir()
+	g.Expect(os.WriteFile(filepath.Join(root, "kustomization.yaml"), []byte("resources:\n- secret.yaml\n"), 0o600)).To(Succeed())
+	g.Expect(os.WriteFile(filepath.Join(root, "secret.yaml"), sopsYAMLWithKeyGroups(0, pgpKeyGroup(preflightPGPFingerprint)), 0o600)).To(Succeed())
+
+	d := &Decryptor{root: root, kustomization: &kustomizev1.Kustomization{}}
+	g.Expect(d.PreflightCheck(root)).To(Succeed())
+}
+
+func TestDecryptor_hasPGPKey(t *testing.T) {
+	d := &Decryptor{pgpFingerprints: []string{preflightPGPFingerprint}}
+	tests := []struct {
+		fingerprint string
+		want        bool
+	}{
+		{fingerprint: preflightPGPFingerprint, want: true},
+		{fingerprint: strings.ToLower(preflightPGPFingerprint), want: true},
+		{fingerprint: "9732075EA221A7EA", want: true},
+		{fingerprint: "35C1A64CD7FC0AB6EB66756B2445463C3234ECE1", want: false},
+		{fingerprint: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fingerprint, func(t *testing.T) {
+			if got := d.hasPGPKey(tt.fingerprint); got != tt.want {
+				t.Errorf("hasPGPKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptor_PreflightCheck_RemoteKeyServices(t *testing.T) {
+	g := NewWithT(t)
+
+	root := t.TempDir()
+	g.Expect(os.WriteFile(filepath.Join(root, "kustomization.yaml"), []byte("resources:\n- secret.yaml\n"), 0o600)).To(Succeed())
+	g.Expect(os.WriteFile(filepath.Join(root, "secret.yaml"), sopsYAMLWithKeyGroups(0, pgpKeyGroup(preflightPGPFingerprint)), 0o600)).To(Succeed())
+
+	// The keys of the remote key service are not known, and the data key
+	// may therefore be decrypted by it.
+	d := &Decryptor{
+		root: root,
+		kustomization: &kustomizev1.Kustomization{
+			Spec: kustomizev1.KustomizationSpec{
+				Decryption: &kustomizev1.Decryption{Provider: DecryptionProviderSOPS},
+			},
+		},
+		remoteKeyServices: []keyservice.KeyServiceClient{stubKeyService{}},
+	}
+	g.Expect(d.PreflightCheck(root)).To(Succeed())
+
+	d.remoteKeyServices = nil
+	g.Expect(d.PreflightCheck(root)).ToNot(Succeed())
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package securebytes provides helpers to remove secret data, such as
+// private keys, tokens and decrypted plaintext, from memory and disk once it
+// is no longer needed, to prevent it from ending up in e.g. core dumps.
+//
+// Go strings are immutable and can not be wiped, secret data should
+// therefore be kept in byte slices for as long as possible. Copies the
+// runtime makes when a slice grows, or which libraries keep internally, are
+// out of reach.
+package securebytes
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Wipe overwrites the given byte slices with zeros.
+func Wipe(bs ...[]byte) {
+	for _, b := range bs {
+		clear(b)
+	}
+}
+
+// WipeMap overwrites the values of the given map with zeros, e.g. the data
+// of a Kubernetes Secret. The entries are kept.
+func WipeMap[K comparable](m map[K][]byte) {
+	for _, v := range m {
+		clear(v)
+	}
+}
+
+// ShredFile overwrites the contents of the regular file at the given path
+// with zeros and flushes them to disk, to prevent the data from lingering
+// on the file system after the file is removed. Symlinks are not followed.
+func ShredFile(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New("cannot shred irregular file")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = io.CopyN(f, zeroReader{}, fi.Size()); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// zeroReader is an io.Reader returning an infinite stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
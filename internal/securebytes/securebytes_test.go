@@ -0,0 +1,73 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package securebytes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestWipe(t *testing.T) {
+	g := NewWithT(t)
+
+	key, token := []byte("AGE-SECRET-KEY-1"), []byte("hvs.token")
+	buf := make([]byte, 0, 32)
+	buf = append(buf, "plaintext"...)
+	Wipe(key, token, buf, nil)
+
+	g.Expect(key).To(Equal(make([]byte, len("AGE-SECRET-KEY-1"))))
+	g.Expect(token).To(Equal(make([]byte, len("hvs.token"))))
+	g.Expect(buf).To(Equal(make([]byte, len("plaintext"))))
+}
+
+func TestWipeMap(t *testing.T) {
+	g := NewWithT(t)
+
+	data := map[string][]byte{
+		"age.agekey":       []byte("AGE-SECRET-KEY-1"),
+		"sops.vault-token": []byte("hvs.token"),
+		"empty":            nil,
+	}
+	WipeMap(data)
+
+	g.Expect(data).To(HaveLen(3))
+	g.Expect(data["age.agekey"]).To(Equal(make([]byte, len("AGE-SECRET-KEY-1"))))
+	g.Expect(data["sops.vault-token"]).To(Equal(make([]byte, len("hvs.token"))))
+}
+
+func TestShredFile(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "secret.yaml")
+	g.Expect(os.WriteFile(file, []byte("secret"), 0o600)).To(Succeed())
+
+	g.Expect(ShredFile(file)).To(Succeed())
+	g.Expect(os.ReadFile(file)).To(Equal(make([]byte, len("secret"))))
+
+	link := filepath.Join(dir, "link")
+	target := filepath.Join(dir, "target")
+	g.Expect(os.WriteFile(target, []byte("data"), 0o600)).To(Succeed())
+	g.Expect(os.Symlink(target, link)).To(Succeed())
+	g.Expect(ShredFile(link)).To(MatchError("cannot shred irregular file"))
+	g.Expect(os.ReadFile(target)).To(Equal([]byte("data")))
+
+	g.Expect(ShredFile(filepath.Join(dir, "missing"))).ToNot(Succeed())
+}
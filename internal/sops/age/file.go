@@ -0,0 +1,95 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package age
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/fluxcd/kustomize-controller/internal/securebytes"
+)
+
+// IdentityFile is a concurrency safe reader of the age identities of a file,
+// e.g. mounted into the controller by a CSI secret-store volume. The
+// identities are parsed once, and parsed again when the modification time
+// or size of the file changes, which allows the file to be rotated without
+// a restart.
+type IdentityFile struct {
+	path string
+
+	mu         sync.Mutex
+	modTime    time.Time
+	size       int64
+	identities []age.Identity
+}
+
+// NewIdentityFile returns a new IdentityFile for the file at the given path.
+// The file is not read until the first call to Identities.
+func NewIdentityFile(path string) *IdentityFile {
+	return &IdentityFile{path: path}
+}
+
+// Path returns the path of the file.
+func (f *IdentityFile) Path() string {
+	return f.path
+}
+
+// Identities returns the age identities of the file, see ParseIdentities.
+// SSH private keys must not be encrypted with a passphrase.
+//
+// It returns an error if the file can not be read, or its identities can
+// not be parsed, in which case the identities are parsed again on the next
+// call.
+func (f *IdentityFile) Identities() ([]age.Identity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The file is stat'ed through any symlink, as CSI and Kubernetes
+	// volumes atomically replace the files by swapping a symlink.
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		f.reset()
+		return nil, fmt.Errorf("failed to read age identity file '%s': %w", f.path, err)
+	}
+	if f.identities != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.identities, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		f.reset()
+		return nil, fmt.Errorf("failed to read age identity file '%s': %w", f.path, err)
+	}
+	defer securebytes.Wipe(data)
+	identities, err := ParseIdentities(data, nil)
+	if err != nil {
+		f.reset()
+		return nil, fmt.Errorf("failed to parse age identity file '%s': %w", f.path, err)
+	}
+	f.modTime, f.size, f.identities = fi.ModTime(), fi.Size(), identities
+	return f.identities, nil
+}
+
+// reset forgets the parsed identities. It must be called while holding the
+// lock.
+func (f *IdentityFile) reset() {
+	f.modTime, f.size, f.identities = time.Time{}, 0, nil
+}
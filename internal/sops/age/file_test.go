@@ -0,0 +1,107 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package age
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	. "github.com/onsi/gomega"
+)
+
+func TestIdentityFile_Identities(t *testing.T) {
+	g := NewWithT(t)
+
+	id, err := age.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+	rotatedID, err := age.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	path := filepath.Join(t.TempDir(), "keys.txt")
+	f := NewIdentityFile(path)
+	g.Expect(f.Path()).To(Equal(path))
+
+	_, err = f.Identities()
+	g.Expect(err).To(MatchError(ContainSubstring("failed to read age identity file '%s'", path)))
+
+	modTime := time.Unix(1700000000, 0)
+	g.Expect(os.WriteFile(path, []byte("# created\n"+id.String()+"\n"), 0o600)).To(Succeed())
+	g.Expect(os.Chtimes(path, modTime, modTime)).To(Succeed())
+
+	identities, err := f.Identities()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(identities).To(HaveLen(1))
+	g.Expect(identities[0].(*age.X25519Identity).Recipient().String()).To(Equal(id.Recipient().String()))
+
+	// Changes to the content without a change of the modification time and
+	// size are not observed.
+	g.Expect(os.WriteFile(path, []byte("# rotated\n"+rotatedID.String()+"\n"), 0o600)).To(Succeed())
+	g.Expect(os.Chtimes(path, modTime, modTime)).To(Succeed())
+	identities, err = f.Identities()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(identities[0].(*age.X25519Identity).Recipient().String()).To(Equal(id.Recipient().String()))
+
+	modTime = modTime.Add(time.Minute)
+	g.Expect(os.Chtimes(path, modTime, modTime)).To(Succeed())
+	identities, err = f.Identities()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(identities).To(HaveLen(1))
+	g.Expect(identities[0].(*age.X25519Identity).Recipient().String()).To(Equal(rotatedID.Recipient().String()))
+
+	g.Expect(os.WriteFile(path, []byte("invalid\n"), 0o600)).To(Succeed())
+	_, err = f.Identities()
+	g.Expect(err).To(MatchError(ContainSubstring("failed to parse age identity file '%s'", path)))
+}
+
+func TestIdentityFile_Identities_Symlink(t *testing.T) {
+	g := NewWithT(t)
+
+	id, err := age.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+	rotatedID, err := age.GenerateX25519Identity()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// Mimic the atomic writer of Kubernetes and CSI volumes, which swaps the
+	// symlink to a directory with the new version of the files.
+	dir := t.TempDir()
+	modTime := time.Unix(1700000000, 0)
+	for i, data := range []string{id.String(), rotatedID.String()} {
+		version := filepath.Join(dir, fmt.Sprintf("..version%d", i))
+		g.Expect(os.Mkdir(version, 0o700)).To(Succeed())
+		g.Expect(os.WriteFile(filepath.Join(version, "keys.txt"), []byte(data+"\n"), 0o600)).To(Succeed())
+		mtime := modTime.Add(time.Duration(i) * time.Minute)
+		g.Expect(os.Chtimes(filepath.Join(version, "keys.txt"), mtime, mtime)).To(Succeed())
+	}
+	g.Expect(os.Symlink("..version0", filepath.Join(dir, "..data"))).To(Succeed())
+	g.Expect(os.Symlink(filepath.Join("..data", "keys.txt"), filepath.Join(dir, "keys.txt"))).To(Succeed())
+
+	f := NewIdentityFile(filepath.Join(dir, "keys.txt"))
+	identities, err := f.Identities()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(identities[0].(*age.X25519Identity).Recipient().String()).To(Equal(id.Recipient().String()))
+
+	g.Expect(os.Symlink("..version1", filepath.Join(dir, "..data_tmp"))).To(Succeed())
+	g.Expect(os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))).To(Succeed())
+
+	identities, err = f.Identities()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(identities[0].(*age.X25519Identity).Recipient().String()).To(Equal(rotatedID.Recipient().String()))
+}
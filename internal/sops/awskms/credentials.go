@@ -17,12 +17,275 @@ limitations under the License.
 package awskms
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/yaml"
 )
 
+const (
+	// RoleARNAnnotation is the annotation of a Kubernetes ServiceAccount
+	// containing the ARN of the IAM role to assume with a token of the
+	// ServiceAccount, as used by IAM Roles for Service Accounts (IRSA).
+	RoleARNAnnotation = "eks.amazonaws.com/role-arn"
+
+	// ServiceAccountTokenAudience is the audience of the ServiceAccount
+	// tokens exchanged for credentials of an IAM role.
+	ServiceAccountTokenAudience = "sts.amazonaws.com"
+
+	// defaultSTSRegion is the region of the STS client used to assume a role
+	// with a web identity token, when no region is configured in the
+	// environment.
+	defaultSTSRegion = "us-east-1"
+)
+
+// Config is the AWS KMS configuration found in a decryption Secret.
+type Config struct {
+	// AccessKeyID is the access key ID of static credentials.
+	AccessKeyID string `json:"aws_access_key_id,omitempty"`
+	// SecretAccessKey is the secret access key of static credentials.
+	SecretAccessKey string `json:"aws_secret_access_key,omitempty"`
+	// SessionToken is the (optional) session token of static credentials.
+	SessionToken string `json:"aws_session_token,omitempty"`
+
+	// Credentials is the content of a shared credentials file in the INI
+	// format, with one or more profiles.
+	Credentials string `json:"credentials,omitempty"`
+	// Profile is the (optional) profile of the Credentials to use. Defaults
+	// to "default".
+	Profile string `json:"profile,omitempty"`
+
+	// RoleARN is the ARN of the IAM role to assume with the web identity
+	// token in WebIdentityTokenFile.
+	RoleARN string `json:"role_arn,omitempty"`
+	// WebIdentityTokenFile is the path to the web identity token file.
+	// Defaults to the AWS_WEB_IDENTITY_TOKEN_FILE environment variable.
+	WebIdentityTokenFile string `json:"web_identity_token_file,omitempty"`
+	// SessionName is the (optional) name of the role session.
+	SessionName string `json:"session_name,omitempty"`
+
+	// AssumeRoleARN is the ARN of the IAM role to assume with the base
+	// credentials (the static or web identity credentials of the Config, or
+	// else the default credential chain), for example in another account.
+	// It takes precedence over the role of the keys in the SOPS metadata.
+	AssumeRoleARN string `json:"aws_role_arn,omitempty"`
+	// ExternalID is the (optional) external ID to assume the AssumeRoleARN
+	// with.
+	ExternalID string `json:"aws_external_id,omitempty"`
+	// AssumeRoleSessionName is the (optional) name of the AssumeRoleARN
+	// session.
+	AssumeRoleSessionName string `json:"aws_session_name,omitempty"`
+
+	// KMSEndpoint is the (optional) URL of the KMS endpoint, for example a
+	// FIPS or VPC interface endpoint.
+	KMSEndpoint string `json:"aws_endpoint_kms,omitempty"`
+	// STSEndpoint is the (optional) URL of the STS endpoint used to assume
+	// roles, for example a FIPS or VPC interface endpoint.
+	STSEndpoint string `json:"aws_endpoint_sts,omitempty"`
+
+	// Region is the (optional) region of the KMS client, overriding the
+	// region of the key ARNs. For multi-region keys, the replica in the
+	// Region is used.
+	Region string `json:"aws_region,omitempty"`
+	// ReplicaRegions are the (optional) regions of the replicas of
+	// multi-region keys, to which decryption fails over when it fails in the
+	// region of the key (or the Region).
+	ReplicaRegions []string `json:"aws_replica_regions,omitempty"`
+
+	// RequiredContext is the (optional) encryption context the KMS keys in
+	// the SOPS metadata must have to be used for decryption.
+	RequiredContext map[string]string `json:"aws_required_context,omitempty"`
+
+	// ProxyURL is the (optional) URL of the HTTP(S) proxy to send the KMS and
+	// STS requests through, instead of the proxy configured with the
+	// HTTPS_PROXY and NO_PROXY environment variables.
+	ProxyURL string `json:"aws_proxy_url,omitempty"`
+}
+
+// LoadConfigFromYAML parses the given YAML into the Config, or returns an
+// error if the YAML could not be parsed.
+func LoadConfigFromYAML(b []byte, c *Config) error {
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return fmt.Errorf("failed to unmarshal AWS credentials file: %w", err)
+	}
+	return nil
+}
+
+// Validate returns an error if more than one kind of base credentials is
+// configured, or if the endpoint or proxy URLs, regions or required
+// encryption context of the Config are invalid.
+func (c Config) Validate() error {
+	var kinds int
+	for _, set := range []bool{c.AccessKeyID != "" || c.SecretAccessKey != "", c.RoleARN != "", c.Credentials != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds > 1 {
+		return errors.New("only one of 'aws_access_key_id', 'role_arn' or 'credentials' can be specified")
+	}
+	if c.Profile != "" && c.Credentials == "" {
+		return errors.New("'profile' requires 'credentials'")
+	}
+	if err := ValidateEndpoint(c.KMSEndpoint); err != nil {
+		return fmt.Errorf("invalid 'aws_endpoint_kms': %w", err)
+	}
+	if err := ValidateEndpoint(c.STSEndpoint); err != nil {
+		return fmt.Errorf("invalid 'aws_endpoint_sts': %w", err)
+	}
+	if err := ValidateRegion(c.Region); err != nil {
+		return fmt.Errorf("invalid 'aws_region': %w", err)
+	}
+	for _, region := range c.ReplicaRegions {
+		if region == "" {
+			return errors.New("invalid 'aws_replica_regions': region can not be empty")
+		}
+		if err := ValidateRegion(region); err != nil {
+			return fmt.Errorf("invalid 'aws_replica_regions': %w", err)
+		}
+	}
+	if _, ok := c.RequiredContext[""]; ok {
+		return errors.New("invalid 'aws_required_context': key can not be empty")
+	}
+	if err := ValidateProxyURL(c.ProxyURL); err != nil {
+		return fmt.Errorf("invalid 'aws_proxy_url': %w", err)
+	}
+	return nil
+}
+
+// ValidateEndpoint returns an error if the given endpoint is not empty,
+// and is not an absolute http or https URL.
+func ValidateEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint URL '%s': must be an absolute http or https URL", endpoint)
+	}
+	return nil
+}
+
+// ValidateRegion returns an error if the given region is not empty, and is
+// not a valid AWS region name.
+func ValidateRegion(region string) error {
+	if region == "" || regionRegex.MatchString(region) {
+		return nil
+	}
+	return fmt.Errorf("invalid region '%s'", region)
+}
+
+// CredentialsProvider returns an aws.CredentialsProvider for the Config.
+// When a RoleARN is set, it assumes the role with the web identity token
+// found in the WebIdentityTokenFile (or AWS_WEB_IDENTITY_TOKEN_FILE).
+// When an access key or Credentials file is set, it returns a
+// credentials.StaticCredentialsProvider.
+// When an AssumeRoleARN is set, the role is assumed with these credentials,
+// or the default credential chain. Otherwise, it returns nil if no
+// credentials are configured. Roles are assumed using the STSEndpoint, if
+// set.
+func (c Config) CredentialsProvider(ctx context.Context) (aws.CredentialsProvider, error) {
+	var provider aws.CredentialsProvider
+	switch {
+	case c.RoleARN != "":
+		tokenFile := c.WebIdentityTokenFile
+		if tokenFile == "" {
+			tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		if tokenFile == "" {
+			return nil, errors.New("a 'web_identity_token_file' or the AWS_WEB_IDENTITY_TOKEN_FILE environment variable is required with 'role_arn'")
+		}
+		httpClient, err := NewHTTPClient(nil, c.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		provider = NewWebIdentityCredentialsProvider(NewSTSClient(c.STSEndpoint, httpClient), c.RoleARN, c.SessionName, stscreds.IdentityTokenFile(tokenFile))
+	case c.AccessKeyID != "" || c.SecretAccessKey != "":
+		provider = credentials.NewStaticCredentialsProvider(c.AccessKeyID, c.SecretAccessKey, c.SessionToken)
+	case c.Credentials != "":
+		var err error
+		if provider, err = loadSharedCredentials(ctx, c.Credentials, c.Profile); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.AssumeRoleARN == "" {
+		return provider, nil
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, func(lo *config.LoadOptions) error {
+		if provider != nil {
+			lo.Credentials = provider
+		}
+		lo.Region = stsRegion()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not load AWS config to assume role '%s': %w", c.AssumeRoleARN, err)
+	}
+	if cfg.HTTPClient, err = NewHTTPClient(cfg.HTTPClient, c.ProxyURL); err != nil {
+		return nil, err
+	}
+	return NewAssumeRoleCredentialsProvider(newSTSClientFromConfig(cfg, c.STSEndpoint), c.AssumeRoleARN, c.AssumeRoleSessionName, c.ExternalID), nil
+}
+
+// loadSharedCredentials returns a credentials.StaticCredentialsProvider with
+// the credentials of the profile (or "default") in the given shared
+// credentials file content. The content is written to a temporary file for
+// config.LoadSharedConfigProfile, which is removed before returning.
+//
+// Only the static credentials of the profile are used: other credential
+// sources, such as a `credential_process`, would run with the privileges of
+// the controller.
+func loadSharedCredentials(ctx context.Context, content, profile string) (aws.CredentialsProvider, error) {
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.CreateTemp("", "aws-credentials-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary AWS credentials file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write temporary AWS credentials file: %w", err)
+	}
+
+	sharedConfig, err := config.LoadSharedConfigProfile(ctx, profile, func(o *config.LoadSharedConfigOptions) {
+		o.ConfigFiles = []string{}
+		o.CredentialsFiles = []string{f.Name()}
+	})
+	if err != nil {
+		var notExistErr config.SharedConfigProfileNotExistError
+		if errors.As(err, &notExistErr) {
+			return nil, fmt.Errorf("profile '%s' not found in 'credentials'", profile)
+		}
+		return nil, fmt.Errorf("failed to load 'credentials': %w", err)
+	}
+	creds := sharedConfig.Credentials
+	if !creds.HasKeys() {
+		return nil, fmt.Errorf("profile '%s' in 'credentials' does not contain an 'aws_access_key_id' and 'aws_secret_access_key'", profile)
+	}
+	return credentials.NewStaticCredentialsProvider(creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken), nil
+}
+
 // LoadStaticCredentialsFromYAML parses the given YAML and returns a
 // credentials.StaticCredentialsProvider that can be used to authenticate with
 // AWS, or an error if the YAML could not be parsed.
@@ -37,3 +300,86 @@ func LoadStaticCredentialsFromYAML(b []byte) (credentials.StaticCredentialsProvi
 	}
 	return credentials.NewStaticCredentialsProvider(d.AccessKeyID, d.SecretAccessKey, d.SessionToken), nil
 }
+
+// NewSTSClient returns an anonymous STS client for the stsRegion, to assume
+// roles with web identity tokens. When the endpoint is not empty, it is used
+// instead of the endpoint resolved for the region. When the httpClient is nil,
+// the default HTTP client of the SDK is used.
+func NewSTSClient(endpoint string, httpClient aws.HTTPClient) *sts.Client {
+	o := sts.Options{Region: stsRegion(), HTTPClient: httpClient}
+	if endpoint != "" {
+		o.BaseEndpoint = aws.String(endpoint)
+	}
+	return sts.New(o)
+}
+
+// newSTSClientFromConfig returns an STS client for the given config. When
+// the endpoint is not empty, it is used instead of the endpoint resolved for
+// the region of the config.
+func newSTSClientFromConfig(cfg aws.Config, endpoint string) *sts.Client {
+	return sts.NewFromConfig(cfg, func(o *sts.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+}
+
+// stsRegion returns the region configured in the AWS_REGION or
+// AWS_DEFAULT_REGION environment variable, or else defaultSTSRegion.
+func stsRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	if region := os.Getenv("AWS_DEFAULT_REGION"); region != "" {
+		return region
+	}
+	return defaultSTSRegion
+}
+
+// NewAssumeRoleCredentialsProvider returns an aws.CredentialsProvider which
+// assumes the given role using the STS client, with the external ID if not
+// empty. When the session name is empty, the defaultSessionName is used.
+// The credentials are cached until they are near expiry.
+func NewAssumeRoleCredentialsProvider(client stscreds.AssumeRoleAPIClient, roleARN, sessionName, externalID string) aws.CredentialsProvider {
+	if sessionName == "" {
+		sessionName = defaultSessionName()
+	}
+	return aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(client, roleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = sessionName
+		if externalID != "" {
+			o.ExternalID = aws.String(externalID)
+		}
+	}))
+}
+
+// NewWebIdentityCredentialsProvider returns an aws.CredentialsProvider which
+// assumes the given role using the STS client, with the web identity token
+// of the retriever. The credentials are cached until they are near expiry.
+func NewWebIdentityCredentialsProvider(client stscreds.AssumeRoleWithWebIdentityAPIClient, roleARN, sessionName string, token stscreds.IdentityTokenRetriever) aws.CredentialsProvider {
+	return aws.NewCredentialsCache(stscreds.NewWebIdentityRoleProvider(client, roleARN, token, func(o *stscreds.WebIdentityRoleOptions) {
+		o.RoleSessionName = sessionName
+	}))
+}
+
+// ServiceAccountToken is a stscreds.IdentityTokenRetriever which requests a
+// token for a Kubernetes ServiceAccount with the ServiceAccountTokenAudience.
+type ServiceAccountToken struct {
+	// Client is used to request the token.
+	Client client.Client
+	// ServiceAccount is the ServiceAccount to request the token for.
+	ServiceAccount *corev1.ServiceAccount
+}
+
+// GetIdentityToken requests a token for the ServiceAccount.
+func (t ServiceAccountToken) GetIdentityToken() ([]byte, error) {
+	tokenRequest := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences: []string{ServiceAccountTokenAudience},
+		},
+	}
+	if err := t.Client.SubResource("token").Create(context.TODO(), t.ServiceAccount, tokenRequest); err != nil {
+		return nil, fmt.Errorf("failed to request token for ServiceAccount '%s/%s': %w",
+			t.ServiceAccount.Namespace, t.ServiceAccount.Name, err)
+	}
+	return []byte(tokenRequest.Status.Token), nil
+}
@@ -18,9 +18,21 @@ package awskms
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func TestLoadStaticCredentialsFromYAML(t *testing.T) {
@@ -40,3 +52,447 @@ aws_session_token: test-token
 	g.Expect(creds.SecretAccessKey).To(Equal("test-secret"))
 	g.Expect(creds.SessionToken).To(Equal("test-token"))
 }
+
+func TestLoadConfigFromYAML(t *testing.T) {
+	g := NewWithT(t)
+
+	conf := Config{}
+	g.Expect(LoadConfigFromYAML([]byte(`
+role_arn: arn:aws:iam::123456789012:role/sops
+web_identity_token_file: /var/run/secrets/token
+session_name: sops-session
+`), &conf)).To(Succeed())
+	g.Expect(conf).To(Equal(Config{
+		RoleARN:              "arn:aws:iam::123456789012:role/sops",
+		WebIdentityTokenFile: "/var/run/secrets/token",
+		SessionName:          "sops-session",
+	}))
+
+	g.Expect(LoadConfigFromYAML([]byte("invalid"), &conf)).ToNot(Succeed())
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    Config
+		wantErr string
+	}{
+		{
+			name: "without endpoints",
+		},
+		{
+			name: "credentials with profile",
+			conf: Config{
+				Credentials: "[default]",
+				Profile:     "production",
+			},
+		},
+		{
+			name: "static credentials and credentials file",
+			conf: Config{
+				AccessKeyID: "test-id",
+				Credentials: "[default]",
+			},
+			wantErr: "only one of 'aws_access_key_id', 'role_arn' or 'credentials' can be specified",
+		},
+		{
+			name: "web identity and static credentials",
+			conf: Config{
+				AccessKeyID:     "test-id",
+				SecretAccessKey: "test-secret",
+				RoleARN:         "arn:aws:iam::123456789012:role/sops",
+			},
+			wantErr: "only one of 'aws_access_key_id', 'role_arn' or 'credentials' can be specified",
+		},
+		{
+			name: "profile without credentials",
+			conf: Config{
+				Profile: "production",
+			},
+			wantErr: "'profile' requires 'credentials'",
+		},
+		{
+			name: "valid endpoints",
+			conf: Config{
+				KMSEndpoint: "https://kms-fips.us-gov-west-1.amazonaws.com",
+				STSEndpoint: "https://vpce-0123456789abcdef-abcdefgh.sts.us-west-2.vpce.amazonaws.com",
+			},
+		},
+		{
+			name: "KMS endpoint without scheme",
+			conf: Config{
+				KMSEndpoint: "kms-fips.us-gov-west-1.amazonaws.com",
+			},
+			wantErr: "invalid 'aws_endpoint_kms': invalid endpoint URL 'kms-fips.us-gov-west-1.amazonaws.com': must be an absolute http or https URL",
+		},
+		{
+			name: "region",
+			conf: Config{
+				Region: "us-gov-west-1",
+			},
+		},
+		{
+			name: "invalid region",
+			conf: Config{
+				Region: "US West 2",
+			},
+			wantErr: "invalid 'aws_region': invalid region 'US West 2'",
+		},
+		{
+			name: "replica regions",
+			conf: Config{
+				ReplicaRegions: []string{"us-east-1", "eu-west-1"},
+			},
+		},
+		{
+			name: "invalid replica region",
+			conf: Config{
+				ReplicaRegions: []string{"us-east-1", "eu west 1"},
+			},
+			wantErr: "invalid 'aws_replica_regions': invalid region 'eu west 1'",
+		},
+		{
+			name: "empty replica region",
+			conf: Config{
+				ReplicaRegions: []string{""},
+			},
+			wantErr: "invalid 'aws_replica_regions': region can not be empty",
+		},
+		{
+			name: "required context",
+			conf: Config{
+				RequiredContext: map[string]string{"tenant": "team-a"},
+			},
+		},
+		{
+			name: "required context with empty key",
+			conf: Config{
+				RequiredContext: map[string]string{"": "team-a"},
+			},
+			wantErr: "invalid 'aws_required_context': key can not be empty",
+		},
+		{
+			name: "proxy URL",
+			conf: Config{
+				ProxyURL: "http://proxy.example.com:3128",
+			},
+		},
+		{
+			name: "invalid proxy URL",
+			conf: Config{
+				ProxyURL: "socks5://proxy.example.com:1080",
+			},
+			wantErr: "invalid 'aws_proxy_url': invalid proxy URL 'socks5://proxy.example.com:1080': must be an absolute http or https URL",
+		},
+		{
+			name: "STS endpoint with unsupported scheme",
+			conf: Config{
+				STSEndpoint: "ftp://sts.amazonaws.com",
+			},
+			wantErr: "invalid 'aws_endpoint_sts': invalid endpoint URL 'ftp://sts.amazonaws.com': must be an absolute http or https URL",
+		},
+		{
+			name: "unparsable endpoint",
+			conf: Config{
+				KMSEndpoint: "https://kms.amazonaws.com/%zz",
+			},
+			wantErr: "invalid 'aws_endpoint_kms': invalid endpoint URL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			err := tt.conf.Validate()
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+		})
+	}
+}
+
+func TestConfig_CredentialsProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    Config
+		env     map[string]string
+		want    interface{}
+		wantErr string
+	}{
+		{
+			name: "static credentials",
+			conf: Config{
+				AccessKeyID:     "test-id",
+				SecretAccessKey: "test-secret",
+			},
+			want: credentials.StaticCredentialsProvider{},
+		},
+		{
+			name: "web identity with token file",
+			conf: Config{
+				RoleARN:              "arn:aws:iam::123456789012:role/sops",
+				WebIdentityTokenFile: "/var/run/secrets/token",
+			},
+			want: &aws.CredentialsCache{},
+		},
+		{
+			name: "web identity with token file from environment",
+			conf: Config{
+				RoleARN: "arn:aws:iam::123456789012:role/sops",
+			},
+			env: map[string]string{
+				"AWS_WEB_IDENTITY_TOKEN_FILE": "/var/run/secrets/token",
+			},
+			want: &aws.CredentialsCache{},
+		},
+		{
+			name: "no credentials",
+			conf: Config{},
+			want: nil,
+		},
+		{
+			name: "credentials file",
+			conf: Config{
+				Credentials: "[default]\naws_access_key_id = test-id\naws_secret_access_key = test-secret\n",
+			},
+			want: credentials.StaticCredentialsProvider{},
+		},
+		{
+			name: "credentials file without profile",
+			conf: Config{
+				Credentials: "[default]\naws_access_key_id = test-id\naws_secret_access_key = test-secret\n",
+				Profile:     "production",
+			},
+			wantErr: "profile 'production' not found in 'credentials'",
+		},
+		{
+			name: "assume role with static credentials",
+			conf: Config{
+				AccessKeyID:     "test-id",
+				SecretAccessKey: "test-secret",
+				AssumeRoleARN:   "arn:aws:iam::123456789012:role/central",
+				ExternalID:      "some-external-id",
+			},
+			want: &aws.CredentialsCache{},
+		},
+		{
+			name: "assume role with default credentials",
+			conf: Config{
+				AssumeRoleARN: "arn:aws:iam::123456789012:role/central",
+			},
+			want: &aws.CredentialsCache{},
+		},
+		{
+			name: "web identity without token file",
+			conf: Config{
+				RoleARN: "arn:aws:iam::123456789012:role/sops",
+			},
+			wantErr: "a 'web_identity_token_file' or the AWS_WEB_IDENTITY_TOKEN_FILE environment variable is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			got, err := tt.conf.CredentialsProvider(context.TODO())
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			if tt.want == nil {
+				g.Expect(got).To(BeNil())
+				return
+			}
+			g.Expect(got).To(BeAssignableToTypeOf(tt.want))
+		})
+	}
+}
+
+func TestNewWebIdentityCredentialsProvider(t *testing.T) {
+	g := NewWithT(t)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	g.Expect(os.WriteFile(tokenFile, []byte("web-identity-token"), 0o600)).To(Succeed())
+
+	stub := &stubSTS{}
+	provider := NewWebIdentityCredentialsProvider(stub, "arn:aws:iam::123456789012:role/sops", "sops-session",
+		stscreds.IdentityTokenFile(tokenFile))
+
+	for i := 0; i < 2; i++ {
+		creds, err := provider.Retrieve(context.TODO())
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(creds.AccessKeyID).To(Equal("assumed-id"))
+		g.Expect(creds.SecretAccessKey).To(Equal("assumed-secret"))
+		g.Expect(creds.SessionToken).To(Equal("assumed-token"))
+	}
+
+	// The credentials are cached until they expire.
+	g.Expect(stub.inputs).To(HaveLen(1))
+	g.Expect(*stub.inputs[0].RoleArn).To(Equal("arn:aws:iam::123456789012:role/sops"))
+	g.Expect(*stub.inputs[0].RoleSessionName).To(Equal("sops-session"))
+	g.Expect(*stub.inputs[0].WebIdentityToken).To(Equal("web-identity-token"))
+}
+
+func TestNewWebIdentityCredentialsProvider_Error(t *testing.T) {
+	g := NewWithT(t)
+
+	stub := &stubSTS{err: errors.New("InvalidIdentityToken")}
+	provider := NewWebIdentityCredentialsProvider(stub, "arn:aws:iam::123456789012:role/sops", "",
+		stscreds.IdentityTokenFile(filepath.Join(t.TempDir(), "token")))
+
+	_, err := provider.Retrieve(context.TODO())
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("unable to read file"))
+	g.Expect(stub.inputs).To(BeEmpty())
+
+	provider = NewWebIdentityCredentialsProvider(stub, "arn:aws:iam::123456789012:role/sops", "",
+		stubToken("web-identity-token"))
+	_, err = provider.Retrieve(context.TODO())
+	g.Expect(err).To(MatchError(ContainSubstring("InvalidIdentityToken")))
+	g.Expect(stub.inputs).To(HaveLen(1))
+}
+
+func TestServiceAccountToken_GetIdentityToken(t *testing.T) {
+	g := NewWithT(t)
+
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "tenant",
+			Namespace: "tenant-ns",
+		},
+	}
+	c := fake.NewClientBuilder().WithObjects(sa).Build()
+
+	token, err := ServiceAccountToken{Client: c, ServiceAccount: sa}.GetIdentityToken()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).ToNot(BeEmpty())
+
+	_, err = ServiceAccountToken{Client: c, ServiceAccount: &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "missing",
+			Namespace: "tenant-ns",
+		},
+	}}.GetIdentityToken()
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to request token for ServiceAccount 'tenant-ns/missing'"))
+}
+
+// stubSTS is a stscreds.AssumeRoleWithWebIdentityAPIClient recording its
+// inputs, and returning err or else static credentials.
+type stubSTS struct {
+	err    error
+	inputs []*sts.AssumeRoleWithWebIdentityInput
+}
+
+func (s *stubSTS) AssumeRoleWithWebIdentity(_ context.Context, params *sts.AssumeRoleWithWebIdentityInput, _ ...func(*sts.Options)) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	s.inputs = append(s.inputs, params)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &sts.AssumeRoleWithWebIdentityOutput{
+		Credentials: &ststypes.Credentials{
+			AccessKeyId:     aws.String("assumed-id"),
+			SecretAccessKey: aws.String("assumed-secret"),
+			SessionToken:    aws.String("assumed-token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+// stubToken is a stscreds.IdentityTokenRetriever returning a static token.
+type stubToken string
+
+func (t stubToken) GetIdentityToken() ([]byte, error) {
+	return []byte(t), nil
+}
+
+func Test_loadSharedCredentials(t *testing.T) {
+	const credentialsFile = `[default]
+aws_access_key_id = default-id
+aws_secret_access_key = default-secret
+
+[production]
+aws_access_key_id = production-id
+aws_secret_access_key = production-secret
+aws_session_token = production-token
+
+[process]
+credential_process = /bin/sh -c 'echo pwned'
+`
+	tests := []struct {
+		name      string
+		profile   string
+		content   string
+		wantCreds aws.Credentials
+		wantErr   string
+	}{
+		{
+			name:    "default profile",
+			content: credentialsFile,
+			wantCreds: aws.Credentials{
+				AccessKeyID:     "default-id",
+				SecretAccessKey: "default-secret",
+			},
+		},
+		{
+			name:    "named profile with session token",
+			profile: "production",
+			content: credentialsFile,
+			wantCreds: aws.Credentials{
+				AccessKeyID:     "production-id",
+				SecretAccessKey: "production-secret",
+				SessionToken:    "production-token",
+			},
+		},
+		{
+			name:    "profile not found",
+			profile: "staging",
+			content: credentialsFile,
+			wantErr: "profile 'staging' not found in 'credentials'",
+		},
+		{
+			name:    "profile without static credentials",
+			profile: "process",
+			content: credentialsFile,
+			wantErr: "profile 'process' in 'credentials' does not contain an 'aws_access_key_id' and 'aws_secret_access_key'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			tmpDir := t.TempDir()
+			t.Setenv("TMPDIR", tmpDir)
+
+			got, err := loadSharedCredentials(context.TODO(), tt.content, tt.profile)
+
+			// The temporary credentials file is always removed.
+			entries, dirErr := os.ReadDir(tmpDir)
+			g.Expect(dirErr).ToNot(HaveOccurred())
+			g.Expect(entries).To(BeEmpty())
+
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+
+			creds, err := got.Retrieve(context.TODO())
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(creds.AccessKeyID).To(Equal(tt.wantCreds.AccessKeyID))
+			g.Expect(creds.SecretAccessKey).To(Equal(tt.wantCreds.SecretAccessKey))
+			g.Expect(creds.SessionToken).To(Equal(tt.wantCreds.SessionToken))
+		})
+	}
+}
@@ -0,0 +1,369 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awskms
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	awskms "github.com/getsops/sops/v3/kms"
+)
+
+const (
+	// roleSessionNameLengthLimit is the maximum length of an STS role
+	// session name.
+	roleSessionNameLengthLimit = 64
+
+	// defaultAttemptTimeout is the default timeout of a decryption attempt
+	// in a region, when failing over to the ReplicaRegions of a
+	// multi-region key.
+	defaultAttemptTimeout = 10 * time.Second
+)
+
+var (
+	// partitions are the AWS partitions in which KMS keys can be used.
+	partitions = map[string]struct{}{
+		"aws":        {},
+		"aws-cn":     {},
+		"aws-us-gov": {},
+		"aws-iso":    {},
+		"aws-iso-b":  {},
+	}
+	// accountIDRegex matches an AWS account ID.
+	accountIDRegex = regexp.MustCompile(`^[0-9]{12}$`)
+	// regionRegex matches an AWS region name, for example "us-west-2" or
+	// "cn-north-1".
+	regionRegex = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+	// sessionNameRegex matches the characters which are not allowed in an
+	// STS role session name.
+	sessionNameRegex = regexp.MustCompile(`[^a-zA-Z0-9=,.@_-]+`)
+)
+
+// ClientOptions configures the AWS KMS client used by Encrypt and Decrypt.
+type ClientOptions struct {
+	// CredentialsProvider provides the credentials for the requests. When
+	// nil, the default credential chain of the controller is used.
+	CredentialsProvider aws.CredentialsProvider
+	// IgnoreKeyRole disables assuming the role of the key found in the SOPS
+	// metadata, as the CredentialsProvider assumes a role configured in the
+	// decryption Secret which takes precedence.
+	IgnoreKeyRole bool
+	// KMSEndpoint is the URL of the KMS endpoint. When empty, the endpoint
+	// is resolved for the region of the key.
+	KMSEndpoint string
+	// STSEndpoint is the URL of the STS endpoint used to assume the role of
+	// the key. When empty, the endpoint is resolved for the region of the
+	// key.
+	STSEndpoint string
+	// Region overrides the region of the key ARN for the KMS client. The ARN
+	// of a multi-region key is rewritten to the ARN of its replica in the
+	// Region.
+	Region string
+	// ReplicaRegions are the regions of the replicas of multi-region keys.
+	// When Decrypt fails in the region of the key (or the Region), it is
+	// attempted in each of the ReplicaRegions in order, until it succeeds.
+	ReplicaRegions []string
+	// AttemptTimeout is the timeout of each decryption attempt when failing
+	// over to the ReplicaRegions. Defaults to defaultAttemptTimeout.
+	AttemptTimeout time.Duration
+	// OnRegionFailover is called when Decrypt succeeds in one of the
+	// ReplicaRegions, with the region and the errors of the preceding
+	// attempts.
+	OnRegionFailover func(key *awskms.MasterKey, region string, err error)
+	// RequiredContext is the encryption context the key must have for
+	// Decrypt. Each of its keys must be present in the encryption context of
+	// the key, with the same value.
+	RequiredContext map[string]string
+	// ProxyURL is the URL of the HTTP(S) proxy to send the KMS and STS
+	// requests through. When empty, the proxy is determined by the
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+	ProxyURL string
+}
+
+// keyARN is a parsed ARN of an AWS KMS key or alias.
+type keyARN struct {
+	arn.ARN
+}
+
+// parseKeyARN parses the given ARN of an AWS KMS key or alias, in any of the
+// known partitions. It returns an error naming the ARN if it is invalid.
+func parseKeyARN(s string) (keyARN, error) {
+	a, err := arn.Parse(s)
+	if err != nil {
+		return keyARN{}, fmt.Errorf("invalid AWS KMS key ARN '%s': %w", s, err)
+	}
+	if _, ok := partitions[a.Partition]; !ok {
+		return keyARN{}, fmt.Errorf("invalid AWS KMS key ARN '%s': unknown partition '%s'", s, a.Partition)
+	}
+	if a.Service != "kms" {
+		return keyARN{}, fmt.Errorf("invalid AWS KMS key ARN '%s': service must be 'kms'", s)
+	}
+	if !regionRegex.MatchString(a.Region) {
+		return keyARN{}, fmt.Errorf("invalid AWS KMS key ARN '%s': invalid region '%s'", s, a.Region)
+	}
+	if !accountIDRegex.MatchString(a.AccountID) {
+		return keyARN{}, fmt.Errorf("invalid AWS KMS key ARN '%s': invalid account ID '%s'", s, a.AccountID)
+	}
+	kind, id, _ := strings.Cut(a.Resource, "/")
+	if (kind != "key" && kind != "alias") || id == "" {
+		return keyARN{}, fmt.Errorf("invalid AWS KMS key ARN '%s': resource must be a 'key/' or 'alias/'", s)
+	}
+	return keyARN{ARN: a}, nil
+}
+
+// IsMultiRegion returns if the ARN is of a multi-region key.
+func (a keyARN) IsMultiRegion() bool {
+	return strings.HasPrefix(a.Resource, "key/mrk-")
+}
+
+// InRegion returns the ARN of the key in the given region. For a
+// multi-region key, this is the ARN of its replica in the region. Other
+// keys only exist in the region of their ARN, which is returned as is.
+func (a keyARN) InRegion(region string) string {
+	if region == "" || !a.IsMultiRegion() {
+		return a.String()
+	}
+	replica := a.ARN
+	replica.Region = region
+	return replica.String()
+}
+
+// Encrypt takes a SOPS data key, encrypts it with the AWS KMS key using the
+// credentials of the given options, and stores the result in the
+// EncryptedKey field of the key. The role of the key is assumed unless
+// IgnoreKeyRole is set.
+//
+// It is the counterpart of awskms.MasterKey.Encrypt, allowing the
+// configuration of the KMS client.
+func Encrypt(ctx context.Context, key *awskms.MasterKey, opts ClientOptions, dataKey []byte) error {
+	client, keyID, err := newKMSClient(ctx, key, opts)
+	if err != nil {
+		return err
+	}
+	out, err := client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:             &keyID,
+		Plaintext:         dataKey,
+		EncryptionContext: stringPointerToStringMap(key.EncryptionContext),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encrypt sops data key with AWS KMS: %w", withProxyError(client.Options().HTTPClient, err))
+	}
+	key.EncryptedKey = base64.StdEncoding.EncodeToString(out.CiphertextBlob)
+	return nil
+}
+
+// Decrypt decrypts the EncryptedKey field of the AWS KMS key using the
+// credentials of the given options, and returns the result. The role of the
+// key is assumed unless IgnoreKeyRole is set.
+//
+// For a multi-region key with ReplicaRegions configured, a failed attempt
+// falls through to the replica of the key in the next region, with each
+// attempt limited to the AttemptTimeout.
+//
+// It is the counterpart of awskms.MasterKey.Decrypt, allowing the
+// configuration of the KMS client.
+func Decrypt(ctx context.Context, key *awskms.MasterKey, opts ClientOptions) ([]byte, error) {
+	if err := checkEncryptionContext(key, opts.RequiredContext); err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(key.EncryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error base64-decoding encrypted data key: %w", err)
+	}
+	regions, err := failoverRegions(key, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(regions) == 0 {
+		return decrypt(ctx, key, opts, ciphertext)
+	}
+
+	timeout := opts.AttemptTimeout
+	if timeout <= 0 {
+		timeout = defaultAttemptTimeout
+	}
+	var errs []error
+	for i, region := range regions {
+		attemptOpts := opts
+		attemptOpts.Region = region
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		plaintext, err := decrypt(attemptCtx, key, attemptOpts, ciphertext)
+		cancel()
+		if err == nil {
+			if i > 0 && opts.OnRegionFailover != nil {
+				opts.OnRegionFailover(key, region, errors.Join(errs...))
+			}
+			return plaintext, nil
+		}
+		errs = append(errs, fmt.Errorf("region '%s': %w", region, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("failed to decrypt sops data key with AWS KMS in any of the regions %s: %w",
+		strings.Join(regions, ", "), errors.Join(errs...))
+}
+
+// checkEncryptionContext returns an error if the encryption context of the
+// key does not contain each of the keys of the required context with the
+// same value.
+func checkEncryptionContext(key *awskms.MasterKey, required map[string]string) error {
+	actual := stringPointerToStringMap(key.EncryptionContext)
+	var errs []error
+	for _, k := range slices.Sorted(maps.Keys(required)) {
+		v, ok := actual[k]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("missing key '%s'", k))
+		case v != required[k]:
+			errs = append(errs, fmt.Errorf("key '%s' has value '%s' instead of '%s'", k, v, required[k]))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("encryption context of AWS KMS key '%s' does not match the required context: %w",
+			key.Arn, errors.Join(errs...))
+	}
+	return nil
+}
+
+// failoverRegions returns the regions in which to attempt the decryption of
+// a multi-region key, starting with the region of the key (or the Region of
+// the options), followed by the ReplicaRegions. It returns nil if the key is
+// not a multi-region key, or no ReplicaRegions are configured.
+func failoverRegions(key *awskms.MasterKey, opts ClientOptions) ([]string, error) {
+	if len(opts.ReplicaRegions) == 0 {
+		return nil, nil
+	}
+	keyARN, err := parseKeyARN(key.Arn)
+	if err != nil {
+		return nil, err
+	}
+	if !keyARN.IsMultiRegion() {
+		return nil, nil
+	}
+	primary := keyARN.Region
+	if opts.Region != "" {
+		primary = opts.Region
+	}
+	regions := []string{primary}
+	for _, region := range opts.ReplicaRegions {
+		if !slices.Contains(regions, region) {
+			regions = append(regions, region)
+		}
+	}
+	return regions, nil
+}
+
+// decrypt decrypts the ciphertext with the AWS KMS key in a single region.
+func decrypt(ctx context.Context, key *awskms.MasterKey, opts ClientOptions, ciphertext []byte) ([]byte, error) {
+	client, keyID, err := newKMSClient(ctx, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:             &keyID,
+		CiphertextBlob:    ciphertext,
+		EncryptionContext: stringPointerToStringMap(key.EncryptionContext),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sops data key with AWS KMS: %w", withProxyError(client.Options().HTTPClient, err))
+	}
+	return out.Plaintext, nil
+}
+
+// newKMSClient returns a KMS client for the region of the key (or the Region
+// of the options), with the credentials and endpoints of the given options,
+// and the ID of the key to use with the client. When the key has a role,
+// and the options do not IgnoreKeyRole, the role is assumed with the
+// credentials.
+func newKMSClient(ctx context.Context, key *awskms.MasterKey, opts ClientOptions) (*kms.Client, string, error) {
+	keyARN, err := parseKeyARN(key.Arn)
+	if err != nil {
+		return nil, "", err
+	}
+	region := keyARN.Region
+	if opts.Region != "" {
+		region = opts.Region
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, func(lo *config.LoadOptions) error {
+		if opts.CredentialsProvider != nil {
+			lo.Credentials = opts.CredentialsProvider
+		}
+		if key.AwsProfile != "" {
+			lo.SharedConfigProfile = key.AwsProfile
+		}
+		lo.Region = region
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("could not load AWS config: %w", err)
+	}
+	if cfg.HTTPClient, err = NewHTTPClient(cfg.HTTPClient, opts.ProxyURL); err != nil {
+		return nil, "", err
+	}
+
+	if key.Role != "" && !opts.IgnoreKeyRole {
+		cfg.Credentials = NewAssumeRoleCredentialsProvider(newSTSClientFromConfig(cfg, opts.STSEndpoint), key.Role, "", "")
+	}
+	client := kms.NewFromConfig(cfg, func(o *kms.Options) {
+		if opts.KMSEndpoint != "" {
+			o.BaseEndpoint = aws.String(opts.KMSEndpoint)
+		}
+	})
+	return client, keyARN.InRegion(opts.Region), nil
+}
+
+// defaultSessionName returns the default name of STS role sessions, in the
+// format of `sops@<hostname>`. The hostname is sanitized, and the name is
+// truncated to the roleSessionNameLengthLimit.
+func defaultSessionName() string {
+	hostname, _ := os.Hostname()
+	name := "sops@" + sessionNameRegex.ReplaceAllString(hostname, "")
+	if len(name) > roleSessionNameLengthLimit {
+		name = name[:roleSessionNameLengthLimit]
+	}
+	return name
+}
+
+// stringPointerToStringMap converts the encryption context of a key to the
+// map expected by the KMS client. It returns nil for an empty context.
+func stringPointerToStringMap(in map[string]*string) map[string]string {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		if v == nil {
+			continue
+		}
+		out[k] = *v
+	}
+	return out
+}
@@ -0,0 +1,728 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awskms
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	awskms "github.com/getsops/sops/v3/kms"
+	. "github.com/onsi/gomega"
+)
+
+const testKeyARN = "arn:aws:kms:us-west-2:107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48"
+
+func TestEncryptDecrypt(t *testing.T) {
+	g := NewWithT(t)
+
+	fake := newFakeAWS(t)
+	opts := ClientOptions{
+		CredentialsProvider: credentials.NewStaticCredentialsProvider("base-id", "base-secret", ""),
+	}
+
+	key := awskms.NewMasterKeyFromArn(testKeyARN, nil, "")
+	g.Expect(Encrypt(context.TODO(), key, opts, []byte("data-key"))).To(Succeed())
+	g.Expect(key.EncryptedKey).ToNot(BeEmpty())
+
+	got, err := Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal([]byte("data-key")))
+
+	g.Expect(fake.assumedRoles()).To(BeEmpty())
+	g.Expect(fake.kmsCallers()).To(Equal([]string{"base-id", "base-id"}))
+}
+
+func TestDecrypt_RolePrecedence(t *testing.T) {
+	tests := []struct {
+		name          string
+		conf          Config
+		keyRole       string
+		wantRoles     []assumedRole
+		wantKMSCaller string
+	}{
+		{
+			name: "without roles",
+			conf: Config{
+				AccessKeyID:     "base-id",
+				SecretAccessKey: "base-secret",
+			},
+			wantKMSCaller: "base-id",
+		},
+		{
+			name: "metadata role",
+			conf: Config{
+				AccessKeyID:     "base-id",
+				SecretAccessKey: "base-secret",
+			},
+			keyRole: "arn:aws:iam::111111111111:role/metadata",
+			wantRoles: []assumedRole{
+				{RoleARN: "arn:aws:iam::111111111111:role/metadata", Caller: "base-id"},
+			},
+			wantKMSCaller: "assumed-metadata",
+		},
+		{
+			name: "secret role",
+			conf: Config{
+				AccessKeyID:           "base-id",
+				SecretAccessKey:       "base-secret",
+				AssumeRoleARN:         "arn:aws:iam::222222222222:role/central",
+				ExternalID:            "some-external-id",
+				AssumeRoleSessionName: "tenant",
+			},
+			wantRoles: []assumedRole{
+				{RoleARN: "arn:aws:iam::222222222222:role/central", ExternalID: "some-external-id", SessionName: "tenant", Caller: "base-id"},
+			},
+			wantKMSCaller: "assumed-central",
+		},
+		{
+			name: "secret role takes precedence over metadata role",
+			conf: Config{
+				AccessKeyID:     "base-id",
+				SecretAccessKey: "base-secret",
+				AssumeRoleARN:   "arn:aws:iam::222222222222:role/central",
+			},
+			keyRole: "arn:aws:iam::111111111111:role/metadata",
+			wantRoles: []assumedRole{
+				{RoleARN: "arn:aws:iam::222222222222:role/central", Caller: "base-id"},
+			},
+			wantKMSCaller: "assumed-central",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			fake := newFakeAWS(t)
+
+			provider, err := tt.conf.CredentialsProvider(context.TODO())
+			g.Expect(err).ToNot(HaveOccurred())
+			opts := ClientOptions{
+				CredentialsProvider: provider,
+				IgnoreKeyRole:       tt.conf.AssumeRoleARN != "",
+			}
+
+			key := awskms.NewMasterKeyFromArn(testKeyARN, nil, "")
+			key.Role = tt.keyRole
+			key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+
+			got, err := Decrypt(context.TODO(), key, opts)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal([]byte("data-key")))
+
+			roles := fake.assumedRoles()
+			for i := range roles {
+				if tt.conf.AssumeRoleSessionName == "" {
+					g.Expect(roles[i].SessionName).To(HavePrefix("sops@"))
+					roles[i].SessionName = ""
+				}
+			}
+			if tt.wantRoles == nil {
+				g.Expect(roles).To(BeEmpty())
+			} else {
+				g.Expect(roles).To(Equal(tt.wantRoles))
+			}
+			g.Expect(fake.kmsCallers()).To(Equal([]string{tt.wantKMSCaller}))
+		})
+	}
+}
+
+func TestDecrypt_Endpoints(t *testing.T) {
+	g := NewWithT(t)
+
+	kmsEndpoint, kmsURL := startFakeAWS(t)
+	stsEndpoint, stsURL := startFakeAWS(t)
+
+	opts := ClientOptions{
+		CredentialsProvider: credentials.NewStaticCredentialsProvider("base-id", "base-secret", ""),
+		KMSEndpoint:         kmsURL,
+		STSEndpoint:         stsURL,
+	}
+
+	key := awskms.NewMasterKeyFromArn(testKeyARN, nil, "")
+	key.Role = "arn:aws:iam::111111111111:role/metadata"
+	key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+
+	got, err := Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal([]byte("data-key")))
+
+	g.Expect(stsEndpoint.assumedRoles()).To(HaveLen(1))
+	g.Expect(stsEndpoint.kmsCallers()).To(BeEmpty())
+	g.Expect(kmsEndpoint.assumedRoles()).To(BeEmpty())
+	g.Expect(kmsEndpoint.kmsCallers()).To(Equal([]string{"assumed-metadata"}))
+}
+
+func TestDecrypt_ConfigSTSEndpoint(t *testing.T) {
+	g := NewWithT(t)
+
+	kmsEndpoint, kmsURL := startFakeAWS(t)
+	stsEndpoint, stsURL := startFakeAWS(t)
+
+	conf := Config{
+		AccessKeyID:     "base-id",
+		SecretAccessKey: "base-secret",
+		AssumeRoleARN:   "arn:aws:iam::222222222222:role/central",
+		KMSEndpoint:     kmsURL,
+		STSEndpoint:     stsURL,
+	}
+	g.Expect(conf.Validate()).To(Succeed())
+	provider, err := conf.CredentialsProvider(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+
+	key := awskms.NewMasterKeyFromArn(testKeyARN, nil, "")
+	key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+
+	_, err = Decrypt(context.TODO(), key, ClientOptions{
+		CredentialsProvider: provider,
+		IgnoreKeyRole:       true,
+		KMSEndpoint:         conf.KMSEndpoint,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	g.Expect(stsEndpoint.assumedRoles()).To(HaveLen(1))
+	g.Expect(kmsEndpoint.kmsCallers()).To(Equal([]string{"assumed-central"}))
+}
+
+func TestDecrypt_Error(t *testing.T) {
+	g := NewWithT(t)
+
+	key := awskms.NewMasterKeyFromArn(testKeyARN, nil, "")
+	key.EncryptedKey = "invalid base64"
+	_, err := Decrypt(context.TODO(), key, ClientOptions{})
+	g.Expect(err).To(MatchError(ContainSubstring("error base64-decoding encrypted data key")))
+
+	key = awskms.NewMasterKeyFromArn("invalid-arn", nil, "")
+	key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+	_, err = Decrypt(context.TODO(), key, ClientOptions{})
+	g.Expect(err).To(MatchError(ContainSubstring("invalid AWS KMS key ARN 'invalid-arn'")))
+}
+
+func TestDecrypt_Region(t *testing.T) {
+	tests := []struct {
+		name       string
+		arn        string
+		region     string
+		wantRegion string
+		wantKeyID  string
+	}{
+		{
+			name:       "region of ARN",
+			arn:        "arn:aws:kms:us-west-2:107501996527:key/mrk-1234abcd12ab34cd56ef1234567890ab",
+			wantRegion: "us-west-2",
+			wantKeyID:  "arn:aws:kms:us-west-2:107501996527:key/mrk-1234abcd12ab34cd56ef1234567890ab",
+		},
+		{
+			name:       "replica of multi-region key",
+			arn:        "arn:aws:kms:us-west-2:107501996527:key/mrk-1234abcd12ab34cd56ef1234567890ab",
+			region:     "eu-west-1",
+			wantRegion: "eu-west-1",
+			wantKeyID:  "arn:aws:kms:eu-west-1:107501996527:key/mrk-1234abcd12ab34cd56ef1234567890ab",
+		},
+		{
+			name:       "single-region key",
+			arn:        testKeyARN,
+			region:     "eu-west-1",
+			wantRegion: "eu-west-1",
+			wantKeyID:  testKeyARN,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			fake := newFakeAWS(t)
+
+			key := awskms.NewMasterKeyFromArn(tt.arn, nil, "")
+			key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+
+			_, err := Decrypt(context.TODO(), key, ClientOptions{
+				CredentialsProvider: credentials.NewStaticCredentialsProvider("base-id", "base-secret", ""),
+				Region:              tt.region,
+			})
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(fake.kmsRequests()).To(Equal([]kmsRequest{{Region: tt.wantRegion, KeyID: tt.wantKeyID}}))
+		})
+	}
+}
+
+func TestDecrypt_RegionFailover(t *testing.T) {
+	const mrkARN = "arn:aws:kms:us-west-2:107501996527:key/mrk-1234abcd12ab34cd56ef1234567890ab"
+
+	tests := []struct {
+		name           string
+		arn            string
+		region         string
+		replicaRegions []string
+		unavailable    []string
+		unresponsive   []string
+		wantRegions    []string
+		wantFailover   string
+		wantErr        []string
+	}{
+		{
+			name:           "served by region of key",
+			arn:            mrkARN,
+			replicaRegions: []string{"eu-west-1"},
+			wantRegions:    []string{"us-west-2"},
+		},
+		{
+			name:           "region of key unavailable",
+			arn:            mrkARN,
+			replicaRegions: []string{"eu-west-1"},
+			unavailable:    []string{"us-west-2"},
+			wantRegions:    []string{"us-west-2", "eu-west-1"},
+			wantFailover:   "eu-west-1",
+		},
+		{
+			name:           "region of key unresponsive",
+			arn:            mrkARN,
+			replicaRegions: []string{"eu-west-1", "ap-southeast-2"},
+			unresponsive:   []string{"us-west-2"},
+			wantRegions:    []string{"us-west-2", "eu-west-1"},
+			wantFailover:   "eu-west-1",
+		},
+		{
+			name:           "region override unavailable",
+			arn:            mrkARN,
+			region:         "eu-west-1",
+			replicaRegions: []string{"eu-west-1", "us-west-2"},
+			unavailable:    []string{"eu-west-1"},
+			wantRegions:    []string{"eu-west-1", "us-west-2"},
+			wantFailover:   "us-west-2",
+		},
+		{
+			name:           "all regions unavailable",
+			arn:            mrkARN,
+			replicaRegions: []string{"eu-west-1"},
+			unavailable:    []string{"us-west-2"},
+			unresponsive:   []string{"eu-west-1"},
+			wantRegions:    []string{"us-west-2", "eu-west-1"},
+			wantErr: []string{
+				"failed to decrypt sops data key with AWS KMS in any of the regions us-west-2, eu-west-1",
+				"region 'us-west-2'",
+				"region 'eu-west-1'",
+			},
+		},
+		{
+			name:           "single-region key",
+			arn:            testKeyARN,
+			replicaRegions: []string{"eu-west-1"},
+			unavailable:    []string{"us-west-2"},
+			wantRegions:    []string{"us-west-2"},
+			wantErr:        []string{"failed to decrypt sops data key with AWS KMS"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			fake := newFakeAWS(t)
+			fake.unavailable = tt.unavailable
+			fake.unresponsive = tt.unresponsive
+
+			key := awskms.NewMasterKeyFromArn(tt.arn, nil, "")
+			key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+
+			var failover string
+			got, err := Decrypt(context.TODO(), key, ClientOptions{
+				CredentialsProvider: credentials.NewStaticCredentialsProvider("base-id", "base-secret", ""),
+				Region:              tt.region,
+				ReplicaRegions:      tt.replicaRegions,
+				AttemptTimeout:      500 * time.Millisecond,
+				OnRegionFailover: func(_ *awskms.MasterKey, region string, err error) {
+					g.Expect(err).To(HaveOccurred())
+					failover = region
+				},
+			})
+
+			var regions []string
+			for _, r := range fake.kmsRequests() {
+				if !slices.Contains(regions, r.Region) {
+					regions = append(regions, r.Region)
+				}
+			}
+			g.Expect(regions).To(Equal(tt.wantRegions))
+			g.Expect(failover).To(Equal(tt.wantFailover))
+
+			if len(tt.wantErr) > 0 {
+				for _, want := range tt.wantErr {
+					g.Expect(err).To(MatchError(ContainSubstring(want)))
+				}
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal([]byte("data-key")))
+		})
+	}
+}
+
+func TestDecrypt_EncryptionContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		context  map[string]string
+		required map[string]string
+		wantErr  string
+	}{
+		{
+			name:    "forwarded without required context",
+			context: map[string]string{"tenant": "team-a", "env": "production"},
+		},
+		{
+			name:     "matching required context",
+			context:  map[string]string{"tenant": "team-a", "env": "production"},
+			required: map[string]string{"tenant": "team-a"},
+		},
+		{
+			name:     "missing required keys",
+			context:  map[string]string{"env": "production"},
+			required: map[string]string{"tenant": "team-a", "cluster": "eu-1"},
+			wantErr: "encryption context of AWS KMS key '" + testKeyARN + "' does not match the required context: " +
+				"missing key 'cluster'\nmissing key 'tenant'",
+		},
+		{
+			name:     "without context",
+			required: map[string]string{"tenant": "team-a"},
+			wantErr:  "missing key 'tenant'",
+		},
+		{
+			name:     "mismatching required context",
+			context:  map[string]string{"tenant": "team-b"},
+			required: map[string]string{"tenant": "team-a"},
+			wantErr:  "key 'tenant' has value 'team-b' instead of 'team-a'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			fake := newFakeAWS(t)
+
+			encryptionContext := make(map[string]*string, len(tt.context))
+			for k, v := range tt.context {
+				encryptionContext[k] = &v
+			}
+			key := awskms.NewMasterKeyFromArn(testKeyARN, encryptionContext, "")
+			key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+
+			got, err := Decrypt(context.TODO(), key, ClientOptions{
+				CredentialsProvider: credentials.NewStaticCredentialsProvider("base-id", "base-secret", ""),
+				RequiredContext:     tt.required,
+			})
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				// The assertion fails before any request to KMS.
+				g.Expect(fake.kmsRequests()).To(BeEmpty())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal([]byte("data-key")))
+			g.Expect(fake.kmsRequests()).To(HaveLen(1))
+			g.Expect(fake.kmsRequests()[0].EncryptionContext).To(Equal(tt.context))
+		})
+	}
+}
+
+func Test_parseKeyARN(t *testing.T) {
+	tests := []struct {
+		name          string
+		arn           string
+		wantPartition string
+		wantRegion    string
+		wantMRK       bool
+		wantErr       string
+	}{
+		{
+			name:          "aws partition",
+			arn:           "arn:aws:kms:us-west-2:107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48",
+			wantPartition: "aws",
+			wantRegion:    "us-west-2",
+		},
+		{
+			name:          "aws-cn partition",
+			arn:           "arn:aws-cn:kms:cn-north-1:107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48",
+			wantPartition: "aws-cn",
+			wantRegion:    "cn-north-1",
+		},
+		{
+			name:          "aws-us-gov partition",
+			arn:           "arn:aws-us-gov:kms:us-gov-west-1:107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48",
+			wantPartition: "aws-us-gov",
+			wantRegion:    "us-gov-west-1",
+		},
+		{
+			name:          "alias",
+			arn:           "arn:aws:kms:eu-central-1:107501996527:alias/sops",
+			wantPartition: "aws",
+			wantRegion:    "eu-central-1",
+		},
+		{
+			name:          "multi-region key",
+			arn:           "arn:aws:kms:us-east-1:107501996527:key/mrk-1234abcd12ab34cd56ef1234567890ab",
+			wantPartition: "aws",
+			wantRegion:    "us-east-1",
+			wantMRK:       true,
+		},
+		{
+			name:          "multi-region key in aws-us-gov partition",
+			arn:           "arn:aws-us-gov:kms:us-gov-east-1:107501996527:key/mrk-1234abcd12ab34cd56ef1234567890ab",
+			wantPartition: "aws-us-gov",
+			wantRegion:    "us-gov-east-1",
+			wantMRK:       true,
+		},
+		{
+			name:    "not an ARN",
+			arn:     "612d5f0p-p1l3-45e6-aca6-a5b005693a48",
+			wantErr: "invalid AWS KMS key ARN '612d5f0p-p1l3-45e6-aca6-a5b005693a48': arn: invalid prefix",
+		},
+		{
+			name:    "unknown partition",
+			arn:     "arn:aws-mars:kms:us-west-2:107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48",
+			wantErr: "invalid AWS KMS key ARN 'arn:aws-mars:kms:us-west-2:107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48': unknown partition 'aws-mars'",
+		},
+		{
+			name:    "other service",
+			arn:     "arn:aws:iam::107501996527:role/sops",
+			wantErr: "service must be 'kms'",
+		},
+		{
+			name:    "missing region",
+			arn:     "arn:aws:kms::107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48",
+			wantErr: "invalid region ''",
+		},
+		{
+			name:    "invalid account ID",
+			arn:     "arn:aws:kms:us-west-2:1075:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48",
+			wantErr: "invalid account ID '1075'",
+		},
+		{
+			name:    "invalid resource",
+			arn:     "arn:aws:kms:us-west-2:107501996527:grant/612d5f0p-p1l3-45e6-aca6-a5b005693a48",
+			wantErr: "resource must be a 'key/' or 'alias/'",
+		},
+		{
+			name:    "missing key ID",
+			arn:     "arn:aws:kms:us-west-2:107501996527:key/",
+			wantErr: "resource must be a 'key/' or 'alias/'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := parseKeyARN(tt.arn)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got.Partition).To(Equal(tt.wantPartition))
+			g.Expect(got.Region).To(Equal(tt.wantRegion))
+			g.Expect(got.IsMultiRegion()).To(Equal(tt.wantMRK))
+			g.Expect(got.InRegion("")).To(Equal(tt.arn))
+		})
+	}
+}
+
+func Test_keyARN_InRegion(t *testing.T) {
+	g := NewWithT(t)
+
+	mrk, err := parseKeyARN("arn:aws-cn:kms:cn-north-1:107501996527:key/mrk-1234abcd12ab34cd56ef1234567890ab")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(mrk.InRegion("cn-northwest-1")).To(Equal("arn:aws-cn:kms:cn-northwest-1:107501996527:key/mrk-1234abcd12ab34cd56ef1234567890ab"))
+
+	key, err := parseKeyARN(testKeyARN)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(key.InRegion("eu-west-1")).To(Equal(testKeyARN))
+}
+
+func Test_defaultSessionName(t *testing.T) {
+	g := NewWithT(t)
+
+	name := defaultSessionName()
+	g.Expect(name).To(HavePrefix("sops@"))
+	g.Expect(len(name)).To(BeNumerically("<=", roleSessionNameLengthLimit))
+	g.Expect(name).To(MatchRegexp(`^[a-zA-Z0-9=,.@_-]+$`))
+}
+
+// assumedRole is an STS AssumeRole request recorded by fakeAWS.
+type assumedRole struct {
+	RoleARN     string
+	ExternalID  string
+	SessionName string
+	// Caller is the access key ID which signed the request.
+	Caller string
+}
+
+// fakeAWS is an HTTP server mimicking the AWS STS AssumeRole and KMS
+// Encrypt and Decrypt APIs. The STS credentials of an assumed role have an
+// access key ID of "assumed-<role name>". KMS requests decrypt to
+// "data-key", unless signed for an unavailable or unresponsive region. The
+// AWS_ENDPOINT_URL of the test points to the server.
+type fakeAWS struct {
+	// unavailable are the regions for which KMS requests fail with a
+	// service unavailable error.
+	unavailable []string
+	// unresponsive are the regions for which KMS requests hang until they
+	// are canceled.
+	unresponsive []string
+
+	mu       sync.Mutex
+	roles    []assumedRole
+	callers  []string
+	requests []kmsRequest
+}
+
+// kmsRequest is a KMS request recorded by fakeAWS.
+type kmsRequest struct {
+	// Region is the region for which the request was signed.
+	Region            string
+	KeyID             string
+	EncryptionContext map[string]string
+}
+
+// credentialRegex captures the access key ID, region and service of the
+// Authorization header of a signed request.
+var credentialRegex = regexp.MustCompile(`Credential=([^/]+)/[^/]+/([^/]+)/([^/]+)/`)
+
+// newFakeAWS starts a fakeAWS, and points the AWS_ENDPOINT_URL to it.
+func newFakeAWS(t *testing.T) *fakeAWS {
+	t.Helper()
+
+	f, url := startFakeAWS(t)
+	t.Setenv("AWS_ENDPOINT_URL", url)
+	return f
+}
+
+// startFakeAWS starts a fakeAWS, and returns it with its URL. It isolates
+// the test from the AWS configuration of the environment.
+func startFakeAWS(t *testing.T) (*fakeAWS, string) {
+	t.Helper()
+
+	f := &fakeAWS{}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	return f, server.URL
+}
+
+func (f *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := credentialRegex.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		http.Error(w, "missing signature", http.StatusForbidden)
+		return
+	}
+	caller, region, service := m[1], m[2], m[3]
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch service {
+	case "sts":
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("Action") != "AssumeRole" {
+			http.Error(w, "unexpected STS request", http.StatusBadRequest)
+			return
+		}
+		roleARN := r.PostForm.Get("RoleArn")
+		f.roles = append(f.roles, assumedRole{
+			RoleARN:     roleARN,
+			ExternalID:  r.PostForm.Get("ExternalId"),
+			SessionName: r.PostForm.Get("RoleSessionName"),
+			Caller:      caller,
+		})
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>assumed-%s</AccessKeyId>
+      <SecretAccessKey>assumed-secret</SecretAccessKey>
+      <SessionToken>assumed-token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`, roleARN[strings.LastIndex(roleARN, "/")+1:])
+	case "kms":
+		var input struct {
+			KeyId             string
+			EncryptionContext map[string]string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "unexpected KMS request", http.StatusBadRequest)
+			return
+		}
+		f.callers = append(f.callers, caller)
+		f.requests = append(f.requests, kmsRequest{Region: region, KeyID: input.KeyId, EncryptionContext: input.EncryptionContext})
+		if slices.Contains(f.unresponsive, region) {
+			f.mu.Unlock()
+			<-r.Context().Done()
+			f.mu.Lock()
+			return
+		}
+		if slices.Contains(f.unavailable, region) {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprint(w, `{"__type":"KMSInternalException","message":"region unavailable"}`)
+			return
+		}
+		var resp map[string]string
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			resp = map[string]string{"KeyId": testKeyARN, "CiphertextBlob": base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))}
+		case "TrentService.Decrypt":
+			resp = map[string]string{"KeyId": testKeyARN, "Plaintext": base64.StdEncoding.EncodeToString([]byte("data-key"))}
+		default:
+			http.Error(w, "unexpected KMS request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		_ = json.NewEncoder(w).Encode(resp)
+	default:
+		http.Error(w, "unexpected service", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeAWS) assumedRoles() []assumedRole {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]assumedRole(nil), f.roles...)
+}
+
+func (f *fakeAWS) kmsCallers() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.callers...)
+}
+
+func (f *fakeAWS) kmsRequests() []kmsRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]kmsRequest(nil), f.requests...)
+}
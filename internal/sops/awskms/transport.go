@@ -0,0 +1,131 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awskms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// proxyClient is an aws.HTTPClient which sends requests through an HTTP(S)
+// proxy, and includes the URL of the proxy in connection errors and
+// timeouts.
+type proxyClient struct {
+	client aws.HTTPClient
+	proxy  func(*http.Request) (*url.URL, error)
+
+	// failedProxy is the proxy of the last failed request, used to mention
+	// the proxy in timeouts, for which the SDK replaces the error of Do.
+	mu          sync.Mutex
+	failedProxy *url.URL
+}
+
+// NewHTTPClient returns an aws.HTTPClient for the KMS and STS clients which
+// sends requests through the given proxy URL. When proxyURL is empty, the
+// proxy is determined by the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// environment variables.
+// The client is derived from the given base client, retaining its options
+// like a custom CA bundle. When base is nil, the default HTTP client of the
+// SDK is used. A base client which is not an *awshttp.BuildableClient can
+// not be configured, and is returned as is.
+// It returns an error if the proxy URL can not be parsed.
+func NewHTTPClient(base aws.HTTPClient, proxyURL string) (aws.HTTPClient, error) {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := parseProxyURL(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	if base == nil {
+		base = awshttp.NewBuildableClient()
+	}
+	buildable, ok := base.(*awshttp.BuildableClient)
+	if !ok {
+		return base, nil
+	}
+	return &proxyClient{
+		client: buildable.WithTransportOptions(func(tr *http.Transport) {
+			tr.Proxy = proxy
+		}),
+		proxy: proxy,
+	}, nil
+}
+
+// Do sends the request, and wraps any error with the URL of the proxy used
+// for the request.
+func (c *proxyClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if u, pErr := c.proxy(req); pErr == nil && u != nil {
+			c.mu.Lock()
+			c.failedProxy = u
+			c.mu.Unlock()
+			return nil, fmt.Errorf("failed to send request through proxy '%s': %w", u.Redacted(), err)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// withProxyError wraps the given error of a request sent with the client
+// with the URL of the proxy, if the request timed out or was canceled while
+// being sent through a proxy.
+func withProxyError(client aws.HTTPClient, err error) error {
+	c, ok := client.(*proxyClient)
+	if !ok || !(errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)) {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failedProxy == nil {
+		return err
+	}
+	return fmt.Errorf("failed to send request through proxy '%s': %w", c.failedProxy.Redacted(), err)
+}
+
+// ValidateProxyURL returns an error if the given proxy URL is not empty,
+// and is not an absolute http or https URL.
+func ValidateProxyURL(proxyURL string) error {
+	if proxyURL == "" {
+		return nil
+	}
+	_, err := parseProxyURL(proxyURL)
+	return err
+}
+
+// parseProxyURL parses the given proxy URL, and returns an error if it does
+// not have an HTTP(S) scheme or a host.
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL '%s': must be an absolute http or https URL", u.Redacted())
+	}
+	return u, nil
+}
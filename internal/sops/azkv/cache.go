@@ -0,0 +1,162 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azkv
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// cacheResultHit is the value of the result label for cache hits.
+	cacheResultHit = "hit"
+	// cacheResultMiss is the value of the result label for cache misses.
+	cacheResultMiss = "miss"
+)
+
+// CredentialCache is a concurrency safe cache of azcore.TokenCredential
+// objects, keyed on the SHA-256 hash of the AADConfig data they were
+// constructed from. This allows the credentials, and the AAD access tokens
+// cached by them, to be reused across reconciliations until the data changes.
+//
+// The azidentity credentials refresh their access token when it is near
+// expiry, the cache itself evicts the least recently used entry when the max
+// size is reached, and any entry which is older than the max age.
+//
+// A nil *CredentialCache is valid, and results in credentials always being
+// constructed.
+type CredentialCache struct {
+	maxSize int
+	maxAge  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	entriesGauge   prometheus.Gauge
+	requestCounter *prometheus.CounterVec
+
+	// now is used to determine the age of entries, and can be overwritten
+	// in tests.
+	now func() time.Time
+}
+
+// credentialCacheEntry is a CredentialCache entry.
+type credentialCacheEntry struct {
+	key        string
+	credential azcore.TokenCredential
+	createdAt  time.Time
+}
+
+// NewCredentialCache returns a new CredentialCache which holds up to maxSize
+// credentials, for at most maxAge. A maxAge of zero disables the expiration
+// of entries.
+func NewCredentialCache(maxSize int, maxAge time.Duration) *CredentialCache {
+	return &CredentialCache{
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		entriesGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gotk_azure_credential_cache_entries",
+			Help: "The number of Azure token credentials in the cache.",
+		}),
+		requestCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotk_azure_credential_cache_requests_total",
+			Help: "The number of Azure token credential cache requests, partitioned by hit or miss result.",
+		}, []string{"result"}),
+		now: time.Now,
+	}
+}
+
+// MustRegister registers the metrics of the cache with the given
+// prometheus.Registerer. It panics if any of the metrics can not be
+// registered.
+func (c *CredentialCache) MustRegister(r prometheus.Registerer) {
+	r.MustRegister(c.entriesGauge, c.requestCounter)
+}
+
+// GetOrCreate returns the cached azcore.TokenCredential for the given
+// AADConfig data. If no (unexpired) credential is found, create is called to
+// construct one, which is added to the cache on success.
+func (c *CredentialCache) GetOrCreate(data []byte, create func() (azcore.TokenCredential, error)) (azcore.TokenCredential, error) {
+	if c == nil {
+		return create()
+	}
+
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*credentialCacheEntry)
+		if !c.expired(entry) {
+			c.lru.MoveToFront(e)
+			c.requestCounter.WithLabelValues(cacheResultHit).Inc()
+			return entry.credential, nil
+		}
+		c.removeElement(e)
+	}
+	c.requestCounter.WithLabelValues(cacheResultMiss).Inc()
+
+	credential, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	c.entries[key] = c.lru.PushFront(&credentialCacheEntry{
+		key:        key,
+		credential: credential,
+		createdAt:  c.now(),
+	})
+	for c.lru.Len() > c.maxSize {
+		c.removeElement(c.lru.Back())
+	}
+	c.entriesGauge.Set(float64(c.lru.Len()))
+	return credential, nil
+}
+
+// Len returns the number of entries in the cache.
+func (c *CredentialCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// expired returns if the given entry is older than the max age of the cache.
+func (c *CredentialCache) expired(entry *credentialCacheEntry) bool {
+	return c.maxAge > 0 && c.now().Sub(entry.createdAt) >= c.maxAge
+}
+
+// removeElement removes the given element from the cache.
+// It must be called while holding the lock.
+func (c *CredentialCache) removeElement(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*credentialCacheEntry).key)
+	c.entriesGauge.Set(float64(c.lru.Len()))
+}
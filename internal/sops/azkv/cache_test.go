@@ -0,0 +1,198 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azkv
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCredentialCache_GetOrCreate(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewCredentialCache(2, 0)
+
+	var created int
+	create := func() (azcore.TokenCredential, error) {
+		created++
+		return azidentity.NewClientSecretCredential("some-tenant-id", "some-client-id", "some-client-secret", nil)
+	}
+
+	first, err := c.GetOrCreate([]byte("a"), create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(first).ToNot(BeNil())
+	g.Expect(created).To(Equal(1))
+
+	got, err := c.GetOrCreate([]byte("a"), create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(BeIdenticalTo(first))
+	g.Expect(created).To(Equal(1))
+
+	got, err = c.GetOrCreate([]byte("b"), create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).ToNot(BeIdenticalTo(first))
+	g.Expect(created).To(Equal(2))
+	g.Expect(c.Len()).To(Equal(2))
+
+	g.Expect(testutil.ToFloat64(c.requestCounter.WithLabelValues(cacheResultHit))).To(Equal(float64(1)))
+	g.Expect(testutil.ToFloat64(c.requestCounter.WithLabelValues(cacheResultMiss))).To(Equal(float64(2)))
+	g.Expect(testutil.ToFloat64(c.entriesGauge)).To(Equal(float64(2)))
+}
+
+func TestCredentialCache_GetOrCreate_Error(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewCredentialCache(2, 0)
+
+	got, err := c.GetOrCreate([]byte("a"), func() (azcore.TokenCredential, error) {
+		return nil, errors.New("invalid data")
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(got).To(BeNil())
+	g.Expect(c.Len()).To(BeZero())
+}
+
+func TestCredentialCache_GetOrCreate_Eviction(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewCredentialCache(2, 0)
+
+	var created int
+	create := func() (azcore.TokenCredential, error) {
+		created++
+		return azidentity.NewClientSecretCredential("some-tenant-id", "some-client-id", "some-client-secret", nil)
+	}
+
+	for _, k := range []string{"a", "b", "a", "c"} {
+		_, err := c.GetOrCreate([]byte(k), create)
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	g.Expect(created).To(Equal(3))
+	g.Expect(c.Len()).To(Equal(2))
+	g.Expect(testutil.ToFloat64(c.entriesGauge)).To(Equal(float64(2)))
+
+	// "b" was the least recently used entry, and should have been evicted.
+	_, err := c.GetOrCreate([]byte("a"), create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(created).To(Equal(3))
+	_, err = c.GetOrCreate([]byte("b"), create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(created).To(Equal(4))
+}
+
+func TestCredentialCache_GetOrCreate_MaxAge(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewCredentialCache(2, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	var created int
+	create := func() (azcore.TokenCredential, error) {
+		created++
+		return azidentity.NewClientSecretCredential("some-tenant-id", "some-client-id", "some-client-secret", nil)
+	}
+
+	_, err := c.GetOrCreate([]byte("a"), create)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	now = now.Add(30 * time.Second)
+	_, err = c.GetOrCreate([]byte("a"), create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(created).To(Equal(1))
+
+	now = now.Add(30 * time.Second)
+	_, err = c.GetOrCreate([]byte("a"), create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(created).To(Equal(2))
+	g.Expect(c.Len()).To(Equal(1))
+}
+
+func TestCredentialCache_GetOrCreate_Nil(t *testing.T) {
+	g := NewWithT(t)
+
+	var c *CredentialCache
+
+	var created int
+	create := func() (azcore.TokenCredential, error) {
+		created++
+		return azidentity.NewClientSecretCredential("some-tenant-id", "some-client-id", "some-client-secret", nil)
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := c.GetOrCreate([]byte("a"), create)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(got).ToNot(BeNil())
+	}
+	g.Expect(created).To(Equal(2))
+	g.Expect(c.Len()).To(BeZero())
+}
+
+func TestCredentialCache_GetOrCreate_Concurrent(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewCredentialCache(10, 0)
+
+	var (
+		mu      sync.Mutex
+		created int
+	)
+	create := func() (azcore.TokenCredential, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		created++
+		return azidentity.NewClientSecretCredential("some-tenant-id", "some-client-id", "some-client-secret", nil)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = c.GetOrCreate([]byte("a"), create)
+		}()
+	}
+	wg.Wait()
+
+	g.Expect(created).To(Equal(1))
+	g.Expect(testutil.ToFloat64(c.requestCounter.WithLabelValues(cacheResultHit))).To(Equal(float64(49)))
+}
+
+func TestCredentialCache_MustRegister(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewCredentialCache(2, 0)
+	reg := prometheus.NewRegistry()
+	g.Expect(func() { c.MustRegister(reg) }).ToNot(Panic())
+
+	_, err := c.GetOrCreate([]byte("a"), func() (azcore.TokenCredential, error) {
+		return azidentity.NewClientSecretCredential("some-tenant-id", "some-client-id", "some-client-secret", nil)
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	count, err := testutil.GatherAndCount(reg, "gotk_azure_credential_cache_entries", "gotk_azure_credential_cache_requests_total")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(count).To(Equal(2))
+}
@@ -18,16 +18,28 @@ package azkv
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
 	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/dimchansky/utfbom"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"sigs.k8s.io/yaml"
+
+	"github.com/fluxcd/kustomize-controller/internal/securebytes"
 )
 
 // LoadAADConfigFromBytes attempts to load the given bytes into the given AADConfig.
@@ -38,23 +50,74 @@ func LoadAADConfigFromBytes(b []byte, s *AADConfig) error {
 	if err != nil {
 		return fmt.Errorf("failed to decode Azure authentication file bytes: %w", err)
 	}
+	defer securebytes.Wipe(b)
 	if err = yaml.Unmarshal(b, s); err != nil {
-		err = fmt.Errorf("failed to unmarshal Azure authentication file: %w", err)
+		return fmt.Errorf("failed to unmarshal Azure authentication file: %w", err)
+	}
+	if s.Cloud != "" {
+		if _, ok := cloudConfigs[strings.ToLower(s.Cloud)]; !ok {
+			return fmt.Errorf("invalid Azure authentication file: unknown cloud '%s', must be one of: %s",
+				s.Cloud, strings.Join([]string{azurePublicCloud, azureChinaCloud, azureUSGovernmentCloud}, ", "))
+		}
+	}
+	if s.ProxyURL != "" {
+		if _, err = parseProxyURL(s.ProxyURL); err != nil {
+			return fmt.Errorf("invalid Azure authentication file: %w", err)
+		}
 	}
-	return err
+	return nil
+}
+
+const (
+	// azureClientIDEnv is the environment variable holding the client ID
+	// injected by the Azure Workload Identity webhook.
+	azureClientIDEnv = "AZURE_CLIENT_ID"
+	// azureTenantIDEnv is the environment variable holding the tenant ID
+	// injected by the Azure Workload Identity webhook.
+	azureTenantIDEnv = "AZURE_TENANT_ID"
+	// azureFederatedTokenFileEnv is the environment variable holding the path
+	// to the projected service account token injected by the Azure Workload
+	// Identity webhook.
+	azureFederatedTokenFileEnv = "AZURE_FEDERATED_TOKEN_FILE"
+)
+
+const (
+	// azurePublicCloud is the name of the Azure Public Cloud.
+	azurePublicCloud = "AzurePublicCloud"
+	// azureChinaCloud is the name of the Azure China Cloud.
+	azureChinaCloud = "AzureChinaCloud"
+	// azureUSGovernmentCloud is the name of the Azure US Government Cloud.
+	azureUSGovernmentCloud = "AzureUSGovernmentCloud"
+)
+
+// cloudConfigs maps the lowercase names of the supported sovereign clouds to
+// their cloud.Configuration.
+var cloudConfigs = map[string]cloud.Configuration{
+	strings.ToLower(azurePublicCloud):       cloud.AzurePublic,
+	strings.ToLower(azureChinaCloud):        cloud.AzureChina,
+	strings.ToLower(azureUSGovernmentCloud): cloud.AzureGovernment,
 }
 
 // AADConfig contains the selection of fields from an Azure authentication file
 // required for Active Directory authentication.
 type AADConfig struct {
 	AZConfig
+	AKSConfig
 	TenantID                   string `json:"tenantId,omitempty"`
 	ClientID                   string `json:"clientId,omitempty"`
+	ResourceID                 string `json:"resourceId,omitempty"`
 	ClientSecret               string `json:"clientSecret,omitempty"`
 	ClientCertificate          string `json:"clientCertificate,omitempty"`
 	ClientCertificatePassword  string `json:"clientCertificatePassword,omitempty"`
 	ClientCertificateSendChain bool   `json:"clientCertificateSendChain,omitempty"`
 	AuthorityHost              string `json:"authorityHost,omitempty"`
+	Cloud                      string `json:"cloud,omitempty"`
+	ProxyURL                   string `json:"proxyURL,omitempty"`
+	VaultDNSSuffix             string `json:"vaultDnsSuffix,omitempty"`
+	LatestKeyVersionFallback   bool   `json:"latestKeyVersionFallback,omitempty"`
+	FederatedTokenFile         string `json:"federatedTokenFile,omitempty"`
+	FederatedTokenAudience     string `json:"federatedTokenAudience,omitempty"`
+	CredentialChain            bool   `json:"credentialChain,omitempty"`
 }
 
 // AZConfig contains the Service Principal fields as generated by `az`.
@@ -65,6 +128,158 @@ type AZConfig struct {
 	Password string `json:"password,omitempty"`
 }
 
+// AKSConfig contains the Service Principal and Managed Identity fields as
+// found in the AKS `azure.json` (kubelet cloud provider configuration) file.
+// The `tenantId` field is shared with AADConfig.
+// Ref: https://cloud-provider-azure.sigs.k8s.io/install/configs/
+type AKSConfig struct {
+	AADClientID                 string `json:"aadClientId,omitempty"`
+	AADClientSecret             string `json:"aadClientSecret,omitempty"`
+	UseManagedIdentityExtension bool   `json:"useManagedIdentityExtension,omitempty"`
+	UserAssignedIdentityID      string `json:"userAssignedIdentityID,omitempty"`
+}
+
+// Validate validates the AADConfig before any credential is constructed. It
+// checks that fields which require each other are set together, that
+// mutually exclusive fields are not, that the client certificate can be
+// parsed, that the authority host and proxy are valid URLs, that the cloud is
+// known and the vault DNS suffix is a valid DNS name, and that a set of
+// credentials is found.
+// It returns an aggregate of field errors naming the offending fields, or
+// nil. The values of secret fields are never included.
+func (s AADConfig) Validate() error {
+	var errs field.ErrorList
+
+	if s.ClientSecret != "" && s.ClientCertificate != "" {
+		errs = append(errs, field.Forbidden(field.NewPath("clientCertificate"), "may not be set together with 'clientSecret'"))
+	}
+	if s.ClientSecret != "" || s.ClientCertificate != "" {
+		if s.TenantID == "" {
+			errs = append(errs, field.Required(field.NewPath("tenantId"), "required with 'clientSecret' or 'clientCertificate'"))
+		}
+		if s.ClientID == "" {
+			errs = append(errs, field.Required(field.NewPath("clientId"), "required with 'clientSecret' or 'clientCertificate'"))
+		}
+	} else if s.TenantID != "" && s.ClientID != "" && !s.hasWorkloadIdentity() {
+		errs = append(errs, field.Required(field.NewPath("clientSecret"),
+			"'clientSecret' or 'clientCertificate' required with 'tenantId' and 'clientId', unless Workload Identity is configured"))
+	}
+	if s.ClientCertificate != "" {
+		if _, _, err := azidentity.ParseCertificates([]byte(s.ClientCertificate), []byte(s.ClientCertificatePassword)); err != nil {
+			errs = append(errs, field.Invalid(field.NewPath("clientCertificate"), field.OmitValueType{},
+				fmt.Sprintf("failed to parse client certificate: %s", err)))
+		}
+	} else {
+		if s.ClientCertificatePassword != "" {
+			errs = append(errs, field.Forbidden(field.NewPath("clientCertificatePassword"), "requires 'clientCertificate'"))
+		}
+		if s.ClientCertificateSendChain {
+			errs = append(errs, field.Forbidden(field.NewPath("clientCertificateSendChain"), "requires 'clientCertificate'"))
+		}
+	}
+	if s.ClientID != "" && s.ResourceID != "" {
+		errs = append(errs, field.Forbidden(field.NewPath("resourceId"), "may not be set together with 'clientId'"))
+	}
+	if s.FederatedTokenFile != "" || s.FederatedTokenAudience != "" {
+		tokenFile, clientID, tenantID := s.workloadIdentityConfig()
+		if tokenFile == "" {
+			errs = append(errs, field.Required(field.NewPath("federatedTokenFile"),
+				"required with 'federatedTokenAudience' when AZURE_FEDERATED_TOKEN_FILE is not set"))
+		}
+		if clientID == "" {
+			errs = append(errs, field.Required(field.NewPath("clientId"),
+				"required with 'federatedTokenFile' when AZURE_CLIENT_ID is not set"))
+		}
+		if tenantID == "" {
+			errs = append(errs, field.Required(field.NewPath("tenantId"),
+				"required with 'federatedTokenFile' when AZURE_TENANT_ID is not set"))
+		}
+	}
+
+	if s.AppID != "" || s.Tenant != "" || s.Password != "" {
+		for _, f := range []struct{ name, value string }{{"appId", s.AppID}, {"tenant", s.Tenant}, {"password", s.Password}} {
+			if f.value == "" {
+				errs = append(errs, field.Required(field.NewPath(f.name), "required with 'appId', 'tenant' and 'password'"))
+			}
+		}
+	}
+	if !s.UseManagedIdentityExtension && (s.AADClientID != "" || s.AADClientSecret != "") {
+		if s.AADClientID == "" {
+			errs = append(errs, field.Required(field.NewPath("aadClientId"), "required with 'aadClientSecret'"))
+		}
+		if s.AADClientSecret == "" {
+			errs = append(errs, field.Required(field.NewPath("aadClientSecret"), "required with 'aadClientId'"))
+		}
+		if s.TenantID == "" {
+			errs = append(errs, field.Required(field.NewPath("tenantId"), "required with 'aadClientId' and 'aadClientSecret'"))
+		}
+	}
+
+	if s.AuthorityHost != "" {
+		if u, err := url.Parse(s.AuthorityHost); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, field.Invalid(field.NewPath("authorityHost"), s.AuthorityHost, "must be an absolute https URL"))
+		}
+	}
+	if s.Cloud != "" {
+		if _, ok := cloudConfigs[strings.ToLower(s.Cloud)]; !ok {
+			errs = append(errs, field.NotSupported(field.NewPath("cloud"), s.Cloud,
+				[]string{azurePublicCloud, azureChinaCloud, azureUSGovernmentCloud}))
+		}
+	}
+	if s.ProxyURL != "" {
+		if _, err := parseProxyURL(s.ProxyURL); err != nil {
+			errs = append(errs, field.Invalid(field.NewPath("proxyURL"), field.OmitValueType{}, err.Error()))
+		}
+	}
+	if s.VaultDNSSuffix != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(strings.ToLower(strings.Trim(s.VaultDNSSuffix, "."))) {
+			errs = append(errs, field.Invalid(field.NewPath("vaultDnsSuffix"), s.VaultDNSSuffix, msg))
+		}
+	}
+
+	if len(errs) == 0 && !s.CredentialChain && !s.hasCredentials() {
+		errs = append(errs, field.Required(field.NewPath("clientId"),
+			fmt.Sprintf("requires a '%s' or '%s' field, a combination of '%s', '%s' and '%s', '%s', '%s' and '%s', or '%s', '%s' and '%s', or '%s' set to true",
+				"clientId", "resourceId", "tenantId", "clientId", "clientSecret", "tenantId", "clientId", "clientCertificate",
+				"tenantId", "aadClientId", "aadClientSecret", "useManagedIdentityExtension")))
+	}
+
+	return errs.ToAggregate()
+}
+
+// hasCredentials returns if the AADConfig contains a set of credentials for
+// TokenCredentialFromAADConfig.
+func (s AADConfig) hasCredentials() bool {
+	return s.ClientID != "" || s.ResourceID != "" || s.UseManagedIdentityExtension ||
+		(s.AppID != "" && s.Tenant != "" && s.Password != "") ||
+		(s.TenantID != "" && s.AADClientID != "" && s.AADClientSecret != "") ||
+		s.hasWorkloadIdentity()
+}
+
+// hasWorkloadIdentity returns if a Workload Identity can be configured for
+// the AADConfig (see workloadIdentityCredential).
+func (s AADConfig) hasWorkloadIdentity() bool {
+	tokenFile, clientID, tenantID := s.workloadIdentityConfig()
+	return tokenFile != "" && clientID != "" && tenantID != ""
+}
+
+// workloadIdentityConfig returns the federated token file, client ID and
+// tenant ID of the AADConfig, with a fallback to the AZURE_FEDERATED_TOKEN_FILE,
+// AZURE_CLIENT_ID and AZURE_TENANT_ID environment variables.
+func (s AADConfig) workloadIdentityConfig() (tokenFile, clientID, tenantID string) {
+	tokenFile, clientID, tenantID = s.FederatedTokenFile, s.ClientID, s.TenantID
+	if tokenFile == "" {
+		tokenFile = os.Getenv(azureFederatedTokenFileEnv)
+	}
+	if clientID == "" {
+		clientID = os.Getenv(azureClientIDEnv)
+	}
+	if tenantID == "" {
+		tenantID = os.Getenv(azureTenantIDEnv)
+	}
+	return
+}
+
 // TokenCredentialFromAADConfig attempts to construct a Token using the AADConfig values.
 // It detects credentials in the following order:
 //
@@ -74,53 +289,332 @@ type AZConfig struct {
 //     `clientCertificate` (and optionally `clientCertificatePassword`) fields
 //     are found.
 //   - azidentity.ClientSecretCredential when AZConfig fields are found.
+//   - azidentity.ClientSecretCredential when `tenantId`, `aadClientId` and
+//     `aadClientSecret` AKSConfig fields are found, and
+//     `useManagedIdentityExtension` is not enabled.
+//   - azidentity.ManagedIdentityCredential when the AKSConfig
+//     `useManagedIdentityExtension` field is enabled, for the User ID in
+//     `userAssignedIdentityID` or else the system-assigned identity.
+//   - azidentity.ManagedIdentityCredential for a resource ID, when a
+//     `resourceId` field is found.
+//   - azidentity.WorkloadIdentityCredential when the AZURE_FEDERATED_TOKEN_FILE
+//     environment variable is set, using the `clientId` and `tenantId` fields
+//     with a fallback to the AZURE_CLIENT_ID and AZURE_TENANT_ID environment
+//     variables.
+//   - azidentity.ClientAssertionCredential instead of the
+//     azidentity.WorkloadIdentityCredential, when the `federatedTokenFile` or
+//     `federatedTokenAudience` field is set.
 //   - azidentity.ManagedIdentityCredential for a User ID, when a `clientId`
 //     field but no `tenantId` is found.
 //
-// If no set of credentials is found or the azcore.TokenCredential can not be
-// created, an error is returned.
-func TokenCredentialFromAADConfig(c AADConfig) (token azcore.TokenCredential, err error) {
+// When `credentialChain` is enabled, an azidentity.ChainedTokenCredential is
+// returned instead, which attempts the managed identity first, followed by
+// the service principal and workload identity credentials found
+// (see chainedTokenCredential).
+//
+// Requests to Azure Active Directory are sent through the `proxyURL` when
+// set, or else through the proxy configured using the HTTPS_PROXY and
+// NO_PROXY environment variables. This does not apply to the
+// azidentity.ManagedIdentityCredential, as the instance metadata endpoint is
+// local to the host.
+//
+// The returned TokenCredential is tagged with the CredentialKind and the
+// tenant and client ID used, to describe it in error messages.
+//
+// If the AADConfig is invalid (see Validate), or the azcore.TokenCredential
+// can not be created, an error is returned.
+func TokenCredentialFromAADConfig(c AADConfig) (token *TokenCredential, err error) {
+	if err = c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid data: %w", err)
+	}
+
+	transport, err := NewTransport(c.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	clientOptions := azcore.ClientOptions{
+		Cloud:     c.GetCloudConfig(),
+		Transport: transport,
+	}
+
+	if c.CredentialChain {
+		return chainedTokenCredential(c, clientOptions)
+	}
+
+	if token, err = servicePrincipalCredential(c, clientOptions); token != nil || err != nil {
+		return token, err
+	}
+
+	if c.UseManagedIdentityExtension {
+		return managedIdentityCredential(c.UserAssignedIdentityID, "")
+	}
+
+	if c.ResourceID != "" {
+		return managedIdentityCredential("", c.ResourceID)
+	}
+
+	if token, err = workloadIdentityCredential(c, clientOptions); token != nil || err != nil {
+		return token, err
+	}
+
+	// Validate ensures a Client ID is set when no other credentials are found.
+	return managedIdentityCredential(c.ClientID, "")
+}
+
+// chainedTokenCredential returns an azidentity.ChainedTokenCredential which
+// attempts the credentials in the following order, using the first one to
+// successfully acquire a token:
+//
+//   - azidentity.ManagedIdentityCredential, for the User ID in
+//     `userAssignedIdentityID`, the resource ID in `resourceId`, or the User
+//     ID in `clientId` when no `tenantId` is found, or else the
+//     system-assigned identity.
+//   - The service principal credential found in the AADConfig, if any (see
+//     servicePrincipalCredential).
+//   - azidentity.WorkloadIdentityCredential, if configured (see
+//     workloadIdentityCredential).
+//
+// When all credentials fail, the error of the chain contains the failure
+// reason of each of them.
+func chainedTokenCredential(c AADConfig, clientOptions azcore.ClientOptions) (*TokenCredential, error) {
+	sources, err := credentialChainSources(c, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make([]azcore.TokenCredential, 0, len(sources))
+	for _, s := range sources {
+		credentials = append(credentials, s)
+	}
+	chain, err := azidentity.NewChainedTokenCredential(credentials, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenCredential{
+		TokenCredential: chain,
+		Kind:            CredentialKindChain,
+		Sources:         sources,
+	}, nil
+}
+
+// credentialChainSources returns the ordered sources for
+// chainedTokenCredential.
+func credentialChainSources(c AADConfig, clientOptions azcore.ClientOptions) ([]*TokenCredential, error) {
+	var sources []*TokenCredential
+
+	var miClientID, miResourceID string
+	switch {
+	case c.UserAssignedIdentityID != "":
+		miClientID = c.UserAssignedIdentityID
+	case c.ResourceID != "":
+		miResourceID = c.ResourceID
+	case c.ClientID != "" && c.TenantID == "":
+		miClientID = c.ClientID
+	}
+	mi, err := managedIdentityCredential(miClientID, miResourceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct managed identity credential for chain: %w", err)
+	}
+	sources = append(sources, mi)
+
+	sp, err := servicePrincipalCredential(c, clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct service principal credential for chain: %w", err)
+	}
+	if sp != nil {
+		sources = append(sources, sp)
+	}
+
+	wi, err := workloadIdentityCredential(c, clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct workload identity credential for chain: %w", err)
+	}
+	if wi != nil {
+		sources = append(sources, wi)
+	}
+	return sources, nil
+}
+
+// servicePrincipalCredential returns the service principal credential for the
+// first set of fields found in the following order, or nil:
+//
+//   - azidentity.ClientSecretCredential when `tenantId`, `clientId` and
+//     `clientSecret` fields are found.
+//   - azidentity.ClientCertificateCredential when `tenantId`,
+//     `clientCertificate` (and optionally `clientCertificatePassword`) fields
+//     are found.
+//   - azidentity.ClientSecretCredential when AZConfig fields are found.
+//   - azidentity.ClientSecretCredential when `tenantId`, `aadClientId` and
+//     `aadClientSecret` AKSConfig fields are found, and
+//     `useManagedIdentityExtension` is not enabled.
+func servicePrincipalCredential(c AADConfig, clientOptions azcore.ClientOptions) (*TokenCredential, error) {
 	if c.TenantID != "" && c.ClientID != "" {
 		if c.ClientSecret != "" {
-			return azidentity.NewClientSecretCredential(c.TenantID, c.ClientID, c.ClientSecret, &azidentity.ClientSecretCredentialOptions{
-				ClientOptions: azcore.ClientOptions{
-					Cloud: c.GetCloudConfig(),
-				},
+			cred, err := azidentity.NewClientSecretCredential(c.TenantID, c.ClientID, c.ClientSecret, &azidentity.ClientSecretCredentialOptions{
+				ClientOptions: clientOptions,
 			})
+			return newTokenCredential(CredentialKindClientSecret, c.TenantID, c.ClientID, cred, err)
 		}
 		if c.ClientCertificate != "" {
 			certs, pk, err := azidentity.ParseCertificates([]byte(c.ClientCertificate), []byte(c.ClientCertificatePassword))
 			if err != nil {
 				return nil, err
 			}
-			return azidentity.NewClientCertificateCredential(c.TenantID, c.ClientID, certs, pk, &azidentity.ClientCertificateCredentialOptions{
+			cred, err := azidentity.NewClientCertificateCredential(c.TenantID, c.ClientID, certs, pk, &azidentity.ClientCertificateCredentialOptions{
 				SendCertificateChain: c.ClientCertificateSendChain,
-				ClientOptions: azcore.ClientOptions{
-					Cloud: c.GetCloudConfig(),
-				},
+				ClientOptions:        clientOptions,
 			})
+			return newTokenCredential(CredentialKindClientCertificate, c.TenantID, c.ClientID, cred, err)
 		}
 	}
 
-	switch {
-	case c.Tenant != "" && c.AppID != "" && c.Password != "":
-		return azidentity.NewClientSecretCredential(c.Tenant, c.AppID, c.Password, &azidentity.ClientSecretCredentialOptions{
-			ClientOptions: azcore.ClientOptions{
-				Cloud: c.GetCloudConfig(),
-			},
+	if c.Tenant != "" && c.AppID != "" && c.Password != "" {
+		cred, err := azidentity.NewClientSecretCredential(c.Tenant, c.AppID, c.Password, &azidentity.ClientSecretCredentialOptions{
+			ClientOptions: clientOptions,
 		})
-	case c.ClientID != "":
-		return azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
-			ID: azidentity.ClientID(c.ClientID),
+		return newTokenCredential(CredentialKindClientSecret, c.Tenant, c.AppID, cred, err)
+	}
+
+	if !c.UseManagedIdentityExtension && c.TenantID != "" && c.AADClientID != "" && c.AADClientSecret != "" {
+		cred, err := azidentity.NewClientSecretCredential(c.TenantID, c.AADClientID, c.AADClientSecret, &azidentity.ClientSecretCredentialOptions{
+			ClientOptions: clientOptions,
 		})
-	default:
-		return nil, fmt.Errorf("invalid data: requires a '%s' field, a combination of '%s', '%s' and '%s', or '%s', '%s' and '%s'",
-			"clientId", "tenantId", "clientId", "clientSecret", "tenantId", "clientId", "clientCertificate")
+		return newTokenCredential(CredentialKindClientSecret, c.TenantID, c.AADClientID, cred, err)
+	}
+	return nil, nil
+}
+
+// managedIdentityCredential returns an azidentity.ManagedIdentityCredential
+// for the given User ID or resource ID, or the system-assigned identity if
+// both are empty.
+func managedIdentityCredential(clientID, resourceID string) (*TokenCredential, error) {
+	o := &azidentity.ManagedIdentityCredentialOptions{}
+	switch {
+	case clientID != "":
+		o.ID = azidentity.ClientID(clientID)
+	case resourceID != "":
+		o.ID = azidentity.ResourceID(resourceID)
+	}
+	cred, err := azidentity.NewManagedIdentityCredential(o)
+	token, err := newTokenCredential(CredentialKindManagedIdentity, "", clientID, cred, err)
+	if token != nil {
+		token.ResourceID = resourceID
 	}
+	return token, err
 }
 
-// GetCloudConfig returns a cloud.Configuration with the AuthorityHost, or the
-// Azure Public Cloud default.
+// workloadIdentityCredential returns an azidentity.WorkloadIdentityCredential
+// when the AZURE_FEDERATED_TOKEN_FILE environment variable is set, using the
+// `clientId` and `tenantId` fields with a fallback to the AZURE_CLIENT_ID and
+// AZURE_TENANT_ID environment variables. It returns nil if no token file,
+// client or tenant ID is found.
+//
+// When the `federatedTokenFile` or `federatedTokenAudience` field is set, an
+// azidentity.ClientAssertionCredential is returned instead, which exchanges
+// the token read from the `federatedTokenFile` (or AZURE_FEDERATED_TOKEN_FILE)
+// for a token of the (cross-tenant) identity. See federatedTokenAssertion.
+func workloadIdentityCredential(c AADConfig, clientOptions azcore.ClientOptions) (*TokenCredential, error) {
+	tokenFile, clientID, tenantID := c.workloadIdentityConfig()
+	if tokenFile == "" || clientID == "" || tenantID == "" {
+		return nil, nil
+	}
+	if c.FederatedTokenFile != "" || c.FederatedTokenAudience != "" {
+		cred, err := azidentity.NewClientAssertionCredential(tenantID, clientID,
+			federatedTokenAssertion(tokenFile, c.FederatedTokenAudience), &azidentity.ClientAssertionCredentialOptions{
+				ClientOptions: clientOptions,
+			})
+		return newTokenCredential(CredentialKindClientAssertion, tenantID, clientID, cred, err)
+	}
+	cred, err := azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+		ClientID:      clientID,
+		TenantID:      tenantID,
+		TokenFilePath: tokenFile,
+		ClientOptions: clientOptions,
+	})
+	return newTokenCredential(CredentialKindWorkloadIdentity, tenantID, clientID, cred, err)
+}
+
+// federatedTokenAssertion returns a function for an
+// azidentity.ClientAssertionCredential, which reads the federated token from
+// the given file on every call to pick up rotations of the (projected) token.
+// When an audience is given, the function returns an error if the token is
+// not issued for it.
+func federatedTokenAssertion(tokenFile, audience string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read federated token file: %w", err)
+		}
+		defer securebytes.Wipe(b)
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return "", fmt.Errorf("federated token file '%s' is empty", tokenFile)
+		}
+		if audience != "" {
+			audiences, err := tokenAudiences(token)
+			if err != nil {
+				return "", fmt.Errorf("failed to read audience of federated token from '%s': %w", tokenFile, err)
+			}
+			if !slices.Contains(audiences, audience) {
+				return "", fmt.Errorf("federated token from '%s' is issued for audience '%s' instead of '%s'",
+					tokenFile, strings.Join(audiences, ", "), audience)
+			}
+		}
+		return token, nil
+	}
+}
+
+// tokenAudiences returns the audience claim of the given JWT, without
+// verifying its signature.
+func tokenAudiences(token string) ([]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode token payload: %w", err)
+	}
+	var claims struct {
+		Audience json.RawMessage `json:"aud"`
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token payload: %w", err)
+	}
+	var audiences []string
+	if err = json.Unmarshal(claims.Audience, &audiences); err != nil {
+		var audience string
+		if err = json.Unmarshal(claims.Audience, &audience); err != nil {
+			return nil, fmt.Errorf("invalid audience claim: %w", err)
+		}
+		audiences = []string{audience}
+	}
+	return audiences, nil
+}
+
+// MergeClientCertificate merges the given client certificate and password
+// into the AADConfig, taking precedence over the `clientCertificate` and
+// `clientCertificatePassword` fields from the Azure authentication file.
+// The certificate can be PEM or PKCS#12 (PFX) encoded. When no certificate
+// is given, only the password is merged.
+// It returns an error if the (resulting) certificate can not be parsed.
+func (s *AADConfig) MergeClientCertificate(cert, password []byte) error {
+	if len(password) > 0 {
+		s.ClientCertificatePassword = string(password)
+	}
+	if len(cert) > 0 {
+		s.ClientCertificate = string(cert)
+	}
+	if (len(cert) > 0 || len(password) > 0) && s.ClientCertificate != "" {
+		if _, _, err := azidentity.ParseCertificates([]byte(s.ClientCertificate), []byte(s.ClientCertificatePassword)); err != nil {
+			return fmt.Errorf("failed to parse client certificate: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetCloudConfig returns a cloud.Configuration with the AuthorityHost, the
+// configuration of the named Cloud, or the Azure Public Cloud default.
+// The AuthorityHost takes precedence over the Cloud when both are set.
 func (s AADConfig) GetCloudConfig() cloud.Configuration {
 	if s.AuthorityHost != "" {
 		return cloud.Configuration{
@@ -128,26 +622,35 @@ func (s AADConfig) GetCloudConfig() cloud.Configuration {
 			Services:                     map[cloud.ServiceName]cloud.ServiceConfiguration{},
 		}
 	}
+	if c, ok := cloudConfigs[strings.ToLower(s.Cloud)]; ok {
+		return c
+	}
 	return cloud.AzurePublic
 }
 
+// decode returns a copy of the given bytes, decoded to UTF-8 if UTF-16
+// encoded, which the caller should wipe after use.
 func decode(b []byte) ([]byte, error) {
 	reader, enc := utfbom.Skip(bytes.NewReader(b))
+	var order binary.ByteOrder
 	switch enc {
 	case utfbom.UTF16LittleEndian:
-		u16 := make([]uint16, (len(b)/2)-1)
-		err := binary.Read(reader, binary.LittleEndian, &u16)
-		if err != nil {
-			return nil, err
-		}
-		return []byte(string(utf16.Decode(u16))), nil
+		order = binary.LittleEndian
 	case utfbom.UTF16BigEndian:
-		u16 := make([]uint16, (len(b)/2)-1)
-		err := binary.Read(reader, binary.BigEndian, &u16)
-		if err != nil {
-			return nil, err
-		}
-		return []byte(string(utf16.Decode(u16))), nil
+		order = binary.BigEndian
+	default:
+		return io.ReadAll(reader)
+	}
+	u16 := make([]uint16, (len(b)/2)-1)
+	defer clear(u16)
+	if err := binary.Read(reader, order, &u16); err != nil {
+		return nil, err
+	}
+	runes := utf16.Decode(u16)
+	defer clear(runes)
+	out := make([]byte, 0, utf8.UTFMax*len(runes))
+	for _, r := range runes {
+		out = utf8.AppendRune(out, r)
 	}
-	return io.ReadAll(reader)
+	return out, nil
 }
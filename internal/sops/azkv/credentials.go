@@ -29,7 +29,9 @@ import (
 // DefaultTokenCredential is a modification of azidentity.NewDefaultAzureCredential,
 // specifically adapted to not shell out to the Azure CLI.
 //
-// It attempts to return an azcore.TokenCredential based on the following order:
+// It returns an azidentity.ChainedTokenCredential of the credentials which
+// can be constructed from the runtime environment, attempted in the following
+// order:
 //
 //   - azidentity.NewEnvironmentCredential if environment variables AZURE_CLIENT_ID,
 //     AZURE_CLIENT_ID is set with either one of the following: (AZURE_CLIENT_SECRET)
@@ -38,34 +40,36 @@ import (
 //   - azidentity.WorkloadIdentityCredential if environment variable configuration
 //     (AZURE_AUTHORITY_HOST, AZURE_CLIENT_ID, AZURE_FEDERATED_TOKEN_FILE, AZURE_TENANT_ID)
 //     is set by the Azure workload identity webhook.
-//   - azidentity.ManagedIdentityCredential if only AZURE_CLIENT_ID env variable is set.
+//   - azidentity.ManagedIdentityCredential, for the User ID in AZURE_CLIENT_ID
+//     if set.
+//
+// If none of the credentials can be constructed, an error with the reason for
+// each of them is returned.
 func DefaultTokenCredential() (azcore.TokenCredential, error) {
+	const azureAuthorityHost = "AZURE_AUTHORITY_HOST"
+
 	var (
-		azureClientID           = "AZURE_CLIENT_ID"
-		azureFederatedTokenFile = "AZURE_FEDERATED_TOKEN_FILE"
-		azureAuthorityHost      = "AZURE_AUTHORITY_HOST"
-		azureTenantID           = "AZURE_TENANT_ID"
+		errorMessages []string
+		sources       []azcore.TokenCredential
 	)
-
-	var errorMessages []string
 	options := &azidentity.DefaultAzureCredentialOptions{}
 
 	envCred, err := azidentity.NewEnvironmentCredential(&azidentity.EnvironmentCredentialOptions{
 		ClientOptions: options.ClientOptions, DisableInstanceDiscovery: options.DisableInstanceDiscovery},
 	)
 	if err == nil {
-		return envCred, nil
+		sources = append(sources, envCred)
 	} else {
 		errorMessages = append(errorMessages, "EnvironmentCredential: "+err.Error())
 	}
 
 	// workload identity requires values for AZURE_AUTHORITY_HOST, AZURE_CLIENT_ID, AZURE_FEDERATED_TOKEN_FILE, AZURE_TENANT_ID
 	haveWorkloadConfig := false
-	clientID, haveClientID := os.LookupEnv(azureClientID)
+	clientID, haveClientID := os.LookupEnv(azureClientIDEnv)
 	if haveClientID {
-		if file, ok := os.LookupEnv(azureFederatedTokenFile); ok {
+		if file, ok := os.LookupEnv(azureFederatedTokenFileEnv); ok {
 			if _, ok := os.LookupEnv(azureAuthorityHost); ok {
-				if tenantID, ok := os.LookupEnv(azureTenantID); ok {
+				if tenantID, ok := os.LookupEnv(azureTenantIDEnv); ok {
 					haveWorkloadConfig = true
 					workloadCred, err := azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
 						ClientID:                 clientID,
@@ -75,7 +79,7 @@ func DefaultTokenCredential() (azcore.TokenCredential, error) {
 						DisableInstanceDiscovery: options.DisableInstanceDiscovery,
 					})
 					if err == nil {
-						return workloadCred, nil
+						sources = append(sources, workloadCred)
 					} else {
 						errorMessages = append(errorMessages, "Workload Identity"+": "+err.Error())
 					}
@@ -94,10 +98,13 @@ func DefaultTokenCredential() (azcore.TokenCredential, error) {
 	}
 	miCred, err := azidentity.NewManagedIdentityCredential(o)
 	if err == nil {
-		return miCred, nil
+		sources = append(sources, miCred)
 	} else {
 		errorMessages = append(errorMessages, "ManagedIdentity"+": "+err.Error())
 	}
 
-	return nil, errors.New(strings.Join(errorMessages, "\n"))
+	if len(sources) == 0 {
+		return nil, errors.New(strings.Join(errorMessages, "\n"))
+	}
+	return azidentity.NewChainedTokenCredential(sources, nil)
 }
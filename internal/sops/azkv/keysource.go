@@ -0,0 +1,321 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azkv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azkeys"
+	"github.com/getsops/sops/v3/azkv"
+)
+
+// retryOptions configures the bounded exponential backoff of the Azure Key
+// Vault client for transient failures (HTTP 408, 429 and 5xx). A Retry-After
+// header returned by the vault takes precedence over the delay.
+var retryOptions = policy.RetryOptions{
+	MaxRetries:    5,
+	RetryDelay:    1 * time.Second,
+	MaxRetryDelay: 30 * time.Second,
+}
+
+// DefaultVaultDNSSuffixes are the DNS suffixes of the Azure Key Vaults and
+// Managed HSMs in the Azure Public, China and US Government clouds.
+var DefaultVaultDNSSuffixes = []string{
+	"vault.azure.net",
+	"vault.azure.cn",
+	"vault.usgovcloudapi.net",
+	"managedhsm.azure.net",
+	"managedhsm.azure.cn",
+	"managedhsm.usgovcloudapi.net",
+}
+
+// ClientOptions configures the Azure Key Vault client used by Encrypt and
+// Decrypt.
+type ClientOptions struct {
+	// Transport sends the requests to the Key Vault. When nil, the default
+	// transport is used.
+	Transport policy.Transporter
+	// VaultDNSSuffixes are the DNS suffixes of vaults allowed in addition to
+	// the DefaultVaultDNSSuffixes, for example "privatelink.vaultcore.azure.net"
+	// for a Private Link with custom DNS.
+	VaultDNSSuffixes []string
+	// LatestKeyVersionFallback enables Decrypt to retry once with the latest
+	// version of a versioned key, when the version is disabled or not found
+	// (for example after a key rotation). When the retry succeeds, the
+	// function is called with the key and the error of the version.
+	// When nil, no fallback is attempted.
+	LatestKeyVersionFallback func(key *azkv.MasterKey, err error)
+}
+
+// Encrypt takes a SOPS data key, encrypts it with the Azure Key Vault key
+// using the given token, and stores the result in the EncryptedKey field of
+// the key. Requests to the Key Vault are sent using the transport of the
+// given options. Transient failures are retried with a backoff until the
+// context is done.
+//
+// It is the counterpart of azkv.MasterKey.Encrypt, allowing the configuration
+// of the Key Vault client.
+func Encrypt(ctx context.Context, key *azkv.MasterKey, token azcore.TokenCredential, opts ClientOptions, dataKey []byte) error {
+	c, err := newKeyVaultClient(key, token, opts)
+	if err != nil {
+		return keyVaultError("encrypt", key, token, err)
+	}
+
+	resp, err := c.Encrypt(ctx, key.Name, key.Version, azkeys.KeyOperationParameters{
+		Algorithm: to.Ptr(azkeys.EncryptionAlgorithmRSAOAEP256),
+		Value:     dataKey,
+	}, nil)
+	if err != nil {
+		return keyVaultError("encrypt", key, token, err)
+	}
+
+	key.SetEncryptedDataKey([]byte(base64.RawURLEncoding.EncodeToString(resp.KeyOperationResult.Result)))
+	return nil
+}
+
+// Decrypt decrypts the EncryptedKey field of the Azure Key Vault key using
+// the given token, and returns the result. Requests to the Key Vault are sent
+// using the transport of the given options. Transient failures are retried
+// with a backoff until the context is done.
+//
+// When enabled by the LatestKeyVersionFallback of the options, a versioned
+// key which is disabled or not found is retried with its latest version.
+//
+// It is the counterpart of azkv.MasterKey.Decrypt, allowing the configuration
+// of the Key Vault client.
+func Decrypt(ctx context.Context, key *azkv.MasterKey, token azcore.TokenCredential, opts ClientOptions) ([]byte, error) {
+	rawEncryptedKey, err := base64.RawURLEncoding.DecodeString(key.EncryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to base64 decode Azure Key Vault encrypted key: %w", err)
+	}
+
+	c, err := newKeyVaultClient(key, token, opts)
+	if err != nil {
+		return nil, keyVaultError("decrypt", key, token, err)
+	}
+
+	params := azkeys.KeyOperationParameters{
+		Algorithm: to.Ptr(azkeys.EncryptionAlgorithmRSAOAEP256),
+		Value:     rawEncryptedKey,
+	}
+	resp, err := c.Decrypt(ctx, key.Name, key.Version, params, nil)
+	if err != nil && key.Version != "" && opts.LatestKeyVersionFallback != nil && isUnavailableKeyVersion(err) {
+		// An empty version refers to the latest version of the key.
+		latestResp, latestErr := c.Decrypt(ctx, key.Name, "", params, nil)
+		if latestErr != nil {
+			return nil, keyVaultError("decrypt", key, token,
+				fmt.Errorf("%w (retrying with the latest key version failed too: %s)", err, latestErr))
+		}
+		opts.LatestKeyVersionFallback(key, err)
+		return latestResp.KeyOperationResult.Result, nil
+	}
+	if err != nil {
+		return nil, keyVaultError("decrypt", key, token, err)
+	}
+	return resp.KeyOperationResult.Result, nil
+}
+
+// unavailableKeyVersionCodes are the Azure Key Vault error codes returned for
+// a key version which is disabled or does not exist.
+var unavailableKeyVersionCodes = []string{"KeyDisabled", "KeyNotFound"}
+
+// isUnavailableKeyVersion returns if the error is an azcore.ResponseError
+// with an unavailableKeyVersionCodes error code, or inner error code.
+func isUnavailableKeyVersion(err error) bool {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	if slices.Contains(unavailableKeyVersionCodes, respErr.ErrorCode) {
+		return true
+	}
+	if respErr.RawResponse == nil {
+		return false
+	}
+	body, err := runtime.Payload(respErr.RawResponse)
+	if err != nil {
+		return false
+	}
+	var payload struct {
+		Error struct {
+			InnerError struct {
+				Code string `json:"code"`
+			} `json:"innererror"`
+		} `json:"error"`
+	}
+	if err = json.Unmarshal(body, &payload); err != nil {
+		return false
+	}
+	return slices.Contains(unavailableKeyVersionCodes, payload.Error.InnerError.Code)
+}
+
+// newKeyVaultClient returns an azkeys.Client for the vault of the given key,
+// after validating its URL against the allowed DNS suffixes.
+// For vaults under one of the additional VaultDNSSuffixes, the verification
+// of the authentication challenge resource is disabled, as it is issued for
+// the default suffix of the cloud (e.g. "vault.azure.net").
+func newKeyVaultClient(key *azkv.MasterKey, token azcore.TokenCredential, opts ClientOptions) (*azkeys.Client, error) {
+	additional, err := ParseVaultURL(key.VaultURL, opts.VaultDNSSuffixes)
+	if err != nil {
+		return nil, err
+	}
+	return azkeys.NewClient(key.VaultURL, token, &azkeys.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			Transport: opts.Transport,
+			Retry:     retryOptions,
+		},
+		DisableChallengeResourceVerification: additional,
+	})
+}
+
+// ParseVaultURL validates that the given vault URL is an https URL with a
+// host under one of the DefaultVaultDNSSuffixes or the given additional
+// suffixes. It returns true if the host is only allowed by an additional
+// suffix, or an error if it is not allowed.
+func ParseVaultURL(vaultURL string, suffixes []string) (additional bool, err error) {
+	u, err := url.Parse(vaultURL)
+	if err != nil {
+		return false, fmt.Errorf("invalid Azure Key Vault URL: %w", err)
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return false, fmt.Errorf("invalid Azure Key Vault URL '%s': must be an absolute https URL", vaultURL)
+	}
+	host := strings.ToLower(u.Hostname())
+	if hasDNSSuffix(host, DefaultVaultDNSSuffixes) {
+		return false, nil
+	}
+	if hasDNSSuffix(host, suffixes) {
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid Azure Key Vault URL '%s': host '%s' does not match any of the allowed DNS suffixes: %s",
+		vaultURL, host, strings.Join(append(slices.Clone(DefaultVaultDNSSuffixes), suffixes...), ", "))
+}
+
+// hasDNSSuffix returns if the host is a subdomain of any of the suffixes.
+func hasDNSSuffix(host string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		if suffix != "" && strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyVaultError wraps the error of the Azure Key Vault operation for the
+// given key. When the token is a TokenCredential, its description is
+// included to make clear which credential was attempted. Errors caused by
+// throttling persisting after the retries, or by the context deadline, name
+// the vault to make clear where to look.
+// When the error can be classified, a KeyVaultError is returned.
+func keyVaultError(operation string, key *azkv.MasterKey, token azcore.TokenCredential, err error) error {
+	msg := fmt.Sprintf("failed to %s sops data key with Azure Key Vault key '%s'", operation, key.ToString())
+	if t, ok := token.(*TokenCredential); ok {
+		msg += " using " + t.String()
+	}
+
+	var respErr *azcore.ResponseError
+	switch {
+	case errors.As(err, &respErr) && respErr.StatusCode == http.StatusTooManyRequests:
+		err = fmt.Errorf("%s: requests are still throttled by the vault '%s' after retrying, consider raising its request limits: %w",
+			msg, key.VaultURL, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		err = fmt.Errorf("%s: timed out waiting for the vault '%s': %w", msg, key.VaultURL, err)
+	default:
+		err = fmt.Errorf("%s: %w", msg, err)
+	}
+
+	if class := classifyError(err); class != "" {
+		return &KeyVaultError{Class: class, Err: err}
+	}
+	return err
+}
+
+// ErrorClass is the class of an Azure Key Vault operation failure.
+type ErrorClass string
+
+const (
+	// ErrorClassAccessDenied is the class of failures caused by the vault
+	// rejecting the credential (HTTP 401 and 403), or by the credential
+	// failing to authenticate. These failures are not retried.
+	ErrorClassAccessDenied ErrorClass = "AccessDenied"
+	// ErrorClassThrottled is the class of failures caused by the vault
+	// throttling requests (HTTP 429) after the retries are exhausted.
+	ErrorClassThrottled ErrorClass = "Throttled"
+	// ErrorClassConnectionFailed is the class of failures caused by the
+	// transport, for example DNS resolution, connection or proxy errors and
+	// timeouts.
+	ErrorClassConnectionFailed ErrorClass = "ConnectionFailed"
+)
+
+// KeyVaultError is an error of an Azure Key Vault operation, classified by
+// the cause of the failure.
+type KeyVaultError struct {
+	// Class is the class of the failure.
+	Class ErrorClass
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns the message of the underlying error.
+func (e *KeyVaultError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *KeyVaultError) Unwrap() error {
+	return e.Err
+}
+
+// classifyError returns the ErrorClass of the given error of an Azure Key
+// Vault operation, or an empty string if it can not be classified.
+func classifyError(err error) ErrorClass {
+	var (
+		respErr *azcore.ResponseError
+		authErr *azidentity.AuthenticationFailedError
+		netErr  net.Error
+	)
+	switch {
+	case errors.As(err, &respErr):
+		switch respErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return ErrorClassAccessDenied
+		case http.StatusTooManyRequests:
+			return ErrorClassThrottled
+		}
+	case errors.As(err, &authErr):
+		return ErrorClassAccessDenied
+	case errors.As(err, &netErr):
+		return ErrorClassConnectionFailed
+	}
+	return ""
+}
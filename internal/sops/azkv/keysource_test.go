@@ -0,0 +1,614 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azkv
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/getsops/sops/v3/azkv"
+	. "github.com/onsi/gomega"
+)
+
+func TestDecrypt_Proxy(t *testing.T) {
+	g := NewWithT(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	connectHost := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			select {
+			case connectHost <- r.Host:
+			default:
+			}
+			// Cancel the context after the first attempt, to not wait for
+			// retries.
+			cancel()
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(proxy.Close)
+
+	transport, err := NewTransport(proxy.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	token, err := azidentity.NewClientSecretCredential("some-tenant-id", "some-client-id", "some-client-secret", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	key := azkv.NewMasterKey("https://myvault.vault.azure.net", "key-name", "key-version")
+	key.EncryptedKey = "ZW5jcnlwdGVk"
+
+	got, err := Decrypt(ctx, key, token, ClientOptions{Transport: transport})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(got).To(BeNil())
+	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key with Azure Key Vault key 'https://myvault.vault.azure.net/keys/key-name/key-version'"))
+	g.Expect(connectHost).To(Receive(Equal("myvault.vault.azure.net:443")))
+}
+
+func TestDecrypt_InvalidEncryptedKey(t *testing.T) {
+	g := NewWithT(t)
+
+	token, err := azidentity.NewClientSecretCredential("some-tenant-id", "some-client-id", "some-client-secret", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	key := azkv.NewMasterKey("https://myvault.vault.azure.net", "key-name", "key-version")
+	key.EncryptedKey = "invalid base64 !"
+
+	got, err := Decrypt(context.TODO(), key, token, ClientOptions{})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to base64 decode Azure Key Vault encrypted key"))
+	g.Expect(got).To(BeNil())
+}
+
+func TestDecrypt_Retry(t *testing.T) {
+	withFastRetries(t)
+
+	tests := []struct {
+		name       string
+		statuses   []int
+		want       []byte
+		wantErr    string
+		wantCalls  int
+		retryAfter string
+	}{
+		{
+			name:       "retries after throttling",
+			statuses:   []int{http.StatusTooManyRequests, http.StatusOK},
+			retryAfter: "0",
+			want:       []byte("data-key"),
+			wantCalls:  2,
+		},
+		{
+			name:      "retries after server error",
+			statuses:  []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK},
+			want:      []byte("data-key"),
+			wantCalls: 3,
+		},
+		{
+			name:      "persistent throttling exhausts retries",
+			statuses:  []int{http.StatusTooManyRequests},
+			wantErr:   "requests are still throttled by the vault 'https://myvault.vault.azure.net' after retrying",
+			wantCalls: 3,
+		},
+		{
+			name:      "does not retry client errors",
+			statuses:  []int{http.StatusForbidden},
+			wantErr:   "failed to decrypt sops data key with Azure Key Vault key 'https://myvault.vault.azure.net/keys/key-name/key-version'",
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			transport := &fakeKeyVaultTransport{
+				statuses:   tt.statuses,
+				retryAfter: tt.retryAfter,
+				result:     []byte("data-key"),
+			}
+
+			key := azkv.NewMasterKey("https://myvault.vault.azure.net", "key-name", "key-version")
+			key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+
+			got, err := Decrypt(context.TODO(), key, fakeTokenCredential{}, ClientOptions{Transport: transport})
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				g.Expect(got).To(BeNil())
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(got).To(Equal(tt.want))
+			}
+			g.Expect(transport.calls).To(Equal(tt.wantCalls))
+		})
+	}
+}
+
+func TestDecrypt_ErrorClass(t *testing.T) {
+	withFastRetries(t)
+
+	tests := []struct {
+		name      string
+		statuses  []int
+		err       error
+		wantClass ErrorClass
+		wantCalls int
+	}{
+		{
+			name:      "unauthorized",
+			statuses:  []int{http.StatusUnauthorized},
+			wantClass: ErrorClassAccessDenied,
+			wantCalls: 1,
+		},
+		{
+			name:      "forbidden",
+			statuses:  []int{http.StatusForbidden},
+			wantClass: ErrorClassAccessDenied,
+			wantCalls: 1,
+		},
+		{
+			name:      "throttled",
+			statuses:  []int{http.StatusTooManyRequests},
+			wantClass: ErrorClassThrottled,
+			wantCalls: 3,
+		},
+		{
+			name:      "connection failed",
+			err:       &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			wantClass: ErrorClassConnectionFailed,
+			wantCalls: 3,
+		},
+		{
+			name:      "unclassified",
+			statuses:  []int{http.StatusBadRequest},
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			transport := &fakeKeyVaultTransport{
+				statuses: tt.statuses,
+				err:      tt.err,
+			}
+
+			key := azkv.NewMasterKey("https://myvault.vault.azure.net", "key-name", "key-version")
+			key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+
+			_, err := Decrypt(context.TODO(), key, fakeTokenCredential{}, ClientOptions{Transport: transport})
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key with Azure Key Vault key"))
+
+			var kvErr *KeyVaultError
+			if tt.wantClass == "" {
+				g.Expect(errors.As(err, &kvErr)).To(BeFalse())
+			} else {
+				g.Expect(errors.As(err, &kvErr)).To(BeTrue())
+				g.Expect(kvErr.Class).To(Equal(tt.wantClass))
+			}
+			g.Expect(transport.calls).To(Equal(tt.wantCalls))
+		})
+	}
+}
+
+func TestDecrypt_VaultDNSSuffix(t *testing.T) {
+	tests := []struct {
+		name     string
+		vaultURL string
+		resource string
+		suffixes []string
+		wantErr  string
+	}{
+		{
+			name:     "Azure China vault",
+			vaultURL: "https://myvault.vault.azure.cn",
+			resource: "https://vault.azure.cn",
+		},
+		{
+			name:     "Private Link vault with custom DNS suffix",
+			vaultURL: "https://myvault.privatelink.vaultcore.azure.net",
+			resource: "https://vault.azure.net",
+			suffixes: []string{"privatelink.vaultcore.azure.net"},
+		},
+		{
+			name:     "Private Link vault without custom DNS suffix",
+			vaultURL: "https://myvault.privatelink.vaultcore.azure.net",
+			resource: "https://vault.azure.net",
+			wantErr:  "host 'myvault.privatelink.vaultcore.azure.net' does not match any of the allowed DNS suffixes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			transport := &fakeKeyVaultTransport{
+				statuses: []int{http.StatusOK},
+				result:   []byte("data-key"),
+				resource: tt.resource,
+			}
+
+			key := azkv.NewMasterKey(tt.vaultURL, "key-name", "key-version")
+			key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+
+			got, err := Decrypt(context.TODO(), key, fakeTokenCredential{}, ClientOptions{
+				Transport:        transport,
+				VaultDNSSuffixes: tt.suffixes,
+			})
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				g.Expect(transport.calls).To(BeZero())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal([]byte("data-key")))
+		})
+	}
+}
+
+func TestParseVaultURL(t *testing.T) {
+	tests := []struct {
+		name           string
+		vaultURL       string
+		suffixes       []string
+		wantAdditional bool
+		wantErr        string
+	}{
+		{
+			name:     "Azure Public Cloud vault",
+			vaultURL: "https://myvault.vault.azure.net",
+		},
+		{
+			name:     "Azure China vault with trailing slash",
+			vaultURL: "https://myvault.vault.azure.cn/",
+		},
+		{
+			name:     "Azure US Government vault with port",
+			vaultURL: "https://myvault.vault.usgovcloudapi.net:443",
+		},
+		{
+			name:     "Managed HSM",
+			vaultURL: "https://myhsm.managedhsm.azure.net",
+		},
+		{
+			name:     "mixed case host",
+			vaultURL: "https://MyVault.Vault.Azure.Net",
+		},
+		{
+			name:           "additional suffix",
+			vaultURL:       "https://myvault.privatelink.vaultcore.azure.net",
+			suffixes:       []string{"privatelink.vaultcore.azure.net"},
+			wantAdditional: true,
+		},
+		{
+			name:           "additional suffix with leading dot",
+			vaultURL:       "https://myvault.vault.example.com",
+			suffixes:       []string{".vault.example.com"},
+			wantAdditional: true,
+		},
+		{
+			name:     "default suffix takes precedence over additional suffix",
+			vaultURL: "https://myvault.vault.azure.net",
+			suffixes: []string{"azure.net"},
+		},
+		{
+			name:     "suffix without subdomain",
+			vaultURL: "https://vault.azure.net",
+			wantErr:  "does not match any of the allowed DNS suffixes",
+		},
+		{
+			name:     "suffix as part of a label",
+			vaultURL: "https://myvault-vault.azure.net.example.com",
+			wantErr:  "does not match any of the allowed DNS suffixes",
+		},
+		{
+			name:     "unknown suffix",
+			vaultURL: "https://myvault.example.com",
+			wantErr:  "does not match any of the allowed DNS suffixes: vault.azure.net",
+		},
+		{
+			name:     "http scheme",
+			vaultURL: "http://myvault.vault.azure.net",
+			wantErr:  "must be an absolute https URL",
+		},
+		{
+			name:     "no host",
+			vaultURL: "myvault.vault.azure.net",
+			wantErr:  "must be an absolute https URL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := ParseVaultURL(tt.vaultURL, tt.suffixes)
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.wantAdditional))
+		})
+	}
+}
+
+func TestDecrypt_LatestKeyVersionFallback(t *testing.T) {
+	withFastRetries(t)
+
+	const (
+		keyDisabledBody = `{"error": {"code": "Forbidden", "message": "Operation decrypt is not allowed on a disabled key.", "innererror": {"code": "KeyDisabled"}}}`
+		keyNotFoundBody = `{"error": {"code": "KeyNotFound", "message": "A key with (name/id) key-name/key-version was not found in this key vault."}}`
+		forbiddenBody   = `{"error": {"code": "Forbidden", "message": "The user does not have keys decrypt permission.", "innererror": {"code": "ForbiddenByRbac"}}}`
+	)
+
+	tests := []struct {
+		name         string
+		statuses     []int
+		errorBody    string
+		fallback     bool
+		version      string
+		wantErr      string
+		wantPaths    []string
+		wantFallback bool
+	}{
+		{
+			name:         "falls back for disabled key version",
+			statuses:     []int{http.StatusForbidden, http.StatusOK},
+			errorBody:    keyDisabledBody,
+			fallback:     true,
+			version:      "key-version",
+			wantPaths:    []string{"/keys/key-name/key-version/decrypt", "/keys/key-name/decrypt"},
+			wantFallback: true,
+		},
+		{
+			name:         "falls back for key version not found",
+			statuses:     []int{http.StatusNotFound, http.StatusOK},
+			errorBody:    keyNotFoundBody,
+			fallback:     true,
+			version:      "key-version",
+			wantPaths:    []string{"/keys/key-name/key-version/decrypt", "/keys/key-name/decrypt"},
+			wantFallback: true,
+		},
+		{
+			name:      "fallback fails too",
+			statuses:  []int{http.StatusForbidden},
+			errorBody: keyDisabledBody,
+			fallback:  true,
+			version:   "key-version",
+			wantErr:   "retrying with the latest key version failed too",
+			wantPaths: []string{"/keys/key-name/key-version/decrypt", "/keys/key-name/decrypt"},
+		},
+		{
+			name:      "does not fall back when disabled",
+			statuses:  []int{http.StatusForbidden, http.StatusOK},
+			errorBody: keyDisabledBody,
+			version:   "key-version",
+			wantErr:   "KeyDisabled",
+			wantPaths: []string{"/keys/key-name/key-version/decrypt"},
+		},
+		{
+			name:      "does not fall back for other errors",
+			statuses:  []int{http.StatusForbidden, http.StatusOK},
+			errorBody: forbiddenBody,
+			fallback:  true,
+			version:   "key-version",
+			wantErr:   "ForbiddenByRbac",
+			wantPaths: []string{"/keys/key-name/key-version/decrypt"},
+		},
+		{
+			name:      "does not fall back for version-less key",
+			statuses:  []int{http.StatusForbidden, http.StatusOK},
+			errorBody: keyDisabledBody,
+			fallback:  true,
+			wantErr:   "KeyDisabled",
+			wantPaths: []string{"/keys/key-name/decrypt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			transport := &fakeKeyVaultTransport{
+				statuses:  tt.statuses,
+				errorBody: tt.errorBody,
+				result:    []byte("data-key"),
+			}
+
+			key := azkv.NewMasterKey("https://myvault.vault.azure.net", "key-name", tt.version)
+			key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+
+			var fellBack *azkv.MasterKey
+			opts := ClientOptions{Transport: transport}
+			if tt.fallback {
+				opts.LatestKeyVersionFallback = func(key *azkv.MasterKey, err error) {
+					g.Expect(err).To(HaveOccurred())
+					fellBack = key
+				}
+			}
+
+			got, err := Decrypt(context.TODO(), key, fakeTokenCredential{}, opts)
+			if tt.wantErr != "" {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring(tt.wantErr))
+				g.Expect(got).To(BeNil())
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(got).To(Equal([]byte("data-key")))
+			}
+			g.Expect(transport.paths).To(Equal(tt.wantPaths))
+			if tt.wantFallback {
+				g.Expect(fellBack).To(Equal(key))
+			} else {
+				g.Expect(fellBack).To(BeNil())
+			}
+		})
+	}
+}
+
+func TestDecrypt_CredentialDescription(t *testing.T) {
+	withFastRetries(t)
+	g := NewWithT(t)
+
+	token, err := TokenCredentialFromAADConfig(AADConfig{
+		TenantID:     "some-tenant-id",
+		ClientID:     "some-client-id",
+		ClientSecret: "some-client-secret",
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	// Replace the credential to not make calls to Azure Active Directory.
+	token.TokenCredential = fakeTokenCredential{}
+
+	transport := &fakeKeyVaultTransport{
+		statuses: []int{http.StatusForbidden},
+	}
+
+	key := azkv.NewMasterKey("https://myvault.vault.azure.net", "key-name", "key-version")
+	key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+
+	_, err = Decrypt(context.TODO(), key, token, ClientOptions{Transport: transport})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key with Azure Key Vault key " +
+		"'https://myvault.vault.azure.net/keys/key-name/key-version' using azure client-secret credential for tenant some-tenant-id, client some-client-id"))
+	g.Expect(err.Error()).ToNot(ContainSubstring("some-client-secret"))
+}
+
+func TestDecrypt_Timeout(t *testing.T) {
+	g := NewWithT(t)
+
+	transport := &fakeKeyVaultTransport{
+		statuses: []int{http.StatusServiceUnavailable},
+	}
+
+	key := azkv.NewMasterKey("https://myvault.vault.azure.net", "key-name", "key-version")
+	key.EncryptedKey = base64.RawURLEncoding.EncodeToString([]byte("encrypted"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	t.Cleanup(cancel)
+
+	got, err := Decrypt(ctx, key, fakeTokenCredential{}, ClientOptions{Transport: transport})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("timed out waiting for the vault 'https://myvault.vault.azure.net'"))
+	g.Expect(got).To(BeNil())
+	g.Expect(transport.calls).To(Equal(1))
+}
+
+// withFastRetries configures the retryOptions to retry twice without delay
+// for the duration of the test.
+func withFastRetries(t *testing.T) {
+	t.Helper()
+	orig := retryOptions
+	retryOptions = policy.RetryOptions{
+		MaxRetries: 2,
+		RetryDelay: time.Millisecond,
+	}
+	t.Cleanup(func() { retryOptions = orig })
+}
+
+// fakeTokenCredential is an azcore.TokenCredential returning a static token.
+type fakeTokenCredential struct{}
+
+func (fakeTokenCredential) GetToken(_ context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// fakeKeyVaultTransport is a policy.Transporter mimicking an Azure Key Vault.
+// It responds with an authentication challenge to requests without an
+// authorization header, and then with the configured statuses in order,
+// repeating the last one. A 200 response contains the result. When err is
+// set, it is returned instead of a response. The challenge is issued for the
+// resource, or "https://vault.azure.net" if empty. Error responses contain the
+// errorBody, if set. The paths of the authorized requests are recorded.
+type fakeKeyVaultTransport struct {
+	statuses   []int
+	retryAfter string
+	result     []byte
+	err        error
+	resource   string
+	errorBody  string
+
+	mu    sync.Mutex
+	calls int
+	paths []string
+}
+
+func (f *fakeKeyVaultTransport) Do(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if req.Header.Get("Authorization") == "" {
+		resource := f.resource
+		if resource == "" {
+			resource = "https://vault.azure.net"
+		}
+		return f.response(req, http.StatusUnauthorized, map[string]string{
+			"WWW-Authenticate": `Bearer authorization="https://login.microsoftonline.com/tenant", resource="` + resource + `"`,
+		}, ""), nil
+	}
+
+	f.calls++
+	f.paths = append(f.paths, req.URL.Path)
+	if f.err != nil {
+		return nil, f.err
+	}
+	status := f.statuses[min(f.calls-1, len(f.statuses)-1)]
+	switch status {
+	case http.StatusOK:
+		return f.response(req, status, nil, `{"kid": "https://myvault.vault.azure.net/keys/key-name/key-version", "value": "`+
+			base64.RawURLEncoding.EncodeToString(f.result)+`"}`), nil
+	case http.StatusTooManyRequests:
+		var header map[string]string
+		if f.retryAfter != "" {
+			header = map[string]string{"Retry-After": f.retryAfter}
+		}
+		return f.response(req, status, header, `{"error": {"code": "Throttled", "message": "Request was not processed because too many requests were received."}}`), nil
+	default:
+		if f.errorBody != "" {
+			return f.response(req, status, nil, f.errorBody), nil
+		}
+		return f.response(req, status, nil, `{"error": {"code": "Error", "message": "`+http.StatusText(status)+`"}}`), nil
+	}
+}
+
+func (f *fakeKeyVaultTransport) response(req *http.Request, status int, header map[string]string, body string) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+	for k, v := range header {
+		resp.Header.Set(k, v)
+	}
+	return resp
+}
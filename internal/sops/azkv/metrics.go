@@ -0,0 +1,101 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azkv
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TokenMetrics records the latency and failures of the AAD access token
+// requests of the TokenCredential objects instrumented with it, partitioned
+// by credential kind and tenant.
+//
+// A nil *TokenMetrics is valid, and results in credentials not being
+// instrumented.
+type TokenMetrics struct {
+	durationHistogram *prometheus.HistogramVec
+	failureCounter    *prometheus.CounterVec
+
+	// now is used to measure the duration of requests, and can be
+	// overwritten in tests.
+	now func() time.Time
+}
+
+// NewTokenMetrics returns a new TokenMetrics.
+func NewTokenMetrics() *TokenMetrics {
+	return &TokenMetrics{
+		durationHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sops_azkv_token_duration_seconds",
+			Help:    "The duration in seconds of Azure AAD access token requests, partitioned by credential kind and tenant.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"kind", "tenant"}),
+		failureCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sops_azkv_token_failures_total",
+			Help: "The number of failed Azure AAD access token requests, partitioned by credential kind and tenant.",
+		}, []string{"kind", "tenant"}),
+		now: time.Now,
+	}
+}
+
+// MustRegister registers the metrics with the given prometheus.Registerer.
+// It panics if any of the metrics can not be registered.
+func (m *TokenMetrics) MustRegister(r prometheus.Registerer) {
+	r.MustRegister(m.durationHistogram, m.failureCounter)
+}
+
+// Instrument returns a copy of the given TokenCredential of which each
+// GetToken call is recorded in the metrics. It returns the TokenCredential
+// as is if m is nil.
+func (m *TokenMetrics) Instrument(token *TokenCredential) *TokenCredential {
+	if m == nil || token == nil {
+		return token
+	}
+	instrumented := *token
+	instrumented.TokenCredential = &instrumentedCredential{
+		credential: token.TokenCredential,
+		metrics:    m,
+		kind:       string(token.Kind),
+		tenant:     token.TenantID,
+	}
+	return &instrumented
+}
+
+// instrumentedCredential is an azcore.TokenCredential which records the
+// duration and failures of the GetToken calls of the wrapped credential.
+type instrumentedCredential struct {
+	credential azcore.TokenCredential
+	metrics    *TokenMetrics
+	kind       string
+	tenant     string
+}
+
+// GetToken requests an access token from the wrapped credential, and
+// records the duration of the request and its failure, if any.
+func (c *instrumentedCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	start := c.metrics.now()
+	token, err := c.credential.GetToken(ctx, options)
+	c.metrics.durationHistogram.WithLabelValues(c.kind, c.tenant).Observe(c.metrics.now().Sub(start).Seconds())
+	if err != nil {
+		c.metrics.failureCounter.WithLabelValues(c.kind, c.tenant).Inc()
+	}
+	return token, err
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azkv
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// stubTokenCredential is an azcore.TokenCredential returning err, or a
+// static token if nil, and counting its calls.
+type stubTokenCredential struct {
+	err   error
+	calls int
+}
+
+func (c *stubTokenCredential) GetToken(_ context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.calls++
+	if c.err != nil {
+		return azcore.AccessToken{}, c.err
+	}
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func TestTokenMetrics_Instrument(t *testing.T) {
+	g := NewWithT(t)
+
+	m := NewTokenMetrics()
+	var ticks int
+	m.now = func() time.Time {
+		ticks++
+		return time.Unix(0, 0).Add(time.Duration(ticks) * 250 * time.Millisecond)
+	}
+
+	succeeding := &stubTokenCredential{}
+	failing := &stubTokenCredential{err: errors.New("AADSTS700016: application not found")}
+
+	ok := m.Instrument(&TokenCredential{
+		TokenCredential: succeeding,
+		Kind:            CredentialKindClientSecret,
+		TenantID:        "some-tenant-id",
+		ClientID:        "some-client-id",
+	})
+	g.Expect(ok.Kind).To(Equal(CredentialKindClientSecret))
+	g.Expect(ok.String()).To(Equal("azure client-secret credential for tenant some-tenant-id, client some-client-id"))
+
+	token, err := ok.GetToken(context.TODO(), policy.TokenRequestOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token.Token).To(Equal("token"))
+	_, err = ok.GetToken(context.TODO(), policy.TokenRequestOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(succeeding.calls).To(Equal(2))
+
+	failed := m.Instrument(&TokenCredential{
+		TokenCredential: failing,
+		Kind:            CredentialKindWorkloadIdentity,
+		TenantID:        "other-tenant-id",
+	})
+	_, err = failed.GetToken(context.TODO(), policy.TokenRequestOptions{})
+	g.Expect(err).To(MatchError(failing.err))
+	g.Expect(failing.calls).To(Equal(1))
+
+	g.Expect(testutil.CollectAndCount(m.durationHistogram)).To(Equal(2))
+	g.Expect(testutil.ToFloat64(m.failureCounter.WithLabelValues("client-secret", "some-tenant-id"))).To(BeZero())
+	g.Expect(testutil.ToFloat64(m.failureCounter.WithLabelValues("workload-identity", "other-tenant-id"))).To(Equal(float64(1)))
+
+	g.Expect(testutil.CollectAndCompare(m.durationHistogram, strings.NewReader(`
+# HELP sops_azkv_token_duration_seconds The duration in seconds of Azure AAD access token requests, partitioned by credential kind and tenant.
+# TYPE sops_azkv_token_duration_seconds histogram
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="0.01"} 0
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="0.02"} 0
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="0.04"} 0
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="0.08"} 0
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="0.16"} 0
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="0.32"} 2
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="0.64"} 2
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="1.28"} 2
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="2.56"} 2
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="5.12"} 2
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="10.24"} 2
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="20.48"} 2
+sops_azkv_token_duration_seconds_bucket{kind="client-secret",tenant="some-tenant-id",le="+Inf"} 2
+sops_azkv_token_duration_seconds_sum{kind="client-secret",tenant="some-tenant-id"} 0.5
+sops_azkv_token_duration_seconds_count{kind="client-secret",tenant="some-tenant-id"} 2
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="0.01"} 0
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="0.02"} 0
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="0.04"} 0
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="0.08"} 0
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="0.16"} 0
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="0.32"} 1
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="0.64"} 1
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="1.28"} 1
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="2.56"} 1
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="5.12"} 1
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="10.24"} 1
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="20.48"} 1
+sops_azkv_token_duration_seconds_bucket{kind="workload-identity",tenant="other-tenant-id",le="+Inf"} 1
+sops_azkv_token_duration_seconds_sum{kind="workload-identity",tenant="other-tenant-id"} 0.25
+sops_azkv_token_duration_seconds_count{kind="workload-identity",tenant="other-tenant-id"} 1
+`))).To(Succeed())
+}
+
+func TestTokenMetrics_Instrument_Nil(t *testing.T) {
+	g := NewWithT(t)
+
+	token := &TokenCredential{
+		TokenCredential: &stubTokenCredential{},
+		Kind:            CredentialKindManagedIdentity,
+	}
+
+	var m *TokenMetrics
+	g.Expect(m.Instrument(token)).To(BeIdenticalTo(token))
+	g.Expect(NewTokenMetrics().Instrument(nil)).To(BeNil())
+}
+
+func TestTokenMetrics_MustRegister(t *testing.T) {
+	g := NewWithT(t)
+
+	m := NewTokenMetrics()
+	reg := prometheus.NewRegistry()
+	g.Expect(func() { m.MustRegister(reg) }).ToNot(Panic())
+
+	token := m.Instrument(&TokenCredential{
+		TokenCredential: &stubTokenCredential{err: errors.New("failure")},
+		Kind:            CredentialKindManagedIdentity,
+	})
+	_, err := token.GetToken(context.TODO(), policy.TokenRequestOptions{})
+	g.Expect(err).To(HaveOccurred())
+
+	count, err := testutil.GatherAndCount(reg, "sops_azkv_token_duration_seconds", "sops_azkv_token_failures_total")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(count).To(Equal(2))
+}
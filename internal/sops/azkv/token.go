@@ -0,0 +1,113 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azkv
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// CredentialKind is the kind of Azure credential constructed from an
+// AADConfig.
+type CredentialKind string
+
+const (
+	// CredentialKindClientSecret is the kind of a service principal
+	// credential with a client secret.
+	CredentialKindClientSecret CredentialKind = "client-secret"
+	// CredentialKindClientCertificate is the kind of a service principal
+	// credential with a client certificate.
+	CredentialKindClientCertificate CredentialKind = "client-certificate"
+	// CredentialKindManagedIdentity is the kind of a managed identity
+	// credential.
+	CredentialKindManagedIdentity CredentialKind = "managed-identity"
+	// CredentialKindWorkloadIdentity is the kind of a workload identity
+	// credential.
+	CredentialKindWorkloadIdentity CredentialKind = "workload-identity"
+	// CredentialKindClientAssertion is the kind of a client assertion
+	// credential with a federated token file.
+	CredentialKindClientAssertion CredentialKind = "client-assertion"
+	// CredentialKindChain is the kind of a chain of credentials.
+	CredentialKindChain CredentialKind = "credential-chain"
+)
+
+// TokenCredential is an azcore.TokenCredential tagged with the kind of
+// credential and the (non-secret) identifiers it was constructed with, to
+// describe it in error messages.
+type TokenCredential struct {
+	azcore.TokenCredential
+
+	// Kind is the kind of the credential.
+	Kind CredentialKind
+	// TenantID is the tenant ID of the credential, if any.
+	TenantID string
+	// ClientID is the client ID of the credential, if any. For a managed
+	// identity, an empty client and resource ID refer to the system-assigned
+	// identity.
+	ClientID string
+	// ResourceID is the resource ID of a managed identity credential, if any.
+	ResourceID string
+	// Sources are the credentials of a CredentialKindChain.
+	Sources []*TokenCredential
+}
+
+// String returns a description of the credential, for example
+// "azure client-secret credential for tenant X, client Y". It never contains
+// secrets.
+func (t *TokenCredential) String() string {
+	if t.Kind == CredentialKindChain {
+		sources := make([]string, 0, len(t.Sources))
+		for _, s := range t.Sources {
+			sources = append(sources, s.String())
+		}
+		return fmt.Sprintf("azure %s of [%s]", t.Kind, strings.Join(sources, "; "))
+	}
+
+	var ids []string
+	if t.TenantID != "" {
+		ids = append(ids, "tenant "+t.TenantID)
+	}
+	if t.ClientID != "" {
+		ids = append(ids, "client "+t.ClientID)
+	}
+	if t.ResourceID != "" {
+		ids = append(ids, "resource "+t.ResourceID)
+	}
+	if len(ids) == 0 {
+		if t.Kind == CredentialKindManagedIdentity {
+			return fmt.Sprintf("azure %s credential for the system-assigned identity", t.Kind)
+		}
+		return fmt.Sprintf("azure %s credential", t.Kind)
+	}
+	return fmt.Sprintf("azure %s credential for %s", t.Kind, strings.Join(ids, ", "))
+}
+
+// newTokenCredential returns a TokenCredential tagging the given credential,
+// or the error if not nil.
+func newTokenCredential(kind CredentialKind, tenantID, clientID string, credential azcore.TokenCredential, err error) (*TokenCredential, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &TokenCredential{
+		TokenCredential: credential,
+		Kind:            kind,
+		TenantID:        tenantID,
+		ClientID:        clientID,
+	}, nil
+}
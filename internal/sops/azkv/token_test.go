@@ -0,0 +1,145 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azkv
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestTokenCredential_String(t *testing.T) {
+	tlsMock := validTLS(t)
+
+	tests := []struct {
+		name   string
+		config AADConfig
+		env    map[string]string
+		want   string
+	}{
+		{
+			name: "Service Principal with Secret",
+			config: AADConfig{
+				TenantID:     "some-tenant-id",
+				ClientID:     "some-client-id",
+				ClientSecret: "some-client-secret",
+			},
+			want: "azure client-secret credential for tenant some-tenant-id, client some-client-id",
+		},
+		{
+			name: "Service Principal with Certificate",
+			config: AADConfig{
+				TenantID:          "some-tenant-id",
+				ClientID:          "some-client-id",
+				ClientCertificate: string(tlsMock),
+			},
+			want: "azure client-certificate credential for tenant some-tenant-id, client some-client-id",
+		},
+		{
+			name: "Service Principal with az CLI format",
+			config: AADConfig{
+				AZConfig: AZConfig{
+					AppID:    "some-app-id",
+					Tenant:   "some-tenant",
+					Password: "some-password",
+				},
+			},
+			want: "azure client-secret credential for tenant some-tenant, client some-app-id",
+		},
+		{
+			name: "Service Principal with AKS azure.json format",
+			config: AADConfig{
+				TenantID: "some-tenant-id",
+				AKSConfig: AKSConfig{
+					AADClientID:     "some-client-id",
+					AADClientSecret: "some-client-secret",
+				},
+			},
+			want: "azure client-secret credential for tenant some-tenant-id, client some-client-id",
+		},
+		{
+			name: "Managed Identity with Client ID",
+			config: AADConfig{
+				ClientID: "some-client-id",
+			},
+			want: "azure managed-identity credential for client some-client-id",
+		},
+		{
+			name: "Managed Identity with Resource ID",
+			config: AADConfig{
+				ResourceID: "/subscriptions/some-subscription-id/resourceGroups/some-resource-group/providers/Microsoft.ManagedIdentity/userAssignedIdentities/some-identity",
+			},
+			want: "azure managed-identity credential for resource /subscriptions/some-subscription-id/resourceGroups/some-resource-group/providers/Microsoft.ManagedIdentity/userAssignedIdentities/some-identity",
+		},
+		{
+			name: "system-assigned Managed Identity",
+			config: AADConfig{
+				AKSConfig: AKSConfig{
+					UseManagedIdentityExtension: true,
+				},
+			},
+			want: "azure managed-identity credential for the system-assigned identity",
+		},
+		{
+			name: "Workload Identity",
+			config: AADConfig{
+				ClientID: "some-client-id",
+			},
+			env: map[string]string{
+				azureFederatedTokenFileEnv: "/var/run/secrets/azure/tokens/azure-identity-token",
+				azureTenantIDEnv:           "some-tenant-id",
+			},
+			want: "azure workload-identity credential for tenant some-tenant-id, client some-client-id",
+		},
+		{
+			name: "Client assertion with federated token file",
+			config: AADConfig{
+				TenantID:           "some-tenant-id",
+				ClientID:           "some-client-id",
+				FederatedTokenFile: "/var/run/secrets/azure/tokens/azure-identity-token",
+			},
+			want: "azure client-assertion credential for tenant some-tenant-id, client some-client-id",
+		},
+		{
+			name: "Credential chain",
+			config: AADConfig{
+				TenantID:        "some-tenant-id",
+				ClientID:        "some-client-id",
+				ClientSecret:    "some-client-secret",
+				CredentialChain: true,
+			},
+			want: "azure credential-chain of [azure managed-identity credential for the system-assigned identity; " +
+				"azure client-secret credential for tenant some-tenant-id, client some-client-id]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			for _, k := range []string{azureFederatedTokenFileEnv, azureClientIDEnv, azureTenantIDEnv} {
+				t.Setenv(k, tt.env[k])
+			}
+
+			got, err := TokenCredentialFromAADConfig(tt.config)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got.String()).To(Equal(tt.want))
+			g.Expect(got.String()).ToNot(ContainSubstring("some-client-secret"))
+			g.Expect(got.String()).ToNot(ContainSubstring("some-password"))
+			g.Expect(got.String()).ToNot(ContainSubstring("PRIVATE KEY"))
+		})
+	}
+}
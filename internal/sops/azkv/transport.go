@@ -0,0 +1,85 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azkv
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// proxyTransport is a policy.Transporter which sends requests through an
+// HTTP(S) proxy, and includes the URL of the proxy in connection errors.
+type proxyTransport struct {
+	client *http.Client
+	proxy  func(*http.Request) (*url.URL, error)
+}
+
+// NewTransport returns a policy.Transporter for the Azure clients which sends
+// requests through the given proxy URL. When proxyURL is empty, the proxy
+// is determined by the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment
+// variables.
+// It returns an error if the proxy URL can not be parsed.
+func NewTransport(proxyURL string) (policy.Transporter, error) {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := parseProxyURL(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	return &proxyTransport{
+		client: &http.Client{Transport: transport},
+		proxy:  proxy,
+	}, nil
+}
+
+// Do sends the request, and wraps any error with the URL of the proxy used
+// for the request.
+func (t *proxyTransport) Do(req *http.Request) (*http.Response, error) {
+	resp, err := t.client.Do(req)
+	if err != nil {
+		if u, pErr := t.proxy(req); pErr == nil && u != nil {
+			return nil, fmt.Errorf("failed to send request through proxy '%s': %w", u.Redacted(), err)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// parseProxyURL parses the given proxy URL, and returns an error if it does
+// not have an HTTP(S) scheme or a host.
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL '%s': must be an absolute http or https URL", u.Redacted())
+	}
+	return u, nil
+}
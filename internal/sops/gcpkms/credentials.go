@@ -0,0 +1,183 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcpkms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/auth"
+	"cloud.google.com/go/auth/credentials"
+	"github.com/getsops/sops/v3/gcpkms"
+)
+
+// Scope is the OAuth2 scope of the credentials for GCP KMS requests.
+const Scope = "https://www.googleapis.com/auth/cloudkms"
+
+// supportedCredentialsTypes are the types of GCP credentials JSON accepted
+// for KMS requests.
+var supportedCredentialsTypes = []string{
+	"service_account",
+	"authorized_user",
+	"external_account",
+	"impersonated_service_account",
+}
+
+// credentialsFile holds the fields of a GCP credentials JSON which are
+// validated before the credentials are loaded.
+type credentialsFile struct {
+	Type             string `json:"type"`
+	ProjectID        string `json:"project_id"`
+	CredentialSource *struct {
+		File string `json:"file"`
+	} `json:"credential_source"`
+	SourceCredentials *credentialsFile `json:"source_credentials"`
+}
+
+// validate checks the type of the credentials is supported, and that the
+// token file of external_account credentials can be read, as the latter
+// would otherwise only surface at the time of the first KMS request.
+func (f *credentialsFile) validate() error {
+	switch f.Type {
+	case "":
+		return errors.New("GCP credentials JSON does not contain a 'type'")
+	case "service_account":
+		if f.ProjectID == "" {
+			return errors.New("GCP service_account credentials JSON does not contain a 'project_id'")
+		}
+	case "external_account":
+		if f.CredentialSource != nil && f.CredentialSource.File != "" {
+			file, err := os.Open(f.CredentialSource.File)
+			if err != nil {
+				return fmt.Errorf("failed to read token file of GCP external_account credentials: %w", err)
+			}
+			_ = file.Close()
+		}
+	case "impersonated_service_account":
+		if f.SourceCredentials == nil {
+			return errors.New("GCP impersonated_service_account credentials do not contain 'source_credentials'")
+		}
+		if err := f.SourceCredentials.validate(); err != nil {
+			return fmt.Errorf("invalid 'source_credentials': %w", err)
+		}
+	default:
+		for _, t := range supportedCredentialsTypes {
+			if f.Type == t {
+				return nil
+			}
+		}
+		return fmt.Errorf("unsupported GCP credentials type '%s', must be one of: %s",
+			f.Type, strings.Join(supportedCredentialsTypes, ", "))
+	}
+	return nil
+}
+
+// LoadCredentialsJSON returns the GCP credentials JSON from the given bytes,
+// as commonly found in a Secret: with surrounding whitespace, or with an
+// extra layer of base64 encoding. It validates the structure of the JSON, and
+// returns an error pointing at the problem if it is invalid.
+func LoadCredentialsJSON(b []byte) ([]byte, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, errors.New("GCP credentials JSON is empty")
+	}
+	if b[0] != '{' {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(b), nil)))
+		if err != nil {
+			return nil, fmt.Errorf("GCP credentials are neither a JSON object nor base64-encoded JSON: %w", err)
+		}
+		if b = bytes.TrimSpace(decoded); len(b) == 0 || b[0] != '{' {
+			return nil, errors.New("base64-decoded GCP credentials are not a JSON object")
+		}
+	}
+	var f credentialsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse GCP credentials JSON: %w", err)
+	}
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// detectDefault detects the credentials for the given options, and can be
+// overwritten in tests.
+var detectDefault = credentials.DetectDefault
+
+// CredentialsFromJSON returns the credentials for GCP KMS requests from the
+// given JSON. This can be a service account key, user credentials,
+// external_account credentials for Workload Identity Federation, or
+// impersonated_service_account credentials.
+// The JSON is loaded with LoadCredentialsJSON.
+// It returns an error if the JSON can not be parsed, is of an unsupported
+// type, or is incomplete.
+func CredentialsFromJSON(b []byte) (*auth.Credentials, error) {
+	return credentialsFromJSON(b, Scope)
+}
+
+// credentialsFromJSON returns the credentials with the given scope from the
+// given JSON, see CredentialsFromJSON.
+func credentialsFromJSON(b []byte, scope string) (*auth.Credentials, error) {
+	b, err := LoadCredentialsJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := credentials.DetectDefault(&credentials.DetectOptions{
+		Scopes:          []string{scope},
+		CredentialsJSON: b,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse GCP credentials JSON: %w", err)
+	}
+	return creds, nil
+}
+
+// DefaultCredentials returns the ambient credentials of the controller for
+// GCP KMS requests. For compatibility with SOPS, these are the credentials in
+// the gcpkms.SopsGoogleCredentialsEnv environment variable (either a path to
+// a file or the JSON itself) when set, or else the Application Default
+// Credentials: the GOOGLE_APPLICATION_CREDENTIALS file, the gcloud
+// configuration, or the metadata server (e.g. GKE Workload Identity).
+func DefaultCredentials() (*auth.Credentials, error) {
+	return defaultCredentials(Scope)
+}
+
+// defaultCredentials returns the ambient credentials with the given scope,
+// see DefaultCredentials.
+func defaultCredentials(scope string) (*auth.Credentials, error) {
+	if v, ok := os.LookupEnv(gcpkms.SopsGoogleCredentialsEnv); ok && v != "" {
+		b := []byte(v)
+		if _, err := os.Stat(v); err == nil {
+			if b, err = os.ReadFile(v); err != nil {
+				return nil, fmt.Errorf("failed to read %s file: %w", gcpkms.SopsGoogleCredentialsEnv, err)
+			}
+		}
+		return credentialsFromJSON(b, scope)
+	}
+	creds, err := detectDefault(&credentials.DetectOptions{
+		Scopes: []string{scope},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find GCP Application Default Credentials: %w", err)
+	}
+	return creds, nil
+}
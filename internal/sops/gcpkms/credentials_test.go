@@ -0,0 +1,288 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcpkms
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/auth"
+	"github.com/getsops/sops/v3/gcpkms"
+	. "github.com/onsi/gomega"
+)
+
+const testAuthorizedUserJSON = `{
+  "type": "authorized_user",
+  "client_id": "some-client-id",
+  "client_secret": "some-client-secret",
+  "refresh_token": "some-refresh-token"
+}`
+
+func TestLoadCredentialsJSON(t *testing.T) {
+	serviceAccountJSON := `{
+  "type": "service_account",
+  "project_id": "test-flux",
+  "private_key_id": "some-private-key-id",
+  "client_email": "flux@test-flux.iam.gserviceaccount.com"
+}`
+	encoded := base64.StdEncoding.EncodeToString([]byte(serviceAccountJSON))
+
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "raw JSON",
+			data: serviceAccountJSON,
+			want: serviceAccountJSON,
+		},
+		{
+			name: "whitespace-padded JSON",
+			data: "\n  " + serviceAccountJSON + "\r\n\n",
+			want: serviceAccountJSON,
+		},
+		{
+			name: "base64-encoded JSON",
+			data: encoded,
+			want: serviceAccountJSON,
+		},
+		{
+			name: "whitespace-padded and wrapped base64-encoded JSON",
+			data: "\n" + encoded[:40] + "\n" + encoded[40:] + "\n",
+			want: serviceAccountJSON,
+		},
+		{
+			name:    "empty",
+			data:    " \n",
+			wantErr: "GCP credentials JSON is empty",
+		},
+		{
+			name:    "invalid base64",
+			data:    "not-base64!",
+			wantErr: "GCP credentials are neither a JSON object nor base64-encoded JSON",
+		},
+		{
+			name:    "base64-encoded non-JSON",
+			data:    base64.StdEncoding.EncodeToString([]byte("type: service_account")),
+			wantErr: "base64-decoded GCP credentials are not a JSON object",
+		},
+		{
+			name:    "invalid JSON",
+			data:    `{"type": "service_account",}`,
+			wantErr: "failed to parse GCP credentials JSON: invalid character '}'",
+		},
+		{
+			name:    "missing type",
+			data:    `{"project_id": "test-flux"}`,
+			wantErr: "GCP credentials JSON does not contain a 'type'",
+		},
+		{
+			name:    "service_account without project_id",
+			data:    base64.StdEncoding.EncodeToString([]byte(`{"type": "service_account"}`)),
+			wantErr: "GCP service_account credentials JSON does not contain a 'project_id'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := LoadCredentialsJSON([]byte(tt.data))
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(string(got)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestCredentialsFromJSON(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("subject-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	externalAccountJSON := func(file string) string {
+		return fmt.Sprintf(`{
+  "type": "external_account",
+  "audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+  "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+  "token_url": "https://sts.googleapis.com/v1/token",
+  "credential_source": {
+    "file": %q
+  }
+}`, file)
+	}
+
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{
+			name: "authorized_user",
+			json: testAuthorizedUserJSON,
+		},
+		{
+			name: "external_account with token file",
+			json: externalAccountJSON(tokenFile),
+		},
+		{
+			name: "external_account with token URL",
+			json: `{
+  "type": "external_account",
+  "audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+  "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+  "token_url": "https://sts.googleapis.com/v1/token",
+  "credential_source": {
+    "url": "http://169.254.169.254/token"
+  }
+}`,
+		},
+		{
+			name:    "external_account with missing token file",
+			json:    externalAccountJSON(filepath.Join(t.TempDir(), "missing")),
+			wantErr: "failed to read token file of GCP external_account credentials",
+		},
+		{
+			name: "impersonated_service_account",
+			json: `{
+  "type": "impersonated_service_account",
+  "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/sops@test-flux.iam.gserviceaccount.com:generateAccessToken",
+  "source_credentials": ` + testAuthorizedUserJSON + `
+}`,
+		},
+		{
+			name: "impersonated_service_account with external_account source",
+			json: `{
+  "type": "impersonated_service_account",
+  "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/sops@test-flux.iam.gserviceaccount.com:generateAccessToken",
+  "source_credentials": ` + externalAccountJSON(filepath.Join(t.TempDir(), "missing")) + `
+}`,
+			wantErr: "invalid 'source_credentials': failed to read token file of GCP external_account credentials",
+		},
+		{
+			name: "impersonated_service_account without source credentials",
+			json: `{
+  "type": "impersonated_service_account",
+  "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/sops@test-flux.iam.gserviceaccount.com:generateAccessToken"
+}`,
+			wantErr: "GCP impersonated_service_account credentials do not contain 'source_credentials'",
+		},
+		{
+			name:    "unsupported type",
+			json:    `{"type": "gdch_service_account"}`,
+			wantErr: "unsupported GCP credentials type 'gdch_service_account', must be one of: service_account, authorized_user, external_account, impersonated_service_account",
+		},
+		{
+			name:    "missing type",
+			json:    `{"client_id": "some-client-id"}`,
+			wantErr: "GCP credentials JSON does not contain a 'type'",
+		},
+		{
+			name:    "invalid JSON",
+			json:    "{invalid",
+			wantErr: "failed to parse GCP credentials JSON",
+		},
+		{
+			name:    "incomplete authorized_user",
+			json:    `{"type": "authorized_user", "client_id": "some-client-id"}`,
+			wantErr: "client secret must be provided",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			creds, err := CredentialsFromJSON([]byte(tt.json))
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(creds.JSON()).To(Equal([]byte(tt.json)))
+		})
+	}
+}
+
+func TestDefaultCredentials(t *testing.T) {
+	credsFile := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(credsFile, []byte(testAuthorizedUserJSON), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ambient := newFakeCredentials("ambient-token")
+
+	tests := []struct {
+		name       string
+		env        string
+		defaultErr error
+		want       *auth.Credentials
+		wantJSON   bool
+		wantErr    string
+	}{
+		{
+			name: "application default credentials",
+			want: ambient,
+		},
+		{
+			name:       "no application default credentials",
+			defaultErr: errors.New("could not find default credentials"),
+			wantErr:    "failed to find GCP Application Default Credentials: could not find default credentials",
+		},
+		{
+			name:     "SOPS environment variable with JSON",
+			env:      testAuthorizedUserJSON,
+			wantJSON: true,
+		},
+		{
+			name:     "SOPS environment variable with file",
+			env:      credsFile,
+			wantJSON: true,
+		},
+		{
+			name:    "SOPS environment variable with invalid JSON",
+			env:     "{",
+			wantErr: "failed to parse GCP credentials JSON",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			t.Setenv(gcpkms.SopsGoogleCredentialsEnv, tt.env)
+			stubDefaultCredentials(t, ambient, tt.defaultErr)
+
+			got, err := DefaultCredentials()
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			if tt.wantJSON {
+				g.Expect(got.JSON()).To(Equal([]byte(testAuthorizedUserJSON)))
+				return
+			}
+			g.Expect(got).To(BeIdenticalTo(tt.want))
+		})
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcpkms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/auth"
+	"cloud.google.com/go/auth/credentials/impersonate"
+	"cloud.google.com/go/auth/httptransport"
+)
+
+// impersonationScope is the OAuth2 scope of the credentials used to
+// impersonate service accounts with the IAM Credentials API.
+const impersonationScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// ParseImpersonationChain parses the given comma-separated list of service
+// account emails, ending with the service account to impersonate, and
+// optionally preceded by the delegates to impersonate it through.
+// It returns nil if the list is empty, or an error if any of the service
+// accounts is not an email address.
+func ParseImpersonationChain(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var chain []string
+	for _, sa := range strings.Split(s, ",") {
+		sa = strings.TrimSpace(sa)
+		if sa == "" {
+			return nil, errors.New("service account can not be empty")
+		}
+		if i := strings.Index(sa, "@"); i <= 0 || i == len(sa)-1 {
+			return nil, fmt.Errorf("invalid service account '%s': must be an email address", sa)
+		}
+		chain = append(chain, sa)
+	}
+	return chain, nil
+}
+
+// impersonateCredentials returns credentials for the last service account of
+// the ImpersonationChain of the given options, impersonated through the
+// preceding delegates with the given base credentials.
+func impersonateCredentials(base *auth.Credentials, opts ClientOptions) (*auth.Credentials, error) {
+	chain := opts.ImpersonationChain
+	p := &impersonatedTokenProvider{
+		target:    chain[len(chain)-1],
+		delegates: chain[:len(chain)-1],
+		base:      describeCredentials(base),
+	}
+
+	client, err := httptransport.NewClient(&httptransport.Options{
+		Credentials:      base,
+		BaseRoundTripper: opts.iamTransport,
+		InternalOptions: &httptransport.InternalOptions{
+			SkipUniverseDomainValidation: true,
+		},
+	})
+	if err != nil {
+		return nil, p.wrapError(err)
+	}
+	if p.creds, err = impersonate.NewCredentials(&impersonate.CredentialsOptions{
+		TargetPrincipal: p.target,
+		Delegates:       p.delegates,
+		Scopes:          []string{Scope},
+		Client:          client,
+	}); err != nil {
+		return nil, p.wrapError(err)
+	}
+	return auth.NewCredentials(&auth.CredentialsOptions{TokenProvider: p}), nil
+}
+
+// impersonatedTokenProvider is an auth.TokenProvider returning the tokens of
+// impersonated credentials, naming the impersonated and base identities in
+// any errors.
+type impersonatedTokenProvider struct {
+	creds     *auth.Credentials
+	target    string
+	delegates []string
+	base      string
+}
+
+// Token returns a token of the impersonated service account.
+func (p *impersonatedTokenProvider) Token(ctx context.Context) (*auth.Token, error) {
+	t, err := p.creds.Token(ctx)
+	if err != nil {
+		return nil, p.wrapError(err)
+	}
+	return t, nil
+}
+
+func (p *impersonatedTokenProvider) wrapError(err error) error {
+	if len(p.delegates) > 0 {
+		return fmt.Errorf("failed to impersonate GCP service account '%s' through delegates '%s' with %s: %w",
+			p.target, strings.Join(p.delegates, "', '"), p.base, err)
+	}
+	return fmt.Errorf("failed to impersonate GCP service account '%s' with %s: %w", p.target, p.base, err)
+}
+
+// describeCredentials returns a description of the identity of the given
+// credentials for use in error messages, based on their JSON.
+func describeCredentials(creds *auth.Credentials) string {
+	var f struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+	}
+	if b := creds.JSON(); len(b) > 0 && json.Unmarshal(b, &f) == nil {
+		switch {
+		case f.ClientEmail != "":
+			return fmt.Sprintf("service account '%s'", f.ClientEmail)
+		case f.Type != "":
+			return fmt.Sprintf("'%s' credentials", f.Type)
+		}
+	}
+	return "ambient credentials"
+}
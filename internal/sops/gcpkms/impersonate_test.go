@@ -0,0 +1,244 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcpkms
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/auth"
+	"github.com/getsops/sops/v3/gcpkms"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	testBaseServiceAccount      = "flux@test-flux.iam.gserviceaccount.com"
+	testDelegateServiceAccount  = "delegate@test-flux.iam.gserviceaccount.com"
+	testDecrypterServiceAccount = "decrypter@test-flux.iam.gserviceaccount.com"
+)
+
+func TestDecrypt_Impersonation(t *testing.T) {
+	tests := []struct {
+		name          string
+		chain         []string
+		wantPath      string
+		wantDelegates []string
+	}{
+		{
+			name:     "service account",
+			chain:    []string{testDecrypterServiceAccount},
+			wantPath: "/v1/projects/-/serviceAccounts/" + testDecrypterServiceAccount + ":generateAccessToken",
+		},
+		{
+			name:          "service account through delegates",
+			chain:         []string{testDelegateServiceAccount, testDecrypterServiceAccount},
+			wantPath:      "/v1/projects/-/serviceAccounts/" + testDecrypterServiceAccount + ":generateAccessToken",
+			wantDelegates: []string{"projects/-/serviceAccounts/" + testDelegateServiceAccount},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			fake, opts := startFakeKMS(t)
+			iam := startFakeIAM(t, http.StatusOK)
+			opts.Credentials = newFakeServiceAccountCredentials("base-token")
+			opts.ImpersonationChain = tt.chain
+			opts.iamTransport = iam.transport()
+
+			key := gcpkms.NewMasterKeyFromResourceID(testResourceID)
+			key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+
+			got, err := Decrypt(context.TODO(), key, opts)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal([]byte("data-key")))
+			g.Expect(fake.authorizations()).To(Equal([]string{"Bearer impersonated-token"}))
+
+			reqs := iam.requests()
+			g.Expect(reqs).To(HaveLen(1))
+			g.Expect(reqs[0].path).To(Equal(tt.wantPath))
+			g.Expect(reqs[0].authorization).To(Equal("Bearer base-token"))
+			g.Expect(reqs[0].body.Delegates).To(Equal(tt.wantDelegates))
+			g.Expect(reqs[0].body.Scope).To(Equal([]string{Scope}))
+		})
+	}
+}
+
+func TestDecrypt_ImpersonationError(t *testing.T) {
+	g := NewWithT(t)
+
+	_, opts := startFakeKMS(t)
+	iam := startFakeIAM(t, http.StatusForbidden)
+	opts.Credentials = newFakeServiceAccountCredentials("base-token")
+	opts.ImpersonationChain = []string{testDelegateServiceAccount, testDecrypterServiceAccount}
+	opts.iamTransport = iam.transport()
+
+	key := gcpkms.NewMasterKeyFromResourceID(testResourceID)
+	key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := Decrypt(ctx, key, opts)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to impersonate GCP service account '" + testDecrypterServiceAccount +
+		"' through delegates '" + testDelegateServiceAccount + "' with service account '" + testBaseServiceAccount + "'"))
+	g.Expect(err.Error()).To(ContainSubstring("status code 403"))
+}
+
+func TestParseImpersonationChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "service account",
+			s:    testDecrypterServiceAccount,
+			want: []string{testDecrypterServiceAccount},
+		},
+		{
+			name: "service account with delegates",
+			s:    testDelegateServiceAccount + ", " + testDecrypterServiceAccount + "\n",
+			want: []string{testDelegateServiceAccount, testDecrypterServiceAccount},
+		},
+		{
+			name:    "empty service account",
+			s:       testDelegateServiceAccount + ",," + testDecrypterServiceAccount,
+			wantErr: "service account can not be empty",
+		},
+		{
+			name:    "invalid service account",
+			s:       "decrypter",
+			wantErr: "invalid service account 'decrypter': must be an email address",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := ParseImpersonationChain(tt.s)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(tt.wantErr))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func Test_describeCredentials(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(describeCredentials(newFakeServiceAccountCredentials("token"))).To(Equal("service account '" + testBaseServiceAccount + "'"))
+	g.Expect(describeCredentials(auth.NewCredentials(&auth.CredentialsOptions{
+		TokenProvider: &fakeTokenProvider{token: "token"},
+		JSON:          []byte(testAuthorizedUserJSON),
+	}))).To(Equal("'authorized_user' credentials"))
+	g.Expect(describeCredentials(newFakeCredentials("token"))).To(Equal("ambient credentials"))
+}
+
+// newFakeServiceAccountCredentials returns credentials with a
+// fakeTokenProvider of the given token, and the JSON of the
+// testBaseServiceAccount.
+func newFakeServiceAccountCredentials(token string) *auth.Credentials {
+	return auth.NewCredentials(&auth.CredentialsOptions{
+		TokenProvider: &fakeTokenProvider{token: token},
+		JSON:          []byte(`{"type": "service_account", "client_email": "` + testBaseServiceAccount + `"}`),
+	})
+}
+
+// fakeIAM is an HTTP server mimicking the generateAccessToken API of the IAM
+// Credentials API, recording the requests.
+type fakeIAM struct {
+	server *httptest.Server
+	status int
+
+	mu   sync.Mutex
+	reqs []iamRequest
+}
+
+// iamRequest is a generateAccessToken request recorded by fakeIAM.
+type iamRequest struct {
+	path          string
+	authorization string
+	body          struct {
+		Delegates []string `json:"delegates"`
+		Scope     []string `json:"scope"`
+	}
+}
+
+// startFakeIAM starts a fakeIAM responding with the given status code.
+func startFakeIAM(t *testing.T, status int) *fakeIAM {
+	t.Helper()
+
+	f := &fakeIAM{status: status}
+	f.server = httptest.NewServer(http.HandlerFunc(f.generateAccessToken))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeIAM) generateAccessToken(w http.ResponseWriter, r *http.Request) {
+	req := iamRequest{path: r.URL.Path, authorization: r.Header.Get("Authorization")}
+	_ = json.NewDecoder(r.Body).Decode(&req.body)
+	f.mu.Lock()
+	f.reqs = append(f.reqs, req)
+	f.mu.Unlock()
+
+	if f.status != http.StatusOK {
+		http.Error(w, `{"error": {"code": 403, "message": "Permission 'iam.serviceAccounts.getAccessToken' denied"}}`, f.status)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"accessToken": "impersonated-token",
+		"expireTime":  time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+}
+
+func (f *fakeIAM) requests() []iamRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]iamRequest(nil), f.reqs...)
+}
+
+// transport returns a transport sending all requests to the fakeIAM.
+func (f *fakeIAM) transport() http.RoundTripper {
+	u, _ := url.Parse(f.server.URL)
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = u.Scheme
+		req.URL.Host = u.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcpkms
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"cloud.google.com/go/auth"
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/getsops/sops/v3/gcpkms"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// resourceIDRegex matches the resource ID of a GCP KMS crypto key.
+	resourceIDRegex = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+)
+
+// ClientOptions configures the GCP KMS client used by Encrypt and Decrypt.
+type ClientOptions struct {
+	// CredentialsJSON is the JSON of the credentials for the requests, for
+	// example a service account key. It takes precedence over Credentials.
+	CredentialsJSON []byte
+
+	// Credentials are the credentials for the requests.
+	// When nil, and no CredentialsJSON is set, the ambient credentials of
+	// DefaultCredentials are used.
+	Credentials *auth.Credentials
+
+	// ImpersonationChain is the chain of service accounts impersonated with
+	// the credentials, ending with the service account used for the requests.
+	// Any preceding service accounts are delegates, each of which must be
+	// allowed to create tokens for the next one, see ParseImpersonationChain.
+	// When empty, the credentials are used for the requests.
+	ImpersonationChain []string
+
+	// Endpoint is the host and optional port of the GCP KMS endpoint, e.g.
+	// "cloudkms.restricted.googleapis.com:443" for the restricted VIP of
+	// Private Google Access. When empty, the default endpoint is used.
+	Endpoint string
+
+	// clientOptions are additional options for the client, allowing tests
+	// to connect to a fake server.
+	clientOptions []option.ClientOption
+
+	// iamTransport is the transport of the requests to the IAM Credentials
+	// API for the ImpersonationChain, allowing tests to connect to a fake
+	// server. When nil, the default transport is used.
+	iamTransport http.RoundTripper
+}
+
+// Encrypt takes a SOPS data key, encrypts it with the GCP KMS key using the
+// credentials of the given options, and stores the result in the
+// EncryptedKey field of the key.
+//
+// It is the counterpart of gcpkms.MasterKey.Encrypt, allowing the
+// configuration of the KMS client.
+func Encrypt(ctx context.Context, key *gcpkms.MasterKey, opts ClientOptions, dataKey []byte) error {
+	client, err := newKMSClient(ctx, key, opts)
+	if err != nil {
+		return fmt.Errorf("cannot create GCP KMS service: %w", err)
+	}
+	defer client.Close()
+
+	resp, err := client.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:      key.ResourceID,
+		Plaintext: dataKey,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encrypt sops data key with GCP KMS key: %w", withEndpointError(opts.Endpoint, err))
+	}
+	// NB: base64 encoding is for compatibility with SOPS <=3.8.x.
+	key.EncryptedKey = base64.StdEncoding.EncodeToString(resp.Ciphertext)
+	return nil
+}
+
+// Decrypt decrypts the EncryptedKey field of the GCP KMS key using the
+// credentials of the given options, and returns the result.
+//
+// It is the counterpart of gcpkms.MasterKey.Decrypt, allowing the
+// configuration of the KMS client.
+func Decrypt(ctx context.Context, key *gcpkms.MasterKey, opts ClientOptions) ([]byte, error) {
+	// NB: base64 encoding is for compatibility with SOPS <=3.8.x.
+	ciphertext, err := base64.StdEncoding.DecodeString(key.EncryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error base64-decoding encrypted data key: %w", err)
+	}
+
+	client, err := newKMSClient(ctx, key, opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create GCP KMS service: %w", err)
+	}
+	defer client.Close()
+
+	resp, err := client.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:       key.ResourceID,
+		Ciphertext: ciphertext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sops data key with GCP KMS key: %w", withEndpointError(opts.Endpoint, err))
+	}
+	return resp.Plaintext, nil
+}
+
+// newKMSClient returns a GCP KMS client with the credentials of the given
+// options, or the ambient credentials.
+// It returns an error if the ResourceID of the key is invalid, if the
+// credentials can not be loaded, or if the setup of the client fails.
+func newKMSClient(ctx context.Context, key *gcpkms.MasterKey, opts ClientOptions) (*kms.KeyManagementClient, error) {
+	if !resourceIDRegex.MatchString(key.ResourceID) {
+		return nil, fmt.Errorf("no valid resource ID found in %q", key.ResourceID)
+	}
+
+	// Impersonating service accounts requires a broader scope than the
+	// KMS requests.
+	scope := Scope
+	if len(opts.ImpersonationChain) > 0 {
+		scope = impersonationScope
+	}
+
+	var err error
+	creds := opts.Credentials
+	switch {
+	case len(opts.CredentialsJSON) > 0:
+		if creds, err = credentialsFromJSON(opts.CredentialsJSON, scope); err != nil {
+			return nil, err
+		}
+	case creds == nil:
+		if creds, err = defaultCredentials(scope); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.ImpersonationChain) > 0 {
+		if creds, err = impersonateCredentials(creds, opts); err != nil {
+			return nil, err
+		}
+	}
+	return kms.NewKeyManagementClient(ctx, newClientOptions(creds, opts)...)
+}
+
+// newClientOptions returns the options for the KMS client with the given
+// credentials, and the Endpoint of the given options if set.
+func newClientOptions(creds *auth.Credentials, opts ClientOptions) []option.ClientOption {
+	clientOpts := []option.ClientOption{option.WithAuthCredentials(creds)}
+	if opts.Endpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(opts.Endpoint))
+	}
+	return append(clientOpts, opts.clientOptions...)
+}
+
+// withEndpointError wraps the given error with the configured endpoint if it
+// is not empty, and the error indicates the endpoint could not be reached,
+// e.g. due to a DNS or TLS failure. As the client retries unavailable
+// endpoints, this includes the context being done while retrying.
+func withEndpointError(endpoint string, err error) error {
+	if endpoint == "" {
+		return err
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return fmt.Errorf("failed to reach endpoint '%s': %w", endpoint, err)
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return fmt.Errorf("failed to reach endpoint '%s': %w", endpoint, err)
+	}
+	return err
+}
+
+// ValidateEndpoint returns an error if the given endpoint is not empty, and
+// is not a host with an optional port.
+func ValidateEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse("//" + endpoint)
+	if err != nil || u.Host != endpoint || u.Hostname() == "" {
+		return fmt.Errorf("invalid endpoint '%s': must be a host with an optional port, e.g. 'cloudkms.restricted.googleapis.com:443'", endpoint)
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcpkms
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/auth"
+	gcpcredentials "cloud.google.com/go/auth/credentials"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/getsops/sops/v3/gcpkms"
+	. "github.com/onsi/gomega"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+const testResourceID = "projects/test-flux/locations/global/keyRings/test-flux/cryptoKeys/sops"
+
+func TestEncryptDecrypt(t *testing.T) {
+	g := NewWithT(t)
+
+	fake, opts := startFakeKMS(t)
+	opts.Credentials = newFakeCredentials("secret-token")
+
+	key := gcpkms.NewMasterKeyFromResourceID(testResourceID)
+	g.Expect(Encrypt(context.TODO(), key, opts, []byte("data-key"))).To(Succeed())
+	g.Expect(key.EncryptedKey).To(Equal(base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))))
+
+	got, err := Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal([]byte("data-key")))
+
+	g.Expect(fake.authorizations()).To(Equal([]string{"Bearer secret-token", "Bearer secret-token"}))
+}
+
+func TestDecrypt_DefaultCredentials(t *testing.T) {
+	g := NewWithT(t)
+
+	fake, opts := startFakeKMS(t)
+	t.Setenv(gcpkms.SopsGoogleCredentialsEnv, "")
+	stubDefaultCredentials(t, newFakeCredentials("ambient-token"), nil)
+
+	key := gcpkms.NewMasterKeyFromResourceID(testResourceID)
+	key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+
+	got, err := Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal([]byte("data-key")))
+	g.Expect(fake.authorizations()).To(Equal([]string{"Bearer ambient-token"}))
+}
+
+func TestDecrypt_Error(t *testing.T) {
+	g := NewWithT(t)
+
+	t.Setenv(gcpkms.SopsGoogleCredentialsEnv, "")
+	stubDefaultCredentials(t, nil, errors.New("could not find default credentials"))
+
+	key := gcpkms.NewMasterKeyFromResourceID(testResourceID)
+	key.EncryptedKey = "invalid base64"
+	_, err := Decrypt(context.TODO(), key, ClientOptions{})
+	g.Expect(err).To(MatchError(ContainSubstring("error base64-decoding encrypted data key")))
+
+	key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+	_, err = Decrypt(context.TODO(), key, ClientOptions{})
+	g.Expect(err).To(MatchError("cannot create GCP KMS service: failed to find GCP Application Default Credentials: could not find default credentials"))
+
+	_, err = Decrypt(context.TODO(), key, ClientOptions{
+		CredentialsJSON: []byte("{invalid"),
+		Credentials:     newFakeCredentials("secret-token"),
+	})
+	g.Expect(err).To(MatchError(ContainSubstring("cannot create GCP KMS service: failed to parse GCP credentials JSON")))
+
+	key = gcpkms.NewMasterKeyFromResourceID("invalid-resource-id")
+	key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+	_, err = Decrypt(context.TODO(), key, ClientOptions{})
+	g.Expect(err).To(MatchError(`cannot create GCP KMS service: no valid resource ID found in "invalid-resource-id"`))
+}
+
+func TestDecrypt_Endpoint(t *testing.T) {
+	g := NewWithT(t)
+
+	_, opts := startFakeKMS(t)
+	opts.Credentials = newFakeCredentials("secret-token")
+
+	// Nothing listens on this port, causing the connection to be refused.
+	opts.Endpoint = "127.0.0.1:1"
+
+	key := gcpkms.NewMasterKeyFromResourceID(testResourceID)
+	key.EncryptedKey = base64.StdEncoding.EncodeToString([]byte("encrypted-data-key"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := Decrypt(ctx, key, opts)
+	g.Expect(err).To(MatchError(ContainSubstring("failed to decrypt sops data key with GCP KMS key: failed to reach endpoint '127.0.0.1:1'")))
+}
+
+func Test_newClientOptions(t *testing.T) {
+	g := NewWithT(t)
+
+	creds := newFakeCredentials("secret-token")
+	g.Expect(newClientOptions(creds, ClientOptions{})).To(Equal([]option.ClientOption{
+		option.WithAuthCredentials(creds),
+	}))
+	g.Expect(newClientOptions(creds, ClientOptions{Endpoint: "cloudkms.restricted.googleapis.com:443"})).To(Equal([]option.ClientOption{
+		option.WithAuthCredentials(creds),
+		option.WithEndpoint("cloudkms.restricted.googleapis.com:443"),
+	}))
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		wantErr  bool
+	}{
+		{endpoint: ""},
+		{endpoint: "cloudkms.restricted.googleapis.com"},
+		{endpoint: "cloudkms.restricted.googleapis.com:443"},
+		{endpoint: "europe-west1-cloudkms.googleapis.com:443"},
+		{endpoint: "https://cloudkms.restricted.googleapis.com", wantErr: true},
+		{endpoint: "cloudkms.restricted.googleapis.com/v1", wantErr: true},
+		{endpoint: "cloudkms.restricted.googleapis.com:https", wantErr: true},
+		{endpoint: ":443", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			g := NewWithT(t)
+
+			err := ValidateEndpoint(tt.endpoint)
+			if tt.wantErr {
+				g.Expect(err).To(MatchError(ContainSubstring("invalid endpoint '" + tt.endpoint + "'")))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+		})
+	}
+}
+
+// stubDefaultCredentials replaces the detection of the Application Default
+// Credentials for the duration of the test.
+func stubDefaultCredentials(t *testing.T, creds *auth.Credentials, err error) {
+	t.Helper()
+
+	orig := detectDefault
+	detectDefault = func(opts *gcpcredentials.DetectOptions) (*auth.Credentials, error) {
+		if len(opts.CredentialsJSON) > 0 || opts.CredentialsFile != "" {
+			t.Fatal("unexpected detection of credentials from JSON")
+		}
+		return creds, err
+	}
+	t.Cleanup(func() { detectDefault = orig })
+}
+
+// fakeTokenProvider is an auth.TokenProvider returning a static token.
+type fakeTokenProvider struct {
+	token string
+}
+
+func (p *fakeTokenProvider) Token(context.Context) (*auth.Token, error) {
+	return &auth.Token{Value: p.token, Type: "Bearer", Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+// newFakeCredentials returns credentials with a fakeTokenProvider of the
+// given token.
+func newFakeCredentials(token string) *auth.Credentials {
+	return auth.NewCredentials(&auth.CredentialsOptions{
+		TokenProvider: &fakeTokenProvider{token: token},
+	})
+}
+
+// fakeKMS is a gRPC server mimicking the GCP KMS Encrypt and Decrypt APIs,
+// recording the authorization of the requests. Requests decrypt to
+// "data-key".
+type fakeKMS struct {
+	kmspb.UnimplementedKeyManagementServiceServer
+
+	mu    sync.Mutex
+	auths []string
+}
+
+// startFakeKMS starts a fakeKMS with TLS, and returns it with the
+// ClientOptions to connect to it.
+func startFakeKMS(t *testing.T) (*fakeKMS, ClientOptions) {
+	t.Helper()
+
+	cert, pool := newTestCertificate(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeKMS{}
+	server := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	kmspb.RegisterKeyManagementServiceServer(server, f)
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	return f, ClientOptions{
+		Endpoint: lis.Addr().String(),
+		clientOptions: []option.ClientOption{
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(pool, "localhost"))),
+		},
+	}
+}
+
+func (f *fakeKMS) Encrypt(ctx context.Context, _ *kmspb.EncryptRequest) (*kmspb.EncryptResponse, error) {
+	f.recordAuthorization(ctx)
+	return &kmspb.EncryptResponse{Ciphertext: []byte("encrypted-data-key")}, nil
+}
+
+func (f *fakeKMS) Decrypt(ctx context.Context, _ *kmspb.DecryptRequest) (*kmspb.DecryptResponse, error) {
+	f.recordAuthorization(ctx)
+	return &kmspb.DecryptResponse{Plaintext: []byte("data-key")}, nil
+}
+
+func (f *fakeKMS) recordAuthorization(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.auths = append(f.auths, md.Get("authorization")...)
+}
+
+func (f *fakeKMS) authorizations() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.auths...)
+}
+
+// newTestCertificate returns a self-signed certificate for localhost, and a
+// pool containing it.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}, pool
+}
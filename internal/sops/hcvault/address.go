@@ -0,0 +1,83 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hcvault
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// defaultPorts are the ports implied by the schemes of Vault addresses.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// ParseAddress parses the given Vault address, and returns it in a
+// normalized form suitable for comparison: the scheme and host are
+// lowercased, the default port of the scheme is removed, and so are any
+// trailing slashes of the path. The path is kept, as Vault may be served
+// behind a reverse proxy under a path prefix.
+// It returns an error if the address is not an absolute http or https URL,
+// or contains user info, a query or a fragment.
+func ParseAddress(address string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(address))
+	if err != nil {
+		return "", fmt.Errorf("invalid Vault address: %w", err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if _, ok := defaultPorts[u.Scheme]; !ok || u.Host == "" {
+		return "", fmt.Errorf("invalid Vault address '%s': must be an absolute http or https URL", address)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid Vault address '%s': must not contain user info, a query or a fragment", address)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		// Hostname strips the brackets of IPv6 addresses.
+		host = "[" + host + "]"
+	}
+	return (&url.URL{
+		Scheme: u.Scheme,
+		Host:   host,
+		Path:   strings.TrimRight(u.Path, "/"),
+	}).String(), nil
+}
+
+// AddressAllowed returns if the given Vault address is equal to one of the
+// addresses of the allowlist after normalization with ParseAddress. An empty
+// allowlist allows any address, while an invalid address is never allowed.
+func AddressAllowed(address string, allowlist []string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	normalized, err := ParseAddress(address)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range allowlist {
+		if a, err := ParseAddress(allowed); err == nil && a == normalized {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hcvault
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		wantErr string
+	}{
+		{address: "https://vault.example.com:8200", want: "https://vault.example.com:8200"},
+		{address: "HTTPS://Vault.Example.com:8200/", want: "https://vault.example.com:8200"},
+		{address: "https://vault.example.com:443", want: "https://vault.example.com"},
+		{address: "http://vault.example.com:80", want: "http://vault.example.com"},
+		{address: "http://vault.example.com:443", want: "http://vault.example.com:443"},
+		{address: "https://proxy.example.com/vault/", want: "https://proxy.example.com/vault"},
+		{address: "https://[::1]:8200", want: "https://[::1]:8200"},
+		{address: "https://[::1]:443", want: "https://[::1]"},
+		{address: " https://vault.example.com\n", want: "https://vault.example.com"},
+		{address: "vault.example.com:8200", wantErr: "must be an absolute http or https URL"},
+		{address: "tcp://vault.example.com:8200", wantErr: "must be an absolute http or https URL"},
+		{address: "https://token@vault.example.com", wantErr: "must not contain user info, a query or a fragment"},
+		{address: "https://vault.example.com?x=y", wantErr: "must not contain user info, a query or a fragment"},
+		{address: "https://vault.example.com:port", wantErr: "invalid Vault address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := ParseAddress(tt.address)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestAddressAllowed(t *testing.T) {
+	allowlist := []string{"https://vault.example.com:8200", "https://proxy.example.com/vault"}
+
+	tests := []struct {
+		name      string
+		address   string
+		allowlist []string
+		want      bool
+	}{
+		{name: "empty allowlist", address: "https://attacker.example.com", want: true},
+		{name: "exact match", address: "https://vault.example.com:8200", allowlist: allowlist, want: true},
+		{name: "normalized match", address: "https://VAULT.example.com:8200/", allowlist: allowlist, want: true},
+		{name: "path prefix match", address: "https://proxy.example.com/vault", allowlist: allowlist, want: true},
+		{name: "other host", address: "https://attacker.example.com:8200", allowlist: allowlist},
+		{name: "other port", address: "https://vault.example.com", allowlist: allowlist},
+		{name: "other scheme", address: "http://vault.example.com:8200", allowlist: allowlist},
+		{name: "other path", address: "https://proxy.example.com/other", allowlist: allowlist},
+		{name: "host suffix", address: "https://vault.example.com.attacker.example.com:8200", allowlist: allowlist},
+		{name: "invalid address", address: "vault.example.com:8200", allowlist: allowlist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(AddressAllowed(tt.address, tt.allowlist)).To(Equal(tt.want))
+		})
+	}
+}
@@ -0,0 +1,379 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hcvault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/kustomize-controller/internal/securebytes"
+)
+
+const (
+	// DefaultKubernetesAuthMount is the default mount path of the Kubernetes
+	// auth method.
+	DefaultKubernetesAuthMount = "kubernetes"
+	// DefaultAppRoleAuthMount is the default mount path of the AppRole auth
+	// method.
+	DefaultAppRoleAuthMount = "approle"
+	// DefaultCertAuthMount is the default mount path of the TLS certificate
+	// auth method.
+	DefaultCertAuthMount = "cert"
+	// DefaultServiceAccountTokenFile is the file of the projected token of
+	// the ServiceAccount of the controller.
+	DefaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// tokenExpiryMargin is the time before the expiry of a token at which a
+	// new login is performed, to prevent the token from expiring while in
+	// use.
+	tokenExpiryMargin = 10 * time.Second
+)
+
+// Login logs in to Vault with an auth method, and caches the resulting
+// token per Vault address and namespace. Renewable tokens are renewed when less than a
+// third of their TTL remains, other tokens are replaced by a new login
+// shortly before they expire.
+type Login struct {
+	method api.AuthMethod
+	// now returns the current time, and can be overwritten in tests.
+	now func() time.Time
+
+	mu     sync.Mutex
+	tokens map[loginKey]loginToken
+}
+
+// loginKey is the Vault address and namespace of a loginToken.
+type loginKey struct {
+	address   string
+	namespace string
+}
+
+// loginKeyForClient returns the loginKey of the given client.
+func loginKeyForClient(client *api.Client) loginKey {
+	return loginKey{address: client.Address(), namespace: client.Namespace()}
+}
+
+// String returns the quoted address, and the namespace if set.
+func (k loginKey) String() string {
+	if k.namespace != "" {
+		return fmt.Sprintf("'%s' in namespace '%s'", k.address, k.namespace)
+	}
+	return fmt.Sprintf("'%s'", k.address)
+}
+
+// loginToken is a token obtained by a Login.
+type loginToken struct {
+	token     string
+	renewable bool
+	// renewAt is the time after which the token is renewed, and expiry the
+	// time at which the token expires. Both are zero if the token does not
+	// expire.
+	renewAt time.Time
+	expiry  time.Time
+}
+
+// newLoginToken returns the loginToken of the given auth response, obtained
+// at the given time.
+func newLoginToken(auth *api.SecretAuth, now time.Time) loginToken {
+	t := loginToken{token: auth.ClientToken, renewable: auth.Renewable}
+	if auth.LeaseDuration > 0 {
+		ttl := time.Duration(auth.LeaseDuration) * time.Second
+		t.expiry = now.Add(ttl)
+		t.renewAt = t.expiry.Add(-ttl / 3)
+	}
+	return t
+}
+
+// NewLogin returns a Login with the given auth method.
+func NewLogin(method api.AuthMethod) *Login {
+	return &Login{
+		method: method,
+		now:    time.Now,
+		tokens: make(map[loginKey]loginToken),
+	}
+}
+
+// Token returns the cached token for the Vault and namespace of the given
+// client. When
+// no token is cached, or the cached token is about to expire and can not be
+// renewed, it logs in with the client.
+func (l *Login) Token(ctx context.Context, client *api.Client) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := loginKeyForClient(client)
+	if t, ok := l.tokens[key]; ok {
+		now := l.now()
+		switch {
+		case t.expiry.IsZero() || now.Before(t.renewAt):
+			return t.token, nil
+		case t.renewable:
+			// When the renewal fails, e.g. because the max TTL of the token
+			// has been reached, a new login is performed.
+			if renewed, err := l.renew(ctx, client, t); err == nil {
+				l.tokens[key] = renewed
+				return renewed.token, nil
+			}
+		case now.Before(t.expiry.Add(-tokenExpiryMargin)):
+			return t.token, nil
+		}
+	}
+
+	client.ClearToken()
+	secret, err := l.method.Login(ctx, client)
+	if err != nil {
+		return "", fmt.Errorf("failed to log in to Vault at %s: %w", key, err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return "", fmt.Errorf("failed to log in to Vault at %s: no client token in login response", key)
+	}
+
+	t := newLoginToken(secret.Auth, l.now())
+	l.tokens[key] = t
+	return t.token, nil
+}
+
+// renew renews the given token with the client, and returns the renewed
+// token. It returns an error if the renewal fails, or if the renewed token
+// would expire before it can be used.
+func (l *Login) renew(ctx context.Context, client *api.Client, t loginToken) (loginToken, error) {
+	client.SetToken(t.token)
+	secret, err := client.Auth().Token().RenewSelfWithContext(ctx, 0)
+	if err != nil {
+		return loginToken{}, err
+	}
+	if secret == nil || secret.Auth == nil {
+		return loginToken{}, errors.New("no auth in token renewal response")
+	}
+	renewed := newLoginToken(secret.Auth, l.now())
+	if renewed.token == "" {
+		renewed.token = t.token
+	}
+	if !renewed.expiry.IsZero() && !l.now().Before(renewed.expiry.Add(-tokenExpiryMargin)) {
+		return loginToken{}, errors.New("renewed token is about to expire")
+	}
+	return renewed, nil
+}
+
+// Invalidate removes the given token for the Vault and namespace of the
+// given client from the cache, causing the next call to Token to log in
+// again. It does nothing if another token has been cached since.
+func (l *Login) Invalidate(client *api.Client, token string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := loginKeyForClient(client)
+	if t, ok := l.tokens[key]; ok && t.token == token {
+		delete(l.tokens, key)
+	}
+}
+
+// JWTSource returns the JSON Web Tokens used to log in with an auth method.
+type JWTSource interface {
+	// JWT returns a token.
+	JWT(ctx context.Context) (string, error)
+}
+
+// KubernetesAuth is an api.AuthMethod logging in with the Kubernetes auth
+// method, using the token of a Kubernetes ServiceAccount.
+type KubernetesAuth struct {
+	// Role is the name of the role to log in with.
+	Role string
+	// MountPath is the mount path of the auth method.
+	// When empty, DefaultKubernetesAuthMount is used.
+	MountPath string
+	// JWTSource returns the ServiceAccount token to log in with.
+	JWTSource JWTSource
+}
+
+// Login logs in with the role and ServiceAccount token, and returns the
+// response.
+func (a *KubernetesAuth) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	mount := a.MountPath
+	if mount == "" {
+		mount = DefaultKubernetesAuthMount
+	}
+	jwt, err := a.JWTSource.JWT(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := client.Logical().WriteWithContext(ctx, path.Join("auth", mount, "login"), map[string]interface{}{
+		"role": a.Role,
+		"jwt":  jwt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("login with Kubernetes auth method at 'auth/%s' and role '%s' failed: %w", mount, a.Role, err)
+	}
+	return secret, nil
+}
+
+// AppRoleAuth is an api.AuthMethod logging in with the AppRole auth method.
+// When the SecretID is a response-wrapping token, it is unwrapped before the
+// first login. As a wrapping token can only be used once, the unwrapped
+// secret ID is kept for subsequent logins.
+type AppRoleAuth struct {
+	// RoleID is the role ID to log in with.
+	RoleID string
+	// SecretID is the secret ID to log in with, or a response-wrapping
+	// token of the secret ID.
+	SecretID string
+	// MountPath is the mount path of the auth method.
+	// When empty, DefaultAppRoleAuthMount is used.
+	MountPath string
+
+	mu       sync.Mutex
+	secretID string
+}
+
+// Login logs in with the role ID and secret ID, and returns the response.
+func (a *AppRoleAuth) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	mount := a.MountPath
+	if mount == "" {
+		mount = DefaultAppRoleAuthMount
+	}
+	secretID, err := a.getSecretID(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("login with AppRole auth method at 'auth/%s' failed: %w", mount, err)
+	}
+	secret, err := client.Logical().WriteWithContext(ctx, path.Join("auth", mount, "login"), map[string]interface{}{
+		"role_id":   a.RoleID,
+		"secret_id": secretID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("login with AppRole auth method at 'auth/%s' failed: %w", mount, err)
+	}
+	return secret, nil
+}
+
+// getSecretID returns the secret ID to log in with, unwrapping the SecretID
+// with the client if it is a response-wrapping token.
+func (a *AppRoleAuth) getSecretID(ctx context.Context, client *api.Client) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.secretID != "" {
+		return a.secretID, nil
+	}
+	if !isWrappingToken(a.SecretID) {
+		a.secretID = a.SecretID
+		return a.secretID, nil
+	}
+
+	// Unwrapping authenticates with the wrapping token itself.
+	defer client.ClearToken()
+	client.ClearToken()
+	secret, err := client.Logical().UnwrapWithContext(ctx, a.SecretID)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap secret ID: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return "", errors.New("failed to unwrap secret ID: response is empty")
+	}
+	secretID, ok := secret.Data["secret_id"].(string)
+	if !ok || secretID == "" {
+		return "", errors.New("failed to unwrap secret ID: response does not contain a 'secret_id'")
+	}
+	a.secretID = secretID
+	return a.secretID, nil
+}
+
+// isWrappingToken returns if the given secret ID is a Vault service token,
+// which is the format of response-wrapping tokens, rather than a secret ID
+// (which is a UUID unless customized).
+func isWrappingToken(secretID string) bool {
+	return strings.HasPrefix(secretID, "hvs.") ||
+		(strings.HasPrefix(secretID, "s.") && len(secretID) == 26)
+}
+
+// CertAuth is an api.AuthMethod logging in with the TLS certificate auth
+// method, using the client certificate configured in the TLS configuration
+// of the client, see ClientOptions.TLSConfig.
+type CertAuth struct {
+	// Name is the name of the certificate role to log in with.
+	// When empty, Vault tries all roles matching the client certificate.
+	Name string
+	// MountPath is the mount path of the auth method.
+	// When empty, DefaultCertAuthMount is used.
+	MountPath string
+}
+
+// Login logs in with the client certificate and the role name, if any, and
+// returns the response.
+func (a *CertAuth) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	mount := a.MountPath
+	if mount == "" {
+		mount = DefaultCertAuthMount
+	}
+	data := map[string]interface{}{}
+	if a.Name != "" {
+		data["name"] = a.Name
+	}
+	secret, err := client.Logical().WriteWithContext(ctx, path.Join("auth", mount, "login"), data)
+	if err != nil {
+		return nil, fmt.Errorf("login with TLS certificate auth method at 'auth/%s' failed: %w", mount, err)
+	}
+	return secret, nil
+}
+
+// ServiceAccountToken is a JWTSource which requests a token for a Kubernetes
+// ServiceAccount.
+type ServiceAccountToken struct {
+	// Client is used to request the token.
+	Client client.Client
+	// ServiceAccount is the ServiceAccount to request the token for.
+	ServiceAccount *corev1.ServiceAccount
+}
+
+// JWT requests a token for the ServiceAccount.
+func (t ServiceAccountToken) JWT(ctx context.Context) (string, error) {
+	tokenRequest := &authenticationv1.TokenRequest{}
+	if err := t.Client.SubResource("token").Create(ctx, t.ServiceAccount, tokenRequest); err != nil {
+		return "", fmt.Errorf("failed to request token for ServiceAccount '%s/%s': %w",
+			t.ServiceAccount.Namespace, t.ServiceAccount.Name, err)
+	}
+	return tokenRequest.Status.Token, nil
+}
+
+// TokenFile is a JWTSource which reads the token from a file, for example
+// the DefaultServiceAccountTokenFile. The file is read on every call, as
+// projected tokens are rotated.
+type TokenFile string
+
+// JWT reads the token from the file.
+func (f TokenFile) JWT(context.Context) (string, error) {
+	b, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", fmt.Errorf("failed to read ServiceAccount token: %w", err)
+	}
+	defer securebytes.Wipe(b)
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", errors.New("failed to read ServiceAccount token: file is empty")
+	}
+	return token, nil
+}
@@ -0,0 +1,447 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hcvault
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getsops/sops/v3/hcvault"
+	"github.com/hashicorp/vault/api"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDecrypt_KubernetesAuth(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+	vault.loginTTL = 3600
+
+	now := time.Now()
+	login := newTestLogin(&now)
+	opts := ClientOptions{Login: login}
+
+	key := hcvault.NewMasterKey(vault.server.URL, "transit", "sops")
+	key.EncryptedKey = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))
+
+	// The first decryption logs in.
+	got, err := Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal([]byte("data-key")))
+	g.Expect(vault.loginRequests()).To(Equal([]map[string]string{
+		{"role": "flux", "jwt": "service-account-token"},
+	}))
+
+	// The token is reused until it is about to expire.
+	now = now.Add(time.Hour - 2*tokenExpiryMargin)
+	_, err = Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(vault.loginRequests()).To(HaveLen(1))
+
+	// After which a new login is performed.
+	now = now.Add(tokenExpiryMargin)
+	_, err = Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(vault.loginRequests()).To(HaveLen(2))
+}
+
+func TestDecrypt_KubernetesAuth_Relogin(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+	vault.loginTTL = 3600
+
+	now := time.Now()
+	opts := ClientOptions{Login: newTestLogin(&now)}
+
+	key := hcvault.NewMasterKey(vault.server.URL, "transit", "sops")
+	key.EncryptedKey = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))
+
+	_, err := Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(vault.loginRequests()).To(HaveLen(1))
+
+	// A token revoked before its expiry results in a permission denied
+	// response, after which a new login is performed.
+	vault.revokeTokens()
+	got, err := Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal([]byte("data-key")))
+	g.Expect(vault.loginRequests()).To(HaveLen(2))
+}
+
+func TestDecrypt_KubernetesAuth_LoginError(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+	vault.loginStatus = http.StatusForbidden
+
+	now := time.Now()
+	key := hcvault.NewMasterKey(vault.server.URL, "transit", "sops")
+	key.EncryptedKey = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))
+
+	_, err := Decrypt(context.TODO(), key, ClientOptions{Login: newTestLogin(&now)})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to log in to Vault at '" + vault.server.URL +
+		"': login with Kubernetes auth method at 'auth/kubernetes' and role 'flux' failed"))
+	g.Expect(err.Error()).To(ContainSubstring("permission denied"))
+	g.Expect(vault.loginRequests()).To(HaveLen(1))
+}
+
+func TestDecrypt_Renewal(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+	vault.loginTTL = 3600
+	vault.renewable = true
+
+	now := time.Now()
+	opts := ClientOptions{Login: newTestLogin(&now)}
+
+	key := hcvault.NewMasterKey(vault.server.URL, "transit", "sops")
+	key.EncryptedKey = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))
+
+	_, err := Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(vault.loginRequests()).To(HaveLen(1))
+
+	// The token is not renewed while more than a third of the TTL remains.
+	now = now.Add(39 * time.Minute)
+	_, err = Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(vault.renewals()).To(Equal(0))
+
+	// After which it is renewed, instead of logging in again.
+	now = now.Add(2 * time.Minute)
+	_, err = Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(vault.renewals()).To(Equal(1))
+	g.Expect(vault.loginRequests()).To(HaveLen(1))
+
+	// The renewal extends the TTL.
+	now = now.Add(39 * time.Minute)
+	_, err = Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(vault.renewals()).To(Equal(1))
+
+	// When the renewal fails, a new login is performed.
+	vault.mu.Lock()
+	vault.renewable = false
+	vault.mu.Unlock()
+	now = now.Add(2 * time.Minute)
+	_, err = Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(vault.renewals()).To(Equal(1))
+	g.Expect(vault.loginRequests()).To(HaveLen(2))
+}
+
+func TestDecrypt_AppRoleAuth(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+	vault.loginTTL = 3600
+	vault.secretID = "secret-id"
+
+	key := hcvault.NewMasterKey(vault.server.URL, "transit", "sops")
+	key.EncryptedKey = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))
+
+	opts := ClientOptions{Login: NewLogin(&AppRoleAuth{
+		RoleID:   "role-id",
+		SecretID: "secret-id",
+	})}
+	got, err := Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal([]byte("data-key")))
+	g.Expect(vault.loginRequests()).To(Equal([]map[string]string{
+		{"role_id": "role-id", "secret_id": "secret-id"},
+	}))
+
+	_, err = Decrypt(context.TODO(), key, ClientOptions{Login: NewLogin(&AppRoleAuth{
+		RoleID:   "role-id",
+		SecretID: "invalid-secret-id",
+	})})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key from Vault transit backend 'transit/decrypt/sops': " +
+		"failed to log in to Vault at '" + vault.server.URL + "': login with AppRole auth method at 'auth/approle' failed"))
+	g.Expect(err.Error()).To(ContainSubstring("invalid role or secret ID"))
+}
+
+func TestDecrypt_AppRoleAuth_WrappedSecretID(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+	vault.secretID = "secret-id"
+	vault.wrappedSecretIDs["hvs.wrapping-token"] = "secret-id"
+
+	key := hcvault.NewMasterKey(vault.server.URL, "transit", "sops")
+	key.EncryptedKey = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))
+
+	opts := ClientOptions{Login: NewLogin(&AppRoleAuth{
+		RoleID:   "role-id",
+		SecretID: "hvs.wrapping-token",
+	})}
+	_, err := Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(vault.loginRequests()).To(Equal([]map[string]string{
+		{"role_id": "role-id", "secret_id": "secret-id"},
+	}))
+
+	// The unwrapped secret ID is used for subsequent logins, as the wrapping
+	// token can only be used once.
+	vault.revokeTokens()
+	_, err = Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(vault.loginRequests()).To(HaveLen(2))
+	g.Expect(vault.loginRequests()[1]).To(HaveKeyWithValue("secret_id", "secret-id"))
+
+	// A used wrapping token can not be unwrapped again.
+	_, err = Decrypt(context.TODO(), key, ClientOptions{Login: NewLogin(&AppRoleAuth{
+		RoleID:   "role-id",
+		SecretID: "hvs.wrapping-token",
+	})})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("login with AppRole auth method at 'auth/approle' failed: failed to unwrap secret ID"))
+	g.Expect(err.Error()).To(ContainSubstring("wrapping token is not valid or does not exist"))
+}
+
+func TestDecrypt_CertAuth(t *testing.T) {
+	clientCertPEM, clientKeyPEM := newTestClientCertificate(t, "flux")
+	clientCert, err := ParseClientCertificate(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+
+	tests := []struct {
+		name       string
+		auth       *CertAuth
+		clientCert *tls.Certificate
+		wantLogin  map[string]string
+		wantErr    string
+	}{
+		{
+			name:       "client certificate",
+			auth:       &CertAuth{},
+			clientCert: &clientCert,
+			wantLogin:  map[string]string{"client_certificate": "flux"},
+		},
+		{
+			name:       "client certificate with role name",
+			auth:       &CertAuth{Name: "sops"},
+			clientCert: &clientCert,
+			wantLogin:  map[string]string{"name": "sops", "client_certificate": "flux"},
+		},
+		{
+			name:      "missing client certificate",
+			auth:      &CertAuth{},
+			wantLogin: map[string]string{},
+			wantErr:   "login with TLS certificate auth method at 'auth/cert' failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			vault := startFakeVaultWithTLS(t, clientCAs)
+			vault.loginTTL = 3600
+			t.Setenv("VAULT_MAX_RETRIES", "0")
+
+			key := hcvault.NewMasterKey(vault.server.URL, "transit", "sops")
+			key.EncryptedKey = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))
+
+			opts := ClientOptions{
+				Login: NewLogin(tt.auth),
+				TLSConfig: NewTLSConfig(TLSOptions{
+					CACertificates:    []*x509.Certificate{vault.server.Certificate()},
+					ClientCertificate: tt.clientCert,
+				}),
+			}
+			got, err := Decrypt(context.TODO(), key, opts)
+			g.Expect(vault.loginRequests()).To(Equal([]map[string]string{tt.wantLogin}))
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal([]byte("data-key")))
+
+			// The token of the login is reused.
+			_, err = Decrypt(context.TODO(), key, opts)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(vault.loginRequests()).To(HaveLen(1))
+		})
+	}
+}
+
+func TestDecrypt_PermissionDenied(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+	vault.secretID = "secret-id"
+
+	key := hcvault.NewMasterKey(vault.server.URL, "transit", "other")
+	key.EncryptedKey = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))
+
+	// A successful login with a token which is not allowed to use the key
+	// is distinguished from a failure to log in.
+	_, err := Decrypt(context.TODO(), key, ClientOptions{Login: NewLogin(&AppRoleAuth{
+		RoleID:   "role-id",
+		SecretID: "secret-id",
+	})})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key from Vault transit backend 'transit/decrypt/other': " +
+		"permission denied for the token obtained by login"))
+	g.Expect(err.Error()).ToNot(ContainSubstring("failed to log in"))
+	g.Expect(vault.loginRequests()).To(HaveLen(2))
+}
+
+func Test_isWrappingToken(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(isWrappingToken("hvs.CAESIJlU4Z3lGY1QPql0tTSXm8UKjxO")).To(BeTrue())
+	g.Expect(isWrappingToken("s.Dxd4TnIqtRzMcBzlAzBI1qzq")).To(BeTrue())
+	g.Expect(isWrappingToken("6d8a2c3e-5c3f-4e1b-9b2a-1f0e4c6d7b8a")).To(BeFalse())
+	g.Expect(isWrappingToken("s.custom-secret-id")).To(BeFalse())
+}
+
+func TestLogin_Token_NonExpiring(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+
+	now := time.Now()
+	login := newTestLogin(&now)
+	client, err := newClient(vault.server.URL, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	token, err := login.Token(context.TODO(), client)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).To(Equal("login-token-1"))
+
+	now = now.Add(365 * 24 * time.Hour)
+	token, err = login.Token(context.TODO(), client)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).To(Equal("login-token-1"))
+
+	// Invalidating another token keeps the cached token.
+	login.Invalidate(client, "other-token")
+	token, err = login.Token(context.TODO(), client)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).To(Equal("login-token-1"))
+	g.Expect(vault.loginRequests()).To(HaveLen(1))
+}
+
+func TestLogin_Token_Namespace(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+
+	now := time.Now()
+	login := newTestLogin(&now)
+	newNamespaceClient := func(namespace string) *api.Client {
+		client, err := newClient(vault.server.URL, nil)
+		g.Expect(err).ToNot(HaveOccurred())
+		client.SetNamespace(namespace)
+		return client
+	}
+
+	// Tokens are cached per namespace, as they are scoped to the namespace
+	// of the login.
+	g.Expect(login.Token(context.TODO(), newNamespaceClient("ns1"))).To(Equal("login-token-1"))
+	g.Expect(login.Token(context.TODO(), newNamespaceClient("ns2"))).To(Equal("login-token-2"))
+	g.Expect(login.Token(context.TODO(), newNamespaceClient("ns1"))).To(Equal("login-token-1"))
+	g.Expect(vault.loginRequests()).To(HaveLen(2))
+
+	vault.mu.Lock()
+	vault.loginStatus = http.StatusForbidden
+	vault.mu.Unlock()
+	_, err := newTestLogin(&now).Token(context.TODO(), newNamespaceClient("ns1"))
+	g.Expect(err).To(MatchError(ContainSubstring("failed to log in to Vault at '" + vault.server.URL + "' in namespace 'ns1'")))
+}
+
+func TestTokenFile_JWT(t *testing.T) {
+	g := NewWithT(t)
+
+	file := filepath.Join(t.TempDir(), "token")
+	g.Expect(os.WriteFile(file, []byte("service-account-token\n"), 0o600)).To(Succeed())
+
+	token, err := TokenFile(file).JWT(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).To(Equal("service-account-token"))
+
+	// The file is read on every call, as projected tokens are rotated.
+	g.Expect(os.WriteFile(file, []byte("rotated-token"), 0o600)).To(Succeed())
+	token, err = TokenFile(file).JWT(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).To(Equal("rotated-token"))
+
+	_, err = TokenFile(filepath.Join(t.TempDir(), "missing")).JWT(context.TODO())
+	g.Expect(err).To(MatchError(ContainSubstring("failed to read ServiceAccount token")))
+}
+
+func TestServiceAccountToken_JWT(t *testing.T) {
+	g := NewWithT(t)
+
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "tenant",
+			Namespace: "tenant-ns",
+		},
+	}
+	c := fake.NewClientBuilder().WithObjects(sa).Build()
+
+	token, err := ServiceAccountToken{Client: c, ServiceAccount: sa}.JWT(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).ToNot(BeEmpty())
+
+	_, err = ServiceAccountToken{Client: c, ServiceAccount: &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "missing",
+			Namespace: "tenant-ns",
+		},
+	}}.JWT(context.TODO())
+	g.Expect(err).To(MatchError(ContainSubstring("failed to request token for ServiceAccount 'tenant-ns/missing'")))
+}
+
+// newTestLogin returns a Login with the Kubernetes auth method for the
+// "flux" role with a static JWT, and the clock of the given time.
+func newTestLogin(now *time.Time) *Login {
+	l := NewLogin(&KubernetesAuth{
+		Role:      "flux",
+		JWTSource: staticJWT("service-account-token"),
+	})
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+// staticJWT is a JWTSource returning a static token.
+type staticJWT string
+
+func (s staticJWT) JWT(context.Context) (string, error) {
+	return string(s), nil
+}
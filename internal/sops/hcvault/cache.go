@@ -0,0 +1,160 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hcvault
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// cacheResultHit is the value of the result label for cache hits.
+	cacheResultHit = "hit"
+	// cacheResultMiss is the value of the result label for cache misses.
+	cacheResultMiss = "miss"
+)
+
+// LoginCache is a concurrency safe cache of Login objects, keyed on the
+// identity of the decryption Secret they were constructed for. This allows
+// the Logins, and the Vault tokens cached by them, to be reused across
+// reconciliations instead of logging in to Vault every time.
+//
+// An entry is replaced when the authentication data of its decryption Secret
+// changes. The Logins renew their tokens when less than a third of the TTL
+// remains, the cache itself evicts the least recently used entry when the
+// max size is reached, and any entry which is older than the max age.
+//
+// A nil *LoginCache is valid, and results in Logins always being
+// constructed.
+type LoginCache struct {
+	maxSize int
+	maxAge  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	entriesGauge   prometheus.Gauge
+	requestCounter *prometheus.CounterVec
+
+	// now is used to determine the age of entries, and as the clock of the
+	// cached Logins. It can be overwritten in tests.
+	now func() time.Time
+}
+
+// loginCacheEntry is a LoginCache entry.
+type loginCacheEntry struct {
+	id        string
+	sum       [sha256.Size]byte
+	login     *Login
+	createdAt time.Time
+}
+
+// NewLoginCache returns a new LoginCache which holds up to maxSize Logins,
+// for at most maxAge. A maxAge of zero disables the expiration of entries.
+func NewLoginCache(maxSize int, maxAge time.Duration) *LoginCache {
+	return &LoginCache{
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		entriesGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gotk_vault_login_cache_entries",
+			Help: "The number of Hashicorp Vault logins in the cache.",
+		}),
+		requestCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotk_vault_login_cache_requests_total",
+			Help: "The number of Hashicorp Vault login cache requests, partitioned by hit or miss result.",
+		}, []string{"result"}),
+		now: time.Now,
+	}
+}
+
+// MustRegister registers the metrics of the cache with the given
+// prometheus.Registerer. It panics if any of the metrics can not be
+// registered.
+func (c *LoginCache) MustRegister(r prometheus.Registerer) {
+	r.MustRegister(c.entriesGauge, c.requestCounter)
+}
+
+// GetOrCreate returns the cached Login for the given id, e.g. the namespaced
+// name of a decryption Secret, if it was created from the same
+// authentication data. Otherwise, create is called to construct a Login,
+// which replaces any cached Login for the id.
+func (c *LoginCache) GetOrCreate(id string, data []byte, create func() *Login) *Login {
+	if c == nil {
+		return create()
+	}
+
+	sum := sha256.Sum256(data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		entry := e.Value.(*loginCacheEntry)
+		if entry.sum == sum && !c.expired(entry) {
+			c.lru.MoveToFront(e)
+			c.requestCounter.WithLabelValues(cacheResultHit).Inc()
+			return entry.login
+		}
+		c.removeElement(e)
+	}
+	c.requestCounter.WithLabelValues(cacheResultMiss).Inc()
+
+	login := create()
+	login.now = c.now
+
+	c.entries[id] = c.lru.PushFront(&loginCacheEntry{
+		id:        id,
+		sum:       sum,
+		login:     login,
+		createdAt: c.now(),
+	})
+	for c.lru.Len() > c.maxSize {
+		c.removeElement(c.lru.Back())
+	}
+	c.entriesGauge.Set(float64(c.lru.Len()))
+	return login
+}
+
+// Len returns the number of entries in the cache.
+func (c *LoginCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// expired returns if the given entry is older than the max age of the cache.
+func (c *LoginCache) expired(entry *loginCacheEntry) bool {
+	return c.maxAge > 0 && c.now().Sub(entry.createdAt) >= c.maxAge
+}
+
+// removeElement removes the given element from the cache.
+// It must be called while holding the lock.
+func (c *LoginCache) removeElement(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*loginCacheEntry).id)
+	c.entriesGauge.Set(float64(c.lru.Len()))
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hcvault
+
+import (
+	"context"
+	"encoding/base64"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getsops/sops/v3/hcvault"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoginCache_GetOrCreate(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewLoginCache(2, 0)
+
+	var created int
+	create := func() *Login {
+		created++
+		return NewLogin(&KubernetesAuth{Role: "flux", JWTSource: staticJWT("service-account-token")})
+	}
+
+	first := c.GetOrCreate("tenant/sops", []byte("a"), create)
+	g.Expect(first).ToNot(BeNil())
+	g.Expect(created).To(Equal(1))
+
+	got := c.GetOrCreate("tenant/sops", []byte("a"), create)
+	g.Expect(got).To(BeIdenticalTo(first))
+	g.Expect(created).To(Equal(1))
+
+	got = c.GetOrCreate("other/sops", []byte("a"), create)
+	g.Expect(got).ToNot(BeIdenticalTo(first))
+	g.Expect(created).To(Equal(2))
+	g.Expect(c.Len()).To(Equal(2))
+
+	// A change of the data replaces the entry of the id.
+	got = c.GetOrCreate("tenant/sops", []byte("b"), create)
+	g.Expect(got).ToNot(BeIdenticalTo(first))
+	g.Expect(created).To(Equal(3))
+	g.Expect(c.Len()).To(Equal(2))
+	g.Expect(c.GetOrCreate("tenant/sops", []byte("b"), create)).To(BeIdenticalTo(got))
+
+	g.Expect(testutil.ToFloat64(c.requestCounter.WithLabelValues(cacheResultHit))).To(Equal(float64(2)))
+	g.Expect(testutil.ToFloat64(c.requestCounter.WithLabelValues(cacheResultMiss))).To(Equal(float64(3)))
+	g.Expect(testutil.ToFloat64(c.entriesGauge)).To(Equal(float64(2)))
+}
+
+func TestLoginCache_GetOrCreate_Eviction(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewLoginCache(2, 0)
+
+	var created int
+	create := func() *Login {
+		created++
+		return NewLogin(&KubernetesAuth{Role: "flux", JWTSource: staticJWT("service-account-token")})
+	}
+
+	for _, id := range []string{"a", "b", "a", "c"} {
+		c.GetOrCreate(id, nil, create)
+	}
+	g.Expect(created).To(Equal(3))
+	g.Expect(c.Len()).To(Equal(2))
+
+	// "b" was the least recently used entry, and should have been evicted.
+	c.GetOrCreate("a", nil, create)
+	g.Expect(created).To(Equal(3))
+	c.GetOrCreate("b", nil, create)
+	g.Expect(created).To(Equal(4))
+}
+
+func TestLoginCache_GetOrCreate_MaxAge(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewLoginCache(2, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	var created int
+	create := func() *Login {
+		created++
+		return NewLogin(&KubernetesAuth{Role: "flux", JWTSource: staticJWT("service-account-token")})
+	}
+
+	c.GetOrCreate("a", nil, create)
+	now = now.Add(30 * time.Second)
+	c.GetOrCreate("a", nil, create)
+	g.Expect(created).To(Equal(1))
+
+	now = now.Add(30 * time.Second)
+	c.GetOrCreate("a", nil, create)
+	g.Expect(created).To(Equal(2))
+	g.Expect(c.Len()).To(Equal(1))
+}
+
+func TestLoginCache_GetOrCreate_Nil(t *testing.T) {
+	g := NewWithT(t)
+
+	var c *LoginCache
+
+	var created int
+	create := func() *Login {
+		created++
+		return NewLogin(&KubernetesAuth{Role: "flux", JWTSource: staticJWT("service-account-token")})
+	}
+
+	first := c.GetOrCreate("a", nil, create)
+	g.Expect(c.GetOrCreate("a", nil, create)).ToNot(BeIdenticalTo(first))
+	g.Expect(created).To(Equal(2))
+	g.Expect(c.Len()).To(BeZero())
+}
+
+func TestLoginCache_Token(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+	vault.loginTTL = 3600
+
+	c := NewLoginCache(2, 0)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	create := func() *Login {
+		return NewLogin(&KubernetesAuth{Role: "flux", JWTSource: staticJWT("service-account-token")})
+	}
+
+	key := hcvault.NewMasterKey(vault.server.URL, "transit", "sops")
+	key.EncryptedKey = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))
+	decrypt := func() {
+		t.Helper()
+		opts := ClientOptions{Login: c.GetOrCreate("tenant/sops", []byte("flux"), create)}
+		_, err := Decrypt(context.TODO(), key, opts)
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+
+	// The token of the cached Login is reused across decryptions.
+	decrypt()
+	decrypt()
+	g.Expect(vault.loginRequests()).To(HaveLen(1))
+
+	// The cached Login uses the clock of the cache, and reuses the
+	// non-renewable token until it is about to expire.
+	now = now.Add(time.Hour - tokenExpiryMargin - time.Second)
+	decrypt()
+	g.Expect(vault.loginRequests()).To(HaveLen(1))
+
+	now = now.Add(time.Second)
+	decrypt()
+	g.Expect(vault.loginRequests()).To(HaveLen(2))
+
+	// Renewable tokens are renewed once less than a third of the TTL
+	// remains.
+	vault.mu.Lock()
+	vault.renewable = true
+	vault.mu.Unlock()
+	now = now.Add(time.Hour)
+	decrypt()
+	g.Expect(vault.loginRequests()).To(HaveLen(3))
+
+	now = now.Add(40*time.Minute + time.Second)
+	decrypt()
+	g.Expect(vault.renewals()).To(Equal(1))
+	g.Expect(vault.loginRequests()).To(HaveLen(3))
+}
+
+func TestLoginCache_Concurrent(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+	vault.loginTTL = 3600
+
+	c := NewLoginCache(10, 0)
+
+	var (
+		mu      sync.Mutex
+		created int
+	)
+	create := func() *Login {
+		mu.Lock()
+		defer mu.Unlock()
+		created++
+		return NewLogin(&KubernetesAuth{Role: "flux", JWTSource: staticJWT("service-account-token")})
+	}
+
+	key := hcvault.NewMasterKey(vault.server.URL, "transit", "sops")
+	key.EncryptedKey = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			opts := ClientOptions{Login: c.GetOrCreate("tenant/sops", []byte("flux"), create)}
+			_, _ = Decrypt(context.TODO(), key, opts)
+		}()
+	}
+	wg.Wait()
+
+	g.Expect(created).To(Equal(1))
+	g.Expect(vault.loginRequests()).To(HaveLen(1))
+	g.Expect(testutil.ToFloat64(c.requestCounter.WithLabelValues(cacheResultHit))).To(Equal(float64(19)))
+}
+
+func TestLoginCache_MustRegister(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewLoginCache(2, 0)
+	reg := prometheus.NewRegistry()
+	g.Expect(func() { c.MustRegister(reg) }).ToNot(Panic())
+
+	c.GetOrCreate("a", nil, func() *Login {
+		return NewLogin(&KubernetesAuth{Role: "flux", JWTSource: staticJWT("service-account-token")})
+	})
+
+	count, err := testutil.GatherAndCount(reg, "gotk_vault_login_cache_entries", "gotk_vault_login_cache_requests_total")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(count).To(Equal(2))
+}
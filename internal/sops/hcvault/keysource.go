@@ -0,0 +1,286 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hcvault
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/getsops/sops/v3/hcvault"
+	"github.com/hashicorp/vault/api"
+)
+
+// ClientOptions configures the Vault client used by Encrypt and Decrypt.
+type ClientOptions struct {
+	// Token is the static token for the requests.
+	// When empty, the VAULT_TOKEN environment variable of the controller is
+	// used.
+	Token string
+
+	// Login logs in to Vault to obtain the token for the requests. It takes
+	// precedence over Token.
+	Login *Login
+
+	// Namespace is the Vault Enterprise namespace of the requests, which
+	// takes precedence over a namespace embedded in the engine path of the
+	// key. An empty namespace explicitly configures the root namespace,
+	// using the engine path as-is. When nil, the namespace embedded in the
+	// engine path is used, see SplitNamespace, or else the VAULT_NAMESPACE
+	// environment variable of the controller.
+	Namespace *string
+
+	// TLSConfig is the TLS configuration of the connections to Vault, see
+	// NewTLSConfig. It takes precedence over the VAULT_CACERT, VAULT_CLIENT_*
+	// and VAULT_SKIP_VERIFY environment variables of the controller.
+	// When nil, the environment variables are used.
+	TLSConfig *tls.Config
+}
+
+// backend is the path of an operation of a Vault transit backend, in a
+// namespace.
+type backend struct {
+	// namespace is the namespace of the backend, if setNamespace is true.
+	// Otherwise, the namespace of the client is used.
+	namespace    string
+	setNamespace bool
+	path         string
+}
+
+// newBackend returns the backend of the given operation of the transit
+// backend of the key, in the namespace of the given options or else the
+// namespace embedded in the engine path of the key.
+func newBackend(key *hcvault.MasterKey, opts ClientOptions, operation string) backend {
+	if opts.Namespace != nil {
+		return backend{
+			namespace:    strings.Trim(*opts.Namespace, "/"),
+			setNamespace: true,
+			path:         path.Join(key.EnginePath, operation, key.KeyName),
+		}
+	}
+	namespace, enginePath := SplitNamespace(key.EnginePath)
+	return backend{
+		namespace:    namespace,
+		setNamespace: namespace != "",
+		path:         path.Join(enginePath, operation, key.KeyName),
+	}
+}
+
+// String returns the quoted path of the backend, and its namespace if set.
+func (b backend) String() string {
+	if b.namespace != "" {
+		return fmt.Sprintf("'%s' in namespace '%s'", b.path, b.namespace)
+	}
+	return fmt.Sprintf("'%s'", b.path)
+}
+
+// SplitNamespace splits the given engine path of a SOPS
+// hc_vault_transit_uri into the Vault Enterprise namespace embedded in it
+// and the mount path of the transit backend. Any segments before the last
+// one are considered to be the namespace, e.g. "ns1/team-a/transit" results
+// in the "ns1/team-a" namespace and "transit" mount path.
+func SplitNamespace(enginePath string) (namespace, mountPath string) {
+	enginePath = strings.Trim(enginePath, "/")
+	i := strings.LastIndex(enginePath, "/")
+	if i < 0 {
+		return "", enginePath
+	}
+	return enginePath[:i], enginePath[i+1:]
+}
+
+// ValidateEnginePath returns an error if the given engine path of a SOPS
+// hc_vault_transit_uri is not a valid mount path. Mount paths may consist of
+// any number of segments, e.g. "team-a/sops/transit", but the segments must
+// not be empty or navigate to a parent with "." or "..", which could be used
+// to address another backend than the one in the metadata.
+func ValidateEnginePath(enginePath string) error {
+	trimmed := strings.Trim(enginePath, "/")
+	if trimmed == "" {
+		return errors.New("engine path is empty")
+	}
+	for _, segment := range strings.Split(trimmed, "/") {
+		switch segment {
+		case "", ".", "..":
+			return fmt.Errorf("invalid engine path '%s': must not contain empty, '.' or '..' segments", enginePath)
+		}
+	}
+	return nil
+}
+
+// Encrypt takes a SOPS data key, encrypts it with the Vault transit backend
+// using the token of the given options, and stores the result in the
+// EncryptedKey field of the key.
+//
+// It is the counterpart of hcvault.MasterKey.Encrypt, allowing the
+// configuration of the authentication.
+func Encrypt(ctx context.Context, key *hcvault.MasterKey, opts ClientOptions, dataKey []byte) error {
+	if err := ValidateEnginePath(key.EnginePath); err != nil {
+		return fmt.Errorf("failed to encrypt sops data key to Vault transit backend: %w", err)
+	}
+	b := newBackend(key, opts, "encrypt")
+	secret, err := write(ctx, key.VaultAddress, b, map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(dataKey),
+	}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt sops data key to Vault transit backend %s: %w", b, err)
+	}
+	encryptedKey, err := encryptedKeyFromSecret(secret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt sops data key to Vault transit backend %s: %w", b, err)
+	}
+	key.EncryptedKey = encryptedKey
+	return nil
+}
+
+// Decrypt decrypts the EncryptedKey field of the key with the Vault transit
+// backend using the token of the given options, and returns the result.
+//
+// It is the counterpart of hcvault.MasterKey.Decrypt, allowing the
+// configuration of the authentication.
+func Decrypt(ctx context.Context, key *hcvault.MasterKey, opts ClientOptions) ([]byte, error) {
+	if err := ValidateEnginePath(key.EnginePath); err != nil {
+		return nil, fmt.Errorf("failed to decrypt sops data key from Vault transit backend: %w", err)
+	}
+	b := newBackend(key, opts, "decrypt")
+	secret, err := write(ctx, key.VaultAddress, b, map[string]interface{}{
+		"ciphertext": key.EncryptedKey,
+	}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sops data key from Vault transit backend %s: %w", b, err)
+	}
+	dataKey, err := dataKeyFromSecret(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sops data key from Vault transit backend %s: %w", b, err)
+	}
+	return dataKey, nil
+}
+
+// write writes the data to the path of the backend of the Vault at the given
+// address, with the token of the given options. When the token was obtained with a Login
+// and permission is denied, the token is assumed to be revoked before its
+// expiry, and the write is retried once with a token of a new login.
+// A permission denied error is distinguished from a failure to log in.
+func write(ctx context.Context, address string, b backend, data map[string]interface{}, opts ClientOptions) (*api.Secret, error) {
+	client, err := newClient(address, opts.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	if b.setNamespace {
+		if b.namespace == "" {
+			client.ClearNamespace()
+		} else {
+			client.SetNamespace(b.namespace)
+		}
+	}
+	path := b.path
+	if opts.Login == nil {
+		if opts.Token != "" {
+			client.SetToken(opts.Token)
+		}
+		secret, err := client.Logical().WriteWithContext(ctx, path, data)
+		if isPermissionDenied(err) {
+			return nil, fmt.Errorf("permission denied for the configured token: %w", err)
+		}
+		return secret, err
+	}
+
+	token, err := opts.Login.Token(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(token)
+	secret, err := client.Logical().WriteWithContext(ctx, path, data)
+	if !isPermissionDenied(err) {
+		return secret, err
+	}
+
+	opts.Login.Invalidate(client, token)
+	if token, err = opts.Login.Token(ctx, client); err != nil {
+		return nil, err
+	}
+	client.SetToken(token)
+	secret, err = client.Logical().WriteWithContext(ctx, path, data)
+	if isPermissionDenied(err) {
+		return nil, fmt.Errorf("permission denied for the token obtained by login: %w", err)
+	}
+	return secret, err
+}
+
+// newClient returns a Vault client for the given address, configured with
+// the VAULT_* environment variables of the controller, and the given TLS
+// configuration if not nil.
+func newClient(address string, tlsConfig *tls.Config) (*api.Client, error) {
+	cfg := api.DefaultConfig()
+	if cfg.Error != nil {
+		return nil, fmt.Errorf("cannot create Vault client: %w", cfg.Error)
+	}
+	cfg.Address = address
+	if tlsConfig != nil {
+		transport, ok := cfg.HttpClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, errors.New("cannot create Vault client: unexpected transport")
+		}
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create Vault client: %w", err)
+	}
+	return client, nil
+}
+
+// isPermissionDenied returns if the error is a response of Vault denying
+// permission.
+func isPermissionDenied(err error) bool {
+	var respErr *api.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden
+}
+
+// encryptedKeyFromSecret returns the encrypted key from the data of the
+// given transit encrypt response.
+func encryptedKeyFromSecret(secret *api.Secret) (string, error) {
+	if secret == nil || secret.Data == nil {
+		return "", errors.New("transit backend is empty")
+	}
+	encryptedKey, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return "", errors.New("no encrypted data")
+	}
+	return encryptedKey, nil
+}
+
+// dataKeyFromSecret returns the data key from the data of the given transit
+// decrypt response.
+func dataKeyFromSecret(secret *api.Secret) ([]byte, error) {
+	if secret == nil || secret.Data == nil {
+		return nil, errors.New("transit backend is empty")
+	}
+	plaintext, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, errors.New("no decrypted data")
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return nil, errors.New("cannot decode base64 plaintext into data key bytes")
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,430 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hcvault
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/getsops/sops/v3/hcvault"
+	. "github.com/onsi/gomega"
+)
+
+func TestEncryptDecrypt_Token(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+	vault.addToken("static-token")
+
+	key := hcvault.NewMasterKey(vault.server.URL, "transit", "sops")
+	opts := ClientOptions{Token: "static-token"}
+	g.Expect(Encrypt(context.TODO(), key, opts, []byte("data-key"))).To(Succeed())
+	g.Expect(key.EncryptedKey).To(Equal("vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))))
+
+	got, err := Decrypt(context.TODO(), key, opts)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(Equal([]byte("data-key")))
+}
+
+func TestDecrypt_Error(t *testing.T) {
+	g := NewWithT(t)
+
+	vault := startFakeVault(t)
+
+	key := hcvault.NewMasterKey(vault.server.URL, "transit", "sops")
+	key.EncryptedKey = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("data-key"))
+	_, err := Decrypt(context.TODO(), key, ClientOptions{Token: "invalid-token"})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key from Vault transit backend 'transit/decrypt/sops': permission denied for the configured token"))
+	g.Expect(err.Error()).To(ContainSubstring("Code: 403"))
+
+	key.EnginePath = "transit/../sys"
+	_, err = Decrypt(context.TODO(), key, ClientOptions{Token: "invalid-token"})
+	g.Expect(err).To(MatchError("failed to decrypt sops data key from Vault transit backend: invalid engine path 'transit/../sys': must not contain empty, '.' or '..' segments"))
+}
+
+// fakeVault is an HTTP server mimicking the Vault transit backend mounted at
+// "transit" with a "sops" key, the Kubernetes, AppRole and TLS certificate
+// auth methods mounted at "kubernetes", "approle" and "cert", token renewal
+// and response unwrapping.
+// The transit backend "encrypts" by prefixing the base64 encoded plaintext.
+type fakeVault struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	tokens map[string]bool
+	logins []map[string]string
+	renews int
+	// loginTTL is the lease duration of the tokens of logins and renewals.
+	loginTTL int
+	// renewable makes the tokens of logins renewable.
+	renewable bool
+	// loginStatus is the status code of logins, if not http.StatusOK.
+	loginStatus int
+	// secretID is the secret ID accepted by AppRole logins.
+	secretID string
+	// wrappedSecretIDs are response-wrapping tokens of secret IDs, which
+	// are removed once unwrapped.
+	wrappedSecretIDs map[string]string
+}
+
+func startFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+	return startFakeVaultWithTLS(t, nil)
+}
+
+// startFakeVaultWithTLS starts a fakeVault which, when clientCAs is not nil,
+// serves TLS and verifies the client certificates with the pool, if any.
+func startFakeVaultWithTLS(t *testing.T, clientCAs *x509.CertPool) *fakeVault {
+	t.Helper()
+
+	v := &fakeVault{
+		tokens:           make(map[string]bool),
+		wrappedSecretIDs: make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/{mount}/login", v.login)
+	mux.HandleFunc("PUT /v1/auth/token/renew-self", v.renewSelf)
+	mux.HandleFunc("PUT /v1/sys/wrapping/unwrap", v.unwrap)
+	mux.HandleFunc("PUT /v1/transit/encrypt/{key}", v.transit("plaintext", "ciphertext", func(s string) string { return "vault:v1:" + s }))
+	mux.HandleFunc("PUT /v1/transit/decrypt/{key}", v.transit("ciphertext", "plaintext", func(s string) string { return strings.TrimPrefix(s, "vault:v1:") }))
+	v.server = httptest.NewUnstartedServer(mux)
+	if clientCAs != nil {
+		v.server.TLS = &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  clientCAs,
+		}
+		v.server.StartTLS()
+	} else {
+		v.server.Start()
+	}
+	t.Cleanup(v.server.Close)
+
+	// Prevent the environment of the test from configuring the client.
+	t.Setenv("VAULT_TOKEN", "")
+	t.Setenv("VAULT_NAMESPACE", "")
+	return v
+}
+
+func (v *fakeVault) addToken(token string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.tokens[token] = true
+}
+
+// revokeTokens revokes all tokens issued by the fakeVault.
+func (v *fakeVault) revokeTokens() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.tokens = make(map[string]bool)
+}
+
+func (v *fakeVault) loginRequests() []map[string]string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]map[string]string(nil), v.logins...)
+}
+
+func (v *fakeVault) renewals() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.renews
+}
+
+func (v *fakeVault) login(w http.ResponseWriter, r *http.Request) {
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The common name of the client certificate is recorded with the
+	// request, to assert the certificate used by TLS certificate logins.
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		req["client_certificate"] = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.logins = append(v.logins, req)
+	if v.loginStatus != 0 {
+		writeVaultError(w, v.loginStatus, "permission denied")
+		return
+	}
+	if r.PathValue("mount") == "approle" && req["secret_id"] != v.secretID {
+		writeVaultError(w, http.StatusBadRequest, "invalid role or secret ID")
+		return
+	}
+	if r.PathValue("mount") == "cert" && req["client_certificate"] == "" {
+		writeVaultError(w, http.StatusBadRequest, "client certificate must be supplied")
+		return
+	}
+	token := fmt.Sprintf("login-token-%d", len(v.logins))
+	v.tokens[token] = true
+	v.writeAuth(w, token)
+}
+
+func (v *fakeVault) renewSelf(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	token := r.Header.Get("X-Vault-Token")
+	if !v.tokens[token] || !v.renewable {
+		writeVaultError(w, http.StatusBadRequest, "lease is not renewable")
+		return
+	}
+	v.renews++
+	v.writeAuth(w, token)
+}
+
+func (v *fakeVault) unwrap(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	token := r.Header.Get("X-Vault-Token")
+	secretID, ok := v.wrappedSecretIDs[token]
+	if !ok {
+		writeVaultError(w, http.StatusBadRequest, "wrapping token is not valid or does not exist")
+		return
+	}
+	delete(v.wrappedSecretIDs, token)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": map[string]string{
+			"secret_id": secretID,
+		},
+	})
+}
+
+// writeAuth writes an auth response with the given token.
+// It must be called while holding the lock.
+func (v *fakeVault) writeAuth(w http.ResponseWriter, token string) {
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"auth": map[string]interface{}{
+			"client_token":   token,
+			"lease_duration": v.loginTTL,
+			"renewable":      v.renewable,
+		},
+	})
+}
+
+func (v *fakeVault) transit(in, out string, transform func(string) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v.mu.Lock()
+		valid := v.tokens[r.Header.Get("X-Vault-Token")]
+		v.mu.Unlock()
+		// The tokens are only allowed to use the "sops" key.
+		if !valid || r.PathValue("key") != "sops" {
+			writeVaultError(w, http.StatusForbidden, "permission denied")
+			return
+		}
+
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]string{
+				out: transform(req[in]),
+			},
+		})
+	}
+}
+
+func writeVaultError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string][]string{"errors": {msg}})
+}
+
+func TestDecrypt_Namespace(t *testing.T) {
+	ptr := func(s string) *string { return &s }
+
+	tests := []struct {
+		name          string
+		env           string
+		enginePath    string
+		namespace     *string
+		wantNamespace string
+		wantPath      string
+		wantErr       string
+	}{
+		{
+			name:       "no namespace",
+			enginePath: "transit",
+			wantPath:   "/v1/transit/decrypt/sops",
+		},
+		{
+			name:          "namespace embedded in engine path",
+			enginePath:    "ns1/team-a/transit",
+			wantNamespace: "ns1/team-a",
+			wantPath:      "/v1/transit/decrypt/sops",
+		},
+		{
+			name:          "configured namespace",
+			enginePath:    "transit",
+			namespace:     ptr("ns1/team-a/"),
+			wantNamespace: "ns1/team-a",
+			wantPath:      "/v1/transit/decrypt/sops",
+		},
+		{
+			name:          "configured namespace takes precedence over embedded namespace",
+			enginePath:    "team-a/transit",
+			namespace:     ptr("ns1"),
+			wantNamespace: "ns1",
+			wantPath:      "/v1/team-a/transit/decrypt/sops",
+		},
+		{
+			name:       "configured empty namespace disables embedded namespace",
+			enginePath: "team-a/transit",
+			namespace:  ptr(""),
+			wantPath:   "/v1/team-a/transit/decrypt/sops",
+		},
+		{
+			name:          "environment namespace",
+			env:           "ns1",
+			enginePath:    "transit",
+			wantNamespace: "ns1",
+			wantPath:      "/v1/transit/decrypt/sops",
+		},
+		{
+			name:          "embedded namespace takes precedence over environment namespace",
+			env:           "ns1",
+			enginePath:    "ns2/transit",
+			wantNamespace: "ns2",
+			wantPath:      "/v1/transit/decrypt/sops",
+		},
+		{
+			name:       "configured empty namespace overrides environment namespace",
+			env:        "ns1",
+			enginePath: "transit",
+			namespace:  ptr(""),
+			wantPath:   "/v1/transit/decrypt/sops",
+		},
+		{
+			name:       "nested mount path in root namespace",
+			enginePath: "/team-a/transit/",
+			namespace:  ptr(""),
+			wantPath:   "/v1/team-a/transit/decrypt/sops",
+		},
+		{
+			name:          "namespace in error",
+			enginePath:    "ns1/team-a/other",
+			wantNamespace: "ns1/team-a",
+			wantPath:      "/v1/other/decrypt/sops",
+			wantErr:       "failed to decrypt sops data key from Vault transit backend 'other/decrypt/sops' in namespace 'ns1/team-a'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var (
+				mu       sync.Mutex
+				requests [][2]string
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests = append(requests, [2]string{r.Header.Get("X-Vault-Namespace"), r.URL.Path})
+				mu.Unlock()
+				if !strings.HasPrefix(r.URL.Path, "/v1/transit/") && !strings.HasPrefix(r.URL.Path, "/v1/team-a/transit/") {
+					writeVaultError(w, http.StatusNotFound, "no handler for route")
+					return
+				}
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{
+					"data": map[string]string{
+						"plaintext": base64.StdEncoding.EncodeToString([]byte("data-key")),
+					},
+				})
+			}))
+			t.Cleanup(server.Close)
+			t.Setenv("VAULT_TOKEN", "")
+			t.Setenv("VAULT_NAMESPACE", tt.env)
+
+			key := hcvault.NewMasterKey(server.URL, tt.enginePath, "sops")
+			key.EncryptedKey = "vault:v1:ZGF0YS1rZXk="
+			got, err := Decrypt(context.TODO(), key, ClientOptions{Token: "token", Namespace: tt.namespace})
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(got).To(Equal([]byte("data-key")))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			g.Expect(requests).To(Equal([][2]string{{tt.wantNamespace, tt.wantPath}}))
+		})
+	}
+}
+
+func TestValidateEnginePath(t *testing.T) {
+	tests := []struct {
+		enginePath string
+		wantErr    string
+	}{
+		{enginePath: "transit"},
+		{enginePath: "/team-a/sops/transit/"},
+		{enginePath: "ns1/team-a/transit"},
+		{enginePath: "", wantErr: "engine path is empty"},
+		{enginePath: "/", wantErr: "engine path is empty"},
+		{enginePath: "transit/../sys", wantErr: "must not contain empty, '.' or '..' segments"},
+		{enginePath: "./transit", wantErr: "must not contain empty, '.' or '..' segments"},
+		{enginePath: "team-a//transit", wantErr: "must not contain empty, '.' or '..' segments"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.enginePath, func(t *testing.T) {
+			g := NewWithT(t)
+
+			err := ValidateEnginePath(tt.enginePath)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+		})
+	}
+}
+
+func TestSplitNamespace(t *testing.T) {
+	tests := []struct {
+		enginePath    string
+		wantNamespace string
+		wantMountPath string
+	}{
+		{enginePath: "transit", wantMountPath: "transit"},
+		{enginePath: "/transit/", wantMountPath: "transit"},
+		{enginePath: "ns1/transit", wantNamespace: "ns1", wantMountPath: "transit"},
+		{enginePath: "ns1/team-a/transit", wantNamespace: "ns1/team-a", wantMountPath: "transit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.enginePath, func(t *testing.T) {
+			g := NewWithT(t)
+
+			namespace, mountPath := SplitNamespace(tt.enginePath)
+			g.Expect(namespace).To(Equal(tt.wantNamespace))
+			g.Expect(mountPath).To(Equal(tt.wantMountPath))
+		})
+	}
+}
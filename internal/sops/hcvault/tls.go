@@ -0,0 +1,90 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hcvault
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// ParseCertificates parses the PEM encoded certificates from the given data.
+// It returns an error if the data contains no certificates, or if any of the
+// certificates can not be parsed.
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM encoded certificates found")
+	}
+	return certs, nil
+}
+
+// ParseClientCertificate parses the PEM encoded client certificate and
+// private key from the given data.
+func ParseClientCertificate(certPEM, keyPEM []byte) (tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse client certificate and key: %w", err)
+	}
+	return cert, nil
+}
+
+// TLSOptions configures the TLS connections to Vault.
+type TLSOptions struct {
+	// CACertificates are the certificates of the CAs trusted to verify the
+	// certificate of Vault. When empty, the system roots are trusted.
+	CACertificates []*x509.Certificate
+	// ClientCertificate is the certificate presented to Vault, if any.
+	ClientCertificate *tls.Certificate
+	// InsecureSkipVerify disables the verification of the certificate of
+	// Vault.
+	InsecureSkipVerify bool
+}
+
+// NewTLSConfig returns the tls.Config for the given options, or nil if the
+// options are empty.
+func NewTLSConfig(opts TLSOptions) *tls.Config {
+	if len(opts.CACertificates) == 0 && opts.ClientCertificate == nil && !opts.InsecureSkipVerify {
+		return nil
+	}
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+	if len(opts.CACertificates) > 0 {
+		cfg.RootCAs = x509.NewCertPool()
+		for _, cert := range opts.CACertificates {
+			cfg.RootCAs.AddCert(cert)
+		}
+	}
+	if opts.ClientCertificate != nil {
+		cfg.Certificates = []tls.Certificate{*opts.ClientCertificate}
+	}
+	return cfg
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hcvault
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getsops/sops/v3/hcvault"
+	. "github.com/onsi/gomega"
+)
+
+func TestDecrypt_TLS(t *testing.T) {
+	clientCertPEM, clientKeyPEM := newTestClientCertificate(t, "flux")
+	clientCert, err := ParseClientCertificate(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+
+	tests := []struct {
+		name              string
+		requireClientCert bool
+		opts              func(server *httptest.Server) TLSOptions
+		wantErr           string
+	}{
+		{
+			name: "untrusted CA",
+			opts: func(*httptest.Server) TLSOptions {
+				return TLSOptions{}
+			},
+			wantErr: "certificate signed by unknown authority",
+		},
+		{
+			name: "custom CA",
+			opts: func(server *httptest.Server) TLSOptions {
+				return TLSOptions{CACertificates: []*x509.Certificate{server.Certificate()}}
+			},
+		},
+		{
+			name: "skip verify",
+			opts: func(*httptest.Server) TLSOptions {
+				return TLSOptions{InsecureSkipVerify: true}
+			},
+		},
+		{
+			name:              "client certificate",
+			requireClientCert: true,
+			opts: func(server *httptest.Server) TLSOptions {
+				return TLSOptions{
+					CACertificates:    []*x509.Certificate{server.Certificate()},
+					ClientCertificate: &clientCert,
+				}
+			},
+		},
+		{
+			name:              "missing client certificate",
+			requireClientCert: true,
+			opts: func(server *httptest.Server) TLSOptions {
+				return TLSOptions{CACertificates: []*x509.Certificate{server.Certificate()}}
+			},
+			wantErr: "certificate required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			var (
+				mu    sync.Mutex
+				peers []string
+			)
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				for _, cert := range r.TLS.PeerCertificates {
+					peers = append(peers, cert.Subject.CommonName)
+				}
+				mu.Unlock()
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{
+					"data": map[string]string{
+						"plaintext": base64.StdEncoding.EncodeToString([]byte("data-key")),
+					},
+				})
+			}))
+			server.TLS = &tls.Config{}
+			if tt.requireClientCert {
+				server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+				server.TLS.ClientCAs = clientCAs
+			}
+			server.StartTLS()
+			t.Cleanup(server.Close)
+			t.Setenv("VAULT_CACERT", "")
+			t.Setenv("VAULT_SKIP_VERIFY", "")
+			// Prevent the client from retrying the failing requests.
+			t.Setenv("VAULT_MAX_RETRIES", "0")
+
+			key := hcvault.NewMasterKey(server.URL, "transit", "sops")
+			key.EncryptedKey = "vault:v1:ZGF0YS1rZXk="
+			got, err := Decrypt(context.TODO(), key, ClientOptions{
+				Token:     "token",
+				TLSConfig: NewTLSConfig(tt.opts(server)),
+			})
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal([]byte("data-key")))
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.requireClientCert {
+				g.Expect(peers).To(Equal([]string{"flux"}))
+			} else {
+				g.Expect(peers).To(BeEmpty())
+			}
+		})
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(NewTLSConfig(TLSOptions{})).To(BeNil())
+
+	cfg := NewTLSConfig(TLSOptions{InsecureSkipVerify: true})
+	g.Expect(cfg.InsecureSkipVerify).To(BeTrue())
+	g.Expect(cfg.RootCAs).To(BeNil())
+	g.Expect(cfg.Certificates).To(BeEmpty())
+}
+
+func TestParseCertificates(t *testing.T) {
+	certPEM, keyPEM := newTestClientCertificate(t, "flux")
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantCount int
+		wantErr   string
+	}{
+		{
+			name:      "certificate",
+			data:      certPEM,
+			wantCount: 1,
+		},
+		{
+			name:      "certificate bundle",
+			data:      append(append([]byte{}, certPEM...), certPEM...),
+			wantCount: 2,
+		},
+		{
+			name:    "no certificates",
+			data:    keyPEM,
+			wantErr: "no PEM encoded certificates found",
+		},
+		{
+			name:    "invalid certificate",
+			data:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("invalid")}),
+			wantErr: "failed to parse certificate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := ParseCertificates(tt.data)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(HaveLen(tt.wantCount))
+		})
+	}
+}
+
+func TestParseClientCertificate(t *testing.T) {
+	g := NewWithT(t)
+
+	certPEM, keyPEM := newTestClientCertificate(t, "flux")
+	_, otherKeyPEM := newTestClientCertificate(t, "other")
+
+	cert, err := ParseClientCertificate(certPEM, keyPEM)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(cert.Leaf.Subject.CommonName).To(Equal("flux"))
+
+	_, err = ParseClientCertificate(certPEM, otherKeyPEM)
+	g.Expect(err).To(MatchError(ContainSubstring("failed to parse client certificate and key: tls: private key does not match public key")))
+}
+
+// newTestClientCertificate returns a PEM encoded self-signed client
+// certificate with the given common name, and its private key.
+func newTestClientCertificate(t *testing.T, commonName string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
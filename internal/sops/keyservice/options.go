@@ -17,14 +17,21 @@ limitations under the License.
 package keyservice
 
 import (
+	"crypto/tls"
+	"time"
+
 	extage "filippo.io/age"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/getsops/sops/v3/age"
 	"github.com/getsops/sops/v3/azkv"
-	"github.com/getsops/sops/v3/gcpkms"
 	"github.com/getsops/sops/v3/hcvault"
 	"github.com/getsops/sops/v3/keyservice"
 	awskms "github.com/getsops/sops/v3/kms"
 	"github.com/getsops/sops/v3/pgp"
+
+	inthcvault "github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
 )
 
 // ServerOption is some configuration that modifies the Server.
@@ -49,6 +56,39 @@ func (o WithVaultToken) ApplyToServer(s *Server) {
 	s.vaultToken = hcvault.Token(o)
 }
 
+// WithVaultNamespace configures the Hashicorp Vault Enterprise namespace on
+// the Server, taking precedence over a namespace embedded in the engine path
+// of the keys. An empty namespace configures the root namespace.
+type WithVaultNamespace string
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithVaultNamespace) ApplyToServer(s *Server) {
+	namespace := string(o)
+	s.vaultNamespace = &namespace
+}
+
+// WithVaultTLSConfig configures the TLS configuration of the connections to
+// Hashicorp Vault on the Server.
+type WithVaultTLSConfig struct {
+	Config *tls.Config
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithVaultTLSConfig) ApplyToServer(s *Server) {
+	s.vaultTLSConfig = o.Config
+}
+
+// WithVaultLogin configures the login to Hashicorp Vault on the Server,
+// taking precedence over WithVaultToken.
+type WithVaultLogin struct {
+	Login *inthcvault.Login
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithVaultLogin) ApplyToServer(s *Server) {
+	s.vaultLogin = o.Login
+}
+
 // WithAgeIdentities configures the parsed age identities on the Server.
 type WithAgeIdentities []extage.Identity
 
@@ -59,12 +99,73 @@ func (o WithAgeIdentities) ApplyToServer(s *Server) {
 
 // WithAWSKeys configures the AWS credentials on the Server
 type WithAWSKeys struct {
-	CredsProvider *awskms.CredentialsProvider
+	CredsProvider aws.CredentialsProvider
+	// IgnoreKeyRole disables assuming the role of the keys, as the
+	// CredsProvider assumes a role which takes precedence.
+	IgnoreKeyRole bool
 }
 
 // ApplyToServer applies this configuration to the given Server.
 func (o WithAWSKeys) ApplyToServer(s *Server) {
 	s.awsCredsProvider = o.CredsProvider
+	s.awsIgnoreKeyRole = o.IgnoreKeyRole
+}
+
+// WithAWSEndpoints configures the URLs of the AWS KMS and STS endpoints on
+// the Server. An empty URL results in the endpoint being resolved for the
+// region of the keys.
+type WithAWSEndpoints struct {
+	KMS string
+	STS string
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAWSEndpoints) ApplyToServer(s *Server) {
+	s.awsKMSEndpoint = o.KMS
+	s.awsSTSEndpoint = o.STS
+}
+
+// WithAWSRegion configures the region of the AWS KMS requests on the
+// Server, overriding the region of the key ARNs.
+type WithAWSRegion string
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAWSRegion) ApplyToServer(s *Server) {
+	s.awsRegion = string(o)
+}
+
+// WithAWSReplicaRegions configures the regions of the replicas of AWS KMS
+// multi-region keys on the Server, to which decryption fails over when it
+// fails in the region of the key. OnFailover is called for every successful
+// failover.
+type WithAWSReplicaRegions struct {
+	Regions    []string
+	OnFailover func(key *awskms.MasterKey, region string, err error)
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAWSReplicaRegions) ApplyToServer(s *Server) {
+	s.awsReplicaRegions = o.Regions
+	s.awsRegionFailover = o.OnFailover
+}
+
+// WithAWSRequiredContext configures the encryption context AWS KMS keys must
+// have to be decrypted on the Server.
+type WithAWSRequiredContext map[string]string
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAWSRequiredContext) ApplyToServer(s *Server) {
+	s.awsRequiredContext = o
+}
+
+// WithAWSProxyURL configures the URL of the proxy for AWS KMS requests on
+// the Server, instead of the proxy configured with the environment
+// variables.
+type WithAWSProxyURL string
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAWSProxyURL) ApplyToServer(s *Server) {
+	s.awsProxyURL = string(o)
 }
 
 // WithGCPCredsJSON configures the GCP service account credentials JSON on the
@@ -73,12 +174,32 @@ type WithGCPCredsJSON []byte
 
 // ApplyToServer applies this configuration to the given Server.
 func (o WithGCPCredsJSON) ApplyToServer(s *Server) {
-	s.gcpCredsJSON = gcpkms.CredentialJSON(o)
+	s.gcpCredsJSON = o
+}
+
+// WithGCPImpersonationChain configures the chain of GCP service accounts
+// impersonated for GCP KMS requests on the Server, ending with the service
+// account used for the requests.
+type WithGCPImpersonationChain []string
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithGCPImpersonationChain) ApplyToServer(s *Server) {
+	s.gcpImpersonationChain = o
+}
+
+// WithGCPEndpoint configures the host and optional port of the GCP KMS
+// endpoint on the Server. An empty endpoint results in the default endpoint
+// being used.
+type WithGCPEndpoint string
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithGCPEndpoint) ApplyToServer(s *Server) {
+	s.gcpKMSEndpoint = string(o)
 }
 
 // WithAzureToken configures the Azure credential token on the Server.
 type WithAzureToken struct {
-	Token *azkv.TokenCredential
+	Token azcore.TokenCredential
 }
 
 // ApplyToServer applies this configuration to the given Server.
@@ -86,6 +207,49 @@ func (o WithAzureToken) ApplyToServer(s *Server) {
 	s.azureToken = o.Token
 }
 
+// WithAzureTransport configures the transport for Azure Key Vault requests
+// on the Server.
+type WithAzureTransport struct {
+	Transport policy.Transporter
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureTransport) ApplyToServer(s *Server) {
+	s.azureTransport = o.Transport
+}
+
+// WithAzureVaultDNSSuffixes configures the DNS suffixes of Azure Key Vaults
+// allowed in addition to the default suffixes of the Azure clouds on the
+// Server.
+type WithAzureVaultDNSSuffixes []string
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureVaultDNSSuffixes) ApplyToServer(s *Server) {
+	s.azureVaultDNSSuffixes = o
+}
+
+// WithAzureLatestKeyVersionFallback enables the fallback to the latest
+// version of an Azure Key Vault key on the Server, when the version used to
+// encrypt the data key is disabled or not found. OnFallback is called for
+// every successful fallback.
+type WithAzureLatestKeyVersionFallback struct {
+	OnFallback func(key *azkv.MasterKey, err error)
+}
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureLatestKeyVersionFallback) ApplyToServer(s *Server) {
+	s.azureLatestKeyVersionFallback = o.OnFallback
+}
+
+// WithAzureTimeout configures the timeout for Azure Key Vault requests,
+// including retries, on the Server.
+type WithAzureTimeout time.Duration
+
+// ApplyToServer applies this configuration to the given Server.
+func (o WithAzureTimeout) ApplyToServer(s *Server) {
+	s.azureTimeout = time.Duration(o)
+}
+
 // WithDefaultServer configures the fallback default server on the Server.
 type WithDefaultServer struct {
 	Server keyservice.KeyServiceServer
@@ -0,0 +1,195 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keyservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// remoteRequestTimeout is the maximum duration of a request to a remote key
+// service.
+const remoteRequestTimeout = 30 * time.Second
+
+// RemoteError is returned by a RemoteClient when a request to the remote
+// key service fails.
+type RemoteError struct {
+	// Address is the address of the remote key service.
+	Address string
+	// Err is the error returned by the gRPC client.
+	Err error
+}
+
+// Error returns the error message of the RemoteError.
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("key service '%s': %s", e.Address, e.Err)
+}
+
+// Unwrap returns the error returned by the gRPC client.
+func (e *RemoteError) Unwrap() error {
+	return e.Err
+}
+
+// Unavailable returns if the request failed because the remote key service
+// could not be reached.
+func (e *RemoteError) Unavailable() bool {
+	return isUnavailable(e.Err)
+}
+
+// RemoteClient is a keyservice.KeyServiceClient forwarding requests to a
+// remote SOPS key service over gRPC, e.g. a daemon with access to an HSM
+// which exposes the key service API on a Unix socket. The connection is
+// established on the first request, re-established when lost, and can be
+// shared by all Decryptors.
+//
+// A transition of the remote key service to unavailable and back is logged,
+// while the errors of the requests are returned as a RemoteError.
+type RemoteClient struct {
+	address string
+	conn    *grpc.ClientConn
+	client  keyservice.KeyServiceClient
+
+	mu          sync.Mutex
+	unavailable bool
+}
+
+// ParseRemoteAddress parses the address of a remote key service in the form
+// of 'unix:///path/to/socket' or 'tcp://host:port', as accepted by the
+// '--keyservice' flag of SOPS, into a gRPC target.
+func ParseRemoteAddress(address string) (string, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid key service address '%s': %w", address, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		if u.Host != "" || path == "" {
+			return "", fmt.Errorf("invalid key service address '%s': must be in the form of 'unix:///path/to/socket'", address)
+		}
+		return "unix://" + path, nil
+	case "tcp":
+		if u.Host == "" || u.Port() == "" || (u.Path != "" && u.Path != "/") {
+			return "", fmt.Errorf("invalid key service address '%s': must be in the form of 'tcp://host:port'", address)
+		}
+		return "passthrough:///" + u.Host, nil
+	default:
+		return "", fmt.Errorf("invalid key service address '%s': unsupported scheme '%s', must be 'unix' or 'tcp'", address, u.Scheme)
+	}
+}
+
+// NewRemoteClient returns a new RemoteClient for the remote key service at
+// the given address, see ParseRemoteAddress. The connection is not
+// established until the first request. It returns an error if the address
+// is invalid.
+//
+// As with SOPS, the connection is not encrypted, and is therefore expected
+// to stay within the Pod, e.g. over a Unix socket on a shared volume.
+func NewRemoteClient(address string) (*RemoteClient, error) {
+	target, err := ParseRemoteAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key service client for '%s': %w", address, err)
+	}
+	return &RemoteClient{
+		address: address,
+		conn:    conn,
+		client:  keyservice.NewKeyServiceClient(conn),
+	}, nil
+}
+
+// Address returns the address of the remote key service.
+func (c *RemoteClient) Address() string {
+	return c.address
+}
+
+// Close closes the connection to the remote key service.
+func (c *RemoteClient) Close() error {
+	return c.conn.Close()
+}
+
+// Encrypt forwards the request to the remote key service.
+func (c *RemoteClient) Encrypt(ctx context.Context, req *keyservice.EncryptRequest, opts ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteRequestTimeout)
+	defer cancel()
+	resp, err := c.client.Encrypt(ctx, req, opts...)
+	return resp, c.observe(err)
+}
+
+// Decrypt forwards the request to the remote key service.
+func (c *RemoteClient) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteRequestTimeout)
+	defer cancel()
+	resp, err := c.client.Decrypt(ctx, req, opts...)
+	return resp, c.observe(err)
+}
+
+// observe records the availability of the remote key service from the
+// result of a request, and logs any change. It returns the error of the
+// request as a RemoteError.
+func (c *RemoteClient) observe(err error) error {
+	unavailable := isUnavailable(err)
+
+	c.mu.Lock()
+	changed := c.unavailable != unavailable
+	c.unavailable = unavailable
+	c.mu.Unlock()
+
+	if changed {
+		log := ctrl.Log.WithName("sops-keyservice")
+		if unavailable {
+			log.Error(err, "SOPS key service unavailable, decrypting with the local key service only", "address", c.address)
+		} else {
+			log.Info("SOPS key service available", "address", c.address)
+		}
+	}
+	if err != nil {
+		return &RemoteError{Address: c.address, Err: err}
+	}
+	return nil
+}
+
+// isUnavailable returns if the given gRPC client error is caused by the
+// remote key service not being reachable.
+func isUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keyservice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/keyservice"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+)
+
+func TestParseRemoteAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		wantErr string
+	}{
+		{address: "unix:///var/run/sops-ks.sock", want: "unix:///var/run/sops-ks.sock"},
+		{address: "tcp://localhost:5000", want: "passthrough:///localhost:5000"},
+		{address: "tcp://127.0.0.1:5000/", want: "passthrough:///127.0.0.1:5000"},
+		{address: "unix://", wantErr: "must be in the form of 'unix:///path/to/socket'"},
+		{address: "unix://host/sock", wantErr: "must be in the form of 'unix:///path/to/socket'"},
+		{address: "tcp://localhost", wantErr: "must be in the form of 'tcp://host:port'"},
+		{address: "tcp://localhost:5000/path", wantErr: "must be in the form of 'tcp://host:port'"},
+		{address: "/var/run/sops-ks.sock", wantErr: "unsupported scheme ''"},
+		{address: "https://localhost:5000", wantErr: "unsupported scheme 'https'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := ParseRemoteAddress(tt.address)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestRemoteClient(t *testing.T) {
+	g := NewWithT(t)
+
+	const (
+		mockRecipient string = "age1lzd99uklcjnc0e7d860axevet2cz99ce9pq6tzuzd05l5nr28ams36nvun"
+		mockIdentity  string = "AGE-SECRET-KEY-1G0Q5K9TV4REQ3ZSQRMTMG8NSWQGYT0T7TZ33RAZEE0GZYVZN0APSU24RK7"
+	)
+
+	i := make(age.ParsedIdentities, 0)
+	g.Expect(i.Import(mockIdentity)).To(Succeed())
+	address, stop := newTestRemoteServer(t, NewServer(WithAgeIdentities(i)))
+
+	c, err := NewRemoteClient(address)
+	g.Expect(err).ToNot(HaveOccurred())
+	t.Cleanup(func() { _ = c.Close() })
+
+	key := KeyFromMasterKey(&age.MasterKey{Recipient: mockRecipient})
+	dataKey := []byte("some data key")
+	encResp, err := c.Encrypt(context.TODO(), &keyservice.EncryptRequest{
+		Key:       &key,
+		Plaintext: dataKey,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	decResp, err := c.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key:        &key,
+		Ciphertext: encResp.Ciphertext,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(decResp.Plaintext).To(Equal(dataKey))
+
+	// Errors of the remote key service are returned as RemoteError.
+	_, err = c.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key:        &key,
+		Ciphertext: []byte("invalid"),
+	})
+	var remoteErr *RemoteError
+	g.Expect(errors.As(err, &remoteErr)).To(BeTrue())
+	g.Expect(remoteErr.Address).To(Equal(c.Address()))
+	g.Expect(remoteErr.Unavailable()).To(BeFalse())
+
+	// The remote key service becomes unavailable.
+	stop()
+	_, err = c.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key:        &key,
+		Ciphertext: encResp.Ciphertext,
+	})
+	g.Expect(errors.As(err, &remoteErr)).To(BeTrue())
+	g.Expect(remoteErr.Unavailable()).To(BeTrue())
+	g.Expect(err.Error()).To(ContainSubstring("key service '%s'", c.Address()))
+}
+
+// newTestRemoteServer serves the given key service server on a Unix socket
+// until the returned stop function is called or the test ends. It returns
+// the address of the socket.
+func newTestRemoteServer(t *testing.T, server keyservice.KeyServiceServer) (string, func()) {
+	t.Helper()
+
+	// The path of a Unix socket is limited to about 100 characters, which
+	// may be exceeded by t.TempDir().
+	dir, err := os.MkdirTemp("", "ks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	lis, err := net.Listen("unix", filepath.Join(dir, "ks.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	keyservice.RegisterKeyServiceServer(s, server)
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+	return "unix://" + lis.Addr().String(), s.Stop
+}
@@ -17,8 +17,13 @@ limitations under the License.
 package keyservice
 
 import (
+	"crypto/tls"
 	"fmt"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/getsops/sops/v3/age"
 	"github.com/getsops/sops/v3/azkv"
 	"github.com/getsops/sops/v3/gcpkms"
@@ -29,9 +34,20 @@ import (
 	"github.com/getsops/sops/v3/pgp"
 	"golang.org/x/net/context"
 
+	intawskms "github.com/fluxcd/kustomize-controller/internal/sops/awskms"
 	intazkv "github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+	intgcpkms "github.com/fluxcd/kustomize-controller/internal/sops/gcpkms"
+	inthcvault "github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
 )
 
+// ambientAzureCredentialsMsg is the message used to wrap Azure Key Vault
+// errors which occurred while using the ambient credentials of the controller.
+const ambientAzureCredentialsMsg = "no Azure credentials were provided in the decryption Secret (or no secretRef was configured), " +
+	"attempted ambient credentials (environment, workload identity, managed identity)"
+
+const ambientGCPCredentialsMsg = "no GCP credentials were provided in the decryption Secret (or no secretRef was configured), " +
+	"attempted ambient credentials (GOOGLE_CREDENTIALS, Application Default Credentials, workload identity)"
+
 // Server is a key service server that uses SOPS MasterKeys to fulfill
 // requests. It intercepts Encrypt and Decrypt requests made for key types
 // that need to run in a contained environment, instead of the default
@@ -54,20 +70,100 @@ type Server struct {
 	// When empty, the request will be handled by defaultServer.
 	vaultToken hcvault.Token
 
+	// vaultLogin logs in to Hashicorp Vault to obtain the token used for
+	// Encrypt and Decrypt operations, and takes precedence over vaultToken.
+	// When nil, and none of the other Vault options are configured, the
+	// request will be handled by defaultServer, see handlesVault.
+	vaultLogin *inthcvault.Login
+
+	// vaultNamespace is the Vault Enterprise namespace used for Encrypt and
+	// Decrypt operations of Hashicorp Vault requests.
+	// When nil, the namespace embedded in the engine path of the key is used.
+	vaultNamespace *string
+
+	// vaultTLSConfig is the TLS configuration of the connections for
+	// Encrypt and Decrypt operations of Hashicorp Vault requests.
+	// When nil, the VAULT_* environment variables of the controller are used.
+	vaultTLSConfig *tls.Config
+
 	// azureToken is the credential token used for Encrypt and Decrypt
 	// operations of Azure Key Vault requests.
-	// When nil, the request will be handled by defaultServer.
-	azureToken *azkv.TokenCredential
+	// When nil, the ambient credentials of the controller are used.
+	azureToken azcore.TokenCredential
+
+	// azureTransport is the transport used for Encrypt and Decrypt
+	// operations of Azure Key Vault requests.
+	// When nil, a transport honoring the proxy environment variables is used.
+	azureTransport policy.Transporter
+
+	// azureVaultDNSSuffixes are the DNS suffixes of Azure Key Vaults allowed
+	// for Encrypt and Decrypt operations, in addition to the
+	// intazkv.DefaultVaultDNSSuffixes.
+	azureVaultDNSSuffixes []string
+
+	// azureLatestKeyVersionFallback is called when an Azure Key Vault
+	// Decrypt operation falls back to the latest version of the key.
+	// When nil, no fallback is attempted.
+	azureLatestKeyVersionFallback func(key *azkv.MasterKey, err error)
+
+	// azureTimeout is the timeout for Encrypt and Decrypt operations of
+	// Azure Key Vault requests, including retries.
+	// When zero, no timeout is applied.
+	azureTimeout time.Duration
 
 	// awsCredsProvider is the Credentials object used for Encrypt and Decrypt
 	// operations of AWS KMS requests.
-	// When nil, the request will be handled by defaultServer.
-	awsCredsProvider *awskms.CredentialsProvider
+	// When nil, the default credential chain of the controller is used.
+	awsCredsProvider aws.CredentialsProvider
+
+	// awsIgnoreKeyRole disables assuming the role of the key for Encrypt and
+	// Decrypt operations of AWS KMS requests, as the awsCredsProvider assumes
+	// a role which takes precedence.
+	awsIgnoreKeyRole bool
+
+	// awsKMSEndpoint and awsSTSEndpoint are the URLs of the KMS and STS
+	// endpoints used for Encrypt and Decrypt operations of AWS KMS requests.
+	// When empty, the endpoints are resolved for the region of the key.
+	awsKMSEndpoint string
+	awsSTSEndpoint string
+
+	// awsRegion overrides the region of the key for Encrypt and Decrypt
+	// operations of AWS KMS requests.
+	// When empty, the region of the key ARN is used.
+	awsRegion string
+
+	// awsReplicaRegions are the regions of the replicas of multi-region keys
+	// to which Decrypt operations of AWS KMS requests fail over.
+	awsReplicaRegions []string
+
+	// awsRegionFailover is called when a Decrypt operation of AWS KMS
+	// requests succeeds in one of the awsReplicaRegions.
+	awsRegionFailover func(key *awskms.MasterKey, region string, err error)
+
+	// awsRequiredContext is the encryption context the keys must have for
+	// Decrypt operations of AWS KMS requests.
+	awsRequiredContext map[string]string
+
+	// awsProxyURL is the URL of the proxy used for Encrypt and Decrypt
+	// operations of AWS KMS requests.
+	// When empty, the proxy environment variables are honored.
+	awsProxyURL string
 
 	// gcpCredsJSON is the JSON credentials used for Decrypt and Encrypt
-	// operations of GCP KMS requests. When nil, a default client with
-	// environmental runtime settings will be used.
-	gcpCredsJSON gcpkms.CredentialJSON
+	// operations of GCP KMS requests.
+	// When nil, the ambient credentials of the controller are used.
+	gcpCredsJSON []byte
+
+	// gcpImpersonationChain is the chain of service accounts impersonated
+	// with the credentials for Decrypt and Encrypt operations of GCP KMS
+	// requests.
+	// When empty, the credentials are used directly.
+	gcpImpersonationChain []string
+
+	// gcpKMSEndpoint is the endpoint used for Decrypt and Encrypt operations
+	// of GCP KMS requests.
+	// When empty, the default endpoint is used.
+	gcpKMSEndpoint string
 
 	// defaultServer is the fallback server, used to handle any request that
 	// is not eligible to be handled by this Server.
@@ -119,7 +215,7 @@ func (ks Server) Encrypt(ctx context.Context, req *keyservice.EncryptRequest) (*
 			Ciphertext: ciphertext,
 		}, nil
 	case *keyservice.Key_VaultKey:
-		if ks.vaultToken != "" {
+		if ks.handlesVault() {
 			ciphertext, err := ks.encryptWithHCVault(k.VaultKey, req.Plaintext)
 			if err != nil {
 				return nil, err
@@ -160,7 +256,9 @@ func (ks Server) Encrypt(ctx context.Context, req *keyservice.EncryptRequest) (*
 }
 
 // Decrypt takes a decrypt request and decrypts the provided ciphertext with
-// the provided key, returning the decrypted result.
+// the provided key, returning the decrypted result. The decrypted data key
+// is not retained by the Server, and should be wiped by the caller once
+// used, see securebytes.Wipe.
 func (ks Server) Decrypt(ctx context.Context, req *keyservice.DecryptRequest) (*keyservice.DecryptResponse, error) {
 	key := req.Key
 	switch k := key.KeyType.(type) {
@@ -181,7 +279,7 @@ func (ks Server) Decrypt(ctx context.Context, req *keyservice.DecryptRequest) (*
 			Plaintext: plaintext,
 		}, nil
 	case *keyservice.Key_VaultKey:
-		if ks.vaultToken != "" {
+		if ks.handlesVault() {
 			plaintext, err := ks.decryptWithHCVault(k.VaultKey, req.Ciphertext)
 			if err != nil {
 				return nil, err
@@ -275,8 +373,7 @@ func (ks *Server) encryptWithHCVault(key *keyservice.VaultKey, plaintext []byte)
 		EnginePath:   key.EnginePath,
 		KeyName:      key.KeyName,
 	}
-	ks.vaultToken.ApplyToMasterKey(&vaultKey)
-	if err := vaultKey.Encrypt(plaintext); err != nil {
+	if err := inthcvault.Encrypt(context.Background(), &vaultKey, ks.getVaultClientOptions(), plaintext); err != nil {
 		return nil, err
 	}
 	return []byte(vaultKey.EncryptedKey), nil
@@ -289,17 +386,29 @@ func (ks *Server) decryptWithHCVault(key *keyservice.VaultKey, ciphertext []byte
 		KeyName:      key.KeyName,
 	}
 	vaultKey.EncryptedKey = string(ciphertext)
-	ks.vaultToken.ApplyToMasterKey(&vaultKey)
-	plaintext, err := vaultKey.Decrypt()
-	return plaintext, err
+	return inthcvault.Decrypt(context.Background(), &vaultKey, ks.getVaultClientOptions())
+}
+
+// handlesVault returns if the Server is configured to handle Hashicorp
+// Vault requests, rather than the defaultServer.
+func (ks *Server) handlesVault() bool {
+	return ks.vaultToken != "" || ks.vaultLogin != nil || ks.vaultNamespace != nil || ks.vaultTLSConfig != nil
+}
+
+// getVaultClientOptions returns the options for the Hashicorp Vault client,
+// with the token or login, namespace and TLS configuration of the Server.
+func (ks *Server) getVaultClientOptions() inthcvault.ClientOptions {
+	return inthcvault.ClientOptions{
+		Token:     string(ks.vaultToken),
+		Login:     ks.vaultLogin,
+		Namespace: ks.vaultNamespace,
+		TLSConfig: ks.vaultTLSConfig,
+	}
 }
 
 func (ks *Server) encryptWithAWSKMS(key *keyservice.KmsKey, plaintext []byte) ([]byte, error) {
 	awsKey := kmsKeyToMasterKey(key)
-	if ks.awsCredsProvider != nil {
-		ks.awsCredsProvider.ApplyToMasterKey(&awsKey)
-	}
-	if err := awsKey.Encrypt(plaintext); err != nil {
+	if err := intawskms.Encrypt(context.Background(), &awsKey, ks.getAWSClientOptions(), plaintext); err != nil {
 		return nil, err
 	}
 	return []byte(awsKey.EncryptedKey), nil
@@ -308,10 +417,23 @@ func (ks *Server) encryptWithAWSKMS(key *keyservice.KmsKey, plaintext []byte) ([
 func (ks *Server) decryptWithAWSKMS(key *keyservice.KmsKey, cipherText []byte) ([]byte, error) {
 	awsKey := kmsKeyToMasterKey(key)
 	awsKey.EncryptedKey = string(cipherText)
-	if ks.awsCredsProvider != nil {
-		ks.awsCredsProvider.ApplyToMasterKey(&awsKey)
+	return intawskms.Decrypt(context.Background(), &awsKey, ks.getAWSClientOptions())
+}
+
+// getAWSClientOptions returns the options for the AWS KMS client, with the
+// configured AWS credentials, endpoints and proxy.
+func (ks *Server) getAWSClientOptions() intawskms.ClientOptions {
+	return intawskms.ClientOptions{
+		CredentialsProvider: ks.awsCredsProvider,
+		IgnoreKeyRole:       ks.awsIgnoreKeyRole,
+		KMSEndpoint:         ks.awsKMSEndpoint,
+		STSEndpoint:         ks.awsSTSEndpoint,
+		Region:              ks.awsRegion,
+		ReplicaRegions:      ks.awsReplicaRegions,
+		OnRegionFailover:    ks.awsRegionFailover,
+		RequiredContext:     ks.awsRequiredContext,
+		ProxyURL:            ks.awsProxyURL,
 	}
-	return awsKey.Decrypt()
 }
 
 func (ks *Server) encryptWithAzureKeyVault(key *keyservice.AzureKeyVaultKey, plaintext []byte) ([]byte, error) {
@@ -320,18 +442,20 @@ func (ks *Server) encryptWithAzureKeyVault(key *keyservice.AzureKeyVaultKey, pla
 		Name:     key.Name,
 		Version:  key.Version,
 	}
-	if ks.azureToken == nil {
-		// Ensure we use the default token credential if none is provided
-		// _without_ shelling out to `az`.
-		defaultToken, err := intazkv.DefaultTokenCredential()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get Azure token credential to encrypt data: %w", err)
-		}
-		azkv.NewTokenCredential(defaultToken).ApplyToMasterKey(&azureKey)
-	} else {
-		ks.azureToken.ApplyToMasterKey(&azureKey)
+	token, ambient, err := ks.getAzureToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Azure token credential to encrypt data: %w", err)
+	}
+	opts, err := ks.getAzureClientOptions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct Azure transport to encrypt data: %w", err)
 	}
-	if err := azureKey.Encrypt(plaintext); err != nil {
+	ctx, cancel := ks.azureContext()
+	defer cancel()
+	if err := intazkv.Encrypt(ctx, &azureKey, token, opts, plaintext); err != nil {
+		if ambient {
+			return nil, fmt.Errorf("%s: %w", ambientAzureCredentialsMsg, err)
+		}
 		return nil, err
 	}
 	return []byte(azureKey.EncryptedKey), nil
@@ -339,32 +463,81 @@ func (ks *Server) encryptWithAzureKeyVault(key *keyservice.AzureKeyVaultKey, pla
 
 func (ks *Server) decryptWithAzureKeyVault(key *keyservice.AzureKeyVaultKey, ciphertext []byte) ([]byte, error) {
 	azureKey := azkv.MasterKey{
-		VaultURL: key.VaultUrl,
-		Name:     key.Name,
-		Version:  key.Version,
+		VaultURL:     key.VaultUrl,
+		Name:         key.Name,
+		Version:      key.Version,
+		EncryptedKey: string(ciphertext),
+	}
+	token, ambient, err := ks.getAzureToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Azure token credential to decrypt data: %w", err)
+	}
+	opts, err := ks.getAzureClientOptions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct Azure transport to decrypt data: %w", err)
+	}
+	ctx, cancel := ks.azureContext()
+	defer cancel()
+	plaintext, err := intazkv.Decrypt(ctx, &azureKey, token, opts)
+	if err != nil && ambient {
+		return nil, fmt.Errorf("%s: %w", ambientAzureCredentialsMsg, err)
+	}
+	return plaintext, err
+}
+
+// getAzureToken returns the configured Azure token credential. If none is
+// configured, it falls back to the ambient credentials of the controller
+// (environment, workload identity or managed identity) _without_ shelling
+// out to `az`, and returns true.
+func (ks *Server) getAzureToken() (azcore.TokenCredential, bool, error) {
+	if ks.azureToken != nil {
+		return ks.azureToken, false, nil
 	}
-	if ks.azureToken == nil {
-		// Ensure we use the default token credential if none is provided
-		// _without_ shelling out to `az`.
-		defaultToken, err := intazkv.DefaultTokenCredential()
+	defaultToken, err := intazkv.DefaultTokenCredential()
+	if err != nil {
+		return nil, true, fmt.Errorf("%s: %w", ambientAzureCredentialsMsg, err)
+	}
+	return defaultToken, true, nil
+}
+
+// azureContext returns a context for Azure Key Vault requests, with the
+// configured timeout.
+func (ks *Server) azureContext() (context.Context, context.CancelFunc) {
+	if ks.azureTimeout > 0 {
+		return context.WithTimeout(context.Background(), ks.azureTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// getAzureClientOptions returns the options for the Azure Key Vault client,
+// with the configured Azure transport or a transport honoring the proxy
+// environment variables.
+func (ks *Server) getAzureClientOptions() (intazkv.ClientOptions, error) {
+	opts := intazkv.ClientOptions{
+		Transport:                ks.azureTransport,
+		VaultDNSSuffixes:         ks.azureVaultDNSSuffixes,
+		LatestKeyVersionFallback: ks.azureLatestKeyVersionFallback,
+	}
+	if opts.Transport == nil {
+		transport, err := intazkv.NewTransport("")
 		if err != nil {
-			return nil, fmt.Errorf("failed to get Azure token credential to decrypt data: %w", err)
+			return opts, err
 		}
-		azkv.NewTokenCredential(defaultToken).ApplyToMasterKey(&azureKey)
-	} else {
-		ks.azureToken.ApplyToMasterKey(&azureKey)
+		opts.Transport = transport
 	}
-	azureKey.EncryptedKey = string(ciphertext)
-	plaintext, err := azureKey.Decrypt()
-	return plaintext, err
+	return opts, nil
 }
 
 func (ks *Server) encryptWithGCPKMS(key *keyservice.GcpKmsKey, plaintext []byte) ([]byte, error) {
 	gcpKey := gcpkms.MasterKey{
 		ResourceID: key.ResourceId,
 	}
-	ks.gcpCredsJSON.ApplyToMasterKey(&gcpKey)
-	if err := gcpKey.Encrypt(plaintext); err != nil {
+	ctx := context.Background()
+	opts, ambient := ks.getGCPClientOptions()
+	if err := intgcpkms.Encrypt(ctx, &gcpKey, opts, plaintext); err != nil {
+		if ambient {
+			return nil, fmt.Errorf("%s: %w", ambientGCPCredentialsMsg, err)
+		}
 		return nil, err
 	}
 	return gcpKey.EncryptedDataKey(), nil
@@ -372,14 +545,33 @@ func (ks *Server) encryptWithGCPKMS(key *keyservice.GcpKmsKey, plaintext []byte)
 
 func (ks *Server) decryptWithGCPKMS(key *keyservice.GcpKmsKey, ciphertext []byte) ([]byte, error) {
 	gcpKey := gcpkms.MasterKey{
-		ResourceID: key.ResourceId,
+		ResourceID:   key.ResourceId,
+		EncryptedKey: string(ciphertext),
+	}
+	ctx := context.Background()
+	opts, ambient := ks.getGCPClientOptions()
+	plaintext, err := intgcpkms.Decrypt(ctx, &gcpKey, opts)
+	if err != nil && ambient {
+		return nil, fmt.Errorf("%s: %w", ambientGCPCredentialsMsg, err)
 	}
-	ks.gcpCredsJSON.ApplyToMasterKey(&gcpKey)
-	gcpKey.EncryptedKey = string(ciphertext)
-	plaintext, err := gcpKey.Decrypt()
 	return plaintext, err
 }
 
+// getGCPClientOptions returns the options for the GCP KMS client, with the
+// configured GCP credentials JSON. If none is configured, it falls back to
+// the ambient credentials of the controller, and returns true.
+func (ks *Server) getGCPClientOptions() (intgcpkms.ClientOptions, bool) {
+	opts := intgcpkms.ClientOptions{
+		ImpersonationChain: ks.gcpImpersonationChain,
+		Endpoint:           ks.gcpKMSEndpoint,
+	}
+	if ks.gcpCredsJSON != nil {
+		opts.CredentialsJSON = ks.gcpCredsJSON
+		return opts, false
+	}
+	return opts, true
+}
+
 func kmsKeyToMasterKey(key *keyservice.KmsKey) awskms.MasterKey {
 	ctx := make(map[string]*string)
 	for k, v := range key.Context {
@@ -19,6 +19,7 @@ package keyservice
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
@@ -32,6 +33,8 @@ import (
 	"github.com/getsops/sops/v3/pgp"
 	. "github.com/onsi/gomega"
 	"golang.org/x/net/context"
+
+	inthcvault "github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
 )
 
 func TestServer_EncryptDecrypt_PGP(t *testing.T) {
@@ -119,6 +122,44 @@ func TestServer_EncryptDecrypt_HCVault(t *testing.T) {
 	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key from Vault transit backend"))
 }
 
+func TestServer_EncryptDecrypt_HCVault_Login(t *testing.T) {
+	g := NewWithT(t)
+
+	s := NewServer(WithVaultLogin{Login: inthcvault.NewLogin(&inthcvault.KubernetesAuth{
+		Role:      "flux",
+		JWTSource: inthcvault.TokenFile(filepath.Join(t.TempDir(), "token")),
+	})})
+	key := KeyFromMasterKey(hcvault.NewMasterKey("https://example.com", "engine-path", "key-name"))
+	_, err := s.Encrypt(context.TODO(), &keyservice.EncryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to encrypt sops data key to Vault transit backend"))
+	g.Expect(err.Error()).To(ContainSubstring("failed to log in to Vault at 'https://example.com'"))
+
+	_, err = s.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key from Vault transit backend"))
+	g.Expect(err.Error()).To(ContainSubstring("failed to read ServiceAccount token"))
+}
+
+func TestServer_EncryptDecrypt_HCVault_Namespace(t *testing.T) {
+	g := NewWithT(t)
+
+	fallback := NewMockKeyServer()
+	s := NewServer(WithVaultNamespace("ns1"), WithDefaultServer{Server: fallback})
+	// Nothing listens on this port, causing the connection to be refused.
+	key := KeyFromMasterKey(hcvault.NewMasterKey("http://127.0.0.1:1", "transit", "key-name"))
+	_, err := s.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key from Vault transit backend 'transit/decrypt/key-name' in namespace 'ns1'"))
+	g.Expect(fallback.decryptReqs).To(HaveLen(0))
+}
+
 func TestServer_EncryptDecrypt_HCVault_Fallback(t *testing.T) {
 	g := NewWithT(t)
 
@@ -152,7 +193,7 @@ func TestServer_EncryptDecrypt_HCVault_Fallback(t *testing.T) {
 func TestServer_EncryptDecrypt_awskms(t *testing.T) {
 	g := NewWithT(t)
 	s := NewServer(WithAWSKeys{
-		CredsProvider: awskms.NewCredentialsProvider(credentials.StaticCredentialsProvider{}),
+		CredsProvider: credentials.StaticCredentialsProvider{},
 	})
 
 	key := KeyFromMasterKey(awskms.NewMasterKeyFromArn("arn:aws:kms:us-west-2:107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48", nil, ""))
@@ -169,12 +210,28 @@ func TestServer_EncryptDecrypt_awskms(t *testing.T) {
 	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key with AWS KMS"))
 }
 
+func TestServer_Decrypt_awskms_RequiredContext(t *testing.T) {
+	g := NewWithT(t)
+	s := NewServer(WithAWSKeys{
+		CredsProvider: credentials.StaticCredentialsProvider{},
+	}, WithAWSRequiredContext{"tenant": "team-a"})
+
+	encryptionContext := "team-b"
+	key := KeyFromMasterKey(awskms.NewMasterKeyFromArn("arn:aws:kms:us-west-2:107501996527:key/612d5f0p-p1l3-45e6-aca6-a5b005693a48",
+		map[string]*string{"tenant": &encryptionContext}, ""))
+	_, err := s.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("key 'tenant' has value 'team-b' instead of 'team-a'"))
+}
+
 func TestServer_EncryptDecrypt_azkv(t *testing.T) {
 	g := NewWithT(t)
 
 	identity, err := azidentity.NewDefaultAzureCredential(nil)
 	g.Expect(err).ToNot(HaveOccurred())
-	s := NewServer(WithAzureToken{Token: azkv.NewTokenCredential(identity)})
+	s := NewServer(WithAzureToken{Token: identity})
 
 	key := KeyFromMasterKey(azkv.NewMasterKey("", "", ""))
 	_, err = s.Encrypt(context.TODO(), &keyservice.EncryptRequest{
@@ -191,6 +248,44 @@ func TestServer_EncryptDecrypt_azkv(t *testing.T) {
 
 }
 
+func TestServer_EncryptDecrypt_azkv_AmbientCredentials(t *testing.T) {
+	g := NewWithT(t)
+
+	s := NewServer()
+
+	key := KeyFromMasterKey(azkv.NewMasterKey("", "", ""))
+	_, err := s.Encrypt(context.TODO(), &keyservice.EncryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("no secretRef was configured"))
+	g.Expect(err.Error()).To(ContainSubstring("attempted ambient credentials"))
+	g.Expect(err.Error()).To(ContainSubstring("failed to encrypt sops data key with Azure Key Vault"))
+
+	_, err = s.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("no secretRef was configured"))
+	g.Expect(err.Error()).To(ContainSubstring("attempted ambient credentials"))
+	g.Expect(err.Error()).To(ContainSubstring("failed to decrypt sops data key with Azure Key Vault"))
+}
+
+func TestServer_EncryptDecrypt_azkv_ConfiguredCredentials(t *testing.T) {
+	g := NewWithT(t)
+
+	identity, err := azidentity.NewClientSecretCredential("some-tenant-id", "some-client-id", "some-client-secret", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	s := NewServer(WithAzureToken{Token: identity})
+
+	key := KeyFromMasterKey(azkv.NewMasterKey("", "", ""))
+	_, err = s.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).ToNot(ContainSubstring("attempted ambient credentials"))
+}
+
 func TestServer_EncryptDecrypt_gcpkms(t *testing.T) {
 	g := NewWithT(t)
 
@@ -212,7 +307,33 @@ func TestServer_EncryptDecrypt_gcpkms(t *testing.T) {
 	})
 	g.Expect(err).To(HaveOccurred())
 	g.Expect(err.Error()).To(ContainSubstring("cannot create GCP KMS service"))
+	g.Expect(err.Error()).ToNot(ContainSubstring("attempted ambient credentials"))
+}
+
+func TestServer_EncryptDecrypt_gcpkms_AmbientCredentials(t *testing.T) {
+	g := NewWithT(t)
+
+	t.Setenv(gcpkms.SopsGoogleCredentialsEnv, "")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(t.TempDir(), "missing.json"))
+	s := NewServer()
 
+	resourceID := "projects/test-flux/locations/global/keyRings/test-flux/cryptoKeys/sops"
+	key := KeyFromMasterKey(gcpkms.NewMasterKeyFromResourceID(resourceID))
+	_, err := s.Encrypt(context.TODO(), &keyservice.EncryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("no secretRef was configured"))
+	g.Expect(err.Error()).To(ContainSubstring("attempted ambient credentials"))
+	g.Expect(err.Error()).To(ContainSubstring("failed to find GCP Application Default Credentials"))
+
+	_, err = s.Decrypt(context.TODO(), &keyservice.DecryptRequest{
+		Key: &key,
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("no secretRef was configured"))
+	g.Expect(err.Error()).To(ContainSubstring("attempted ambient credentials"))
+	g.Expect(err.Error()).To(ContainSubstring("failed to find GCP Application Default Credentials"))
 }
 
 func TestServer_EncryptDecrypt_Nil_KeyType(t *testing.T) {
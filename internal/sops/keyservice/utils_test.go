@@ -53,10 +53,16 @@ func KeyFromMasterKey(k keys.MasterKey) keyservice.Key {
 			},
 		}
 	case *awskms.MasterKey:
+		ctx := make(map[string]string)
+		for k, v := range mk.EncryptionContext {
+			ctx[k] = *v
+		}
 		return keyservice.Key{
 			KeyType: &keyservice.Key_KmsKey{
 				KmsKey: &keyservice.KmsKey{
-					Arn: mk.Arn,
+					Arn:     mk.Arn,
+					Role:    mk.Role,
+					Context: ctx,
 				},
 			},
 		}
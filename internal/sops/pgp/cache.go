@@ -0,0 +1,260 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pgp
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+
+	"github.com/getsops/sops/v3/pgp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errKeyringIncomplete is the error of a Keyring of which the import of the
+// keys did not complete.
+var errKeyringIncomplete = errors.New("import of PGP keys into GnuPG keyring did not complete")
+
+const (
+	// cacheResultHit is the value of the result label for cache hits.
+	cacheResultHit = "hit"
+	// cacheResultMiss is the value of the result label for cache misses.
+	cacheResultMiss = "miss"
+)
+
+// KeyringCache is a concurrency safe cache of GnuPG keyrings, keyed on the
+// identity of the decryption Secret the keys were imported from. This allows
+// the keyrings to be reused across reconciliations, instead of importing the
+// keys into a new GnuPG home directory every time.
+//
+// An entry is replaced when the version of its decryption Secret changes,
+// and the least recently used entry is evicted when the max size is reached.
+// Keyrings are shared by all concurrent users of the same Secret version,
+// and the GnuPG home directory of a replaced or evicted keyring is securely
+// removed once all users released it.
+//
+// A nil *KeyringCache is valid, and results in a new keyring being created
+// for every user.
+type KeyringCache struct {
+	maxSize int
+	dir     string
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	entriesGauge   prometheus.Gauge
+	requestCounter *prometheus.CounterVec
+}
+
+// Keyring is a GnuPG keyring acquired from a KeyringCache.
+type Keyring struct {
+	cache   *KeyringCache
+	id      string
+	version string
+	home    pgp.GnuPGHome
+
+	// ready is closed once the keys have been imported into the home
+	// directory, or the import failed with err.
+	ready chan struct{}
+	err   error
+
+	// refs is the number of users of the keyring, and evicted is set once
+	// the keyring has been removed from the cache. Both are guarded by the
+	// mutex of the cache.
+	refs    int
+	evicted bool
+}
+
+// NewKeyringCache returns a new KeyringCache which holds up to maxSize
+// keyrings, of which the GnuPG home directories are created in the given
+// directory, see NewGnuPGHome.
+func NewKeyringCache(maxSize int, dir string) *KeyringCache {
+	return &KeyringCache{
+		maxSize: maxSize,
+		dir:     dir,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		entriesGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gotk_pgp_keyring_cache_entries",
+			Help: "The number of GnuPG keyrings in the cache.",
+		}),
+		requestCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotk_pgp_keyring_cache_requests_total",
+			Help: "The number of GnuPG keyring cache requests, partitioned by hit or miss result.",
+		}, []string{"result"}),
+	}
+}
+
+// MustRegister registers the metrics of the cache with the given
+// prometheus.Registerer. It panics if any of the metrics can not be
+// registered.
+func (c *KeyringCache) MustRegister(r prometheus.Registerer) {
+	r.MustRegister(c.entriesGauge, c.requestCounter)
+}
+
+// Acquire returns the cached Keyring for the given id, e.g. the namespaced
+// name of a decryption Secret, if it was created for the same version, e.g.
+// the resourceVersion of the Secret. Otherwise, a new GnuPG home directory
+// is created, into which create imports the keys, and the Keyring replaces
+// any cached Keyring for the id. Concurrent calls for the same id and
+// version wait for a single call of create.
+//
+// It returns the error of create if the import fails, in which case the
+// Keyring is not cached. Release must be called on the returned Keyring
+// once the caller no longer uses it.
+func (c *KeyringCache) Acquire(id, version string, create func(home pgp.GnuPGHome) error) (*Keyring, error) {
+	if c == nil {
+		k := &Keyring{ready: make(chan struct{}), refs: 1, evicted: true}
+		created := false
+		defer func() {
+			if !created {
+				k.Release()
+			}
+		}()
+		if err := k.create("", create); err != nil {
+			return nil, err
+		}
+		created = true
+		return k, nil
+	}
+
+	c.mu.Lock()
+	var removed []*Keyring
+	if e, ok := c.entries[id]; ok {
+		k := e.Value.(*Keyring)
+		if k.version == version {
+			k.refs++
+			c.lru.MoveToFront(e)
+			c.requestCounter.WithLabelValues(cacheResultHit).Inc()
+			c.mu.Unlock()
+
+			<-k.ready
+			if k.err != nil {
+				k.Release()
+				return nil, k.err
+			}
+			return k, nil
+		}
+		removed = append(removed, c.removeElement(e)...)
+	}
+	c.requestCounter.WithLabelValues(cacheResultMiss).Inc()
+
+	k := &Keyring{cache: c, id: id, version: version, ready: make(chan struct{}), refs: 1}
+	c.entries[id] = c.lru.PushFront(k)
+	for c.lru.Len() > c.maxSize {
+		removed = append(removed, c.removeElement(c.lru.Back())...)
+	}
+	c.entriesGauge.Set(float64(c.lru.Len()))
+	c.mu.Unlock()
+
+	for _, r := range removed {
+		r.remove()
+	}
+
+	// The keyring is removed from the cache and released when the creation
+	// fails, including when create panics.
+	created := false
+	defer func() {
+		if created {
+			return
+		}
+		c.mu.Lock()
+		if e, ok := c.entries[id]; ok && e.Value == k {
+			c.removeElement(e)
+		}
+		c.mu.Unlock()
+		k.Release()
+	}()
+	if err := k.create(c.dir, create); err != nil {
+		return nil, err
+	}
+	created = true
+	return k, nil
+}
+
+// Len returns the number of entries in the cache.
+func (c *KeyringCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// removeElement removes the given element from the cache, and returns the
+// Keyring of the element if it is no longer in use and must be removed.
+// It must be called while holding the lock.
+func (c *KeyringCache) removeElement(e *list.Element) []*Keyring {
+	k := e.Value.(*Keyring)
+	c.lru.Remove(e)
+	delete(c.entries, k.id)
+	c.entriesGauge.Set(float64(c.lru.Len()))
+	k.evicted = true
+	if k.refs > 0 {
+		return nil
+	}
+	return []*Keyring{k}
+}
+
+// Home returns the GnuPG home directory of the keyring.
+func (k *Keyring) Home() pgp.GnuPGHome {
+	return k.home
+}
+
+// Release releases the keyring for the caller of Acquire. Once a keyring
+// has been released by all its users, and it is no longer cached, its
+// GnuPG home directory is removed. It is safe to call on a nil Keyring.
+func (k *Keyring) Release() {
+	if k == nil {
+		return
+	}
+	if k.cache != nil {
+		k.cache.mu.Lock()
+	}
+	k.refs--
+	remove := k.refs == 0 && k.evicted
+	if k.cache != nil {
+		k.cache.mu.Unlock()
+	}
+	if remove {
+		k.remove()
+	}
+}
+
+// create creates the GnuPG home directory of the keyring in the given
+// directory, and imports the keys into it with the given function.
+// When the function panics, the concurrent users of the keyring observe
+// errKeyringIncomplete.
+func (k *Keyring) create(dir string, create func(home pgp.GnuPGHome) error) error {
+	defer close(k.ready)
+	k.err = errKeyringIncomplete
+	home, err := NewGnuPGHome(dir)
+	if err != nil {
+		k.err = err
+		return err
+	}
+	k.home = home
+	k.err = create(home)
+	return k.err
+}
+
+// remove securely removes the GnuPG home directory of the keyring.
+func (k *Keyring) remove() {
+	_ = RemoveGnuPGHome(k.home)
+}
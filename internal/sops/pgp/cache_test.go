@@ -0,0 +1,239 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pgp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/getsops/sops/v3/pgp"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestKeyringCache_Acquire(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewKeyringCache(2, "")
+
+	var created int
+	create := func(home pgp.GnuPGHome) error {
+		created++
+		return os.WriteFile(filepath.Join(home.String(), "pubring.kbx"), []byte("keys"), 0o600)
+	}
+
+	k1, err := c.Acquire("default/sops-keys", "1", create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(k1.Home().String()).To(BeADirectory())
+	k1.Release()
+
+	k2, err := c.Acquire("default/sops-keys", "1", create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(k2).To(BeIdenticalTo(k1))
+	g.Expect(created).To(Equal(1))
+
+	// A new version of the Secret replaces the keyring, which is removed
+	// once released.
+	k3, err := c.Acquire("default/sops-keys", "2", create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(k3.Home()).ToNot(Equal(k1.Home()))
+	g.Expect(created).To(Equal(2))
+	g.Expect(k1.Home().String()).To(BeADirectory())
+	k2.Release()
+	g.Expect(k1.Home().String()).ToNot(BeAnExistingFile())
+
+	// The released keyring of the current version is kept.
+	k3.Release()
+	g.Expect(k3.Home().String()).To(BeADirectory())
+
+	_, err = c.Acquire("other/sops-keys", "1", create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(created).To(Equal(3))
+	g.Expect(c.Len()).To(Equal(2))
+
+	g.Expect(testutil.ToFloat64(c.requestCounter.WithLabelValues(cacheResultHit))).To(Equal(float64(1)))
+	g.Expect(testutil.ToFloat64(c.requestCounter.WithLabelValues(cacheResultMiss))).To(Equal(float64(3)))
+	g.Expect(testutil.ToFloat64(c.entriesGauge)).To(Equal(float64(2)))
+}
+
+func TestKeyringCache_Acquire_Eviction(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewKeyringCache(1, "")
+	create := func(pgp.GnuPGHome) error { return nil }
+
+	k1, err := c.Acquire("default/a", "1", create)
+	g.Expect(err).ToNot(HaveOccurred())
+	k1.Release()
+
+	k2, err := c.Acquire("default/b", "1", create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.Len()).To(Equal(1))
+	g.Expect(k1.Home().String()).ToNot(BeAnExistingFile())
+
+	// An evicted keyring which is in use is removed once released.
+	_, err = c.Acquire("default/c", "1", create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(k2.Home().String()).To(BeADirectory())
+	k2.Release()
+	g.Expect(k2.Home().String()).ToNot(BeAnExistingFile())
+}
+
+func TestKeyringCache_Acquire_Error(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewKeyringCache(2, "")
+
+	var home pgp.GnuPGHome
+	_, err := c.Acquire("default/sops-keys", "1", func(h pgp.GnuPGHome) error {
+		home = h
+		return errors.New("import failed")
+	})
+	g.Expect(err).To(MatchError("import failed"))
+	g.Expect(c.Len()).To(Equal(0))
+	g.Expect(home.String()).ToNot(BeAnExistingFile())
+
+	k, err := c.Acquire("default/sops-keys", "1", func(pgp.GnuPGHome) error { return nil })
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(k.Home().String()).To(BeADirectory())
+}
+
+func TestKeyringCache_Acquire_Panic(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+	c := NewKeyringCache(2, dir)
+
+	started := make(chan struct{})
+	waiterErr := make(chan error, 1)
+	go func() {
+		<-started
+		k, err := c.Acquire("default/sops-keys", "1", func(pgp.GnuPGHome) error {
+			t.Error("unexpected import by concurrent user")
+			return nil
+		})
+		if err == nil {
+			k.Release()
+		}
+		waiterErr <- err
+	}()
+
+	func() {
+		defer func() {
+			g.Expect(recover()).To(Equal("import panicked"))
+		}()
+		_, _ = c.Acquire("default/sops-keys", "1", func(home pgp.GnuPGHome) error {
+			g.Expect(os.WriteFile(filepath.Join(home.String(), "private-key"), []byte("secret"), 0o600)).To(Succeed())
+			close(started)
+			// Give the concurrent user time to wait on the keyring.
+			g.Eventually(func() float64 {
+				return testutil.ToFloat64(c.requestCounter.WithLabelValues(cacheResultHit))
+			}).Should(Equal(float64(1)))
+			panic("import panicked")
+		})
+	}()
+
+	g.Expect(<-waiterErr).To(MatchError(errKeyringIncomplete))
+	g.Expect(c.Len()).To(Equal(0))
+	g.Expect(os.ReadDir(dir)).To(BeEmpty())
+
+	k, err := c.Acquire("default/sops-keys", "1", func(pgp.GnuPGHome) error { return nil })
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(filepath.Dir(k.Home().String())).To(Equal(dir))
+	k.Release()
+}
+
+func TestKeyringCache_Acquire_Nil(t *testing.T) {
+	g := NewWithT(t)
+
+	var c *KeyringCache
+	var created int
+	create := func(pgp.GnuPGHome) error {
+		created++
+		return nil
+	}
+
+	k1, err := c.Acquire("default/sops-keys", "1", create)
+	g.Expect(err).ToNot(HaveOccurred())
+	k2, err := c.Acquire("default/sops-keys", "1", create)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(k2.Home()).ToNot(Equal(k1.Home()))
+	g.Expect(created).To(Equal(2))
+	g.Expect(c.Len()).To(Equal(0))
+
+	k1.Release()
+	g.Expect(k1.Home().String()).ToNot(BeAnExistingFile())
+	k2.Release()
+	g.Expect(k2.Home().String()).ToNot(BeAnExistingFile())
+}
+
+func TestKeyringCache_Concurrent(t *testing.T) {
+	g := NewWithT(t)
+
+	c := NewKeyringCache(2, "")
+
+	var created atomic.Int32
+	create := func(pgp.GnuPGHome) error {
+		created.Add(1)
+		return nil
+	}
+
+	keyrings := make([]*Keyring, 20)
+	var wg sync.WaitGroup
+	for i := range keyrings {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			k, err := c.Acquire("default/sops-keys", "1", create)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			keyrings[i] = k
+		}(i)
+	}
+	wg.Wait()
+
+	g.Expect(created.Load()).To(Equal(int32(1)))
+	for _, k := range keyrings {
+		g.Expect(k).To(BeIdenticalTo(keyrings[0]))
+		k.Release()
+	}
+	g.Expect(keyrings[0].refs).To(Equal(0))
+	g.Expect(testutil.ToFloat64(c.requestCounter.WithLabelValues(cacheResultHit))).To(Equal(float64(19)))
+}
+
+func TestKeyringCache_MustRegister(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := prometheus.NewRegistry()
+	c := NewKeyringCache(1, "")
+	c.MustRegister(reg)
+
+	k, err := c.Acquire("default/sops-keys", "1", func(pgp.GnuPGHome) error { return nil })
+	g.Expect(err).ToNot(HaveOccurred())
+	k.Release()
+
+	count, err := testutil.GatherAndCount(reg, "gotk_pgp_keyring_cache_entries", "gotk_pgp_keyring_cache_requests_total")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(count).To(Equal(2))
+}
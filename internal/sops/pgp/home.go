@@ -0,0 +1,67 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pgp
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/getsops/sops/v3/pgp"
+
+	"github.com/fluxcd/kustomize-controller/internal/securebytes"
+)
+
+// gnuPGHomePrefix is the prefix of the names of the GnuPG home directories
+// created by NewGnuPGHome.
+const gnuPGHomePrefix = "gnupghome-"
+
+// NewGnuPGHome creates a new GnuPG home directory in the given directory,
+// e.g. a memory-backed (tmpfs) volume to prevent private keys from being
+// written to disk. When dir is empty, the default directory for temporary
+// files is used. The directory is only accessible by the current user,
+// and should be removed with RemoveGnuPGHome.
+func NewGnuPGHome(dir string) (pgp.GnuPGHome, error) {
+	home, err := os.MkdirTemp(dir, gnuPGHomePrefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create GnuPG home directory: %w", err)
+	}
+	return pgp.GnuPGHome(home), nil
+}
+
+// RemoveGnuPGHome securely removes the given GnuPG home directory, see
+// secureRemoveAll.
+func RemoveGnuPGHome(home pgp.GnuPGHome) error {
+	if home == "" {
+		return nil
+	}
+	return secureRemoveAll(home.String())
+}
+
+// secureRemoveAll overwrites all regular files in the given directory with
+// zeros, before removing the directory. This prevents the unlocked private
+// keys from lingering on the file system after removal.
+func secureRemoveAll(dir string) error {
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			_ = securebytes.ShredFile(path)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
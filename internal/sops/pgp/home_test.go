@@ -0,0 +1,65 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pgp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestNewGnuPGHome(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+	home, err := NewGnuPGHome(dir)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(filepath.Dir(home.String())).To(Equal(dir))
+	g.Expect(home.Validate()).To(Succeed())
+
+	info, err := os.Stat(home.String())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(info.Mode().Perm()).To(Equal(os.FileMode(0o700)))
+
+	g.Expect(os.WriteFile(filepath.Join(home.String(), "pubring.kbx"), []byte("keys"), 0o600)).To(Succeed())
+	g.Expect(RemoveGnuPGHome(home)).To(Succeed())
+	g.Expect(os.ReadDir(dir)).To(BeEmpty())
+
+	_, err = NewGnuPGHome(filepath.Join(dir, "missing"))
+	g.Expect(err).To(MatchError(ContainSubstring("failed to create GnuPG home directory")))
+}
+
+func Test_secureRemoveAll(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "private-keys-v1.d", "key")
+	g.Expect(os.MkdirAll(filepath.Dir(file), 0o700)).To(Succeed())
+	g.Expect(os.WriteFile(file, []byte("secret"), 0o600)).To(Succeed())
+
+	// Keep a handle to the file, to read its contents after the removal.
+	f, err := os.Open(file)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer f.Close()
+
+	g.Expect(secureRemoveAll(dir)).To(Succeed())
+	g.Expect(dir).ToNot(BeAnExistingFile())
+	g.Expect(io.ReadAll(f)).To(Equal(make([]byte, len("secret"))))
+}
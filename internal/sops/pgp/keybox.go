@@ -0,0 +1,87 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// keyboxMagic is the magic of the header blob of a GnuPG keybox, at
+	// keyboxMagicOffset.
+	keyboxMagic       = "KBXf"
+	keyboxMagicOffset = 8
+	// keyboxBlobHeaderLen is the length of the start of a blob, consisting
+	// of its length and type.
+	keyboxBlobHeaderLen = 5
+	// keyboxBlobTypeOpenPGP is the type of a blob holding an OpenPGP
+	// keyblock.
+	keyboxBlobTypeOpenPGP = 2
+	// keyboxOpenPGPBlobMinLen is the minimal length of an OpenPGP blob,
+	// which holds the offset and length of its keyblock after its length,
+	// type, version and flags.
+	keyboxOpenPGPBlobMinLen = 16
+)
+
+// isKeybox returns if the given data is a GnuPG keybox, e.g. a
+// "pubring.kbx" file, which starts with a header blob.
+func isKeybox(data []byte) bool {
+	return len(data) >= keyboxMagicOffset+len(keyboxMagic) &&
+		string(data[keyboxMagicOffset:keyboxMagicOffset+len(keyboxMagic)]) == keyboxMagic
+}
+
+// readKeyboxKeyblocks returns the concatenated OpenPGP keyblocks of the
+// blobs of the given GnuPG keybox, in binary format. The blobs of other
+// types, such as X.509 certificates, are skipped. The caller should wipe
+// the returned data, as the keyblocks may include private keys.
+//
+// It returns an error if the keybox is truncated, or any of its blobs is
+// malformed.
+func readKeyboxKeyblocks(data []byte) ([]byte, error) {
+	var keyblocks bytes.Buffer
+	keyblocks.Grow(len(data))
+	for rest, n := data, 1; len(rest) > 0; n++ {
+		if len(rest) < keyboxBlobHeaderLen {
+			return nil, fmt.Errorf("keybox blob %d is truncated", n)
+		}
+		blobLen := binary.BigEndian.Uint32(rest)
+		if blobLen < keyboxBlobHeaderLen || uint64(blobLen) > uint64(len(rest)) {
+			return nil, fmt.Errorf("keybox blob %d has invalid length %d", n, blobLen)
+		}
+		blob := rest[:blobLen]
+		rest = rest[blobLen:]
+
+		if blob[4] != keyboxBlobTypeOpenPGP {
+			continue
+		}
+		if len(blob) < keyboxOpenPGPBlobMinLen {
+			return nil, fmt.Errorf("keybox blob %d is truncated", n)
+		}
+		offset, length := binary.BigEndian.Uint32(blob[8:]), binary.BigEndian.Uint32(blob[12:])
+		if uint64(offset)+uint64(length) > uint64(len(blob)) {
+			return nil, fmt.Errorf("keyblock of keybox blob %d exceeds the blob", n)
+		}
+		keyblocks.Write(blob[offset : offset+length])
+	}
+	if keyblocks.Len() == 0 {
+		return nil, errors.New("keybox does not contain OpenPGP keyblocks")
+	}
+	return keyblocks.Bytes(), nil
+}
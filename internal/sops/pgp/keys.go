@@ -0,0 +1,261 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pgp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+
+	"github.com/fluxcd/kustomize-controller/internal/securebytes"
+)
+
+const (
+	// armorEnd is the start of the footer line of an armored block, which
+	// ends with "-----".
+	armorEnd = "-----END PGP "
+	// armorBegin is the start of the header line of an armored block.
+	armorBegin = "-----BEGIN PGP "
+	// expectedPrivateKey describes the expected format of a key ring.
+	expectedPrivateKey = "an ASCII-armored or binary PGP private key"
+)
+
+var (
+	// ErrPassphraseMissing is returned by UnlockKeys when a private
+	// key is protected with a passphrase, and no passphrase is provided.
+	ErrPassphraseMissing = errors.New("private key is protected with a passphrase, but no passphrase is provided")
+	// ErrIncorrectPassphrase is returned by UnlockKeys when a private
+	// key can not be unlocked with the provided passphrase.
+	ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+)
+
+// FormatError is returned by ValidateKeys when the data is not a PGP key
+// ring with a private key, e.g. when a public key is
+// provided instead. Its message is phrased to follow the name of the data,
+// and does not contain the data itself.
+type FormatError struct {
+	// Found describes what was found instead of a private key.
+	Found string
+}
+
+// Error returns the error message of the FormatError.
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("contains %s, expected %s", e.Found, expectedPrivateKey)
+}
+
+// ValidateKeys returns a FormatError if the given data is not an
+// ASCII-armored or binary PGP key ring, or a GnuPG keybox, which contains at
+// least one private key. Key rings of which the private keys are stored
+// elsewhere, e.g. on a smartcard, are accepted.
+func ValidateKeys(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	kind := "PGP private key block"
+	switch {
+	case len(trimmed) == 0:
+		return &FormatError{Found: "no data"}
+	case isKeybox(data):
+		kind = "GnuPG keybox"
+	case isBinaryKeyRing(data):
+		kind = "binary PGP key ring"
+	case !bytes.Contains(trimmed, []byte(armorBegin)):
+		if bytes.Contains(bytes.ToUpper(trimmed), []byte("AGE-SECRET-KEY-1")) {
+			return &FormatError{Found: "an age identity"}
+		}
+		return &FormatError{Found: "no PGP key ring"}
+	case !bytes.Contains(trimmed, []byte(armorBegin+"PRIVATE KEY BLOCK-----")):
+		if bytes.Contains(trimmed, []byte(armorBegin+"PUBLIC KEY BLOCK-----")) {
+			return &FormatError{Found: "a PGP public key block only"}
+		}
+		return &FormatError{Found: "an armored PGP block which is not a key block"}
+	}
+
+	entities, err := readKeyRings(data)
+	if err != nil {
+		return &FormatError{Found: "a truncated or malformed " + kind}
+	}
+	for _, e := range entities {
+		if e.PrivateKey != nil {
+			return nil
+		}
+		for _, sub := range e.Subkeys {
+			if sub.PrivateKey != nil {
+				return nil
+			}
+		}
+	}
+	return &FormatError{Found: "a " + kind + " without private keys"}
+}
+
+// UnlockKeys returns the given PGP key ring, see ValidateKeys, armored and
+// with all passphrase-protected private keys unlocked with the given
+// passphrase, so that they can be imported into a GnuPG keyring and used
+// without an interactive passphrase prompt. Binary key rings and keyboxes
+// are always armored, as keyboxes can not be imported by GnuPG.
+// When an armored key ring does not contain any protected private key, or
+// a key ring can not be parsed, the data is returned as is to leave any
+// validation to the import. Otherwise, the caller should wipe the returned
+// data after the import, see securebytes.Wipe.
+//
+// It returns an error naming the fingerprint of the key if a protected key
+// can not be unlocked, wrapping ErrPassphraseMissing if no passphrase is
+// provided, or ErrIncorrectPassphrase if the passphrase is wrong.
+func UnlockKeys(data, passphrase []byte) ([]byte, error) {
+	entities, err := readKeyRings(data)
+	if err != nil || (!isProtected(entities) && !isKeybox(data) && !isBinaryKeyRing(data)) {
+		return data, nil
+	}
+
+	for _, e := range entities {
+		if !isProtected(openpgp.EntityList{e}) {
+			continue
+		}
+		fingerprint := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("PGP key '%s': %w", fingerprint, ErrPassphraseMissing)
+		}
+		if err := e.DecryptPrivateKeys(passphrase); err != nil {
+			return nil, fmt.Errorf("failed to unlock PGP key '%s': %w", fingerprint, ErrIncorrectPassphrase)
+		}
+	}
+
+	// The unlocked keys are armored in a buffer large enough to hold them
+	// without reallocation, which would leave copies behind.
+	var buf bytes.Buffer
+	buf.Grow(2 * len(data))
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entities {
+		if e.PrivateKey != nil {
+			err = e.SerializePrivateWithoutSigning(w, &packet.Config{})
+		} else {
+			err = e.Serialize(w)
+		}
+		if err != nil {
+			securebytes.Wipe(buf.Bytes())
+			return nil, fmt.Errorf("failed to serialize PGP key '%X': %w", e.PrimaryKey.Fingerprint, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		securebytes.Wipe(buf.Bytes())
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// PrivateKeyFingerprints returns the fingerprints of the primary keys and
+// subkeys of the given PGP key ring, see ValidateKeys, of which the private
+// key is included, regardless of whether they are protected with a
+// passphrase. Dummy keys of which the secret part is stored elsewhere are
+// ignored. It returns an error if the key ring can not be parsed.
+func PrivateKeyFingerprints(data []byte) ([]string, error) {
+	entities, err := readKeyRings(data)
+	if err != nil {
+		return nil, err
+	}
+	var fingerprints []string
+	for _, e := range entities {
+		if isPrivateKey(e.PrivateKey) {
+			fingerprints = append(fingerprints, fmt.Sprintf("%X", e.PrimaryKey.Fingerprint))
+		}
+		for _, sub := range e.Subkeys {
+			if isPrivateKey(sub.PrivateKey) {
+				fingerprints = append(fingerprints, fmt.Sprintf("%X", sub.PublicKey.Fingerprint))
+			}
+		}
+	}
+	return fingerprints, nil
+}
+
+// readKeyRings reads the entities of the given ASCII-armored or binary key
+// ring, or GnuPG keybox.
+func readKeyRings(data []byte) (openpgp.EntityList, error) {
+	switch {
+	case isKeybox(data):
+		keyblocks, err := readKeyboxKeyblocks(data)
+		if err != nil {
+			return nil, err
+		}
+		defer securebytes.Wipe(keyblocks)
+		return openpgp.ReadKeyRing(bytes.NewReader(keyblocks))
+	case isBinaryKeyRing(data):
+		return openpgp.ReadKeyRing(bytes.NewReader(data))
+	default:
+		return readArmoredKeyRings(data)
+	}
+}
+
+// isBinaryKeyRing returns if the given data is a binary OpenPGP key ring,
+// e.g. a "secring.gpg" file or the output of "gpg --export-secret-keys"
+// without "--armor". Its first byte is the tag of a packet, of which the
+// first bit is always set.
+func isBinaryKeyRing(data []byte) bool {
+	return len(data) > 0 && data[0]&0x80 != 0
+}
+
+// readArmoredKeyRings reads the entities of all the armored key rings in the
+// given data, as GnuPG accepts multiple concatenated armored blocks.
+func readArmoredKeyRings(data []byte) (openpgp.EntityList, error) {
+	var entities openpgp.EntityList
+	for rest := data; len(bytes.TrimSpace(rest)) > 0; {
+		block := rest
+		if i := bytes.Index(rest, []byte(armorEnd)); i >= 0 {
+			i += len(armorEnd)
+			if j := bytes.Index(rest[i:], []byte("-----")); j >= 0 {
+				block = rest[:i+j+len("-----")]
+			}
+		}
+		rest = rest[len(block):]
+
+		el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(block))
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, el...)
+	}
+	return entities, nil
+}
+
+// isProtected returns if any of the entities contains a private (sub)key
+// which is protected with a passphrase. Dummy keys of which the secret part
+// is stored elsewhere, e.g. on a smartcard, are ignored.
+func isProtected(entities openpgp.EntityList) bool {
+	for _, e := range entities {
+		if isProtectedKey(e.PrivateKey) {
+			return true
+		}
+		for _, sub := range e.Subkeys {
+			if isProtectedKey(sub.PrivateKey) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isProtectedKey(key *packet.PrivateKey) bool {
+	return isPrivateKey(key) && key.Encrypted
+}
+
+func isPrivateKey(key *packet.PrivateKey) bool {
+	return key != nil && !key.Dummy()
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2023 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	. "github.com/onsi/gomega"
+)
+
+func TestUnlockKeys(t *testing.T) {
+	plain, fingerprint := newTestKey(t, nil)
+	locked, lockedFingerprint := newTestKey(t, []byte("passphrase"))
+	public := newTestPublicKey(t)
+	plainBinary, lockedBinary := dearmor(t, plain), dearmor(t, locked)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase []byte
+		wantSame   bool
+		wantErr    error
+		wantErrMsg string
+		wantKeys   []string
+	}{
+		{
+			name:     "unprotected key",
+			data:     plain,
+			wantSame: true,
+			wantKeys: []string{fingerprint},
+		},
+		{
+			name:       "unprotected key with passphrase",
+			data:       plain,
+			passphrase: []byte("passphrase"),
+			wantSame:   true,
+			wantKeys:   []string{fingerprint},
+		},
+		{
+			name:     "public key",
+			data:     public,
+			wantSame: true,
+		},
+		{
+			name:     "invalid key",
+			data:     []byte("not-a-valid-armored-key"),
+			wantSame: true,
+		},
+		{
+			name:       "protected key",
+			data:       locked,
+			passphrase: []byte("passphrase"),
+			wantKeys:   []string{lockedFingerprint},
+		},
+		{
+			name:       "protected key without passphrase",
+			data:       locked,
+			wantErr:    ErrPassphraseMissing,
+			wantErrMsg: fmt.Sprintf("PGP key '%s'", lockedFingerprint),
+		},
+		{
+			name:       "protected key with wrong passphrase",
+			data:       locked,
+			passphrase: []byte("wrong"),
+			wantErr:    ErrIncorrectPassphrase,
+			wantErrMsg: fmt.Sprintf("failed to unlock PGP key '%s': incorrect passphrase", lockedFingerprint),
+		},
+		{
+			name:       "mix of protected and unprotected keys",
+			data:       append(append([]byte{}, plain...), locked...),
+			passphrase: []byte("passphrase"),
+			wantKeys:   []string{fingerprint, lockedFingerprint},
+		},
+		{
+			name:     "binary key",
+			data:     plainBinary,
+			wantKeys: []string{fingerprint},
+		},
+		{
+			name:       "binary key ring with protected key",
+			data:       append(append([]byte{}, plainBinary...), lockedBinary...),
+			passphrase: []byte("passphrase"),
+			wantKeys:   []string{fingerprint, lockedFingerprint},
+		},
+		{
+			name:       "binary protected key without passphrase",
+			data:       lockedBinary,
+			wantErr:    ErrPassphraseMissing,
+			wantErrMsg: fmt.Sprintf("PGP key '%s'", lockedFingerprint),
+		},
+		{
+			name:       "keybox",
+			data:       newTestKeybox(t, plainBinary, lockedBinary),
+			passphrase: []byte("passphrase"),
+			wantKeys:   []string{fingerprint, lockedFingerprint},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			got, err := UnlockKeys(tt.data, tt.passphrase)
+			if tt.wantErr != nil {
+				g.Expect(err).To(MatchError(tt.wantErr))
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErrMsg)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			if tt.wantSame {
+				g.Expect(got).To(Equal(tt.data))
+			}
+			if tt.wantKeys == nil {
+				return
+			}
+
+			entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(got))
+			g.Expect(err).ToNot(HaveOccurred())
+			var fingerprints []string
+			for _, e := range entities {
+				fingerprints = append(fingerprints, fmt.Sprintf("%X", e.PrimaryKey.Fingerprint))
+				g.Expect(isProtected(openpgp.EntityList{e})).To(BeFalse())
+				g.Expect(e.PrivateKey).ToNot(BeNil())
+			}
+			g.Expect(fingerprints).To(Equal(tt.wantKeys))
+		})
+	}
+}
+
+func TestPrivateKeyFingerprints(t *testing.T) {
+	g := NewWithT(t)
+
+	plain, fingerprint := newTestKey(t, nil)
+	locked, lockedFingerprint := newTestKey(t, []byte("passphrase"))
+
+	got, err := PrivateKeyFingerprints(append(append(append([]byte{}, plain...), locked...), newTestPublicKey(t)...))
+	g.Expect(err).ToNot(HaveOccurred())
+	// The primary key and encryption subkey of both private keys.
+	g.Expect(got).To(HaveLen(4))
+	g.Expect(got).To(ContainElements(fingerprint, lockedFingerprint))
+
+	got, err = PrivateKeyFingerprints(newTestKeybox(t, dearmor(t, plain), dearmor(t, newTestPublicKey(t))))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(got).To(HaveLen(2))
+	g.Expect(got).To(ContainElement(fingerprint))
+
+	_, err = PrivateKeyFingerprints([]byte("not-a-valid-armored-key"))
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestValidateKeys(t *testing.T) {
+	plain, _ := newTestKey(t, nil)
+	locked, _ := newTestKey(t, []byte("passphrase"))
+	public := newTestPublicKey(t)
+
+	plainBinary := dearmor(t, plain)
+	keybox := newTestKeybox(t, plainBinary)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantFound string
+	}{
+		{name: "private key", data: plain},
+		{name: "passphrase protected private key", data: locked},
+		{name: "private and public key", data: append(append([]byte{}, public...), plain...)},
+		{name: "empty", data: []byte(" \n"), wantFound: "no data"},
+		{name: "public key", data: public, wantFound: "a PGP public key block only"},
+		{name: "signature", data: []byte("-----BEGIN PGP SIGNATURE-----\n\nabc\n-----END PGP SIGNATURE-----\n"), wantFound: "an armored PGP block which is not a key block"},
+		{name: "truncated private key", data: plain[:len(plain)/2], wantFound: "a truncated or malformed PGP private key block"},
+		{name: "binary private key", data: plainBinary},
+		{name: "passphrase protected binary private key", data: dearmor(t, locked)},
+		{name: "keybox", data: keybox},
+		{name: "binary public key", data: dearmor(t, public), wantFound: "a binary PGP key ring without private keys"},
+		{name: "truncated binary private key", data: plainBinary[:len(plainBinary)/2], wantFound: "a truncated or malformed binary PGP key ring"},
+		{name: "keybox with public key", data: newTestKeybox(t, dearmor(t, public)), wantFound: "a GnuPG keybox without private keys"},
+		{name: "truncated keybox", data: keybox[:len(keybox)-8], wantFound: "a truncated or malformed GnuPG keybox"},
+		{name: "age identity", data: []byte("AGE-SECRET-KEY-1G0Q5K9TV4REQ3ZSQRMTMG8NSWQGYT0T7TZ33RAZEE0GZYVZN0APSU24RK7"), wantFound: "an age identity"},
+		{name: "plain text", data: []byte("not-a-valid-armored-key"), wantFound: "no PGP key ring"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			err := ValidateKeys(tt.data)
+			if tt.wantFound == "" {
+				g.Expect(err).ToNot(HaveOccurred())
+				return
+			}
+			var formatErr *FormatError
+			g.Expect(errors.As(err, &formatErr)).To(BeTrue())
+			g.Expect(formatErr.Found).To(Equal(tt.wantFound))
+			g.Expect(err.Error()).To(HaveSuffix("expected an ASCII-armored or binary PGP private key"))
+		})
+	}
+}
+
+// newTestKey returns a new armored PGP private key with an encryption
+// subkey, protected with the given passphrase if not empty, and its
+// fingerprint.
+func newTestKey(t *testing.T, passphrase []byte) ([]byte, string) {
+	t.Helper()
+
+	e, err := openpgp.NewEntity("Flux", "test", "flux@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passphrase) > 0 {
+		if err := e.EncryptPrivateKeys(passphrase, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SerializePrivateWithoutSigning(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+}
+
+// newTestPublicKey returns the armored PGP public key of a new key.
+func newTestPublicKey(t *testing.T) []byte {
+	t.Helper()
+
+	e, err := openpgp.NewEntity("Flux", "test", "flux@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// dearmor returns the binary data of the given armored PGP block.
+func dearmor(t *testing.T, armored []byte) []byte {
+	t.Helper()
+
+	block, err := armor.Decode(bytes.NewReader(armored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// newTestKeybox returns a GnuPG keybox with a header blob, and an OpenPGP
+// blob for each of the given binary keyblocks, followed by an X.509 blob
+// which must be skipped. The OpenPGP blobs only contain the fields read by
+// readKeyboxKeyblocks.
+func newTestKeybox(t *testing.T, keyblocks ...[]byte) []byte {
+	t.Helper()
+
+	blob := func(blobType byte, payload []byte) []byte {
+		b := make([]byte, keyboxOpenPGPBlobMinLen, keyboxOpenPGPBlobMinLen+len(payload))
+		binary.BigEndian.PutUint32(b, uint32(keyboxOpenPGPBlobMinLen+len(payload)))
+		b[4], b[5] = blobType, 1
+		binary.BigEndian.PutUint32(b[8:], keyboxOpenPGPBlobMinLen)
+		binary.BigEndian.PutUint32(b[12:], uint32(len(payload)))
+		return append(b, payload...)
+	}
+
+	header := make([]byte, 32)
+	binary.BigEndian.PutUint32(header, uint32(len(header)))
+	header[4], header[5] = 1, 1
+	copy(header[keyboxMagicOffset:], keyboxMagic)
+
+	kbx := header
+	for _, kb := range keyblocks {
+		kbx = append(kbx, blob(keyboxBlobTypeOpenPGP, kb)...)
+	}
+	return append(kbx, blob(3, []byte("x509"))...)
+}
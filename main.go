@@ -21,6 +21,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/getsops/sops/v3/keyservice"
 	flag "github.com/spf13/pflag"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -32,11 +33,13 @@ import (
 	ctrlcache "sigs.k8s.io/controller-runtime/pkg/cache"
 	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
 	ctrlcfg "sigs.k8s.io/controller-runtime/pkg/config"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
 	"github.com/fluxcd/cli-utils/pkg/kstatus/polling"
 	"github.com/fluxcd/cli-utils/pkg/kstatus/polling/clusterreader"
 	"github.com/fluxcd/cli-utils/pkg/kstatus/polling/engine"
+	"github.com/fluxcd/pkg/apis/meta"
 	"github.com/fluxcd/pkg/runtime/acl"
 	runtimeClient "github.com/fluxcd/pkg/runtime/client"
 	runtimeCtrl "github.com/fluxcd/pkg/runtime/controller"
@@ -53,7 +56,15 @@ import (
 
 	kustomizev1 "github.com/fluxcd/kustomize-controller/api/v1"
 	"github.com/fluxcd/kustomize-controller/internal/controller"
+	"github.com/fluxcd/kustomize-controller/internal/decryptor"
 	"github.com/fluxcd/kustomize-controller/internal/features"
+	intage "github.com/fluxcd/kustomize-controller/internal/sops/age"
+	intawskms "github.com/fluxcd/kustomize-controller/internal/sops/awskms"
+	intazkv "github.com/fluxcd/kustomize-controller/internal/sops/azkv"
+	intgcpkms "github.com/fluxcd/kustomize-controller/internal/sops/gcpkms"
+	inthcvault "github.com/fluxcd/kustomize-controller/internal/sops/hcvault"
+	intkeyservice "github.com/fluxcd/kustomize-controller/internal/sops/keyservice"
+	intpgp "github.com/fluxcd/kustomize-controller/internal/sops/pgp"
 	"github.com/fluxcd/kustomize-controller/internal/statusreaders"
 	// +kubebuilder:scaffold:imports
 )
@@ -81,6 +92,9 @@ func main() {
 		healthAddr              string
 		concurrent              int
 		concurrentSSA           int
+		eventDiffMaxBytes       int
+		eventDiffSecrets        bool
+		concurrentDecryptions   int
 		requeueDependency       time.Duration
 		clientOptions           runtimeClient.Options
 		kubeConfigOpts          runtimeClient.KubeConfigOptions
@@ -91,10 +105,29 @@ func main() {
 		intervalJitterOptions   jitter.IntervalOptions
 		aclOptions              acl.Options
 		noRemoteBases           bool
+		allowUnrestrictedLoad   bool
+		noDecryptionPreflight   bool
+		crossNSDecryptionSecret bool
+		substitutionNamespaces  []string
+		defaultDecryptionSecret string
+		ageKeyFiles             []string
+		keyServiceAddrs         []string
+		sopsMaxFileSize         int64
 		httpRetry               int
 		defaultServiceAccount   string
 		featureGates            feathelper.FeatureGates
 		disallowedFieldManagers []string
+		azureCredCacheSize      int
+		azureCredCacheMaxAge    time.Duration
+		azureVaultDNSSuffixes   []string
+		awsKMSEndpoint          string
+		awsSTSEndpoint          string
+		gcpKMSEndpoint          string
+		vaultLoginCacheSize     int
+		vaultLoginCacheMaxAge   time.Duration
+		vaultAddressAllowlist   []string
+		pgpKeyringCacheSize     int
+		gnuPGHomeDir            string
 	)
 
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
@@ -102,11 +135,55 @@ func main() {
 	flag.StringVar(&healthAddr, "health-addr", ":9440", "The address the health endpoint binds to.")
 	flag.IntVar(&concurrent, "concurrent", 4, "The number of concurrent kustomize reconciles.")
 	flag.IntVar(&concurrentSSA, "concurrent-ssa", 4, "The number of concurrent server-side apply operations.")
+	flag.IntVar(&eventDiffMaxBytes, "event-diff-max-bytes", 0,
+		"The maximum size in bytes of the diff of the changed resources attached to the apply events. The diff requires a server-side apply dry-run of each resource before it is applied. A value of 0 disables the diff.")
+	flag.BoolVar(&eventDiffSecrets, "event-diff-secrets", false,
+		"Include the diff of the changed Secrets in the apply events, with their data values masked. By default, only the names of the changed Secrets are reported.")
+	flag.IntVar(&concurrentDecryptions, "concurrent-decryptions", 0,
+		"The maximum number of Kustomizations decrypted concurrently with SOPS, regardless of the number of concurrent reconciles. Reconciles wait for a decryption to complete when reached. A value of 0 disables the limit.")
 	flag.DurationVar(&requeueDependency, "requeue-dependency", 30*time.Second, "The interval at which failing dependencies are reevaluated.")
 	flag.BoolVar(&noRemoteBases, "no-remote-bases", false,
 		"Disallow remote bases usage in Kustomize overlays. When this flag is enabled, all resources must refer to local files included in the source artifact.")
+	flag.BoolVar(&allowUnrestrictedLoad, "allow-load-restrictions-none", false,
+		"Allow Kustomizations to set the kustomize load restrictions to 'None', to load files from outside of the directory of the kustomization.yaml within the source artifact.")
+	flag.BoolVar(&noDecryptionPreflight, "no-decryption-preflight", false,
+		"Disable the check for the availability of the age and OpenPGP keys of SOPS encrypted files before their decryption.")
+	flag.BoolVar(&crossNSDecryptionSecret, "allow-cross-namespace-decryption-secret", false,
+		"Allow the decryption Secret of a Kustomization to be referenced from another namespace than the one of the Kustomization.")
+	flag.StringSliceVar(&substitutionNamespaces, "allowed-substitution-namespaces", nil,
+		"The namespaces from which the post build substitutions of a Kustomization may load ConfigMaps and Secrets, in addition to the namespace of the Kustomization, e.g. 'flux-system'.")
+	flag.StringVar(&defaultDecryptionSecret, "default-decryption-secret", "",
+		"The decryption Secret used for Kustomizations with the SOPS decryption provider without a secretRef, in the form of '<namespace>/<name>', or '<name>' for a Secret in the namespace of the Kustomization.")
 	flag.IntVar(&httpRetry, "http-retry", 9, "The maximum number of retries when failing to fetch artifacts over HTTP.")
 	flag.StringVar(&defaultServiceAccount, "default-service-account", "", "Default service account used for impersonation.")
+	flag.IntVar(&azureCredCacheSize, "azure-credential-cache-size", 100,
+		"The maximum number of Azure Key Vault credentials to cache across reconciliations. A value of 0 disables the cache.")
+	flag.DurationVar(&azureCredCacheMaxAge, "azure-credential-cache-max-age", time.Hour,
+		"The maximum duration an Azure Key Vault credential is cached. A value of 0 disables the expiration.")
+	flag.StringSliceVar(&azureVaultDNSSuffixes, "azure-vault-dns-suffixes", nil,
+		"The DNS suffixes of Azure Key Vaults allowed in addition to the ones of the Azure clouds, e.g. 'privatelink.vaultcore.azure.net'.")
+	flag.StringVar(&awsKMSEndpoint, "aws-kms-endpoint", "",
+		"The URL of the AWS KMS endpoint used for SOPS decryption, e.g. a FIPS or VPC interface endpoint. Can be overridden in the decryption Secret.")
+	flag.StringVar(&awsSTSEndpoint, "aws-sts-endpoint", "",
+		"The URL of the AWS STS endpoint used to assume roles for SOPS decryption, e.g. a FIPS or VPC interface endpoint. Can be overridden in the decryption Secret.")
+	flag.StringVar(&gcpKMSEndpoint, "gcp-kms-endpoint", "",
+		"The host and optional port of the GCP KMS endpoint used for SOPS decryption, e.g. 'cloudkms.restricted.googleapis.com:443'. Can be overridden in the decryption Secret.")
+	flag.IntVar(&vaultLoginCacheSize, "vault-login-cache-size", 100,
+		"The maximum number of Hashicorp Vault logins to cache across reconciliations. A value of 0 disables the cache.")
+	flag.DurationVar(&vaultLoginCacheMaxAge, "vault-login-cache-max-age", 24*time.Hour,
+		"The maximum duration a Hashicorp Vault login is cached, after which a new login is performed. A value of 0 disables the expiration.")
+	flag.IntVar(&pgpKeyringCacheSize, "pgp-keyring-cache-size", 100,
+		"The maximum number of GnuPG keyrings with the PGP keys of decryption Secrets to cache across reconciliations. A value of 0 disables the cache.")
+	flag.StringVar(&gnuPGHomeDir, "sops-gnupg-home-dir", "",
+		"The directory in which the temporary GnuPG home directories for the import of PGP keys are created, e.g. a memory-backed volume. Defaults to the directory for temporary files.")
+	flag.StringArrayVar(&ageKeyFiles, "sops-age-key-file", nil,
+		"The path of a file with age identities used for the decryption of the SOPS encrypted files of every Kustomization, after the identities of the decryption Secret. The file is read again when it changes. Can be specified multiple times.")
+	flag.StringArrayVar(&keyServiceAddrs, "sops-keyservice-addr", nil,
+		"The address of a remote SOPS key service to which the decryption of data keys is forwarded when the local keys can't decrypt them, e.g. 'unix:///var/run/sops-ks.sock' or 'tcp://localhost:5000'. Can be specified multiple times.")
+	flag.Int64Var(&sopsMaxFileSize, "sops-max-file-size", decryptor.DefaultMaxEncryptedFileSize,
+		"The maximum size in bytes of a SOPS encrypted file to be decrypted. Larger encrypted files fail the build of the Kustomization before they are read. A value of 0 disables the limit.")
+	flag.StringSliceVar(&vaultAddressAllowlist, "sops-vault-address-allowlist", nil,
+		"The Hashicorp Vault addresses SOPS documents may be decrypted with, e.g. 'https://vault.example.com:8200'. When empty, any address is allowed.")
 	flag.StringArrayVar(&disallowedFieldManagers, "override-manager", []string{}, "Field manager disallowed to perform changes on managed resources.")
 
 	clientOptions.BindFlags(flag.CommandLine)
@@ -135,6 +212,75 @@ func main() {
 		os.Exit(1)
 	}
 
+	for flagName, endpoint := range map[string]string{
+		"aws-kms-endpoint": awsKMSEndpoint,
+		"aws-sts-endpoint": awsSTSEndpoint,
+	} {
+		if err := intawskms.ValidateEndpoint(endpoint); err != nil {
+			setupLog.Error(err, "invalid --"+flagName+" flag")
+			os.Exit(1)
+		}
+	}
+	if err := intgcpkms.ValidateEndpoint(gcpKMSEndpoint); err != nil {
+		setupLog.Error(err, "invalid --gcp-kms-endpoint flag")
+		os.Exit(1)
+	}
+	for _, address := range vaultAddressAllowlist {
+		if _, err := inthcvault.ParseAddress(address); err != nil {
+			setupLog.Error(err, "invalid --sops-vault-address-allowlist flag")
+			os.Exit(1)
+		}
+	}
+	if eventDiffMaxBytes < 0 {
+		setupLog.Error(fmt.Errorf("%d is negative", eventDiffMaxBytes), "invalid --event-diff-max-bytes flag")
+		os.Exit(1)
+	}
+	if concurrentDecryptions < 0 {
+		setupLog.Error(fmt.Errorf("%d is negative", concurrentDecryptions), "invalid --concurrent-decryptions flag")
+		os.Exit(1)
+	}
+	if sopsMaxFileSize < 0 {
+		setupLog.Error(fmt.Errorf("%d is negative", sopsMaxFileSize), "invalid --sops-max-file-size flag")
+		os.Exit(1)
+	}
+	if gnuPGHomeDir != "" {
+		if info, err := os.Stat(gnuPGHomeDir); err != nil || !info.IsDir() {
+			setupLog.Error(fmt.Errorf("'%s' is not a directory", gnuPGHomeDir), "invalid --sops-gnupg-home-dir flag")
+			os.Exit(1)
+		}
+	}
+	var ageIdentityFiles []*intage.IdentityFile
+	for _, path := range ageKeyFiles {
+		f := intage.NewIdentityFile(path)
+		if _, err := f.Identities(); err != nil {
+			setupLog.Error(err, "invalid --sops-age-key-file flag")
+			os.Exit(1)
+		}
+		ageIdentityFiles = append(ageIdentityFiles, f)
+	}
+	var remoteKeyServices []keyservice.KeyServiceClient
+	for _, address := range keyServiceAddrs {
+		c, err := intkeyservice.NewRemoteClient(address)
+		if err != nil {
+			setupLog.Error(err, "invalid --sops-keyservice-addr flag")
+			os.Exit(1)
+		}
+		defer c.Close()
+		remoteKeyServices = append(remoteKeyServices, c)
+		setupLog.Info("forwarding SOPS data key decryption to remote key service", "address", address)
+	}
+	var defaultDecryptionRef *meta.NamespacedObjectReference
+	if defaultDecryptionSecret != "" {
+		ref, err := decryptor.ParseSecretReference(defaultDecryptionSecret)
+		if err != nil {
+			setupLog.Error(err, "invalid --default-decryption-secret flag")
+			os.Exit(1)
+		}
+		defaultDecryptionRef = ref
+		setupLog.Info("using default SOPS decryption Secret for Kustomizations without a decryption secretRef",
+			"secret", defaultDecryptionSecret)
+	}
+
 	watchNamespace := ""
 	if !watchOptions.AllNamespaces {
 		watchNamespace = os.Getenv("RUNTIME_NAMESPACE")
@@ -240,6 +386,36 @@ func main() {
 		os.Exit(1)
 	}
 
+	var azureCredCache *intazkv.CredentialCache
+	if azureCredCacheSize > 0 {
+		azureCredCache = intazkv.NewCredentialCache(azureCredCacheSize, azureCredCacheMaxAge)
+		azureCredCache.MustRegister(ctrlmetrics.Registry)
+	}
+
+	azureTokenMetrics := intazkv.NewTokenMetrics()
+	azureTokenMetrics.MustRegister(ctrlmetrics.Registry)
+
+	var vaultLoginCache *inthcvault.LoginCache
+	if vaultLoginCacheSize > 0 {
+		vaultLoginCache = inthcvault.NewLoginCache(vaultLoginCacheSize, vaultLoginCacheMaxAge)
+		vaultLoginCache.MustRegister(ctrlmetrics.Registry)
+	}
+
+	decryptionMetrics := decryptor.NewMetrics()
+	decryptionMetrics.MustRegister(ctrlmetrics.Registry)
+
+	var decryptionLimiter *decryptor.Limiter
+	if concurrentDecryptions > 0 {
+		decryptionLimiter = decryptor.NewLimiter(concurrentDecryptions)
+		decryptionLimiter.MustRegister(ctrlmetrics.Registry)
+	}
+
+	var pgpKeyringCache *intpgp.KeyringCache
+	if pgpKeyringCacheSize > 0 {
+		pgpKeyringCache = intpgp.NewKeyringCache(pgpKeyringCacheSize, gnuPGHomeDir)
+		pgpKeyringCache.MustRegister(ctrlmetrics.Registry)
+	}
+
 	if err = (&controller.KustomizationReconciler{
 		ControllerName:          controllerName,
 		DefaultServiceAccount:   defaultServiceAccount,
@@ -250,14 +426,36 @@ func main() {
 		EventRecorder:           eventRecorder,
 		NoCrossNamespaceRefs:    aclOptions.NoCrossNamespaceRefs,
 		NoRemoteBases:           noRemoteBases,
+		AllowUnrestrictedLoad:   allowUnrestrictedLoad,
+		NoDecryptionPreflight:   noDecryptionPreflight,
+		CrossNSDecryptionSecret: crossNSDecryptionSecret,
+		SubstitutionNamespaces:  substitutionNamespaces,
+		DefaultDecryptionSecret: defaultDecryptionRef,
+		AgeKeyFiles:             ageIdentityFiles,
+		RemoteKeyServices:       remoteKeyServices,
+		SOPSMaxFileSize:         sopsMaxFileSize,
 		FailFast:                failFast,
 		ConcurrentSSA:           concurrentSSA,
+		EventDiffMaxBytes:       eventDiffMaxBytes,
+		EventDiffSecrets:        eventDiffSecrets,
 		KubeConfigOpts:          kubeConfigOpts,
 		PollingOpts:             pollingOpts,
 		StatusPoller:            polling.NewStatusPoller(mgr.GetClient(), mgr.GetRESTMapper(), pollingOpts),
 		DisallowedFieldManagers: disallowedFieldManagers,
 		StrictSubstitutions:     strictSubstitutions,
 		GroupChangeLog:          groupChangeLog,
+		AzureCredentialCache:    azureCredCache,
+		AzureVaultDNSSuffixes:   azureVaultDNSSuffixes,
+		AzureTokenMetrics:       azureTokenMetrics,
+		AWSKMSEndpoint:          awsKMSEndpoint,
+		AWSSTSEndpoint:          awsSTSEndpoint,
+		GCPKMSEndpoint:          gcpKMSEndpoint,
+		VaultLoginCache:         vaultLoginCache,
+		VaultAddressAllowlist:   vaultAddressAllowlist,
+		PGPKeyringCache:         pgpKeyringCache,
+		GnuPGHomeDir:            gnuPGHomeDir,
+		DecryptionMetrics:       decryptionMetrics,
+		DecryptionLimiter:       decryptionLimiter,
 	}).SetupWithManager(ctx, mgr, controller.KustomizationReconcilerOptions{
 		DependencyRequeueInterval: requeueDependency,
 		HTTPRetry:                 httpRetry,